@@ -0,0 +1,79 @@
+// Tox bootstrap node daemon, runs DHT, onion and TCP relay like tox-bootstrapd,
+// reads the same config file and keys file.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/oksbsb/go-toxcore/mintox"
+)
+
+var (
+	cfgfile    = flag.String("config", "", "config file path")
+	foreground = flag.Bool("foreground", false, "run in foreground, always the case, use a service manager to daemonize")
+	logbackend = flag.String("log-backend", "syslog", "syslog or stdout")
+	version    = flag.Bool("version", false, "print version and exit")
+)
+
+func main() {
+	flag.Parse()
+	if *version {
+		fmt.Println("Version:", mintox.BOOTSTRAPD_VERSION)
+		return
+	}
+	if *cfgfile == "" {
+		fmt.Fprintln(os.Stderr, "Error: --config is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch *logbackend {
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	case "syslog":
+		if err := setSyslogOutput(); err != nil {
+			log.Println("Syslog not available, use stdout:", err)
+			log.SetOutput(os.Stdout)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Error: invalid --log-backend:", *logbackend)
+		os.Exit(1)
+	}
+	log.Println("Running mintox-bootstrapd version", mintox.BOOTSTRAPD_VERSION)
+
+	cfg, err := mintox.LoadBootstrapdConfig(*cfgfile)
+	if err != nil {
+		log.Fatalln("Load config:", err)
+	}
+	if cfg.PidFilePath != "" {
+		if _, err := os.Stat(cfg.PidFilePath); err == nil {
+			log.Println("Another instance may be running, pid file exists:", cfg.PidFilePath)
+		}
+		err := ioutil.WriteFile(cfg.PidFilePath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+		if err != nil {
+			log.Fatalln("Write pid file:", err)
+		}
+		defer os.Remove(cfg.PidFilePath)
+	}
+
+	node, err := mintox.NewBootstrapNodeFromConfig(cfg)
+	if err != nil {
+		log.Fatalln("Create node:", err)
+	}
+	if err := node.Start(); err != nil {
+		log.Fatalln("Start node:", err)
+	}
+	log.Println("Public key:", node.Pubkey().ToHex())
+	log.Println("UDP:", node.UDPAddr(), "TCP:", node.TCPAddrs())
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigC
+	log.Println("Received signal, shutdown:", sig)
+	node.Kill()
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+func setSyslogOutput() error { return errors.New("no syslog on this platform") }
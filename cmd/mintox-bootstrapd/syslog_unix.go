@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log"
+	"log/syslog"
+)
+
+func setSyslogOutput() error {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "mintox-bootstrapd")
+	if err != nil {
+		return err
+	}
+	log.SetOutput(w)
+	log.SetFlags(0)
+	return nil
+}
@@ -0,0 +1,70 @@
+// Generate, save and print relay/DHT keypairs, the keys file is the same as
+// of tox-bootstrapd, usable as keys_file_path of mintox-bootstrapd.
+//
+//	mintox-keygen -out /var/lib/tox-bootstrapd/keys
+//	mintox-keygen -in /var/lib/tox-bootstrapd/keys -format base64 -secret
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/oksbsb/go-toxcore/mintox"
+)
+
+var (
+	infile  = flag.String("in", "", "print keys of existing keys file, no new keys")
+	outfile = flag.String("out", "", "save new keys to keys file, print only if empty")
+	force   = flag.Bool("force", false, "overwrite existing -out file")
+	format  = flag.String("format", "hex", "hex or base64")
+	secret  = flag.Bool("secret", false, "also print secret key")
+)
+
+func main() {
+	flag.Parse()
+	if *infile != "" && *outfile != "" {
+		fatal("-in and -out can not be used together")
+	}
+	encode, ok := map[string]func([]byte) string{
+		"hex":    func(b []byte) string { return strings.ToUpper(hex.EncodeToString(b)) },
+		"base64": base64.StdEncoding.EncodeToString,
+	}[*format]
+	if !ok {
+		fatal("invalid -format:", *format)
+	}
+
+	var kf *mintox.KeyFile
+	var err error
+	switch {
+	case *infile != "":
+		kf, err = mintox.ReadKeyFile(*infile)
+	case *outfile != "":
+		if kf, err = mintox.NewKeyFile(); err != nil {
+			break
+		}
+		if *force {
+			err = kf.Save(*outfile)
+		} else {
+			err = kf.SaveNew(*outfile)
+		}
+	default:
+		kf, err = mintox.NewKeyFile()
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Println("Public key:", encode(kf.Pubkey.Bytes()))
+	if *secret || (*infile == "" && *outfile == "") {
+		fmt.Println("Secret key:", encode(kf.Seckey.Bytes()))
+	}
+}
+
+func fatal(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, append([]interface{}{"Error:"}, args...)...)
+	os.Exit(1)
+}
@@ -1,9 +1,12 @@
 package mintox
 
 import (
+	"bytes"
 	"encoding/binary"
-	"gopp"
 	"net"
+	"sync"
+
+	"github.com/pkg/errors"
 )
 
 const MAX_MOTD_LENGTH = 256 /* I recommend you use a maximum of 96 bytes. The hard maximum is this though. */
@@ -14,25 +17,124 @@ type BootstrapInfo struct {
 	Motd    string
 }
 
-func (this *NetworkCore) handleInfoRequest(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
-	pktlen := 1 + 4 + len(this.bsinfo.Motd)
-	buf := gopp.NewBufferBuf([]byte(gopp.RandStrHex(pktlen)))
-	buf.WBufAt(0).WriteByte(BOOTSTRAP_INFO_PACKET_ID)
-	binary.Write(buf.WBufAt(1), binary.BigEndian, this.bsinfo.Version)
-	buf.WBufAt(1 + 4).Write([]byte(this.bsinfo.Motd))
+// like bootstrap_info response: [BOOTSTRAP_INFO_PACKET_ID][version][motd]
+func ParseBootstrapInfo(data []byte) (*BootstrapInfo, error) {
+	if len(data) < 1+4 || len(data) > 1+4+MAX_MOTD_LENGTH || data[0] != BOOTSTRAP_INFO_PACKET_ID {
+		return nil, errors.Errorf("Invalid bootstrap info length: %d", len(data))
+	}
+	return &BootstrapInfo{binary.BigEndian.Uint32(data[1:]), string(data[1+4:])}, nil
+}
 
-	gopp.Assert(buf.Len() == pktlen, "buf error")
-	return this.srv.WriteTo(buf.Bytes(), addr)
+// info request on a TCP relay conn, in place of the handshake. Zero padded,
+// so never confused with a handshake which begins with a public key.
+func NewBootstrapInfoRequest() []byte {
+	req := make([]byte, INFO_REQUEST_PACKET_LENGTH)
+	req[0] = BOOTSTRAP_INFO_PACKET_ID
+	return req
 }
 
-func (this *NetworkCore) BootstrapSetCallback(version uint32, motd string) bool {
+func isTCPBootstrapInfoRequest(data []byte) bool {
+	return bytes.Equal(data, NewBootstrapInfoRequest())
+}
+
+// version and motd answered to info requests, shared by UDP and TCP listeners
+type bootstrapInfoHolder struct {
+	mu     sync.RWMutex
+	on     bool
+	info   BootstrapInfo
+	motdfn func() string // dynamic motd, overrides info.Motd
+}
+
+func (this *bootstrapInfoHolder) set(version uint32, motd string) error {
 	if len(motd) > MAX_MOTD_LENGTH {
-		return false
+		return errors.Errorf("motd too long: %d", len(motd))
 	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.on = true
+	this.info = BootstrapInfo{version, motd}
+	return nil
+}
+
+func (this *bootstrapInfoHolder) setMotd(motd string) error {
+	this.mu.RLock()
+	version := this.info.Version
+	this.mu.RUnlock()
+	if version == 0 {
+		version = BOOTSTRAPD_VERSION
+	}
+	return this.set(version, motd)
+}
+
+func (this *bootstrapInfoHolder) setMotdFunc(fn func() string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.motdfn = fn
+	if fn != nil && this.info.Version == 0 {
+		this.info.Version = BOOTSTRAPD_VERSION
+	}
+	this.on = this.on || fn != nil
+}
 
-	this.bsinfo.Version = version
-	this.bsinfo.Motd = motd
+func (this *bootstrapInfoHolder) enabled() bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.on
+}
+
+// nil if not enabled, generated motd cut to MAX_MOTD_LENGTH
+func (this *bootstrapInfoHolder) response() []byte {
+	this.mu.RLock()
+	on, info, motdfn := this.on, this.info, this.motdfn
+	this.mu.RUnlock()
+	if !on {
+		return nil
+	}
+	if motdfn != nil {
+		info.Motd = motdfn()
+	}
+	if len(info.Motd) > MAX_MOTD_LENGTH {
+		info.Motd = info.Motd[:MAX_MOTD_LENGTH]
+	}
+	buf := make([]byte, 1+4, 1+4+len(info.Motd))
+	buf[0] = BOOTSTRAP_INFO_PACKET_ID
+	binary.BigEndian.PutUint32(buf[1:], info.Version)
+	return append(buf, info.Motd...)
+}
+
+func (this *NetworkCore) handleInfoRequest(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) != INFO_REQUEST_PACKET_LENGTH {
+		return 1, errors.Errorf("Invalid info request length: %d", len(data))
+	}
+	pkt := this.bsinfo.response()
+	if pkt == nil {
+		return 1, errors.New("Bootstrap info not enabled")
+	}
+	return this.srv.WriteTo(pkt, addr)
+}
+
+func (this *NetworkCore) BootstrapSetCallback(version uint32, motd string) bool {
+	if this.bsinfo.set(version, motd) != nil {
+		return false
+	}
 
 	this.RegisterHandle(BOOTSTRAP_INFO_PACKET_ID, this.handleInfoRequest, this)
 	return true
 }
+
+// answer info requests with motd, version of BootstrapSetCallback or BOOTSTRAPD_VERSION
+func (this *NetworkCore) SetMOTD(motd string) error {
+	if err := this.bsinfo.setMotd(motd); err != nil {
+		return err
+	}
+	this.RegisterHandle(BOOTSTRAP_INFO_PACKET_ID, this.handleInfoRequest, this)
+	return nil
+}
+
+// fn called for every info request, so keep it cheap. nil back to the static motd
+func (this *NetworkCore) SetMOTDFunc(fn func() string) {
+	this.bsinfo.setMotdFunc(fn)
+	if fn != nil {
+		this.RegisterHandle(BOOTSTRAP_INFO_PACKET_ID, this.handleInfoRequest, this)
+	}
+}
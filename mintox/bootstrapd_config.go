@@ -0,0 +1,354 @@
+package mintox
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// version in bootstrap info response, like DAEMON_VERSION_NUMBER of tox-bootstrapd
+const BOOTSTRAPD_VERSION = 2018090100
+
+// Config of bootstrap node, same file and keys as tox-bootstrapd.conf,
+// so an existing tox-bootstrapd setup works unchanged.
+type BootstrapdConfig struct {
+	Port         uint16 // udp, 0 for any free port
+	KeysFilePath string
+	PidFilePath  string
+
+	EnableIPv6         bool
+	EnableIPv4Fallback bool // udp ipv4 when ipv6 failed
+	EnableLanDiscovery bool // not supported yet, only warned
+
+	EnableTCPRelay bool
+	TCPRelayPorts  []uint16
+
+	EnableMotd bool
+	Motd       string
+
+	BootstrapNodes []BootstrapdNode
+}
+
+type BootstrapdNode struct {
+	Address   string
+	Port      uint16
+	PublicKey string // hex
+}
+
+// defaults of tox-bootstrapd
+func DefaultBootstrapdConfig() *BootstrapdConfig {
+	cfg := &BootstrapdConfig{}
+	cfg.Port = 33445
+	cfg.KeysFilePath = "keys"
+	cfg.PidFilePath = "tox-bootstrapd.pid"
+	cfg.EnableIPv6 = true
+	cfg.EnableIPv4Fallback = true
+	cfg.EnableLanDiscovery = true
+	cfg.EnableTCPRelay = true
+	cfg.TCPRelayPorts = []uint16{443, 3389, 33445}
+	cfg.EnableMotd = true
+	cfg.Motd = "tox-bootstrapd"
+	return cfg
+}
+
+func LoadBootstrapdConfig(filename string) (*BootstrapdConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	cfg, err := ParseBootstrapdConfig(data)
+	return cfg, errors.Wrap(err, filename)
+}
+
+// defaults for settings not in data, unknown settings ignored
+func ParseBootstrapdConfig(data []byte) (*BootstrapdConfig, error) {
+	root, err := parseLibconfig(data)
+	if err != nil {
+		return nil, err
+	}
+	cfg := DefaultBootstrapdConfig()
+	ints := map[string]*uint16{"port": &cfg.Port}
+	strs := map[string]*string{"keys_file_path": &cfg.KeysFilePath, "pid_file_path": &cfg.PidFilePath, "motd": &cfg.Motd}
+	bools := map[string]*bool{"enable_ipv6": &cfg.EnableIPv6, "enable_ipv4_fallback": &cfg.EnableIPv4Fallback,
+		"enable_lan_discovery": &cfg.EnableLanDiscovery, "enable_tcp_relay": &cfg.EnableTCPRelay,
+		"enable_motd": &cfg.EnableMotd}
+	for name, v := range root {
+		var ok bool
+		switch {
+		case ints[name] != nil:
+			*ints[name], ok = libconfigPort(v)
+		case strs[name] != nil:
+			*strs[name], ok = v.(string)
+		case bools[name] != nil:
+			*bools[name], ok = v.(bool)
+		case name == "tcp_relay_ports":
+			cfg.TCPRelayPorts, ok = nil, true
+			vs, _ := v.([]interface{})
+			for _, pv := range vs {
+				port, pok := libconfigPort(pv)
+				ok = ok && pok
+				cfg.TCPRelayPorts = append(cfg.TCPRelayPorts, port)
+			}
+		case name == "bootstrap_nodes":
+			cfg.BootstrapNodes, ok = nil, true
+			vs, _ := v.([]interface{})
+			for _, nv := range vs {
+				grp, _ := nv.(map[string]interface{})
+				node := BootstrapdNode{}
+				aok, pkok := false, false
+				node.Address, aok = grp["address"].(string)
+				node.PublicKey, pkok = grp["public_key"].(string)
+				port, pok := libconfigPort(grp["port"])
+				node.Port = port
+				ok = ok && aok && pkok && pok
+				cfg.BootstrapNodes = append(cfg.BootstrapNodes, node)
+			}
+		default:
+			ok = true
+		}
+		if !ok {
+			return nil, errors.Errorf("invalid setting type: %s", name)
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+func libconfigPort(v interface{}) (uint16, bool) {
+	n, ok := v.(int64)
+	if !ok || n < 0 || n > 65535 {
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+func (this *BootstrapdConfig) Validate() error {
+	if this.KeysFilePath == "" {
+		return errors.New("empty keys_file_path")
+	}
+	if this.EnableMotd && len(this.Motd)+1 > MAX_MOTD_LENGTH {
+		return errors.Errorf("motd too long: %d", len(this.Motd))
+	}
+	if this.EnableTCPRelay && len(this.TCPRelayPorts) == 0 {
+		return errors.New("tcp relay enabled without tcp_relay_ports")
+	}
+	for i, node := range this.BootstrapNodes {
+		pk, err := hex.DecodeString(node.PublicKey)
+		if err != nil || len(pk) != PUBLIC_KEY_SIZE {
+			return errors.Errorf("invalid public_key of bootstrap node %d: %s", i, node.PublicKey)
+		}
+		if node.Address == "" || node.Port == 0 {
+			return errors.Errorf("invalid address of bootstrap node %d: %s:%d", i, node.Address, node.Port)
+		}
+	}
+	return nil
+}
+
+func (this *BootstrapdNode) Addr() string {
+	return net.JoinHostPort(this.Address, strconv.Itoa(int(this.Port)))
+}
+
+// Subset of libconfig used by tox-bootstrapd.conf: settings of scalar, array,
+// list and group, # // /* */ comments. Values are int64, float64, bool, string,
+// []interface{} for array and list, map[string]interface{} for group.
+func parseLibconfig(data []byte) (map[string]interface{}, error) {
+	p := &libconfigParser{s: string(data), line: 1}
+	grp, err := p.settings(false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "line %d", p.line)
+	}
+	return grp, nil
+}
+
+type libconfigParser struct {
+	s    string
+	pos  int
+	line int
+}
+
+// skip spaces and comments
+func (this *libconfigParser) skip() {
+	for this.pos < len(this.s) {
+		rest := this.s[this.pos:]
+		switch {
+		case rest[0] == '\n':
+			this.line++
+			this.pos++
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\r':
+			this.pos++
+		case rest[0] == '#' || strings.HasPrefix(rest, "//"):
+			if i := strings.IndexByte(rest, '\n'); i >= 0 {
+				this.pos += i
+			} else {
+				this.pos = len(this.s)
+			}
+		case strings.HasPrefix(rest, "/*"):
+			i := strings.Index(rest[2:], "*/")
+			if i < 0 {
+				i = len(rest) - 4
+			}
+			this.line += strings.Count(rest[:i+2], "\n")
+			this.pos += i + 4
+		default:
+			return
+		}
+	}
+}
+
+func (this *libconfigParser) peek() byte {
+	this.skip()
+	if this.pos >= len(this.s) {
+		return 0
+	}
+	return this.s[this.pos]
+}
+
+func isLibconfigNameChar(c byte) bool {
+	return c == '_' || c == '-' || c == '*' || (c >= '0' && c <= '9') ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// name = value; ... until eof or } of group
+func (this *libconfigParser) settings(ingroup bool) (map[string]interface{}, error) {
+	grp := map[string]interface{}{}
+	for {
+		c := this.peek()
+		if c == 0 || (ingroup && c == '}') {
+			if ingroup && c == 0 {
+				return nil, errors.New("unterminated group")
+			}
+			return grp, nil
+		}
+		begin := this.pos
+		for this.pos < len(this.s) && isLibconfigNameChar(this.s[this.pos]) {
+			this.pos++
+		}
+		name := this.s[begin:this.pos]
+		if name == "" {
+			return nil, errors.Errorf("invalid setting name at %q", c)
+		}
+		if c = this.peek(); c != '=' && c != ':' {
+			return nil, errors.Errorf("missing = after %s", name)
+		}
+		this.pos++
+		v, err := this.value()
+		if err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		grp[name] = v
+		if c = this.peek(); c == ';' || c == ',' {
+			this.pos++
+		}
+	}
+}
+
+func (this *libconfigParser) value() (interface{}, error) {
+	switch c := this.peek(); c {
+	case '"':
+		var sb strings.Builder
+		for this.peek() == '"' { // adjacent strings concatenated
+			str, err := this.str()
+			if err != nil {
+				return nil, err
+			}
+			sb.WriteString(str)
+		}
+		return sb.String(), nil
+	case '{':
+		this.pos++
+		grp, err := this.settings(true)
+		if err != nil {
+			return nil, err
+		}
+		this.pos++
+		return grp, nil
+	case '[', '(':
+		this.pos++
+		end := map[byte]byte{'[': ']', '(': ')'}[c]
+		vs := []interface{}{}
+		for {
+			if this.peek() == end {
+				this.pos++
+				return vs, nil
+			}
+			v, err := this.value()
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, v)
+			if c := this.peek(); c == ',' {
+				this.pos++
+			} else if c != end {
+				return nil, errors.Errorf("missing %c", end)
+			}
+		}
+	case 0:
+		return nil, errors.New("missing value")
+	}
+	begin := this.pos
+	for this.pos < len(this.s) && (isLibconfigNameChar(this.s[this.pos]) || strings.IndexByte(".+", this.s[this.pos]) >= 0) {
+		this.pos++
+	}
+	tok := this.s[begin:this.pos]
+	switch strings.ToLower(tok) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if n, err := strconv.ParseInt(strings.TrimRight(tok, "L"), 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(tok, 64); err == nil {
+		return f, nil
+	}
+	return nil, errors.Errorf("invalid value: %q", tok)
+}
+
+func (this *libconfigParser) str() (string, error) {
+	var sb strings.Builder
+	this.pos++ // "
+	for this.pos < len(this.s) {
+		c := this.s[this.pos]
+		this.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\n':
+			return "", errors.New("newline in string")
+		case '\\':
+			if this.pos >= len(this.s) {
+				break
+			}
+			e := this.s[this.pos]
+			this.pos++
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'x':
+				if this.pos+2 <= len(this.s) {
+					if b, err := strconv.ParseUint(this.s[this.pos:this.pos+2], 16, 8); err == nil {
+						sb.WriteByte(byte(b))
+						this.pos += 2
+						continue
+					}
+				}
+				return "", errors.New("invalid \\x escape")
+			default:
+				sb.WriteByte(e)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated string")
+}
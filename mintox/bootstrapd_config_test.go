@@ -0,0 +1,69 @@
+package mintox
+
+import "testing"
+
+const tstBootstrapdConf = `
+// comment
+port = 33446
+keys_file_path = "/tmp/keys" # trailing comment
+/* multi
+   line */
+enable_ipv6 = false;
+enable_lan_discovery = FALSE
+tcp_relay_ports = [443, 0x0D3D]
+motd = "hello " "\"world\"\n"
+unknown_group = { a = 1.5; b = (1, "x") }
+bootstrap_nodes = (
+  { // node
+    address = "127.0.0.1"
+    port = 33445
+    public_key = "0FB96EEBFB1650DDB52E70CF773DDFCABE25A95CC3BB50FC251082E4B63EF82A"
+  },
+  {
+    address = "::1"
+    port = 33445L
+    public_key = "AF66C5FFAA6CA67FB8E287A5B1D8581C15B446E12BF330963EF29E3AFB692918"
+  }
+)
+`
+
+func TestBootstrapdConfigParse(t *testing.T) {
+	cfg, err := ParseBootstrapdConfig([]byte(tstBootstrapdConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 33446 || cfg.KeysFilePath != "/tmp/keys" || cfg.EnableIPv6 || cfg.EnableLanDiscovery {
+		t.Error("config not parsed:", cfg)
+	}
+	if !cfg.EnableTCPRelay || !cfg.EnableIPv4Fallback || cfg.PidFilePath != "tox-bootstrapd.pid" {
+		t.Error("default not kept:", cfg)
+	}
+	if len(cfg.TCPRelayPorts) != 2 || cfg.TCPRelayPorts[1] != 3389 {
+		t.Error("tcp ports:", cfg.TCPRelayPorts)
+	}
+	if cfg.Motd != "hello \"world\"\n" {
+		t.Errorf("motd: %q", cfg.Motd)
+	}
+	if len(cfg.BootstrapNodes) != 2 || cfg.BootstrapNodes[1].Addr() != "[::1]:33445" {
+		t.Error("bootstrap nodes:", cfg.BootstrapNodes)
+	}
+
+	if _, err := LoadBootstrapdConfig("../cmd/mintox-bootstrapd/tox-bootstrapd.conf"); err != nil {
+		t.Error("sample config:", err)
+	}
+
+	for _, bad := range []string{
+		`port = 70000`,
+		`port = "1"`,
+		`motd = "unterminated`,
+		`tcp_relay_ports = [1, 2`,
+		`enable_tcp_relay = true; tcp_relay_ports = []`,
+		`bootstrap_nodes = ({ address = "1.2.3.4"; port = 1; public_key = "ABCD" })`,
+		`g = { a = 1`,
+		`= 1`,
+	} {
+		if _, err := ParseBootstrapdConfig([]byte(bad)); err == nil {
+			t.Error("invalid config accepted:", bad)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package mintox
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Run user callbacks on a bounded set of worker goroutines, off the conn's read goroutine.
+// Callbacks submitted with the same key run in order on the same worker.
+// When the worker's queue is full, block the submitter if block, else drop the callback.
+type CallbackPool struct {
+	workers []chan func()
+	block   bool
+	dropped int64
+
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewCallbackPool(nworkers, qsize int, block bool) *CallbackPool {
+	this := &CallbackPool{}
+	this.block = block
+	for i := 0; i < nworkers; i++ {
+		ch := make(chan func(), qsize)
+		this.workers = append(this.workers, ch)
+		this.wg.Add(1)
+		go this.runWorker(ch)
+	}
+	return this
+}
+
+func (this *CallbackPool) runWorker(ch chan func()) {
+	defer this.wg.Done()
+	for fn := range ch {
+		fn()
+	}
+}
+
+// return false if dropped
+func (this *CallbackPool) Submit(key uint64, fn func()) bool {
+	ch := this.workers[key%uint64(len(this.workers))]
+	if this.block {
+		ch <- fn
+		return true
+	}
+	select {
+	case ch <- fn:
+		return true
+	default:
+		atomic.AddInt64(&this.dropped, 1)
+		return false
+	}
+}
+
+func (this *CallbackPool) Dropped() int64 { return atomic.LoadInt64(&this.dropped) }
+
+// wait queued callbacks done, no Submit after Close
+func (this *CallbackPool) Close() {
+	this.closeOnce.Do(func() {
+		for _, ch := range this.workers {
+			close(ch)
+		}
+	})
+	this.wg.Wait()
+}
+
+// per conn key of CallbackPool
+var cbpoolkeyseq uint64
+
+func nextCallbackKey() uint64 { return atomic.AddUint64(&cbpoolkeyseq, 1) }
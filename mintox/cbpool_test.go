@@ -0,0 +1,63 @@
+package mintox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCallbackPoolOrder(t *testing.T) {
+	pool := NewCallbackPool(4, 1000, true)
+	res := make([][]int, 4) // key 1-3, one worker each
+	for i := 0; i < 300; i++ {
+		key, i := uint64(i%3+1), i
+		pool.Submit(key, func() { res[key] = append(res[key], i) })
+	}
+	pool.Close()
+	for key, seq := range res[1:] {
+		if len(seq) != 100 {
+			t.Fatal("callbacks lost:", key, len(seq))
+		}
+		for j := 1; j < len(seq); j++ {
+			if seq[j] < seq[j-1] {
+				t.Fatal("out of order:", key, seq[j-1], seq[j])
+			}
+		}
+	}
+}
+
+func TestCallbackPoolDrop(t *testing.T) {
+	pool := NewCallbackPool(1, 2, false)
+	release := make(chan bool)
+	btime := time.Now()
+	for i := 0; i < 10; i++ {
+		pool.Submit(1, func() { <-release })
+	}
+	if time.Since(btime) > time.Second {
+		t.Error("submitter blocked by slow callback")
+	}
+	// 1 running + 2 queued
+	if n := pool.Dropped(); n != 7 && n != 8 {
+		t.Error("dropped:", n)
+	}
+	close(release)
+	pool.Close()
+}
+
+func TestClientCallbackPool(t *testing.T) {
+	cli := newTstClient()
+	cli.CallbackPool = NewCallbackPool(2, 16, true)
+	done := make(chan []byte, 1)
+	cli.RoutingDataFunc = func(object Object, number uint32, connid uint8, data []byte, cbdata Object) {
+		time.Sleep(50 * time.Millisecond)
+		done <- data
+	}
+	btime := time.Now()
+	cli.HandleRoutingData([]byte{20, 'h', 'i'})
+	if time.Since(btime) > 40*time.Millisecond {
+		t.Error("callback run on read goroutine")
+	}
+	if data := <-done; string(data) != "hi" {
+		t.Error("data:", string(data))
+	}
+	cli.CallbackPool.Close()
+}
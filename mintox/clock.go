@@ -0,0 +1,20 @@
+package mintox
+
+import "time"
+
+// time source of keepalive, replaced by a fake one in test
+type clock interface {
+	Now() time.Time
+	// like time.NewTicker, call stop when done
+	Tick(d time.Duration) (c <-chan time.Time, stop func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+func (realClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	tick := time.NewTicker(d)
+	return tick.C, tick.Stop
+}
+
+var defaultClock clock = realClock{}
@@ -0,0 +1,796 @@
+package mintox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopp"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const GROUP_ID_LENGTH = 32
+
+const (
+	GROUPCHAT_TYPE_TEXT = 0
+	GROUPCHAT_TYPE_AV   = 1
+)
+
+/* Max close connections of a conference, friends invited us or we invited. */
+const MAX_GROUP_CONNECTIONS = 16
+
+/* Seconds between pings, peers not heard for GROUP_PING_INTERVAL * 3 are removed. */
+const GROUP_PING_INTERVAL = 20
+
+/* Data of invite packets after PACKET_ID_INVITE_CONFERENCE */
+const INVITE_ID = 0
+const INVITE_PACKET_SIZE = (1 + 2 + 1 + GROUP_ID_LENGTH)
+const INVITE_RESPONSE_ID = 1
+const INVITE_RESPONSE_PACKET_SIZE = (1 + 2*2 + 1 + GROUP_ID_LENGTH)
+
+/* Direct packets to close connection, after PACKET_ID_DIRECT_CONFERENCE and groupnum. */
+const (
+	PEER_KILL_ID     = 1
+	PEER_QUERY_ID    = 8
+	PEER_RESPONSE_ID = 9
+	PEER_TITLE_ID    = 10
+)
+
+/* Messages relayed to all peers, after PACKET_ID_MESSAGE_CONFERENCE and groupnum | peernum | msgnum. */
+const (
+	GROUP_MESSAGE_PING_ID      = 0
+	GROUP_MESSAGE_NEW_PEER_ID  = 16
+	GROUP_MESSAGE_KILL_PEER_ID = 17
+	GROUP_MESSAGE_NAME_ID      = 48
+	GROUP_MESSAGE_TITLE_ID     = 49
+)
+
+/* groupnum | peernum | msgnum | message id */
+const GROUP_MESSAGE_HEADER_SIZE = (2 + 2 + 4 + 1)
+const MAX_GROUP_MESSAGE_DATA_LEN = (MAX_CRYPTO_DATA_SIZE - 1 - GROUP_MESSAGE_HEADER_SIZE)
+
+type confPeer struct {
+	Pubkey     *CryptoKey
+	DhtPubkey  *CryptoKey
+	Name       []byte
+	peernum    uint16
+	lastRecv   time.Time
+	lastMsgnum uint32
+}
+
+// friend conn the conference packets go over, groupnum is the friend's one
+type confClose struct {
+	fnum     uint32
+	groupnum uint16
+	online   bool
+}
+
+type conference struct {
+	typ       uint8
+	id        []byte
+	title     []byte
+	peers     []*confPeer // the first one is us
+	close     []*confClose
+	connected bool // our peernum given by the peer invited us
+	msgnum    uint32
+	lastPing  time.Time
+}
+
+// like Group_Chats of group.c, text conferences over friend conns of Messenger.
+// Close conns are only friends invited us or we invited, peers not our friends
+// get messages relayed by them.
+type Conferences struct {
+	m     *Messenger
+	clock clock
+
+	mu    sync.Mutex
+	confs []*conference // conference number =>, nil when deleted
+	stopC chan bool
+
+	// cookie for Join
+	OnInvite func(fnum uint32, typ uint8, cookie []byte)
+	// peer is index of sender in peer list
+	OnMessage func(gnum uint32, peer int, msgtype int, msg []byte)
+	// peer -1 when title got on join
+	OnTitle           func(gnum uint32, peer int, title []byte)
+	OnPeerName        func(gnum uint32, peer int, name []byte)
+	OnPeerListChanged func(gnum uint32)
+}
+
+func NewConferences(m *Messenger) *Conferences {
+	this := &Conferences{}
+	this.m = m
+	this.clock = m.clock
+	this.stopC = make(chan bool)
+	m.mu.Lock()
+	m.confs = this
+	m.mu.Unlock()
+	go this.doConferencesLoop()
+	return this
+}
+
+func (this *Conferences) Kill() { close(this.stopC) }
+
+// mu held by caller
+func (this *Conferences) confLocked(gnum uint32) (*conference, error) {
+	if gnum >= uint32(len(this.confs)) || this.confs[gnum] == nil {
+		return nil, errors.Errorf("Conference not found: %d", gnum)
+	}
+	return this.confs[gnum], nil
+}
+
+// mu held by caller
+func (this *Conferences) addConfLocked(g *conference) uint32 {
+	now := this.clock.Now()
+	g.lastPing = now
+	g.peers = []*confPeer{{Pubkey: this.m.SelfPubkey, DhtPubkey: this.m.fcs.ncro.dhtpk,
+		Name: this.m.Name(), lastRecv: now}}
+	for i, g2 := range this.confs {
+		if g2 == nil {
+			this.confs[i] = g
+			return uint32(i)
+		}
+	}
+	this.confs = append(this.confs, g)
+	return uint32(len(this.confs) - 1)
+}
+
+// New creates conference of GROUPCHAT_TYPE_TEXT with us as the only peer.
+func (this *Conferences) New(typ uint8) (uint32, error) {
+	if typ != GROUPCHAT_TYPE_TEXT {
+		return 0, errors.Errorf("Conference type not supported: %d", typ)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g := &conference{typ: typ, id: CBRandomBytes(GROUP_ID_LENGTH), connected: true}
+	gnum := this.addConfLocked(g)
+	g.peers[0].peernum = uint16(rand.Uint32())
+	return gnum, nil
+}
+
+// Delete leaves conference, peers are told we left.
+func (this *Conferences) Delete(gnum uint32) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return err
+	}
+	if g.connected {
+		pn := make([]byte, 2)
+		binary.BigEndian.PutUint16(pn, g.peers[0].peernum)
+		gopp.ErrPrint(this.sendMessageLocked(g, GROUP_MESSAGE_KILL_PEER_ID, pn), gnum)
+	}
+	for _, c := range g.close {
+		if c.online {
+			this.sendDirect(c, PEER_KILL_ID, nil)
+		}
+	}
+	this.confs[gnum] = nil
+	return nil
+}
+
+// Invite sends invite of conference to online friend.
+func (this *Conferences) Invite(fnum, gnum uint32) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return err
+	}
+	invite := make([]byte, 1+INVITE_PACKET_SIZE)
+	invite[0], invite[1] = PACKET_ID_INVITE_CONFERENCE, INVITE_ID
+	binary.BigEndian.PutUint16(invite[2:], uint16(gnum))
+	invite[4] = g.typ
+	copy(invite[5:], g.id)
+	return this.m.sendFriendPacket(fnum, invite)
+}
+
+// Join joins conference by cookie of OnInvite from friend fnum, peers come
+// with the peer list it sends back.
+func (this *Conferences) Join(fnum uint32, cookie []byte) (uint32, error) {
+	if len(cookie) != INVITE_PACKET_SIZE-1 {
+		return 0, errors.Errorf("Invalid cookie length: %d", len(cookie))
+	}
+	typ, id := cookie[2], cookie[3:]
+	if typ != GROUPCHAT_TYPE_TEXT {
+		return 0, errors.Errorf("Conference type not supported: %d", typ)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if gnum, ok := this.confByIDLocked(typ, id); ok {
+		return gnum, errors.Errorf("Conference already joined: %d", gnum)
+	}
+	g := &conference{typ: typ, id: append([]byte{}, id...)}
+	gnum := this.addConfLocked(g)
+
+	rsp := make([]byte, 1+INVITE_RESPONSE_PACKET_SIZE)
+	rsp[0], rsp[1] = PACKET_ID_INVITE_CONFERENCE, INVITE_RESPONSE_ID
+	binary.BigEndian.PutUint16(rsp[2:], uint16(gnum))
+	copy(rsp[4:], cookie)
+	if err := this.m.sendFriendPacket(fnum, rsp); err != nil {
+		this.confs[gnum] = nil
+		return 0, err
+	}
+	c := &confClose{fnum, binary.BigEndian.Uint16(cookie), true}
+	g.close = append(g.close, c)
+	this.sendDirect(c, PEER_QUERY_ID, nil)
+	return gnum, nil
+}
+
+// SendMessage sends text of MESSAGE_NORMAL or MESSAGE_ACTION to all peers.
+func (this *Conferences) SendMessage(gnum uint32, msgtype int, msg []byte) error {
+	if msgtype != MESSAGE_NORMAL && msgtype != MESSAGE_ACTION {
+		return errors.Errorf("Invalid message type: %d", msgtype)
+	}
+	if len(msg) == 0 || len(msg) > MAX_GROUP_MESSAGE_DATA_LEN {
+		return errors.Errorf("Invalid message length: %d", len(msg))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return err
+	}
+	return this.sendMessageLocked(g, byte(PACKET_ID_MESSAGE+msgtype), msg)
+}
+
+// SetTitle sets title of conference and sends it to all peers.
+func (this *Conferences) SetTitle(gnum uint32, title []byte) error {
+	if len(title) == 0 || len(title) > MAX_NAME_LENGTH {
+		return errors.Errorf("Invalid title length: %d", len(title))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return err
+	}
+	if err := this.sendMessageLocked(g, GROUP_MESSAGE_TITLE_ID, title); err != nil {
+		return err
+	}
+	g.title = append([]byte{}, title...)
+	return nil
+}
+
+func (this *Conferences) Title(gnum uint32) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, g.title...), nil
+}
+
+// ID returns type and id of conference, same for all peers.
+func (this *Conferences) ID(gnum uint32) (uint8, []byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return 0, nil, err
+	}
+	return g.typ, append([]byte{}, g.id...), nil
+}
+
+// List returns numbers of conferences joined.
+func (this *Conferences) List() (gnums []uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, g := range this.confs {
+		if g != nil {
+			gnums = append(gnums, uint32(i))
+		}
+	}
+	return
+}
+
+// PeerCount is number of peers including us, peer indexes change when it changes.
+func (this *Conferences) PeerCount(gnum uint32) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return 0
+	}
+	return len(g.peers)
+}
+
+// mu held by caller
+func (this *Conferences) peerLocked(gnum uint32, peer int) (*confPeer, error) {
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return nil, err
+	}
+	if peer < 0 || peer >= len(g.peers) {
+		return nil, errors.Errorf("Peer not found: %d/%d", gnum, peer)
+	}
+	return g.peers[peer], nil
+}
+
+func (this *Conferences) PeerName(gnum uint32, peer int) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	p, err := this.peerLocked(gnum, peer)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, p.Name...), nil
+}
+
+func (this *Conferences) PeerPubkey(gnum uint32, peer int) (*CryptoKey, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	p, err := this.peerLocked(gnum, peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.Pubkey, nil
+}
+
+// mu held by caller
+func (this *Conferences) confByIDLocked(typ uint8, id []byte) (uint32, bool) {
+	for i, g := range this.confs {
+		if g != nil && g.typ == typ && bytes.Equal(g.id, id) {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+func (g *conference) peerIndex(peernum uint16) int {
+	for i, p := range g.peers {
+		if p.peernum == peernum {
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *conference) closeOf(fnum uint32) *confClose {
+	for _, c := range g.close {
+		if c.fnum == fnum {
+			return c
+		}
+	}
+	return nil
+}
+
+// returns true if peer list changed
+func (this *Conferences) addPeer(g *conference, peernum uint16, realpk, dhtpk *CryptoKey) bool {
+	if g.peerIndex(peernum) >= 0 {
+		return false
+	}
+	// rejoined with new peernum
+	for i, p := range g.peers {
+		if i > 0 && p.Pubkey.Equal2(realpk) {
+			g.peers = append(g.peers[:i], g.peers[i+1:]...)
+			break
+		}
+	}
+	p := &confPeer{Pubkey: realpk, DhtPubkey: dhtpk, peernum: peernum, lastRecv: this.clock.Now()}
+	g.peers = append(g.peers, p)
+	return true
+}
+
+func (g *conference) delPeer(i int) {
+	if i > 0 {
+		g.peers = append(g.peers[:i], g.peers[i+1:]...)
+	}
+}
+
+// groupnum | id | data to close conn. mu held by caller
+func (this *Conferences) sendDirect(c *confClose, id byte, data []byte) {
+	pkt := []byte{PACKET_ID_DIRECT_CONFERENCE, 0, 0, id}
+	binary.BigEndian.PutUint16(pkt[1:], c.groupnum)
+	gopp.ErrPrint(this.m.sendFriendPacket(c.fnum, append(pkt, data...)), c.fnum)
+}
+
+// like send_packet_online, groupnum | type | id. mu held by caller
+func (this *Conferences) sendOnline(gnum uint32, fnum uint32) error {
+	g := this.confs[gnum]
+	pkt := make([]byte, 1+2+1, 1+2+1+GROUP_ID_LENGTH)
+	pkt[0] = PACKET_ID_ONLINE_PACKET
+	binary.BigEndian.PutUint16(pkt[1:], uint16(gnum))
+	pkt[3] = g.typ
+	return this.m.sendFriendPacket(fnum, append(pkt, g.id...))
+}
+
+// like send_message_group, message of us to all close conns. mu held by caller
+func (this *Conferences) sendMessageLocked(g *conference, msgid byte, data []byte) error {
+	if !g.connected {
+		return errors.New("Conference not connected")
+	}
+	g.msgnum++
+	pkt := make([]byte, 1+GROUP_MESSAGE_HEADER_SIZE, 1+GROUP_MESSAGE_HEADER_SIZE+len(data))
+	pkt[0] = PACKET_ID_MESSAGE_CONFERENCE
+	binary.BigEndian.PutUint16(pkt[3:], g.peers[0].peernum)
+	binary.BigEndian.PutUint32(pkt[5:], g.msgnum)
+	pkt[9] = msgid
+	this.sendAllClose(g, append(pkt, data...), nil)
+	return nil
+}
+
+// message packet to all online close conns but from, groupnum set for each
+func (this *Conferences) sendAllClose(g *conference, pkt []byte, from *confClose) {
+	for _, c := range g.close {
+		if c == from || !c.online {
+			continue
+		}
+		pkt2 := append([]byte{}, pkt...)
+		binary.BigEndian.PutUint16(pkt2[1:], c.groupnum)
+		gopp.ErrPrint(this.m.sendFriendPacket(c.fnum, pkt2), c.fnum)
+	}
+}
+
+// like send_peers, peernum | realpk | dhtpk | namelen | name of each, split
+// by packet size, then title. mu held by caller
+func (this *Conferences) sendPeers(g *conference, c *confClose) {
+	var rsp []byte
+	for i, p := range g.peers {
+		if i == 0 && !g.connected {
+			continue
+		}
+		ent := make([]byte, 2, 2+PUBLIC_KEY_SIZE*2+1+len(p.Name))
+		binary.BigEndian.PutUint16(ent, p.peernum)
+		ent = append(append(ent, p.Pubkey.Bytes()...), p.DhtPubkey.Bytes()...)
+		ent = append(append(ent, byte(len(p.Name))), p.Name...)
+		if 1+2+1+len(rsp)+len(ent) > MAX_CRYPTO_DATA_SIZE {
+			this.sendDirect(c, PEER_RESPONSE_ID, rsp)
+			rsp = nil
+		}
+		rsp = append(rsp, ent...)
+	}
+	if len(rsp) > 0 {
+		this.sendDirect(c, PEER_RESPONSE_ID, rsp)
+	}
+	if len(g.title) > 0 {
+		this.sendDirect(c, PEER_TITLE_ID, g.title)
+	}
+}
+
+// packets of conferences from friend, id | data
+func (this *Conferences) handlePacket(fnum uint32, data []byte) {
+	var cbs []func()
+	this.mu.Lock()
+	switch data[0] {
+	case PACKET_ID_INVITE_CONFERENCE:
+		cbs = this.handleInviteLocked(fnum, data[1:])
+	case PACKET_ID_ONLINE_PACKET:
+		this.handleOnlineLocked(fnum, data[1:])
+	case PACKET_ID_DIRECT_CONFERENCE:
+		cbs = this.handleDirectLocked(fnum, data[1:])
+	case PACKET_ID_MESSAGE_CONFERENCE:
+		cbs = this.handleMessageLocked(fnum, data)
+	}
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
+
+// like handle_friend_invite_packet. mu held by caller
+func (this *Conferences) handleInviteLocked(fnum uint32, data []byte) []func() {
+	if len(data) == INVITE_PACKET_SIZE && data[0] == INVITE_ID {
+		cookie := append([]byte{}, data[1:]...)
+		if fn := this.OnInvite; fn != nil {
+			return []func(){func() { fn(fnum, cookie[2], cookie) }}
+		}
+		return nil
+	}
+	if len(data) != INVITE_RESPONSE_PACKET_SIZE || data[0] != INVITE_RESPONSE_ID {
+		return nil
+	}
+	gnum := uint32(binary.BigEndian.Uint16(data[3:]))
+	g, err := this.confLocked(gnum)
+	if err != nil || !g.connected || data[5] != g.typ || !bytes.Equal(data[6:], g.id) {
+		return nil
+	}
+	if g.closeOf(fnum) == nil && len(g.close) >= MAX_GROUP_CONNECTIONS {
+		return nil
+	}
+	realpk, ok := this.m.friendPubkey(fnum)
+	dhtpk := this.m.fcs.DHTPubkey(realpk)
+	if !ok || dhtpk == nil {
+		return nil
+	}
+	peernum := uint16(rand.Uint32())
+	for g.peerIndex(peernum) >= 0 {
+		peernum = uint16(rand.Uint32())
+	}
+	this.addPeer(g, peernum, realpk, dhtpk)
+	c := g.closeOf(fnum)
+	if c == nil {
+		c = &confClose{fnum: fnum}
+		g.close = append(g.close, c)
+	}
+	c.groupnum, c.online = binary.BigEndian.Uint16(data[1:]), true
+	// like group_new_peer_send
+	np := make([]byte, 2, 2+PUBLIC_KEY_SIZE*2)
+	binary.BigEndian.PutUint16(np, peernum)
+	np = append(append(np, realpk.Bytes()...), dhtpk.Bytes()...)
+	gopp.ErrPrint(this.sendMessageLocked(g, GROUP_MESSAGE_NEW_PEER_ID, np), gnum)
+	if fn := this.OnPeerListChanged; fn != nil {
+		return []func(){func() { fn(gnum) }}
+	}
+	return nil
+}
+
+// like handle_packet_online, friend's close conn of conference up again. mu held by caller
+func (this *Conferences) handleOnlineLocked(fnum uint32, data []byte) {
+	if len(data) != 2+1+GROUP_ID_LENGTH {
+		return
+	}
+	gnum, ok := this.confByIDLocked(data[2], data[3:])
+	if !ok {
+		return
+	}
+	g := this.confs[gnum]
+	c := g.closeOf(fnum)
+	if c == nil {
+		return
+	}
+	groupnum := binary.BigEndian.Uint16(data)
+	if c.online && c.groupnum == groupnum {
+		return
+	}
+	c.groupnum, c.online = groupnum, true
+	gopp.ErrPrint(this.sendOnline(gnum, fnum), gnum)
+	if !g.connected {
+		this.sendDirect(c, PEER_QUERY_ID, nil)
+	}
+}
+
+// like handle_direct_packet, groupnum | id | data. mu held by caller
+func (this *Conferences) handleDirectLocked(fnum uint32, data []byte) []func() {
+	if len(data) < 2+1 {
+		return nil
+	}
+	gnum := uint32(binary.BigEndian.Uint16(data))
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return nil
+	}
+	c := g.closeOf(fnum)
+	if c == nil {
+		return nil
+	}
+	dat := data[3:]
+	switch data[2] {
+	case PEER_KILL_ID:
+		for i, c2 := range g.close {
+			if c2 == c {
+				g.close = append(g.close[:i], g.close[i+1:]...)
+				break
+			}
+		}
+	case PEER_QUERY_ID:
+		this.sendPeers(g, c)
+	case PEER_RESPONSE_ID:
+		return this.handlePeersLocked(gnum, g, dat)
+	case PEER_TITLE_ID:
+		if len(dat) == 0 || len(dat) > MAX_NAME_LENGTH {
+			break
+		}
+		g.title = append([]byte{}, dat...)
+		if fn := this.OnTitle; fn != nil {
+			title := g.title
+			return []func(){func() { fn(gnum, -1, title) }}
+		}
+	}
+	return nil
+}
+
+// like handle_send_peers, ours is in it when we just joined. mu held by caller
+func (this *Conferences) handlePeersLocked(gnum uint32, g *conference, data []byte) []func() {
+	changed := false
+	for len(data) >= 2+PUBLIC_KEY_SIZE*2+1 {
+		peernum := binary.BigEndian.Uint16(data)
+		realpk := NewCryptoKey(append([]byte{}, data[2:2+PUBLIC_KEY_SIZE]...))
+		dhtpk := NewCryptoKey(append([]byte{}, data[2+PUBLIC_KEY_SIZE:2+PUBLIC_KEY_SIZE*2]...))
+		namelen := int(data[2+PUBLIC_KEY_SIZE*2])
+		data = data[2+PUBLIC_KEY_SIZE*2+1:]
+		if namelen > len(data) || namelen > MAX_NAME_LENGTH {
+			break
+		}
+		name := append([]byte{}, data[:namelen]...)
+		data = data[namelen:]
+
+		if realpk.Equal2(this.m.SelfPubkey) {
+			if !g.connected {
+				g.peers[0].peernum, g.connected = peernum, true
+				if len(g.peers[0].Name) > 0 {
+					gopp.ErrPrint(this.sendMessageLocked(g, GROUP_MESSAGE_NAME_ID, g.peers[0].Name), gnum)
+				}
+			}
+			continue
+		}
+		if this.addPeer(g, peernum, realpk, dhtpk) {
+			g.peers[len(g.peers)-1].Name = name
+			changed = true
+		}
+	}
+	if fn := this.OnPeerListChanged; changed && fn != nil {
+		return []func(){func() { fn(gnum) }}
+	}
+	return nil
+}
+
+// like handle_message_packet_group, relays message to other close conns and
+// handles it, id | groupnum | peernum | msgnum | message id | data. mu held by caller
+func (this *Conferences) handleMessageLocked(fnum uint32, pkt []byte) []func() {
+	if len(pkt) < 1+GROUP_MESSAGE_HEADER_SIZE {
+		return nil
+	}
+	gnum := uint32(binary.BigEndian.Uint16(pkt[1:]))
+	g, err := this.confLocked(gnum)
+	if err != nil {
+		return nil
+	}
+	c := g.closeOf(fnum)
+	if c == nil || !c.online || !g.connected {
+		return nil
+	}
+	peernum := binary.BigEndian.Uint16(pkt[3:])
+	msgnum := binary.BigEndian.Uint32(pkt[5:])
+	msgid, dat := pkt[9], append([]byte{}, pkt[1+GROUP_MESSAGE_HEADER_SIZE:]...)
+	idx := g.peerIndex(peernum)
+	if idx == 0 {
+		return nil // ours relayed back
+	}
+	if idx < 0 {
+		// sender not known yet, ask peers of the conn it came by
+		this.sendDirect(c, PEER_QUERY_ID, nil)
+		return nil
+	}
+	p := g.peers[idx]
+	if p.lastMsgnum != 0 && msgnum <= p.lastMsgnum {
+		return nil
+	}
+	p.lastMsgnum, p.lastRecv = msgnum, this.clock.Now()
+	this.sendAllClose(g, pkt, c)
+
+	switch msgid {
+	case GROUP_MESSAGE_NEW_PEER_ID:
+		if len(dat) != 2+PUBLIC_KEY_SIZE*2 {
+			break
+		}
+		realpk := NewCryptoKey(append([]byte{}, dat[2:2+PUBLIC_KEY_SIZE]...))
+		dhtpk := NewCryptoKey(append([]byte{}, dat[2+PUBLIC_KEY_SIZE:]...))
+		if realpk.Equal2(this.m.SelfPubkey) || !this.addPeer(g, binary.BigEndian.Uint16(dat), realpk, dhtpk) {
+			break
+		}
+		if fn := this.OnPeerListChanged; fn != nil {
+			return []func(){func() { fn(gnum) }}
+		}
+	case GROUP_MESSAGE_KILL_PEER_ID:
+		if len(dat) != 2 || binary.BigEndian.Uint16(dat) != peernum {
+			break
+		}
+		g.delPeer(idx)
+		if fn := this.OnPeerListChanged; fn != nil {
+			return []func(){func() { fn(gnum) }}
+		}
+	case GROUP_MESSAGE_NAME_ID:
+		if len(dat) > MAX_NAME_LENGTH {
+			break
+		}
+		p.Name = dat
+		if fn := this.OnPeerName; fn != nil {
+			return []func(){func() { fn(gnum, idx, dat) }}
+		}
+	case GROUP_MESSAGE_TITLE_ID:
+		if len(dat) == 0 || len(dat) > MAX_NAME_LENGTH {
+			break
+		}
+		g.title = dat
+		if fn := this.OnTitle; fn != nil {
+			return []func(){func() { fn(gnum, idx, dat) }}
+		}
+	case PACKET_ID_MESSAGE, PACKET_ID_ACTION:
+		if len(dat) == 0 {
+			break
+		}
+		if fn := this.OnMessage; fn != nil {
+			msgtype := int(msgid - PACKET_ID_MESSAGE)
+			return []func(){func() { fn(gnum, idx, msgtype, dat) }}
+		}
+	}
+	return nil
+}
+
+// friend online or offline, close conns to it are told or marked offline
+func (this *Conferences) handleFriendStatus(fnum uint32, online bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for gnum, g := range this.confs {
+		if g == nil {
+			continue
+		}
+		if c := g.closeOf(fnum); c != nil {
+			c.online = false
+			if online {
+				gopp.ErrPrint(this.sendOnline(uint32(gnum), fnum), gnum)
+			}
+		}
+	}
+}
+
+// friend deleted, its number may be reused
+func (this *Conferences) delFriend(fnum uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, g := range this.confs {
+		if g == nil {
+			continue
+		}
+		for i, c := range g.close {
+			if c.fnum == fnum {
+				g.close = append(g.close[:i], g.close[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// our new name to all conferences
+func (this *Conferences) sendNameAll(name []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for gnum, g := range this.confs {
+		if g == nil {
+			continue
+		}
+		g.peers[0].Name = append([]byte{}, name...)
+		if g.connected {
+			gopp.ErrPrint(this.sendMessageLocked(g, GROUP_MESSAGE_NAME_ID, name), gnum)
+		}
+	}
+}
+
+func (this *Conferences) doConferencesLoop() {
+	tickC, stop := this.clock.Tick(time.Second)
+	defer stop()
+	for {
+		select {
+		case <-tickC:
+			this.doConferences()
+		case <-this.stopC:
+			return
+		}
+	}
+}
+
+// like do_groupchats, ping peers and remove ones timed out
+func (this *Conferences) doConferences() {
+	var cbs []func()
+	this.mu.Lock()
+	now := this.clock.Now()
+	for gnum, g := range this.confs {
+		if g == nil || !g.connected {
+			continue
+		}
+		if now.Sub(g.lastPing) >= GROUP_PING_INTERVAL*time.Second {
+			g.lastPing = now
+			gopp.ErrPrint(this.sendMessageLocked(g, GROUP_MESSAGE_PING_ID, nil), gnum)
+		}
+		changed := false
+		for i := len(g.peers) - 1; i > 0; i-- {
+			if now.Sub(g.peers[i].lastRecv) >= GROUP_PING_INTERVAL*3*time.Second {
+				g.delPeer(i)
+				changed = true
+			}
+		}
+		if fn := this.OnPeerListChanged; changed && fn != nil {
+			gnum := uint32(gnum)
+			cbs = append(cbs, func() { fn(gnum) })
+		}
+	}
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
@@ -0,0 +1,183 @@
+package mintox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConferenceRelay(t *testing.T) {
+	clk := newFakeTstClock()
+	ma, mb, mc := newTstMessenger(clk), newTstMessenger(clk), newTstMessenger(clk)
+	for _, m := range []*Messenger{ma, mb, mc} {
+		defer m.tstKill()
+	}
+	// b and c are not friends, their messages go by a
+	fab, fba := tstMakeFriends(t, clk, ma, mb)
+	fac, fca := tstMakeFriends(t, clk, ma, mc)
+	mb.SetName([]byte("b"))
+
+	ca, cb, cc := NewConferences(ma), NewConferences(mb), NewConferences(mc)
+	for _, c := range []*Conferences{ca, cb, cc} {
+		defer c.Kill()
+	}
+	inviteC := make(chan []byte, 2)
+	cb.OnInvite = func(fnum uint32, typ uint8, cookie []byte) {
+		if fnum == fba && typ == GROUPCHAT_TYPE_TEXT {
+			inviteC <- cookie
+		}
+	}
+	cc.OnInvite = func(fnum uint32, typ uint8, cookie []byte) {
+		if fnum == fca {
+			inviteC <- cookie
+		}
+	}
+	titleC := make(chan string, 1)
+	cc.OnTitle = func(gnum uint32, peer int, title []byte) { titleC <- string(title) }
+	type confMsg struct {
+		from string
+		msg  string
+	}
+	msgC := make(chan confMsg, 4)
+	onMessage := func(cs *Conferences) func(uint32, int, int, []byte) {
+		return func(gnum uint32, peer int, msgtype int, msg []byte) {
+			pk, _ := cs.PeerPubkey(gnum, peer)
+			from := map[bool]string{true: "c", false: "?"}[pk.Equal2(mc.SelfPubkey)]
+			msgC <- confMsg{from, string(msg)}
+		}
+	}
+	ca.OnMessage, cb.OnMessage = onMessage(ca), onMessage(cb)
+
+	ga, err := ca.New(GROUPCHAT_TYPE_TEXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.SetTitle(ga, []byte("topic")); err != nil {
+		t.Fatal(err)
+	}
+	join := func(cs *Conferences, fnum, fnumInviter uint32) uint32 {
+		if err := ca.Invite(fnumInviter, ga); err != nil {
+			t.Fatal(err)
+		}
+		var cookie []byte
+		select {
+		case cookie = <-inviteC:
+		case <-time.After(3 * time.Second):
+			t.Fatal("invite not received")
+		}
+		gnum, err := cs.Join(fnum, cookie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cs.Join(fnum, cookie); err == nil {
+			t.Error("joined twice")
+		}
+		return gnum
+	}
+	gb := join(cb, fba, fab)
+	gc := join(cc, fca, fac)
+	if !waitTstCond(3*time.Second, func() bool {
+		return ca.PeerCount(ga) == 3 && cb.PeerCount(gb) == 3 && cc.PeerCount(gc) == 3
+	}) {
+		t.Fatal("peer counts:", ca.PeerCount(ga), cb.PeerCount(gb), cc.PeerCount(gc))
+	}
+	select {
+	case title := <-titleC:
+		if title != "topic" {
+			t.Error("title:", title)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("title not got on join")
+	}
+	_, ida, _ := ca.ID(ga)
+	_, idc, _ := cc.ID(gc)
+	if string(ida) != string(idc) {
+		t.Error("conference id differs")
+	}
+	// name of b sent after it joined, relayed to c
+	if !waitTstCond(3*time.Second, func() bool {
+		for i := 0; i < cc.PeerCount(gc); i++ {
+			if name, _ := cc.PeerName(gc, i); string(name) == "b" {
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Error("name of b not got by c")
+	}
+
+	if err := cc.SendMessage(gc, MESSAGE_NORMAL, []byte("hi all")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-msgC:
+			if m.from != "c" || m.msg != "hi all" {
+				t.Error("message:", m)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("message not received")
+		}
+	}
+	select {
+	case m := <-msgC:
+		t.Error("message received twice:", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := cb.Delete(gb); err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return ca.PeerCount(ga) == 2 && cc.PeerCount(gc) == 2 }) {
+		t.Error("peer left not removed:", ca.PeerCount(ga), cc.PeerCount(gc))
+	}
+	if cb.SendMessage(gb, MESSAGE_NORMAL, []byte("gone")) == nil {
+		t.Error("message sent to deleted conference")
+	}
+}
+
+func TestConferencePeerTimeout(t *testing.T) {
+	clk := newFakeTstClock()
+	ma, mb := newTstMessenger(clk), newTstMessenger(clk)
+	defer ma.tstKill()
+	defer mb.tstKill()
+	fab, fba := tstMakeFriends(t, clk, ma, mb)
+	ca, cb := NewConferences(ma), NewConferences(mb)
+	defer ca.Kill()
+	inviteC := make(chan []byte, 1)
+	cb.OnInvite = func(fnum uint32, typ uint8, cookie []byte) { inviteC <- cookie }
+
+	ga, _ := ca.New(GROUPCHAT_TYPE_TEXT)
+	if err := ca.Invite(fab, ga); err != nil {
+		t.Fatal(err)
+	}
+	var cookie []byte
+	select {
+	case cookie = <-inviteC:
+	case <-time.After(3 * time.Second):
+		t.Fatal("invite not received")
+	}
+	gb, err := cb.Join(fba, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return ca.PeerCount(ga) == 2 && cb.PeerCount(gb) == 2 }) {
+		t.Fatal("peer counts:", ca.PeerCount(ga), cb.PeerCount(gb))
+	}
+
+	step := func(n int) {
+		for i := 0; i < n; i++ {
+			clk.Advance(time.Second)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	// kept by pings
+	step(GROUP_PING_INTERVAL * 4)
+	if ca.PeerCount(ga) != 2 {
+		t.Fatal("peer removed while pinging:", ca.PeerCount(ga))
+	}
+	cb.Kill()
+	step(GROUP_PING_INTERVAL * 4)
+	if ca.PeerCount(ga) != 1 {
+		t.Error("silent peer not removed:", ca.PeerCount(ga))
+	}
+}
@@ -8,7 +8,7 @@ package mintox
 */
 import "C"
 import (
-	"bytes"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 	"gopp"
@@ -28,6 +28,9 @@ const NONCE_SIZE = 24
 const MAC_SIZE = 16
 const SHA512_SIZE = 64
 const SHA256_SIZE = SHA512_SIZE / 2
+const SIG_PUBLIC_KEY_SIZE = 32
+const SIG_SECRET_KEY_SIZE = 64
+const SIGNATURE_SIZE = 64
 
 type byteArray []byte
 
@@ -41,11 +44,13 @@ func (this *byteArray) BinStr() string  { return string(*this) }
 func (this *byteArray) ToHex() string   { return strings.ToUpper(hex.EncodeToString(*this)) }
 func (this *byteArray) ToHex20() string { return strings.ToUpper(hex.EncodeToString(*this))[:20] }
 func (this *byteArray) Len() int        { return len(*this) }
+
+// constant time, only the lengths may leak
 func (this *byteArray) Equal(that []byte) bool {
-	return len(*this) == len(that) && bytes.Compare(*this, that) == 0
+	return subtle.ConstantTimeCompare(*this, that) == 1
 }
 func (this *byteArray) Equal2(that Byteable) bool {
-	return len(*this) == that.Len() && bytes.Compare(*this, that.Bytes()) == 0
+	return subtle.ConstantTimeCompare(*this, that.Bytes()) == 1
 }
 
 type _CryptoKey [PUBLIC_KEY_SIZE]byte
@@ -54,11 +59,11 @@ type CryptoKey struct {
 	*_CryptoKey
 }
 
+// asserts key valid, see CryptoKeyFromHex for untrusted input
 func NewCryptoKeyFromHex(key string) *CryptoKey {
-	keybin, err := hex.DecodeString(key)
-	gopp.ErrPrint(err, key)
-	gopp.Assert(len(keybin) == PUBLIC_KEY_SIZE, "Invalid key:", key)
-	return &CryptoKey{keybin, (*_CryptoKey)(unsafe.Pointer(&keybin[0]))}
+	this, err := CryptoKeyFromHex(key)
+	gopp.Assert(err == nil, "Invalid key:", key, err)
+	return this
 }
 
 func NewCryptoKey(b []byte) *CryptoKey {
@@ -140,6 +145,13 @@ func CBDerivePubkey(seckey *CryptoKey) (pubkey *CryptoKey) {
 	return
 }
 
+// raw x25519, not hashed like CBBeforeNm. error for low order pubkey
+func CBScalarMult(seckey *CryptoKey, pubkey *CryptoKey) (*CryptoKey, error) {
+	buf := make([]byte, PUBLIC_KEY_SIZE)
+	iret := C.crypto_scalarmult_curve25519(cbytesPtr(buf), cbytesPtr(seckey.Bytes()), cbytesPtr(pubkey.Bytes()))
+	return NewCryptoKey(buf), cbiret2err(int(iret))
+}
+
 /////
 func EncryptDataSymmetric(seckey *CryptoKey, nonce *CBNonce, plain []byte) (encrypted []byte, err error) {
 	temp_plain := make([]byte, len(plain)+cryptobox.CryptoBoxZeroBytes())
@@ -159,16 +171,89 @@ func EncryptDataSymmetric(seckey *CryptoKey, nonce *CBNonce, plain []byte) (encr
 }
 
 func DecryptDataSymmetric(seckey *CryptoKey, nonce *CBNonce, encrypted []byte) (plain []byte, err error) {
+	if len(encrypted) < cryptobox.CryptoBoxMacBytes() {
+		return nil, errors.Errorf("Encrypted too short: %d", len(encrypted))
+	}
 	temp_encrypted := make([]byte, len(encrypted)+cryptobox.CryptoBoxBoxZeroBytes())
 	copy(temp_encrypted[cryptobox.CryptoBoxBoxZeroBytes():], encrypted)
 
 	plain, err = CBOpenAfterNm(seckey, nonce, temp_encrypted)
 	gopp.ErrPrint(err, len(plain), len(encrypted))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
 	plain = plain[cryptobox.CryptoBoxZeroBytes():]
 	gopp.Assert(len(plain) == len(encrypted)-cryptobox.CryptoBoxMacBytes(),
 		"size error:", len(plain), len(encrypted))
-	if err != nil {
-		err = errors.Wrap(err, "")
-	}
 	return
 }
+
+// EncryptDataSymmetric appended to dst without temporary buffers,
+// dst reused when its capacity is enough, so no allocation with a pooled dst.
+func EncryptDataSymmetricTo(dst []byte, seckey *CryptoKey, nonce *CBNonce, plain []byte) ([]byte, error) {
+	n := len(dst)
+	dst = growBytes(dst, len(plain)+MAC_SIZE)
+	iret := C.crypto_box_easy_afternm(cbytesPtr(dst[n:]), cbytesPtr(plain), C.ulonglong(len(plain)),
+		cbytesPtr(nonce.Bytes()), cbytesPtr(seckey.Bytes()))
+	if iret != 0 {
+		return dst[:n], errors.Wrap(cbiret2err(int(iret)), "")
+	}
+	return dst, nil
+}
+
+// DecryptDataSymmetric appended to dst, like EncryptDataSymmetricTo
+func DecryptDataSymmetricTo(dst []byte, seckey *CryptoKey, nonce *CBNonce, encrypted []byte) ([]byte, error) {
+	if len(encrypted) < MAC_SIZE {
+		return dst, errors.Errorf("Encrypted too short: %d", len(encrypted))
+	}
+	n := len(dst)
+	dst = growBytes(dst, len(encrypted)-MAC_SIZE)
+	iret := C.crypto_box_open_easy_afternm(cbytesPtr(dst[n:]), cbytesPtr(encrypted), C.ulonglong(len(encrypted)),
+		cbytesPtr(nonce.Bytes()), cbytesPtr(seckey.Bytes()))
+	if iret != 0 {
+		return dst[:n], errors.Wrap(cbiret2err(int(iret)), "")
+	}
+	return dst, nil
+}
+
+// ed25519 keypair, sk is SIG_SECRET_KEY_SIZE bytes
+func NewSigKeyPair() (pk *CryptoKey, sk []byte, err error) {
+	pkb, sk := make([]byte, SIG_PUBLIC_KEY_SIZE), make([]byte, SIG_SECRET_KEY_SIZE)
+	iret := C.crypto_sign_keypair(cbytesPtr(pkb), cbytesPtr(sk))
+	return NewCryptoKey(pkb), sk, cbiret2err(int(iret))
+}
+
+// CryptoSign returns detached signature of msg
+func CryptoSign(sk []byte, msg []byte) ([]byte, error) {
+	if len(sk) != SIG_SECRET_KEY_SIZE {
+		return nil, errors.Errorf("Invalid sign key length: %d", len(sk))
+	}
+	sig := make([]byte, SIGNATURE_SIZE)
+	iret := C.crypto_sign_detached(cbytesPtr(sig), nil, cbytesPtr(msg), C.ulonglong(len(msg)), cbytesPtr(sk))
+	return sig, cbiret2err(int(iret))
+}
+
+func CryptoSignVerify(pk *CryptoKey, msg []byte, sig []byte) bool {
+	if len(sig) != SIGNATURE_SIZE {
+		return false
+	}
+	return C.crypto_sign_verify_detached(cbytesPtr(sig), cbytesPtr(msg), C.ulonglong(len(msg)), cbytesPtr(pk.Bytes())) == 0
+}
+
+// b extended by n bytes, reallocated only if capacity not enough
+func growBytes(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b[:len(b)+n]
+	}
+	nb := make([]byte, len(b)+n)
+	copy(nb, b)
+	return nb
+}
+
+// nil for empty, &b[0] panics
+func cbytesPtr(b []byte) *C.uint8_t {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.uint8_t)(unsafe.Pointer(&b[0]))
+}
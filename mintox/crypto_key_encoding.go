@@ -0,0 +1,199 @@
+package mintox
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// chars of hex kept by String, the rest redacted
+const CRYPTO_KEY_STRING_PREFIX = 8
+
+// short hex prefix for log, never the whole key, safe for secret keys too
+func (this *CryptoKey) String() string {
+	if this == nil || len(this.byteArray) == 0 {
+		return "<nil>"
+	}
+	return this.ToHex()[:CRYPTO_KEY_STRING_PREFIX]
+}
+
+// CryptoKeyFromHex parses 64 hex chars of any case, spaces around trimmed
+func CryptoKeyFromHex(s string) (*CryptoKey, error) {
+	s = strings.TrimSpace(s)
+	if len(s) != PUBLIC_KEY_SIZE*2 {
+		return nil, errors.Errorf("Invalid hex key length: %d, want %d", len(s), PUBLIC_KEY_SIZE*2)
+	}
+	keybin, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid hex key")
+	}
+	return NewCryptoKey(keybin), nil
+}
+
+func (this *CryptoKey) ToBase64() string { return base64.StdEncoding.EncodeToString(this.Bytes()) }
+
+// CryptoKeyFromBase64 parses std or url base64, padded or not
+func CryptoKeyFromBase64(s string) (*CryptoKey, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	enc := base64.RawStdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.RawURLEncoding
+	}
+	keybin, err := enc.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid base64 key")
+	}
+	if len(keybin) != PUBLIC_KEY_SIZE {
+		return nil, errors.Errorf("Invalid base64 key size: %d, want %d", len(keybin), PUBLIC_KEY_SIZE)
+	}
+	return NewCryptoKey(keybin), nil
+}
+
+// ToBech32 encodes with human readable part hrp like BIP-173, lower case
+func (this *CryptoKey) ToBech32(hrp string) (string, error) {
+	return bech32Encode(hrp, this.Bytes())
+}
+
+// CryptoKeyFromBech32 parses a bech32 key, its hrp must be hrp
+func CryptoKeyFromBech32(hrp, s string) (*CryptoKey, error) {
+	gothrp, keybin, err := bech32Decode(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if gothrp != strings.ToLower(hrp) {
+		return nil, errors.Errorf("Invalid bech32 hrp: %s, want %s", gothrp, hrp)
+	}
+	if len(keybin) != PUBLIC_KEY_SIZE {
+		return nil, errors.Errorf("Invalid bech32 key size: %d, want %d", len(keybin), PUBLIC_KEY_SIZE)
+	}
+	return NewCryptoKey(keybin), nil
+}
+
+/////
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+const bech32MaxLen = 90
+
+var bech32Gen = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := uint(0); i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= bech32Gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	ret := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		ret = append(ret, hrp[i]>>5)
+	}
+	ret = append(ret, 0)
+	for i := 0; i < len(hrp); i++ {
+		ret = append(ret, hrp[i]&31)
+	}
+	return ret
+}
+
+// regroup bits, like convertbits of the BIP-173 reference
+func bech32ConvertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	acc, bits := uint32(0), uint(0)
+	maxv, maxacc := uint32(1)<<to-1, uint32(1)<<(from+to-1)-1
+	ret := make([]byte, 0, len(data)*int(from)/int(to)+1)
+	for _, v := range data {
+		if uint32(v)>>from != 0 {
+			return nil, errors.Errorf("Invalid %d bits value: %d", from, v)
+		}
+		acc = (acc<<from | uint32(v)) & maxacc
+		bits += from
+		for bits >= to {
+			bits -= to
+			ret = append(ret, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("Invalid bech32 padding")
+	}
+	return ret, nil
+}
+
+func bech32Encode(hrp string, data []byte) (string, error) {
+	if len(hrp) == 0 || len(hrp) > 83 {
+		return "", errors.Errorf("Invalid bech32 hrp length: %d", len(hrp))
+	}
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", errors.Errorf("Invalid bech32 hrp char: %q", hrp[i])
+		}
+	}
+	hrp = strings.ToLower(hrp)
+	d5, err := bech32ConvertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	if len(hrp)+1+len(d5)+6 > bech32MaxLen {
+		return "", errors.Errorf("Bech32 too long: %d", len(hrp)+1+len(d5)+6)
+	}
+	values := append(bech32HrpExpand(hrp), d5...)
+	polymod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ 1
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, d := range d5 {
+		sb.WriteByte(bech32Charset[d])
+	}
+	for i := uint(0); i < 6; i++ {
+		sb.WriteByte(bech32Charset[(polymod>>(5*(5-i)))&31])
+	}
+	return sb.String(), nil
+}
+
+// hrp lower cased and data of 8 bits
+func bech32Decode(s string) (string, []byte, error) {
+	if len(s) > bech32MaxLen {
+		return "", nil, errors.Errorf("Bech32 too long: %d", len(s))
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("Bech32 mixed case")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("Invalid bech32 separator position")
+	}
+	hrp := s[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, errors.Errorf("Invalid bech32 hrp char: %q", hrp[i])
+		}
+	}
+	d5 := make([]byte, 0, len(s)-pos-1)
+	for i := pos + 1; i < len(s); i++ {
+		d := strings.IndexByte(bech32Charset, s[i])
+		if d < 0 {
+			return "", nil, errors.Errorf("Invalid bech32 char: %q", s[i])
+		}
+		d5 = append(d5, byte(d))
+	}
+	if bech32Polymod(append(bech32HrpExpand(hrp), d5...)) != 1 {
+		return "", nil, errors.New("Invalid bech32 checksum")
+	}
+	data, err := bech32ConvertBits(d5[:len(d5)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
@@ -0,0 +1,61 @@
+package mintox
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCryptoKeyEncoding(t *testing.T) {
+	pk, sk, _ := NewCBKeyPair()
+	if k, err := CryptoKeyFromHex(" " + strings.ToLower(pk.ToHex()) + "\n"); err != nil || !k.Equal2(pk) {
+		t.Error("hex:", err)
+	}
+	for _, s := range []string{"", pk.ToHex()[:62], pk.ToHex() + "00", "zz" + pk.ToHex()[2:]} {
+		if _, err := CryptoKeyFromHex(s); err == nil {
+			t.Error("invalid hex accepted:", s)
+		}
+	}
+
+	b64 := pk.ToBase64()
+	urlb64 := strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(b64, "="))
+	for _, s := range []string{b64, strings.TrimRight(b64, "="), urlb64} {
+		if k, err := CryptoKeyFromBase64(s); err != nil || !k.Equal2(pk) {
+			t.Error("base64:", s, err)
+		}
+	}
+	if _, err := CryptoKeyFromBase64(b64[:20]); err == nil {
+		t.Error("short base64 accepted")
+	}
+
+	b32, err := pk.ToBech32("tox")
+	if err != nil || !strings.HasPrefix(b32, "tox1") {
+		t.Fatal("bech32:", b32, err)
+	}
+	if k, err := CryptoKeyFromBech32("tox", strings.ToUpper(b32)); err != nil || !k.Equal2(pk) {
+		t.Error("bech32 parse:", err)
+	}
+	if _, err := CryptoKeyFromBech32("toxsk", b32); err == nil {
+		t.Error("bech32 of other hrp accepted")
+	}
+	flipped := []byte(b32)
+	flipped[10] = map[bool]byte{true: 'q', false: 'p'}[flipped[10] != 'q']
+	if _, err := CryptoKeyFromBech32("tox", string(flipped)); err == nil {
+		t.Error("bech32 checksum not checked")
+	}
+	// BIP-173 vector
+	if hrp, data, err := bech32Decode("abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw"); err != nil || hrp != "abcdef" || len(data) != 20 {
+		t.Error("bech32 vector:", hrp, len(data), err)
+	}
+
+	if s := fmt.Sprint(sk); len(s) != CRYPTO_KEY_STRING_PREFIX || !strings.HasPrefix(sk.ToHex(), s) {
+		t.Error("key not redacted:", s)
+	}
+	var nilkey *CryptoKey
+	if s := fmt.Sprint(nilkey); s != "<nil>" {
+		t.Error("nil key:", s)
+	}
+	if pk.Equal(sk.Bytes()) || !pk.Equal(pk.Dup().Bytes()) || pk.Equal(pk.Bytes()[:16]) {
+		t.Error("equal")
+	}
+}
@@ -8,8 +8,12 @@ import (
 	"math"
 	"math/rand"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
+
+	"github.com/pkg/errors"
 )
 
 /* Maximum number of clients stored per friend. */
@@ -51,6 +55,8 @@ const DHT_FAKE_FRIEND_NUMBER = 2
 
 const MAX_CRYPTO_REQUEST_SIZE = 1024
 
+const CRYPTO_SIZE = 1 + PUBLIC_KEY_SIZE*2 + NONCE_SIZE
+
 const CRYPTO_PACKET_FRIEND_REQ = 32 /* Friend request crypto packet ID. */
 const CRYPTO_PACKET_HARDENING = 48  /* Hardening crypto packet ID. */
 const CRYPTO_PACKET_DHTPK = 156
@@ -140,7 +146,7 @@ type NodeFormat struct {
 func (this *NodeFormat) Key() string { return this.Pubkey.BinStr() }
 func (this *NodeFormat) Compare(that PLItem) int {
 	v := IDClosest(this.cmppk, this.Pubkey, that.(*NodeFormat).Pubkey)
-	// log.Println(v, this.cmppk.ToHex()[:20], this.Pubkey.ToHex()[:20], that.(*NodeFormat).Pubkey.ToHex()[:20])
+	// log.Println(v, this.cmppk, this.Pubkey, that.(*NodeFormat).Pubkey)
 	return v
 }
 func (this *NodeFormat) Update(thati PLItem) {}
@@ -156,7 +162,7 @@ type DHTFriend struct {
 	BootstrapTimes uint32
 
 	/* Symetric NAT hole punching stuff. */
-	// NAT         nat;
+	nat *dhtNAT
 
 	LockCount uint16
 	Callbacks []struct {
@@ -179,6 +185,7 @@ func NewDHTFriend() *DHTFriend {
 	this := &DHTFriend{}
 	this.ClientList = NewPriorityList(MAX_FRIEND_CLIENTS)
 	this.ToBootstrap = NewPriorityList(MAX_SENT_NODES)
+	this.nat = newDHTNAT()
 	return this
 }
 
@@ -223,7 +230,7 @@ type DHT struct {
 	SelfPubkey *CryptoKey
 	SelfSeckey *CryptoKey
 
-	CloseClientList     *PriorityList // [LCLIENT_LIST]*ClientData
+	CloseClientList     *NodeTable // k-buckets, [LCLIENT_LENGTH][LCLIENT_NODES]*ClientData
 	CloseLastGetNodes   time.Time
 	CloseBootstrapTimes uint32
 
@@ -231,33 +238,45 @@ type DHT struct {
 
 	SharedKeysRecv map[string]*SharedKey // binpk =>
 	SharedKeysSent map[string]*SharedKey // binpk =>
+	shrkeymu       sync.Mutex            // of SharedKeysRecv and SharedKeysSent, Bootstrap runs on caller's goroutine
 
 	CryptoPacketHandlers map[uint8]CryptoPacketHandle
+	cphandlermu          sync.RWMutex // of CryptoPacketHandlers, registered on a running DHT
 
 	ToBootstrap        *PriorityList // [MAX_CLOSE_TO_BOOTSTRAP_NODES]*NodeFormat
 	lastDoClosestState [6]int
+
+	getnodesPings *PingRegistry // ping ids of sent getnodes, sendnodes must match one
+
+	HolePunchingEnabled bool // punch holes to friends behind symmetric NAT, default true
+
+	nodesRespFunc atomic.Value // func(pubkey, addr, rtt), see SetCallbackNodesResponse
 }
 
-func NewDHT() *DHT {
+func NewDHT() *DHT { return NewDHTWithNetworkCore(NewNetworkCore()) }
+
+// DHT on a NetworkCore listened by caller, like new_dht
+func NewDHTWithNetworkCore(neto *NetworkCore) *DHT {
 	this := &DHT{}
-	this.Neto = NewNetworkCore()
+	this.Neto = neto
 	this.Pingo = NewPing(this, this.SelfPubkey, this.Neto)
 
 	this.SelfPubkey, this.SelfSeckey, _ = NewCBKeyPair()
-	log.Println(this.SelfPubkey.ToHex(), this.SelfSeckey.ToHex())
+	log.Println(this.SelfPubkey.ToHex(), logkey(this.SelfSeckey))
 
 	this.SharedKeysRecv = make(map[string]*SharedKey)
 	this.SharedKeysSent = make(map[string]*SharedKey)
-	this.CloseClientList = NewPriorityList(LCLIENT_LIST)
+	this.CloseClientList = NewNodeTable(this.SelfPubkey)
+	this.getnodesPings = NewPingRegistry(DHT_PING_ARRAY_SIZE, PING_TIMEOUT*time.Second)
 	this.FriendsList = NewPriorityList(int(math.MaxInt32))
 	this.ToBootstrap = NewPriorityList(MAX_CLOSE_TO_BOOTSTRAP_NODES) //(MAX_CLOSE_TO_BOOTSTRAP_NODES)
 	this.CryptoPacketHandlers = make(map[uint8]CryptoPacketHandle)
+	this.HolePunchingEnabled = true
 
 	this.Neto.RegisterHandle(NET_PACKET_GET_NODES, this.HandleGetNodes, this)
 	this.Neto.RegisterHandle(NET_PACKET_SEND_NODES_IPV6, this.HandleSendNodesIpv6, this)
 	this.Neto.RegisterHandle(NET_PACKET_CRYPTO, this.HandleCryptoPacket, this)
-	// this.RegisterHandleCryptoPacket(ptype uint8, cbfn CryptoPacketHandleFunc, object interface{})
-	// this.RegisterHandleCryptoPacket(ptype uint8, cbfn CryptoPacketHandleFunc, object interface{})
+	this.RegisterHandleCryptoPacket(CRYPTO_PACKET_NAT_PING, this.HandleNATPing, this)
 
 	this.start()
 	return this
@@ -273,8 +292,8 @@ func (this *DHT) start() { go this.doDHT() }
 func (this *DHT) doDHT() {
 	closesttm := time.NewTicker(3 * time.Second)
 	frndtm := time.NewTicker(5 * time.Second)
-	nattm := time.NewTicker(6 * time.Second)
-	pingtm := time.NewTicker(PING_INTERVAL * time.Second)
+	nattm := time.NewTicker(1 * time.Second)
+	pingtm := time.NewTicker(TIME_TO_PING * time.Second)
 	doneC := make(chan struct{}, 0)
 	stop := false
 	for !stop {
@@ -301,6 +320,9 @@ func (this *DHT) doClosest() {
 	// getnodes from ToBootstrap
 	// this.BootstrapFromAddr(serv_addr, NewCryptoKeyFromHex(serv_pubkey_str))
 	sentOfBS, sentOfClosest, sentOfFakeBS := 0, 0, 0
+	if n := this.CloseClientList.KillTimedOut(time.Now()); n > 0 {
+		log.Println("killed timeout nodes:", n, this.CloseClientList.Len())
+	}
 	items := this.ToBootstrap.Head(this.ToBootstrap.Len())
 	if true {
 		if len(items) > 0 {
@@ -399,7 +421,7 @@ func (this *DHT) doDHTFriends() {
 			this.GetNodes(node.Addr, node.Pubkey, frndo.Pubkey)
 			n += 1
 			if n == 1 {
-				frndid = frndo.Pubkey.ToHex()[:20]
+				frndid = frndo.Pubkey.String()
 			}
 		})
 		frndo.ClientList.EachSnap(func(itemi PLItem) {
@@ -415,7 +437,7 @@ func (this *DHT) doDHTFriends() {
 			if itemi.(*NodeFormat).Key() == frndo.Key() {
 				frndSeen = true
 				frndAddr = itemi.(*NodeFormat).Addr.String()
-				// log.Println("seen from frndo.ClientList:", frndo.Pubkey.ToHex()[:20])
+				// log.Println("seen from frndo.ClientList:", frndo.Pubkey)
 				frndSeenAt = append(frndSeenAt, "frndo.ClientList")
 				return
 			}
@@ -423,7 +445,7 @@ func (this *DHT) doDHTFriends() {
 		frndo.ToBootstrap.EachSnap(func(itemi PLItem) {
 			if itemi.(*NodeFormat).Key() == frndo.Key() {
 				// frndSeen = true
-				// log.Println("seen from frndo.ToBootstrap:", frndo.Pubkey.ToHex()[:20])
+				// log.Println("seen from frndo.ToBootstrap:", frndo.Pubkey)
 				frndSeenAt = append(frndSeenAt, "frndo.ToBootstrap")
 				return
 			}
@@ -431,12 +453,12 @@ func (this *DHT) doDHTFriends() {
 		this.CloseClientList.EachSnap(func(itemi PLItem) {
 			if itemi.(*ClientData).Key() == frndo.Key() {
 				// frndSeen = true
-				// log.Println("seen from dht.ClientList:", frndo.Pubkey.ToHex()[:20])
+				// log.Println("seen from dht.ClientList:", frndo.Pubkey)
 				frndSeenAt = append(frndSeenAt, "dht.ClientList")
 				return
 			}
 		})
-		log.Println("frndSeen:", frndSeen, frndAddr, frndSeenAt, frndo.Pubkey.ToHex()[:20])
+		log.Println("frndSeen:", frndSeen, frndAddr, frndSeenAt, frndo.Pubkey)
 		if !frndSeen {
 			slts := this.CloseClientList.SelectRandn(48)
 			for _, itemi := range slts {
@@ -450,11 +472,11 @@ func (this *DHT) doDHTFriends() {
 		log.Println("sent getnodes for friends:", this.FriendsList.Len(), n, frndid)
 	}
 }
-func (this *DHT) doNAT() {
-
-}
+func (this *DHT) doNAT() { this.doNATAt(time.Now()) }
 func (this *DHT) doToPing() {
-
+	for _, node := range this.Pingo.takeToPing() {
+		this.GetNodes(node.Addr, node.Pubkey, this.SelfPubkey)
+	}
 }
 func (this *DHT) doHardening() {
 
@@ -462,78 +484,84 @@ func (this *DHT) doHardening() {
 
 func (this *DHT) HandleGetNodes(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
 	log.Println("Handle getnodes request:", addr.String(), len(data))
+	if len(data) != 1+PUBLIC_KEY_SIZE+NONCE_SIZE+PUBLIC_KEY_SIZE+8+MAC_SIZE {
+		return 1, errors.Errorf("Invalid getnodes length: %d", len(data))
+	}
 	peerpk := NewCryptoKey(data[1 : 1+PUBLIC_KEY_SIZE])
+	if peerpk.Equal(this.SelfPubkey.Bytes()) {
+		return 1, errors.New("Getnodes from self")
+	}
 	nonce := NewCBNonce(data[1+PUBLIC_KEY_SIZE : 1+PUBLIC_KEY_SIZE+NONCE_SIZE])
-	log.Println("getnodes from:", peerpk.ToHex20(), nonce.ToHex20(), "have:", this.CloseClientList.Len(), addr)
+	log.Println("getnodes from:", peerpk.ToHex20(), logkey(nonce), "have:", this.CloseClientList.Len(), addr)
 	shrkey := this.GetSharedKeyRecv(peerpk)
 	plnpkt, err := DecryptDataSymmetric(shrkey, nonce, data[1+PUBLIC_KEY_SIZE+NONCE_SIZE:])
-	gopp.ErrPrint(err)
+	if err != nil || len(plnpkt) != PUBLIC_KEY_SIZE+8 {
+		return 1, errors.Errorf("Invalid getnodes packet: %v", err)
+	}
 	searchpk := NewCryptoKey(plnpkt[0:PUBLIC_KEY_SIZE])
 	sbdata := plnpkt[PUBLIC_KEY_SIZE:]
-	gopp.Assert(len(plnpkt) == PUBLIC_KEY_SIZE+8, "Invalid packet")
-	gopp.Assert(len(sbdata) == 8, "Invalid packet")
 
 	this.sendnodes_ipv6(addr, peerpk, searchpk, sbdata, shrkey)
+	this.add_to_ping(peerpk, addr)
 
 	return 0, nil
 }
 
 func (this *DHT) HandleSendNodesIpv6(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
 	// log.Println(addr.String(), len(data))
+	const minlen = 1 + PUBLIC_KEY_SIZE + NONCE_SIZE + 1 + 8 + MAC_SIZE
+	if len(data) < minlen || len(data) > minlen+MAX_SENT_NODES*PACKED_NODE_SIZE_IP6 {
+		return 1, errors.Errorf("Invalid sendnodes length: %d", len(data))
+	}
 	pubkey := NewCryptoKey(data[1 : 1+PUBLIC_KEY_SIZE])
 	nonce := NewCBNonce(data[1+PUBLIC_KEY_SIZE : 1+PUBLIC_KEY_SIZE+NONCE_SIZE])
 	encrypted := data[1+PUBLIC_KEY_SIZE+NONCE_SIZE:]
 	shrkey := this.GetSharedKeySent(pubkey)
 	plain, err := DecryptDataSymmetric(shrkey, nonce, encrypted)
-	gopp.ErrPrint(err)
-
-	plainBuf := gopp.NewBufferBuf(plain)
-	numNodes, err := plainBuf.ReadByte()
-	gopp.ErrPrint(err)
-	// log.Println("numNodes=", numNodes)
-	var pingid uint64
-	reqidpos := len(plain) - int(unsafe.Sizeof(pingid))
-	err = binary.Read(plainBuf.RBufAt(reqidpos), binary.BigEndian, &pingid)
-	gopp.ErrPrint(err, reqidpos)
-	// log.Println("pingid=", pingid)
-	// TODO check pingid is our sent
-
-	//
-	for i, offset := 0, 1; i < int(numNodes); i++ {
-		tmpbuf := plainBuf.RBufAt(offset)
-		tmplen := tmpbuf.Len()
-		byte0, err := tmpbuf.ReadByte()
-		gopp.ErrPrint(err)
-
-		istcp := byte0&128 == 1
-		isip6 := byte0&127 == 10
-		// log.Printf("node: %d, %s, %s\n", i, gopp.IfElseStr(istcp, "TCP", "UDP"),
-		//	gopp.IfElseStr(isip6, "IPV6", "IPV4"))
-		var ipobj net.IP = make([]byte, gopp.IfElseInt(isip6, 16, 4))
-		tmpbuf.Read(ipobj)
-		// var ipobj net.IP = gopp.BytesReverse(ipbuf)
-		var port uint16
-		binary.Read(tmpbuf, binary.BigEndian, &port)
-		addro := gopp.IfElse(istcp, &net.TCPAddr{Port: int(port), IP: ipobj}, &net.UDPAddr{Port: int(port), IP: ipobj}).(net.Addr)
+	if err != nil {
+		return 1, err
+	}
 
-		nodekey_, err := tmpbuf.Readn(PUBLIC_KEY_SIZE)
-		nodekey := NewCryptoKey(nodekey_)
-		// log.Println("node: ", i, addro.Network(), addro.String(), nodekey.ToHex())
+	numNodes := int(plain[0])
+	if numNodes > MAX_SENT_NODES {
+		return 1, errors.Errorf("Too many nodes: %d", numNodes)
+	}
+	pingid := binary.BigEndian.Uint64(plain[len(plain)-8:])
+	rtt, ok := this.getnodesPings.Match(pingid)
+	if !ok {
+		return 1, errors.Errorf("Unknown sendnodes ping id: %d, %v", pingid, addr)
+	}
+	if f, _ := this.nodesRespFunc.Load().(func(*CryptoKey, net.Addr, time.Duration)); f != nil {
+		f(pubkey, addr, rtt)
+	}
 
-		offset += tmplen - tmpbuf.Len()
+	// responded our getnodes, so the sender is alive
+	clidat := &ClientData{Pubkey: pubkey, cmppk: this.SelfPubkey}
+	clidat.Assoc.Addr = addr
+	clidat.Assoc.RetAddr = addr
+	clidat.Assoc.Timestamp = time.Now()
+	clidat.Assoc.LastPinged = time.Now()
+	clidat.Assoc.RetTimestamp = time.Now()
+	this.CloseClientList.Put(clidat)
+
+	nodesdat := plain[1 : len(plain)-8]
+	for i, offset := 0, 0; i < numNodes; i++ {
+		node, n, err := UnpackNode(nodesdat[offset:])
+		if err != nil {
+			return 1, err
+		}
+		offset += n
+		if node.Pubkey.Equal(this.SelfPubkey.Bytes()) {
+			continue
+		}
 
 		// process node
-		nodfmt := &NodeFormat{Pubkey: nodekey, Addr: addro, cmppk: this.SelfPubkey}
+		nodfmt := &NodeFormat{Pubkey: node.Pubkey, Addr: node.Addr, cmppk: this.SelfPubkey}
 		this.ToBootstrap.Put(nodfmt)
-
-		clidat := &ClientData{Pubkey: nodekey, cmppk: this.SelfPubkey}
-		clidat.Assoc.Addr = addro
-		clidat.Assoc.RetAddr = addro
-		clidat.Assoc.Timestamp = time.Now()
-		clidat.Assoc.LastPinged = time.Now()
-		clidat.Assoc.RetTimestamp = time.Now()
-		this.CloseClientList.Put(clidat)
-		// log.Println("tobslen:", numNodes, this.ToBootstrap.Len(), "closestlen:", this.CloseClientList.Len())
+		this.noteReturnedAddr(pubkey, addr, node)
+		if _, istcp := node.Addr.(*net.TCPAddr); !istcp {
+			this.add_to_ping(node.Pubkey, node.Addr)
+		}
 
 		this.FriendsList.EachInline(func(itemi PLItem) { itemi.(*DHTFriend).AddNode(nodfmt) })
 	}
@@ -541,14 +569,64 @@ func (this *DHT) HandleSendNodesIpv6(object interface{}, addr net.Addr, data []b
 	return 0, nil
 }
 
-func (this *DHT) HandleCryptoPacket(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
-	log.Println(addr.String(), len(data))
-	return 0, nil
+/* Create a request to peer.
+ * packet format: [NET_PACKET_CRYPTO][recvpk][sendpk][nonce][enc(request_id|data)]
+ */
+func (this *DHT) createRequest(recvpk *CryptoKey, reqid uint8, data []byte) ([]byte, error) {
+	if len(data)+CRYPTO_SIZE+1+MAC_SIZE > MAX_CRYPTO_REQUEST_SIZE {
+		return nil, errors.Errorf("Request too long: %d", len(data))
+	}
+	nonce := CBRandomNonce()
+	shrkey := this.GetSharedKeySent(recvpk)
+	encrypted, err := EncryptDataSymmetric(shrkey, nonce, append([]byte{reqid}, data...))
+	if err != nil {
+		return nil, err
+	}
+	pkt := gopp.NewBufferZero()
+	pkt.WriteByte(byte(NET_PACKET_CRYPTO))
+	pkt.Write(recvpk.Bytes())
+	pkt.Write(this.SelfPubkey.Bytes())
+	pkt.Write(nonce.Bytes())
+	pkt.Write(encrypted)
+	return pkt.Bytes(), nil
+}
+
+/* Handle a request addressed to us, return sender pk, request_id and data. */
+func (this *DHT) handleRequest(pkt []byte) (sendpk *CryptoKey, reqid uint8, data []byte, err error) {
+	sendpk = NewCryptoKey(pkt[1+PUBLIC_KEY_SIZE : 1+2*PUBLIC_KEY_SIZE])
+	nonce := NewCBNonce(pkt[1+2*PUBLIC_KEY_SIZE : CRYPTO_SIZE])
+	shrkey := this.GetSharedKeyRecv(sendpk)
+	plain, err := DecryptDataSymmetric(shrkey, nonce, pkt[CRYPTO_SIZE:])
+	if err != nil || len(plain) == 0 {
+		return nil, 0, nil, errors.Errorf("Invalid request: %v", err)
+	}
+	return sendpk, plain[0], plain[1:], nil
 }
 
-func (this *DHT) HandleNATPing(object interface{}, addr net.Addr, srcpk *CryptoKey, data []byte, cbdata interface{}) (int, error) {
-	log.Println(addr.String(), len(data))
-	return 0, nil
+// like cryptopacket_handle, ours dispatched by request id, others routed to close nodes
+func (this *DHT) HandleCryptoPacket(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) <= CRYPTO_SIZE+MAC_SIZE || len(data) > MAX_CRYPTO_REQUEST_SIZE+MAC_SIZE {
+		return 1, errors.Errorf("Invalid crypto packet length: %d", len(data))
+	}
+	recvpk := NewCryptoKey(data[1 : 1+PUBLIC_KEY_SIZE])
+	if !recvpk.Equal(this.SelfPubkey.Bytes()) {
+		/* If request is not for us, try routing it. */
+		itemi := this.CloseClientList.GetByKey(recvpk.BinStr())
+		if itemi == nil || IsTimeout4Now(itemi.(*ClientData).Assoc.Timestamp, BAD_NODE_TIMEOUT) {
+			return 1, errors.Errorf("No route for crypto packet: %s", recvpk.ToHex20())
+		}
+		_, err := this.Neto.WriteTo(data, itemi.(*ClientData).Assoc.Addr)
+		return 0, err
+	}
+	srcpk, reqid, plain, err := this.handleRequest(data)
+	if err != nil {
+		return 1, err
+	}
+	handle, ok := this.cryptoPacketHandler(reqid)
+	if !ok {
+		return 1, errors.Errorf("Unknown crypto packet request id: %d", reqid)
+	}
+	return handle.Func(handle.Object, addr, srcpk, plain, cbdata)
 }
 func (this *DHT) HandleHardingPacket(object interface{}, addr net.Addr, srcpk *CryptoKey, data []byte, cbdata interface{}) (int, error) {
 	log.Println(addr.String(), len(data))
@@ -556,14 +634,24 @@ func (this *DHT) HandleHardingPacket(object interface{}, addr net.Addr, srcpk *C
 }
 
 func (this *DHT) RegisterHandleCryptoPacket(ptype uint8, cbfn CryptoPacketHandleFunc, object interface{}) {
+	this.cphandlermu.Lock()
+	defer this.cphandlermu.Unlock()
 	this.CryptoPacketHandlers[ptype] = CryptoPacketHandle{cbfn, object}
 }
 
+func (this *DHT) cryptoPacketHandler(ptype uint8) (CryptoPacketHandle, bool) {
+	this.cphandlermu.RLock()
+	defer this.cphandlermu.RUnlock()
+	h, ok := this.CryptoPacketHandlers[ptype]
+	return h, ok
+}
+
 /* Send a getnodes request.
    sendback_node is the node that it will send back the response to (set to NULL to disable this) */
 func (this *DHT) GetNodes(addr net.Addr, pubkey *CryptoKey, client_id *CryptoKey) {
 	pingid := rand.Uint64()
 	gopp.CmpAndSwapN(&pingid, 0, 1)
+	this.getnodesPings.Add(pingid)
 
 	plain := gopp.NewBufferZero()
 	plain.Write(client_id.Bytes())
@@ -587,7 +675,15 @@ func (this *DHT) GetNodes(addr net.Addr, pubkey *CryptoKey, client_id *CryptoKey
 	// log.Println("Sent getnodes request:", len(pkt), addr.String(), pingid)
 }
 
+// f called when a sendnodes answered our getnodes, with its round trip time, nil to unset
+func (this *DHT) SetCallbackNodesResponse(f func(pubkey *CryptoKey, addr net.Addr, rtt time.Duration)) {
+	this.nodesRespFunc.Store(f)
+}
+
 func (this *DHT) Bootstrap(addr net.Addr, pubkey *CryptoKey) error {
+	if !this.Neto.UDPEnabled() {
+		return errors.New("UDP disabled, bootstrap by TCP relay instead")
+	}
 	this.GetNodes(addr, pubkey, this.SelfPubkey)
 	return nil
 }
@@ -657,6 +753,58 @@ func (this *DHT) AddFriend(pubkey *CryptoKey, IPCallback func(interface{}, int32
 	return
 }
 
+func (this *DHT) DelFriend(pubkey *CryptoKey) bool {
+	itemi := this.FriendsList.GetByKey(pubkey.BinStr())
+	if itemi == nil {
+		return false
+	}
+	return this.FriendsList.Remove(itemi)
+}
+
+// like DHT_getfriendip, addr of friend seen in its client list
+func (this *DHT) GetFriendIP(pubkey *CryptoKey) net.Addr {
+	itemi := this.FriendsList.GetByKey(pubkey.BinStr())
+	if itemi == nil {
+		return nil
+	}
+	itemi2 := itemi.(*DHTFriend).ClientList.GetByKey(pubkey.BinStr())
+	if itemi2 == nil {
+		return nil
+	}
+	return itemi2.(*NodeFormat).Addr
+}
+
+// GetClosestNodes returns at most n good nodes we know closest to pubkey,
+// from the close list and friends' client lists.
+func (this *DHT) GetClosestNodes(pubkey *CryptoKey, n int) []*NodeFormat {
+	return this.closestNodes(pubkey, n, true)
+}
+
+func (this *DHT) closestNodes(pubkey *CryptoKey, n int, begood bool) (rets []*NodeFormat) {
+	seen := map[string]bool{}
+	for _, clidat := range this.CloseClientList.Closest(pubkey, n, begood) {
+		seen[clidat.Key()] = true
+		rets = append(rets, &NodeFormat{Pubkey: clidat.Pubkey, Addr: clidat.Assoc.Addr, cmppk: pubkey})
+	}
+	this.FriendsList.EachSnap(func(itemi PLItem) {
+		itemi.(*DHTFriend).ClientList.EachSnap(func(itemj PLItem) {
+			node := itemj.(*NodeFormat)
+			if seen[node.Key()] || node.Pubkey.Equal(pubkey.Bytes()) {
+				return
+			}
+			seen[node.Key()] = true
+			rets = append(rets, &NodeFormat{Pubkey: node.Pubkey, Addr: node.Addr, cmppk: pubkey})
+		})
+	})
+	sort.Slice(rets, func(i, j int) bool {
+		return bytes.Compare(IDDistance(pubkey, rets[i].Pubkey), IDDistance(pubkey, rets[j].Pubkey)) < 0
+	})
+	if len(rets) > n {
+		rets = rets[:n]
+	}
+	return
+}
+
 func (this *DHT) GetSharedKeyRecv(pubkey *CryptoKey) *CryptoKey {
 	return this.GetSharedKey(this.SharedKeysRecv, pubkey)
 }
@@ -664,6 +812,8 @@ func (this *DHT) GetSharedKeySent(pubkey *CryptoKey) *CryptoKey {
 	return this.GetSharedKey(this.SharedKeysSent, pubkey)
 }
 func (this *DHT) GetSharedKey(shrkeys map[string]*SharedKey, pubkey *CryptoKey) *CryptoKey {
+	this.shrkeymu.Lock()
+	defer this.shrkeymu.Unlock()
 	if shrkeyo, ok := shrkeys[pubkey.BinStr()]; ok {
 		return shrkeyo.Shrkey
 	} else {
@@ -1,15 +1,23 @@
 package mintox
 
 import (
+	"context"
 	"crypto/sha256"
 	"gopp"
 	"log"
+	"net"
+	"os"
+	"strconv"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 func MainBootstrapNode() {
 	bsnodeo := NewBootstrapNode()
-	bsnodeo.Start()
+	if err := bsnodeo.Start(); err != nil {
+		log.Fatalln(err)
+	}
 	go func() {
 		time.Sleep(3 * time.Second)
 		host, pubkeyh := bsnodes[6], bsnodes[7]
@@ -29,17 +37,26 @@ func MainBootstrapNode() {
 type BootstrapNode struct {
 	is_waiting_for_dht_connection bool
 
-	PORT  uint16   // udp
-	ports []uint16 // tcp
+	cfg *BootstrapdConfig
 
 	seckey  *CryptoKey
 	pubkey  *CryptoKey
 	dhto    *DHT
 	tcpsrvo *TCPServer
+	bsro    *Bootstrapper // of cfg.BootstrapNodes, nil if none
 
-	// oniono *Onion
+	oniono  *Onion
 	onionao *Onion_Announce
 	// landiso *LanDiscovery
+
+	startedAt time.Time
+}
+
+// numbers for dynamic motd, see SetMOTDFunc
+type BootstrapNodeStats struct {
+	Uptime   time.Duration
+	DHTNodes int // in close list
+	TCPConns int // relay conns, confirmed and in handshake
 }
 
 func NewBootstrapNode() *BootstrapNode {
@@ -49,32 +66,174 @@ func NewBootstrapNode() *BootstrapNode {
 	return this
 }
 
+// keys loaded from cfg.KeysFilePath, or created and saved there if not exist
+func NewBootstrapNodeFromConfig(cfg *BootstrapdConfig) (*BootstrapNode, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	this := &BootstrapNode{}
+	this.is_waiting_for_dht_connection = true
+	this.cfg = cfg
+	var err error
+	this.pubkey, this.seckey, err = LoadBootstrapdKeys(cfg.KeysFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
 func (this *BootstrapNode) setInitVars() {
-	this.PORT = 54432
-	this.ports = []uint16{this.PORT, 4433, 3389}
+	this.cfg = DefaultBootstrapdConfig()
+	this.cfg.Port = 54432
+	this.cfg.TCPRelayPorts = []uint16{this.cfg.Port, 4433, 3389}
+	this.cfg.Motd = "This is a test motd of pgobs"
 	binskca := sha256.Sum256([]byte("TODO tox bootstrap node secret key"))
 	this.seckey = NewCryptoKey(binskca[:])
 	this.pubkey = CBDerivePubkey(this.seckey)
 }
 
-func (this *BootstrapNode) Start() {
-	log.Println("Listen on:", "UDP:", this.PORT, "TCP:", this.ports)
+// like tox-bootstrapd main: networking, DHT, onion, TCP relay, then bootstrap to other nodes
+func (this *BootstrapNode) Start() error {
+	cfg := this.cfg
+	neto, err := this.listenUDP()
+	if err != nil {
+		return err
+	}
+	log.Println("Listen on:", "UDP:", neto.LocalAddr(), "TCP:", cfg.TCPRelayPorts)
 	log.Println("DHT Public key:", this.pubkey.ToHex())
+	this.startedAt = time.Now()
 
-	this.dhto = NewDHT()
+	this.dhto = NewDHTWithNetworkCore(neto)
 	this.dhto.SetKeyPair(this.pubkey, this.seckey)
 	// onion
+	this.oniono = this.dhto.NewOnion()
 	this.onionao = NewOnionAnnounce(this.dhto)
 
-	this.dhto.Neto.BootstrapSetCallback(1, "This is a test motd of pgobs")
+	if cfg.EnableMotd {
+		// sent with trailing nul like tox-bootstrapd
+		neto.BootstrapSetCallback(BOOTSTRAPD_VERSION, cfg.Motd+"\x00")
+	}
 
-	this.tcpsrvo = NewTCPServer(this.ports, this.seckey, nil)
-	this.tcpsrvo.Start()
+	if cfg.EnableTCPRelay {
+		tcpcfg := DefaultTCPServerConfig()
+		tcpcfg.Ports = cfg.TCPRelayPorts
+		tcpcfg.AddrFamily = gopp.IfElseStr(cfg.EnableIPv6, TCP_FAMILY_DUAL, TCP_FAMILY_IPV4)
+		tcpcfg.Seckey = this.seckey
+		tcpcfg.Oniono = this.oniono
+		this.tcpsrvo, err = NewTCPServerFromConfig(tcpcfg)
+		if err != nil {
+			this.Kill()
+			return err
+		}
+		if cfg.EnableMotd {
+			gopp.ErrPrint(this.tcpsrvo.SetMOTD(cfg.Motd + "\x00"))
+		}
+		this.tcpsrvo.Start()
+	}
 
-	// dht bootstrap
+	// dht bootstrap, again when close list shrinks
+	if len(cfg.BootstrapNodes) > 0 {
+		var nodes []NodeAddr
+		for _, node := range cfg.BootstrapNodes {
+			nodes = append(nodes, NodeAddr{PublicKey: node.PublicKey, IPv4: node.Address, Port: node.Port})
+		}
+		this.bsro = NewBootstrapper(this.dhto, nodes)
+		this.bsro.Start()
+	}
 
 	// lan discovery
+	if cfg.EnableLanDiscovery {
+		log.Println("LAN discovery not supported, ignored")
+	}
+	return nil
+}
+
+// ipv6 dual stack when enabled, ipv4 if that failed and fallback enabled
+func (this *BootstrapNode) listenUDP() (*NetworkCore, error) {
+	cfg := this.cfg
+	if cfg.EnableIPv6 {
+		neto, err := NewNetworkCoreFromAddr("udp", &net.UDPAddr{IP: net.IPv6unspecified, Port: int(cfg.Port)})
+		if err == nil || !cfg.EnableIPv4Fallback {
+			return neto, err
+		}
+		log.Println("Listen IPv6 failed, fallback to IPv4:", err)
+	}
+	return NewNetworkCoreFromAddr("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: int(cfg.Port)})
+}
+
+func (this *BootstrapNode) Pubkey() *CryptoKey { return this.pubkey }
 
+func (this *BootstrapNode) Stats() (st BootstrapNodeStats) {
+	st.Uptime = time.Since(this.startedAt)
+	if this.dhto != nil {
+		st.DHTNodes = this.dhto.CloseClientList.Len()
+	}
+	if this.tcpsrvo != nil {
+		st.TCPConns = this.tcpsrvo.ConnCount()
+	}
+	return
+}
+
+// motd generated per info request on UDP and TCP, like the uptime motd of
+// some public nodes, cut to MAX_MOTD_LENGTH. Call after Start, nil for cfg.Motd.
+func (this *BootstrapNode) SetMOTDFunc(fn func(st BootstrapNodeStats) string) {
+	var motdfn func() string
+	if fn != nil {
+		motdfn = func() string { return fn(this.Stats()) + "\x00" }
+	}
+	this.dhto.Neto.SetMOTDFunc(motdfn)
+	if this.tcpsrvo != nil {
+		this.tcpsrvo.SetMOTDFunc(motdfn)
+	}
+}
+
+// udp addr, nil before started
+func (this *BootstrapNode) UDPAddr() net.Addr {
+	if this.dhto == nil {
+		return nil
+	}
+	return this.dhto.Neto.LocalAddr()
+}
+
+// tcp relay addrs, nil if relay not enabled
+func (this *BootstrapNode) TCPAddrs() []net.Addr {
+	if this.tcpsrvo == nil {
+		return nil
+	}
+	return this.tcpsrvo.Addrs()
+}
+
+func (this *BootstrapNode) Kill() {
+	if this.bsro != nil {
+		this.bsro.Stop()
+	}
+	if this.tcpsrvo != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		err := this.tcpsrvo.Shutdown(ctx)
+		cancel()
+		gopp.ErrPrint(err)
+	}
+	if this.onionao != nil {
+		this.onionao.Kill()
+		this.oniono.Kill()
+	}
+	if this.dhto != nil {
+		this.dhto.Neto.Close()
+	}
+}
+
+// keys file of tox-bootstrapd, see KeyFile, created if not exist
+func LoadBootstrapdKeys(filename string) (pk *CryptoKey, sk *CryptoKey, err error) {
+	kf, err := ReadKeyFile(filename)
+	if os.IsNotExist(errors.Cause(err)) {
+		if kf, err = NewKeyFile(); err == nil {
+			err = kf.SaveNew(filename)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return kf.Pubkey, kf.Seckey, nil
 }
 
 //////
@@ -98,3 +257,13 @@ type NodeAddr struct {
 }
 
 func (this *NodeAddr) SupportTCP() bool { return len(this.TCPPorts) > 0 }
+
+// udp host:port, ipv4 first, empty for none. "-" is none in nodes.tox.chat json
+func (this *NodeAddr) Addr() string {
+	for _, host := range []string{this.IPv4, this.IPv6} {
+		if host != "" && host != "-" {
+			return net.JoinHostPort(host, strconv.Itoa(int(this.Port)))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package mintox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBootstrapNodeFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootstrapd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := DefaultBootstrapdConfig()
+	cfg.KeysFilePath = filepath.Join(dir, "keys")
+	cfg.Port = 0
+	cfg.TCPRelayPorts = []uint16{0}
+	cfg.EnableIPv6 = false
+	cfg.EnableLanDiscovery = false
+	cfg.Motd = "test motd"
+
+	node, err := NewBootstrapNodeFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys saved and loaded again
+	node2, err := NewBootstrapNodeFromConfig(cfg)
+	if err != nil || !node2.Pubkey().Equal2(node.Pubkey()) {
+		t.Fatal("keys not reloaded:", err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Kill()
+
+	port := node.UDPAddr().(*net.UDPAddr).Port
+	c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := make([]byte, INFO_REQUEST_PACKET_LENGTH)
+	req[0] = BOOTSTRAP_INFO_PACKET_ID
+	c.Write(req[:10]) // wrong length ignored
+	c.Write(req)
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	rsp := make([]byte, 1+4+MAX_MOTD_LENGTH)
+	n, err := c.Read(rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp = rsp[:n]
+	if rsp[0] != BOOTSTRAP_INFO_PACKET_ID || binary.BigEndian.Uint32(rsp[1:]) != BOOTSTRAPD_VERSION ||
+		!bytes.Equal(rsp[5:], []byte("test motd\x00")) {
+		t.Errorf("info response: %q", rsp)
+	}
+
+	pk, sk, _ := NewCBKeyPair()
+	cli := NewTCPClient(node.TCPAddrs()[0].String(), node.Pubkey(), pk, sk)
+	defer cli.Close()
+	if !waitTstCond(3*time.Second, func() bool { return cli.Status == TCP_CLIENT_CONFIRMED }) {
+		t.Error("tcp relay not confirmed")
+	}
+}
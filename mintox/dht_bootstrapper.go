@@ -0,0 +1,259 @@
+package mintox
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bootstrapper keeps a DHT connected from a list of bootstrap nodes, like the
+// json published at nodes.tox.chat. All nodes are probed with getnodes
+// concurrently every ProbeInterval, scored by answers and latency, and the
+// best ones asked again whenever the close list shrinks under MinCloseNodes.
+
+const DHT_BOOTSTRAP_PROBE_INTERVAL = 300 // seconds, health probe of all nodes
+const DHT_BOOTSTRAP_CHECK_INTERVAL = 5   // seconds, close list check
+const DHT_BOOTSTRAP_MIN_CLOSE = 8        // close nodes wanted
+const DHT_BOOTSTRAP_COUNT = 4            // best nodes asked on each re-bootstrap
+const DHT_BOOTSTRAP_MAX_FAILS = 3        // unanswered probes in a row before unhealthy
+
+// health of one bootstrap node
+type BootstrapNodeHealth struct {
+	Node         NodeAddr
+	Pubkey       *CryptoKey
+	Addr         *net.UDPAddr  // resolved, nil if not yet or failed
+	Probes       int           // getnodes sent, resolve failures included
+	Answers      int           // sendnodes received for them
+	Fails        int           // probes unanswered in a row
+	RTT          time.Duration // smoothed, 0 if never answered
+	LastAnswerAt time.Time
+
+	probeAt time.Time // outstanding probe, zero if none
+}
+
+func (this *BootstrapNodeHealth) Healthy() bool {
+	return this.Addr != nil && this.Fails < DHT_BOOTSTRAP_MAX_FAILS
+}
+
+// answer ratio over latency, higher is better, 0 if never resolved
+func (this *BootstrapNodeHealth) Score() float64 {
+	if this.Addr == nil {
+		return 0
+	}
+	rtt := this.RTT
+	if rtt == 0 {
+		rtt = PING_TIMEOUT * time.Second / 2
+	}
+	success := float64(this.Answers+1) / float64(this.Probes+2)
+	return success / (1 + rtt.Seconds()) / float64(1+this.Fails)
+}
+
+type Bootstrapper struct {
+	MinCloseNodes  int           // re-bootstrap when close list under, default DHT_BOOTSTRAP_MIN_CLOSE
+	BootstrapCount int           // best nodes asked each re-bootstrap, default DHT_BOOTSTRAP_COUNT
+	ProbeInterval  time.Duration // default DHT_BOOTSTRAP_PROBE_INTERVAL seconds
+
+	dhto        *DHT
+	clock       clock
+	mu          sync.Mutex
+	nodes       map[string]*BootstrapNodeHealth // binpk =>
+	lastProbeAt time.Time                       // of all nodes
+	started     int32
+	stopC       chan struct{}
+	stopOnce    sync.Once
+}
+
+func NewBootstrapper(dhto *DHT, nodes []NodeAddr) *Bootstrapper {
+	this := &Bootstrapper{}
+	this.MinCloseNodes = DHT_BOOTSTRAP_MIN_CLOSE
+	this.BootstrapCount = DHT_BOOTSTRAP_COUNT
+	this.ProbeInterval = DHT_BOOTSTRAP_PROBE_INTERVAL * time.Second
+	this.dhto = dhto
+	this.clock = defaultClock
+	this.nodes = map[string]*BootstrapNodeHealth{}
+	this.stopC = make(chan struct{})
+	this.SetNodes(nodes)
+	return this
+}
+
+// SetNodes replaces the node list, health of nodes still listed kept. Nodes
+// with invalid pubkey or no address skipped, returns count of the kept.
+func (this *Bootstrapper) SetNodes(nodes []NodeAddr) int {
+	newnodes := map[string]*BootstrapNodeHealth{}
+	for _, node := range nodes {
+		pkb, err := hex.DecodeString(node.PublicKey)
+		if err != nil || len(pkb) != PUBLIC_KEY_SIZE || node.Addr() == "" {
+			log.Println("Invalid bootstrap node, skip:", node.PublicKey, node.Addr())
+			continue
+		}
+		pubkey := NewCryptoKey(pkb)
+		newnodes[pubkey.BinStr()] = &BootstrapNodeHealth{Node: node, Pubkey: pubkey}
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for binpk, h := range newnodes {
+		if oh, ok := this.nodes[binpk]; ok && oh.Node.Addr() == h.Node.Addr() {
+			oh.Node = h.Node
+			newnodes[binpk] = oh
+		}
+	}
+	this.nodes = newnodes
+	return len(newnodes)
+}
+
+// Start probes all nodes at once, then checks the close list every
+// DHT_BOOTSTRAP_CHECK_INTERVAL seconds till Stop.
+func (this *Bootstrapper) Start() {
+	if !atomic.CompareAndSwapInt32(&this.started, 0, 1) {
+		return
+	}
+	this.dhto.SetCallbackNodesResponse(this.onNodesResponse)
+	go this.run()
+}
+
+func (this *Bootstrapper) Stop() {
+	this.stopOnce.Do(func() {
+		close(this.stopC)
+		if atomic.LoadInt32(&this.started) == 1 {
+			this.dhto.SetCallbackNodesResponse(nil)
+		}
+	})
+}
+
+func (this *Bootstrapper) run() {
+	tickC, tickStop := this.clock.Tick(DHT_BOOTSTRAP_CHECK_INTERVAL * time.Second)
+	defer tickStop()
+	this.check(this.clock.Now())
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case <-tickC:
+		}
+		this.check(this.clock.Now())
+	}
+}
+
+// count unanswered probes, probe all nodes each ProbeInterval, else
+// re-bootstrap from the best nodes when close list shrunk
+func (this *Bootstrapper) check(now time.Time) {
+	this.mu.Lock()
+	for _, h := range this.nodes {
+		if !h.probeAt.IsZero() && now.Sub(h.probeAt) >= PING_TIMEOUT*time.Second {
+			h.probeAt = time.Time{}
+			h.Fails++
+		}
+	}
+	probeAll := this.lastProbeAt.IsZero() || now.Sub(this.lastProbeAt) >= this.ProbeInterval
+	if probeAll {
+		this.lastProbeAt = now
+	}
+	this.mu.Unlock()
+
+	if probeAll {
+		this.probe(this.sorted(0))
+		return
+	}
+	if n := this.dhto.CloseClientList.Len(); n < this.MinCloseNodes {
+		best := this.sorted(this.BootstrapCount)
+		log.Println("Close list shrunk, bootstrap:", n, len(best))
+		this.probe(best)
+	}
+}
+
+// Bootstrap asks the best nodes now, returns count of getnodes sent
+func (this *Bootstrapper) Bootstrap() int { return this.probe(this.sorted(this.BootstrapCount)) }
+
+// getnodes to nodes concurrently, names resolved first
+func (this *Bootstrapper) probe(hs []*BootstrapNodeHealth) int {
+	var sent int32
+	var wg sync.WaitGroup
+	for _, h := range hs {
+		wg.Add(1)
+		go func(h *BootstrapNodeHealth) {
+			defer wg.Done()
+			this.mu.Lock()
+			addr, hostport := h.Addr, h.Node.Addr()
+			this.mu.Unlock()
+			if addr == nil {
+				var err error
+				addr, err = net.ResolveUDPAddr("udp", hostport)
+				this.mu.Lock()
+				if err != nil {
+					h.Probes++
+					h.Fails++
+					this.mu.Unlock()
+					log.Println("Resolve bootstrap node failed:", hostport, err)
+					return
+				}
+				h.Addr = addr
+				this.mu.Unlock()
+			}
+			this.mu.Lock()
+			h.Probes++
+			if h.probeAt.IsZero() {
+				h.probeAt = this.clock.Now()
+			}
+			this.mu.Unlock()
+			if err := this.dhto.Bootstrap(addr, h.Pubkey); err == nil {
+				atomic.AddInt32(&sent, 1)
+			}
+		}(h)
+	}
+	wg.Wait()
+	return int(sent)
+}
+
+func (this *Bootstrapper) onNodesResponse(pubkey *CryptoKey, addr net.Addr, rtt time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	h, ok := this.nodes[pubkey.BinStr()]
+	if !ok || h.probeAt.IsZero() {
+		return
+	}
+	h.probeAt = time.Time{}
+	h.Answers++
+	h.Fails = 0
+	h.LastAnswerAt = this.clock.Now()
+	if h.RTT == 0 {
+		h.RTT = rtt
+	} else {
+		h.RTT = (7*h.RTT + rtt) / 8
+	}
+}
+
+// healthy first then by score, at most n, 0 for all
+func (this *Bootstrapper) sorted(n int) []*BootstrapNodeHealth {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	hs := make([]*BootstrapNodeHealth, 0, len(this.nodes))
+	for _, h := range this.nodes {
+		hs = append(hs, h)
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		if hs[i].Healthy() != hs[j].Healthy() {
+			return hs[i].Healthy()
+		}
+		return hs[i].Score() > hs[j].Score()
+	})
+	if n > 0 && len(hs) > n {
+		hs = hs[:n]
+	}
+	return hs
+}
+
+// Health of all nodes, best first
+func (this *Bootstrapper) Health() []BootstrapNodeHealth {
+	hs := this.sorted(0)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	healths := make([]BootstrapNodeHealth, len(hs))
+	for i, h := range hs {
+		healths[i] = *h
+	}
+	return healths
+}
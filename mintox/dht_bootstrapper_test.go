@@ -0,0 +1,98 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTstDHT(t *testing.T) *DHT {
+	neto, err := NewNetworkCoreFromAddr("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDHTWithNetworkCore(neto)
+}
+
+func tstNodeAddrOf(dhto *DHT) NodeAddr {
+	addr := dhto.Neto.LocalAddr().(*net.UDPAddr)
+	return NodeAddr{PublicKey: dhto.SelfPubkey.ToHex(), IPv4: addr.IP.String(), IPv6: "-", Port: uint16(addr.Port)}
+}
+
+func TestNodeAddrAddr(t *testing.T) {
+	node := NodeAddr{IPv4: "-", IPv6: "::1", Port: 33445}
+	if addr := node.Addr(); addr != "[::1]:33445" {
+		t.Error("ipv6 addr:", addr)
+	}
+	node.IPv4 = "node.tox.example"
+	if addr := node.Addr(); addr != "node.tox.example:33445" {
+		t.Error("ipv4 addr:", addr)
+	}
+	if addr := (&NodeAddr{IPv4: "-", IPv6: "-"}).Addr(); addr != "" {
+		t.Error("no addr:", addr)
+	}
+}
+
+func TestBootstrapper(t *testing.T) {
+	node := newTstDHT(t)
+	defer node.Neto.Close()
+	dhto := newTstDHT(t)
+	defer dhto.Neto.Close()
+
+	deadpk, _, _ := NewCBKeyPair()
+	dead := NodeAddr{PublicKey: deadpk.ToHex(), IPv4: "127.0.0.1", Port: 1}
+	invalid := NodeAddr{PublicKey: "1234", IPv4: "127.0.0.1", Port: 1}
+	bsr := NewBootstrapper(dhto, []NodeAddr{tstNodeAddrOf(node), dead, invalid})
+	if n := len(bsr.Health()); n != 2 {
+		t.Fatal("invalid node kept:", n)
+	}
+	clk := newFakeTstClock()
+	bsr.clock = clk
+	bsr.Start()
+	defer bsr.Stop()
+
+	healthOf := func(pubkey *CryptoKey) (h BootstrapNodeHealth) {
+		for _, h = range bsr.Health() {
+			if h.Pubkey.Equal2(pubkey) {
+				return
+			}
+		}
+		t.Fatal("node not found:", pubkey)
+		return
+	}
+	if !waitTstCond(3*time.Second, func() bool { return healthOf(node.SelfPubkey).Answers == 1 }) {
+		t.Fatal("probe not answered")
+	}
+	if h := healthOf(node.SelfPubkey); h.RTT <= 0 || h.Probes != 1 || !h.Healthy() {
+		t.Error("node health:", h.RTT, h.Probes, h.Healthy())
+	}
+	if dhto.CloseClientList.Len() != 1 {
+		t.Error("node not in close list:", dhto.CloseClientList.Len())
+	}
+
+	// close list under MinCloseNodes, best nodes asked again each check,
+	// dead one unhealthy after unanswered probes
+	if !waitTstCond(3*time.Second, func() bool { return clk.tickerCount() > 0 }) {
+		t.Fatal("check not started")
+	}
+	for i := 1; i <= DHT_BOOTSTRAP_MAX_FAILS; i++ {
+		clk.Advance(DHT_BOOTSTRAP_CHECK_INTERVAL * time.Second)
+		if !waitTstCond(3*time.Second, func() bool {
+			return healthOf(deadpk).Fails == i && healthOf(node.SelfPubkey).Answers == i+1
+		}) {
+			t.Fatal("check not done:", i, healthOf(deadpk).Fails, healthOf(node.SelfPubkey).Answers)
+		}
+	}
+	hs := bsr.Health()
+	if !hs[0].Pubkey.Equal2(node.SelfPubkey) || hs[1].Healthy() || hs[0].Score() <= hs[1].Score() {
+		t.Error("health order:", hs[0].Pubkey, hs[1].Healthy())
+	}
+
+	// health of nodes still listed kept
+	if n := bsr.SetNodes([]NodeAddr{tstNodeAddrOf(node)}); n != 1 {
+		t.Fatal("nodes set:", n)
+	}
+	if hs := bsr.Health(); len(hs) != 1 || hs[0].Answers == 0 {
+		t.Error("health not kept:", len(hs))
+	}
+}
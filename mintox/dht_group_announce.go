@@ -0,0 +1,305 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Announces of group chat peers, like group_announce.c. Peers of public groups
+// store where to reach them on the DHT nodes closest to the chat id, joiners
+// get them back from the same nodes. A node keeps the dht pubkey and udp addr
+// the store request came from, so a peer can only announce itself.
+
+const CRYPTO_PACKET_GC_ANNOUNCE = 90      // chat id | real pubkey | relay count | relays
+const CRYPTO_PACKET_GC_GET_ANNOUNCES = 91 // chat id | sendback
+const CRYPTO_PACKET_GC_ANNOUNCES = 92     // sendback | count | announces
+
+const GC_ANNOUNCE_TIMEOUT = 300    // seconds, stored announce kept
+const GC_ANNOUNCE_MAX_PEERS = 8    // stored per chat id, oldest dropped
+const GC_ANNOUNCE_MAX_GROUPS = 512 // chat ids stored
+const GC_ANNOUNCE_MAX_SENT = 4     // announces in a response
+const GC_ANNOUNCE_MAX_RELAYS = 2   // tcp relays of an announce
+const GC_ANNOUNCE_NODES = 4        // closest nodes stored to and asked
+
+// where a group peer can be reached
+type GroupAnnounce struct {
+	Pubkey    *CryptoKey    // real pubkey
+	DhtPubkey *CryptoKey    // of the store request
+	Addr      net.Addr      // udp addr the store request came from
+	Relays    []*NodeFormat // tcp relays, addr is *net.TCPAddr
+
+	at time.Time
+}
+
+// real pubkey | packed node of addr and dht pubkey | relay count | relays
+func (this *GroupAnnounce) pack() ([]byte, error) {
+	node, err := PackNode(this.Addr, this.DhtPubkey)
+	if err != nil {
+		return nil, err
+	}
+	buf := append(append([]byte{}, this.Pubkey.Bytes()...), node...)
+	buf = append(buf, byte(len(this.Relays)))
+	for _, relay := range this.Relays {
+		data, err := PackNode(relay.Addr, relay.Pubkey)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// announce and used bytes of data
+func unpackGroupAnnounce(data []byte) (*GroupAnnounce, int, error) {
+	if len(data) < PUBLIC_KEY_SIZE+1 {
+		return nil, 0, errors.Errorf("Group announce too short: %d", len(data))
+	}
+	ann := &GroupAnnounce{Pubkey: NewCryptoKey(data[:PUBLIC_KEY_SIZE])}
+	node, n, err := UnpackNode(data[PUBLIC_KEY_SIZE:])
+	if err != nil {
+		return nil, 0, err
+	}
+	ann.DhtPubkey, ann.Addr = node.Pubkey, node.Addr
+	pos := PUBLIC_KEY_SIZE + n
+	relays, n, err := unpackGroupRelays(data[pos:])
+	if err != nil {
+		return nil, 0, err
+	}
+	ann.Relays = relays
+	return ann, pos + n, nil
+}
+
+// count | tcp nodes, at most GC_ANNOUNCE_MAX_RELAYS
+func unpackGroupRelays(data []byte) ([]*NodeFormat, int, error) {
+	if len(data) < 1 || data[0] > GC_ANNOUNCE_MAX_RELAYS {
+		return nil, 0, errors.New("Invalid group announce relays")
+	}
+	var relays []*NodeFormat
+	pos := 1
+	for i := 0; i < int(data[0]); i++ {
+		node, n, err := UnpackNode(data[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, ok := node.Addr.(*net.TCPAddr); !ok {
+			return nil, 0, errors.Errorf("Group announce relay not tcp: %v", node.Addr)
+		}
+		relays = append(relays, node)
+		pos += n
+	}
+	return relays, pos, nil
+}
+
+type gcAnnounceSearch struct {
+	chatid *CryptoKey
+	sent   time.Time
+}
+
+// GroupAnnounces stores announces of others as a DHT node, and stores ours
+// and gets others' as a group peer.
+type GroupAnnounces struct {
+	dhto  *DHT
+	clock clock
+
+	mu       sync.Mutex
+	stored   map[string][]*GroupAnnounce // binchatid =>
+	searches map[uint64]*gcAnnounceSearch
+
+	// announces got for chat id, ours not in them, set by SetCallbackAnnounces
+	OnAnnounces func(chatid *CryptoKey, anns []*GroupAnnounce)
+}
+
+func NewGroupAnnounces(dhto *DHT) *GroupAnnounces {
+	this := &GroupAnnounces{}
+	this.dhto = dhto
+	this.clock = defaultClock
+	this.stored = map[string][]*GroupAnnounce{}
+	this.searches = map[uint64]*gcAnnounceSearch{}
+	dhto.RegisterHandleCryptoPacket(CRYPTO_PACKET_GC_ANNOUNCE, this.handleAnnounce, this)
+	dhto.RegisterHandleCryptoPacket(CRYPTO_PACKET_GC_GET_ANNOUNCES, this.handleGetAnnounces, this)
+	dhto.RegisterHandleCryptoPacket(CRYPTO_PACKET_GC_ANNOUNCES, this.handleAnnounces, this)
+	return this
+}
+
+// fn called on the dht goroutine, nil to unset
+func (this *GroupAnnounces) SetCallbackAnnounces(fn func(chatid *CryptoKey, anns []*GroupAnnounce)) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.OnAnnounces = fn
+}
+
+// Announce stores us as peer of chatid on the closest nodes, reached by the
+// dht addr or by relays. Returns count of nodes sent to.
+func (this *GroupAnnounces) Announce(chatid, realpk *CryptoKey, relays []*NodeFormat) (int, error) {
+	if len(relays) > GC_ANNOUNCE_MAX_RELAYS {
+		relays = relays[:GC_ANNOUNCE_MAX_RELAYS]
+	}
+	data := append(append([]byte{}, chatid.Bytes()...), realpk.Bytes()...)
+	data = append(data, byte(len(relays)))
+	for _, relay := range relays {
+		node, err := PackNode(relay.Addr, relay.Pubkey)
+		if err != nil {
+			return 0, err
+		}
+		data = append(data, node...)
+	}
+	return this.sendClosest(chatid, CRYPTO_PACKET_GC_ANNOUNCE, func() []byte { return data })
+}
+
+// Search asks the closest nodes for peers of chatid, got by OnAnnounces.
+// Returns count of nodes asked.
+func (this *GroupAnnounces) Search(chatid *CryptoKey) (int, error) {
+	return this.sendClosest(chatid, CRYPTO_PACKET_GC_GET_ANNOUNCES, func() []byte {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		now := this.clock.Now()
+		for id, s := range this.searches {
+			if now.Sub(s.sent) >= PING_TIMEOUT*time.Second {
+				delete(this.searches, id)
+			}
+		}
+		sbid := rand.Uint64()
+		for this.searches[sbid] != nil {
+			sbid = rand.Uint64()
+		}
+		this.searches[sbid] = &gcAnnounceSearch{chatid, now}
+		data := make([]byte, PUBLIC_KEY_SIZE+8)
+		copy(data, chatid.Bytes())
+		binary.BigEndian.PutUint64(data[PUBLIC_KEY_SIZE:], sbid)
+		return data
+	})
+}
+
+// request of data, made for each, to GC_ANNOUNCE_NODES nodes closest to chatid
+func (this *GroupAnnounces) sendClosest(chatid *CryptoKey, reqid uint8, data func() []byte) (int, error) {
+	sent := 0
+	var lasterr error
+	for _, node := range this.dhto.GetClosestNodes(chatid, GC_ANNOUNCE_NODES) {
+		pkt, err := this.dhto.createRequest(node.Pubkey, reqid, data())
+		if err != nil {
+			return sent, err
+		}
+		if _, err := this.dhto.Neto.WriteTo(pkt, node.Addr); err != nil {
+			lasterr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		if lasterr == nil {
+			lasterr = errors.New("No dht nodes close to chat id")
+		}
+		return 0, lasterr
+	}
+	return sent, nil
+}
+
+func (this *GroupAnnounces) handleAnnounce(object interface{}, addr net.Addr, srcpk *CryptoKey, data []byte, cbdata interface{}) (int, error) {
+	if len(data) < PUBLIC_KEY_SIZE*2+1 {
+		return 1, errors.Errorf("Invalid group announce length: %d", len(data))
+	}
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		return 1, errors.Errorf("Group announce not by udp: %v", addr)
+	}
+	chatid := NewCryptoKey(data[:PUBLIC_KEY_SIZE])
+	relays, _, err := unpackGroupRelays(data[PUBLIC_KEY_SIZE*2:])
+	if err != nil {
+		return 1, err
+	}
+	ann := &GroupAnnounce{Pubkey: NewCryptoKey(data[PUBLIC_KEY_SIZE : PUBLIC_KEY_SIZE*2]),
+		DhtPubkey: srcpk, Addr: addr, Relays: relays, at: this.clock.Now()}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.pruneLocked()
+	anns, ok := this.stored[chatid.BinStr()]
+	if !ok && len(this.stored) >= GC_ANNOUNCE_MAX_GROUPS {
+		return 1, errors.New("Too many groups announced")
+	}
+	for i, a := range anns {
+		if a.Pubkey.Equal2(ann.Pubkey) {
+			anns = append(anns[:i], anns[i+1:]...)
+			break
+		}
+	}
+	if len(anns) >= GC_ANNOUNCE_MAX_PEERS {
+		anns = anns[1:]
+	}
+	this.stored[chatid.BinStr()] = append(anns, ann)
+	return 0, nil
+}
+
+// drop timed out announces. mu held by caller
+func (this *GroupAnnounces) pruneLocked() {
+	now := this.clock.Now()
+	for binid, anns := range this.stored {
+		i := 0
+		for i < len(anns) && now.Sub(anns[i].at) >= GC_ANNOUNCE_TIMEOUT*time.Second {
+			i++
+		}
+		if i == len(anns) {
+			delete(this.stored, binid)
+		} else {
+			this.stored[binid] = anns[i:]
+		}
+	}
+}
+
+// newest announces of chat id but the asker's, sendback | count | announces
+func (this *GroupAnnounces) handleGetAnnounces(object interface{}, addr net.Addr, srcpk *CryptoKey, data []byte, cbdata interface{}) (int, error) {
+	if len(data) != PUBLIC_KEY_SIZE+8 {
+		return 1, errors.Errorf("Invalid get group announces length: %d", len(data))
+	}
+	rsp := append(append([]byte{}, data[PUBLIC_KEY_SIZE:]...), 0)
+	this.mu.Lock()
+	this.pruneLocked()
+	anns := this.stored[string(data[:PUBLIC_KEY_SIZE])]
+	for i := len(anns) - 1; i >= 0 && rsp[8] < GC_ANNOUNCE_MAX_SENT; i-- {
+		if anns[i].DhtPubkey.Equal2(srcpk) {
+			continue
+		}
+		if packed, err := anns[i].pack(); err == nil {
+			rsp = append(rsp, packed...)
+			rsp[8]++
+		}
+	}
+	this.mu.Unlock()
+	pkt, err := this.dhto.createRequest(srcpk, CRYPTO_PACKET_GC_ANNOUNCES, rsp)
+	if err != nil {
+		return 1, err
+	}
+	_, err = this.dhto.Neto.WriteTo(pkt, addr)
+	return 0, err
+}
+
+func (this *GroupAnnounces) handleAnnounces(object interface{}, addr net.Addr, srcpk *CryptoKey, data []byte, cbdata interface{}) (int, error) {
+	if len(data) < 8+1 {
+		return 1, errors.Errorf("Invalid group announces length: %d", len(data))
+	}
+	this.mu.Lock()
+	s, ok := this.searches[binary.BigEndian.Uint64(data)]
+	fn := this.OnAnnounces
+	this.mu.Unlock()
+	if !ok {
+		return 1, errors.New("Group announces not asked")
+	}
+	var anns []*GroupAnnounce
+	rest := data[8+1:]
+	for i := 0; i < int(data[8]) && i < GC_ANNOUNCE_MAX_SENT; i++ {
+		ann, n, err := unpackGroupAnnounce(rest)
+		if err != nil {
+			return 1, err
+		}
+		anns = append(anns, ann)
+		rest = rest[n:]
+	}
+	if fn != nil && len(anns) > 0 {
+		fn(s.chatid, anns)
+	}
+	return 0, nil
+}
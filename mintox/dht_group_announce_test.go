@@ -0,0 +1,82 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGroupAnnounceSearch(t *testing.T) {
+	// peer and joiner both know the node, not each other
+	dhts := []*DHT{NewDHT(), NewDHT(), NewDHT()}
+	for _, d := range dhts {
+		defer d.Neto.srv.Close()
+	}
+	addrOf := func(d *DHT) net.Addr {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: d.Neto.srv.LocalAddr().(*net.UDPAddr).Port}
+	}
+	node := dhts[1]
+	for _, d := range []*DHT{dhts[0], dhts[2]} {
+		d.Bootstrap(addrOf(node), node.SelfPubkey)
+		if !waitTstCond(3*time.Second, func() bool { return d.CloseClientList.GetByKey(node.SelfPubkey.BinStr()) != nil }) {
+			t.Fatal("bootstrap node not added")
+		}
+	}
+	peer, nodega, joiner := NewGroupAnnounces(dhts[0]), NewGroupAnnounces(node), NewGroupAnnounces(dhts[2])
+	annC := make(chan []*GroupAnnounce, 2)
+	joiner.SetCallbackAnnounces(func(chatid *CryptoKey, anns []*GroupAnnounce) { annC <- anns })
+	peer.SetCallbackAnnounces(func(chatid *CryptoKey, anns []*GroupAnnounce) { annC <- anns })
+
+	chatid, _, _ := NewSigKeyPair()
+	realpk, _, _ := NewCBKeyPair()
+	relaypk, _, _ := NewCBKeyPair()
+	relay := &NodeFormat{Pubkey: relaypk, Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445}}
+	if n, err := peer.Announce(chatid, realpk, []*NodeFormat{relay}); n != 1 || err != nil {
+		t.Fatal("announce:", n, err)
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		nodega.mu.Lock()
+		defer nodega.mu.Unlock()
+		return len(nodega.stored[chatid.BinStr()]) == 1
+	}) {
+		t.Fatal("announce not stored")
+	}
+
+	if _, err := joiner.Search(chatid); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case anns := <-annC:
+		if len(anns) != 1 || !anns[0].Pubkey.Equal2(realpk) || !anns[0].DhtPubkey.Equal2(dhts[0].SelfPubkey) {
+			t.Fatal("announces:", anns)
+		}
+		if len(anns[0].Relays) != 1 || !anns[0].Relays[0].Pubkey.Equal2(relaypk) {
+			t.Error("relays:", anns[0].Relays)
+		}
+		if anns[0].Addr.(*net.UDPAddr).Port != addrOf(dhts[0]).(*net.UDPAddr).Port {
+			t.Error("addr:", anns[0].Addr)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("announces not got")
+	}
+
+	// the announcer gets no announce of itself
+	if _, err := peer.Search(chatid); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case anns := <-annC:
+		t.Error("own announce got:", anns)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// stored one times out
+	nodega.mu.Lock()
+	nodega.stored[chatid.BinStr()][0].at = time.Now().Add(-GC_ANNOUNCE_TIMEOUT * time.Second)
+	nodega.pruneLocked()
+	_, ok := nodega.stored[chatid.BinStr()]
+	nodega.mu.Unlock()
+	if ok {
+		t.Error("timed out announce kept")
+	}
+}
@@ -0,0 +1,297 @@
+package mintox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopp"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* Seconds after the last punching to start the port guessing over */
+const PUNCH_RESET_TIME = 40
+
+// like NAT of DHT_Friend, symmetric NAT hole punching state of a friend
+type dhtNAT struct {
+	mu sync.Mutex
+
+	/* 1 if currently hole punching, otherwise 0 */
+	holePunching   bool
+	punchingIndex  uint32
+	tries          uint32
+	punchingIndex2 uint32
+
+	punchingAt    time.Time
+	recvNATPingAt time.Time
+	natPingID     uint64
+	natPingAt     time.Time
+
+	directAt time.Time              // friend answered our ping directly
+	retaddrs map[string]*dhtRetAddr // binpk of node => friend's addr it returned
+}
+
+// friend's addr returned by a node, like ret_ip_port of Client_data
+type dhtRetAddr struct {
+	Addr     net.Addr // friend's addr seen by node
+	NodeAddr net.Addr // node's addr, the NAT ping route
+	At       time.Time
+}
+
+func newDHTNAT() *dhtNAT {
+	return &dhtNAT{natPingID: newNATPingID(), retaddrs: map[string]*dhtRetAddr{}}
+}
+
+func newNATPingID() uint64 {
+	pingid := rand.Uint64()
+	gopp.CmpAndSwapN(&pingid, 0, 1)
+	return pingid
+}
+
+// like returnedip_ports for friend, keep at most MAX_FRIEND_CLIENTS newest nodes
+func (this *dhtNAT) addRetAddr(nodepk *CryptoKey, nodeaddr, addr net.Addr, now time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.retaddrs[nodepk.BinStr()] = &dhtRetAddr{addr, nodeaddr, now}
+	for len(this.retaddrs) > MAX_FRIEND_CLIENTS {
+		oldest := ""
+		for k, ra := range this.retaddrs {
+			if oldest == "" || ra.At.Before(this.retaddrs[oldest].At) {
+				oldest = k
+			}
+		}
+		delete(this.retaddrs, oldest)
+	}
+}
+
+// like friend_iplist, nil if friend reached directly already
+func (this *dhtNAT) friendIPList(now time.Time) (rets []*dhtRetAddr) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !IsTimeout4Time(now, this.directAt, BAD_NODE_TIMEOUT) {
+		return nil
+	}
+	for _, ra := range this.retaddrs {
+		if !IsTimeout4Time(now, ra.At, BAD_NODE_TIMEOUT) {
+			rets = append(rets, ra)
+		}
+	}
+	return
+}
+
+// like nat_commonip, ip returned by at least minnum nodes
+func natCommonIP(addrs []*dhtRetAddr, minnum int) net.IP {
+	for i, ra := range addrs {
+		ip, _, _ := splitNodeAddr(ra.Addr)
+		n := 0
+		for _, rb := range addrs[i:] {
+			if ipb, _, _ := splitNodeAddr(rb.Addr); ip.Equal(ipb) {
+				n++
+			}
+		}
+		if n >= minnum {
+			return ip
+		}
+	}
+	return nil
+}
+
+// like nat_getports, ports of addrs with ip
+func natGetPorts(addrs []*dhtRetAddr, ip net.IP) (ports []uint16) {
+	for _, ra := range addrs {
+		if ipa, port, _ := splitNodeAddr(ra.Addr); ip.Equal(ipa) {
+			ports = append(ports, uint16(port))
+		}
+	}
+	return
+}
+
+// port guessing of punch_holes, ports around the ones seen by nodes, alternating
+// above and below. The one port if all seen are the same, not a symmetric NAT.
+func natGuessPorts(ports []uint16, index uint32) []uint16 {
+	same := true
+	for _, port := range ports {
+		same = same && port == ports[0]
+	}
+	if same {
+		return ports[:1]
+	}
+	numports := uint32(len(ports))
+	guesses := make([]uint16, MAX_PUNCHING_PORTS)
+	for i := range guesses {
+		it := uint32(i) + index
+		delta := int(it / (2 * numports))
+		if it%2 == 1 {
+			delta = -delta
+		}
+		guesses[i] = uint16(int(ports[(it/2)%numports]) + delta)
+	}
+	return guesses
+}
+
+// ports tried in sequence from 1024 after MAX_NORMAL_PUNCHING_TRIES failed
+func natSequentialPorts(index2 uint32) []uint16 {
+	ports := make([]uint16, MAX_PUNCHING_PORTS)
+	for i := range ports {
+		ports[i] = uint16(1024 + uint32(i) + index2)
+	}
+	return ports
+}
+
+// like do_NAT, NAT ping friends known by enough nodes but not reached directly,
+// punch holes when both sides answered the pings recently.
+func (this *DHT) doNATAt(now time.Time) {
+	this.FriendsList.EachSnap(func(itemi PLItem) {
+		frndo := itemi.(*DHTFriend)
+		addrs := frndo.nat.friendIPList(now)
+		if len(addrs) < MAX_FRIEND_CLIENTS/2 {
+			return
+		}
+		nat := frndo.nat
+		nat.mu.Lock()
+		var pingid uint64
+		if IsTimeout4Time(now, nat.natPingAt, PUNCH_INTERVAL) {
+			pingid, nat.natPingAt = nat.natPingID, now
+		}
+		ip := net.IP(nil)
+		var ports []uint16
+		if nat.holePunching && IsTimeout4Time(now, nat.punchingAt, PUNCH_INTERVAL) &&
+			!IsTimeout4Time(now, nat.recvNATPingAt, PUNCH_INTERVAL*2) {
+			if ip = natCommonIP(addrs, MAX_FRIEND_CLIENTS/2); ip != nil {
+				if IsTimeout4Time(now, nat.punchingAt, PUNCH_RESET_TIME) {
+					nat.tries, nat.punchingIndex, nat.punchingIndex2 = 0, 0, 0
+				}
+				ports = this.punchPortsLocked(nat, natGetPorts(addrs, ip))
+				nat.punchingAt = now
+				nat.holePunching = false
+			}
+		}
+		nat.mu.Unlock()
+
+		if pingid != 0 {
+			err := this.sendNATPing(frndo.Pubkey, pingid, NAT_PING_REQUEST)
+			gopp.ErrPrint(err, frndo.Pubkey.ToHex20())
+		}
+		for _, port := range ports {
+			this.Pingo.SendPingRequest(&net.UDPAddr{IP: ip, Port: int(port)}, frndo.Pubkey)
+		}
+		if len(ports) > 0 {
+			log.Println("Punching holes:", ip, len(ports), frndo.Pubkey.ToHex20())
+		}
+	})
+}
+
+// like punch_holes, ports to ping this round. nat.mu held by caller
+func (this *DHT) punchPortsLocked(nat *dhtNAT, seen []uint16) (ports []uint16) {
+	if !this.HolePunchingEnabled || len(seen) == 0 || len(seen) > MAX_FRIEND_CLIENTS {
+		return nil
+	}
+	ports = natGuessPorts(seen, nat.punchingIndex)
+	if len(ports) > 1 {
+		nat.punchingIndex += uint32(len(ports))
+	}
+	if nat.tries > MAX_NORMAL_PUNCHING_TRIES {
+		ports = append(ports, natSequentialPorts(nat.punchingIndex2)...)
+		nat.punchingIndex2 += MAX_PUNCHING_PORTS / 2
+	}
+	nat.tries++
+	return
+}
+
+// like send_NATping, routed by nodes which know friend's addr
+func (this *DHT) sendNATPing(pubkey *CryptoKey, pingid uint64, ptype byte) error {
+	data := make([]byte, 1+8)
+	data[0] = ptype
+	binary.BigEndian.PutUint64(data[1:], pingid)
+	pkt, err := this.createRequest(pubkey, CRYPTO_PACKET_NAT_PING, data)
+	if err != nil {
+		return err
+	}
+	if this.routeToFriend(pubkey, pkt) == 0 {
+		return errors.Errorf("No route to friend: %s", pubkey.ToHex20())
+	}
+	return nil
+}
+
+// like route_tofriend, send to nodes which returned friend's addr, return the count
+func (this *DHT) routeToFriend(pubkey *CryptoKey, pkt []byte) int {
+	itemi := this.FriendsList.GetByKey(pubkey.BinStr())
+	if itemi == nil {
+		return 0
+	}
+	addrs := itemi.(*DHTFriend).nat.friendIPList(time.Now())
+	if len(addrs) < MAX_FRIEND_CLIENTS/4 {
+		return 0
+	}
+	sent := 0
+	for _, ra := range addrs {
+		if _, err := this.Neto.WriteTo(pkt, ra.NodeAddr); err == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// like handle_NATping
+func (this *DHT) HandleNATPing(object interface{}, addr net.Addr, srcpk *CryptoKey, data []byte, cbdata interface{}) (int, error) {
+	if len(data) != 1+8 {
+		return 1, errors.Errorf("Invalid NAT ping length: %d", len(data))
+	}
+	itemi := this.FriendsList.GetByKey(srcpk.BinStr())
+	if itemi == nil {
+		return 1, errors.Errorf("NAT ping from non friend: %s", srcpk.ToHex20())
+	}
+	nat := itemi.(*DHTFriend).nat
+	pingid := binary.BigEndian.Uint64(data[1:])
+	switch data[0] {
+	case NAT_PING_REQUEST:
+		nat.mu.Lock()
+		nat.recvNATPingAt = time.Now()
+		nat.mu.Unlock()
+		err := this.sendNATPing(srcpk, pingid, NAT_PING_RESPONSE)
+		return 0, err
+	case NAT_PING_RESPONSE:
+		nat.mu.Lock()
+		defer nat.mu.Unlock()
+		if pingid != nat.natPingID {
+			return 1, errors.Errorf("Unknown NAT ping id: %d", pingid)
+		}
+		nat.natPingID = newNATPingID()
+		nat.holePunching = true
+		return 0, nil
+	}
+	return 1, errors.Errorf("Invalid NAT ping type: %d", data[0])
+}
+
+// friend answered our ping directly, a hole punched or no NAT in between
+func (this *DHT) friendPinged(pubkey *CryptoKey, addr net.Addr) {
+	itemi := this.FriendsList.GetByKey(pubkey.BinStr())
+	if itemi == nil {
+		return
+	}
+	frndo := itemi.(*DHTFriend)
+	frndo.nat.mu.Lock()
+	frndo.nat.directAt = time.Now()
+	frndo.nat.mu.Unlock()
+	if old := this.GetFriendIP(pubkey); old == nil || old.String() != addr.String() {
+		log.Println("Friend reached directly:", addr, pubkey.ToHex20())
+	}
+	frndo.ClientList.Remove(&NodeFormat{Pubkey: pubkey})
+	frndo.ClientList.Put(&NodeFormat{Pubkey: pubkey, Addr: addr, cmppk: frndo.cmppk})
+}
+
+// sendnodes from node nodepk had friends' addrs, remember them for NAT ping routes
+func (this *DHT) noteReturnedAddr(nodepk *CryptoKey, nodeaddr net.Addr, node *NodeFormat) {
+	if bytes.Equal(nodepk.Bytes(), node.Pubkey.Bytes()) {
+		return
+	}
+	itemi := this.FriendsList.GetByKey(node.Pubkey.BinStr())
+	if itemi == nil {
+		return
+	}
+	itemi.(*DHTFriend).nat.addRetAddr(nodepk, nodeaddr, node.Addr, time.Now())
+}
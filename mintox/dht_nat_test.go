@@ -0,0 +1,136 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNATGuessPorts(t *testing.T) {
+	if ports := natGuessPorts([]uint16{1000, 1000, 1000}, 7); len(ports) != 1 || ports[0] != 1000 {
+		t.Error("same ports:", ports)
+	}
+	ports := natGuessPorts([]uint16{1000, 2000}, 0)
+	want := []uint16{1000, 1000, 2000, 2000, 1001, 999, 2001, 1999}
+	if len(ports) != MAX_PUNCHING_PORTS {
+		t.Fatal("guessed:", len(ports))
+	}
+	for i, port := range want {
+		if ports[i] != port {
+			t.Error("guessed port:", i, ports[i], port)
+		}
+	}
+	if ports2 := natGuessPorts([]uint16{1000, 2000}, 4); ports2[0] != ports[4] {
+		t.Error("index not continued:", ports2[0])
+	}
+
+	d := &DHT{HolePunchingEnabled: true}
+	nat := newDHTNAT()
+	for i := 0; i <= MAX_NORMAL_PUNCHING_TRIES; i++ {
+		if n := len(d.punchPortsLocked(nat, []uint16{1000, 2000})); n != MAX_PUNCHING_PORTS {
+			t.Fatal("normal tries:", i, n)
+		}
+	}
+	ports = d.punchPortsLocked(nat, []uint16{1000, 2000})
+	if len(ports) != 2*MAX_PUNCHING_PORTS || ports[MAX_PUNCHING_PORTS] != 1024 || nat.punchingIndex2 != MAX_PUNCHING_PORTS/2 {
+		t.Error("sequential ports:", len(ports), nat.punchingIndex2)
+	}
+	d.HolePunchingEnabled = false
+	if len(d.punchPortsLocked(nat, []uint16{1000, 2000})) != 0 {
+		t.Error("punched when disabled")
+	}
+}
+
+func TestDHTHolePunching(t *testing.T) {
+	dhts := []*DHT{NewDHT(), NewDHT()}
+	defer dhts[0].Neto.srv.Close()
+	defer dhts[1].Neto.srv.Close()
+	addrOf := func(d *DHT) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: d.Neto.srv.LocalAddr().(*net.UDPAddr).Port}
+	}
+	a, b := dhts[0], dhts[1]
+	a.AddFriend(b.SelfPubkey, nil, nil, 0)
+	b.AddFriend(a.SelfPubkey, nil, nil, 0)
+
+	// nodes seeing the friend behind a symmetric NAT, a port each, one the real
+	natOf := func(d *DHT, friend *DHT) *dhtNAT {
+		nat := d.FriendsList.GetByKey(friend.SelfPubkey.BinStr()).(*DHTFriend).nat
+		for i := 0; i < MAX_FRIEND_CLIENTS/2; i++ {
+			nodepk, _, _ := NewCBKeyPair()
+			addr := addrOf(friend)
+			addr.Port += i * 3
+			nat.addRetAddr(nodepk, addrOf(friend), addr, time.Now())
+		}
+		return nat
+	}
+	nata, natb := natOf(a, b), natOf(b, a)
+	if n := len(nata.friendIPList(time.Now())); n != MAX_FRIEND_CLIENTS/2 {
+		t.Fatal("friend ip list:", n)
+	}
+
+	a.doNATAt(time.Now())
+	b.doNATAt(time.Now())
+	if !waitTstCond(5*time.Second, func() bool {
+		nata.mu.Lock()
+		defer nata.mu.Unlock()
+		natb.mu.Lock()
+		defer natb.mu.Unlock()
+		return !nata.recvNATPingAt.IsZero() && !natb.recvNATPingAt.IsZero() && (nata.holePunching || nata.tries > 0)
+	}) {
+		t.Fatal("NAT ping not answered")
+	}
+
+	a.doNATAt(time.Now())
+	if !waitTstCond(5*time.Second, func() bool {
+		addr := a.GetFriendIP(b.SelfPubkey)
+		return addr != nil && addr.String() == addrOf(b).String()
+	}) {
+		t.Fatal("hole not punched:", a.GetFriendIP(b.SelfPubkey))
+	}
+	if nata.friendIPList(time.Now()) != nil {
+		t.Error("NAT ping friend reached directly")
+	}
+
+	// response with stale id dropped
+	data := []byte{NAT_PING_RESPONSE, 0, 0, 0, 0, 0, 0, 0, 0}
+	if n, _ := a.HandleNATPing(nil, addrOf(b), b.SelfPubkey, data, nil); n == 0 {
+		t.Error("unknown NAT ping id accepted")
+	}
+	if n, _ := a.HandleNATPing(nil, addrOf(b), a.SelfPubkey, data, nil); n == 0 {
+		t.Error("NAT ping from non friend accepted")
+	}
+}
+
+func TestDHTCryptoRequest(t *testing.T) {
+	a, b := NewDHT(), NewDHT()
+	defer a.Neto.srv.Close()
+	defer b.Neto.srv.Close()
+	var got []byte
+	b.RegisterHandleCryptoPacket(CRYPTO_PACKET_DHTPK, func(object interface{}, addr net.Addr, srcpk *CryptoKey,
+		data []byte, cbdata interface{}) (int, error) {
+		if srcpk.Equal2(a.SelfPubkey) {
+			got = data
+		}
+		return 0, nil
+	}, nil)
+
+	pkt, err := a.createRequest(b.SelfPubkey, CRYPTO_PACKET_DHTPK, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.HandleCryptoPacket(nil, nil, pkt, nil); n != 0 || string(got) != "hello" {
+		t.Error("request not handled:", n, err, string(got))
+	}
+	if _, err := a.createRequest(b.SelfPubkey, CRYPTO_PACKET_DHTPK, make([]byte, MAX_CRYPTO_REQUEST_SIZE)); err == nil {
+		t.Error("too long request created")
+	}
+	pkt[len(pkt)-1] ^= 1
+	if n, _ := b.HandleCryptoPacket(nil, nil, pkt, nil); n == 0 {
+		t.Error("corrupted request handled")
+	}
+	// not ours and no close node to route to
+	pkt, _ = b.createRequest(a.SelfPubkey, CRYPTO_PACKET_DHTPK, []byte("x"))
+	if n, _ := b.HandleCryptoPacket(nil, nil, pkt, nil); n == 0 {
+		t.Error("unroutable request handled")
+	}
+}
@@ -0,0 +1,187 @@
+package mintox
+
+import (
+	"context"
+	"encoding/json"
+	"gopp"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Fetcher of the official node list json, cached on disk so a restart within
+// TTL or with nodes.tox.chat down still has nodes, feeds a Bootstrapper.
+
+const TOX_NODES_URL = "https://nodes.tox.chat/json"
+const TOX_NODES_TTL = 12 * 3600      // seconds, cache fresh for
+const TOX_NODES_MAX_SIZE = 4 << 20   // bytes of downloaded json
+const TOX_NODES_FETCH_TIMEOUT = 30   // seconds
+const TOX_NODES_RETRY_INTERVAL = 300 // seconds, next fetch after failed one
+
+// json of nodes.tox.chat
+type NodesList struct {
+	LastScan    int64      `json:"last_scan"`    // unix time
+	LastRefresh int64      `json:"last_refresh"` // unix time
+	Nodes       []NodeAddr `json:"nodes"`
+}
+
+func ParseNodesList(data []byte) (*NodesList, error) {
+	list := &NodesList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, errors.Wrap(err, "parse nodes")
+	}
+	if len(list.Nodes) == 0 {
+		return nil, errors.New("No nodes")
+	}
+	return list, nil
+}
+
+// nodes wanted of a list, all false keeps all
+type NodesFilter struct {
+	UDP    bool // with udp address, for DHT bootstrap
+	TCP    bool // with tcp relay ports
+	Online bool // status of wanted ones up on last scan
+}
+
+func (this *NodesList) Filter(filter NodesFilter) (nodes []NodeAddr) {
+	for _, node := range this.Nodes {
+		if filter.UDP && (node.Addr() == "" || (filter.Online && !node.StatusUDP)) {
+			continue
+		}
+		if filter.TCP && (!node.SupportTCP() || (filter.Online && !node.StatusTCP)) {
+			continue
+		}
+		if filter.Online && !filter.UDP && !filter.TCP && !node.StatusUDP && !node.StatusTCP {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return
+}
+
+type NodesFetcher struct {
+	URL       string        // default TOX_NODES_URL
+	CacheFile string        // empty for no disk cache
+	TTL       time.Duration // default TOX_NODES_TTL seconds
+	Filter    NodesFilter   // of nodes fed, default online udp ones
+	Client    *http.Client  // default with TOX_NODES_FETCH_TIMEOUT
+	clock     clock
+}
+
+func NewNodesFetcher(cachefile string) *NodesFetcher {
+	this := &NodesFetcher{}
+	this.URL = TOX_NODES_URL
+	this.CacheFile = cachefile
+	this.TTL = TOX_NODES_TTL * time.Second
+	this.Filter = NodesFilter{UDP: true, Online: true}
+	this.Client = &http.Client{Timeout: TOX_NODES_FETCH_TIMEOUT * time.Second}
+	this.clock = defaultClock
+	return this
+}
+
+// Fetch returns the cached list if fresher than TTL, else downloads and caches
+// it. The stale cache is returned when download failed.
+func (this *NodesFetcher) Fetch(ctx context.Context) (*NodesList, error) {
+	cached, fresh := this.loadCache()
+	if fresh {
+		return cached, nil
+	}
+	data, err := this.download(ctx)
+	var list *NodesList
+	if err == nil {
+		list, err = ParseNodesList(data)
+	}
+	if err != nil {
+		if cached != nil {
+			log.Println("Fetch nodes failed, use stale cache:", this.URL, err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	if this.CacheFile != "" {
+		err := writeFileAtomic(this.CacheFile, data)
+		gopp.ErrPrint(err, this.CacheFile)
+	}
+	return list, nil
+}
+
+// cached list and if within TTL, nil if no valid cache
+func (this *NodesFetcher) loadCache() (*NodesList, bool) {
+	if this.CacheFile == "" {
+		return nil, false
+	}
+	fi, err := os.Stat(this.CacheFile)
+	if err != nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(this.CacheFile)
+	if err != nil {
+		return nil, false
+	}
+	list, err := ParseNodesList(data)
+	if err != nil {
+		log.Println("Invalid nodes cache, ignore:", this.CacheFile, err)
+		return nil, false
+	}
+	return list, this.clock.Now().Sub(fi.ModTime()) < this.TTL
+}
+
+func (this *NodesFetcher) download(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, this.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, this.URL)
+	}
+	resp, err := this.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, this.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Fetch nodes: %s, %s", this.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, TOX_NODES_MAX_SIZE+1))
+	if err != nil {
+		return nil, errors.Wrap(err, this.URL)
+	}
+	if len(data) > TOX_NODES_MAX_SIZE {
+		return nil, errors.Errorf("Nodes json too large: %s, max %d", this.URL, TOX_NODES_MAX_SIZE)
+	}
+	return data, nil
+}
+
+// Feed fetches and sets nodes passed Filter to bsr, returns count set
+func (this *NodesFetcher) Feed(ctx context.Context, bsr *Bootstrapper) (int, error) {
+	list, err := this.Fetch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	nodes := list.Filter(this.Filter)
+	if len(nodes) == 0 {
+		return 0, errors.Errorf("No nodes passed filter: %d, %+v", len(list.Nodes), this.Filter)
+	}
+	return bsr.SetNodes(nodes), nil
+}
+
+// RunFeed feeds bsr at once, then each TTL, or sooner after failed, till ctx done
+func (this *NodesFetcher) RunFeed(ctx context.Context, bsr *Bootstrapper) {
+	for {
+		interval := this.TTL
+		n, err := this.Feed(ctx, bsr)
+		if err != nil {
+			log.Println("Feed nodes failed:", err)
+			interval = TOX_NODES_RETRY_INTERVAL * time.Second
+		} else {
+			log.Println("Bootstrap nodes fed:", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
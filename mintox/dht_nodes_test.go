@@ -0,0 +1,104 @@
+package mintox
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const tstNodesJSON = `{"last_scan": 1500000000, "last_refresh": 1500000000, "nodes": [
+{"ipv4": "127.0.0.1", "ipv6": "-", "port": 33445, "tcp_ports": [443, 3389],
+ "public_key": "1111111111111111111111111111111111111111111111111111111111111111",
+ "maintainer": "a", "location": "DE", "status_udp": true, "status_tcp": true, "version": "1000002018", "motd": "", "last_ping": 1500000000},
+{"ipv4": "-", "ipv6": "::1", "port": 33445, "tcp_ports": [],
+ "public_key": "2222222222222222222222222222222222222222222222222222222222222222",
+ "status_udp": true, "status_tcp": false},
+{"ipv4": "127.0.0.2", "ipv6": "-", "port": 33445, "tcp_ports": [33445],
+ "public_key": "3333333333333333333333333333333333333333333333333333333333333333",
+ "status_udp": false, "status_tcp": false}
+]}`
+
+func TestNodesListFilter(t *testing.T) {
+	list, err := ParseNodesList([]byte(tstNodesJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Nodes) != 3 || list.LastScan != 1500000000 || list.Nodes[0].Location != "DE" {
+		t.Fatal("parsed:", len(list.Nodes), list.LastScan)
+	}
+	for _, c := range []struct {
+		filter NodesFilter
+		want   int
+	}{
+		{NodesFilter{}, 3},
+		{NodesFilter{Online: true}, 2},
+		{NodesFilter{UDP: true}, 3},
+		{NodesFilter{UDP: true, Online: true}, 2},
+		{NodesFilter{TCP: true}, 2},
+		{NodesFilter{TCP: true, Online: true}, 1},
+	} {
+		if n := len(list.Filter(c.filter)); n != c.want {
+			t.Errorf("filter %+v: %d, want %d", c.filter, n, c.want)
+		}
+	}
+	if _, err := ParseNodesList([]byte(`{"nodes": []}`)); err == nil {
+		t.Error("empty list accepted")
+	}
+}
+
+func TestNodesFetcher(t *testing.T) {
+	var reqs, fail int32
+	hsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(tstNodesJSON))
+	}))
+	defer hsrv.Close()
+	cachefile := filepath.Join(t.TempDir(), "nodes.json")
+	newf := func() *NodesFetcher {
+		f := NewNodesFetcher(cachefile)
+		f.URL = hsrv.URL
+		return f
+	}
+	ctx := context.Background()
+
+	f := newf()
+	if list, err := f.Fetch(ctx); err != nil || len(list.Nodes) != 3 {
+		t.Fatal("fetch:", err)
+	}
+	if _, err := os.Stat(cachefile); err != nil {
+		t.Fatal("not cached:", err)
+	}
+	// fresh cache, also of a new fetcher
+	if _, err := newf().Fetch(ctx); err != nil || atomic.LoadInt32(&reqs) != 1 {
+		t.Error("cache not used:", err, reqs)
+	}
+
+	// stale cache used when fetch failed
+	atomic.StoreInt32(&fail, 1)
+	f.TTL = time.Nanosecond
+	if list, err := f.Fetch(ctx); err != nil || len(list.Nodes) != 3 || atomic.LoadInt32(&reqs) != 2 {
+		t.Error("stale cache:", err, reqs)
+	}
+	os.Remove(cachefile)
+	if _, err := f.Fetch(ctx); err == nil {
+		t.Error("fetch failed without cache")
+	}
+
+	// feed online udp nodes
+	atomic.StoreInt32(&fail, 0)
+	dhto := newTstDHT(t)
+	defer dhto.Neto.Close()
+	bsr := NewBootstrapper(dhto, nil)
+	if n, err := f.Feed(ctx, bsr); err != nil || n != 2 || len(bsr.Health()) != 2 {
+		t.Error("fed:", n, err)
+	}
+}
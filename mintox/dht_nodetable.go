@@ -0,0 +1,235 @@
+package mintox
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// k-bucket node table like the close list of c-toxcore.
+// Bucket index is the count of leading bits of node key same as ours,
+// each bucket holds LCLIENT_NODES nodes, so it keeps more nodes close to us.
+// Items are *ClientData, methods follow PriorityList so they can replace each other.
+type NodeTable struct {
+	selfpk *CryptoKey
+
+	mu      sync.RWMutex
+	keys    map[string]*ClientData
+	buckets [LCLIENT_LENGTH][]*ClientData
+}
+
+func NewNodeTable(selfpk *CryptoKey) *NodeTable {
+	this := &NodeTable{}
+	this.selfpk = selfpk
+	this.keys = map[string]*ClientData{}
+	return this
+}
+
+// like bit_by_bit_cmp, count of leading same bits, capped to last bucket
+func bucketIndex(selfpk *CryptoKey, pubkey *CryptoKey) int {
+	pk1, pk2 := selfpk.Bytes(), pubkey.Bytes()
+	n := 0
+	for i := 0; i < PUBLIC_KEY_SIZE; i++ {
+		x := pk1[i] ^ pk2[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n >= LCLIENT_LENGTH {
+		n = LCLIENT_LENGTH - 1
+	}
+	return n
+}
+
+func (this *NodeTable) Len() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return len(this.keys)
+}
+
+// Put adds or updates a *ClientData. When the bucket is full, the most stale
+// bad node is replaced, return false if no room.
+func (this *NodeTable) Put(itemi PLItem) bool {
+	item := itemi.(*ClientData)
+	if item.Pubkey.Equal(this.selfpk.Bytes()) {
+		return false
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if old, ok := this.keys[item.Key()]; ok {
+		old.Update(item)
+		return true
+	}
+	idx := bucketIndex(this.selfpk, item.Pubkey)
+	bucket := this.buckets[idx]
+	if len(bucket) < LCLIENT_NODES {
+		this.buckets[idx] = append(bucket, item)
+		this.keys[item.Key()] = item
+		return true
+	}
+	badi := this.badNodeLocked(bucket, time.Now())
+	if badi < 0 {
+		return false
+	}
+	delete(this.keys, bucket[badi].Key())
+	bucket[badi] = item
+	this.keys[item.Key()] = item
+	return true
+}
+
+// like node_addable_to_close_list, a new node with pubkey can be put
+func (this *NodeTable) Addable(pubkey *CryptoKey) bool {
+	if pubkey.Equal(this.selfpk.Bytes()) {
+		return false
+	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if _, ok := this.keys[pubkey.BinStr()]; ok {
+		return false
+	}
+	bucket := this.buckets[bucketIndex(this.selfpk, pubkey)]
+	return len(bucket) < LCLIENT_NODES || this.badNodeLocked(bucket, time.Now()) >= 0
+}
+
+// index of the most stale node not seen in BAD_NODE_TIMEOUT, or -1
+func (this *NodeTable) badNodeLocked(bucket []*ClientData, now time.Time) int {
+	badi := -1
+	for i, item := range bucket {
+		if !IsTimeout4Time(now, item.Assoc.Timestamp, BAD_NODE_TIMEOUT) {
+			continue
+		}
+		if badi < 0 || item.Assoc.Timestamp.Before(bucket[badi].Assoc.Timestamp) {
+			badi = i
+		}
+	}
+	return badi
+}
+
+func (this *NodeTable) Remove(itemi PLItem) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	item, ok := this.keys[itemi.Key()]
+	if !ok {
+		return false
+	}
+	this.removeLocked(item)
+	return true
+}
+
+func (this *NodeTable) removeLocked(item *ClientData) {
+	idx := bucketIndex(this.selfpk, item.Pubkey)
+	bucket := this.buckets[idx]
+	for i := range bucket {
+		if bucket[i] == item {
+			this.buckets[idx] = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	delete(this.keys, item.Key())
+}
+
+// KillTimedOut removes nodes not seen in KILL_NODE_TIMEOUT, returns removed count.
+func (this *NodeTable) KillTimedOut(now time.Time) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	n := 0
+	for _, item := range this.keys {
+		if IsTimeout4Time(now, item.Assoc.Timestamp, KILL_NODE_TIMEOUT) {
+			this.removeLocked(item)
+			n++
+		}
+	}
+	return n
+}
+
+func (this *NodeTable) GetByKey(key string) PLItem {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if item, ok := this.keys[key]; ok {
+		return item
+	}
+	return nil
+}
+
+// items from the closest bucket to the farthest
+func (this *NodeTable) snapLocked() (lst []PLItem) {
+	for i := len(this.buckets) - 1; i >= 0; i-- {
+		for _, item := range this.buckets[i] {
+			lst = append(lst, item)
+		}
+	}
+	return
+}
+
+// snapshot
+func (this *NodeTable) EachSnap(f func(itemi PLItem)) {
+	if f == nil {
+		return
+	}
+	this.mu.RLock()
+	lst := this.snapLocked()
+	this.mu.RUnlock()
+	for _, item := range lst {
+		f(item)
+	}
+}
+
+// not call other method in this call, or deadlock
+func (this *NodeTable) EachInline(f func(itemi PLItem)) {
+	if f == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, item := range this.snapLocked() {
+		f(item)
+	}
+}
+
+func (this *NodeTable) SelectRandn(k int) (slts []PLItem) {
+	if k <= 0 {
+		return
+	}
+	this.mu.RLock()
+	lst := this.snapLocked()
+	this.mu.RUnlock()
+	if len(lst) <= k {
+		return lst
+	}
+	for _, i := range rand.Perm(len(lst))[:k] {
+		slts = append(slts, lst[i])
+	}
+	return
+}
+
+// Closest returns at most n nodes closest to pubkey by XOR distance, pubkey itself excluded.
+// With begood, nodes not seen in BAD_NODE_TIMEOUT are skipped.
+func (this *NodeTable) Closest(pubkey *CryptoKey, n int, begood bool) (rets []*ClientData) {
+	now := time.Now()
+	this.mu.RLock()
+	for _, item := range this.keys {
+		if item.Pubkey.Equal(pubkey.Bytes()) {
+			continue
+		}
+		if begood && IsTimeout4Time(now, item.Assoc.Timestamp, BAD_NODE_TIMEOUT) {
+			continue
+		}
+		rets = append(rets, item)
+	}
+	this.mu.RUnlock()
+	sort.Slice(rets, func(i, j int) bool {
+		return bytes.Compare(IDDistance(pubkey, rets[i].Pubkey), IDDistance(pubkey, rets[j].Pubkey)) < 0
+	})
+	if len(rets) > n {
+		rets = rets[:n]
+	}
+	return
+}
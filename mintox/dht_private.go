@@ -5,7 +5,6 @@ import (
 	"gopp"
 	"log"
 	"net"
-	"strings"
 )
 
 func (this *DHT) sendnodes_ipv6(addr net.Addr, pubkey *CryptoKey, clientid *CryptoKey, sbdata []byte, shrkey *CryptoKey) int {
@@ -14,11 +13,8 @@ func (this *DHT) sendnodes_ipv6(addr net.Addr, pubkey *CryptoKey, clientid *Cryp
 	taddr.IP = tip
 	taddr.Port = 12345
 
-	nodes := this.get_close_nodes(pubkey, 0, false, true)
+	nodes := this.get_close_nodes(clientid, 0, false, true)
 	// log.Println("will send nodes:", len(nodes))
-	if len(nodes) <= 0 {
-		return 0
-	}
 
 	buf := gopp.NewBufferZero()
 	buf.WriteByte(byte(len(nodes)))
@@ -36,31 +32,21 @@ func (this *DHT) sendnodes_ipv6(addr net.Addr, pubkey *CryptoKey, clientid *Cryp
 	return 0
 }
 
+// probe node with getnodes later if it can be put into close list,
+// it is put when the sendnodes comes back.
 func (this *DHT) add_to_ping(pubkey *CryptoKey, addr net.Addr) {
-
+	if !this.CloseClientList.Addable(pubkey) {
+		return
+	}
+	this.Pingo.addToPing(&NodeFormat{Pubkey: pubkey, Addr: addr, cmppk: this.SelfPubkey})
 }
 
 func pack_ip_port(addr net.Addr) []byte {
-	buf := gopp.NewBufferZero()
-
-	is_ipv4, net_family := true, byte(TOX_AF_INET)
-	_ = is_ipv4
-	if strings.HasPrefix(addr.String(), "[") {
-		is_ipv4 = false
-		net_family = TOX_AF_INET6
+	ip, port, _ := splitNodeAddr(addr)
+	if ip.To4() != nil {
+		return packNode(TOX_AF_INET, ip.To4(), port, nil)
 	}
-
-	buf.WriteByte(net_family)
-	uaddr := addr.(*net.UDPAddr)
-	if is_ipv4 {
-		buf.Write(uaddr.IP.To4())
-	} else {
-		buf.Write(uaddr.IP)
-	}
-	buf.Write([]byte{0, 0})
-	binary.Write(buf.WBufAt(1+4), binary.BigEndian, uint16(uaddr.Port))
-	// unpack_ip_port(buf.Bytes()) // for self unpack test
-	return buf.Bytes()
+	return packNode(TOX_AF_INET6, ip.To16(), port, nil)
 }
 
 func unpack_ip_port(data []byte) {
@@ -83,27 +69,6 @@ func unpack_ip_port(data []byte) {
 }
 
 func (this *DHT) get_close_nodes(pubkey *CryptoKey, safamily uint8, islan, begood bool) (rets []*NodeFormat) {
-	// get from this.CloseClientList
-	// get from this.FriendsList
-	// TODO more check
-
-	tmplst := NewPriorityList(1000)
-	this.CloseClientList.EachSnap(func(itemi PLItem) {
-		tmplst.Put(itemi.(*ClientData))
-	})
-
-	this.FriendsList.EachSnap(func(itemi PLItem) {
-		itemj := itemi.(*DHTFriend)
-		itemj.ClientList.EachSnap(func(itemk PLItem) {
-			tmplst.Put(itemk.(*ClientData))
-		})
-	})
-	items := tmplst.SelectRandn(MAX_SENT_NODES)
-	for _, itemx := range items {
-		clidat := itemx.(*ClientData)
-		node := &NodeFormat{Addr: clidat.Assoc.Addr, Pubkey: clidat.Pubkey}
-		rets = append(rets, node)
-	}
-	// log.Printf("selected %d of %d\n", len(rets), tmplst.Len())
-	return
+	// TODO safamily and islan check
+	return this.closestNodes(pubkey, MAX_SENT_NODES, begood)
 }
@@ -0,0 +1,148 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// key with the first bits same as selfpk, then differs at bit nsame
+func newTstKeyAt(selfpk *CryptoKey, nsame int) *CryptoKey {
+	pk, _, _ := NewCBKeyPair()
+	b := pk.Bytes()
+	copy(b, selfpk.Bytes()[:nsame/8+1])
+	mask := byte(0x80) >> uint(nsame%8)
+	b[nsame/8] = (b[nsame/8] &^ mask) | (^selfpk.Bytes()[nsame/8] & mask)
+	return pk
+}
+
+func newTstClientData(pk *CryptoKey, seen time.Time) *ClientData {
+	clidat := &ClientData{Pubkey: pk}
+	clidat.Assoc.Addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445}
+	clidat.Assoc.Timestamp = seen
+	clidat.Assoc.LastPinged = seen
+	return clidat
+}
+
+func TestNodeTableBuckets(t *testing.T) {
+	selfpk, _, _ := NewCBKeyPair()
+	tbl := NewNodeTable(selfpk)
+	if tbl.Put(newTstClientData(selfpk, time.Now())) {
+		t.Error("self put")
+	}
+
+	now := time.Now()
+	stale := now.Add(-(BAD_NODE_TIMEOUT + 1) * time.Second)
+	var keys []*CryptoKey
+	for i := 0; i < LCLIENT_NODES; i++ {
+		pk := newTstKeyAt(selfpk, 3)
+		if bucketIndex(selfpk, pk) != 3 {
+			t.Fatal("bucket index:", bucketIndex(selfpk, pk))
+		}
+		keys = append(keys, pk)
+		tbl.Put(newTstClientData(pk, ifElseTstTime(i == 0, stale, now)))
+	}
+	// bucket full, only the bad one can be replaced
+	newpk := newTstKeyAt(selfpk, 3)
+	if !tbl.Addable(newpk) || !tbl.Put(newTstClientData(newpk, now)) {
+		t.Fatal("bad node not replaced")
+	}
+	if tbl.GetByKey(keys[0].BinStr()) != nil || tbl.Len() != LCLIENT_NODES {
+		t.Error("bad node still in table:", tbl.Len())
+	}
+	morepk := newTstKeyAt(selfpk, 3)
+	if tbl.Addable(morepk) || tbl.Put(newTstClientData(morepk, now)) {
+		t.Error("put into full good bucket")
+	}
+	// other bucket has room
+	if !tbl.Put(newTstClientData(newTstKeyAt(selfpk, 40), now)) {
+		t.Error("put into empty bucket failed")
+	}
+
+	// update existing refresh timestamp
+	tbl.Put(newTstClientData(keys[1], now.Add(time.Second)))
+	if tbl.GetByKey(keys[1].BinStr()).(*ClientData).Assoc.Timestamp != now.Add(time.Second) {
+		t.Error("node not updated")
+	}
+
+	if n := tbl.KillTimedOut(now.Add((KILL_NODE_TIMEOUT + 1) * time.Second)); n != LCLIENT_NODES {
+		t.Error("killed:", n, tbl.Len())
+	}
+	if tbl.Len() != 1 {
+		t.Error("refreshed node killed:", tbl.Len())
+	}
+}
+
+func ifElseTstTime(c bool, a, b time.Time) time.Time {
+	if c {
+		return a
+	}
+	return b
+}
+
+func TestNodeTableClosest(t *testing.T) {
+	selfpk, _, _ := NewCBKeyPair()
+	tbl := NewNodeTable(selfpk)
+	for i := 0; i < 64; i++ {
+		pk, _, _ := NewCBKeyPair()
+		tbl.Put(newTstClientData(pk, time.Now()))
+	}
+	target, _, _ := NewCBKeyPair()
+	nodes := tbl.Closest(target, MAX_SENT_NODES, true)
+	if len(nodes) != MAX_SENT_NODES {
+		t.Fatal("closest count:", len(nodes))
+	}
+	farthest := nodes[len(nodes)-1].Pubkey
+	tbl.EachSnap(func(itemi PLItem) {
+		item := itemi.(*ClientData)
+		for _, n := range nodes {
+			if n == item {
+				return
+			}
+		}
+		if IDClosest(target, item.Pubkey, farthest) == 0 {
+			t.Error("closer node not selected:", item.Pubkey.ToHex20())
+		}
+	})
+	for i := 1; i < len(nodes); i++ {
+		if IDClosest(target, nodes[i].Pubkey, nodes[i-1].Pubkey) == 0 {
+			t.Error("not sorted by distance:", i)
+		}
+	}
+}
+
+func TestDHTGetNodes(t *testing.T) {
+	dhts := []*DHT{NewDHT(), NewDHT()}
+	defer dhts[0].Neto.srv.Close()
+	defer dhts[1].Neto.srv.Close()
+	addrOf := func(d *DHT) net.Addr {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: d.Neto.srv.LocalAddr().(*net.UDPAddr).Port}
+	}
+
+	// sendnodes with unknown ping id ignored
+	if n, _ := dhts[0].HandleSendNodesIpv6(nil, addrOf(dhts[1]), make([]byte, 1+PUBLIC_KEY_SIZE+NONCE_SIZE+1+8+MAC_SIZE), nil); n == 0 {
+		t.Error("bad sendnodes accepted")
+	}
+
+	dhts[0].Bootstrap(addrOf(dhts[1]), dhts[1].SelfPubkey)
+	ok := waitTstCond(3*time.Second, func() bool { return dhts[0].CloseClientList.GetByKey(dhts[1].SelfPubkey.BinStr()) != nil })
+	if !ok {
+		t.Fatal("bootstrap node not added")
+	}
+	// the requester is probed back and added too
+	ok = waitTstCond((TIME_TO_PING+3)*time.Second, func() bool {
+		return dhts[1].CloseClientList.GetByKey(dhts[0].SelfPubkey.BinStr()) != nil
+	})
+	if !ok {
+		t.Fatal("requester not added")
+	}
+
+	target, _, _ := NewCBKeyPair()
+	nodes := dhts[0].GetClosestNodes(target, MAX_SENT_NODES)
+	if len(nodes) != 1 || !nodes[0].Pubkey.Equal(dhts[1].SelfPubkey.Bytes()) {
+		t.Error("closest nodes:", len(nodes))
+	}
+	if len(dhts[0].GetClosestNodes(dhts[1].SelfPubkey, MAX_SENT_NODES)) != 0 {
+		t.Error("searched node itself returned")
+	}
+}
@@ -26,7 +26,7 @@ func NewDHTApi(pubkey, seckey string) *DHTApi {
 	dht := NewDHT()
 	dht.SetKeyPair(this.SelfPubkey, this.SelfSeckey)
 	this.dhto = dht
-	log.Println("dht key:", this.SelfPubkey.ToHex(), this.SelfSeckey.ToHex())
+	log.Println("dht key:", this.SelfPubkey.ToHex(), logkey(this.SelfSeckey))
 	dht.Neto.RegisterHandle(NET_PACKET_CRYPTO_DATA, this.HandleCryptoDataPacket, this)
 	return this
 }
@@ -69,14 +69,14 @@ func (this *DHTApi) sendPacketToFriend(pubkey *CryptoKey, pkt []byte) {
 	{
 		itemi := this.dhto.FriendsList.GetByKey(pubkey.BinStr())
 		if itemi == nil {
-			log.Println("can not find friend", pubkey.ToHex()[:20])
+			log.Println("can not find friend", pubkey)
 		} else {
 			itemi2 := itemi.(*DHTFriend).ClientList.GetByKey(pubkey.BinStr())
 			if itemi2 == nil {
-				log.Println("can not find friend info", pubkey.ToHex()[:20])
+				log.Println("can not find friend info", pubkey)
 			} else {
 				clidat := itemi2.(*NodeFormat)
-				log.Println("found friend:", clidat.Addr, pubkey.ToHex()[:20])
+				log.Println("found friend:", clidat.Addr, pubkey)
 				addr = clidat.Addr
 			}
 		}
@@ -84,7 +84,7 @@ func (this *DHTApi) sendPacketToFriend(pubkey *CryptoKey, pkt []byte) {
 	{
 		itemi := this.dhto.CloseClientList.GetByKey(pubkey.BinStr())
 		if itemi == nil {
-			log.Println("can not find friend from closest", pubkey.ToHex()[:20])
+			log.Println("can not find friend from closest", pubkey)
 		}
 	}
 
@@ -104,7 +104,7 @@ func (this *DHTApi) sendPacketToFriend(pubkey *CryptoKey, pkt []byte) {
 	if addr != nil {
 		wn, err := this.dhto.Neto.WriteTo(pkt, addr)
 		gopp.ErrPrint(err, wn, addr)
-		log.Println("sent data:", addr, wn, pubkey.ToHex()[:20])
+		log.Println("sent data:", addr, wn, pubkey)
 	}
 
 	if false {
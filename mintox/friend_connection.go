@@ -0,0 +1,683 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"gopp"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* Friend connection status, as Messenger's CONNECTION_* */
+const (
+	CONNECTION_NONE = 0
+	CONNECTION_TCP  = 1
+	CONNECTION_UDP  = 2
+)
+
+/* Packet ids used by friend_connection, in net_crypto lossless range. */
+const PACKET_ID_ALIVE = 16
+const PACKET_ID_SHARE_RELAYS = 17
+const PACKET_ID_FRIEND_REQUESTS = 18
+
+/* Interval between the sending of ping packets. */
+const FRIEND_PING_INTERVAL = 8
+
+/* If no packets are received from friend in this time interval, kill the connection. */
+const FRIEND_CONNECTION_TIMEOUT = (FRIEND_PING_INTERVAL * 4)
+
+// peer behind TCP relays, routed by its dht pubkey
+type tcpRelayAddr struct {
+	dhtpk *CryptoKey
+}
+
+func (this *tcpRelayAddr) Network() string { return "tcp_relay" }
+func (this *tcpRelayAddr) String() string  { return "tcp_relay/" + this.dhtpk.ToHex() }
+
+func isTCPRelayAddr(addr net.Addr) bool {
+	_, ok := addr.(*tcpRelayAddr)
+	return ok
+}
+
+type FriendConn struct {
+	Pubkey    *CryptoKey // friend real pubkey
+	DhtPubkey *CryptoKey // nil until known, see SetDHTPubkey
+	Status    uint8      // CONNECTION_*
+
+	udpAddr  net.Addr // given by SetFriendAddr or found in dht
+	crypto   *CryptoConn
+	tryTCP   bool // last udp attempt failed, connect by relay first
+	lastRecv time.Time
+	lastPing time.Time
+
+	OnStatus   func(fc *FriendConn, status uint8)
+	OnLossless func(fc *FriendConn, data []byte)
+	OnLossy    func(fc *FriendConn, data []byte)
+}
+
+// like friend_connection, keep net_crypto conns to friends by real pubkey,
+// directly by UDP when friend addr known, else by routes of TCP relays,
+// and fall back to the other one when a conn fails or times out.
+// Friend's dht pubkey comes from onion (dht_pk_callback) or its handshake.
+type FriendConns struct {
+	ncro  *NetCrypto
+	dhto  *DHT // nil then friend addr only by SetFriendAddr
+	clock clock
+
+	mu      sync.Mutex
+	friends map[string]*FriendConn // binpk =>
+	stopC   chan bool
+
+	// conn from peer not added, set callbacks of fc and return true to keep it
+	// as friend, like friend requests over net_crypto. nil rejects all.
+	OnStranger func(fc *FriendConn) bool
+
+	// leaf lock, sendTCP is called under ncro.mu
+	relaysmu sync.RWMutex
+	relays   []*TCPClient
+
+	proxy *TCPProxyInfo // of relays from ConnectTCPRelay, under mu
+
+	// finds friends' dht pubkey and sends requests when not connected, under mu
+	onion *OnionClient
+	// friend request got by onion, nospam | message
+	OnFriendRequest func(realpk *CryptoKey, data []byte)
+}
+
+func NewFriendConns(ncro *NetCrypto, dhto *DHT) *FriendConns {
+	this := &FriendConns{}
+	this.ncro, this.dhto = ncro, dhto
+	this.clock = ncro.clock
+	this.friends = map[string]*FriendConn{}
+	this.stopC = make(chan bool)
+
+	ncro.mu.Lock()
+	udpsend := ncro.sendto
+	ncro.sendto = func(pkt []byte, addr net.Addr) error {
+		if raddr, ok := addr.(*tcpRelayAddr); ok {
+			return this.sendTCP(raddr.dhtpk, pkt)
+		}
+		return udpsend(pkt, addr)
+	}
+	ncro.OnNewConn = this.acceptConn
+	ncro.mu.Unlock()
+
+	go this.doFriendConnsLoop()
+	return this
+}
+
+func (this *FriendConns) Kill() {
+	close(this.stopC)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, fc := range this.friends {
+		if fc.crypto != nil {
+			fc.crypto.Close()
+			fc.crypto = nil
+		}
+	}
+}
+
+// AddFriend returns conn of friend, set its callbacks then SetDHTPubkey to connect.
+func (this *FriendConns) AddFriend(realpk *CryptoKey) *FriendConn {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if fc, ok := this.friends[realpk.BinStr()]; ok {
+		return fc
+	}
+	fc := &FriendConn{Pubkey: realpk}
+	this.friends[realpk.BinStr()] = fc
+	if this.onion != nil {
+		this.onion.AddFriend(realpk)
+	}
+	return fc
+}
+
+func (this *FriendConns) DelFriend(realpk *CryptoKey) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	fc, ok := this.friends[realpk.BinStr()]
+	if !ok {
+		return false
+	}
+	delete(this.friends, realpk.BinStr())
+	if this.onion != nil {
+		this.onion.DelFriend(realpk)
+	}
+	if fc.crypto != nil {
+		fc.crypto.Close()
+		fc.crypto = nil
+	}
+	if fc.DhtPubkey != nil {
+		this.forgetDHTPubkeyLocked(fc.DhtPubkey)
+	}
+	return true
+}
+
+func (this *FriendConns) Friend(realpk *CryptoKey) *FriendConn {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.friends[realpk.BinStr()]
+}
+
+// DHTPubkey of friend, nil until known
+func (this *FriendConns) DHTPubkey(realpk *CryptoKey) *CryptoKey {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if fc, ok := this.friends[realpk.BinStr()]; ok {
+		return fc.DhtPubkey
+	}
+	return nil
+}
+
+// like dht_pk_callback, friend's dht pubkey got from onion or its handshake.
+// The old conn is killed when it changes.
+func (this *FriendConns) SetDHTPubkey(realpk, dhtpk *CryptoKey) {
+	this.mu.Lock()
+	fc, ok := this.friends[realpk.BinStr()]
+	if !ok || (fc.DhtPubkey != nil && fc.DhtPubkey.Equal2(dhtpk)) {
+		this.mu.Unlock()
+		return
+	}
+	var cb func()
+	if fc.DhtPubkey != nil {
+		log.Println("Friend dht pubkey changed:", realpk.ToHex20(), fc.DhtPubkey.ToHex20(), dhtpk.ToHex20())
+		this.forgetDHTPubkeyLocked(fc.DhtPubkey)
+		if fc.crypto != nil && !fc.crypto.DhtPubkey.Equal2(dhtpk) {
+			fc.crypto.Close()
+			fc.crypto = nil
+			cb = this.setStatusLocked(fc, CONNECTION_NONE)
+		}
+		fc.udpAddr = nil
+	}
+	fc.DhtPubkey = dhtpk
+	this.addDHTPubkeyLocked(dhtpk)
+	this.mu.Unlock()
+	if cb != nil {
+		cb()
+	}
+}
+
+// SetFriendAddr sets udp addr of friend, used before the one found in dht.
+func (this *FriendConns) SetFriendAddr(realpk *CryptoKey, addr net.Addr) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if fc, ok := this.friends[realpk.BinStr()]; ok {
+		fc.udpAddr = addr
+	}
+}
+
+// UDPAddr of friend, of its conn when direct, nil if not known
+func (this *FriendConns) UDPAddr(realpk *CryptoKey) net.Addr {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	fc, ok := this.friends[realpk.BinStr()]
+	if !ok {
+		return nil
+	}
+	if fc.crypto != nil {
+		this.ncro.mu.Lock()
+		addr := fc.crypto.Addr
+		this.ncro.mu.Unlock()
+		if addr != nil && !isTCPRelayAddr(addr) {
+			return addr
+		}
+	}
+	return fc.udpAddr
+}
+
+// AddTCPRelay uses cli to reach friends behind it, cli must use our dht keypair
+// as friends route to their dht pubkeys.
+func (this *FriendConns) AddTCPRelay(cli *TCPClient) {
+	cli.OnData = func(peerpk *CryptoKey, data []byte) {
+		err := this.ncro.handleTCPPacket(&tcpRelayAddr{peerpk}, data)
+		gopp.ErrPrint(err, peerpk.ToHex20(), cli.ServAddr)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.relaysmu.Lock()
+	this.relays = append(this.relays, cli)
+	this.relaysmu.Unlock()
+	if this.onion != nil {
+		this.onion.AddTCPRelay(cli)
+	}
+	for _, fc := range this.friends {
+		if fc.DhtPubkey != nil {
+			err := cli.AddPeer(fc.DhtPubkey)
+			gopp.ErrPrint(err, cli.ServAddr)
+		}
+	}
+}
+
+// connect relays through proxy from now on. UDP is disabled with a proxy,
+// so friends are only reached by TCP relays, like c with udp_enabled=false.
+func (this *FriendConns) SetProxy(proxy *TCPProxyInfo) {
+	this.mu.Lock()
+	this.proxy = proxy
+	this.mu.Unlock()
+	if this.ncro.neto != nil {
+		this.ncro.neto.SetUDPEnabled(proxy == nil || proxy.Type == TCP_PROXY_NONE)
+	}
+}
+
+func (this *FriendConns) udpEnabled() bool {
+	return this.ncro.neto == nil || this.ncro.neto.UDPEnabled()
+}
+
+// connect relay with our dht keypair, through the proxy if any, and add it
+func (this *FriendConns) ConnectTCPRelay(addr string, relaypk *CryptoKey) *TCPClient {
+	this.mu.Lock()
+	proxy := this.proxy
+	this.mu.Unlock()
+	cli := NewTCPClientProxy(addr, relaypk, this.ncro.dhtpk, this.ncro.dhtsk, proxy)
+	this.AddTCPRelay(cli)
+	return cli
+}
+
+// bootstrap dht by UDP, or take the node as TCP relay when UDP is disabled
+func (this *FriendConns) Bootstrap(addr string, pubkey *CryptoKey) error {
+	if this.udpEnabled() {
+		if this.dhto == nil {
+			return errors.New("no dht to bootstrap")
+		}
+		addro, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		return this.dhto.Bootstrap(addro, pubkey)
+	}
+	this.ConnectTCPRelay(addr, pubkey)
+	return nil
+}
+
+// SetOnionClient finds friends by oc, to learn their dht pubkeys and relays.
+func (this *FriendConns) SetOnionClient(oc *OnionClient) {
+	oc.OnDHTPubkey = this.handleOnionDHTPubkey
+	oc.RegisterDataHandler(ONION_DATA_FRIEND_REQ, func(realpk *CryptoKey, data []byte) {
+		if fn := this.OnFriendRequest; fn != nil {
+			fn(realpk, data[1:])
+		}
+	})
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.onion = oc
+	for _, fc := range this.friends {
+		oc.AddFriend(fc.Pubkey)
+		oc.SetFriendOnline(fc.Pubkey, fc.Status != CONNECTION_NONE)
+		if fc.DhtPubkey != nil {
+			oc.SetFriendDHTPubkey(fc.Pubkey, fc.DhtPubkey)
+		}
+	}
+	for _, cli := range this.snapRelays() {
+		oc.AddTCPRelay(cli)
+	}
+}
+
+// like dht_pk_callback and tcp_relay_node_callback, reach friend by its relays
+// and ask dht nodes close to it for its addr
+func (this *FriendConns) handleOnionDHTPubkey(realpk, dhtpk *CryptoKey, nodes []*NodeFormat) {
+	this.SetDHTPubkey(realpk, dhtpk)
+	for _, node := range nodes {
+		switch addr := node.Addr.(type) {
+		case *net.TCPAddr:
+			if !this.hasRelay(node.Pubkey) {
+				this.ConnectTCPRelay(addr.String(), node.Pubkey)
+			}
+		case *net.UDPAddr:
+			if this.dhto != nil && this.udpEnabled() {
+				this.dhto.GetNodes(addr, node.Pubkey, dhtpk)
+			}
+		}
+	}
+}
+
+func (this *FriendConns) hasRelay(pubkey *CryptoKey) bool {
+	for _, cli := range this.snapRelays() {
+		if cli.ServPubkey.Equal2(pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// like send_friend_request_packet, by friend conn when connected, else by onion
+func (this *FriendConns) SendFriendRequest(realpk *CryptoKey, nospam uint32, msg []byte) error {
+	pkt := make([]byte, 1+4, 1+4+len(msg))
+	binary.BigEndian.PutUint32(pkt[1:], nospam)
+	pkt = append(pkt, msg...)
+	if this.Status(realpk) != CONNECTION_NONE {
+		pkt[0] = PACKET_ID_FRIEND_REQUESTS
+		_, err := this.SendLossless(realpk, pkt)
+		return err
+	}
+	this.mu.Lock()
+	oc := this.onion
+	this.mu.Unlock()
+	if oc == nil {
+		return errors.New("Friend not connected")
+	}
+	pkt[0] = ONION_DATA_FRIEND_REQ
+	_, err := oc.SendData(realpk, pkt)
+	return err
+}
+
+// mu held by caller
+func (this *FriendConns) addDHTPubkeyLocked(dhtpk *CryptoKey) {
+	if this.dhto != nil {
+		this.dhto.AddFriend(dhtpk, nil, nil, 0)
+	}
+	for _, cli := range this.snapRelays() {
+		err := cli.AddPeer(dhtpk)
+		gopp.ErrPrint(err, cli.ServAddr)
+	}
+}
+
+// mu held by caller
+func (this *FriendConns) forgetDHTPubkeyLocked(dhtpk *CryptoKey) {
+	if this.dhto != nil {
+		this.dhto.DelFriend(dhtpk)
+	}
+	for _, cli := range this.snapRelays() {
+		err := cli.RemovePeer(dhtpk)
+		gopp.ErrPrint(err, cli.ServAddr)
+	}
+}
+
+func (this *FriendConns) snapRelays() []*TCPClient {
+	this.relaysmu.RLock()
+	defer this.relaysmu.RUnlock()
+	return append([]*TCPClient{}, this.relays...)
+}
+
+func (this *FriendConns) hasTCPRoute(dhtpk *CryptoKey) bool {
+	for _, cli := range this.snapRelays() {
+		if _, ok := cli.ConnidOf(dhtpk); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sendto of net_crypto for tcpRelayAddr, by first relay with route to peer
+func (this *FriendConns) sendTCP(dhtpk *CryptoKey, pkt []byte) error {
+	for _, cli := range this.snapRelays() {
+		if _, ok := cli.ConnidOf(dhtpk); !ok {
+			continue
+		}
+		if err := cli.SendData(dhtpk, pkt); err == nil {
+			return nil
+		}
+	}
+	return errors.Errorf("No relay route to: %s", dhtpk.ToHex20())
+}
+
+// OnNewConn of net_crypto, only friends accepted
+func (this *FriendConns) acceptConn(c *CryptoConn) bool {
+	this.mu.Lock()
+	fc, ok := this.friends[c.Pubkey.BinStr()]
+	this.mu.Unlock()
+	if !ok {
+		fc = &FriendConn{Pubkey: c.Pubkey}
+		if this.OnStranger == nil || !this.OnStranger(fc) {
+			return false
+		}
+		this.mu.Lock()
+		if _, ok := this.friends[c.Pubkey.BinStr()]; ok {
+			this.mu.Unlock()
+			return false
+		}
+		this.friends[c.Pubkey.BinStr()] = fc
+		this.mu.Unlock()
+	}
+	this.SetDHTPubkey(c.Pubkey, c.DhtPubkey)
+	// net_crypto has no conn of friend now, the old one if any is gone
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	fc.crypto = c
+	this.attach(c)
+	return true
+}
+
+func (this *FriendConns) attach(c *CryptoConn) {
+	c.OnStatus = this.handleCryptoStatus
+	c.OnLossless = func(c *CryptoConn, data []byte) {
+		if fc := this.touch(c); fc != nil && data[0] != PACKET_ID_ALIVE && fc.OnLossless != nil {
+			fc.OnLossless(fc, data)
+		}
+	}
+	c.OnLossy = func(c *CryptoConn, data []byte) {
+		if fc := this.touch(c); fc != nil && fc.OnLossy != nil {
+			fc.OnLossy(fc, data)
+		}
+	}
+}
+
+// friend of c if c is its current conn, and mark it alive
+func (this *FriendConns) touch(c *CryptoConn) *FriendConn {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	fc, ok := this.friends[c.Pubkey.BinStr()]
+	if !ok || fc.crypto != c {
+		return nil
+	}
+	fc.lastRecv = this.clock.Now()
+	return fc
+}
+
+func (this *FriendConns) handleCryptoStatus(c *CryptoConn, status uint8) {
+	this.mu.Lock()
+	fc, ok := this.friends[c.Pubkey.BinStr()]
+	if !ok || fc.crypto != c {
+		this.mu.Unlock()
+		return
+	}
+	var cb func()
+	switch status {
+	case CRYPTO_CONN_ESTABLISHED:
+		now := this.clock.Now()
+		fc.lastRecv, fc.lastPing = now, now
+		this.ncro.mu.Lock()
+		viatcp := isTCPRelayAddr(c.Addr)
+		this.ncro.mu.Unlock()
+		fc.tryTCP = false
+		cb = this.setStatusLocked(fc, uint8(gopp.IfElseInt(viatcp, CONNECTION_TCP, CONNECTION_UDP)))
+	case CRYPTO_CONN_NO_CONNECTION:
+		this.dropConnLocked(fc)
+		cb = this.setStatusLocked(fc, CONNECTION_NONE)
+	}
+	this.mu.Unlock()
+	if cb != nil {
+		cb()
+	}
+}
+
+// forget failed conn, next connect by the other transport. mu held by caller
+func (this *FriendConns) dropConnLocked(fc *FriendConn) {
+	this.ncro.mu.Lock()
+	viaudp := !isTCPRelayAddr(fc.crypto.Addr)
+	this.ncro.mu.Unlock()
+	fc.tryTCP = viaudp
+	fc.crypto = nil
+}
+
+// returns status callback to call without mu. mu held by caller
+func (this *FriendConns) setStatusLocked(fc *FriendConn, status uint8) func() {
+	if fc.Status == status {
+		return nil
+	}
+	log.Println("Friend conn status:", fc.Pubkey.ToHex20(), fc.Status, "=>", status)
+	fc.Status = status
+	if this.onion != nil {
+		this.onion.SetFriendOnline(fc.Pubkey, status != CONNECTION_NONE)
+		if fc.DhtPubkey != nil {
+			this.onion.SetFriendDHTPubkey(fc.Pubkey, fc.DhtPubkey)
+		}
+	}
+	if fn := fc.OnStatus; fn != nil {
+		return func() { fn(fc, status) }
+	}
+	return nil
+}
+
+// mu held by caller
+func (this *FriendConns) connectLocked(fc *FriendConn) {
+	var addr net.Addr
+	viatcp := this.hasTCPRoute(fc.DhtPubkey)
+	switch {
+	case fc.udpAddr != nil && this.udpEnabled() && !(fc.tryTCP && viatcp):
+		addr = fc.udpAddr
+	case viatcp:
+		addr = &tcpRelayAddr{fc.DhtPubkey}
+	default:
+		return
+	}
+	c, err := this.ncro.Connect(fc.Pubkey, fc.DhtPubkey, addr)
+	if err != nil {
+		gopp.ErrPrint(err, fc.Pubkey.ToHex20())
+		return
+	}
+	this.ncro.mu.Lock()
+	fc.crypto = c
+	this.attach(c)
+	this.ncro.mu.Unlock()
+}
+
+func (this *FriendConns) doFriendConnsLoop() {
+	tickC, stop := this.clock.Tick(time.Second)
+	defer stop()
+	for {
+		select {
+		case <-tickC:
+			this.doFriendConns()
+		case <-this.stopC:
+			return
+		}
+	}
+}
+
+// like do_friend_connections, connect friends with known dht pubkey,
+// ping connected ones and kill those not heard in FRIEND_CONNECTION_TIMEOUT.
+func (this *FriendConns) doFriendConns() {
+	var cbs []func()
+	now := this.clock.Now()
+	this.mu.Lock()
+	for _, fc := range this.friends {
+		if fc.DhtPubkey == nil {
+			continue
+		}
+		if this.dhto != nil && fc.udpAddr == nil {
+			fc.udpAddr = this.dhto.GetFriendIP(fc.DhtPubkey)
+		}
+		if fc.crypto == nil {
+			this.connectLocked(fc)
+			continue
+		}
+		if fc.Status == CONNECTION_NONE {
+			continue // connecting, net_crypto gives up by itself
+		}
+		if now.Sub(fc.lastRecv) > FRIEND_CONNECTION_TIMEOUT*time.Second {
+			log.Println("Friend conn timeout:", fc.Pubkey.ToHex20(), fc.Status)
+			c := fc.crypto
+			this.dropConnLocked(fc)
+			c.Close()
+			if cb := this.setStatusLocked(fc, CONNECTION_NONE); cb != nil {
+				cbs = append(cbs, cb)
+			}
+			continue
+		}
+		if now.Sub(fc.lastPing) >= FRIEND_PING_INTERVAL*time.Second {
+			fc.lastPing = now
+			_, err := fc.crypto.SendLossless([]byte{PACKET_ID_ALIVE})
+			gopp.ErrPrint(err, fc.Pubkey.ToHex20())
+		}
+	}
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
+
+// SendLossless sends data to friend over current conn, see CryptoConn.SendLossless.
+func (this *FriendConns) SendLossless(realpk *CryptoKey, data []byte) (uint32, error) {
+	this.mu.Lock()
+	fc, ok := this.friends[realpk.BinStr()]
+	var c *CryptoConn
+	if ok {
+		c = fc.crypto
+	}
+	this.mu.Unlock()
+	if c == nil {
+		return 0, errors.Errorf("Friend not connected: %s", realpk.ToHex20())
+	}
+	return c.SendLossless(data)
+}
+
+// SendLossy sends data to friend over current conn, see CryptoConn.SendLossy.
+func (this *FriendConns) SendLossy(realpk *CryptoKey, data []byte) error {
+	this.mu.Lock()
+	fc, ok := this.friends[realpk.BinStr()]
+	var c *CryptoConn
+	if ok {
+		c = fc.crypto
+	}
+	this.mu.Unlock()
+	if c == nil {
+		return errors.Errorf("Friend not connected: %s", realpk.ToHex20())
+	}
+	return c.SendLossy(data)
+}
+
+// CONNECTION_* of friend conn
+func (this *FriendConns) Status(realpk *CryptoKey) uint8 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if fc, ok := this.friends[realpk.BinStr()]; ok {
+		return fc.Status
+	}
+	return CONNECTION_NONE
+}
+
+// PacketReceived tells if friend got packet num of current conn, see CryptoConn.PacketReceived.
+func (this *FriendConns) PacketReceived(realpk *CryptoKey, num uint32) bool {
+	this.mu.Lock()
+	fc, ok := this.friends[realpk.BinStr()]
+	var c *CryptoConn
+	if ok {
+		c = fc.crypto
+	}
+	this.mu.Unlock()
+	return c != nil && c.PacketReceived(num)
+}
+
+// FreeSendSlots is lossless packets can be sent to friend now, see CryptoConn.FreeSendSlots.
+func (this *FriendConns) FreeSendSlots(realpk *CryptoKey) uint32 {
+	this.mu.Lock()
+	fc, ok := this.friends[realpk.BinStr()]
+	var c *CryptoConn
+	if ok {
+		c = fc.crypto
+	}
+	this.mu.Unlock()
+	if c == nil {
+		return 0
+	}
+	return c.FreeSendSlots()
+}
+
+// SendQueueLen is number of lossless packets friend not got yet, see CryptoConn.SendQueueLen.
+func (this *FriendConns) SendQueueLen(realpk *CryptoKey) uint32 {
+	this.mu.Lock()
+	fc, ok := this.friends[realpk.BinStr()]
+	var c *CryptoConn
+	if ok {
+		c = fc.crypto
+	}
+	this.mu.Unlock()
+	if c == nil {
+		return 0
+	}
+	return c.SendQueueLen()
+}
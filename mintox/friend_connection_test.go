@@ -0,0 +1,127 @@
+package mintox
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// advance clk by a second per step, net_crypto and friend conns tick on it
+func stepTstClock(clk *fakeTstClock, cond func() bool) bool {
+	for i := 0; i < MAX_NUM_SENDPACKET_TRIES; i++ {
+		clk.Advance(time.Second)
+		if waitTstCond(300*time.Millisecond, cond) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFriendConnFallback(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+
+	clk := newFakeTstClock()
+	var blockUDP int32
+	ncs := []*NetCrypto{newTstNetCrypto(clk), newTstNetCrypto(clk)}
+	fcs := make([]*FriendConns, 2)
+	clis := make([]*TCPClient, 2)
+	for i, nc := range ncs {
+		defer nc.neto.srv.Close()
+		defer nc.Kill()
+		sendto := nc.sendto
+		nc.sendto = func(pkt []byte, addr net.Addr) error {
+			if atomic.LoadInt32(&blockUDP) == 1 {
+				return nil
+			}
+			return sendto(pkt, addr)
+		}
+		fcs[i] = NewFriendConns(nc, nil)
+		defer fcs[i].Kill()
+		clis[i] = NewTCPClient(lsner.Addr().String(), srvo.Pubkey, nc.dhtpk, nc.dhtsk)
+		defer clis[i].Close()
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		return clis[0].Status == TCP_CLIENT_CONFIRMED && clis[1].Status == TCP_CLIENT_CONFIRMED
+	}) {
+		t.Fatal("relay clients not confirmed")
+	}
+	for i := range fcs {
+		fcs[i].AddTCPRelay(clis[i])
+	}
+
+	statusC := make(chan uint8, 8)
+	dataC := make(chan []byte, 1)
+	fc0 := fcs[0].AddFriend(ncs[1].SelfPubkey)
+	fc1 := fcs[1].AddFriend(ncs[0].SelfPubkey)
+	fc1.OnStatus = func(fc *FriendConn, status uint8) { statusC <- status }
+	fc1.OnLossless = func(fc *FriendConn, data []byte) { dataC <- data }
+	// only friend 0 knows the other, friend 1 learns dht pubkey from handshake
+	fcs[0].SetFriendAddr(ncs[1].SelfPubkey, ncs[1].tstAddr())
+	fcs[0].SetDHTPubkey(ncs[1].SelfPubkey, ncs[1].dhtpk)
+
+	status := func(fcso *FriendConns, fc *FriendConn) uint8 {
+		fcso.mu.Lock()
+		defer fcso.mu.Unlock()
+		return fc.Status
+	}
+	if !stepTstClock(clk, func() bool {
+		return status(fcs[0], fc0) == CONNECTION_UDP && status(fcs[1], fc1) == CONNECTION_UDP
+	}) {
+		t.Fatal("not connected by udp:", status(fcs[0], fc0), status(fcs[1], fc1))
+	}
+	if st := <-statusC; st != CONNECTION_UDP {
+		t.Error("status callback:", st)
+	}
+	if fcs[1].Friend(ncs[0].SelfPubkey).DhtPubkey == nil {
+		t.Error("dht pubkey not learned from handshake")
+	}
+	if _, err := fcs[0].SendLossless(ncs[1].SelfPubkey, []byte{PACKET_ID_MESSAGE, 'h'}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-dataC:
+		if string(data) != string([]byte{PACKET_ID_MESSAGE, 'h'}) {
+			t.Error("lossless data:", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("lossless data not received")
+	}
+
+	// udp lost, both time out then reconnect by relay
+	atomic.StoreInt32(&blockUDP, 1)
+	clk.Advance(FRIEND_CONNECTION_TIMEOUT*time.Second + time.Second)
+	if !stepTstClock(clk, func() bool {
+		return status(fcs[0], fc0) == CONNECTION_TCP && status(fcs[1], fc1) == CONNECTION_TCP
+	}) {
+		t.Fatal("not connected by tcp:", status(fcs[0], fc0), status(fcs[1], fc1))
+	}
+	if st0, st1 := <-statusC, <-statusC; st0 != CONNECTION_NONE || st1 != CONNECTION_TCP {
+		t.Error("fallback status callbacks:", st0, st1)
+	}
+	if _, err := fcs[0].SendLossless(ncs[1].SelfPubkey, []byte{PACKET_ID_MESSAGE, 't'}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-dataC:
+		if data[1] != 't' {
+			t.Error("lossless data by tcp:", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("lossless data by tcp not received")
+	}
+
+	if !fcs[1].DelFriend(ncs[0].SelfPubkey) || fcs[1].DelFriend(ncs[0].SelfPubkey) {
+		t.Error("DelFriend")
+	}
+}
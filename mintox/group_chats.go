@@ -0,0 +1,1577 @@
+package mintox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopp"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Group chats v2, like group_chats.c of toxcore "new groupchats". A group is
+// known by its chat id, the founder's signature pubkey, kept across restarts
+// by Save and Load. Peers are all connected to each other by FriendConns, so
+// every packet comes from its sender and roles are checked against it.
+// A peer's sig pubkey comes with its proof, a signature by it over chat id |
+// real pubkey | sig pubkey, so no one takes the sig pubkey, and the role, of
+// another.
+// Private groups are joined by invite of a friend, public ones also by chat
+// id, with peers found by GroupAnnounces.
+
+const PACKET_ID_INVITE_GROUPCHAT = 95 // to friend, chat id | privacy state | name len | name
+const PACKET_ID_GROUPCHAT = 100       // to peer, chat id | packet type | data
+
+const GC_CHAT_ID_SIZE = SIG_PUBLIC_KEY_SIZE
+const GC_PACKET_HEADER_SIZE = (1 + GC_CHAT_ID_SIZE + 1)
+const MAX_GC_MESSAGE_SIZE = (MAX_CRYPTO_DATA_SIZE - GC_PACKET_HEADER_SIZE - 1)
+
+const GC_SELF_PEER_ID = 0
+
+const GC_PING_INTERVAL = 12                    // seconds, versions sent to peers
+const GC_PEER_TIMEOUT = (GC_PING_INTERVAL * 4) // seconds, silent peer removed
+const GC_JOIN_RETRY_INTERVAL = 5               // seconds, join request to a peer again
+const GC_SEARCH_INTERVAL = 10                  // seconds, public group searched by chat id
+const GC_ANNOUNCE_INTERVAL = 60                // seconds, public group announced
+const GC_INVITE_TIMEOUT = 600                  // seconds, invited friend may join a private group
+const GC_KICK_TIMEOUT = 60                     // seconds, kick signed at applied within
+const MAX_GC_JOIN_TARGETS = 8
+const MAX_GC_SAVED_PEERS = 16
+
+// packet types after chat id
+const (
+	GC_JOIN_REQUEST    = 1  // sig pubkey | proof | nick len | nick | password len | password
+	GC_JOIN_RESPONSE   = 2  // code, when ok | sig pubkey | proof | nick len | nick
+	GC_SHARED_STATE    = 3  // sig | state
+	GC_MOD_LIST        = 4  // count | sig pubkeys
+	GC_SANCTIONS_LIST  = 5  // sig | sanctions
+	GC_TOPIC           = 6  // sig | topic
+	GC_PEER_LIST       = 7  // peers
+	GC_NEW_PEER        = 8  // peer admitted by the sender
+	GC_PEER_INFO       = 9  // sig pubkey | proof | nick len | nick
+	GC_MESSAGE         = 10 // type | message
+	GC_PRIVATE_MESSAGE = 11 // type | message
+	GC_KICK_PEER       = 12 // signer | sig pubkey of kicked | unix time | sig
+	GC_PEER_EXIT       = 13
+	GC_PING            = 14 // versions of shared state | sanctions | topic
+	GC_SYNC_REQUEST    = 15
+)
+
+// like Tox_Group_Join_Fail
+const (
+	GC_JOIN_OK               = 0
+	GC_JOIN_FAIL_PEER_LIMIT  = 1
+	GC_JOIN_FAIL_PASSWORD    = 2
+	GC_JOIN_FAIL_NOT_INVITED = 3
+)
+
+// like Tox_Group_Mod_Event
+const (
+	GC_MOD_EVENT_KICK      = 0
+	GC_MOD_EVENT_OBSERVER  = 1
+	GC_MOD_EVENT_USER      = 2
+	GC_MOD_EVENT_MODERATOR = 3
+)
+
+// like Tox_Group_Exit_Type
+const (
+	GC_EXIT_QUIT    = 0
+	GC_EXIT_TIMEOUT = 1
+	GC_EXIT_KICK    = 2
+)
+
+type gcPeer struct {
+	id       uint32
+	realpk   *CryptoKey
+	dhtpk    *CryptoKey
+	sigpk    *CryptoKey
+	proof    []byte // of sigpk, see gcSigProofMsg
+	nick     []byte
+	addr     net.Addr // udp addr told by who admitted it
+	heard    bool     // packet got from it, else our info sent again each ping
+	lastRecv time.Time
+	lastConn time.Time // conn to it added
+}
+
+// peer to send join request to, the inviter, a found announce or a saved peer
+type gcJoinTarget struct {
+	realpk  *CryptoKey
+	lastReq time.Time
+}
+
+type groupChat struct {
+	chatid       *CryptoKey
+	sigpk        *CryptoKey // ours in this group, chat id when founder
+	sigsk        []byte
+	nick         []byte
+	password     []byte // to join with
+	state        gcSharedState
+	mods         []*CryptoKey
+	pendingMods  []*CryptoKey // got before the shared state with its hash
+	sanctions    gcSanctions
+	topic        gcTopic
+	peers        []*gcPeer
+	nextPeerID   uint32
+	connected    bool // admitted, or founder
+	searching    bool // joining by chat id
+	targets      []*gcJoinTarget
+	invited      map[string]time.Time // binpk of invited friends => when
+	known        map[string]bool      // binpk of sig pubkeys admitted, may rejoin a private group
+	lastPing     time.Time
+	lastSearch   time.Time
+	lastAnnounce time.Time
+}
+
+// info of a group, see GroupChats.Info
+type GroupInfo struct {
+	ChatID    *CryptoKey
+	Name      []byte
+	Privacy   uint8
+	TopicLock bool
+	PeerLimit uint16
+	Password  []byte
+	Topic     []byte
+	SelfRole  uint8
+	Connected bool
+}
+
+// info of a peer, see GroupChats.Peers
+type GroupPeerInfo struct {
+	ID     uint32
+	Pubkey *CryptoKey // signature pubkey in the group
+	Nick   []byte
+	Role   uint8
+}
+
+// GroupChats are groups over conns of Messenger's FriendConns, with peers not
+// our friends too.
+type GroupChats struct {
+	m     *Messenger
+	ga    *GroupAnnounces // nil then groups not announced nor joined by chat id
+	clock clock
+
+	mu     sync.Mutex
+	groups []*groupChat // group number =>, nil when left
+	stopC  chan bool
+
+	// invite of friend, join by JoinByInvite with it
+	OnInvite func(fnum uint32, invite []byte, groupName []byte)
+	// we are admitted and got the group state
+	OnSelfJoin func(gnum uint32)
+	// join request refused with GC_JOIN_FAIL_*
+	OnJoinFail       func(gnum uint32, code int)
+	OnPeerJoin       func(gnum, peerid uint32)
+	OnPeerExit       func(gnum, peerid uint32, exitType int, nick []byte)
+	OnPeerName       func(gnum, peerid uint32, nick []byte)
+	OnMessage        func(gnum, peerid uint32, msgtype int, msg []byte)
+	OnPrivateMessage func(gnum, peerid uint32, msgtype int, msg []byte)
+	// peerid of setter, GC_SELF_PEER_ID if not in group
+	OnTopic        func(gnum, peerid uint32, topic []byte)
+	OnTopicLock    func(gnum uint32, locked bool)
+	OnPrivacyState func(gnum uint32, privacy uint8)
+	OnPeerLimit    func(gnum uint32, limit uint16)
+	OnPassword     func(gnum uint32, password []byte)
+	// role of target changed to the one of event, or it was kicked, by source.
+	// Target is GC_SELF_PEER_ID for us, the group is gone when we were kicked.
+	OnModeration func(gnum, source, target uint32, event int)
+}
+
+func NewGroupChats(m *Messenger, ga *GroupAnnounces) *GroupChats {
+	this := &GroupChats{}
+	this.m, this.ga = m, ga
+	this.clock = m.clock
+	this.stopC = make(chan bool)
+	if ga != nil {
+		ga.SetCallbackAnnounces(this.handleAnnounces)
+	}
+	m.mu.Lock()
+	m.groups = this
+	m.mu.Unlock()
+	go this.doGroupChatsLoop()
+	return this
+}
+
+func (this *GroupChats) Kill() { close(this.stopC) }
+
+// mu held by caller
+func (this *GroupChats) groupLocked(gnum uint32) (*groupChat, error) {
+	if gnum >= uint32(len(this.groups)) || this.groups[gnum] == nil {
+		return nil, errors.Errorf("Group not found: %d", gnum)
+	}
+	return this.groups[gnum], nil
+}
+
+// mu held by caller
+func (this *GroupChats) groupByIDLocked(chatid []byte) (uint32, bool) {
+	for i, g := range this.groups {
+		if g != nil && g.chatid.Equal(chatid) {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// mu held by caller
+func (this *GroupChats) addGroupLocked(g *groupChat) uint32 {
+	g.nextPeerID = GC_SELF_PEER_ID + 1
+	g.invited = map[string]time.Time{}
+	if g.known == nil {
+		g.known = map[string]bool{}
+	}
+	for i, g2 := range this.groups {
+		if g2 == nil {
+			this.groups[i] = g
+			return uint32(i)
+		}
+	}
+	this.groups = append(this.groups, g)
+	return uint32(len(this.groups) - 1)
+}
+
+// New creates group of GC_PRIVACY_STATE_*, we are its founder
+func (this *GroupChats) New(privacy uint8, name []byte) (uint32, error) {
+	if privacy > GC_PRIVACY_STATE_PRIVATE {
+		return 0, errors.Errorf("Invalid privacy state: %d", privacy)
+	}
+	if len(name) == 0 || len(name) > MAX_GC_GROUP_NAME_SIZE {
+		return 0, errors.Errorf("Invalid group name length: %d", len(name))
+	}
+	sigpk, sigsk, err := NewSigKeyPair()
+	if err != nil {
+		return 0, err
+	}
+	g := &groupChat{chatid: sigpk, sigpk: sigpk, sigsk: sigsk, nick: this.m.Name(), connected: true}
+	g.state = gcSharedState{version: 1, peerLimit: GC_DEFAULT_PEER_LIMIT, privacy: privacy,
+		name: append([]byte{}, name...), modHash: gcModListHash(nil)}
+	if err := g.state.sign(g.chatid, g.sigsk); err != nil {
+		return 0, err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.addGroupLocked(g), nil
+}
+
+// mu held by caller
+func (this *GroupChats) newJoinLocked(chatid *CryptoKey, password []byte) (*groupChat, uint32, error) {
+	if len(password) > MAX_GC_PASSWORD_SIZE {
+		return nil, 0, errors.Errorf("Invalid password length: %d", len(password))
+	}
+	if gnum, ok := this.groupByIDLocked(chatid.Bytes()); ok {
+		return nil, gnum, errors.Errorf("Group already joined: %d", gnum)
+	}
+	sigpk, sigsk, err := NewSigKeyPair()
+	if err != nil {
+		return nil, 0, err
+	}
+	g := &groupChat{chatid: chatid, sigpk: sigpk, sigsk: sigsk, nick: this.m.Name(),
+		password: append([]byte{}, password...)}
+	return g, this.addGroupLocked(g), nil
+}
+
+// Join joins public group by chat id, with peers found by GroupAnnounces
+func (this *GroupChats) Join(chatid *CryptoKey, password []byte) (uint32, error) {
+	if this.ga == nil {
+		return 0, errors.New("No group announces, join by invite")
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, gnum, err := this.newJoinLocked(chatid, password)
+	if err != nil {
+		return gnum, err
+	}
+	g.searching = true
+	this.searchLocked(g)
+	return gnum, nil
+}
+
+// JoinByInvite joins group by invite of OnInvite from friend fnum
+func (this *GroupChats) JoinByInvite(fnum uint32, invite []byte, password []byte) (uint32, error) {
+	if len(invite) < GC_CHAT_ID_SIZE+2 {
+		return 0, errors.Errorf("Invalid invite length: %d", len(invite))
+	}
+	realpk, ok := this.m.friendPubkey(fnum)
+	if !ok {
+		return 0, errors.Errorf("Friend not found: %d", fnum)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, gnum, err := this.newJoinLocked(NewCryptoKey(invite[:GC_CHAT_ID_SIZE]), password)
+	if err != nil {
+		return gnum, err
+	}
+	g.targets = append(g.targets, &gcJoinTarget{realpk: realpk})
+	if this.m.fcs.Status(realpk) != CONNECTION_NONE {
+		this.sendJoinRequestLocked(g, g.targets[0])
+	}
+	return gnum, nil
+}
+
+// Invite sends invite of group to online friend, who may join a private group then.
+func (this *GroupChats) Invite(fnum, gnum uint32) error {
+	realpk, ok := this.m.friendPubkey(fnum)
+	if !ok {
+		return errors.Errorf("Friend not found: %d", fnum)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		return err
+	}
+	if !g.connected {
+		return errors.New("Group not connected")
+	}
+	invite := []byte{PACKET_ID_INVITE_GROUPCHAT}
+	invite = append(append(invite, g.chatid.Bytes()...), g.state.privacy)
+	invite = append(append(invite, byte(len(g.state.name))), g.state.name...)
+	if err := this.m.sendFriendPacket(fnum, invite); err != nil {
+		return err
+	}
+	g.invited[realpk.BinStr()] = this.clock.Now()
+	return nil
+}
+
+// Leave leaves group, peers are told we left
+func (this *GroupChats) Leave(gnum uint32) error {
+	this.mu.Lock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		this.mu.Unlock()
+		return err
+	}
+	this.broadcastLocked(g, GC_PEER_EXIT, nil)
+	this.groups[gnum] = nil
+	cbs := this.releaseLocked(g.peers...)
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+	return nil
+}
+
+// SendMessage sends text of MESSAGE_NORMAL or MESSAGE_ACTION to all peers, observers can't
+func (this *GroupChats) SendMessage(gnum uint32, msgtype int, msg []byte) error {
+	return this.sendMessage(gnum, nil, msgtype, msg)
+}
+
+// SendPrivateMessage sends text to one peer
+func (this *GroupChats) SendPrivateMessage(gnum, peerid uint32, msgtype int, msg []byte) error {
+	return this.sendMessage(gnum, &peerid, msgtype, msg)
+}
+
+func (this *GroupChats) sendMessage(gnum uint32, peerid *uint32, msgtype int, msg []byte) error {
+	if msgtype != MESSAGE_NORMAL && msgtype != MESSAGE_ACTION {
+		return errors.Errorf("Invalid message type: %d", msgtype)
+	}
+	if len(msg) == 0 || len(msg) > MAX_GC_MESSAGE_SIZE {
+		return errors.Errorf("Invalid message length: %d", len(msg))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		return err
+	}
+	if !g.connected {
+		return errors.New("Group not connected")
+	}
+	if g.roleOf(g.sigpk) == GC_ROLE_OBSERVER {
+		return errors.New("Observer can't send messages")
+	}
+	data := append([]byte{byte(msgtype)}, msg...)
+	if peerid == nil {
+		this.broadcastLocked(g, GC_MESSAGE, data)
+		return nil
+	}
+	p := g.peerByID(*peerid)
+	if p == nil {
+		return errors.Errorf("Peer not found: %d/%d", gnum, *peerid)
+	}
+	return this.sendLocked(g, p.realpk, GC_PRIVATE_MESSAGE, data)
+}
+
+// SetSelfName sets our nick in group and tells peers
+func (this *GroupChats) SetSelfName(gnum uint32, nick []byte) error {
+	if len(nick) > MAX_NAME_LENGTH {
+		return errors.Errorf("Invalid nick length: %d", len(nick))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		return err
+	}
+	g.nick = append([]byte{}, nick...)
+	this.broadcastLocked(g, GC_PEER_INFO, g.selfInfo(this.m.SelfPubkey))
+	return nil
+}
+
+// SetTopic sets topic, by moderators only when topic locked, never by observers
+func (this *GroupChats) SetTopic(gnum uint32, topic []byte) error {
+	if len(topic) > MAX_GC_TOPIC_SIZE {
+		return errors.Errorf("Invalid topic length: %d", len(topic))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		return err
+	}
+	if !g.connected {
+		return errors.New("Group not connected")
+	}
+	if !g.canSetTopic(g.sigpk) {
+		return errors.New("Topic not allowed to set")
+	}
+	tp := &gcTopic{version: g.topic.version + 1, setter: g.sigpk, topic: append([]byte{}, topic...)}
+	if err := tp.sign(g.chatid, g.sigsk); err != nil {
+		return err
+	}
+	g.topic = *tp
+	this.broadcastLocked(g, GC_TOPIC, tp.bytes())
+	return nil
+}
+
+// SetTopicLock by founder, moderators only may set topic when locked
+func (this *GroupChats) SetTopicLock(gnum uint32, locked bool) error {
+	return this.updateState(gnum, func(st *gcSharedState) error {
+		st.topicLock = locked
+		return nil
+	})
+}
+
+// SetPrivacyState by founder, public groups are announced
+func (this *GroupChats) SetPrivacyState(gnum uint32, privacy uint8) error {
+	return this.updateState(gnum, func(st *gcSharedState) error {
+		if privacy > GC_PRIVACY_STATE_PRIVATE {
+			return errors.Errorf("Invalid privacy state: %d", privacy)
+		}
+		st.privacy = privacy
+		return nil
+	})
+}
+
+// SetPassword by founder, empty for none
+func (this *GroupChats) SetPassword(gnum uint32, password []byte) error {
+	return this.updateState(gnum, func(st *gcSharedState) error {
+		if len(password) > MAX_GC_PASSWORD_SIZE {
+			return errors.Errorf("Invalid password length: %d", len(password))
+		}
+		st.password = append([]byte{}, password...)
+		return nil
+	})
+}
+
+// SetPeerLimit by founder, peers over it are not kicked, new ones not admitted
+func (this *GroupChats) SetPeerLimit(gnum uint32, limit uint16) error {
+	return this.updateState(gnum, func(st *gcSharedState) error {
+		if limit == 0 {
+			return errors.New("Invalid peer limit: 0")
+		}
+		st.peerLimit = limit
+		return nil
+	})
+}
+
+func (this *GroupChats) updateState(gnum uint32, fn func(st *gcSharedState) error) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		return err
+	}
+	return this.updateStateLocked(g, fn)
+}
+
+// new version of shared state signed and sent by founder. mu held by caller
+func (this *GroupChats) updateStateLocked(g *groupChat, fn func(st *gcSharedState) error) error {
+	if !g.sigpk.Equal2(g.chatid) {
+		return errors.New("Not founder")
+	}
+	st := g.state
+	if err := fn(&st); err != nil {
+		return err
+	}
+	st.version++
+	st.modHash = gcModListHash(g.mods)
+	if err := st.sign(g.chatid, g.sigsk); err != nil {
+		return err
+	}
+	g.state = st
+	this.broadcastLocked(g, GC_SHARED_STATE, st.bytes())
+	return nil
+}
+
+// SetRole sets role of peer. Moderators are set by founder, observers by
+// founder or moderators over users.
+func (this *GroupChats) SetRole(gnum, peerid uint32, role uint8) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		return err
+	}
+	p := g.peerByID(peerid)
+	if p == nil || p.sigpk == nil {
+		return errors.Errorf("Peer not found: %d/%d", gnum, peerid)
+	}
+	self, cur := g.roleOf(g.sigpk), g.roleOf(p.sigpk)
+	if role == cur {
+		return nil
+	}
+	if role <= GC_ROLE_FOUNDER || role > GC_ROLE_OBSERVER || cur == GC_ROLE_FOUNDER {
+		return errors.Errorf("Invalid role change: %d => %d", cur, role)
+	}
+	if role == GC_ROLE_MODERATOR || cur == GC_ROLE_MODERATOR {
+		if self != GC_ROLE_FOUNDER {
+			return errors.New("Moderators set by founder only")
+		}
+		mods := append([]*CryptoKey{}, g.mods...)
+		if i := gcKeyIndex(mods, p.sigpk); i >= 0 {
+			mods = append(mods[:i], mods[i+1:]...)
+		}
+		if role == GC_ROLE_MODERATOR {
+			if len(mods) >= MAX_GC_MODERATORS {
+				return errors.New("Too many moderators")
+			}
+			mods = append(mods, p.sigpk)
+		}
+		if cur == GC_ROLE_OBSERVER {
+			if err := this.setObserverLocked(g, p.sigpk, false); err != nil {
+				return err
+			}
+		}
+		g.mods = mods
+		this.broadcastLocked(g, GC_MOD_LIST, packGCModList(mods))
+		if err := this.updateStateLocked(g, func(st *gcSharedState) error { return nil }); err != nil {
+			return err
+		}
+		if role != GC_ROLE_OBSERVER {
+			return nil
+		}
+	} else if self > GC_ROLE_MODERATOR || self >= cur {
+		return errors.New("Role not allowed to set")
+	}
+	return this.setObserverLocked(g, p.sigpk, role == GC_ROLE_OBSERVER)
+}
+
+// new sanctions list with sigpk observer or not, signed and sent by us. mu held by caller
+func (this *GroupChats) setObserverLocked(g *groupChat, sigpk *CryptoKey, observer bool) error {
+	observers := append([]*CryptoKey{}, g.sanctions.observers...)
+	if i := gcKeyIndex(observers, sigpk); i >= 0 {
+		observers = append(observers[:i], observers[i+1:]...)
+	}
+	if observer {
+		if len(observers) >= MAX_GC_SANCTIONS {
+			return errors.New("Too many sanctions")
+		}
+		observers = append(observers, sigpk)
+	}
+	sc := &gcSanctions{version: g.sanctions.version + 1, signer: g.sigpk, observers: observers}
+	if err := sc.sign(g.chatid, g.sigsk); err != nil {
+		return err
+	}
+	g.sanctions = *sc
+	this.broadcastLocked(g, GC_SANCTIONS_LIST, sc.bytes())
+	return nil
+}
+
+// Kick removes peer of lower role from group, by founder or moderators
+func (this *GroupChats) Kick(gnum, peerid uint32) error {
+	this.mu.Lock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		this.mu.Unlock()
+		return err
+	}
+	p := g.peerByID(peerid)
+	if p == nil || p.sigpk == nil {
+		this.mu.Unlock()
+		return errors.Errorf("Peer not found: %d/%d", gnum, peerid)
+	}
+	if self := g.roleOf(g.sigpk); self > GC_ROLE_MODERATOR || self >= g.roleOf(p.sigpk) {
+		this.mu.Unlock()
+		return errors.New("Peer not allowed to kick")
+	}
+	kick := gcKickPack(g.sigpk, p.sigpk, this.clock.Now())
+	sig, err := CryptoSign(g.sigsk, append(append([]byte{}, g.chatid.Bytes()...), kick...))
+	if err != nil {
+		this.mu.Unlock()
+		return err
+	}
+	this.broadcastLocked(g, GC_KICK_PEER, append(kick, sig...))
+	g.delPeer(p)
+	delete(g.known, p.sigpk.BinStr())
+	cbs := this.releaseLocked(p)
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+	return nil
+}
+
+func (this *GroupChats) Info(gnum uint32) (*GroupInfo, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		return nil, err
+	}
+	return &GroupInfo{ChatID: g.chatid, Name: append([]byte{}, g.state.name...), Privacy: g.state.privacy,
+		TopicLock: g.state.topicLock, PeerLimit: g.state.peerLimit, Password: append([]byte{}, g.state.password...),
+		Topic: append([]byte{}, g.topic.topic...), SelfRole: g.roleOf(g.sigpk), Connected: g.connected}, nil
+}
+
+// Peers of group but us, with their roles
+func (this *GroupChats) Peers(gnum uint32) ([]GroupPeerInfo, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g, err := this.groupLocked(gnum)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]GroupPeerInfo, 0, len(g.peers))
+	for _, p := range g.peers {
+		infos = append(infos, GroupPeerInfo{p.id, p.sigpk, append([]byte{}, p.nick...), g.roleOf(p.sigpk)})
+	}
+	return infos, nil
+}
+
+// List returns numbers of groups joined
+func (this *GroupChats) List() (gnums []uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, g := range this.groups {
+		if g != nil {
+			gnums = append(gnums, uint32(i))
+		}
+	}
+	return
+}
+
+// Save packs groups having state, with up to MAX_GC_SAVED_PEERS peers to
+// rejoin by, big endian: count | groups of chat id | sig pubkey | sig seckey |
+// nick | password | state | mod list | sanctions | topic | peers, see Load.
+func (this *GroupChats) Save() []byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var buf []byte
+	count := 0
+	for _, g := range this.groups {
+		if g == nil || g.state.version == 0 {
+			continue
+		}
+		count++
+		buf = append(append(append(buf, g.chatid.Bytes()...), g.sigpk.Bytes()...), g.sigsk...)
+		buf = append(append(buf, byte(len(g.nick))), g.nick...)
+		buf = append(append(buf, byte(len(g.password))), g.password...)
+		buf = appendGCBytes16(buf, g.state.bytes())
+		buf = appendGCBytes16(buf, packGCModList(g.mods))
+		if g.sanctions.version > 0 {
+			buf = appendGCBytes16(buf, g.sanctions.bytes())
+		} else {
+			buf = appendGCBytes16(buf, nil)
+		}
+		if g.topic.version > 0 {
+			buf = appendGCBytes16(buf, g.topic.bytes())
+		} else {
+			buf = appendGCBytes16(buf, nil)
+		}
+		var peers []*gcPeer
+		for _, p := range g.peers {
+			if p.sigpk != nil && p.dhtpk != nil && len(peers) < MAX_GC_SAVED_PEERS {
+				peers = append(peers, p)
+			}
+		}
+		buf = append(buf, byte(len(peers)))
+		for _, p := range peers {
+			buf = append(append(append(buf, p.realpk.Bytes()...), p.dhtpk.Bytes()...), p.sigpk.Bytes()...)
+		}
+	}
+	return append([]byte{byte(count >> 8), byte(count)}, buf...)
+}
+
+// u16 length | data
+func appendGCBytes16(buf []byte, data []byte) []byte {
+	return append(append(buf, byte(len(data)>>8), byte(len(data))), data...)
+}
+
+// Load restores groups of Save. The founder's are connected, others rejoin by
+// their saved peers. Groups with bad signatures or already joined are skipped.
+func (this *GroupChats) Load(data []byte) error {
+	rd := &gcReader{data: data}
+	count := int(binary.BigEndian.Uint16(rd.next(2)))
+	var gs []*groupChat
+	for i := 0; i < count && rd.err == nil; i++ {
+		g := &groupChat{known: map[string]bool{}}
+		g.chatid = NewCryptoKey(rd.next(GC_CHAT_ID_SIZE))
+		g.sigpk = NewCryptoKey(rd.next(SIG_PUBLIC_KEY_SIZE))
+		g.sigsk = append([]byte{}, rd.next(SIG_SECRET_KEY_SIZE)...)
+		g.nick = append([]byte{}, rd.next(int(rd.next(1)[0]))...)
+		g.password = append([]byte{}, rd.next(int(rd.next(1)[0]))...)
+		state, mods, sanctions, topic := rd.next16(), rd.next16(), rd.next16(), rd.next16()
+		var targets []*gcJoinTarget
+		for j := int(rd.next(1)[0]); j > 0 && rd.err == nil; j-- {
+			p := &gcPeer{realpk: NewCryptoKey(rd.next(PUBLIC_KEY_SIZE))}
+			p.dhtpk, p.sigpk = NewCryptoKey(rd.next(PUBLIC_KEY_SIZE)), NewCryptoKey(rd.next(SIG_PUBLIC_KEY_SIZE))
+			g.known[p.sigpk.BinStr()] = true
+			g.peers = append(g.peers, p) // targets below, not peers
+			targets = append(targets, &gcJoinTarget{realpk: p.realpk})
+		}
+		if rd.err != nil {
+			break
+		}
+		if err := g.load(state, mods, sanctions, topic); err != nil {
+			gopp.ErrPrint(err, g.chatid.ToHex20())
+			continue
+		}
+		g.connected = g.sigpk.Equal2(g.chatid)
+		if !g.connected {
+			g.targets = targets
+		}
+		gs = append(gs, g)
+	}
+	if rd.err != nil {
+		return rd.err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, g := range gs {
+		if _, ok := this.groupByIDLocked(g.chatid.Bytes()); ok {
+			continue
+		}
+		saved := g.peers
+		g.peers = nil
+		this.addGroupLocked(g)
+		for _, p := range saved {
+			this.connectLocked(p.realpk, p.dhtpk, nil)
+		}
+		g.searching = !g.connected && g.state.privacy == GC_PRIVACY_STATE_PUBLIC && this.ga != nil
+	}
+	return nil
+}
+
+// state, mod list, sanctions and topic of Save, checked like got from peers
+func (g *groupChat) load(state, mods, sanctions, topic []byte) error {
+	st, err := unpackGCSharedState(state)
+	if err != nil {
+		return err
+	}
+	ml, err := unpackGCModList(mods)
+	if err != nil {
+		return err
+	}
+	g.applyModList(ml)
+	if err := g.applySharedState(st); err != nil {
+		return err
+	}
+	if len(sanctions) > 0 {
+		sc, err := unpackGCSanctions(sanctions)
+		if err != nil {
+			return err
+		}
+		if err := g.applySanctions(sc); err != nil {
+			return err
+		}
+	}
+	if len(topic) > 0 {
+		tp, err := unpackGCTopic(topic)
+		if err != nil {
+			return err
+		}
+		if err := g.applyTopic(tp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reads of Load, err set and zeros returned once data runs out
+type gcReader struct {
+	data []byte
+	err  error
+}
+
+func (this *gcReader) next(n int) []byte {
+	if this.err != nil || len(this.data) < n {
+		if this.err == nil {
+			this.err = errors.Errorf("Groups savedata too short: %d < %d", len(this.data), n)
+		}
+		return make([]byte, n)
+	}
+	b := this.data[:n]
+	this.data = this.data[n:]
+	return b
+}
+
+// u16 length | data
+func (this *gcReader) next16() []byte {
+	return this.next(int(binary.BigEndian.Uint16(this.next(2))))
+}
+
+func (g *groupChat) peerByID(id uint32) *gcPeer {
+	for _, p := range g.peers {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (g *groupChat) peerByRealpk(realpk *CryptoKey) *gcPeer {
+	for _, p := range g.peers {
+		if p.realpk.Equal2(realpk) {
+			return p
+		}
+	}
+	return nil
+}
+
+// peer id of sigpk, GC_SELF_PEER_ID for us or not in group
+func (g *groupChat) idOf(sigpk *CryptoKey) uint32 {
+	for _, p := range g.peers {
+		if p.sigpk != nil && p.sigpk.Equal2(sigpk) {
+			return p.id
+		}
+	}
+	return GC_SELF_PEER_ID
+}
+
+func (g *groupChat) delPeer(p *gcPeer) {
+	for i, p2 := range g.peers {
+		if p2 == p {
+			g.peers = append(g.peers[:i], g.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+// chat id | realpk | sig pubkey, signed by sig pubkey for proof of it
+func gcSigProofMsg(chatid, realpk, sigpk *CryptoKey) []byte {
+	return append(append(append([]byte{}, chatid.Bytes()...), realpk.Bytes()...), sigpk.Bytes()...)
+}
+
+// sig pubkey | proof | nick len | nick, of us with realpk
+func (g *groupChat) selfInfo(realpk *CryptoKey) []byte {
+	proof, err := CryptoSign(g.sigsk, gcSigProofMsg(g.chatid, realpk, g.sigpk))
+	gopp.ErrPrint(err, g.chatid.ToHex20())
+	buf := append(append([]byte{}, g.sigpk.Bytes()...), proof...)
+	return append(append(buf, byte(len(g.nick))), g.nick...)
+}
+
+// sig pubkey | proof | nick len | nick of selfInfo by realpk, and used bytes
+// of data. Errors if the proof not by sig pubkey for realpk.
+func unpackGCPeerInfo(chatid, realpk *CryptoKey, data []byte) (p *gcPeer, n int, err error) {
+	pos := SIG_PUBLIC_KEY_SIZE + SIGNATURE_SIZE
+	if len(data) < pos+1 || int(data[pos]) > MAX_NAME_LENGTH || len(data) < pos+1+int(data[pos]) {
+		return nil, 0, errors.Errorf("Invalid group peer info: %d", len(data))
+	}
+	p = &gcPeer{realpk: realpk, sigpk: NewCryptoKey(data[:SIG_PUBLIC_KEY_SIZE])}
+	p.proof = append([]byte{}, data[SIG_PUBLIC_KEY_SIZE:pos]...)
+	if !CryptoSignVerify(p.sigpk, gcSigProofMsg(chatid, realpk, p.sigpk), p.proof) {
+		return nil, 0, errors.Errorf("Invalid sig pubkey proof: %s", realpk.ToHex20())
+	}
+	p.nick = append([]byte{}, data[pos+1:pos+1+int(data[pos])]...)
+	return p, pos + 1 + len(p.nick), nil
+}
+
+// like Conferences.addPeer, new peer with next id. mu held by caller
+func (this *GroupChats) addPeerLocked(g *groupChat, realpk *CryptoKey) *gcPeer {
+	now := this.clock.Now()
+	p := &gcPeer{id: g.nextPeerID, realpk: realpk, lastRecv: now, lastConn: now}
+	g.nextPeerID++
+	g.peers = append(g.peers, p)
+	return p
+}
+
+// conn to peer by FriendConns, its packets come by Messenger. mu held by caller
+func (this *GroupChats) connectLocked(realpk, dhtpk *CryptoKey, addr net.Addr) {
+	fcs := this.m.fcs
+	this.m.attach(fcs.AddFriend(realpk))
+	if addr != nil {
+		fcs.SetFriendAddr(realpk, addr)
+	}
+	if dhtpk != nil {
+		fcs.SetDHTPubkey(realpk, dhtpk)
+	}
+}
+
+// conns of peers not in any group now and not friends closed, by returned
+// funcs to call without mu. mu held by caller
+func (this *GroupChats) releaseLocked(peers ...*gcPeer) (cbs []func()) {
+	for _, p := range peers {
+		if this.wantsPeerLocked(p.realpk) {
+			continue
+		}
+		realpk := p.realpk
+		cbs = append(cbs, func() {
+			if _, ok := this.m.FriendNumber(realpk); !ok {
+				this.m.fcs.DelFriend(realpk)
+			}
+		})
+	}
+	return
+}
+
+// mu held by caller
+func (this *GroupChats) wantsPeerLocked(realpk *CryptoKey) bool {
+	for _, g := range this.groups {
+		if g == nil {
+			continue
+		}
+		if g.peerByRealpk(realpk) != nil {
+			return true
+		}
+		for _, t := range g.targets {
+			if t.realpk.Equal2(realpk) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PACKET_ID_GROUPCHAT | chat id | typ | data to peer. mu held by caller
+func (this *GroupChats) sendLocked(g *groupChat, realpk *CryptoKey, typ byte, data []byte) error {
+	pkt := make([]byte, 0, GC_PACKET_HEADER_SIZE+len(data))
+	pkt = append(append(append(pkt, PACKET_ID_GROUPCHAT), g.chatid.Bytes()...), typ)
+	_, err := this.m.fcs.SendLossless(realpk, append(pkt, data...))
+	return err
+}
+
+// to all peers connected. mu held by caller
+func (this *GroupChats) broadcastLocked(g *groupChat, typ byte, data []byte) {
+	for _, p := range g.peers {
+		if this.m.fcs.Status(p.realpk) == CONNECTION_NONE {
+			continue
+		}
+		gopp.ErrPrint(this.sendLocked(g, p.realpk, typ, data), p.id)
+	}
+}
+
+// shared state, mod list, sanctions and topic. mu held by caller
+func (this *GroupChats) sendStateLocked(g *groupChat, realpk *CryptoKey) {
+	gopp.ErrPrint(this.sendLocked(g, realpk, GC_MOD_LIST, packGCModList(g.mods)))
+	gopp.ErrPrint(this.sendLocked(g, realpk, GC_SHARED_STATE, g.state.bytes()))
+	if g.sanctions.version > 0 {
+		gopp.ErrPrint(this.sendLocked(g, realpk, GC_SANCTIONS_LIST, g.sanctions.bytes()))
+	}
+	if g.topic.version > 0 {
+		gopp.ErrPrint(this.sendLocked(g, realpk, GC_TOPIC, g.topic.bytes()))
+	}
+}
+
+// realpk | dhtpk | sig pubkey | proof | nick len | nick | addr count | packed addr
+func (this *GroupChats) packPeer(p *gcPeer) []byte {
+	buf := append(append([]byte{}, p.realpk.Bytes()...), p.dhtpk.Bytes()...)
+	buf = append(append(buf, p.sigpk.Bytes()...), p.proof...)
+	buf = append(append(buf, byte(len(p.nick))), p.nick...)
+	if p.addr != nil {
+		if node, err := PackNode(p.addr, p.dhtpk); err == nil {
+			return append(append(buf, 1), node...)
+		}
+	}
+	return append(buf, 0)
+}
+
+// peer of packPeer with proof checked, no id, and used bytes of data
+func unpackGCPeer(chatid *CryptoKey, data []byte) (*gcPeer, int, error) {
+	if len(data) < PUBLIC_KEY_SIZE*2 {
+		return nil, 0, errors.Errorf("Group peer too short: %d", len(data))
+	}
+	p, n, err := unpackGCPeerInfo(chatid, NewCryptoKey(data[:PUBLIC_KEY_SIZE]), data[PUBLIC_KEY_SIZE*2:])
+	if err != nil {
+		return nil, 0, err
+	}
+	p.dhtpk = NewCryptoKey(data[PUBLIC_KEY_SIZE : PUBLIC_KEY_SIZE*2])
+	pos := PUBLIC_KEY_SIZE*2 + n
+	if len(data) < pos+1 {
+		return nil, 0, errors.New("Group peer too short")
+	}
+	if data[pos] == 0 {
+		return p, pos + 1, nil
+	}
+	node, n, err := UnpackNode(data[pos+1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	p.addr = node.Addr
+	return p, pos + 1 + n, nil
+}
+
+// peers known but to, split by packet size, an empty list too as the joiner
+// is connected by the last one. mu held by caller
+func (this *GroupChats) sendPeerListLocked(g *groupChat, to *gcPeer) {
+	var buf []byte
+	sent := false
+	for _, p := range g.peers {
+		if p == to || p.sigpk == nil || p.dhtpk == nil {
+			continue
+		}
+		ent := this.packPeer(p)
+		if GC_PACKET_HEADER_SIZE+len(buf)+len(ent) > MAX_CRYPTO_DATA_SIZE {
+			gopp.ErrPrint(this.sendLocked(g, to.realpk, GC_PEER_LIST, buf))
+			buf, sent = nil, true
+		}
+		buf = append(buf, ent...)
+	}
+	if len(buf) > 0 || !sent {
+		gopp.ErrPrint(this.sendLocked(g, to.realpk, GC_PEER_LIST, buf))
+	}
+}
+
+// mu held by caller
+func (this *GroupChats) sendJoinRequestLocked(g *groupChat, t *gcJoinTarget) {
+	req := append(g.selfInfo(this.m.SelfPubkey), byte(len(g.password)))
+	req = append(req, g.password...)
+	if err := this.sendLocked(g, t.realpk, GC_JOIN_REQUEST, req); err == nil {
+		t.lastReq = this.clock.Now()
+	}
+}
+
+// mu held by caller
+func (this *GroupChats) searchLocked(g *groupChat) {
+	g.lastSearch = this.clock.Now()
+	_, err := this.ga.Search(g.chatid)
+	gopp.ErrPrint(err, g.chatid.ToHex20())
+}
+
+// peers found for public group we are joining
+func (this *GroupChats) handleAnnounces(chatid *CryptoKey, anns []*GroupAnnounce) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	gnum, ok := this.groupByIDLocked(chatid.Bytes())
+	if !ok || this.groups[gnum].connected {
+		return
+	}
+	g := this.groups[gnum]
+	for _, ann := range anns {
+		if ann.Pubkey.Equal2(this.m.SelfPubkey) || len(g.targets) >= MAX_GC_JOIN_TARGETS {
+			continue
+		}
+		found := false
+		for _, t := range g.targets {
+			found = found || t.realpk.Equal2(ann.Pubkey)
+		}
+		if found {
+			continue
+		}
+		g.targets = append(g.targets, &gcJoinTarget{realpk: ann.Pubkey})
+		this.connectLocked(ann.Pubkey, ann.DhtPubkey, ann.Addr)
+	}
+}
+
+// conn of friend or peer up or down, returns true if a group wants it
+func (this *GroupChats) handleConnStatus(realpk *CryptoKey, status uint8) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	wanted := false
+	for _, g := range this.groups {
+		if g == nil {
+			continue
+		}
+		for _, t := range g.targets {
+			if t.realpk.Equal2(realpk) {
+				wanted = true
+				if !g.connected && status != CONNECTION_NONE {
+					this.sendJoinRequestLocked(g, t)
+				}
+			}
+		}
+		if p := g.peerByRealpk(realpk); p != nil {
+			wanted = true
+			if g.connected && status != CONNECTION_NONE {
+				gopp.ErrPrint(this.sendLocked(g, realpk, GC_PEER_INFO, g.selfInfo(this.m.SelfPubkey)), p.id)
+			}
+		}
+	}
+	return wanted
+}
+
+// invite of friend, chat id | privacy state | name len | name
+func (this *GroupChats) handleInvite(fnum uint32, data []byte) {
+	if len(data) < GC_CHAT_ID_SIZE+2 || int(data[GC_CHAT_ID_SIZE+1]) > MAX_GC_GROUP_NAME_SIZE ||
+		len(data) != GC_CHAT_ID_SIZE+2+int(data[GC_CHAT_ID_SIZE+1]) {
+		return
+	}
+	this.mu.Lock()
+	fn := this.OnInvite
+	this.mu.Unlock()
+	if fn != nil {
+		invite := append([]byte{}, data...)
+		fn(fnum, invite, invite[GC_CHAT_ID_SIZE+2:])
+	}
+}
+
+// packets of groups from friend or peer, PACKET_ID_GROUPCHAT | chat id | type | data
+func (this *GroupChats) handlePacket(realpk *CryptoKey, data []byte) {
+	if len(data) < GC_PACKET_HEADER_SIZE {
+		return
+	}
+	var cbs []func()
+	this.mu.Lock()
+	if gnum, ok := this.groupByIDLocked(data[1 : 1+GC_CHAT_ID_SIZE]); ok {
+		typ, dat := data[1+GC_CHAT_ID_SIZE], data[GC_PACKET_HEADER_SIZE:]
+		cbs = this.handleGroupPacketLocked(gnum, this.groups[gnum], realpk, typ, dat)
+	}
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
+
+// mu held by caller
+func (this *GroupChats) handleGroupPacketLocked(gnum uint32, g *groupChat, realpk *CryptoKey, typ byte, data []byte) []func() {
+	switch typ {
+	case GC_JOIN_REQUEST:
+		return this.handleJoinRequestLocked(gnum, g, realpk, data)
+	case GC_JOIN_RESPONSE:
+		return this.handleJoinResponseLocked(gnum, g, realpk, data)
+	}
+	p := g.peerByRealpk(realpk)
+	if p == nil {
+		return nil
+	}
+	p.lastRecv, p.heard = this.clock.Now(), true
+	switch typ {
+	case GC_SHARED_STATE:
+		st, err := unpackGCSharedState(data)
+		if err != nil {
+			break
+		}
+		return this.applyLocked(gnum, g, p, func() error { return g.applySharedState(st) })
+	case GC_MOD_LIST:
+		mods, err := unpackGCModList(data)
+		if err != nil {
+			break
+		}
+		return this.applyLocked(gnum, g, p, func() error { g.applyModList(mods); return nil })
+	case GC_SANCTIONS_LIST:
+		sc, err := unpackGCSanctions(data)
+		if err != nil {
+			break
+		}
+		return this.applyLocked(gnum, g, p, func() error { return g.applySanctions(sc) })
+	case GC_TOPIC:
+		tp, err := unpackGCTopic(data)
+		if err != nil {
+			break
+		}
+		if err := g.applyTopic(tp); err != nil {
+			break
+		}
+		if fn := this.OnTopic; fn != nil && g.connected {
+			peerid, topic := g.idOf(tp.setter), tp.topic
+			return []func(){func() { fn(gnum, peerid, topic) }}
+		}
+	case GC_PEER_LIST:
+		return this.handlePeerListLocked(gnum, g, data)
+	case GC_NEW_PEER:
+		np, _, err := unpackGCPeer(g.chatid, data)
+		if err != nil || np.realpk.Equal2(this.m.SelfPubkey) || g.peerByRealpk(np.realpk) != nil {
+			break
+		}
+		return this.addListedPeerLocked(gnum, g, np, false)
+	case GC_PEER_INFO:
+		return this.handlePeerInfoLocked(gnum, g, p, data)
+	case GC_MESSAGE, GC_PRIVATE_MESSAGE:
+		if len(data) < 2 || data[0] > MESSAGE_ACTION || g.roleOf(p.sigpk) == GC_ROLE_OBSERVER {
+			break
+		}
+		fn := this.OnMessage
+		if typ == GC_PRIVATE_MESSAGE {
+			fn = this.OnPrivateMessage
+		}
+		if fn != nil {
+			peerid, msgtype, msg := p.id, int(data[0]), append([]byte{}, data[1:]...)
+			return []func(){func() { fn(gnum, peerid, msgtype, msg) }}
+		}
+	case GC_KICK_PEER:
+		return this.handleKickLocked(gnum, g, p, data)
+	case GC_PEER_EXIT:
+		g.delPeer(p)
+		cbs := this.releaseLocked(p)
+		if fn := this.OnPeerExit; fn != nil {
+			cbs = append(cbs, func() { fn(gnum, p.id, GC_EXIT_QUIT, p.nick) })
+		}
+		return cbs
+	case GC_PING:
+		if len(data) != 4*3 {
+			break
+		}
+		if binary.BigEndian.Uint32(data) > g.state.version || binary.BigEndian.Uint32(data[4:]) > g.sanctions.version ||
+			binary.BigEndian.Uint32(data[8:]) > g.topic.version {
+			gopp.ErrPrint(this.sendLocked(g, realpk, GC_SYNC_REQUEST, nil), p.id)
+		}
+	case GC_SYNC_REQUEST:
+		if g.state.version > 0 {
+			this.sendStateLocked(g, realpk)
+			this.sendPeerListLocked(g, p)
+		}
+	}
+	return nil
+}
+
+// like handle_gc_handshake_request of a joiner, admit it if allowed, then
+// give it the group state and peers, and tell peers of it. mu held by caller
+func (this *GroupChats) handleJoinRequestLocked(gnum uint32, g *groupChat, realpk *CryptoKey, data []byte) []func() {
+	if g.state.version == 0 {
+		return nil // not joined ourselves
+	}
+	info, pos, err := unpackGCPeerInfo(g.chatid, realpk, data)
+	if err != nil || len(data) < pos+1 || len(data) != pos+1+int(data[pos]) {
+		return nil
+	}
+	sigpk, nick, password := info.sigpk, info.nick, data[pos+1:]
+	if sigpk.Equal2(g.sigpk) {
+		return nil
+	}
+	p := g.peerByRealpk(realpk)
+	code := GC_JOIN_OK
+	invitedAt, invited := g.invited[realpk.BinStr()]
+	invited = invited && this.clock.Now().Sub(invitedAt) < GC_INVITE_TIMEOUT*time.Second
+	switch {
+	case g.state.privacy == GC_PRIVACY_STATE_PRIVATE && p == nil && !invited &&
+		!g.known[sigpk.BinStr()] && g.roleOf(sigpk) > GC_ROLE_MODERATOR:
+		code = GC_JOIN_FAIL_NOT_INVITED
+	case len(g.state.password) > 0 && !bytes.Equal(password, g.state.password):
+		code = GC_JOIN_FAIL_PASSWORD
+	case p == nil && len(g.peers)+1 >= int(g.state.peerLimit):
+		code = GC_JOIN_FAIL_PEER_LIMIT
+	}
+	if code != GC_JOIN_OK {
+		gopp.ErrPrint(this.sendLocked(g, realpk, GC_JOIN_RESPONSE, []byte{byte(code)}), gnum)
+		return nil
+	}
+	delete(g.invited, realpk.BinStr())
+	g.known[sigpk.BinStr()] = true
+	isnew := p == nil
+	if isnew {
+		p = this.addPeerLocked(g, realpk)
+	}
+	p.sigpk, p.proof, p.nick, p.heard = sigpk, info.proof, nick, true
+	p.dhtpk, p.addr = this.m.fcs.DHTPubkey(realpk), this.m.fcs.UDPAddr(realpk)
+	if p.dhtpk == nil {
+		g.delPeer(p)
+		return nil
+	}
+	rsp := append([]byte{GC_JOIN_OK}, g.selfInfo(this.m.SelfPubkey)...)
+	if err := this.sendLocked(g, realpk, GC_JOIN_RESPONSE, rsp); err != nil {
+		g.delPeer(p)
+		return nil
+	}
+	this.sendStateLocked(g, realpk)
+	this.sendPeerListLocked(g, p)
+	np := this.packPeer(p)
+	for _, p2 := range g.peers {
+		if p2 != p && this.m.fcs.Status(p2.realpk) != CONNECTION_NONE {
+			gopp.ErrPrint(this.sendLocked(g, p2.realpk, GC_NEW_PEER, np), p2.id)
+		}
+	}
+	if fn := this.OnPeerJoin; isnew && fn != nil {
+		return []func(){func() { fn(gnum, p.id) }}
+	}
+	return nil
+}
+
+// answer of our join request, the group state follows when ok. mu held by caller
+func (this *GroupChats) handleJoinResponseLocked(gnum uint32, g *groupChat, realpk *CryptoKey, data []byte) []func() {
+	ti := -1
+	for i, t := range g.targets {
+		if t.realpk.Equal2(realpk) {
+			ti = i
+		}
+	}
+	if ti < 0 || len(data) < 1 {
+		return nil
+	}
+	if data[0] != GC_JOIN_OK {
+		g.targets = append(g.targets[:ti], g.targets[ti+1:]...)
+		if fn := this.OnJoinFail; fn != nil {
+			code := int(data[0])
+			return []func(){func() { fn(gnum, code) }}
+		}
+		return nil
+	}
+	info, n, err := unpackGCPeerInfo(g.chatid, realpk, data[1:])
+	if err != nil || 1+n != len(data) {
+		return nil
+	}
+	p := g.peerByRealpk(realpk)
+	isnew := p == nil
+	if isnew {
+		p = this.addPeerLocked(g, realpk)
+	}
+	p.sigpk, p.proof, p.nick = info.sigpk, info.proof, info.nick
+	p.dhtpk, p.heard = this.m.fcs.DHTPubkey(realpk), true
+	g.known[p.sigpk.BinStr()] = true
+	if fn := this.OnPeerJoin; isnew && fn != nil {
+		return []func(){func() { fn(gnum, p.id) }}
+	}
+	return nil
+}
+
+// admitted with group state and peers got. mu held by caller
+func (this *GroupChats) joinedLocked(gnum uint32, g *groupChat) []func() {
+	if g.connected {
+		return nil
+	}
+	g.connected, g.searching, g.targets = true, false, nil
+	g.lastAnnounce = time.Time{}
+	this.broadcastLocked(g, GC_PEER_INFO, g.selfInfo(this.m.SelfPubkey))
+	if fn := this.OnSelfJoin; fn != nil {
+		return []func(){func() { fn(gnum) }}
+	}
+	return nil
+}
+
+// state packet applied by apply, callbacks of shared state and role changes. mu held by caller
+func (this *GroupChats) applyLocked(gnum uint32, g *groupChat, from *gcPeer, apply func() error) []func() {
+	oldst := g.state
+	roles := map[uint32]uint8{GC_SELF_PEER_ID: g.roleOf(g.sigpk)}
+	for _, p := range g.peers {
+		roles[p.id] = g.roleOf(p.sigpk)
+	}
+	oldSanctions := g.sanctions.version
+	if err := apply(); err != nil || !g.connected {
+		return nil
+	}
+	var cbs []func()
+	st := g.state
+	if fn := this.OnTopicLock; fn != nil && st.topicLock != oldst.topicLock {
+		cbs = append(cbs, func() { fn(gnum, st.topicLock) })
+	}
+	if fn := this.OnPrivacyState; fn != nil && st.privacy != oldst.privacy {
+		cbs = append(cbs, func() { fn(gnum, st.privacy) })
+	}
+	if fn := this.OnPeerLimit; fn != nil && st.peerLimit != oldst.peerLimit {
+		cbs = append(cbs, func() { fn(gnum, st.peerLimit) })
+	}
+	if fn := this.OnPassword; fn != nil && !bytes.Equal(st.password, oldst.password) {
+		cbs = append(cbs, func() { fn(gnum, st.password) })
+	}
+	// moderators by founder, observers by signer of sanctions
+	source := g.idOf(g.chatid)
+	if g.sanctions.version != oldSanctions {
+		source = g.idOf(g.sanctions.signer)
+	}
+	if source == GC_SELF_PEER_ID {
+		source = from.id
+	}
+	fn := this.OnModeration
+	for peerid, old := range roles {
+		sigpk := g.sigpk
+		if peerid != GC_SELF_PEER_ID {
+			sigpk = g.peerByID(peerid).sigpk
+		}
+		role := g.roleOf(sigpk)
+		if role == old || fn == nil {
+			continue
+		}
+		event := map[uint8]int{GC_ROLE_MODERATOR: GC_MOD_EVENT_MODERATOR, GC_ROLE_USER: GC_MOD_EVENT_USER,
+			GC_ROLE_OBSERVER: GC_MOD_EVENT_OBSERVER}[role]
+		target := peerid
+		cbs = append(cbs, func() { fn(gnum, source, target, event) })
+	}
+	return cbs
+}
+
+// peers of group from the peer admitted us, connected to, the last one after
+// the group state. mu held by caller
+func (this *GroupChats) handlePeerListLocked(gnum uint32, g *groupChat, data []byte) []func() {
+	var cbs []func()
+	if g.state.version > 0 {
+		cbs = this.joinedLocked(gnum, g)
+	}
+	for len(data) > 0 {
+		np, n, err := unpackGCPeer(g.chatid, data)
+		if err != nil {
+			break
+		}
+		data = data[n:]
+		if np.realpk.Equal2(this.m.SelfPubkey) || g.peerByRealpk(np.realpk) != nil {
+			continue
+		}
+		cbs = append(cbs, this.addListedPeerLocked(gnum, g, np, true)...)
+	}
+	return cbs
+}
+
+// peer told by another, connected to now when connect, else when it did not
+// connect to us in GC_JOIN_RETRY_INTERVAL. mu held by caller
+func (this *GroupChats) addListedPeerLocked(gnum uint32, g *groupChat, np *gcPeer, connect bool) []func() {
+	if g.state.peerLimit > 0 && len(g.peers)+1 >= int(g.state.peerLimit) {
+		return nil
+	}
+	p := this.addPeerLocked(g, np.realpk)
+	p.dhtpk, p.sigpk, p.proof, p.nick, p.addr = np.dhtpk, np.sigpk, np.proof, np.nick, np.addr
+	g.known[p.sigpk.BinStr()] = true
+	if connect {
+		this.connectLocked(p.realpk, p.dhtpk, p.addr)
+	}
+	if fn := this.OnPeerJoin; fn != nil {
+		return []func(){func() { fn(gnum, p.id) }}
+	}
+	return nil
+}
+
+// sig pubkey | proof | nick len | nick, the sig pubkey of a peer never changes. mu held by caller
+func (this *GroupChats) handlePeerInfoLocked(gnum uint32, g *groupChat, p *gcPeer, data []byte) []func() {
+	info, n, err := unpackGCPeerInfo(g.chatid, p.realpk, data)
+	if err != nil || n != len(data) {
+		return nil
+	}
+	if p.sigpk != nil && !p.sigpk.Equal2(info.sigpk) {
+		return nil
+	}
+	p.sigpk, p.proof = info.sigpk, info.proof
+	nick := info.nick
+	if bytes.Equal(nick, p.nick) {
+		return nil
+	}
+	p.nick = nick
+	if fn := this.OnPeerName; fn != nil {
+		return []func(){func() { fn(gnum, p.id, nick) }}
+	}
+	return nil
+}
+
+// signer | sig pubkey of kicked | unix time, signed over chat id | these
+func gcKickPack(signer, target *CryptoKey, at time.Time) []byte {
+	buf := append(append([]byte{}, signer.Bytes()...), target.Bytes()...)
+	tbuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(tbuf, uint64(at.Unix()))
+	return append(buf, tbuf...)
+}
+
+// kick signed by founder or a moderator of higher role than kicked, recently.
+// mu held by caller
+func (this *GroupChats) handleKickLocked(gnum uint32, g *groupChat, from *gcPeer, data []byte) []func() {
+	pos := SIG_PUBLIC_KEY_SIZE*2 + 8
+	if len(data) != pos+SIGNATURE_SIZE {
+		return nil
+	}
+	signer, sigpk := NewCryptoKey(data[:SIG_PUBLIC_KEY_SIZE]), NewCryptoKey(data[SIG_PUBLIC_KEY_SIZE:SIG_PUBLIC_KEY_SIZE*2])
+	at := time.Unix(int64(binary.BigEndian.Uint64(data[SIG_PUBLIC_KEY_SIZE*2:pos])), 0)
+	if d := this.clock.Now().Sub(at); d > GC_KICK_TIMEOUT*time.Second || d < -GC_KICK_TIMEOUT*time.Second {
+		return nil
+	}
+	if !CryptoSignVerify(signer, append(append([]byte{}, g.chatid.Bytes()...), data[:pos]...), data[pos:]) {
+		return nil
+	}
+	role := g.roleOf(signer)
+	if role > GC_ROLE_MODERATOR || role >= g.roleOf(sigpk) {
+		return nil
+	}
+	source := g.idOf(signer)
+	if source == GC_SELF_PEER_ID {
+		source = from.id
+	}
+	fn, exitfn := this.OnModeration, this.OnPeerExit
+	if sigpk.Equal2(g.sigpk) {
+		this.groups[gnum] = nil
+		cbs := this.releaseLocked(g.peers...)
+		if fn != nil {
+			cbs = append(cbs, func() { fn(gnum, source, GC_SELF_PEER_ID, GC_MOD_EVENT_KICK) })
+		}
+		return cbs
+	}
+	var p *gcPeer
+	for _, p2 := range g.peers {
+		if p2.sigpk != nil && p2.sigpk.Equal2(sigpk) {
+			p = p2
+		}
+	}
+	if p == nil {
+		return nil
+	}
+	g.delPeer(p)
+	delete(g.known, p.sigpk.BinStr())
+	cbs := this.releaseLocked(p)
+	if fn != nil {
+		cbs = append(cbs, func() { fn(gnum, source, p.id, GC_MOD_EVENT_KICK) })
+	}
+	if exitfn != nil {
+		cbs = append(cbs, func() { exitfn(gnum, p.id, GC_EXIT_KICK, p.nick) })
+	}
+	return cbs
+}
+
+func (this *GroupChats) doGroupChatsLoop() {
+	tickC, stop := this.clock.Tick(time.Second)
+	defer stop()
+	for {
+		select {
+		case <-tickC:
+			this.doGroupChats()
+		case <-this.stopC:
+			return
+		}
+	}
+}
+
+// like do_gc, join, ping and announce, remove silent peers
+func (this *GroupChats) doGroupChats() {
+	var cbs []func()
+	this.mu.Lock()
+	now := this.clock.Now()
+	for gnum, g := range this.groups {
+		if g == nil {
+			continue
+		}
+		if !g.connected {
+			if g.searching && this.ga != nil && now.Sub(g.lastSearch) >= GC_SEARCH_INTERVAL*time.Second {
+				this.searchLocked(g)
+			}
+			for _, t := range g.targets {
+				if now.Sub(t.lastReq) >= GC_JOIN_RETRY_INTERVAL*time.Second &&
+					this.m.fcs.Status(t.realpk) != CONNECTION_NONE {
+					this.sendJoinRequestLocked(g, t)
+				}
+			}
+			continue
+		}
+		ping := now.Sub(g.lastPing) >= GC_PING_INTERVAL*time.Second
+		if ping {
+			g.lastPing = now
+			vers := make([]byte, 4*3)
+			binary.BigEndian.PutUint32(vers, g.state.version)
+			binary.BigEndian.PutUint32(vers[4:], g.sanctions.version)
+			binary.BigEndian.PutUint32(vers[8:], g.topic.version)
+			this.broadcastLocked(g, GC_PING, vers)
+		}
+		for i := len(g.peers) - 1; i >= 0; i-- {
+			p := g.peers[i]
+			if now.Sub(p.lastRecv) >= GC_PEER_TIMEOUT*time.Second {
+				g.delPeer(p)
+				cbs = append(cbs, this.releaseLocked(p)...)
+				if fn := this.OnPeerExit; fn != nil {
+					gnum := uint32(gnum)
+					cbs = append(cbs, func() { fn(gnum, p.id, GC_EXIT_TIMEOUT, p.nick) })
+				}
+				continue
+			}
+			if this.m.fcs.Friend(p.realpk) == nil && p.dhtpk != nil &&
+				now.Sub(p.lastConn) >= GC_JOIN_RETRY_INTERVAL*time.Second {
+				p.lastConn = now
+				this.connectLocked(p.realpk, p.dhtpk, p.addr)
+			}
+			if ping && !p.heard && this.m.fcs.Status(p.realpk) != CONNECTION_NONE {
+				gopp.ErrPrint(this.sendLocked(g, p.realpk, GC_PEER_INFO, g.selfInfo(this.m.SelfPubkey)), p.id)
+			}
+		}
+		if g.state.privacy == GC_PRIVACY_STATE_PUBLIC && this.ga != nil &&
+			now.Sub(g.lastAnnounce) >= GC_ANNOUNCE_INTERVAL*time.Second {
+			g.lastAnnounce = now
+			_, err := this.ga.Announce(g.chatid, this.m.SelfPubkey, nil)
+			gopp.ErrPrint(err, gnum)
+		}
+	}
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
@@ -0,0 +1,323 @@
+package mintox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Signed state of a group, like group_moderation.c and the shared state of
+// group_chats.c. The chat id is the founder's signature pubkey, the founder
+// signs the shared state which has the hash of the moderator list, moderators
+// and the founder sign the sanctions list, and a topic is signed by its setter.
+// A newer version replaces the old one when its signature and signer's role are valid.
+
+const MAX_GC_GROUP_NAME_SIZE = 48
+const MAX_GC_TOPIC_SIZE = 512
+const MAX_GC_PASSWORD_SIZE = 32
+const MAX_GC_MODERATORS = 32
+const MAX_GC_SANCTIONS = 32
+const GC_DEFAULT_PEER_LIMIT = 100
+
+const (
+	GC_ROLE_FOUNDER   = 0
+	GC_ROLE_MODERATOR = 1
+	GC_ROLE_USER      = 2
+	GC_ROLE_OBSERVER  = 3
+)
+
+const (
+	GC_PRIVACY_STATE_PUBLIC  = 0 // joinable by chat id, announced in dht
+	GC_PRIVACY_STATE_PRIVATE = 1 // joinable by friend invite only
+)
+
+const GC_SANCTION_OBSERVER = 0
+
+// version | peer limit | privacy state | topic lock | name len | name |
+// password len | password | mod list hash, signed by founder
+type gcSharedState struct {
+	version   uint32
+	peerLimit uint16
+	privacy   uint8
+	topicLock bool // topic set by moderators only
+	name      []byte
+	password  []byte
+	modHash   []byte
+	sig       []byte
+}
+
+func (this *gcSharedState) pack() []byte {
+	buf := make([]byte, 4+2+1+1, 4+2+1+1+1+len(this.name)+1+len(this.password)+SHA256_SIZE)
+	binary.BigEndian.PutUint32(buf, this.version)
+	binary.BigEndian.PutUint16(buf[4:], this.peerLimit)
+	buf[6] = this.privacy
+	if this.topicLock {
+		buf[7] = 1
+	}
+	buf = append(append(buf, byte(len(this.name))), this.name...)
+	buf = append(append(buf, byte(len(this.password))), this.password...)
+	return append(buf, this.modHash...)
+}
+
+// sig | packed
+func unpackGCSharedState(data []byte) (*gcSharedState, error) {
+	if len(data) < SIGNATURE_SIZE+4+2+1+1+1+1+SHA256_SIZE {
+		return nil, errors.Errorf("Shared state too short: %d", len(data))
+	}
+	this := &gcSharedState{sig: append([]byte{}, data[:SIGNATURE_SIZE]...)}
+	data = data[SIGNATURE_SIZE:]
+	this.version = binary.BigEndian.Uint32(data)
+	this.peerLimit = binary.BigEndian.Uint16(data[4:])
+	this.privacy, this.topicLock = data[6], data[7] != 0
+	data = data[8:]
+	if int(data[0]) > MAX_GC_GROUP_NAME_SIZE || len(data) < 1+int(data[0])+1 {
+		return nil, errors.New("Invalid shared state name")
+	}
+	this.name = append([]byte{}, data[1:1+data[0]]...)
+	data = data[1+data[0]:]
+	if int(data[0]) > MAX_GC_PASSWORD_SIZE || len(data) != 1+int(data[0])+SHA256_SIZE {
+		return nil, errors.New("Invalid shared state password")
+	}
+	this.password = append([]byte{}, data[1:1+data[0]]...)
+	this.modHash = append([]byte{}, data[1+data[0]:]...)
+	if this.privacy > GC_PRIVACY_STATE_PRIVATE {
+		return nil, errors.Errorf("Invalid privacy state: %d", this.privacy)
+	}
+	return this, nil
+}
+
+func (this *gcSharedState) sign(chatid *CryptoKey, sk []byte) (err error) {
+	this.sig, err = CryptoSign(sk, append(append([]byte{}, chatid.Bytes()...), this.pack()...))
+	return
+}
+
+func (this *gcSharedState) verify(chatid *CryptoKey) bool {
+	return CryptoSignVerify(chatid, append(append([]byte{}, chatid.Bytes()...), this.pack()...), this.sig)
+}
+
+func (this *gcSharedState) bytes() []byte {
+	return append(append([]byte{}, this.sig...), this.pack()...)
+}
+
+// like mod_list_make_hash, zeros for none
+func gcModListHash(mods []*CryptoKey) []byte {
+	if len(mods) == 0 {
+		return make([]byte, SHA256_SIZE)
+	}
+	h := sha256.New()
+	for _, pk := range mods {
+		h.Write(pk.Bytes())
+	}
+	return h.Sum(nil)
+}
+
+// count | sig pubkeys
+func packGCModList(mods []*CryptoKey) []byte {
+	buf := []byte{byte(len(mods))}
+	for _, pk := range mods {
+		buf = append(buf, pk.Bytes()...)
+	}
+	return buf
+}
+
+func unpackGCModList(data []byte) ([]*CryptoKey, error) {
+	if len(data) < 1 || data[0] > MAX_GC_MODERATORS || len(data) != 1+int(data[0])*SIG_PUBLIC_KEY_SIZE {
+		return nil, errors.Errorf("Invalid mod list length: %d", len(data))
+	}
+	var mods []*CryptoKey
+	for pos := 1; pos < len(data); pos += SIG_PUBLIC_KEY_SIZE {
+		mods = append(mods, NewCryptoKey(data[pos:pos+SIG_PUBLIC_KEY_SIZE]))
+	}
+	return mods, nil
+}
+
+// version | signer | count | sanction type | target of each, signed by signer
+type gcSanctions struct {
+	version   uint32
+	signer    *CryptoKey // founder or a moderator
+	observers []*CryptoKey
+	sig       []byte
+}
+
+func (this *gcSanctions) pack() []byte {
+	buf := make([]byte, 4, 4+SIG_PUBLIC_KEY_SIZE+1+len(this.observers)*(1+SIG_PUBLIC_KEY_SIZE))
+	binary.BigEndian.PutUint32(buf, this.version)
+	buf = append(append(buf, this.signer.Bytes()...), byte(len(this.observers)))
+	for _, pk := range this.observers {
+		buf = append(append(buf, GC_SANCTION_OBSERVER), pk.Bytes()...)
+	}
+	return buf
+}
+
+// sig | packed
+func unpackGCSanctions(data []byte) (*gcSanctions, error) {
+	if len(data) < SIGNATURE_SIZE+4+SIG_PUBLIC_KEY_SIZE+1 {
+		return nil, errors.Errorf("Sanctions list too short: %d", len(data))
+	}
+	this := &gcSanctions{sig: append([]byte{}, data[:SIGNATURE_SIZE]...)}
+	data = data[SIGNATURE_SIZE:]
+	this.version = binary.BigEndian.Uint32(data)
+	this.signer = NewCryptoKey(data[4 : 4+SIG_PUBLIC_KEY_SIZE])
+	count := int(data[4+SIG_PUBLIC_KEY_SIZE])
+	data = data[4+SIG_PUBLIC_KEY_SIZE+1:]
+	if count > MAX_GC_SANCTIONS || len(data) != count*(1+SIG_PUBLIC_KEY_SIZE) {
+		return nil, errors.Errorf("Invalid sanctions count: %d", count)
+	}
+	for ; len(data) > 0; data = data[1+SIG_PUBLIC_KEY_SIZE:] {
+		if data[0] != GC_SANCTION_OBSERVER {
+			return nil, errors.Errorf("Invalid sanction type: %d", data[0])
+		}
+		this.observers = append(this.observers, NewCryptoKey(data[1:1+SIG_PUBLIC_KEY_SIZE]))
+	}
+	return this, nil
+}
+
+func (this *gcSanctions) sign(chatid *CryptoKey, sk []byte) (err error) {
+	this.sig, err = CryptoSign(sk, append(append([]byte{}, chatid.Bytes()...), this.pack()...))
+	return
+}
+
+func (this *gcSanctions) verify(chatid *CryptoKey) bool {
+	return CryptoSignVerify(this.signer, append(append([]byte{}, chatid.Bytes()...), this.pack()...), this.sig)
+}
+
+func (this *gcSanctions) bytes() []byte { return append(append([]byte{}, this.sig...), this.pack()...) }
+
+// version | setter | topic, signed by setter
+type gcTopic struct {
+	version uint32
+	setter  *CryptoKey
+	topic   []byte
+	sig     []byte
+}
+
+func (this *gcTopic) pack() []byte {
+	buf := make([]byte, 4, 4+SIG_PUBLIC_KEY_SIZE+len(this.topic))
+	binary.BigEndian.PutUint32(buf, this.version)
+	return append(append(buf, this.setter.Bytes()...), this.topic...)
+}
+
+// sig | packed
+func unpackGCTopic(data []byte) (*gcTopic, error) {
+	if len(data) < SIGNATURE_SIZE+4+SIG_PUBLIC_KEY_SIZE || len(data) > SIGNATURE_SIZE+4+SIG_PUBLIC_KEY_SIZE+MAX_GC_TOPIC_SIZE {
+		return nil, errors.Errorf("Invalid topic length: %d", len(data))
+	}
+	this := &gcTopic{sig: append([]byte{}, data[:SIGNATURE_SIZE]...)}
+	data = data[SIGNATURE_SIZE:]
+	this.version = binary.BigEndian.Uint32(data)
+	this.setter = NewCryptoKey(data[4 : 4+SIG_PUBLIC_KEY_SIZE])
+	this.topic = append([]byte{}, data[4+SIG_PUBLIC_KEY_SIZE:]...)
+	return this, nil
+}
+
+func (this *gcTopic) sign(chatid *CryptoKey, sk []byte) (err error) {
+	this.sig, err = CryptoSign(sk, append(append([]byte{}, chatid.Bytes()...), this.pack()...))
+	return
+}
+
+func (this *gcTopic) verify(chatid *CryptoKey) bool {
+	return CryptoSignVerify(this.setter, append(append([]byte{}, chatid.Bytes()...), this.pack()...), this.sig)
+}
+
+func (this *gcTopic) bytes() []byte { return append(append([]byte{}, this.sig...), this.pack()...) }
+
+// role of peer by its signature pubkey
+func (g *groupChat) roleOf(sigpk *CryptoKey) uint8 {
+	if sigpk == nil {
+		return GC_ROLE_USER
+	}
+	if sigpk.Equal2(g.chatid) {
+		return GC_ROLE_FOUNDER
+	}
+	if gcKeyIndex(g.mods, sigpk) >= 0 {
+		return GC_ROLE_MODERATOR
+	}
+	if gcKeyIndex(g.sanctions.observers, sigpk) >= 0 {
+		return GC_ROLE_OBSERVER
+	}
+	return GC_ROLE_USER
+}
+
+func gcKeyIndex(keys []*CryptoKey, pk *CryptoKey) int {
+	for i, k := range keys {
+		if k.Equal2(pk) {
+			return i
+		}
+	}
+	return -1
+}
+
+// like mod_list_verify_sig_pk, a newer founder signed state, mod list kept
+// only when it matches the hash
+func (g *groupChat) applySharedState(st *gcSharedState) error {
+	if st.version <= g.state.version {
+		return errors.Errorf("Shared state not newer: %d <= %d", st.version, g.state.version)
+	}
+	if !st.verify(g.chatid) {
+		return errors.New("Invalid shared state signature")
+	}
+	g.state = *st
+	if !bytes.Equal(gcModListHash(g.mods), st.modHash) {
+		g.mods = nil
+		if g.pendingMods != nil && bytes.Equal(gcModListHash(g.pendingMods), st.modHash) {
+			g.mods, g.pendingMods = g.pendingMods, nil
+		}
+	}
+	return nil
+}
+
+// mod list of current shared state, else kept for a newer one
+func (g *groupChat) applyModList(mods []*CryptoKey) {
+	if g.state.version > 0 && bytes.Equal(gcModListHash(mods), g.state.modHash) {
+		g.mods, g.pendingMods = mods, nil
+		return
+	}
+	g.pendingMods = mods
+}
+
+// like sanctions_list_check_integrity, signer is founder or moderator, who can't
+// sanction the founder, moderators only by the founder
+func (g *groupChat) applySanctions(sc *gcSanctions) error {
+	if sc.version <= g.sanctions.version {
+		return errors.Errorf("Sanctions not newer: %d <= %d", sc.version, g.sanctions.version)
+	}
+	signerRole := g.roleOf(sc.signer)
+	if signerRole > GC_ROLE_MODERATOR {
+		return errors.Errorf("Sanctions signer not moderator: %d", signerRole)
+	}
+	for _, pk := range sc.observers {
+		if role := g.roleOf(pk); role == GC_ROLE_FOUNDER || (role == GC_ROLE_MODERATOR && signerRole != GC_ROLE_FOUNDER) {
+			return errors.Errorf("Sanction of role: %d", role)
+		}
+	}
+	if !sc.verify(g.chatid) {
+		return errors.New("Invalid sanctions signature")
+	}
+	g.sanctions = *sc
+	return nil
+}
+
+// setter is moderator when topic locked, else not observer
+func (g *groupChat) canSetTopic(sigpk *CryptoKey) bool {
+	role := g.roleOf(sigpk)
+	if g.state.topicLock {
+		return role <= GC_ROLE_MODERATOR
+	}
+	return role < GC_ROLE_OBSERVER
+}
+
+func (g *groupChat) applyTopic(tp *gcTopic) error {
+	if tp.version <= g.topic.version {
+		return errors.Errorf("Topic not newer: %d <= %d", tp.version, g.topic.version)
+	}
+	if !g.canSetTopic(tp.setter) {
+		return errors.New("Topic setter not allowed")
+	}
+	if !tp.verify(g.chatid) {
+		return errors.New("Invalid topic signature")
+	}
+	g.topic = *tp
+	return nil
+}
@@ -0,0 +1,370 @@
+package mintox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupChatSignedState(t *testing.T) {
+	chatid, founder, _ := NewSigKeyPair()
+	g := &groupChat{chatid: chatid, sigpk: chatid}
+	st := &gcSharedState{version: 1, peerLimit: 10, name: []byte("g"), modHash: gcModListHash(nil)}
+	if err := st.sign(chatid, founder); err != nil {
+		t.Fatal(err)
+	}
+	st2, err := unpackGCSharedState(st.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.applySharedState(st2); err != nil || string(g.state.name) != "g" {
+		t.Fatal("shared state not applied:", err)
+	}
+	if g.applySharedState(st2) == nil {
+		t.Error("same version applied again")
+	}
+	modpk, modsk, _ := NewSigKeyPair()
+	userpk, usersk, _ := NewSigKeyPair()
+	forged := &gcSharedState{version: 2, peerLimit: 10, modHash: gcModListHash(nil)}
+	forged.sign(chatid, usersk)
+	if g.applySharedState(forged) == nil {
+		t.Error("state not signed by founder applied")
+	}
+
+	// mod list waits for the state with its hash
+	g.applyModList([]*CryptoKey{modpk})
+	if g.roleOf(modpk) != GC_ROLE_USER {
+		t.Error("mod list applied before state")
+	}
+	st = &gcSharedState{version: 2, peerLimit: 10, modHash: gcModListHash([]*CryptoKey{modpk})}
+	st.sign(chatid, founder)
+	if err := g.applySharedState(st); err != nil || g.roleOf(modpk) != GC_ROLE_MODERATOR {
+		t.Fatal("mod not set:", err, g.roleOf(modpk))
+	}
+
+	sanction := func(signer *CryptoKey, sk []byte, version uint32, pks ...*CryptoKey) *gcSanctions {
+		sc := &gcSanctions{version: version, signer: signer, observers: pks}
+		sc.sign(chatid, sk)
+		sc2, err := unpackGCSanctions(sc.bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sc2
+	}
+	if g.applySanctions(sanction(userpk, usersk, 1, modpk)) == nil {
+		t.Error("sanctions by user applied")
+	}
+	if g.applySanctions(sanction(modpk, modsk, 1, chatid)) == nil {
+		t.Error("founder sanctioned")
+	}
+	if err := g.applySanctions(sanction(modpk, modsk, 1, userpk)); err != nil || g.roleOf(userpk) != GC_ROLE_OBSERVER {
+		t.Fatal("observer not set:", err)
+	}
+
+	// topic locked to moderators
+	st = &gcSharedState{version: 3, peerLimit: 10, topicLock: true, modHash: g.state.modHash}
+	st.sign(chatid, founder)
+	if err := g.applySharedState(st); err != nil {
+		t.Fatal(err)
+	}
+	tp := &gcTopic{version: 1, setter: userpk, topic: []byte("x")}
+	tp.sign(chatid, usersk)
+	if g.applyTopic(tp) == nil {
+		t.Error("topic of observer applied")
+	}
+	tp = &gcTopic{version: 1, setter: modpk, topic: []byte("news")}
+	tp.sign(chatid, modsk)
+	tp2, _ := unpackGCTopic(tp.bytes())
+	if err := g.applyTopic(tp2); err != nil || string(g.topic.topic) != "news" {
+		t.Error("topic of mod not applied:", err)
+	}
+}
+
+func TestGroupPeerInfoProof(t *testing.T) {
+	chatid, _, _ := NewSigKeyPair()
+	sigpk, sigsk, _ := NewSigKeyPair()
+	realpk, _, _ := NewCBKeyPair()
+	otherpk, _, _ := NewCBKeyPair()
+	g := &groupChat{chatid: chatid, sigpk: sigpk, sigsk: sigsk, nick: []byte("n")}
+	info := g.selfInfo(realpk)
+	p, n, err := unpackGCPeerInfo(chatid, realpk, info)
+	if err != nil || n != len(info) || !p.sigpk.Equal2(sigpk) || string(p.nick) != "n" {
+		t.Fatal("peer info:", err, n)
+	}
+	if _, _, err := unpackGCPeerInfo(chatid, otherpk, info); err == nil {
+		t.Error("proof of another realpk accepted")
+	}
+	forged := append(append([]byte{}, chatid.Bytes()...), info[SIG_PUBLIC_KEY_SIZE:]...)
+	if _, _, err := unpackGCPeerInfo(chatid, realpk, forged); err == nil {
+		t.Error("sig pubkey of founder taken")
+	}
+
+	p.dhtpk = otherpk
+	ent := (&GroupChats{}).packPeer(p)
+	p2, n, err := unpackGCPeer(chatid, ent)
+	if err != nil || n != len(ent) || !p2.sigpk.Equal2(sigpk) || !p2.dhtpk.Equal2(otherpk) {
+		t.Fatal("listed peer:", err, n)
+	}
+	copy(ent, otherpk.Bytes())
+	if _, _, err := unpackGCPeer(chatid, ent); err == nil {
+		t.Error("listed peer of another realpk accepted")
+	}
+}
+
+func TestGroupKickSigned(t *testing.T) {
+	chatid, founder, _ := NewSigKeyPair()
+	userpk, usersk, _ := NewSigKeyPair()
+	selfpk, selfsk, _ := NewSigKeyPair()
+	clk := newFakeTstClock()
+	g := &groupChat{chatid: chatid, sigpk: selfpk, sigsk: selfsk}
+	from := &gcPeer{id: 1, sigpk: userpk}
+	g.peers = []*gcPeer{from}
+	gcs := &GroupChats{clock: clk, groups: []*groupChat{g}}
+	kick := func(signer *CryptoKey, sk []byte, target *CryptoKey, at time.Time) []byte {
+		data := gcKickPack(signer, target, at)
+		sig, _ := CryptoSign(sk, append(append([]byte{}, chatid.Bytes()...), data...))
+		return append(data, sig...)
+	}
+
+	gcs.handleKickLocked(0, g, from, kick(userpk, usersk, selfpk, clk.Now()))
+	forged := kick(userpk, usersk, selfpk, clk.Now())
+	copy(forged, chatid.Bytes())
+	gcs.handleKickLocked(0, g, from, forged)
+	gcs.handleKickLocked(0, g, from, kick(chatid, founder, selfpk, clk.Now().Add(-2*GC_KICK_TIMEOUT*time.Second)))
+	if gcs.groups[0] == nil {
+		t.Fatal("kicked by forged, stale or user's kick")
+	}
+	gcs.handleKickLocked(0, g, from, kick(chatid, founder, selfpk, clk.Now()))
+	if gcs.groups[0] != nil {
+		t.Error("not kicked by founder")
+	}
+}
+
+type tstGroupEvent struct {
+	typ    string
+	peerid uint32
+	data   string
+}
+
+func newTstGroupChats(m *Messenger, evC chan tstGroupEvent) *GroupChats {
+	gcs := NewGroupChats(m, nil)
+	gcs.OnInvite = func(fnum uint32, invite []byte, name []byte) { evC <- tstGroupEvent{"invite", fnum, string(invite)} }
+	gcs.OnSelfJoin = func(gnum uint32) { evC <- tstGroupEvent{"join", 0, ""} }
+	gcs.OnMessage = func(gnum, peerid uint32, msgtype int, msg []byte) { evC <- tstGroupEvent{"msg", peerid, string(msg)} }
+	gcs.OnTopic = func(gnum, peerid uint32, topic []byte) { evC <- tstGroupEvent{"topic", peerid, string(topic)} }
+	gcs.OnModeration = func(gnum, source, target uint32, event int) {
+		evC <- tstGroupEvent{"mod", target, string(rune('0' + event))}
+	}
+	return gcs
+}
+
+func waitTstGroupEvent(t *testing.T, evC chan tstGroupEvent, typ string) tstGroupEvent {
+	for {
+		select {
+		case ev := <-evC:
+			if ev.typ == typ {
+				return ev
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("group event not got:", typ)
+		}
+	}
+}
+
+// joiner of group gnum of gca by invite of friend fnum
+func tstGroupJoin(t *testing.T, gca *GroupChats, gnum, fnum uint32, gcs *GroupChats, evC chan tstGroupEvent, fnumInviter uint32) uint32 {
+	if err := gca.Invite(fnum, gnum); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitTstGroupEvent(t, evC, "invite")
+	gnum2, err := gcs.JoinByInvite(fnumInviter, []byte(ev.data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitTstGroupEvent(t, evC, "join")
+	if _, err := gcs.JoinByInvite(fnumInviter, []byte(ev.data), nil); err == nil {
+		t.Error("joined twice")
+	}
+	return gnum2
+}
+
+func tstGroupPeerID(t *testing.T, gcs *GroupChats, gnum uint32, nick string) uint32 {
+	peers, _ := gcs.Peers(gnum)
+	for _, p := range peers {
+		if string(p.Nick) == nick {
+			return p.ID
+		}
+	}
+	t.Fatal("peer not found:", nick)
+	return 0
+}
+
+func TestGroupChatModeration(t *testing.T) {
+	clk := newFakeTstClock()
+	ma, mb, mc := newTstMessenger(clk), newTstMessenger(clk), newTstMessenger(clk)
+	for _, m := range []*Messenger{ma, mb, mc} {
+		defer m.tstKill()
+	}
+	// b and c are not friends, c connects to b by the peer list of a
+	fab, fba := tstMakeFriends(t, clk, ma, mb)
+	fac, fca := tstMakeFriends(t, clk, ma, mc)
+	ma.SetName([]byte("a"))
+	mb.SetName([]byte("b"))
+	mc.SetName([]byte("c"))
+	evaC, evbC, evcC := make(chan tstGroupEvent, 16), make(chan tstGroupEvent, 16), make(chan tstGroupEvent, 16)
+	gca, gcb, gcc := newTstGroupChats(ma, evaC), newTstGroupChats(mb, evbC), newTstGroupChats(mc, evcC)
+	for _, gcs := range []*GroupChats{gca, gcb, gcc} {
+		defer gcs.Kill()
+	}
+
+	ga, err := gca.New(GC_PRIVACY_STATE_PRIVATE, []byte("grp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gb := tstGroupJoin(t, gca, ga, fab, gcb, evbC, fba)
+	gc := tstGroupJoin(t, gca, ga, fac, gcc, evcC, fca)
+	if info, _ := gcc.Info(gc); info == nil || string(info.Name) != "grp" || info.SelfRole != GC_ROLE_USER {
+		t.Fatal("group info:", info)
+	}
+	peerCount := func(gcs *GroupChats, gnum uint32) int {
+		peers, _ := gcs.Peers(gnum)
+		return len(peers)
+	}
+	if !stepTstClock(clk, func() bool {
+		return peerCount(gca, ga) == 2 && peerCount(gcb, gb) == 2 && peerCount(gcc, gc) == 2 &&
+			mc.fcs.Status(mb.SelfPubkey) != CONNECTION_NONE
+	}) {
+		t.Fatal("peer counts:", peerCount(gca, ga), peerCount(gcb, gb), peerCount(gcc, gc))
+	}
+
+	if err := gcc.SendMessage(gc, MESSAGE_NORMAL, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		gcs  *GroupChats
+		gnum uint32
+		evC  chan tstGroupEvent
+	}{{gca, ga, evaC}, {gcb, gb, evbC}} {
+		ev := waitTstGroupEvent(t, c.evC, "msg")
+		if ev.data != "hi" || ev.peerid != tstGroupPeerID(t, c.gcs, c.gnum, "c") {
+			t.Error("message:", ev)
+		}
+	}
+
+	// b moderator by founder, then c observer by b
+	if gcb.SetRole(gb, tstGroupPeerID(t, gcb, gb, "c"), GC_ROLE_OBSERVER) == nil {
+		t.Error("user set role")
+	}
+	if err := gca.SetRole(ga, tstGroupPeerID(t, gca, ga, "b"), GC_ROLE_MODERATOR); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitTstGroupEvent(t, evcC, "mod")
+	if ev.peerid != tstGroupPeerID(t, gcc, gc, "b") || ev.data != "3" {
+		t.Error("moderation:", ev)
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		info, _ := gcb.Info(gb)
+		return info.SelfRole == GC_ROLE_MODERATOR
+	}) {
+		t.Fatal("b not moderator")
+	}
+	if err := gcb.SetRole(gb, tstGroupPeerID(t, gcb, gb, "c"), GC_ROLE_OBSERVER); err != nil {
+		t.Fatal(err)
+	}
+	ev = waitTstGroupEvent(t, evcC, "mod")
+	if ev.peerid != GC_SELF_PEER_ID || ev.data != "1" {
+		t.Error("moderation of self:", ev)
+	}
+	if gcc.SendMessage(gc, MESSAGE_NORMAL, []byte("x")) == nil {
+		t.Error("observer sent message")
+	}
+	if gcb.SetRole(gb, tstGroupPeerID(t, gcb, gb, "a"), GC_ROLE_OBSERVER) == nil {
+		t.Error("founder made observer")
+	}
+
+	// topic locked to moderators
+	if err := gca.SetTopicLock(ga, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		info, _ := gcb.Info(gb)
+		return info.TopicLock
+	}) {
+		t.Fatal("topic lock not got")
+	}
+	if gcb.SetTopicLock(gb, false) == nil {
+		t.Error("topic lock set by moderator")
+	}
+	if err := gcb.SetTopic(gb, []byte("news")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitTstGroupEvent(t, evcC, "topic"); ev.data != "news" || ev.peerid != tstGroupPeerID(t, gcc, gc, "b") {
+		t.Error("topic:", ev)
+	}
+
+	if err := gcb.Kick(gb, tstGroupPeerID(t, gcb, gb, "c")); err != nil {
+		t.Fatal(err)
+	}
+	ev = waitTstGroupEvent(t, evcC, "mod")
+	if ev.peerid != GC_SELF_PEER_ID || ev.data != "0" {
+		t.Error("kick of self:", ev)
+	}
+	if len(gcc.List()) != 0 {
+		t.Error("group kept after kick")
+	}
+	if !waitTstCond(3*time.Second, func() bool { return peerCount(gca, ga) == 1 }) {
+		t.Error("kicked peer kept:", peerCount(gca, ga))
+	}
+}
+
+func TestGroupChatRejoin(t *testing.T) {
+	clk := newFakeTstClock()
+	ma, mb := newTstMessenger(clk), newTstMessenger(clk)
+	defer ma.tstKill()
+	defer mb.tstKill()
+	fab, fba := tstMakeFriends(t, clk, ma, mb)
+	evaC, evbC := make(chan tstGroupEvent, 16), make(chan tstGroupEvent, 16)
+	gca, gcb := newTstGroupChats(ma, evaC), newTstGroupChats(mb, evbC)
+	defer gca.Kill()
+	defer gcb.Kill()
+
+	ga, _ := gca.New(GC_PRIVACY_STATE_PRIVATE, []byte("grp"))
+	gca.SetTopic(ga, []byte("topic"))
+	gb := tstGroupJoin(t, gca, ga, fab, gcb, evbC, fba)
+
+	sd, err := ParseSaveData(mb.SaveData().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gcb.Leave(gb); err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		peers, _ := gca.Peers(ga)
+		return len(peers) == 0
+	}) {
+		t.Fatal("left peer kept")
+	}
+
+	// not invited again, admitted as known peer of the private group
+	if err := gcb.Load(sd.Groups); err != nil {
+		t.Fatal(err)
+	}
+	gnums := gcb.List()
+	if len(gnums) != 1 {
+		t.Fatal("groups loaded:", gnums)
+	}
+	if !stepTstClock(clk, func() bool {
+		info, _ := gcb.Info(gnums[0])
+		peers, _ := gca.Peers(ga)
+		return info.Connected && len(peers) == 1
+	}) {
+		t.Fatal("not rejoined")
+	}
+	info, _ := gcb.Info(gnums[0])
+	if string(info.Name) != "grp" || string(info.Topic) != "topic" || info.Privacy != GC_PRIVACY_STATE_PRIVATE {
+		t.Error("loaded info:", info)
+	}
+	if gcb.Load(sd.Groups) != nil || len(gcb.List()) != 1 {
+		t.Error("joined group loaded again")
+	}
+}
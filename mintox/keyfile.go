@@ -0,0 +1,74 @@
+package mintox
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// KeyFile is a keypair of a relay or DHT node, stored like the keys file of
+// tox-bootstrapd: public key then secret key, raw, no header.
+type KeyFile struct {
+	Pubkey *CryptoKey
+	Seckey *CryptoKey
+}
+
+const KEY_FILE_SIZE = PUBLIC_KEY_SIZE + SECRET_KEY_SIZE
+
+func NewKeyFile() (*KeyFile, error) {
+	pk, sk, err := NewCBKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return &KeyFile{pk, sk}, nil
+}
+
+// ParseKeyFile checks size and that the public key is of the secret key
+func ParseKeyFile(data []byte) (*KeyFile, error) {
+	if len(data) != KEY_FILE_SIZE {
+		return nil, errors.Errorf("invalid keys file size: %d, want %d", len(data), KEY_FILE_SIZE)
+	}
+	this := &KeyFile{NewCryptoKey(data[:PUBLIC_KEY_SIZE]), NewCryptoKey(data[PUBLIC_KEY_SIZE:])}
+	if !this.Pubkey.Equal2(CBDerivePubkey(this.Seckey)) {
+		return nil, errors.New("keys not match")
+	}
+	return this, nil
+}
+
+func ReadKeyFile(filename string) (*KeyFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	this, err := ParseKeyFile(data)
+	return this, errors.Wrap(err, filename)
+}
+
+func (this *KeyFile) Bytes() []byte {
+	return append(append(make([]byte, 0, KEY_FILE_SIZE), this.Pubkey.Bytes()...), this.Seckey.Bytes()...)
+}
+
+// Save writes the keys readable by owner only, an old file replaced as a whole
+func (this *KeyFile) Save(filename string) error {
+	return errors.Wrap(writeFileAtomic(filename, this.Bytes()), filename)
+}
+
+// SaveNew is Save but fails if filename exists, never loses a node identity
+func (this *KeyFile) SaveNew(filename string) error {
+	fp, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, filename)
+	}
+	_, err = fp.Write(this.Bytes())
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return errors.Wrap(err, filename)
+}
@@ -0,0 +1,54 @@
+package mintox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "keys")
+
+	kf, err := NewKeyFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kf.SaveNew(filename); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0600 || fi.Size() != KEY_FILE_SIZE {
+		t.Fatal("keys file:", fi, err)
+	}
+	kf2, err := NewKeyFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kf2.SaveNew(filename); err == nil {
+		t.Error("existing keys file overwritten")
+	}
+
+	// bootstrapd loads the same file
+	pk, sk, err := LoadBootstrapdKeys(filename)
+	if err != nil || !pk.Equal2(kf.Pubkey) || !sk.Equal2(kf.Seckey) {
+		t.Fatal("keys not loaded:", err)
+	}
+	if err := kf2.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	if kf3, err := ReadKeyFile(filename); err != nil || !kf3.Pubkey.Equal2(kf2.Pubkey) {
+		t.Error("keys not replaced:", err)
+	}
+
+	if _, err := ParseKeyFile(kf.Bytes()[:PUBLIC_KEY_SIZE]); err == nil {
+		t.Error("short keys file accepted")
+	}
+	if _, err := ParseKeyFile(append(append([]byte{}, kf.Pubkey.Bytes()...), kf2.Seckey.Bytes()...)); err == nil {
+		t.Error("mismatched keys accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package mintox
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of histogram buckets, the last bucket is for larger ones
+var latencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// fixed bucket latency histogram, atomic access
+type LatencyHist struct {
+	counts [9]int64 // len(latencyBuckets)+1
+	sum    int64    // nanoseconds
+	count  int64
+}
+
+func (this *LatencyHist) Add(d time.Duration) {
+	idx := len(latencyBuckets)
+	for i, ub := range latencyBuckets {
+		if d <= ub {
+			idx = i
+			break
+		}
+	}
+	atomic.AddInt64(&this.counts[idx], 1)
+	atomic.AddInt64(&this.sum, int64(d))
+	atomic.AddInt64(&this.count, 1)
+}
+
+type LatencyHistSnapshot struct {
+	Bounds []time.Duration // Counts[i] is <= Bounds[i], the last Counts is > all Bounds
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+	Mean   time.Duration
+}
+
+func (this *LatencyHist) Snapshot() LatencyHistSnapshot {
+	snap := LatencyHistSnapshot{Bounds: latencyBuckets}
+	for i := range this.counts {
+		snap.Counts = append(snap.Counts, atomic.LoadInt64(&this.counts[i]))
+	}
+	snap.Count = atomic.LoadInt64(&this.count)
+	snap.Sum = time.Duration(atomic.LoadInt64(&this.sum))
+	if snap.Count > 0 {
+		snap.Mean = snap.Sum / time.Duration(snap.Count)
+	}
+	return snap
+}
@@ -0,0 +1,26 @@
+package mintox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHist(t *testing.T) {
+	h := &LatencyHist{}
+	for _, d := range []time.Duration{0, time.Millisecond, 2 * time.Millisecond, time.Second, time.Minute} {
+		h.Add(d)
+	}
+	snap := h.Snapshot()
+	want := []int64{2, 1, 0, 0, 0, 0, 1, 0, 1}
+	for i := range want {
+		if snap.Counts[i] != want[i] {
+			t.Error("bucket:", i, snap.Counts[i], want[i])
+		}
+	}
+	if len(snap.Counts) != len(snap.Bounds)+1 || snap.Count != 5 {
+		t.Error("invalid snapshot:", len(snap.Counts), len(snap.Bounds), snap.Count)
+	}
+	if mean := (time.Minute + time.Second + 3*time.Millisecond) / 5; snap.Mean != mean {
+		t.Error("mean:", snap.Mean, mean)
+	}
+}
@@ -0,0 +1,21 @@
+package mintox
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// LogKeyMaterial controls whether secret/shared keys and nonces can be printed in log.
+// default off, build with -tags mintoxdebug or set it explicitly to debug handshake things.
+var LogKeyMaterial = logKeyMaterialDefault
+
+// format key/nonce for log, redacted unless LogKeyMaterial
+func logkey(k Byteable) string {
+	if k == nil || k.Len() == 0 {
+		return "<nil>"
+	}
+	if !LogKeyMaterial {
+		return "<redacted>"
+	}
+	return strings.ToUpper(hex.EncodeToString(k.Bytes()))
+}
@@ -0,0 +1,18 @@
+package mintox
+
+import "testing"
+
+func TestLogKeyRedact(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	old := LogKeyMaterial
+	defer func() { LogKeyMaterial = old }()
+
+	LogKeyMaterial = false
+	if s := logkey(sk); s != "<redacted>" {
+		t.Error("key not redacted:", s)
+	}
+	LogKeyMaterial = true
+	if s := logkey(sk); s != sk.ToHex() {
+		t.Error("key not printed:", s)
+	}
+}
@@ -1,5 +1,14 @@
 package mintox
 
+import (
+	"encoding/binary"
+	"gopp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 const MAX_NAME_LENGTH = 128
 
 /* TODO(irungentoo): this must depend on other variable. */
@@ -11,7 +20,8 @@ const NUM_SAVED_TCP_RELAYS = 8
 /* This cannot be bigger than 256 */
 const MAX_CONCURRENT_FILE_PIPES = 256
 
-// const FRIEND_ADDRESS_SIZE = (CRYPTO_PUBLIC_KEY_SIZE + sizeof(uint32_t) + sizeof(uint16_t))
+/* pubkey | nospam | checksum */
+const FRIEND_ADDRESS_SIZE = (PUBLIC_KEY_SIZE + 4 + 2)
 
 const (
 	MESSAGE_NORMAL = 0
@@ -41,3 +51,854 @@ const PACKET_ID_LOSSY_CONFERENCE = 199
 const PACKET_ID_LOSSLESS_RANGE_START = 160
 const PACKET_ID_LOSSLESS_RANGE_SIZE = 32
 const PACKET_LOSSY_AV_RESERVED = 8 /* Number of lossy packet types at start of range reserved for A/V. */
+
+/* Max length of friend request message, as TOX_MAX_FRIEND_REQUEST_LENGTH */
+const MAX_FRIEND_REQUEST_DATA_SIZE = 1016
+
+/* Requesters remembered, their repeated requests ignored, as MAX_RECEIVED_STORED */
+const MAX_RECEIVED_STORED = 32
+
+/* Seconds before a friend request not accepted is sent again, doubled each time. */
+const FRIENDREQUEST_TIMEOUT = 5
+
+/* Interval of asking file chunks to send. */
+const MESSENGER_FILE_INTERVAL = 50 * time.Millisecond
+
+/* Max length of message, as TOX_MAX_MESSAGE_LENGTH */
+const MAX_MESSAGE_LENGTH = (MAX_CRYPTO_DATA_SIZE - 1)
+
+const (
+	FRIEND_NOFRIEND  = 0
+	FRIEND_ADDED     = 1
+	FRIEND_REQUESTED = 2
+	FRIEND_CONFIRMED = 3
+	FRIEND_ONLINE    = 4
+)
+
+const (
+	USERSTATUS_NONE    = 0
+	USERSTATUS_AWAY    = 1
+	USERSTATUS_BUSY    = 2
+	USERSTATUS_INVALID = 3
+)
+
+// like address_checksum, xor of every two bytes
+func addressChecksum(data []byte) (sum [2]byte) {
+	for i, b := range data {
+		sum[i%2] ^= b
+	}
+	return
+}
+
+type messengerReceipt struct {
+	pktnum uint32
+	msgid  uint32
+}
+
+type Friend struct {
+	Pubkey        *CryptoKey
+	Status        uint8 // FRIEND_*
+	Name          []byte
+	StatusMessage []byte
+	UserStatus    uint8
+	IsTyping      bool
+	AvatarHash    []byte // of the avatar got last, see SetFriendAvatarHash
+	LastSeen      time.Time
+
+	connStatus     uint8  // CONNECTION_* of its friend conn
+	nospam         uint32 // from its address, sent back with request
+	reqmsg         []byte
+	reqLastSent    time.Time
+	reqTimeout     int // seconds, doubled each time the request resent
+	nameSent       bool
+	statusmsgSent  bool
+	userstatusSent bool
+	userTyping     bool // we are typing to it
+	typingSent     bool
+	msgid          uint32 // last sent message id
+	receipts       []messengerReceipt
+	fileSending    [MAX_CONCURRENT_FILE_PIPES]fileTransfer
+	fileReceiving  [MAX_CONCURRENT_FILE_PIPES]fileTransfer
+	queue          []*queuedSend // by QueueMessage, until delivered
+}
+
+// like Messenger, friends by Tox ID and messages to them over FriendConns.
+// Friend requests go over friend conns, or by onion when FriendConns() has an
+// onion client, else the friend's dht pubkey and addr must be given to it.
+type Messenger struct {
+	fcs        *FriendConns
+	SelfPubkey *CryptoKey
+	SelfSeckey *CryptoKey
+	clock      clock
+
+	mu         sync.Mutex
+	nospam     uint32
+	name       []byte
+	statusmsg  []byte
+	userstatus uint8
+	friends    []*Friend // friend number =>, nil when deleted
+	stopC      chan bool
+	confs      *Conferences                    // set by NewConferences, gets conference packets of friends
+	msi        *MSISession                     // set by NewMSISession, gets call signaling of friends
+	rtp        *RTPSession                     // set by NewRTPSession, gets media of friends
+	groups     *GroupChats                     // set by NewGroupChats, gets group packets of friends and peers
+	reqsRecv   [MAX_RECEIVED_STORED]*CryptoKey // ring of requesters, like Received_Requests
+	reqsIndex  int
+	msgstore   MessageStore // of QueueMessage
+	queueID    uint64       // last QueuedMessage.ID
+	avatar     []byte       // see SetAvatar
+
+	OnFriendRequest          func(pubkey *CryptoKey, msg []byte)
+	OnFriendMessage          func(fnum uint32, msgtype int, msg []byte)
+	OnFriendName             func(fnum uint32, name []byte)
+	OnFriendStatusMessage    func(fnum uint32, msg []byte)
+	OnFriendUserStatus       func(fnum uint32, status uint8)
+	OnFriendTyping           func(fnum uint32, typing bool)
+	OnFriendConnectionStatus func(fnum uint32, status uint8) // CONNECTION_*
+	OnReadReceipt            func(fnum uint32, msgid uint32)
+	OnMessageDelivered       func(fnum uint32, id uint64)   // of QueueMessage
+	OnFriendLossyPacket      func(fnum uint32, data []byte) // data[0] custom lossy packet id
+	// inbound file request, accept it by FileControl
+	OnFileRecv        func(fnum, filenumber uint32, kind uint32, size uint64, filename []byte)
+	OnFileRecvControl func(fnum, filenumber uint32, control uint8)
+	// data nil when the file finished
+	OnFileRecvChunk func(fnum, filenumber uint32, position uint64, data []byte)
+	// send the chunk by FileSendChunk, length 0 when friend got the whole file
+	OnFileChunkRequest func(fnum, filenumber uint32, position uint64, length int)
+	// avatar of friend received, nil when it has none. Avatars come by file callbacks if not set
+	OnFriendAvatar func(fnum uint32, data []byte)
+}
+
+func NewMessenger(fcs *FriendConns) *Messenger {
+	this := &Messenger{}
+	this.fcs = fcs
+	this.SelfPubkey, this.SelfSeckey = fcs.ncro.SelfPubkey, fcs.ncro.SelfSeckey
+	this.clock = fcs.clock
+	this.nospam = RandomNospam()
+	this.msgstore = newMemMessageStore()
+	this.stopC = make(chan bool)
+	fcs.OnStranger = func(fc *FriendConn) bool {
+		this.attach(fc)
+		return true
+	}
+	fcs.OnFriendRequest = this.handleOnionRequest
+	go this.doMessengerLoop()
+	return this
+}
+
+func (this *Messenger) Kill() { close(this.stopC) }
+
+func (this *Messenger) FriendConns() *FriendConns { return this.fcs }
+
+// Address is the Tox ID of us, pubkey | nospam | checksum
+func (this *Messenger) Address() []byte { return this.ToxID().Bytes() }
+
+func (this *Messenger) ToxID() ToxID { return NewToxID(this.SelfPubkey, this.Nospam()) }
+
+func (this *Messenger) Nospam() uint32 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.nospam
+}
+
+// SetNospam changes Tox ID, requests to the old one are dropped.
+func (this *Messenger) SetNospam(nospam uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.nospam = nospam
+}
+
+// RotateNospam changes to a random nospam, to stop requests from a leaked Tox ID.
+func (this *Messenger) RotateNospam() ToxID {
+	this.SetNospam(RandomNospam())
+	return this.ToxID()
+}
+
+// AddFriend sends friend request with msg to address when connected to it.
+func (this *Messenger) AddFriend(address []byte, msg []byte) (uint32, error) {
+	id, err := ToxIDFromBytes(address)
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) == 0 {
+		return 0, errors.New("Empty friend request message")
+	}
+	if len(msg) > MAX_FRIEND_REQUEST_DATA_SIZE {
+		return 0, errors.Errorf("Friend request message too long: %d", len(msg))
+	}
+	realpk := id.Pubkey()
+	if realpk.Equal2(this.SelfPubkey) {
+		return 0, errors.New("Add self as friend")
+	}
+	nospam := id.Nospam()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if fnum, ok := this.friendNumLocked(realpk); ok {
+		f := this.friends[fnum]
+		if f.Status >= FRIEND_CONFIRMED || f.nospam == nospam {
+			return fnum, errors.Errorf("Friend already added: %d", fnum)
+		}
+		// like FAERR_SETNEWNOSPAM, request again with the new one
+		f.nospam, f.reqmsg, f.Status = nospam, append([]byte{}, msg...), FRIEND_ADDED
+		if this.fcs.Status(realpk) != CONNECTION_NONE {
+			gopp.ErrPrint(this.sendRequestLocked(f), fnum)
+		}
+		return fnum, nil
+	}
+	f := &Friend{Pubkey: realpk, Status: FRIEND_ADDED}
+	f.nospam, f.reqmsg = nospam, append([]byte{}, msg...)
+	return this.addFriendLocked(f), nil
+}
+
+// AddFriendNorequest adds friend by pubkey, like accepting its request.
+func (this *Messenger) AddFriendNorequest(pubkey *CryptoKey) (uint32, error) {
+	if pubkey.Equal2(this.SelfPubkey) {
+		return 0, errors.New("Add self as friend")
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if fnum, ok := this.friendNumLocked(pubkey); ok {
+		return fnum, errors.Errorf("Friend already added: %d", fnum)
+	}
+	fnum := this.addFriendLocked(&Friend{Pubkey: pubkey, Status: FRIEND_CONFIRMED})
+	// conn of its request may be up already, errors when not connected
+	this.fcs.SendLossless(pubkey, []byte{PACKET_ID_ONLINE})
+	return fnum, nil
+}
+
+// mu held by caller
+func (this *Messenger) addFriendLocked(f *Friend) uint32 {
+	this.attach(this.fcs.AddFriend(f.Pubkey))
+	f.connStatus = this.fcs.Status(f.Pubkey)
+	this.loadQueueLocked(f)
+	for i, f2 := range this.friends {
+		if f2 == nil {
+			this.friends[i] = f
+			return uint32(i)
+		}
+	}
+	this.friends = append(this.friends, f)
+	return uint32(len(this.friends) - 1)
+}
+
+func (this *Messenger) DelFriend(fnum uint32) error {
+	this.mu.Lock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		this.mu.Unlock()
+		return err
+	}
+	if f.Status == FRIEND_ONLINE {
+		_, err := this.fcs.SendLossless(f.Pubkey, []byte{PACKET_ID_OFFLINE})
+		gopp.ErrPrint(err, fnum)
+	}
+	this.friends[fnum] = nil
+	this.forgetRequestLocked(f.Pubkey) // may request again
+	gopp.ErrPrint(this.msgstore.Clear(f.Pubkey.ToHex()), fnum)
+	confs, msi, rtp := this.confs, this.msi, this.rtp
+	this.mu.Unlock()
+	this.fcs.DelFriend(f.Pubkey)
+	if confs != nil {
+		confs.delFriend(fnum)
+	}
+	if msi != nil {
+		msi.delFriend(fnum)
+	}
+	if rtp != nil {
+		rtp.delFriend(fnum)
+	}
+	return nil
+}
+
+// mu held by caller
+func (this *Messenger) friendNumLocked(pubkey *CryptoKey) (uint32, bool) {
+	for i, f := range this.friends {
+		if f != nil && f.Pubkey.Equal2(pubkey) {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// mu held by caller
+func (this *Messenger) friendLocked(fnum uint32) (*Friend, error) {
+	if int(fnum) >= len(this.friends) || this.friends[fnum] == nil {
+		return nil, errors.Errorf("Friend not found: %d", fnum)
+	}
+	return this.friends[fnum], nil
+}
+
+func (this *Messenger) FriendNumber(pubkey *CryptoKey) (uint32, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.friendNumLocked(pubkey)
+}
+
+func (this *Messenger) FriendList() (fnums []uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, f := range this.friends {
+		if f != nil {
+			fnums = append(fnums, uint32(i))
+		}
+	}
+	return
+}
+
+// Friend returns a copy of friend fnum, nil if not found.
+func (this *Messenger) Friend(fnum uint32) *Friend {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return nil
+	}
+	fcopy := *f
+	fcopy.receipts, fcopy.queue = nil, nil
+	fcopy.fileSending, fcopy.fileReceiving = [MAX_CONCURRENT_FILE_PIPES]fileTransfer{}, [MAX_CONCURRENT_FILE_PIPES]fileTransfer{}
+	return &fcopy
+}
+
+// CONNECTION_* of friend, CONNECTION_NONE until it is online
+func (this *Messenger) FriendConnectionStatus(fnum uint32) uint8 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil || f.Status != FRIEND_ONLINE {
+		return CONNECTION_NONE
+	}
+	return f.connStatus
+}
+
+// SendMessage sends text of msgtype MESSAGE_NORMAL or MESSAGE_ACTION to online
+// friend, returns message id which OnReadReceipt tells when friend got it.
+func (this *Messenger) SendMessage(fnum uint32, msgtype int, msg []byte) (uint32, error) {
+	if msgtype != MESSAGE_NORMAL && msgtype != MESSAGE_ACTION {
+		return 0, errors.Errorf("Invalid message type: %d", msgtype)
+	}
+	if len(msg) == 0 || len(msg) > MAX_MESSAGE_LENGTH {
+		return 0, errors.Errorf("Invalid message length: %d", len(msg))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return 0, err
+	}
+	if f.Status != FRIEND_ONLINE {
+		return 0, errors.Errorf("Friend not online: %d", fnum)
+	}
+	pktnum, err := this.fcs.SendLossless(f.Pubkey, append([]byte{byte(PACKET_ID_MESSAGE + msgtype)}, msg...))
+	if err != nil {
+		return 0, err
+	}
+	f.msgid++
+	f.receipts = append(f.receipts, messengerReceipt{pktnum, f.msgid})
+	return f.msgid, nil
+}
+
+// lossless packet to online friend, for conferences
+func (this *Messenger) sendFriendPacket(fnum uint32, data []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return err
+	}
+	if f.Status != FRIEND_ONLINE {
+		return errors.Errorf("Friend not online: %d", fnum)
+	}
+	_, err = this.fcs.SendLossless(f.Pubkey, data)
+	return err
+}
+
+// lossy packet to online friend, for rtp
+func (this *Messenger) sendFriendLossy(fnum uint32, data []byte) error {
+	this.mu.Lock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		this.mu.Unlock()
+		return err
+	}
+	if f.Status != FRIEND_ONLINE {
+		this.mu.Unlock()
+		return errors.Errorf("Friend not online: %d", fnum)
+	}
+	pubkey := f.Pubkey
+	this.mu.Unlock()
+	return this.fcs.SendLossy(pubkey, data)
+}
+
+// SendLossyPacket like m_send_custom_lossy_packet, data[0] in the lossy range
+// after the ids reserved for A/V, may be lost or come out of order.
+func (this *Messenger) SendLossyPacket(fnum uint32, data []byte) error {
+	if len(data) == 0 || len(data) > MAX_CRYPTO_DATA_SIZE {
+		return errors.Errorf("Invalid packet length: %d", len(data))
+	}
+	if data[0] < PACKET_ID_LOSSY_RANGE_START+PACKET_LOSSY_AV_RESERVED ||
+		data[0] >= PACKET_ID_LOSSY_RANGE_START+PACKET_ID_LOSSY_RANGE_SIZE {
+		return errors.Errorf("Not custom lossy packet id: %d", data[0])
+	}
+	return this.sendFriendLossy(fnum, data)
+}
+
+func (this *Messenger) friendPubkey(fnum uint32) (*CryptoKey, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return nil, false
+	}
+	return f.Pubkey, true
+}
+
+func (this *Messenger) SetName(name []byte) error {
+	if len(name) > MAX_NAME_LENGTH {
+		return errors.Errorf("Name too long: %d", len(name))
+	}
+	this.mu.Lock()
+	this.name = append([]byte{}, name...)
+	for _, f := range this.friends {
+		if f != nil {
+			f.nameSent = false
+		}
+	}
+	this.sendInfoAllLocked()
+	confs := this.confs
+	this.mu.Unlock()
+	if confs != nil {
+		confs.sendNameAll(name)
+	}
+	return nil
+}
+
+func (this *Messenger) SetStatusMessage(msg []byte) error {
+	if len(msg) > MAX_STATUSMESSAGE_LENGTH {
+		return errors.Errorf("Status message too long: %d", len(msg))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.statusmsg = append([]byte{}, msg...)
+	for _, f := range this.friends {
+		if f != nil {
+			f.statusmsgSent = false
+		}
+	}
+	this.sendInfoAllLocked()
+	return nil
+}
+
+func (this *Messenger) SetUserStatus(status uint8) error {
+	if status >= USERSTATUS_INVALID {
+		return errors.Errorf("Invalid user status: %d", status)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.userstatus = status
+	for _, f := range this.friends {
+		if f != nil {
+			f.userstatusSent = false
+		}
+	}
+	this.sendInfoAllLocked()
+	return nil
+}
+
+// SetTyping tells friend whether we are typing to it, like m_set_usertyping
+func (this *Messenger) SetTyping(fnum uint32, typing bool) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return err
+	}
+	if f.userTyping != typing {
+		f.userTyping, f.typingSent = typing, false
+		if f.Status == FRIEND_ONLINE {
+			this.sendInfoLocked(f)
+		}
+	}
+	return nil
+}
+
+func (this *Messenger) FriendTyping(fnum uint32) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	return err == nil && f.IsTyping
+}
+
+func (this *Messenger) Name() []byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]byte{}, this.name...)
+}
+
+func (this *Messenger) StatusMessage() []byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]byte{}, this.statusmsg...)
+}
+
+func (this *Messenger) UserStatus() uint8 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.userstatus
+}
+
+// mu held by caller
+func (this *Messenger) sendInfoAllLocked() {
+	for _, f := range this.friends {
+		if f != nil && f.Status == FRIEND_ONLINE {
+			this.sendInfoLocked(f)
+		}
+	}
+}
+
+// send name, status message, user status and typing not sent yet. mu held by caller
+func (this *Messenger) sendInfoLocked(f *Friend) {
+	send := func(ptype byte, data []byte) bool {
+		_, err := this.fcs.SendLossless(f.Pubkey, append([]byte{ptype}, data...))
+		gopp.ErrPrint(err, ptype, f.Pubkey.ToHex20())
+		return err == nil
+	}
+	if !f.nameSent {
+		f.nameSent = send(PACKET_ID_NICKNAME, this.name)
+	}
+	if !f.statusmsgSent {
+		f.statusmsgSent = send(PACKET_ID_STATUSMESSAGE, this.statusmsg)
+	}
+	if !f.userstatusSent {
+		f.userstatusSent = send(PACKET_ID_USERSTATUS, []byte{this.userstatus})
+	}
+	if !f.typingSent {
+		typing := byte(0)
+		if f.userTyping {
+			typing = 1
+		}
+		f.typingSent = send(PACKET_ID_TYPING, []byte{typing})
+	}
+}
+
+func (this *Messenger) attach(fc *FriendConn) {
+	fc.OnStatus = func(fc *FriendConn, status uint8) { this.handleConnStatus(fc.Pubkey, status) }
+	fc.OnLossless = func(fc *FriendConn, data []byte) { this.handlePacket(fc.Pubkey, data) }
+	fc.OnLossy = func(fc *FriendConn, data []byte) { this.handleLossyPacket(fc.Pubkey, data) }
+}
+
+// mu held by caller
+func (this *Messenger) setOnlineLocked(fnum uint32, f *Friend, online bool) func() {
+	if online == (f.Status == FRIEND_ONLINE) {
+		return nil
+	}
+	status := uint8(CONNECTION_NONE)
+	if online {
+		f.Status = FRIEND_ONLINE
+		f.nameSent, f.statusmsgSent, f.userstatusSent = false, false, false
+		f.typingSent = false
+		this.sendInfoLocked(f)
+		this.sendQueueLocked(f)
+		this.sendAvatarLocked(fnum, f)
+		status = f.connStatus
+	} else {
+		f.Status = FRIEND_CONFIRMED
+		f.LastSeen = this.clock.Now()
+		f.IsTyping = false
+		f.receipts = nil
+		this.unsendQueueLocked(f)
+		this.breakFilesLocked(f)
+	}
+	fn, confs, msi, rtp := this.OnFriendConnectionStatus, this.confs, this.msi, this.rtp
+	return func() {
+		if fn != nil {
+			fn(fnum, status)
+		}
+		if confs != nil {
+			confs.handleFriendStatus(fnum, online)
+		}
+		if msi != nil {
+			msi.handleFriendStatus(fnum, online)
+		}
+		if rtp != nil {
+			rtp.handleFriendStatus(fnum, online)
+		}
+	}
+}
+
+func (this *Messenger) handleConnStatus(pubkey *CryptoKey, status uint8) {
+	this.mu.Lock()
+	groups := this.groups
+	fnum, ok := this.friendNumLocked(pubkey)
+	if !ok {
+		this.mu.Unlock()
+		if groups != nil && groups.handleConnStatus(pubkey, status) {
+			return // group peer
+		}
+		if status == CONNECTION_NONE {
+			this.fcs.DelFriend(pubkey) // stranger gone without being added
+		}
+		return
+	}
+	f := this.friends[fnum]
+	var cb func()
+	prev := f.connStatus
+	f.connStatus = status
+	if status == CONNECTION_NONE {
+		cb = this.setOnlineLocked(fnum, f, false)
+	} else {
+		if f.Status == FRIEND_ADDED || f.Status == FRIEND_REQUESTED {
+			gopp.ErrPrint(this.sendRequestLocked(f), fnum)
+		}
+		_, err := this.fcs.SendLossless(pubkey, []byte{PACKET_ID_ONLINE})
+		gopp.ErrPrint(err, fnum)
+		if f.Status == FRIEND_ONLINE && prev != status && this.OnFriendConnectionStatus != nil {
+			fn := this.OnFriendConnectionStatus
+			cb = func() { fn(fnum, status) }
+		}
+	}
+	this.mu.Unlock()
+	if cb != nil {
+		cb()
+	}
+	if groups != nil {
+		groups.handleConnStatus(pubkey, status)
+	}
+}
+
+// friend request over friend conn or onion, nospam | message. mu held by caller
+func (this *Messenger) sendRequestLocked(f *Friend) error {
+	if err := this.fcs.SendFriendRequest(f.Pubkey, f.nospam, f.reqmsg); err != nil {
+		return err
+	}
+	f.Status = FRIEND_REQUESTED
+	f.reqLastSent = this.clock.Now()
+	if f.reqTimeout == 0 {
+		f.reqTimeout = FRIENDREQUEST_TIMEOUT
+	}
+	return nil
+}
+
+// request from stranger got by onion, nospam | message
+func (this *Messenger) handleOnionRequest(pubkey *CryptoKey, data []byte) {
+	this.mu.Lock()
+	var cb func()
+	if _, ok := this.friendNumLocked(pubkey); !ok {
+		cb = this.handleFriendRequestLocked(pubkey, append([]byte{PACKET_ID_FRIEND_REQUESTS}, data...))
+	}
+	this.mu.Unlock()
+	if cb != nil {
+		cb()
+	}
+}
+
+// like handle_packet of Messenger, lossless packet from friend or stranger
+func (this *Messenger) handlePacket(pubkey *CryptoKey, data []byte) {
+	var cb func()
+	defer func() {
+		if cb != nil {
+			cb()
+		}
+	}()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if groups := this.groups; groups != nil && data[0] == PACKET_ID_GROUPCHAT {
+		data := append([]byte{}, data...)
+		cb = func() { groups.handlePacket(pubkey, data) }
+		return
+	}
+	fnum, ok := this.friendNumLocked(pubkey)
+	if !ok {
+		if data[0] == PACKET_ID_FRIEND_REQUESTS {
+			cb = this.handleFriendRequestLocked(pubkey, data)
+		}
+		return
+	}
+	f := this.friends[fnum]
+	dat := append([]byte{}, data[1:]...)
+	if data[0] == PACKET_ID_ONLINE {
+		if f.Status != FRIEND_ONLINE {
+			// it may have sent its online before we added it, and it must
+			// get ours before our info
+			_, err := this.fcs.SendLossless(pubkey, []byte{PACKET_ID_ONLINE})
+			gopp.ErrPrint(err, fnum)
+			cb = this.setOnlineLocked(fnum, f, true)
+		}
+		return
+	}
+	if f.Status != FRIEND_ONLINE {
+		return
+	}
+	switch data[0] {
+	case PACKET_ID_OFFLINE:
+		cb = this.setOnlineLocked(fnum, f, false)
+	case PACKET_ID_NICKNAME:
+		if len(dat) > MAX_NAME_LENGTH {
+			break
+		}
+		f.Name = dat
+		if fn := this.OnFriendName; fn != nil {
+			cb = func() { fn(fnum, dat) }
+		}
+	case PACKET_ID_STATUSMESSAGE:
+		if len(dat) > MAX_STATUSMESSAGE_LENGTH {
+			break
+		}
+		f.StatusMessage = dat
+		if fn := this.OnFriendStatusMessage; fn != nil {
+			cb = func() { fn(fnum, dat) }
+		}
+	case PACKET_ID_USERSTATUS:
+		if len(dat) != 1 || dat[0] >= USERSTATUS_INVALID {
+			break
+		}
+		f.UserStatus = dat[0]
+		if fn := this.OnFriendUserStatus; fn != nil {
+			cb = func() { fn(fnum, dat[0]) }
+		}
+	case PACKET_ID_TYPING:
+		if len(dat) != 1 {
+			break
+		}
+		typing := dat[0] != 0
+		f.IsTyping = typing
+		if fn := this.OnFriendTyping; fn != nil {
+			cb = func() { fn(fnum, typing) }
+		}
+	case PACKET_ID_MESSAGE, PACKET_ID_ACTION:
+		if len(dat) == 0 {
+			break
+		}
+		msgtype := int(data[0] - PACKET_ID_MESSAGE)
+		if fn := this.OnFriendMessage; fn != nil {
+			cb = func() { fn(fnum, msgtype, dat) }
+		}
+	case PACKET_ID_FILE_SENDREQUEST, PACKET_ID_FILE_CONTROL, PACKET_ID_FILE_DATA:
+		cb = this.handleFilePacketLocked(fnum, f, data)
+	case PACKET_ID_MSI, PACKET_ID_MSI_BITRATE:
+		if msi := this.msi; msi != nil {
+			data := append([]byte{}, data...)
+			cb = func() { msi.handlePacket(fnum, data) }
+		}
+	case PACKET_ID_INVITE_CONFERENCE, PACKET_ID_ONLINE_PACKET, PACKET_ID_DIRECT_CONFERENCE, PACKET_ID_MESSAGE_CONFERENCE:
+		if confs := this.confs; confs != nil {
+			data := append([]byte{}, data...)
+			cb = func() { confs.handlePacket(fnum, data) }
+		}
+	case PACKET_ID_INVITE_GROUPCHAT:
+		if groups := this.groups; groups != nil {
+			cb = func() { groups.handleInvite(fnum, dat) }
+		}
+	}
+}
+
+// like m_handle_lossy_packet, A/V ones to rtp, custom ones to app
+func (this *Messenger) handleLossyPacket(pubkey *CryptoKey, data []byte) {
+	this.mu.Lock()
+	fnum, ok := this.friendNumLocked(pubkey)
+	online := ok && this.friends[fnum].Status == FRIEND_ONLINE
+	fn, rtp := this.OnFriendLossyPacket, this.rtp
+	this.mu.Unlock()
+	if !online {
+		return
+	}
+	data = append([]byte{}, data...)
+	if data[0] < PACKET_ID_LOSSY_RANGE_START+PACKET_LOSSY_AV_RESERVED {
+		if rtp != nil && (data[0] == RTP_TYPE_AUDIO || data[0] == RTP_TYPE_VIDEO) {
+			rtp.handlePacket(fnum, data)
+		}
+		return
+	}
+	if fn != nil {
+		fn(fnum, data)
+	}
+}
+
+// like friendreq_handlepacket, nospam | message. mu held by caller
+func (this *Messenger) handleFriendRequestLocked(pubkey *CryptoKey, data []byte) func() {
+	if len(data) <= 1+4 || len(data) > 1+4+MAX_FRIEND_REQUEST_DATA_SIZE {
+		return nil
+	}
+	if this.requestReceivedLocked(pubkey) {
+		return nil
+	}
+	if binary.BigEndian.Uint32(data[1:]) != this.nospam {
+		return nil
+	}
+	this.reqsRecv[this.reqsIndex%MAX_RECEIVED_STORED] = pubkey
+	this.reqsIndex++
+	msg := append([]byte{}, data[1+4:]...)
+	if fn := this.OnFriendRequest; fn != nil {
+		return func() { fn(pubkey, msg) }
+	}
+	return nil
+}
+
+// like request_received. mu held by caller
+func (this *Messenger) requestReceivedLocked(pubkey *CryptoKey) bool {
+	for _, pk := range this.reqsRecv {
+		if pk != nil && pk.Equal2(pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// like remove_request_received. mu held by caller
+func (this *Messenger) forgetRequestLocked(pubkey *CryptoKey) {
+	for i, pk := range this.reqsRecv {
+		if pk != nil && pk.Equal2(pubkey) {
+			this.reqsRecv[i] = nil
+		}
+	}
+}
+
+func (this *Messenger) doMessengerLoop() {
+	tickC, stop := this.clock.Tick(time.Second)
+	defer stop()
+	fileTickC, fileStop := this.clock.Tick(MESSENGER_FILE_INTERVAL)
+	defer fileStop()
+	for {
+		select {
+		case <-tickC:
+			this.doMessenger()
+		case <-fileTickC:
+			this.doFiles()
+		case <-this.stopC:
+			return
+		}
+	}
+}
+
+// like do_friends, send requests until accepted, resend info failed to send and check receipts
+func (this *Messenger) doMessenger() {
+	var cbs []func()
+	this.mu.Lock()
+	for i, f := range this.friends {
+		if f != nil && f.Status == FRIEND_REQUESTED &&
+			this.clock.Now().Sub(f.reqLastSent) >= time.Duration(f.reqTimeout)*time.Second {
+			f.Status = FRIEND_ADDED
+			f.reqTimeout *= 2
+		}
+		if f != nil && f.Status == FRIEND_ADDED {
+			// fails until connected or found by onion
+			this.sendRequestLocked(f)
+		}
+		if f == nil || f.Status != FRIEND_ONLINE {
+			continue
+		}
+		this.sendInfoLocked(f)
+		cbs = append(cbs, this.doQueueLocked(uint32(i), f)...)
+		for len(f.receipts) > 0 && this.fcs.PacketReceived(f.Pubkey, f.receipts[0].pktnum) {
+			if fn := this.OnReadReceipt; fn != nil {
+				fnum, msgid := uint32(i), f.receipts[0].msgid
+				cbs = append(cbs, func() { fn(fnum, msgid) })
+			}
+			f.receipts = f.receipts[1:]
+		}
+	}
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
@@ -0,0 +1,123 @@
+package mintox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"gopp"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// Avatars as Tox clients do: a file of kind FILEKIND_AVATAR offered to each
+// friend coming online, its file id the sha256 of the data. A friend having
+// that hash already kills it, a file of size 0 means no avatar.
+// Handled by the messenger when OnFriendAvatar set, else by file callbacks.
+
+/* Max avatar size accepted, as TOX_AVATAR_MAX_DATA_LENGTH */
+const MAX_AVATAR_DATA_LENGTH = 65536
+
+// SetAvatar offers data to online friends and those coming online, nil for no avatar.
+func (this *Messenger) SetAvatar(data []byte) error {
+	if len(data) > MAX_AVATAR_DATA_LENGTH {
+		return errors.Errorf("Avatar too big: %d", len(data))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.avatar = append([]byte{}, data...) // not nil, offered even if empty
+	for i, f := range this.friends {
+		if f == nil || f.Status != FRIEND_ONLINE {
+			continue
+		}
+		for j := range f.fileSending {
+			if ft := &f.fileSending[j]; ft.avatar {
+				err := this.sendFileControlLocked(f, false, fileNumber(false, uint8(j)), FILECONTROL_KILL, nil)
+				gopp.ErrPrint(err, i)
+				*ft = fileTransfer{}
+			}
+		}
+		this.sendAvatarLocked(uint32(i), f)
+	}
+	return nil
+}
+
+func (this *Messenger) Avatar() []byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]byte{}, this.avatar...)
+}
+
+// AvatarHash is the file id of avatar data
+func AvatarHash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// SetFriendAvatarHash tells the hash of friend's avatar cached by app,
+// so the same one is not received again.
+func (this *Messenger) SetFriendAvatarHash(fnum uint32, hash []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return err
+	}
+	f.AvatarHash = append([]byte(nil), hash...)
+	return nil
+}
+
+// nothing before SetAvatar, size 0 after avatar removed. mu held by caller
+func (this *Messenger) sendAvatarLocked(fnum uint32, f *Friend) {
+	avatar := this.avatar
+	if avatar == nil {
+		return
+	}
+	_, ft, err := this.fileSendLocked(fnum, f, FILEKIND_AVATAR, uint64(len(avatar)), AvatarHash(avatar), nil)
+	if err != nil {
+		gopp.ErrPrint(err, fnum)
+		return
+	}
+	ft.avatar, ft.data = true, avatar
+}
+
+// kill the avatar we have or no avatar, else get it whole. mu held by caller
+func (this *Messenger) recvAvatarLocked(fnum uint32, f *Friend, filenum uint8, ft *fileTransfer) func() {
+	filenumber := fileNumber(true, filenum)
+	if ft.size == 0 || ft.size > MAX_AVATAR_DATA_LENGTH || bytes.Equal(ft.id, f.AvatarHash) {
+		removed := ft.size == 0 && f.AvatarHash != nil
+		*ft = fileTransfer{}
+		gopp.ErrPrint(this.sendFileControlLocked(f, true, filenumber, FILECONTROL_KILL, nil), fnum)
+		if !removed {
+			return nil
+		}
+		f.AvatarHash = nil
+		fn := this.OnFriendAvatar
+		return func() { fn(fnum, nil) }
+	}
+	if err := this.sendFileControlLocked(f, true, filenumber, FILECONTROL_ACCEPT, nil); err != nil {
+		*ft = fileTransfer{}
+		return nil
+	}
+	ft.status, ft.avatar = FILESTATUS_TRANSFERRING, true
+	ft.data = make([]byte, 0, ft.size)
+	return nil
+}
+
+// mu held by caller
+func (this *Messenger) recvAvatarChunkLocked(fnum uint32, f *Friend, ft *fileTransfer, dat []byte, finished bool) func() {
+	ft.data = append(ft.data, dat...)
+	if !finished {
+		return nil
+	}
+	data, id := ft.data, ft.id
+	*ft = fileTransfer{}
+	if !bytes.Equal(AvatarHash(data), id) {
+		log.Println("Avatar not match its hash, drop:", fnum, len(data))
+		return nil
+	}
+	f.AvatarHash = id
+	if fn := this.OnFriendAvatar; fn != nil {
+		return func() { fn(fnum, data) }
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package mintox
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMessengerAvatar(t *testing.T) {
+	clk := newFakeTstClock()
+	m0, m1 := newTstMessenger(clk), newTstMessenger(clk)
+	defer m0.tstKill()
+	defer m1.tstKill()
+	if m0.SetAvatar(make([]byte, MAX_AVATAR_DATA_LENGTH+1)) == nil {
+		t.Error("too big avatar set")
+	}
+	avatar := CBRandomBytes(2*MAX_FILE_DATA_SIZE + 100)
+	m0.SetAvatar(avatar)
+	type recvAvatar struct {
+		fnum uint32
+		data []byte
+	}
+	avatarC := make(chan recvAvatar, 4)
+	m1.OnFriendAvatar = func(fnum uint32, data []byte) { avatarC <- recvAvatar{fnum, data} }
+	m1.OnFileRecv = func(fnum, filenumber uint32, kind uint32, size uint64, filename []byte) {
+		t.Error("avatar by file callback:", kind, size)
+	}
+	recv := func() (ra recvAvatar, ok bool) {
+		ok = stepTstClock(clk, func() bool {
+			select {
+			case ra = <-avatarC:
+				return true
+			default:
+				return false
+			}
+		})
+		return
+	}
+
+	// offered when friend comes online
+	fnum0, fnum1 := tstMakeFriends(t, clk, m0, m1)
+	ra, ok := recv()
+	if !ok || ra.fnum != fnum1 || !bytes.Equal(ra.data, avatar) {
+		t.Fatal("avatar not received:", ok, len(ra.data))
+	}
+	if f := m1.Friend(fnum1); !bytes.Equal(f.AvatarHash, AvatarHash(avatar)) {
+		t.Error("avatar hash:", f.AvatarHash)
+	}
+
+	// the one friend has is not sent again
+	m0.SetAvatar(avatar)
+	sending := func() bool {
+		m0.mu.Lock()
+		defer m0.mu.Unlock()
+		for _, ft := range m0.friends[fnum0].fileSending {
+			if ft.status != FILESTATUS_NONE {
+				return true
+			}
+		}
+		return false
+	}
+	if !waitTstCond(3*time.Second, func() bool { return !sending() }) {
+		t.Error("same avatar not killed")
+	}
+	if len(avatarC) != 0 {
+		t.Error("same avatar received again")
+	}
+
+	// removed
+	m0.SetAvatar(nil)
+	if ra, ok := recv(); !ok || ra.data != nil {
+		t.Fatal("avatar not removed:", ok, len(ra.data))
+	}
+	if f := m1.Friend(fnum1); f.AvatarHash != nil {
+		t.Error("hash of removed avatar:", f.AvatarHash)
+	}
+}
@@ -0,0 +1,487 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const FILE_ID_LENGTH = 32
+const MAX_FILENAME_LENGTH = 255
+
+/* filenum | data */
+const MAX_FILE_DATA_SIZE = (MAX_CRYPTO_DATA_SIZE - 2)
+
+/* Size of streams of unknown length, finished by a chunk shorter than MAX_FILE_DATA_SIZE. */
+const FILE_SIZE_STREAM = math.MaxUint64
+
+/* Max lossless packets queued to friend before no more chunks requested. */
+const FILE_SEND_QUEUE_SIZE = 64
+
+/* Packets of the send rate left to messages, chunks not sent into them. */
+const MIN_SLOTS_FREE = (CRYPTO_MIN_QUEUE_LENGTH / 4)
+
+const (
+	FILEKIND_DATA   = 0
+	FILEKIND_AVATAR = 1
+)
+
+const (
+	FILESTATUS_NONE         = 0
+	FILESTATUS_NOT_ACCEPTED = 1
+	FILESTATUS_TRANSFERRING = 2
+	FILESTATUS_FINISHED     = 3
+)
+
+const (
+	FILE_PAUSE_NOT   = 0
+	FILE_PAUSE_US    = 1
+	FILE_PAUSE_OTHER = 2
+	FILE_PAUSE_BOTH  = 3
+)
+
+const (
+	FILECONTROL_ACCEPT = 0
+	FILECONTROL_PAUSE  = 1
+	FILECONTROL_KILL   = 2
+	FILECONTROL_SEEK   = 3
+)
+
+// like struct File_Transfers
+type fileTransfer struct {
+	status      uint8 // FILESTATUS_*
+	paused      uint8 // FILE_PAUSE_*
+	kind        uint32
+	size        uint64
+	transferred uint64
+	requested   uint64 // sending, chunks requested by OnFileChunkRequest
+	slots       int    // sending, requested chunks not sent yet
+	lastPktnum  uint32 // sending, packet of last chunk
+	id          []byte
+	avatar      bool   // by the messenger, not app callbacks, see SetAvatar
+	data        []byte // avatar, whole one sending or received so far
+}
+
+// inbound file numbers are (filenum+1)<<16, outbound are filenum
+func fileNumber(inbound bool, filenum uint8) uint32 {
+	if inbound {
+		return (uint32(filenum) + 1) << 16
+	}
+	return uint32(filenum)
+}
+
+// mu held by caller
+func (this *Messenger) fileLocked(fnum, filenumber uint32) (*Friend, *fileTransfer, bool, error) {
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	inbound := filenumber >= 1<<16
+	var ft *fileTransfer
+	switch {
+	case !inbound && filenumber < MAX_CONCURRENT_FILE_PIPES:
+		ft = &f.fileSending[filenumber]
+	case inbound && filenumber>>16-1 < MAX_CONCURRENT_FILE_PIPES && filenumber&0xffff == 0:
+		ft = &f.fileReceiving[filenumber>>16-1]
+	}
+	if ft == nil || ft.status == FILESTATUS_NONE {
+		return nil, nil, false, errors.Errorf("File not found: %d/%d", fnum, filenumber)
+	}
+	return f, ft, inbound, nil
+}
+
+// FileSend sends a file request of kind FILEKIND_* to online friend, size may be
+// FILE_SIZE_STREAM, fileid a random one if nil. Returns the file number, chunks
+// of which are asked by OnFileChunkRequest after friend accepts it.
+func (this *Messenger) FileSend(fnum uint32, kind uint32, size uint64, fileid []byte, filename []byte) (uint32, error) {
+	if len(filename) > MAX_FILENAME_LENGTH {
+		return 0, errors.Errorf("Filename too long: %d", len(filename))
+	}
+	if fileid == nil {
+		fileid = CBRandomBytes(FILE_ID_LENGTH)
+	}
+	if len(fileid) != FILE_ID_LENGTH {
+		return 0, errors.Errorf("Invalid file id length: %d", len(fileid))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return 0, err
+	}
+	filenumber, _, err := this.fileSendLocked(fnum, f, kind, size, fileid, filename)
+	return filenumber, err
+}
+
+// mu held by caller
+func (this *Messenger) fileSendLocked(fnum uint32, f *Friend, kind uint32, size uint64, fileid []byte, filename []byte) (uint32, *fileTransfer, error) {
+	if f.Status != FRIEND_ONLINE {
+		return 0, nil, errors.Errorf("Friend not online: %d", fnum)
+	}
+	i := 0
+	for ; i < MAX_CONCURRENT_FILE_PIPES && f.fileSending[i].status != FILESTATUS_NONE; i++ {
+	}
+	if i == MAX_CONCURRENT_FILE_PIPES {
+		return 0, nil, errors.Errorf("Too many files sending: %d", fnum)
+	}
+
+	pkt := make([]byte, 2+4+8, 2+4+8+FILE_ID_LENGTH+len(filename))
+	pkt[0], pkt[1] = PACKET_ID_FILE_SENDREQUEST, byte(i)
+	binary.BigEndian.PutUint32(pkt[2:], kind)
+	binary.BigEndian.PutUint64(pkt[6:], size)
+	pkt = append(append(pkt, fileid...), filename...)
+	if _, err := this.fcs.SendLossless(f.Pubkey, pkt); err != nil {
+		return 0, nil, err
+	}
+	f.fileSending[i] = fileTransfer{status: FILESTATUS_NOT_ACCEPTED, kind: kind, size: size,
+		id: append([]byte{}, fileid...)}
+	return fileNumber(false, uint8(i)), &f.fileSending[i], nil
+}
+
+// FileControl accepts, pauses, resumes by accept or kills file, control FILECONTROL_*, except seek.
+func (this *Messenger) FileControl(fnum, filenumber uint32, control uint8) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, ft, inbound, err := this.fileLocked(fnum, filenumber)
+	if err != nil {
+		return err
+	}
+	if f.Status != FRIEND_ONLINE {
+		return errors.Errorf("Friend not online: %d", fnum)
+	}
+	if ft.avatar {
+		return errors.Errorf("Avatar file controlled by messenger: %d/%d", fnum, filenumber)
+	}
+	switch control {
+	case FILECONTROL_ACCEPT:
+		if ft.status == FILESTATUS_TRANSFERRING && ft.paused&FILE_PAUSE_US == 0 {
+			if ft.paused&FILE_PAUSE_OTHER != 0 {
+				return errors.Errorf("File paused by friend: %d/%d", fnum, filenumber)
+			}
+			return errors.Errorf("File not paused: %d/%d", fnum, filenumber)
+		}
+		if ft.status == FILESTATUS_NOT_ACCEPTED && !inbound {
+			return errors.Errorf("File not accepted by friend: %d/%d", fnum, filenumber)
+		}
+		if ft.status == FILESTATUS_FINISHED {
+			return errors.Errorf("File finished: %d/%d", fnum, filenumber)
+		}
+	case FILECONTROL_PAUSE:
+		if ft.status != FILESTATUS_TRANSFERRING || ft.paused&FILE_PAUSE_US != 0 {
+			return errors.Errorf("File not transferring: %d/%d", fnum, filenumber)
+		}
+	case FILECONTROL_KILL:
+	default:
+		return errors.Errorf("Invalid file control: %d", control)
+	}
+	if err := this.sendFileControlLocked(f, inbound, filenumber, control, nil); err != nil {
+		return err
+	}
+	switch control {
+	case FILECONTROL_ACCEPT:
+		ft.status = FILESTATUS_TRANSFERRING
+		ft.paused &^= FILE_PAUSE_US
+	case FILECONTROL_PAUSE:
+		ft.paused |= FILE_PAUSE_US
+		ft.requested, ft.slots = ft.transferred, 0
+	case FILECONTROL_KILL:
+		*ft = fileTransfer{}
+	}
+	return nil
+}
+
+// FileSeek sets the position to receive an inbound file from, before it is accepted.
+func (this *Messenger) FileSeek(fnum, filenumber uint32, position uint64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, ft, inbound, err := this.fileLocked(fnum, filenumber)
+	if err != nil {
+		return err
+	}
+	if f.Status != FRIEND_ONLINE {
+		return errors.Errorf("Friend not online: %d", fnum)
+	}
+	if !inbound || ft.status != FILESTATUS_NOT_ACCEPTED {
+		return errors.Errorf("File not seekable: %d/%d", fnum, filenumber)
+	}
+	if position >= ft.size {
+		return errors.Errorf("Seek position beyond size: %d/%d", position, ft.size)
+	}
+	pos := make([]byte, 8)
+	binary.BigEndian.PutUint64(pos, position)
+	if err := this.sendFileControlLocked(f, inbound, filenumber, FILECONTROL_SEEK, pos); err != nil {
+		return err
+	}
+	ft.transferred = position
+	return nil
+}
+
+// FileSendChunk sends data at position asked by OnFileChunkRequest. Data shorter
+// than MAX_FILE_DATA_SIZE is the last chunk.
+func (this *Messenger) FileSendChunk(fnum, filenumber uint32, position uint64, data []byte) error {
+	if len(data) > MAX_FILE_DATA_SIZE {
+		return errors.Errorf("Invalid chunk length: %d", len(data))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, ft, inbound, err := this.fileLocked(fnum, filenumber)
+	if err != nil {
+		return err
+	}
+	if inbound || ft.avatar {
+		return errors.Errorf("File not sent by app: %d/%d", fnum, filenumber)
+	}
+	return this.fileSendChunkLocked(f, ft, filenumber, position, data)
+}
+
+// mu held by caller
+func (this *Messenger) fileSendChunkLocked(f *Friend, ft *fileTransfer, filenumber uint32, position uint64, data []byte) error {
+	if ft.status != FILESTATUS_TRANSFERRING || ft.paused != FILE_PAUSE_NOT {
+		return errors.Errorf("File not transferring: %d", filenumber)
+	}
+	if position != ft.transferred {
+		return errors.Errorf("Chunk position not expected: %d/%d", position, ft.transferred)
+	}
+	if ft.size != FILE_SIZE_STREAM {
+		if uint64(len(data)) > ft.size-ft.transferred ||
+			len(data) != MAX_FILE_DATA_SIZE && ft.transferred+uint64(len(data)) != ft.size {
+			return errors.Errorf("Invalid chunk length: %d", len(data))
+		}
+	}
+	pktnum, err := this.fcs.SendLossless(f.Pubkey, append([]byte{PACKET_ID_FILE_DATA, byte(filenumber)}, data...))
+	if err != nil {
+		return err
+	}
+	ft.transferred += uint64(len(data))
+	if ft.slots > 0 {
+		ft.slots--
+	}
+	if len(data) != MAX_FILE_DATA_SIZE || ft.transferred == ft.size {
+		ft.status = FILESTATUS_FINISHED
+		ft.lastPktnum = pktnum
+	}
+	return nil
+}
+
+// FileID returns the id of file given by FileSend or got with OnFileRecv.
+func (this *Messenger) FileID(fnum, filenumber uint32) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, ft, _, err := this.fileLocked(fnum, filenumber)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, ft.id...), nil
+}
+
+// FileTransferred returns bytes of file sent or received so far.
+func (this *Messenger) FileTransferred(fnum, filenumber uint32) (uint64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, ft, _, err := this.fileLocked(fnum, filenumber)
+	if err != nil {
+		return 0, err
+	}
+	return ft.transferred, nil
+}
+
+// send_receive | filenum | control | data. mu held by caller
+func (this *Messenger) sendFileControlLocked(f *Friend, inbound bool, filenumber uint32, control uint8, data []byte) error {
+	pkt := []byte{PACKET_ID_FILE_CONTROL, 0, byte(filenumber), control}
+	if inbound {
+		pkt[1], pkt[2] = 1, byte(filenumber>>16-1)
+	}
+	_, err := this.fcs.SendLossless(f.Pubkey, append(pkt, data...))
+	return err
+}
+
+// like break_files, transfers dropped when friend goes offline. mu held by caller
+func (this *Messenger) breakFilesLocked(f *Friend) {
+	for i := range f.fileSending {
+		f.fileSending[i] = fileTransfer{}
+		f.fileReceiving[i] = fileTransfer{}
+	}
+}
+
+// file packets from online friend, returns callback to call without mu. mu held by caller
+func (this *Messenger) handleFilePacketLocked(fnum uint32, f *Friend, data []byte) func() {
+	switch data[0] {
+	case PACKET_ID_FILE_SENDREQUEST:
+		if len(data) < 2+4+8+FILE_ID_LENGTH || len(data) > 2+4+8+FILE_ID_LENGTH+MAX_FILENAME_LENGTH {
+			return nil
+		}
+		ft := &f.fileReceiving[data[1]]
+		if ft.status != FILESTATUS_NONE {
+			return nil
+		}
+		*ft = fileTransfer{status: FILESTATUS_NOT_ACCEPTED}
+		ft.kind = binary.BigEndian.Uint32(data[2:])
+		ft.size = binary.BigEndian.Uint64(data[6:])
+		ft.id = append([]byte{}, data[14:14+FILE_ID_LENGTH]...)
+		if ft.kind == FILEKIND_AVATAR && this.OnFriendAvatar != nil {
+			return this.recvAvatarLocked(fnum, f, data[1], ft)
+		}
+		filenumber, kind, size := fileNumber(true, data[1]), ft.kind, ft.size
+		filename := append([]byte{}, data[14+FILE_ID_LENGTH:]...)
+		if fn := this.OnFileRecv; fn != nil {
+			return func() { fn(fnum, filenumber, kind, size, filename) }
+		}
+	case PACKET_ID_FILE_CONTROL:
+		if len(data) < 4 || data[1] > 1 {
+			return nil
+		}
+		return this.handleFileControlLocked(fnum, f, data[1] == 1, data[2], data[3], data[4:])
+	case PACKET_ID_FILE_DATA:
+		if len(data) < 2 {
+			return nil
+		}
+		ft := &f.fileReceiving[data[1]]
+		if ft.status != FILESTATUS_TRANSFERRING {
+			return nil
+		}
+		dat := append([]byte{}, data[2:]...)
+		if ft.size-ft.transferred < uint64(len(dat)) {
+			dat = dat[:ft.size-ft.transferred]
+		}
+		position := ft.transferred
+		ft.transferred += uint64(len(dat))
+		// chunk of 0 length tells the file finished
+		finished := len(dat) == 0
+		if !finished && (ft.transferred >= ft.size || len(data)-2 != MAX_FILE_DATA_SIZE) {
+			finished = true
+		}
+		if ft.avatar {
+			return this.recvAvatarChunkLocked(fnum, f, ft, dat, finished)
+		}
+		if finished {
+			*ft = fileTransfer{}
+		}
+		filenumber := fileNumber(true, data[1])
+		if fn := this.OnFileRecvChunk; fn != nil {
+			return func() {
+				if len(dat) > 0 {
+					fn(fnum, filenumber, position, dat)
+				}
+				if finished {
+					fn(fnum, filenumber, position+uint64(len(dat)), nil)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// like handle_filecontrol, outbound is true for file we send. mu held by caller
+func (this *Messenger) handleFileControlLocked(fnum uint32, f *Friend, outbound bool, filenum uint8, control uint8, data []byte) func() {
+	ft := &f.fileReceiving[filenum]
+	if outbound {
+		ft = &f.fileSending[filenum]
+	}
+	if ft.status == FILESTATUS_NONE {
+		return nil
+	}
+	avatar := ft.avatar
+	switch control {
+	case FILECONTROL_ACCEPT:
+		if outbound && ft.status == FILESTATUS_NOT_ACCEPTED {
+			ft.status = FILESTATUS_TRANSFERRING
+		} else if ft.paused&FILE_PAUSE_OTHER != 0 {
+			ft.paused &^= FILE_PAUSE_OTHER
+		} else {
+			return nil
+		}
+	case FILECONTROL_PAUSE:
+		if ft.status != FILESTATUS_TRANSFERRING || ft.paused&FILE_PAUSE_OTHER != 0 {
+			return nil
+		}
+		ft.paused |= FILE_PAUSE_OTHER
+		ft.requested, ft.slots = ft.transferred, 0
+	case FILECONTROL_KILL:
+		*ft = fileTransfer{}
+	case FILECONTROL_SEEK:
+		if !outbound || ft.status != FILESTATUS_NOT_ACCEPTED || len(data) != 8 {
+			return nil
+		}
+		position := binary.BigEndian.Uint64(data)
+		if position >= ft.size {
+			return nil
+		}
+		ft.transferred, ft.requested = position, position
+		return nil
+	default:
+		return nil
+	}
+	filenumber := fileNumber(!outbound, filenum)
+	if fn := this.OnFileRecvControl; fn != nil && !avatar {
+		return func() { fn(fnum, filenumber, control) }
+	}
+	return nil
+}
+
+// like do_reqchunk_filecb, ask chunks of accepted files while friend send queue
+// not full, and finish files when friend got their last chunk.
+func (this *Messenger) doFiles() {
+	var cbs []func()
+	this.mu.Lock()
+	for i, f := range this.friends {
+		if f == nil || f.Status != FRIEND_ONLINE {
+			continue
+		}
+		fnum := uint32(i)
+		free := FILE_SEND_QUEUE_SIZE - int(this.fcs.SendQueueLen(f.Pubkey))
+		if slots := int(this.fcs.FreeSendSlots(f.Pubkey)) - MIN_SLOTS_FREE; slots < free {
+			free = slots
+		}
+		for j := range f.fileSending {
+			free -= f.fileSending[j].slots
+		}
+		for j := range f.fileSending {
+			ft := &f.fileSending[j]
+			filenumber := fileNumber(false, uint8(j))
+			if ft.status == FILESTATUS_FINISHED && this.fcs.PacketReceived(f.Pubkey, ft.lastPktnum) {
+				position, avatar := ft.transferred, ft.avatar
+				*ft = fileTransfer{}
+				if fn := this.OnFileChunkRequest; fn != nil && !avatar {
+					cbs = append(cbs, func() { fn(fnum, filenumber, position, 0) })
+				}
+				continue
+			}
+			if ft.status != FILESTATUS_TRANSFERRING || ft.paused != FILE_PAUSE_NOT {
+				continue
+			}
+			if ft.size == 0 {
+				// nothing to ask, finish by empty chunk
+				pktnum, err := this.fcs.SendLossless(f.Pubkey, []byte{PACKET_ID_FILE_DATA, byte(j)})
+				if err == nil {
+					ft.status, ft.lastPktnum = FILESTATUS_FINISHED, pktnum
+				}
+				continue
+			}
+			for ; free > 0 && (ft.size == FILE_SIZE_STREAM || ft.requested < ft.size); free-- {
+				length := uint64(MAX_FILE_DATA_SIZE)
+				if ft.size-ft.requested < length {
+					length = ft.size - ft.requested
+				}
+				position := ft.requested
+				ft.requested += length
+				ft.slots++
+				if ft.avatar {
+					// ours, sent without asking app
+					if this.fileSendChunkLocked(f, ft, filenumber, position, ft.data[position:position+length]) != nil {
+						ft.requested, ft.slots = position, ft.slots-1
+						break
+					}
+					continue
+				}
+				if fn := this.OnFileChunkRequest; fn != nil {
+					cbs = append(cbs, func() { fn(fnum, filenumber, position, int(length)) })
+				}
+			}
+		}
+	}
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
@@ -0,0 +1,215 @@
+package mintox
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// two messengers friends of each other and online over UDP
+func newTstFriendPair(t *testing.T, clk *fakeTstClock) (m0, m1 *Messenger, fnum0, fnum1 uint32) {
+	m0, m1 = newTstMessenger(clk), newTstMessenger(clk)
+	fnum0, fnum1 = tstMakeFriends(t, clk, m0, m1)
+	return
+}
+
+func tstMakeFriends(t *testing.T, clk *fakeTstClock, m0, m1 *Messenger) (fnum0, fnum1 uint32) {
+	fnum0, err := m0.AddFriendNorequest(m1.SelfPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fnum1, err = m1.AddFriendNorequest(m0.SelfPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m0.fcs.SetFriendAddr(m1.SelfPubkey, m1.fcs.ncro.tstAddr())
+	m0.fcs.SetDHTPubkey(m1.SelfPubkey, m1.fcs.ncro.dhtpk)
+	if !stepTstClock(clk, func() bool {
+		return m0.FriendConnectionStatus(fnum0) == CONNECTION_UDP && m1.FriendConnectionStatus(fnum1) == CONNECTION_UDP
+	}) {
+		t.Fatal("friends not online")
+	}
+	return
+}
+
+func TestMessengerFileTransfer(t *testing.T) {
+	clk := newFakeTstClock()
+	m0, m1, fnum0, fnum1 := newTstFriendPair(t, clk)
+	defer m0.tstKill()
+	defer m1.tstKill()
+
+	data := CBRandomBytes(2*MAX_FILE_DATA_SIZE + 100)
+	type recvFile struct {
+		filenumber uint32
+		kind       uint32
+		size       uint64
+		filename   string
+	}
+	recvC := make(chan recvFile, 1)
+	m1.OnFileRecv = func(fnum, filenumber uint32, kind uint32, size uint64, filename []byte) {
+		recvC <- recvFile{filenumber, kind, size, string(filename)}
+	}
+	ctrlC := make(chan uint8, 4)
+	m0.OnFileRecvControl = func(fnum, filenumber uint32, control uint8) { ctrlC <- control }
+	sentC := make(chan uint64, 1)
+	m0.OnFileChunkRequest = func(fnum, filenumber uint32, position uint64, length int) {
+		if length == 0 {
+			sentC <- position
+			return
+		}
+		if err := m0.FileSendChunk(fnum, filenumber, position, data[position:position+uint64(length)]); err != nil {
+			t.Error(err)
+		}
+	}
+	var got []byte
+	doneC := make(chan uint64, 1)
+	m1.OnFileRecvChunk = func(fnum, filenumber uint32, position uint64, dat []byte) {
+		if dat == nil {
+			doneC <- position
+			return
+		}
+		if position != uint64(MAX_FILE_DATA_SIZE+len(got)) {
+			t.Error("chunk position:", position, len(got))
+		}
+		got = append(got, dat...)
+	}
+
+	if _, err := m0.FileSend(fnum0, FILEKIND_DATA, uint64(len(data)), nil, make([]byte, MAX_FILENAME_LENGTH+1)); err == nil {
+		t.Error("too long filename sent")
+	}
+	filenum, err := m0.FileSend(fnum0, FILEKIND_DATA, uint64(len(data)), nil, []byte("f.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rf recvFile
+	select {
+	case rf = <-recvC:
+	case <-time.After(3 * time.Second):
+		t.Fatal("file request not received")
+	}
+	if rf.kind != FILEKIND_DATA || rf.size != uint64(len(data)) || rf.filename != "f.bin" || rf.filenumber < 1<<16 {
+		t.Fatal("file request:", rf)
+	}
+	id0, _ := m0.FileID(fnum0, filenum)
+	id1, err := m1.FileID(fnum1, rf.filenumber)
+	if err != nil || len(id0) != FILE_ID_LENGTH || !bytes.Equal(id0, id1) {
+		t.Error("file id:", id0, id1, err)
+	}
+	if m0.FileControl(fnum0, filenum, FILECONTROL_ACCEPT) == nil {
+		t.Error("sender accepted own file")
+	}
+
+	// resume from second chunk
+	if err := m1.FileSeek(fnum1, rf.filenumber, uint64(len(data))); err == nil {
+		t.Error("seek beyond size")
+	}
+	if err := m1.FileSeek(fnum1, rf.filenumber, MAX_FILE_DATA_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.FileControl(fnum1, rf.filenumber, FILECONTROL_ACCEPT); err != nil {
+		t.Fatal(err)
+	}
+	var position uint64
+	if !stepTstClock(clk, func() bool {
+		select {
+		case position = <-sentC:
+			return true
+		default:
+			return false
+		}
+	}) {
+		t.Fatal("file not sent")
+	}
+	if position != uint64(len(data)) {
+		t.Error("sent position:", position)
+	}
+	select {
+	case position = <-doneC:
+		if position != uint64(len(data)) || !bytes.Equal(got, data[MAX_FILE_DATA_SIZE:]) {
+			t.Error("received file:", position, len(got))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("file not finished")
+	}
+	if st := <-ctrlC; st != FILECONTROL_ACCEPT {
+		t.Error("control:", st)
+	}
+	if _, err := m1.FileTransferred(fnum1, rf.filenumber); err == nil {
+		t.Error("finished file still found")
+	}
+}
+
+func TestMessengerFilePauseKill(t *testing.T) {
+	clk := newFakeTstClock()
+	m0, m1, fnum0, fnum1 := newTstFriendPair(t, clk)
+	defer m0.tstKill()
+	defer m1.tstKill()
+
+	recvC := make(chan uint32, 1)
+	m1.OnFileRecv = func(fnum, filenumber uint32, kind uint32, size uint64, filename []byte) {
+		recvC <- filenumber
+	}
+	ctrl0C, ctrl1C := make(chan uint8, 4), make(chan uint8, 4)
+	m0.OnFileRecvControl = func(fnum, filenumber uint32, control uint8) { ctrl0C <- control }
+	m1.OnFileRecvControl = func(fnum, filenumber uint32, control uint8) { ctrl1C <- control }
+	waitCtrl := func(c chan uint8, want uint8) {
+		select {
+		case ctrl := <-c:
+			if ctrl != want {
+				t.Error("control:", ctrl, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("control not received:", want)
+		}
+	}
+
+	filenum, err := m0.FileSend(fnum0, FILEKIND_AVATAR, FILE_SIZE_STREAM, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rfilenum uint32
+	select {
+	case rfilenum = <-recvC:
+	case <-time.After(3 * time.Second):
+		t.Fatal("file request not received")
+	}
+	if m1.FileControl(fnum1, rfilenum, FILECONTROL_PAUSE) == nil {
+		t.Error("paused before accepted")
+	}
+	if err := m1.FileControl(fnum1, rfilenum, FILECONTROL_ACCEPT); err != nil {
+		t.Fatal(err)
+	}
+	waitCtrl(ctrl0C, FILECONTROL_ACCEPT)
+	if err := m1.FileControl(fnum1, rfilenum, FILECONTROL_PAUSE); err != nil {
+		t.Fatal(err)
+	}
+	waitCtrl(ctrl0C, FILECONTROL_PAUSE)
+	if m0.FileSendChunk(fnum0, filenum, 0, []byte("x")) == nil {
+		t.Error("chunk sent while paused")
+	}
+	if m0.FileControl(fnum0, filenum, FILECONTROL_ACCEPT) == nil {
+		t.Error("resumed file paused by friend")
+	}
+	if err := m1.FileControl(fnum1, rfilenum, FILECONTROL_ACCEPT); err != nil {
+		t.Fatal(err)
+	}
+	waitCtrl(ctrl0C, FILECONTROL_ACCEPT)
+	chunk := make([]byte, MAX_FILE_DATA_SIZE)
+	if !waitTstCond(3*time.Second, func() bool { return m0.FileSendChunk(fnum0, filenum, 0, chunk) == nil }) {
+		t.Error("chunk not sent after resumed")
+	}
+
+	if err := m0.FileControl(fnum0, filenum, FILECONTROL_KILL); err != nil {
+		t.Fatal(err)
+	}
+	waitCtrl(ctrl1C, FILECONTROL_KILL)
+	if _, err := m0.FileTransferred(fnum0, filenum); err == nil {
+		t.Error("killed file still found")
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		_, err := m1.FileTransferred(fnum1, rfilenum)
+		return err != nil
+	}) {
+		t.Error("killed file still found by friend")
+	}
+}
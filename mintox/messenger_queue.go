@@ -0,0 +1,266 @@
+package mintox
+
+import (
+	"encoding/json"
+	"gopp"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* Messages sent by one flush of a friend's queue, the rest next second. */
+const MESSAGE_QUEUE_BURST = 32
+
+// one message of QueueMessage, kept by MessageStore until delivered
+type QueuedMessage struct {
+	ID       uint64    `json:"id"`
+	Type     int       `json:"type"` // MESSAGE_*
+	Msg      []byte    `json:"msg"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// MessageStore keeps undelivered messages by friend pubkey hex, so they are
+// sent after restart. Memory and json file ones here, a bolt or sqlite one
+// fits the same. Safe for concurrent use.
+type MessageStore interface {
+	Add(pubkey string, qm QueuedMessage) error
+	Remove(pubkey string, id uint64) error
+	List(pubkey string) ([]QueuedMessage, error) // by ID
+	Clear(pubkey string) error
+}
+
+// queued message and its send state, of Friend.queue
+type queuedSend struct {
+	QueuedMessage
+	sent   bool // over the current conn
+	pktnum uint32
+}
+
+// in memory, the default, messages lost on restart
+type memMessageStore struct {
+	mu   sync.Mutex
+	msgs map[string][]QueuedMessage
+}
+
+func newMemMessageStore() *memMessageStore {
+	return &memMessageStore{msgs: map[string][]QueuedMessage{}}
+}
+
+func (this *memMessageStore) Add(pubkey string, qm QueuedMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.msgs[pubkey] = append(this.msgs[pubkey], qm)
+	return nil
+}
+
+func (this *memMessageStore) Remove(pubkey string, id uint64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	msgs := this.msgs[pubkey]
+	for i, qm := range msgs {
+		if qm.ID == id {
+			msgs = append(msgs[:i:i], msgs[i+1:]...)
+			break
+		}
+	}
+	if len(msgs) == 0 {
+		delete(this.msgs, pubkey)
+	} else {
+		this.msgs[pubkey] = msgs
+	}
+	return nil
+}
+
+func (this *memMessageStore) List(pubkey string) ([]QueuedMessage, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	msgs := append([]QueuedMessage{}, this.msgs[pubkey]...)
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs, nil
+}
+
+func (this *memMessageStore) Clear(pubkey string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.msgs, pubkey)
+	return nil
+}
+
+// FileMessageStore is a memory store saved to a json file on each change
+type FileMessageStore struct {
+	*memMessageStore
+	filename string
+	filemu   sync.Mutex // change and its save
+}
+
+// NewFileMessageStore loads filename, none yet is an empty store
+func NewFileMessageStore(filename string) (*FileMessageStore, error) {
+	this := &FileMessageStore{memMessageStore: newMemMessageStore(), filename: filename}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return this, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "load messages")
+	}
+	if err := json.Unmarshal(data, &this.msgs); err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	return this, nil
+}
+
+func (this *FileMessageStore) Add(pubkey string, qm QueuedMessage) error {
+	this.filemu.Lock()
+	defer this.filemu.Unlock()
+	this.memMessageStore.Add(pubkey, qm)
+	return this.save()
+}
+
+func (this *FileMessageStore) Remove(pubkey string, id uint64) error {
+	this.filemu.Lock()
+	defer this.filemu.Unlock()
+	this.memMessageStore.Remove(pubkey, id)
+	return this.save()
+}
+
+func (this *FileMessageStore) Clear(pubkey string) error {
+	this.filemu.Lock()
+	defer this.filemu.Unlock()
+	this.memMessageStore.Clear(pubkey)
+	return this.save()
+}
+
+// filemu locked
+func (this *FileMessageStore) save() error {
+	this.mu.Lock()
+	data, err := json.MarshalIndent(this.msgs, "", "  ")
+	this.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeFileAtomic(this.filename, data), "save messages")
+}
+
+/////
+
+// SetMessageStore replaces the in memory store, queues of friends added are
+// loaded from ms. Set it before LoadSaveData.
+func (this *Messenger) SetMessageStore(ms MessageStore) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.msgstore = ms
+	for _, f := range this.friends {
+		if f != nil {
+			this.loadQueueLocked(f)
+		}
+	}
+}
+
+// QueueMessage sends msg like SendMessage when friend online, else keeps it
+// until then, resent until friend got it, also after restart with a
+// persistent MessageStore. A message may arrive twice if the conn broke
+// before its receipt. OnMessageDelivered tells when friend got it.
+func (this *Messenger) QueueMessage(fnum uint32, msgtype int, msg []byte) (uint64, error) {
+	if msgtype != MESSAGE_NORMAL && msgtype != MESSAGE_ACTION {
+		return 0, errors.Errorf("Invalid message type: %d", msgtype)
+	}
+	if len(msg) == 0 || len(msg) > MAX_MESSAGE_LENGTH {
+		return 0, errors.Errorf("Invalid message length: %d", len(msg))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return 0, err
+	}
+	this.queueID++
+	qm := QueuedMessage{ID: this.queueID, Type: msgtype, Msg: append([]byte{}, msg...), QueuedAt: this.clock.Now()}
+	if err := this.msgstore.Add(f.Pubkey.ToHex(), qm); err != nil {
+		return 0, err
+	}
+	f.queue = append(f.queue, &queuedSend{QueuedMessage: qm})
+	if f.Status == FRIEND_ONLINE {
+		this.sendQueueLocked(f)
+	}
+	return qm.ID, nil
+}
+
+// messages of friend not delivered yet
+func (this *Messenger) QueuedMessages(fnum uint32) []QueuedMessage {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, err := this.friendLocked(fnum)
+	if err != nil {
+		return nil
+	}
+	msgs := make([]QueuedMessage, 0, len(f.queue))
+	for _, qs := range f.queue {
+		msgs = append(msgs, qs.QueuedMessage)
+	}
+	return msgs
+}
+
+// mu held by caller
+func (this *Messenger) loadQueueLocked(f *Friend) {
+	msgs, err := this.msgstore.List(f.Pubkey.ToHex())
+	gopp.ErrPrint(err, f.Pubkey.ToHex20())
+	f.queue = nil
+	for _, qm := range msgs {
+		f.queue = append(f.queue, &queuedSend{QueuedMessage: qm})
+		if qm.ID > this.queueID {
+			this.queueID = qm.ID
+		}
+	}
+}
+
+// send messages not sent over the current conn in order, stop at a send
+// failure like packet queue full. mu held by caller
+func (this *Messenger) sendQueueLocked(f *Friend) {
+	n := 0
+	for _, qs := range f.queue {
+		if qs.sent {
+			continue
+		}
+		if n >= MESSAGE_QUEUE_BURST {
+			return
+		}
+		pktnum, err := this.fcs.SendLossless(f.Pubkey, append([]byte{byte(PACKET_ID_MESSAGE + qs.Type)}, qs.Msg...))
+		if err != nil {
+			return
+		}
+		qs.sent, qs.pktnum = true, pktnum
+		n++
+	}
+}
+
+// conn gone, packet numbers of the next one start over. mu held by caller
+func (this *Messenger) unsendQueueLocked(f *Friend) {
+	for _, qs := range f.queue {
+		qs.sent = false
+	}
+}
+
+// drop delivered messages, send the rest. mu held by caller
+func (this *Messenger) doQueueLocked(fnum uint32, f *Friend) (cbs []func()) {
+	rest := f.queue[:0]
+	for _, qs := range f.queue {
+		if !qs.sent || !this.fcs.PacketReceived(f.Pubkey, qs.pktnum) {
+			rest = append(rest, qs)
+			continue
+		}
+		gopp.ErrPrint(this.msgstore.Remove(f.Pubkey.ToHex(), qs.ID), fnum)
+		if fn := this.OnMessageDelivered; fn != nil {
+			id := qs.ID
+			cbs = append(cbs, func() { fn(fnum, id) })
+		}
+	}
+	for i := len(rest); i < len(f.queue); i++ {
+		f.queue[i] = nil
+	}
+	f.queue = rest
+	this.sendQueueLocked(f)
+	return
+}
@@ -0,0 +1,85 @@
+package mintox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMessengerQueueOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mintox-msgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "msgs.json")
+	clk := newFakeTstClock()
+
+	m0, m1 := newTstMessenger(clk), newTstMessenger(clk)
+	defer m1.tstKill()
+	ms, err := NewFileMessageStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m0.SetMessageStore(ms)
+	fnum, _ := m0.AddFriendNorequest(m1.SelfPubkey)
+	for _, msg := range []string{"first", "second"} {
+		if _, err := m0.QueueMessage(fnum, MESSAGE_NORMAL, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m0.QueueMessage(fnum, MESSAGE_NORMAL, nil); err == nil {
+		t.Error("empty message queued")
+	}
+	if qms := m0.QueuedMessages(fnum); len(qms) != 2 || qms[1].ID != 2 {
+		t.Fatal("queued:", qms)
+	}
+	m0.tstKill()
+
+	// queue of friend loaded by a messenger restarted with the store
+	ms, err = NewFileMessageStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := newTstMessenger(clk)
+	defer m2.tstKill()
+	m2.SetMessageStore(ms)
+	msgC := make(chan string, 4)
+	m1.OnFriendMessage = func(fnum uint32, msgtype int, msg []byte) { msgC <- string(msg) }
+	deliveredC := make(chan uint64, 4)
+	m2.OnMessageDelivered = func(fnum uint32, id uint64) { deliveredC <- id }
+	fnum2, _ := tstMakeFriends(t, clk, m2, m1)
+
+	var delivered []uint64
+	if !stepTstClock(clk, func() bool {
+		select {
+		case id := <-deliveredC:
+			delivered = append(delivered, id)
+		default:
+		}
+		return len(delivered) == 2
+	}) {
+		t.Fatal("not delivered:", delivered)
+	}
+	if delivered[0] != 1 || delivered[1] != 2 {
+		t.Error("delivered order:", delivered)
+	}
+	if msg0, msg1 := <-msgC, <-msgC; msg0 != "first" || msg1 != "second" {
+		t.Error("messages:", msg0, msg1)
+	}
+	if qms := m2.QueuedMessages(fnum2); len(qms) != 0 {
+		t.Error("delivered still queued:", qms)
+	}
+	ms, _ = NewFileMessageStore(filename)
+	if qms, _ := ms.List(m1.SelfPubkey.ToHex()); len(qms) != 0 {
+		t.Error("delivered still stored:", qms)
+	}
+	// online friend gets it at once, ids go on
+	if id, err := m2.QueueMessage(fnum2, MESSAGE_ACTION, []byte("third")); err != nil || id != 3 {
+		t.Fatal("queue online:", id, err)
+	}
+	if !stepTstClock(clk, func() bool { return len(deliveredC) == 1 }) {
+		t.Error("online message not delivered")
+	}
+}
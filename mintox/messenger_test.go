@@ -0,0 +1,280 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func newTstMessenger(clk clock) *Messenger {
+	nc := newTstNetCrypto(clk)
+	return NewMessenger(NewFriendConns(nc, nil))
+}
+
+func (this *Messenger) tstKill() {
+	this.Kill()
+	this.fcs.Kill()
+	this.fcs.ncro.Kill()
+	this.fcs.ncro.neto.srv.Close()
+}
+
+func TestMessengerAddress(t *testing.T) {
+	m := newTstMessenger(defaultClock)
+	defer m.tstKill()
+	m.SetNospam(0x01020304)
+	addr := m.Address()
+	if len(addr) != FRIEND_ADDRESS_SIZE || string(addr[PUBLIC_KEY_SIZE:PUBLIC_KEY_SIZE+4]) != "\x01\x02\x03\x04" {
+		t.Fatal("address:", addr)
+	}
+	if _, err := m.AddFriend(addr, []byte("hi")); err == nil {
+		t.Error("self added")
+	}
+	pk, _, _ := NewCBKeyPair()
+	addr2 := append(append([]byte{}, pk.Bytes()...), addr[PUBLIC_KEY_SIZE:]...)
+	if _, err := m.AddFriend(addr2, []byte("hi")); err == nil {
+		t.Error("bad checksum accepted")
+	}
+	sum := addressChecksum(addr2[:PUBLIC_KEY_SIZE+4])
+	copy(addr2[PUBLIC_KEY_SIZE+4:], sum[:])
+	if _, err := m.AddFriend(addr2, nil); err == nil {
+		t.Error("empty request message accepted")
+	}
+	fnum, err := m.AddFriend(addr2, []byte("hi"))
+	if err != nil || fnum != 0 {
+		t.Fatal(fnum, err)
+	}
+	if _, err := m.AddFriend(addr2, []byte("hi")); err == nil {
+		t.Error("friend added twice")
+	}
+}
+
+func TestMessengerFriendRequestMessage(t *testing.T) {
+	clk := newFakeTstClock()
+	m0, m1 := newTstMessenger(clk), newTstMessenger(clk)
+	defer m0.tstKill()
+	defer m1.tstKill()
+	m0.SetName([]byte("m0"))
+	m1.SetStatusMessage([]byte("busy m1"))
+	m1.SetUserStatus(USERSTATUS_BUSY)
+
+	reqC := make(chan []byte, 1)
+	m1.OnFriendRequest = func(pubkey *CryptoKey, msg []byte) {
+		if pubkey.Equal2(m0.SelfPubkey) {
+			reqC <- msg
+		}
+	}
+	nameC := make(chan []byte, 1)
+	msgC := make(chan []byte, 2)
+	m1.OnFriendName = func(fnum uint32, name []byte) { nameC <- name }
+	m1.OnFriendMessage = func(fnum uint32, msgtype int, msg []byte) {
+		msgC <- append([]byte{byte(msgtype)}, msg...)
+	}
+	receiptC := make(chan uint32, 2)
+	m0.OnReadReceipt = func(fnum uint32, msgid uint32) { receiptC <- msgid }
+
+	// request to old nospam dropped
+	addr := m1.Address()
+	m1.SetNospam(m1.Nospam() + 1)
+	fnum, err := m0.AddFriend(addr, []byte("add me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcs := m0.FriendConns()
+	fcs.SetFriendAddr(m1.SelfPubkey, m1.fcs.ncro.tstAddr())
+	fcs.SetDHTPubkey(m1.SelfPubkey, m1.fcs.ncro.dhtpk)
+	if !stepTstClock(clk, func() bool { return fcs.Status(m1.SelfPubkey) == CONNECTION_UDP }) {
+		t.Fatal("friend conn not up")
+	}
+	select {
+	case <-reqC:
+		t.Fatal("request with old nospam received")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// request sent again with the new nospam
+	if _, err := m0.AddFriend(m1.Address(), []byte("add me")); err != nil {
+		t.Fatal(err)
+	}
+	var msg []byte
+	if !stepTstClock(clk, func() bool {
+		select {
+		case msg = <-reqC:
+			return true
+		default:
+			return false
+		}
+	}) || string(msg) != "add me" {
+		t.Fatal("friend request not received:", string(msg))
+	}
+	fnum1, err := m1.AddFriendNorequest(m0.SelfPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		return m0.FriendConnectionStatus(fnum) == CONNECTION_UDP && m1.FriendConnectionStatus(fnum1) == CONNECTION_UDP
+	}) {
+		t.Fatal("friends not online:", m0.FriendConnectionStatus(fnum), m1.FriendConnectionStatus(fnum1))
+	}
+
+	select {
+	case name := <-nameC:
+		if string(name) != "m0" {
+			t.Error("name:", string(name))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("name not received")
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		f := m0.Friend(fnum)
+		return string(f.StatusMessage) == "busy m1" && f.UserStatus == USERSTATUS_BUSY
+	}) {
+		t.Error("status not received:", m0.Friend(fnum))
+	}
+
+	if _, err := m0.SendMessage(fnum, MESSAGE_NORMAL, nil); err == nil {
+		t.Error("empty message sent")
+	}
+	id0, err := m0.SendMessage(fnum, MESSAGE_NORMAL, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1, err := m0.SendMessage(fnum, MESSAGE_ACTION, []byte("waves"))
+	if err != nil || id1 != id0+1 {
+		t.Fatal(id0, id1, err)
+	}
+	for _, want := range []string{"\x00hello", "\x01waves"} {
+		select {
+		case msg := <-msgC:
+			if string(msg) != want {
+				t.Error("message:", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("message not received:", want)
+		}
+	}
+	// receipts with acks of next request packets
+	for _, want := range []uint32{id0, id1} {
+		var got uint32
+		if !stepTstClock(clk, func() bool {
+			select {
+			case got = <-receiptC:
+				return true
+			default:
+				return false
+			}
+		}) || got != want {
+			t.Fatal("receipt:", got, want)
+		}
+	}
+
+	offC := make(chan uint8, 1)
+	m1.OnFriendConnectionStatus = func(fnum uint32, status uint8) { offC <- status }
+	if err := m0.DelFriend(fnum); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case st := <-offC:
+		if st != CONNECTION_NONE {
+			t.Error("offline status:", st)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("friend not offline after delete")
+	}
+	if m0.DelFriend(fnum) == nil {
+		t.Error("deleted twice")
+	}
+}
+
+// repeated requests of a stranger reported once, as onion ones are resent
+func TestMessengerFriendRequestDedupe(t *testing.T) {
+	m := newTstMessenger(defaultClock)
+	defer m.tstKill()
+	reqs := map[string]int{}
+	m.OnFriendRequest = func(pubkey *CryptoKey, msg []byte) { reqs[pubkey.BinStr()]++ }
+	request := func(pubkey *CryptoKey, nospam uint32) {
+		data := make([]byte, 4, 4+2)
+		binary.BigEndian.PutUint32(data, nospam)
+		m.handleOnionRequest(pubkey, append(data, "hi"...))
+	}
+
+	pk0, _, _ := NewCBKeyPair()
+	request(pk0, m.Nospam()+1)
+	request(pk0, m.Nospam())
+	request(pk0, m.Nospam())
+	if reqs[pk0.BinStr()] != 1 {
+		t.Fatal("requests of pk0:", reqs[pk0.BinStr()])
+	}
+	// deleted friend may request again
+	fnum, _ := m.AddFriendNorequest(pk0)
+	m.DelFriend(fnum)
+	request(pk0, m.Nospam())
+	if reqs[pk0.BinStr()] != 2 {
+		t.Error("request after delete:", reqs[pk0.BinStr()])
+	}
+	// forgotten when out of the ring
+	for i := 0; i < MAX_RECEIVED_STORED; i++ {
+		pk, _, _ := NewCBKeyPair()
+		request(pk, m.Nospam())
+	}
+	request(pk0, m.Nospam())
+	if reqs[pk0.BinStr()] != 3 || len(reqs) != 1+MAX_RECEIVED_STORED {
+		t.Error("ring of requesters:", reqs[pk0.BinStr()], len(reqs))
+	}
+}
+
+func TestMessengerTypingStatus(t *testing.T) {
+	clk := newFakeTstClock()
+	m0, m1, fnum0, fnum1 := newTstFriendPair(t, clk)
+	defer m0.tstKill()
+	defer m1.tstKill()
+	typingC := make(chan bool, 4)
+	m1.OnFriendTyping = func(fnum uint32, typing bool) { typingC <- typing }
+	statusC := make(chan uint8, 4)
+	m1.OnFriendUserStatus = func(fnum uint32, status uint8) { statusC <- status }
+	smsgC := make(chan string, 4)
+	m1.OnFriendStatusMessage = func(fnum uint32, msg []byte) { smsgC <- string(msg) }
+
+	waitC := func(cond func() bool) bool { return waitTstCond(3*time.Second, cond) }
+	m0.SetTyping(fnum0, true)
+	if !waitC(func() bool { return m1.FriendTyping(fnum1) }) {
+		t.Fatal("typing not received")
+	}
+	m0.SetTyping(fnum0, true)
+	m0.SetTyping(fnum0, false)
+	if !waitC(func() bool { return !m1.FriendTyping(fnum1) }) {
+		t.Fatal("typing stop not received")
+	}
+	var typings []bool
+	for len(typingC) > 0 {
+		typings = append(typings, <-typingC)
+	}
+	if n := len(typings); n < 2 || !typings[n-2] || typings[n-1] {
+		t.Error("typing callbacks:", typings)
+	}
+	if m0.SetTyping(fnum0+1, true) == nil {
+		t.Error("typing to no friend")
+	}
+
+	m0.SetUserStatus(USERSTATUS_AWAY)
+	m0.SetStatusMessage([]byte("lunch"))
+	if !waitC(func() bool {
+		f := m1.Friend(fnum1)
+		return f.UserStatus == USERSTATUS_AWAY && string(f.StatusMessage) == "lunch"
+	}) {
+		t.Fatal("status not received:", m1.Friend(fnum1))
+	}
+	var status uint8
+	for len(statusC) > 0 {
+		status = <-statusC
+	}
+	var smsg string
+	for len(smsgC) > 0 {
+		smsg = <-smsgC
+	}
+	if status != USERSTATUS_AWAY || smsg != "lunch" {
+		t.Error("status callbacks:", status, smsg)
+	}
+	if m0.SetUserStatus(USERSTATUS_INVALID) == nil {
+		t.Error("invalid user status set")
+	}
+}
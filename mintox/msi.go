@@ -0,0 +1,414 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"gopp"
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/* Capabilities of a call side, as MSICapabilities */
+const (
+	MSI_CAP_S_AUDIO = 4  // sending audio
+	MSI_CAP_S_VIDEO = 8  // sending video
+	MSI_CAP_R_AUDIO = 16 // receiving audio
+	MSI_CAP_R_VIDEO = 32 // receiving video
+)
+
+/* Error of a call, as MSIError */
+const (
+	MSI_E_NONE            = 0
+	MSI_E_INVALID_MESSAGE = 1
+	MSI_E_INVALID_PARAM   = 2
+	MSI_E_INVALID_STATE   = 3
+	MSI_E_STRAY_MESSAGE   = 4
+	MSI_E_SYSTEM          = 5
+	MSI_E_HANDLE          = 6
+	MSI_E_UNDISCLOSED     = 7
+)
+
+/* Call state, as MSICallState */
+const (
+	MSI_CALL_INACTIVE   = 0 // no call
+	MSI_CALL_ACTIVE     = 1
+	MSI_CALL_REQUESTING = 2 // we invited, waiting answer
+	MSI_CALL_REQUESTED  = 3 // friend invited us
+)
+
+/* Header ids of msi message, id | size | value, ended by 0 */
+const (
+	MSI_ID_REQUEST      = 1
+	MSI_ID_ERROR        = 2
+	MSI_ID_CAPABILITIES = 3
+)
+
+/* Values of request header */
+const (
+	MSI_REQU_INIT = 0
+	MSI_REQU_PUSH = 1
+	MSI_REQU_POP  = 2
+)
+
+/* Bit rates a call side wants, audio kbps | video kbps. Not of toxcore, other clients ignore it. */
+const PACKET_ID_MSI_BITRATE = (PACKET_ID_LOSSLESS_RANGE_START + PACKET_ID_LOSSLESS_RANGE_SIZE - 1)
+
+// like MSIMessage, headers not got are -1
+type msiMessage struct {
+	request      int
+	err          int
+	capabilities int
+}
+
+// like msi_msg_parse, every header of one byte value
+func parseMSIMessage(data []byte) (*msiMessage, error) {
+	msg := &msiMessage{request: -1, err: -1, capabilities: -1}
+	for len(data) > 0 && data[0] != 0 {
+		if len(data) < 3 || data[1] != 1 {
+			return nil, errors.Errorf("Invalid msi header: %v", data)
+		}
+		id, value := data[0], int(data[2])
+		switch id {
+		case MSI_ID_REQUEST:
+			if value > MSI_REQU_POP {
+				return nil, errors.Errorf("Invalid msi request: %d", value)
+			}
+			msg.request = value
+		case MSI_ID_ERROR:
+			if value > MSI_E_UNDISCLOSED {
+				return nil, errors.Errorf("Invalid msi error: %d", value)
+			}
+			msg.err = value
+		case MSI_ID_CAPABILITIES:
+			msg.capabilities = value
+		default:
+			return nil, errors.Errorf("Invalid msi header id: %d", id)
+		}
+		data = data[3:]
+	}
+	if len(data) == 0 {
+		return nil, errors.New("Msi message not ended")
+	}
+	if msg.request < 0 {
+		return nil, errors.New("No msi request")
+	}
+	return msg, nil
+}
+
+// PACKET_ID_MSI | headers | 0
+func (this *msiMessage) bytes() []byte {
+	pkt := []byte{PACKET_ID_MSI}
+	for _, h := range [][2]int{{MSI_ID_REQUEST, this.request}, {MSI_ID_ERROR, this.err},
+		{MSI_ID_CAPABILITIES, this.capabilities}} {
+		if h[1] >= 0 {
+			pkt = append(pkt, byte(h[0]), 1, byte(h[1]))
+		}
+	}
+	return append(pkt, 0)
+}
+
+// like MSICall, one with a friend
+type msiCall struct {
+	state    uint8 // MSI_CALL_*
+	selfCaps uint8
+	peerCaps uint8
+}
+
+// like MSISession of toxav, signaling of one to one calls with friends over
+// lossless packets of Messenger. Media goes elsewhere, started by OnStart.
+type MSISession struct {
+	m *Messenger
+
+	mu    sync.Mutex
+	calls map[uint32]*msiCall // fnum =>
+
+	OnInvite       func(fnum uint32, peerCaps uint8) // answer by Answer or Hangup
+	OnStart        func(fnum uint32, peerCaps uint8) // our invite answered
+	OnEnd          func(fnum uint32)                 // hung up or rejected by friend
+	OnError        func(fnum uint32, code int)       // MSI_E_*, call ended
+	OnPeerTimeout  func(fnum uint32)                 // friend offline, call ended
+	OnCapabilities func(fnum uint32, peerCaps uint8)
+	// bit rates friend wants to receive, kbps, 0 for no change
+	OnBitRate func(fnum uint32, audio, video uint32)
+}
+
+func NewMSISession(m *Messenger) *MSISession {
+	this := &MSISession{}
+	this.m = m
+	this.calls = map[uint32]*msiCall{}
+	m.mu.Lock()
+	m.msi = this
+	m.mu.Unlock()
+	return this
+}
+
+// Invite calls online friend with our capabilities, MSI_CAP_*
+func (this *MSISession) Invite(fnum uint32, caps uint8) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.calls[fnum]; ok {
+		return errors.Errorf("Already in call: %d", fnum)
+	}
+	msg := &msiMessage{request: MSI_REQU_INIT, err: -1, capabilities: int(caps)}
+	if err := this.m.sendFriendPacket(fnum, msg.bytes()); err != nil {
+		return err
+	}
+	this.calls[fnum] = &msiCall{state: MSI_CALL_REQUESTING, selfCaps: caps}
+	return nil
+}
+
+// Answer accepts invite of friend with our capabilities
+func (this *MSISession) Answer(fnum uint32, caps uint8) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	call, ok := this.calls[fnum]
+	if !ok || call.state != MSI_CALL_REQUESTED {
+		return errors.Errorf("No call to answer: %d", fnum)
+	}
+	msg := &msiMessage{request: MSI_REQU_PUSH, err: -1, capabilities: int(caps)}
+	if err := this.m.sendFriendPacket(fnum, msg.bytes()); err != nil {
+		return err
+	}
+	call.state, call.selfCaps = MSI_CALL_ACTIVE, caps
+	return nil
+}
+
+// Hangup ends the call, or rejects an invite
+func (this *MSISession) Hangup(fnum uint32) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.calls[fnum]; !ok {
+		return errors.Errorf("No call: %d", fnum)
+	}
+	delete(this.calls, fnum)
+	msg := &msiMessage{request: MSI_REQU_POP, err: -1, capabilities: -1}
+	return this.m.sendFriendPacket(fnum, msg.bytes())
+}
+
+// ChangeCapabilities tells friend in active call what we send and receive now,
+// like muting audio or stopping video
+func (this *MSISession) ChangeCapabilities(fnum uint32, caps uint8) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	call, ok := this.calls[fnum]
+	if !ok || call.state != MSI_CALL_ACTIVE {
+		return errors.Errorf("No active call: %d", fnum)
+	}
+	if call.selfCaps == caps {
+		return nil
+	}
+	msg := &msiMessage{request: MSI_REQU_PUSH, err: -1, capabilities: int(caps)}
+	if err := this.m.sendFriendPacket(fnum, msg.bytes()); err != nil {
+		return err
+	}
+	call.selfCaps = caps
+	return nil
+}
+
+// SetBitRate asks friend in active call to send at these kbps, 0 for no change
+func (this *MSISession) SetBitRate(fnum uint32, audio, video uint32) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	call, ok := this.calls[fnum]
+	if !ok || call.state != MSI_CALL_ACTIVE {
+		return errors.Errorf("No active call: %d", fnum)
+	}
+	pkt := make([]byte, 1+4+4)
+	pkt[0] = PACKET_ID_MSI_BITRATE
+	binary.BigEndian.PutUint32(pkt[1:], audio)
+	binary.BigEndian.PutUint32(pkt[5:], video)
+	return this.m.sendFriendPacket(fnum, pkt)
+}
+
+// MSI_CALL_* with friend
+func (this *MSISession) CallState(fnum uint32) uint8 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if call, ok := this.calls[fnum]; ok {
+		return call.state
+	}
+	return MSI_CALL_INACTIVE
+}
+
+func (this *MSISession) PeerCapabilities(fnum uint32) uint8 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if call, ok := this.calls[fnum]; ok {
+		return call.peerCaps
+	}
+	return 0
+}
+
+// like handle_msi_packet
+func (this *MSISession) handlePacket(fnum uint32, data []byte) {
+	var cb func()
+	this.mu.Lock()
+	if data[0] == PACKET_ID_MSI_BITRATE {
+		cb = this.handleBitRateLocked(fnum, data[1:])
+	} else {
+		cb = this.handleMessageLocked(fnum, data[1:])
+	}
+	this.mu.Unlock()
+	if cb != nil {
+		cb()
+	}
+}
+
+// mu held by caller
+func (this *MSISession) handleMessageLocked(fnum uint32, data []byte) func() {
+	msg, err := parseMSIMessage(data)
+	if err != nil {
+		log.Println(err, fnum)
+		if _, ok := this.calls[fnum]; ok {
+			return this.failLocked(fnum, MSI_E_INVALID_MESSAGE)
+		}
+		this.sendErrorLocked(fnum, MSI_E_INVALID_MESSAGE)
+		return nil
+	}
+	call, ok := this.calls[fnum]
+	if !ok {
+		switch msg.request {
+		case MSI_REQU_INIT:
+			call = &msiCall{state: MSI_CALL_INACTIVE}
+			this.calls[fnum] = call
+		case MSI_REQU_PUSH:
+			this.sendErrorLocked(fnum, MSI_E_STRAY_MESSAGE)
+			return nil
+		default:
+			return nil // pop of a call gone, answering it may loop
+		}
+	}
+	switch msg.request {
+	case MSI_REQU_INIT:
+		return this.handleInitLocked(fnum, call, msg)
+	case MSI_REQU_PUSH:
+		return this.handlePushLocked(fnum, call, msg)
+	default:
+		return this.handlePopLocked(fnum, call, msg)
+	}
+}
+
+// like handle_init. mu held by caller
+func (this *MSISession) handleInitLocked(fnum uint32, call *msiCall, msg *msiMessage) func() {
+	if msg.capabilities < 0 {
+		return this.failLocked(fnum, MSI_E_INVALID_MESSAGE)
+	}
+	caps := uint8(msg.capabilities)
+	switch call.state {
+	case MSI_CALL_INACTIVE:
+		call.state, call.peerCaps = MSI_CALL_REQUESTED, caps
+		if fn := this.OnInvite; fn != nil {
+			return func() { fn(fnum, caps) }
+		}
+	case MSI_CALL_ACTIVE:
+		// friend reconnected, it lost the call state
+		resp := &msiMessage{request: MSI_REQU_PUSH, err: -1, capabilities: int(call.selfCaps)}
+		gopp.ErrPrint(this.m.sendFriendPacket(fnum, resp.bytes()), fnum)
+		call.peerCaps = caps
+		if fn := this.OnCapabilities; fn != nil {
+			return func() { fn(fnum, caps) }
+		}
+	default:
+		return this.failLocked(fnum, MSI_E_INVALID_STATE)
+	}
+	return nil
+}
+
+// like handle_push. mu held by caller
+func (this *MSISession) handlePushLocked(fnum uint32, call *msiCall, msg *msiMessage) func() {
+	if msg.capabilities < 0 {
+		return this.failLocked(fnum, MSI_E_INVALID_MESSAGE)
+	}
+	caps := uint8(msg.capabilities)
+	switch call.state {
+	case MSI_CALL_ACTIVE:
+		if call.peerCaps == caps {
+			return nil
+		}
+		call.peerCaps = caps
+		if fn := this.OnCapabilities; fn != nil {
+			return func() { fn(fnum, caps) }
+		}
+	case MSI_CALL_REQUESTING:
+		call.state, call.peerCaps = MSI_CALL_ACTIVE, caps
+		if fn := this.OnStart; fn != nil {
+			return func() { fn(fnum, caps) }
+		}
+	default:
+		return this.failLocked(fnum, MSI_E_INVALID_STATE)
+	}
+	return nil
+}
+
+// like handle_pop, friend ended the call, by error if any. mu held by caller
+func (this *MSISession) handlePopLocked(fnum uint32, call *msiCall, msg *msiMessage) func() {
+	delete(this.calls, fnum)
+	if msg.err >= 0 {
+		if fn := this.OnError; fn != nil {
+			code := msg.err
+			return func() { fn(fnum, code) }
+		}
+		return nil
+	}
+	if call.state == MSI_CALL_INACTIVE {
+		return nil
+	}
+	if fn := this.OnEnd; fn != nil {
+		return func() { fn(fnum) }
+	}
+	return nil
+}
+
+// mu held by caller
+func (this *MSISession) handleBitRateLocked(fnum uint32, data []byte) func() {
+	call, ok := this.calls[fnum]
+	if !ok || call.state != MSI_CALL_ACTIVE || len(data) != 4+4 {
+		return nil
+	}
+	audio, video := binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:])
+	if fn := this.OnBitRate; fn != nil {
+		return func() { fn(fnum, audio, video) }
+	}
+	return nil
+}
+
+// like send_error, pop with error. mu held by caller
+func (this *MSISession) sendErrorLocked(fnum uint32, code int) {
+	msg := &msiMessage{request: MSI_REQU_POP, err: code, capabilities: -1}
+	gopp.ErrPrint(this.m.sendFriendPacket(fnum, msg.bytes()), fnum, code)
+}
+
+// tell friend the error and end the call. mu held by caller
+func (this *MSISession) failLocked(fnum uint32, code int) func() {
+	this.sendErrorLocked(fnum, code)
+	call := this.calls[fnum]
+	delete(this.calls, fnum)
+	if call == nil || call.state == MSI_CALL_INACTIVE {
+		return nil // app knew nothing of it
+	}
+	if fn := this.OnError; fn != nil {
+		return func() { fn(fnum, code) }
+	}
+	return nil
+}
+
+func (this *MSISession) handleFriendStatus(fnum uint32, online bool) {
+	if online {
+		return
+	}
+	this.mu.Lock()
+	_, ok := this.calls[fnum]
+	delete(this.calls, fnum)
+	fn := this.OnPeerTimeout
+	this.mu.Unlock()
+	if ok && fn != nil {
+		fn(fnum)
+	}
+}
+
+func (this *MSISession) delFriend(fnum uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.calls, fnum)
+}
@@ -0,0 +1,145 @@
+package mintox
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMSIMessage(t *testing.T) {
+	msg := &msiMessage{request: MSI_REQU_POP, err: MSI_E_INVALID_STATE, capabilities: -1}
+	pkt := msg.bytes()
+	if !bytes.Equal(pkt, []byte{PACKET_ID_MSI, MSI_ID_REQUEST, 1, MSI_REQU_POP, MSI_ID_ERROR, 1, MSI_E_INVALID_STATE, 0}) {
+		t.Fatal("msi packet:", pkt)
+	}
+	msg2, err := parseMSIMessage(pkt[1:])
+	if err != nil || *msg2 != *msg {
+		t.Fatal("parse:", msg2, err)
+	}
+	for _, data := range [][]byte{
+		{},
+		{MSI_ID_REQUEST, 1, MSI_REQU_INIT},                 // not ended
+		{MSI_ID_CAPABILITIES, 1, 4, 0},                     // no request
+		{MSI_ID_REQUEST, 2, MSI_REQU_INIT, 0, 0},           // size
+		{MSI_ID_REQUEST, 1, MSI_REQU_POP + 1, 0},           // request
+		{MSI_ID_REQUEST, 1, MSI_REQU_INIT, 9, 1, 0, 0},     // header id
+		{MSI_ID_REQUEST, 1, MSI_REQU_POP, MSI_ID_ERROR, 1}, // truncated
+	} {
+		if _, err := parseMSIMessage(data); err == nil {
+			t.Error("invalid msi message parsed:", data)
+		}
+	}
+}
+
+func TestMSICall(t *testing.T) {
+	clk := newFakeTstClock()
+	m0, m1, fnum0, fnum1 := newTstFriendPair(t, clk)
+	defer m0.tstKill()
+	defer m1.tstKill()
+	s0, s1 := NewMSISession(m0), NewMSISession(m1)
+	evC := make(chan string, 8)
+	capsC := make(chan uint8, 8)
+	for i, s := range []*MSISession{s0, s1} {
+		name := string('0' + rune(i))
+		s.OnInvite = func(fnum uint32, caps uint8) { evC <- name + "invite"; capsC <- caps }
+		s.OnStart = func(fnum uint32, caps uint8) { evC <- name + "start"; capsC <- caps }
+		s.OnEnd = func(fnum uint32) { evC <- name + "end" }
+		s.OnError = func(fnum uint32, code int) { evC <- name + "error" }
+		s.OnCapabilities = func(fnum uint32, caps uint8) { evC <- name + "caps"; capsC <- caps }
+	}
+	expect := func(ev string, caps int) {
+		t.Helper()
+		select {
+		case got := <-evC:
+			if got != ev {
+				t.Fatal("msi event:", got, ev)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no msi event:", ev)
+		}
+		if caps >= 0 {
+			if got := <-capsC; got != uint8(caps) {
+				t.Error("caps:", ev, got, caps)
+			}
+		}
+	}
+	audio := MSI_CAP_S_AUDIO | MSI_CAP_R_AUDIO
+	video := MSI_CAP_S_VIDEO | MSI_CAP_R_VIDEO
+
+	if err := s0.Invite(fnum0, uint8(audio)); err != nil {
+		t.Fatal(err)
+	}
+	if s0.Invite(fnum0, uint8(audio)) == nil {
+		t.Error("invited twice")
+	}
+	expect("1invite", audio)
+	if s0.CallState(fnum0) != MSI_CALL_REQUESTING || s1.CallState(fnum1) != MSI_CALL_REQUESTED {
+		t.Error("call states:", s0.CallState(fnum0), s1.CallState(fnum1))
+	}
+	if s0.Answer(fnum0, uint8(audio)) == nil {
+		t.Error("own invite answered")
+	}
+	if err := s1.Answer(fnum1, uint8(audio|video)); err != nil {
+		t.Fatal(err)
+	}
+	expect("0start", audio|video)
+	if s0.CallState(fnum0) != MSI_CALL_ACTIVE || s1.CallState(fnum1) != MSI_CALL_ACTIVE {
+		t.Error("call not active:", s0.CallState(fnum0), s1.CallState(fnum1))
+	}
+
+	s0.ChangeCapabilities(fnum0, uint8(audio|video))
+	expect("1caps", audio|video)
+	rateC := make(chan [2]uint32, 1)
+	s0.OnBitRate = func(fnum uint32, audio, video uint32) { rateC <- [2]uint32{audio, video} }
+	s1.SetBitRate(fnum1, 48, 0)
+	select {
+	case rate := <-rateC:
+		if rate != [2]uint32{48, 0} {
+			t.Error("bit rate:", rate)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("bit rate not received")
+	}
+
+	s0.Hangup(fnum0)
+	expect("1end", -1)
+	if s1.CallState(fnum1) != MSI_CALL_INACTIVE || s1.SetBitRate(fnum1, 1, 1) == nil {
+		t.Error("call not ended:", s1.CallState(fnum1))
+	}
+
+	// rejected
+	s1.Invite(fnum1, uint8(video))
+	expect("0invite", video)
+	s0.Hangup(fnum0)
+	expect("1end", -1)
+
+	// push without call is answered by error, ending the call of the other
+	m0.sendFriendPacket(fnum0, (&msiMessage{request: MSI_REQU_INIT, err: -1, capabilities: audio}).bytes())
+	expect("1invite", audio)
+	s1.mu.Lock()
+	s1.calls[fnum1].state = MSI_CALL_ACTIVE
+	s1.mu.Unlock()
+	s1.ChangeCapabilities(fnum1, uint8(video))
+	expect("1error", -1)
+	if s1.CallState(fnum1) != MSI_CALL_INACTIVE {
+		t.Error("call not ended by error")
+	}
+
+	// friend gone
+	timeoutC := make(chan uint32, 1)
+	s1.OnPeerTimeout = func(fnum uint32) { timeoutC <- fnum }
+	s0.Invite(fnum0, uint8(audio))
+	expect("1invite", audio)
+	m0.DelFriend(fnum0)
+	select {
+	case fnum := <-timeoutC:
+		if fnum != fnum1 {
+			t.Error("timeout of:", fnum)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("no peer timeout")
+	}
+	if s0.CallState(fnum0) != MSI_CALL_INACTIVE {
+		t.Error("call of deleted friend")
+	}
+}
@@ -0,0 +1,844 @@
+package mintox
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"gopp"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CRYPTO_CONN_NO_CONNECTION     = 0
+	CRYPTO_CONN_COOKIE_REQUESTING = 1 //send cookie request packets
+	CRYPTO_CONN_HANDSHAKE_SENT    = 2 //send handshake packets
+	CRYPTO_CONN_NOT_CONFIRMED     = 3 //send handshake packets, we have received one from the other
+	CRYPTO_CONN_ESTABLISHED       = 4
+)
+
+/* Maximum size of receiving and sending packet buffers. */
+const CRYPTO_PACKET_BUFFER_SIZE = 32768 /* Must be a power of 2 */
+
+const MAX_CRYPTO_PACKET_SIZE = 1400
+
+const CRYPTO_DATA_PACKET_MIN_SIZE = (1 + 2 + (4 + 4) + MAC_SIZE)
+
+/* Max size of data in packets */
+const MAX_CRYPTO_DATA_SIZE = (MAX_CRYPTO_PACKET_SIZE - CRYPTO_DATA_PACKET_MIN_SIZE)
+
+/* Interval in ms between sending cookie request/handshake packets. */
+const CRYPTO_SEND_PACKET_INTERVAL = 1000
+
+/* The maximum number of times we try to send the cookie request and handshake before giving up. */
+const MAX_NUM_SENDPACKET_TRIES = 8
+
+/* All packets will be padded a number of bytes based on this number. */
+const CRYPTO_MAX_PADDING = 8
+
+/* rtt used before it is measured, in ms */
+const DEFAULT_PING_CONNECTION = 1000
+
+/* half of the 16 bits nonce counter in data packets */
+const DATA_NUM_THRESHOLD = 21845
+
+const PACKET_ID_PADDING = 0 /* Denotes padding */
+const PACKET_ID_REQUEST = 1 /* Used to request unreceived packets */
+const PACKET_ID_KILL = 2    /* Used to kill connection */
+
+/* Packet ids 0 to CRYPTO_RESERVED_PACKETS - 1 are reserved for use by net_crypto. */
+const CRYPTO_RESERVED_PACKETS = 16
+const PACKET_ID_LOSSY_RANGE_START = 192
+const PACKET_ID_LOSSY_RANGE_SIZE = 63
+
+const COOKIE_TIMEOUT = 15 // seconds
+const COOKIE_DATA_LENGTH = (PUBLIC_KEY_SIZE * 2)
+const COOKIE_CONTENTS_LENGTH = (8 + COOKIE_DATA_LENGTH)
+const COOKIE_LENGTH = (NONCE_SIZE + COOKIE_CONTENTS_LENGTH + MAC_SIZE)
+
+const COOKIE_REQUEST_PLAIN_LENGTH = (COOKIE_DATA_LENGTH + 8)
+const COOKIE_REQUEST_LENGTH = (1 + PUBLIC_KEY_SIZE + NONCE_SIZE + COOKIE_REQUEST_PLAIN_LENGTH + MAC_SIZE)
+const COOKIE_RESPONSE_LENGTH = (1 + NONCE_SIZE + COOKIE_LENGTH + 8 + MAC_SIZE)
+
+const HANDSHAKE_PACKET_LENGTH = (1 + COOKIE_LENGTH + NONCE_SIZE + NONCE_SIZE + PUBLIC_KEY_SIZE +
+	SHA512_SIZE + COOKIE_LENGTH + MAC_SIZE)
+
+// sent lossless packet, zero sentAt means requested by peer and to resend
+type cryptoSentPacket struct {
+	data   []byte
+	sentAt time.Time
+}
+
+// packet number window [start, end)
+type cryptoSendArray struct {
+	start uint32
+	end   uint32
+	pkts  map[uint32]*cryptoSentPacket
+}
+
+type cryptoRecvArray struct {
+	start uint32
+	end   uint32
+	pkts  map[uint32][]byte
+}
+
+// like clear_buffer_until, peer received all packets before num
+func (this *cryptoSendArray) clearUntil(num uint32) error {
+	if num-this.start > this.end-this.start {
+		return errors.Errorf("Invalid buffer start: %d, [%d, %d)", num, this.start, this.end)
+	}
+	for ; this.start != num; this.start++ {
+		delete(this.pkts, this.start)
+	}
+	return nil
+}
+
+// like add_data_to_buffer, dup packet is error
+func (this *cryptoRecvArray) add(num uint32, data []byte) error {
+	if num-this.start >= CRYPTO_PACKET_BUFFER_SIZE {
+		return errors.Errorf("Packet number out of window: %d, %d", num, this.start)
+	}
+	if _, ok := this.pkts[num]; ok {
+		return errors.Errorf("Dup packet: %d", num)
+	}
+	this.pkts[num] = data
+	if num-this.start >= this.end-this.start {
+		this.end = num + 1
+	}
+	return nil
+}
+
+// like read_data_beg_buffer, take received packets in order
+func (this *cryptoRecvArray) takeInOrder() (datas [][]byte) {
+	for this.start != this.end {
+		data, ok := this.pkts[this.start]
+		if !ok {
+			break
+		}
+		delete(this.pkts, this.start)
+		datas = append(datas, data)
+		this.start++
+	}
+	return
+}
+
+type CryptoConn struct {
+	ncro      *NetCrypto
+	Pubkey    *CryptoKey // peer real pubkey
+	DhtPubkey *CryptoKey // peer dht pubkey
+	Addr      net.Addr
+	Status    uint8
+
+	sesspk     *CryptoKey // our session keys
+	sesssk     *CryptoKey
+	peersesspk *CryptoKey
+	shrkey     *CryptoKey // session shared key
+	sentNonce  *CBNonce
+	recvNonce  *CBNonce
+	echoid     uint64
+
+	tempPacket []byte // cookie request or handshake, resent until established
+	tempSentAt time.Time
+	tempTries  int
+
+	sendArray cryptoSendArray
+	recvArray cryptoRecvArray
+	rtt       time.Duration
+	cc        cryptoCongestion
+	reqSentAt time.Time // request packet
+
+	OnLossless func(c *CryptoConn, data []byte)
+	OnLossy    func(c *CryptoConn, data []byte)
+	OnStatus   func(c *CryptoConn, status uint8)
+}
+
+// net_crypto over UDP, conn keyed by peer real pubkey and addr.
+type NetCrypto struct {
+	neto       *NetworkCore
+	dhtpk      *CryptoKey
+	dhtsk      *CryptoKey
+	SelfPubkey *CryptoKey
+	SelfSeckey *CryptoKey
+	secsymkey  *CryptoKey // for cookies
+	clock      clock
+
+	// accept new conn from peer, set callbacks of c here. nil rejects all.
+	OnNewConn func(c *CryptoConn) bool
+	// lossless packets per second of c computed each PACKET_COUNTER_AVERAGE_INTERVAL
+	OnSendRate func(c *CryptoConn, rate float64)
+
+	mu    sync.Mutex
+	conns map[string]*CryptoConn // binpk =>
+	addrs map[string]*CryptoConn // addr =>
+	stopC chan bool
+
+	maxSendRate float64 // see SetMaxSendRate
+
+	// replaced in test to drop packets
+	sendto func(pkt []byte, addr net.Addr) error
+}
+
+func NewNetCrypto(dhto *DHT, selfpk, selfsk *CryptoKey) *NetCrypto {
+	return newNetCrypto(dhto.Neto, dhto.SelfPubkey, dhto.SelfSeckey, selfpk, selfsk, defaultClock)
+}
+
+func newNetCrypto(neto *NetworkCore, dhtpk, dhtsk, selfpk, selfsk *CryptoKey, clk clock) *NetCrypto {
+	this := &NetCrypto{}
+	this.neto = neto
+	this.dhtpk, this.dhtsk = dhtpk, dhtsk
+	this.SelfPubkey, this.SelfSeckey = selfpk, selfsk
+	_, this.secsymkey, _ = NewCBKeyPair()
+	this.clock = clk
+	this.conns = map[string]*CryptoConn{}
+	this.addrs = map[string]*CryptoConn{}
+	this.stopC = make(chan bool)
+	this.sendto = func(pkt []byte, addr net.Addr) error {
+		_, err := this.neto.WriteTo(pkt, addr)
+		return err
+	}
+
+	neto.RegisterHandle(NET_PACKET_COOKIE_REQUEST, this.handleCookieRequest, this)
+	neto.RegisterHandle(NET_PACKET_COOKIE_RESPONSE, this.handleCookieResponse, this)
+	neto.RegisterHandle(NET_PACKET_CRYPTO_HS, this.handleHandshake, this)
+	neto.RegisterHandle(NET_PACKET_CRYPTO_DATA, this.handleData, this)
+
+	go this.doNetCryptoLoop()
+	return this
+}
+
+func (this *NetCrypto) Kill() {
+	neto := this.neto
+	neto.RegisterHandle(NET_PACKET_COOKIE_REQUEST, nil, nil)
+	neto.RegisterHandle(NET_PACKET_COOKIE_RESPONSE, nil, nil)
+	neto.RegisterHandle(NET_PACKET_CRYPTO_HS, nil, nil)
+	neto.RegisterHandle(NET_PACKET_CRYPTO_DATA, nil, nil)
+	close(this.stopC)
+}
+
+// like handle_packet_TCP_connection, crypto packet relayed by TCP relay,
+// addr stands for the relayed peer and replies go back by sendto.
+func (this *NetCrypto) handleTCPPacket(addr net.Addr, data []byte) error {
+	if len(data) == 0 {
+		return errors.New("Empty TCP crypto packet")
+	}
+	var err error
+	switch data[0] {
+	case NET_PACKET_COOKIE_REQUEST:
+		_, err = this.handleCookieRequest(this, addr, data, nil)
+	case NET_PACKET_COOKIE_RESPONSE:
+		_, err = this.handleCookieResponse(this, addr, data, nil)
+	case NET_PACKET_CRYPTO_HS:
+		_, err = this.handleHandshake(this, addr, data, nil)
+	case NET_PACKET_CRYPTO_DATA:
+		_, err = this.handleData(this, addr, data, nil)
+	default:
+		err = errors.Errorf("Unknown TCP crypto packet: %d", data[0])
+	}
+	return err
+}
+
+func (this *NetCrypto) doNetCryptoLoop() {
+	tickC, stop := this.clock.Tick(PACKET_COUNTER_AVERAGE_INTERVAL * time.Millisecond)
+	defer stop()
+	for {
+		select {
+		case <-tickC:
+			this.doNetCrypto()
+		case <-this.stopC:
+			return
+		}
+	}
+}
+
+// Connect starts a conn to peer with real pubkey realpk, whose dht pubkey is dhtpk at addr.
+func (this *NetCrypto) Connect(realpk, dhtpk *CryptoKey, addr net.Addr) (*CryptoConn, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.conns[realpk.BinStr()]; ok {
+		return nil, errors.Errorf("Already connected: %s", realpk.ToHex20())
+	}
+	c := this.newConn(realpk, dhtpk, addr)
+	c.Status = CRYPTO_CONN_COOKIE_REQUESTING
+	c.echoid = rand.Uint64()
+
+	plain := make([]byte, COOKIE_REQUEST_PLAIN_LENGTH)
+	copy(plain, this.SelfPubkey.Bytes())
+	binary.BigEndian.PutUint64(plain[COOKIE_DATA_LENGTH:], c.echoid)
+	shrkey, err := CBBeforeNm(dhtpk, this.dhtsk)
+	if err != nil {
+		return nil, err
+	}
+	nonce := CBRandomNonce()
+	encrypted, err := EncryptDataSymmetric(shrkey, nonce, plain)
+	if err != nil {
+		return nil, err
+	}
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(NET_PACKET_COOKIE_REQUEST)
+	buf.Write(this.dhtpk.Bytes())
+	buf.Write(nonce.Bytes())
+	buf.Write(encrypted)
+
+	this.addConn(c)
+	this.sendTempPacket(c, buf.Bytes())
+	return c, nil
+}
+
+func (this *NetCrypto) newConn(realpk, dhtpk *CryptoKey, addr net.Addr) *CryptoConn {
+	c := &CryptoConn{ncro: this}
+	c.Pubkey, c.DhtPubkey, c.Addr = realpk, dhtpk, addr
+	c.sesspk, c.sesssk, _ = NewCBKeyPair()
+	c.sentNonce = CBRandomNonce()
+	c.sendArray.pkts = map[uint32]*cryptoSentPacket{}
+	c.recvArray.pkts = map[uint32][]byte{}
+	c.rtt = DEFAULT_PING_CONNECTION * time.Millisecond
+	return c
+}
+
+// mu held by caller
+func (this *NetCrypto) addConn(c *CryptoConn) {
+	this.conns[c.Pubkey.BinStr()] = c
+	this.addrs[c.Addr.String()] = c
+}
+
+// mu held by caller
+func (this *NetCrypto) removeConn(c *CryptoConn) {
+	if this.conns[c.Pubkey.BinStr()] == c {
+		delete(this.conns, c.Pubkey.BinStr())
+	}
+	if this.addrs[c.Addr.String()] == c {
+		delete(this.addrs, c.Addr.String())
+	}
+	c.Status = CRYPTO_CONN_NO_CONNECTION
+}
+
+func (this *NetCrypto) Conn(realpk *CryptoKey) *CryptoConn {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.conns[realpk.BinStr()]
+}
+
+// mu held by caller
+func (this *NetCrypto) sendTempPacket(c *CryptoConn, pkt []byte) {
+	c.tempPacket = pkt
+	c.tempSentAt = this.clock.Now()
+	c.tempTries = 1
+	err := this.sendto(pkt, c.Addr)
+	gopp.ErrPrint(err, c.Addr)
+}
+
+// cookie: nonce | encrypted(time | realpk | dhtpk) by our symmetric key
+func (this *NetCrypto) createCookie(realpk, dhtpk *CryptoKey) ([]byte, error) {
+	contents := make([]byte, COOKIE_CONTENTS_LENGTH)
+	binary.BigEndian.PutUint64(contents, uint64(this.clock.Now().Unix()))
+	copy(contents[8:], realpk.Bytes())
+	copy(contents[8+PUBLIC_KEY_SIZE:], dhtpk.Bytes())
+	nonce := CBRandomNonce()
+	encrypted, err := EncryptDataSymmetric(this.secsymkey, nonce, contents)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce.Bytes(), encrypted...), nil
+}
+
+func (this *NetCrypto) openCookie(cookie []byte) (realpk, dhtpk *CryptoKey, err error) {
+	if len(cookie) != COOKIE_LENGTH {
+		return nil, nil, errors.Errorf("Invalid cookie length: %d", len(cookie))
+	}
+	nonce := NewCBNonce(append([]byte{}, cookie[:NONCE_SIZE]...))
+	contents, err := DecryptDataSymmetric(this.secsymkey, nonce, cookie[NONCE_SIZE:])
+	if err != nil {
+		return nil, nil, err
+	}
+	cookieTime := int64(binary.BigEndian.Uint64(contents))
+	now := this.clock.Now().Unix()
+	if cookieTime+COOKIE_TIMEOUT < now || now < cookieTime {
+		return nil, nil, errors.Errorf("Cookie timeout: %d, now: %d", cookieTime, now)
+	}
+	realpk = NewCryptoKey(append([]byte{}, contents[8:8+PUBLIC_KEY_SIZE]...))
+	dhtpk = NewCryptoKey(append([]byte{}, contents[8+PUBLIC_KEY_SIZE:]...))
+	return
+}
+
+// like handle_cookie_request, stateless, answer with a cookie
+func (this *NetCrypto) handleCookieRequest(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) != COOKIE_REQUEST_LENGTH {
+		return 1, errors.Errorf("Invalid cookie request length: %d", len(data))
+	}
+	peerdhtpk := NewCryptoKey(append([]byte{}, data[1:1+PUBLIC_KEY_SIZE]...))
+	nonce := NewCBNonce(data[1+PUBLIC_KEY_SIZE : 1+PUBLIC_KEY_SIZE+NONCE_SIZE])
+	shrkey, err := CBBeforeNm(peerdhtpk, this.dhtsk)
+	if err != nil {
+		return 1, err
+	}
+	plain, err := DecryptDataSymmetric(shrkey, nonce, data[1+PUBLIC_KEY_SIZE+NONCE_SIZE:])
+	if err != nil {
+		return 1, err
+	}
+	realpk := NewCryptoKey(append([]byte{}, plain[:PUBLIC_KEY_SIZE]...))
+	cookie, err := this.createCookie(realpk, peerdhtpk)
+	if err != nil {
+		return 1, err
+	}
+	rspnonce := CBRandomNonce()
+	encrypted, err := EncryptDataSymmetric(shrkey, rspnonce, append(cookie, plain[COOKIE_DATA_LENGTH:]...))
+	if err != nil {
+		return 1, err
+	}
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(NET_PACKET_COOKIE_RESPONSE)
+	buf.Write(rspnonce.Bytes())
+	buf.Write(encrypted)
+	return 0, this.sendto(buf.Bytes(), addr)
+}
+
+func (this *NetCrypto) handleCookieResponse(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) != COOKIE_RESPONSE_LENGTH {
+		return 1, errors.Errorf("Invalid cookie response length: %d", len(data))
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	c := this.addrs[addr.String()]
+	if c == nil || c.Status != CRYPTO_CONN_COOKIE_REQUESTING {
+		return 1, errors.Errorf("No cookie requesting conn: %v", addr)
+	}
+	shrkey, err := CBBeforeNm(c.DhtPubkey, this.dhtsk)
+	if err != nil {
+		return 1, err
+	}
+	nonce := NewCBNonce(data[1 : 1+NONCE_SIZE])
+	plain, err := DecryptDataSymmetric(shrkey, nonce, data[1+NONCE_SIZE:])
+	if err != nil {
+		return 1, err
+	}
+	if binary.BigEndian.Uint64(plain[COOKIE_LENGTH:]) != c.echoid {
+		return 1, errors.Errorf("Invalid cookie echo id: %v", addr)
+	}
+	pkt, err := this.createHandshake(c, plain[:COOKIE_LENGTH])
+	if err != nil {
+		return 1, err
+	}
+	c.Status = CRYPTO_CONN_HANDSHAKE_SENT
+	this.sendTempPacket(c, pkt)
+	return 0, nil
+}
+
+// handshake: cookie | nonce | encrypted(base nonce | session pk | sha512(cookie) | cookie for peer)
+func (this *NetCrypto) createHandshake(c *CryptoConn, cookie []byte) ([]byte, error) {
+	othercookie, err := this.createCookie(c.Pubkey, c.DhtPubkey)
+	if err != nil {
+		return nil, err
+	}
+	cookiehash := sha512.Sum512(cookie)
+	plain := gopp.NewBufferZero()
+	plain.Write(c.sentNonce.Bytes())
+	plain.Write(c.sesspk.Bytes())
+	plain.Write(cookiehash[:])
+	plain.Write(othercookie)
+
+	shrkey, err := CBBeforeNm(c.Pubkey, this.SelfSeckey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := CBRandomNonce()
+	encrypted, err := EncryptDataSymmetric(shrkey, nonce, plain.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(NET_PACKET_CRYPTO_HS)
+	buf.Write(cookie)
+	buf.Write(nonce.Bytes())
+	buf.Write(encrypted)
+	return buf.Bytes(), nil
+}
+
+func (this *NetCrypto) handleHandshake(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) != HANDSHAKE_PACKET_LENGTH {
+		return 1, errors.Errorf("Invalid handshake length: %d", len(data))
+	}
+	cookie := data[1 : 1+COOKIE_LENGTH]
+	realpk, dhtpk, err := this.openCookie(cookie)
+	if err != nil {
+		return 1, err
+	}
+	shrkey, err := CBBeforeNm(realpk, this.SelfSeckey)
+	if err != nil {
+		return 1, err
+	}
+	nonce := NewCBNonce(data[1+COOKIE_LENGTH : 1+COOKIE_LENGTH+NONCE_SIZE])
+	plain, err := DecryptDataSymmetric(shrkey, nonce, data[1+COOKIE_LENGTH+NONCE_SIZE:])
+	if err != nil {
+		return 1, err
+	}
+	cookiehash := sha512.Sum512(cookie)
+	if !bytes.Equal(cookiehash[:], plain[NONCE_SIZE+PUBLIC_KEY_SIZE:NONCE_SIZE+PUBLIC_KEY_SIZE+SHA512_SIZE]) {
+		return 1, errors.Errorf("Invalid handshake cookie hash: %v", addr)
+	}
+	peernonce := NewCBNonce(append([]byte{}, plain[:NONCE_SIZE]...))
+	peersesspk := NewCryptoKey(append([]byte{}, plain[NONCE_SIZE:NONCE_SIZE+PUBLIC_KEY_SIZE]...))
+	othercookie := plain[NONCE_SIZE+PUBLIC_KEY_SIZE+SHA512_SIZE:]
+
+	this.mu.Lock()
+	c := this.addrs[addr.String()]
+	if c == nil {
+		c = this.conns[realpk.BinStr()]
+	}
+	isnew := c == nil
+	if isnew {
+		c = this.newConn(realpk, dhtpk, addr)
+		this.mu.Unlock()
+		if this.OnNewConn == nil || !this.OnNewConn(c) {
+			return 1, errors.Errorf("Conn not accepted: %s, %v", realpk.ToHex20(), addr)
+		}
+		this.mu.Lock()
+		if this.conns[realpk.BinStr()] != nil {
+			this.mu.Unlock()
+			return 1, errors.Errorf("Conn added meanwhile: %s", realpk.ToHex20())
+		}
+		this.addConn(c)
+	}
+	defer this.mu.Unlock()
+
+	if !c.Pubkey.Equal(realpk.Bytes()) || !c.DhtPubkey.Equal(dhtpk.Bytes()) {
+		return 1, errors.Errorf("Handshake key mismatch: %s, %v", realpk.ToHex20(), addr)
+	}
+	switch c.Status {
+	case CRYPTO_CONN_NO_CONNECTION, CRYPTO_CONN_COOKIE_REQUESTING,
+		CRYPTO_CONN_HANDSHAKE_SENT, CRYPTO_CONN_NOT_CONFIRMED:
+	default:
+		return 1, errors.Errorf("Handshake on established conn: %v", addr)
+	}
+	c.recvNonce = peernonce
+	c.peersesspk = peersesspk
+	c.shrkey, err = CBBeforeNm(c.peersesspk, c.sesssk)
+	if err != nil {
+		return 1, err
+	}
+	if c.Addr.String() != addr.String() {
+		delete(this.addrs, c.Addr.String())
+		c.Addr = addr
+		this.addrs[addr.String()] = c
+	}
+	// the initiator already sent its handshake
+	if c.Status != CRYPTO_CONN_HANDSHAKE_SENT && c.Status != CRYPTO_CONN_NOT_CONFIRMED {
+		pkt, err := this.createHandshake(c, othercookie)
+		if err != nil {
+			return 1, err
+		}
+		this.sendTempPacket(c, pkt)
+	}
+	c.Status = CRYPTO_CONN_NOT_CONFIRMED
+	// any data confirms the conn to peer
+	this.sendRequestPacket(c)
+	return 0, nil
+}
+
+// like increment_nonce_number, add num to big endian nonce
+func incrementNonceNumber(nonce []byte, num uint32) {
+	carry := uint32(0)
+	for i := len(nonce) - 1; i >= 0 && (num != 0 || carry != 0); i-- {
+		sum := uint32(nonce[i]) + num&0xff + carry
+		nonce[i] = byte(sum)
+		carry = sum >> 8
+		num >>= 8
+	}
+}
+
+// data packet: 0x1b | last 2 bytes of nonce | encrypted(buffer start | num | padding | data)
+// mu held by caller
+func (this *NetCrypto) sendDataPacket(c *CryptoConn, num uint32, data []byte) error {
+	padding := (MAX_CRYPTO_DATA_SIZE - len(data)) % CRYPTO_MAX_PADDING
+	plain := make([]byte, 8+padding+len(data))
+	binary.BigEndian.PutUint32(plain, c.recvArray.start)
+	binary.BigEndian.PutUint32(plain[4:], num)
+	copy(plain[8+padding:], data)
+
+	encrypted, err := EncryptDataSymmetric(c.shrkey, c.sentNonce, plain)
+	if err != nil {
+		return err
+	}
+	pkt := make([]byte, 0, 1+2+len(encrypted))
+	pkt = append(pkt, NET_PACKET_CRYPTO_DATA)
+	pkt = append(pkt, c.sentNonce.Bytes()[NONCE_SIZE-2:]...)
+	pkt = append(pkt, encrypted...)
+	incrementNonceNumber(c.sentNonce.Bytes(), 1)
+	return this.sendto(pkt, c.Addr)
+}
+
+// SendLossless sends data in order and reliably, data[0] is the packet id
+// in [CRYPTO_RESERVED_PACKETS, PACKET_ID_LOSSY_RANGE_START). Returns packet number.
+// Over the send rate it is queued, sent later.
+func (this *CryptoConn) SendLossless(data []byte) (uint32, error) {
+	if len(data) == 0 || len(data) > MAX_CRYPTO_DATA_SIZE {
+		return 0, errors.Errorf("Invalid data length: %d", len(data))
+	}
+	if data[0] < CRYPTO_RESERVED_PACKETS || data[0] >= PACKET_ID_LOSSY_RANGE_START {
+		return 0, errors.Errorf("Not lossless packet id: %d", data[0])
+	}
+	ncro := this.ncro
+	ncro.mu.Lock()
+	defer ncro.mu.Unlock()
+	if this.Status != CRYPTO_CONN_ESTABLISHED {
+		return 0, errors.Errorf("Conn not established: %d", this.Status)
+	}
+	if this.sendArray.end-this.sendArray.start >= CRYPTO_PACKET_BUFFER_SIZE {
+		return 0, errors.New("Send buffer is full")
+	}
+	num := this.sendArray.end
+	pkt := &cryptoSentPacket{data: append([]byte{}, data...)}
+	this.sendArray.pkts[num] = pkt
+	this.sendArray.end++
+	if this.cc.left == 0 {
+		return num, nil
+	}
+	if err := ncro.sendDataPacket(this, num, data); err != nil {
+		gopp.ErrPrint(err, num, this.Addr) // kept, resent as requested
+		return num, nil
+	}
+	pkt.sentAt = ncro.clock.Now()
+	this.cc.onSent()
+	return num, nil
+}
+
+// SendLossy sends data without numbering, data[0] in lossy packet id range.
+func (this *CryptoConn) SendLossy(data []byte) error {
+	if len(data) == 0 || len(data) > MAX_CRYPTO_DATA_SIZE {
+		return errors.Errorf("Invalid data length: %d", len(data))
+	}
+	if data[0] < PACKET_ID_LOSSY_RANGE_START || data[0] >= PACKET_ID_LOSSY_RANGE_START+PACKET_ID_LOSSY_RANGE_SIZE {
+		return errors.Errorf("Not lossy packet id: %d", data[0])
+	}
+	ncro := this.ncro
+	ncro.mu.Lock()
+	defer ncro.mu.Unlock()
+	if this.Status != CRYPTO_CONN_ESTABLISHED {
+		return errors.Errorf("Conn not established: %d", this.Status)
+	}
+	return ncro.sendDataPacket(this, this.sendArray.end, data)
+}
+
+// Close sends kill packet to peer and removes the conn.
+func (this *CryptoConn) Close() error {
+	ncro := this.ncro
+	ncro.mu.Lock()
+	var err error
+	if this.Status == CRYPTO_CONN_ESTABLISHED {
+		err = ncro.sendDataPacket(this, this.sendArray.end, []byte{PACKET_ID_KILL})
+	}
+	ncro.removeConn(this)
+	ncro.mu.Unlock()
+	return err
+}
+
+// like cryptpacket_received, peer got packet num returned by SendLossless.
+func (this *CryptoConn) PacketReceived(num uint32) bool {
+	ncro := this.ncro
+	ncro.mu.Lock()
+	defer ncro.mu.Unlock()
+	return num-this.sendArray.start >= this.sendArray.end-this.sendArray.start
+}
+
+// SendQueueLen is number of lossless packets not yet received by peer.
+func (this *CryptoConn) SendQueueLen() uint32 {
+	ncro := this.ncro
+	ncro.mu.Lock()
+	defer ncro.mu.Unlock()
+	return this.sendArray.end - this.sendArray.start
+}
+
+// like generate_request_packet, list missing packet numbers as deltas, 0 means 255 skipped.
+// mu held by caller
+func (this *CryptoConn) requestPacket() []byte {
+	data := []byte{PACKET_ID_REQUEST}
+	n := uint32(1)
+	for i := this.recvArray.start; i != this.recvArray.end; i++ {
+		if len(data) >= MAX_CRYPTO_DATA_SIZE {
+			break
+		}
+		if _, ok := this.recvArray.pkts[i]; !ok {
+			data = append(data, byte(n))
+			n = 0
+		} else if n == 255 {
+			data = append(data, 0)
+			n = 0
+		}
+		n++
+	}
+	return data
+}
+
+// mu held by caller
+func (this *NetCrypto) sendRequestPacket(c *CryptoConn) {
+	err := this.sendDataPacket(c, c.sendArray.end, c.requestPacket())
+	gopp.ErrPrint(err, c.Addr)
+}
+
+// like handle_request_packet, mark requested packets to resend, free others before them.
+// mu held by caller
+func (this *CryptoConn) handleRequestPacket(data []byte) error {
+	data = data[1:]
+	now := this.ncro.clock.Now()
+	n := uint32(1)
+	for i := this.sendArray.start; i != this.sendArray.end; i++ {
+		if len(data) == 0 {
+			break
+		}
+		if n == uint32(data[0]) {
+			if pkt, ok := this.sendArray.pkts[i]; ok && pkt.sentAt.Add(this.rtt).Before(now) {
+				pkt.sentAt = time.Time{}
+			}
+			data = data[1:]
+			n = 0
+		} else {
+			delete(this.sendArray.pkts, i)
+		}
+		if n == 255 {
+			n = 1
+			if len(data) == 0 || data[0] != 0 {
+				return errors.New("Invalid request packet")
+			}
+			data = data[1:]
+		} else {
+			n++
+		}
+	}
+	return nil
+}
+
+func (this *NetCrypto) handleData(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) <= CRYPTO_DATA_PACKET_MIN_SIZE || len(data) > MAX_CRYPTO_PACKET_SIZE {
+		return 1, errors.Errorf("Invalid data packet length: %d", len(data))
+	}
+	var cbs []func()
+	defer func() {
+		for _, cb := range cbs {
+			cb()
+		}
+	}()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	c := this.addrs[addr.String()]
+	if c == nil || (c.Status != CRYPTO_CONN_NOT_CONFIRMED && c.Status != CRYPTO_CONN_ESTABLISHED) {
+		return 1, errors.Errorf("No conn for data: %v", addr)
+	}
+
+	num := binary.BigEndian.Uint16(data[1:3])
+	curnum := binary.BigEndian.Uint16(c.recvNonce.Bytes()[NONCE_SIZE-2:])
+	diff := num - curnum
+	nonce := NewCBNonce(append([]byte{}, c.recvNonce.Bytes()...))
+	incrementNonceNumber(nonce.Bytes(), uint32(diff))
+	plain, err := DecryptDataSymmetric(c.shrkey, nonce, data[3:])
+	if err != nil {
+		return 1, err
+	}
+	if diff > DATA_NUM_THRESHOLD*2 {
+		incrementNonceNumber(c.recvNonce.Bytes(), DATA_NUM_THRESHOLD)
+	}
+
+	bufstart := binary.BigEndian.Uint32(plain)
+	pktnum := binary.BigEndian.Uint32(plain[4:])
+	if err := c.sendArray.clearUntil(bufstart); err != nil {
+		return 1, err
+	}
+	realdata := bytes.TrimLeft(plain[8:], string([]byte{PACKET_ID_PADDING}))
+	if len(realdata) == 0 {
+		return 1, errors.New("Empty data packet")
+	}
+
+	if c.Status == CRYPTO_CONN_NOT_CONFIRMED {
+		c.Status = CRYPTO_CONN_ESTABLISHED
+		c.tempPacket = nil
+		c.cc.init(this.clock.Now(), this.maxSendRate)
+		c.reqSentAt = this.clock.Now()
+		this.sendRequestPacket(c)
+		if fn := c.OnStatus; fn != nil {
+			cbs = append(cbs, func() { fn(c, CRYPTO_CONN_ESTABLISHED) })
+		}
+	}
+
+	switch ptype := realdata[0]; {
+	case ptype == PACKET_ID_REQUEST:
+		if err := c.handleRequestPacket(realdata); err != nil {
+			return 1, err
+		}
+		this.sendQueued(c, this.clock.Now())
+	case ptype == PACKET_ID_KILL:
+		this.removeConn(c)
+		if fn := c.OnStatus; fn != nil {
+			cbs = append(cbs, func() { fn(c, CRYPTO_CONN_NO_CONNECTION) })
+		}
+	case ptype >= CRYPTO_RESERVED_PACKETS && ptype < PACKET_ID_LOSSY_RANGE_START:
+		if err := c.recvArray.add(pktnum, append([]byte{}, realdata...)); err != nil {
+			return 0, nil // dup, already delivered or buffered
+		}
+		for _, dat := range c.recvArray.takeInOrder() {
+			dat := dat
+			if fn := c.OnLossless; fn != nil {
+				cbs = append(cbs, func() { fn(c, dat) })
+			}
+		}
+	case ptype >= PACKET_ID_LOSSY_RANGE_START && ptype < PACKET_ID_LOSSY_RANGE_START+PACKET_ID_LOSSY_RANGE_SIZE:
+		if fn := c.OnLossy; fn != nil {
+			dat := append([]byte{}, realdata...)
+			cbs = append(cbs, func() { fn(c, dat) })
+		}
+	default:
+		log.Println("Unknown crypto data packet:", ptype, addr)
+	}
+	return 0, nil
+}
+
+// like do_net_crypto, resend cookie request/handshake until established,
+// give up after MAX_NUM_SENDPACKET_TRIES, request missing packets and send
+// queued ones by the send rate.
+func (this *NetCrypto) doNetCrypto() {
+	var cbs []func()
+	now := this.clock.Now()
+	this.mu.Lock()
+	for _, c := range this.conns {
+		switch c.Status {
+		case CRYPTO_CONN_COOKIE_REQUESTING, CRYPTO_CONN_HANDSHAKE_SENT, CRYPTO_CONN_NOT_CONFIRMED:
+			if now.Sub(c.tempSentAt) < CRYPTO_SEND_PACKET_INTERVAL*time.Millisecond {
+				break
+			}
+			if c.tempTries >= MAX_NUM_SENDPACKET_TRIES {
+				log.Println("Crypto conn timeout:", c.Status, c.Addr)
+				this.removeConn(c)
+				if fn := c.OnStatus; fn != nil {
+					c := c
+					cbs = append(cbs, func() { fn(c, CRYPTO_CONN_NO_CONNECTION) })
+				}
+				break
+			}
+			c.tempSentAt = now
+			c.tempTries++
+			err := this.sendto(c.tempPacket, c.Addr)
+			gopp.ErrPrint(err, c.Addr)
+			if c.Status == CRYPTO_CONN_NOT_CONFIRMED {
+				this.sendRequestPacket(c)
+			}
+		case CRYPTO_CONN_ESTABLISHED:
+			if now.Sub(c.reqSentAt) >= CRYPTO_SEND_PACKET_INTERVAL*time.Millisecond {
+				c.reqSentAt = now
+				this.sendRequestPacket(c)
+			}
+			if c.cc.update(now, c.sendArray.end-c.sendArray.start, c.rtt) {
+				if fn := this.OnSendRate; fn != nil {
+					c, rate := c, c.cc.sendRate
+					cbs = append(cbs, func() { fn(c, rate) })
+				}
+			}
+			this.sendQueued(c, now)
+		}
+	}
+	this.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
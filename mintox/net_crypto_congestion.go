@@ -0,0 +1,215 @@
+package mintox
+
+import (
+	"time"
+)
+
+// Congestion control of lossless packets, like send_crypto_packets. The send
+// rate follows packets sent and resent over the last intervals, cut when the
+// send queue grows. Packets over the rate wait in the send array, sent with
+// requested ones as the rate allows.
+
+/* Interval in ms the send rate is computed in. */
+const PACKET_COUNTER_AVERAGE_INTERVAL = 50
+
+const CONGESTION_QUEUE_ARRAY_SIZE = 12
+const CONGESTION_LAST_SENT_ARRAY_SIZE = (CONGESTION_QUEUE_ARRAY_SIZE * 2)
+
+/* Rate not raised for this many ms after packets left ran out. */
+const CONGESTION_EVENT_TIMEOUT = 1000
+
+/* Minimum packets per second. */
+const CRYPTO_PACKET_MIN_RATE = 4.0
+
+/* Packets that can be sent at once without regard to the rate. */
+const CRYPTO_MIN_QUEUE_LENGTH = 64
+
+/* Send queue over this many seconds of the rate slows sending. */
+const SEND_QUEUE_RATIO = 2.0
+
+// like the congestion fields of Crypto_Connection
+type cryptoCongestion struct {
+	sendRate          float64 // packets per second
+	sendRateRequested float64 // of sent and resent ones
+	maxRate           float64 // by SetMaxSendRate, 0 no limit
+
+	left, leftRequested       uint32 // packets may send now
+	leftRem, leftRequestedRem float64
+	leftSetAt                 time.Time
+	leftRequestedSetAt        time.Time
+
+	sent, resent uint32 // in current interval
+	counterSetAt time.Time
+	queueSizes   [CONGESTION_QUEUE_ARRAY_SIZE]uint32
+	lastSent     [CONGESTION_LAST_SENT_ARRAY_SIZE]uint32
+	lastResent   [CONGESTION_LAST_SENT_ARRAY_SIZE]uint32
+	counter      uint32
+	congestionAt time.Time // packets left ran out
+}
+
+func (this *cryptoCongestion) init(now time.Time, maxRate float64) {
+	this.sendRate, this.sendRateRequested = CRYPTO_PACKET_MIN_RATE, CRYPTO_PACKET_MIN_RATE
+	this.maxRate = maxRate
+	this.left, this.leftRequested = CRYPTO_MIN_QUEUE_LENGTH, CRYPTO_MIN_QUEUE_LENGTH
+	this.leftSetAt, this.leftRequestedSetAt = now, now
+	this.counterSetAt = now
+}
+
+// like the rate part of send_crypto_packets, once each interval, returns
+// if computed. npackets is the send queue length.
+func (this *cryptoCongestion) update(now time.Time, npackets uint32, rtt time.Duration) bool {
+	interval := PACKET_COUNTER_AVERAGE_INTERVAL * time.Millisecond
+	if now.Sub(this.counterSetAt) <= interval {
+		return false
+	}
+	this.counterSetAt = now
+	sent, resent := this.sent, this.resent
+	this.sent, this.resent = 0, 0
+
+	pos := this.counter % CONGESTION_QUEUE_ARRAY_SIZE
+	this.queueSizes[pos] = npackets
+	// queue grown over the last intervals
+	sum := int64(npackets) - int64(this.queueSizes[(pos+1)%CONGESTION_QUEUE_ARRAY_SIZE])
+	npos := this.counter % CONGESTION_LAST_SENT_ARRAY_SIZE
+	this.lastSent[npos], this.lastResent[npos] = sent, resent
+	this.counter = (this.counter + 1) % (CONGESTION_QUEUE_ARRAY_SIZE * CONGESTION_LAST_SENT_ARRAY_SIZE)
+
+	delay := uint32((rtt + interval/2) / interval)
+	remArray := uint32(CONGESTION_LAST_SENT_ARRAY_SIZE - CONGESTION_QUEUE_ARRAY_SIZE)
+	if delay > remArray {
+		delay = remArray
+	}
+	var totalSent, totalResent int64
+	for j := uint32(0); j < CONGESTION_QUEUE_ARRAY_SIZE; j++ {
+		i := (j + remArray - delay + npos) % CONGESTION_LAST_SENT_ARRAY_SIZE
+		totalSent += int64(this.lastSent[i])
+		totalResent += int64(this.lastResent[i])
+	}
+	if sum > 0 {
+		totalSent -= sum
+	} else if totalResent > -sum {
+		totalResent = -sum
+	}
+
+	window := float64(CONGESTION_QUEUE_ARRAY_SIZE*PACKET_COUNTER_AVERAGE_INTERVAL) / 1000
+	minSpeed := float64(totalSent) / window
+	minSpeedRequest := float64(totalSent+totalResent) / window
+	if minSpeed < CRYPTO_PACKET_MIN_RATE {
+		minSpeed = CRYPTO_PACKET_MIN_RATE
+	}
+	ratio := float64(npackets) / minSpeed
+	switch {
+	case ratio > SEND_QUEUE_RATIO && npackets > CRYPTO_MIN_QUEUE_LENGTH:
+		this.sendRate = minSpeed * SEND_QUEUE_RATIO / ratio
+	case now.Sub(this.congestionAt) > CONGESTION_EVENT_TIMEOUT*time.Millisecond:
+		this.sendRate = minSpeed * 1.2
+	default:
+		this.sendRate = minSpeed * 0.9
+	}
+	this.sendRateRequested = minSpeedRequest * 1.2
+	if this.sendRate < CRYPTO_PACKET_MIN_RATE {
+		this.sendRate = CRYPTO_PACKET_MIN_RATE
+	}
+	if this.maxRate > 0 && this.sendRate > this.maxRate {
+		this.sendRate = this.maxRate
+	}
+	if this.sendRateRequested < this.sendRate {
+		this.sendRateRequested = this.sendRate
+	}
+	if this.maxRate > 0 && this.sendRateRequested > this.maxRate {
+		this.sendRateRequested = this.maxRate
+	}
+	return true
+}
+
+// add packets allowed by rate since last set, at most 4 times them over
+// CRYPTO_MIN_QUEUE_LENGTH kept
+func refillPacketsLeft(left *uint32, rem *float64, setAt *time.Time, rate float64, now time.Time) {
+	if now.Sub(*setAt) < time.Duration(float64(time.Second)/rate+0.5) {
+		return
+	}
+	n := rate*now.Sub(*setAt).Seconds() + *rem
+	num := uint32(n)
+	if *left > num*4+CRYPTO_MIN_QUEUE_LENGTH {
+		*left = num*4 + CRYPTO_MIN_QUEUE_LENGTH
+	} else {
+		*left += num
+	}
+	*setAt, *rem = now, n-float64(num)
+}
+
+// packet sent by SendLossless
+func (this *cryptoCongestion) onSent() {
+	this.sent++
+	if this.left > 0 {
+		this.left--
+	}
+	if this.leftRequested > 0 {
+		this.leftRequested--
+	}
+}
+
+// like the send part of send_crypto_packets, queued and requested packets
+// as the rate allows. mu held by caller
+func (this *NetCrypto) sendQueued(c *CryptoConn, now time.Time) {
+	cc := &c.cc
+	refillPacketsLeft(&cc.left, &cc.leftRem, &cc.leftSetAt, cc.sendRate, now)
+	refillPacketsLeft(&cc.leftRequested, &cc.leftRequestedRem, &cc.leftRequestedSetAt, cc.sendRateRequested, now)
+	n := this.sendRequested(c, cc.leftRequested, now)
+	cc.leftRequested -= n
+	cc.resent += n
+	if n < cc.left {
+		cc.left -= n
+	} else {
+		cc.congestionAt = now
+		cc.left = 0
+	}
+}
+
+// like send_requested_packets, packets not sent or requested, at most max.
+// mu held by caller
+func (this *NetCrypto) sendRequested(c *CryptoConn, max uint32, now time.Time) (n uint32) {
+	for num := c.sendArray.start; num != c.sendArray.end && n < max; num++ {
+		pkt, ok := c.sendArray.pkts[num]
+		if !ok || !pkt.sentAt.IsZero() {
+			continue
+		}
+		if err := this.sendDataPacket(c, num, pkt.data); err != nil {
+			break
+		}
+		pkt.sentAt = now
+		n++
+	}
+	return
+}
+
+// SetMaxSendRate limits lossless packets per second of each conn, 0 for no limit
+func (this *NetCrypto) SetMaxSendRate(rate float64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.maxSendRate = rate
+	for _, c := range this.conns {
+		c.cc.maxRate = rate
+	}
+}
+
+// SendRate is lossless packets per second the conn sends at now
+func (this *CryptoConn) SendRate() float64 {
+	ncro := this.ncro
+	ncro.mu.Lock()
+	defer ncro.mu.Unlock()
+	return this.cc.sendRate
+}
+
+// like crypto_num_free_sendqueue_slots, lossless packets can be sent now
+// without waiting for the rate
+func (this *CryptoConn) FreeSendSlots() uint32 {
+	ncro := this.ncro
+	ncro.mu.Lock()
+	defer ncro.mu.Unlock()
+	free := CRYPTO_PACKET_BUFFER_SIZE - (this.sendArray.end - this.sendArray.start)
+	if this.cc.left < free {
+		return this.cc.left
+	}
+	return free
+}
@@ -0,0 +1,155 @@
+package mintox
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCryptoCongestionRate(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cc := &cryptoCongestion{}
+	cc.init(now, 0)
+	if cc.sendRate != CRYPTO_PACKET_MIN_RATE || cc.left != CRYPTO_MIN_QUEUE_LENGTH {
+		t.Fatal("init:", cc.sendRate, cc.left)
+	}
+	step := func(sent, npackets uint32) {
+		now = now.Add(PACKET_COUNTER_AVERAGE_INTERVAL*time.Millisecond + time.Millisecond)
+		cc.sent = sent
+		if !cc.update(now, npackets, time.Second) {
+			t.Fatal("rate not updated")
+		}
+	}
+	// 100 packets each interval, queue steady
+	for i := 0; i < CONGESTION_LAST_SENT_ARRAY_SIZE; i++ {
+		step(100, 10)
+	}
+	steady := 100 * 1000 / PACKET_COUNTER_AVERAGE_INTERVAL * 1.2
+	if math.Abs(cc.sendRate-steady) > 1 {
+		t.Fatal("steady rate:", cc.sendRate, steady)
+	}
+	if cc.update(now, 10, time.Second) {
+		t.Error("updated within interval")
+	}
+	// queue growing, cut
+	for i := uint32(1); i <= CONGESTION_QUEUE_ARRAY_SIZE; i++ {
+		step(100, 10+i*1000)
+	}
+	if cc.sendRate >= steady/2 {
+		t.Error("rate not cut by queue growth:", cc.sendRate)
+	}
+	cc.maxRate = 50
+	step(100, 10)
+	if cc.sendRate != 50 || cc.sendRateRequested != 50 {
+		t.Error("max rate:", cc.sendRate, cc.sendRateRequested)
+	}
+	cc.maxRate = 0
+	for i := 0; i < CONGESTION_LAST_SENT_ARRAY_SIZE; i++ {
+		step(0, 0)
+	}
+	if cc.sendRate != CRYPTO_PACKET_MIN_RATE*1.2 {
+		t.Error("idle rate:", cc.sendRate)
+	}
+
+	left, rem, setAt := uint32(0), 0.0, now
+	refillPacketsLeft(&left, &rem, &setAt, 100, now.Add(time.Millisecond))
+	if left != 0 {
+		t.Error("refilled before a packet of rate:", left)
+	}
+	refillPacketsLeft(&left, &rem, &setAt, 100, now.Add(1005*time.Millisecond))
+	if left != 100 || math.Abs(rem-0.5) > 1e-6 || !setAt.Equal(now.Add(1005*time.Millisecond)) {
+		t.Error("refill:", left, rem)
+	}
+	left = 1000
+	refillPacketsLeft(&left, &rem, &setAt, 10, setAt.Add(time.Second))
+	if left != 10*4+CRYPTO_MIN_QUEUE_LENGTH {
+		t.Error("left not capped:", left)
+	}
+}
+
+// packets over the rate queued and sent later in order
+func TestNetCryptoSendRate(t *testing.T) {
+	clk := newFakeTstClock()
+	nc0, nc1 := newTstNetCrypto(clk), newTstNetCrypto(clk)
+	defer nc0.neto.srv.Close()
+	defer nc1.neto.srv.Close()
+	defer nc0.Kill()
+	defer nc1.Kill()
+
+	var mu sync.Mutex
+	var recvs []byte
+	nc1.OnNewConn = func(c *CryptoConn) bool {
+		c.OnLossless = func(c *CryptoConn, data []byte) {
+			mu.Lock()
+			recvs = append(recvs, data[1])
+			mu.Unlock()
+		}
+		return true
+	}
+	recvn := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(recvs)
+	}
+	rateC := make(chan float64, 64)
+	nc0.OnSendRate = func(c *CryptoConn, rate float64) {
+		select {
+		case rateC <- rate:
+		default:
+		}
+	}
+	nc0.SetMaxSendRate(10)
+
+	c0, err := nc0.Connect(nc1.SelfPubkey, nc1.dhtpk, nc1.tstAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return nc0.tstStatus(nc1.SelfPubkey) == CRYPTO_CONN_ESTABLISHED }) {
+		t.Fatal("not established")
+	}
+	n := CRYPTO_MIN_QUEUE_LENGTH + 30
+	for i := 0; i < n; i++ {
+		if _, err := c0.SendLossless([]byte{PACKET_ID_LOSSLESS_RANGE_START, byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c0.FreeSendSlots() != 0 {
+		t.Error("free slots over rate:", c0.FreeSendSlots())
+	}
+	if !waitTstCond(3*time.Second, func() bool { return recvn() == CRYPTO_MIN_QUEUE_LENGTH }) {
+		t.Fatal("first packets not received:", recvn())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if recvn() != CRYPTO_MIN_QUEUE_LENGTH {
+		t.Fatal("sent over rate:", recvn())
+	}
+
+	// each second at most max rate more
+	for i := 0; i < 20 && recvn() < n; i++ {
+		last := recvn()
+		clk.Advance(time.Second)
+		select {
+		case rate := <-rateC:
+			if rate > 10 {
+				t.Fatal("rate over max:", rate)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("rate not reported")
+		}
+		waitTstCond(300*time.Millisecond, func() bool { return recvn() > last })
+		if recvn()-last > 10 {
+			t.Fatal("sent over max rate:", recvn()-last)
+		}
+	}
+	if recvn() != n {
+		t.Fatal("queued packets not all sent:", recvn())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, b := range recvs {
+		if b != byte(i) {
+			t.Fatal("out of order:", i, b)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package mintox
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTstNetCrypto(clk clock) *NetCrypto {
+	neto := NewNetworkCore()
+	dhtpk, dhtsk, _ := NewCBKeyPair()
+	pk, sk, _ := NewCBKeyPair()
+	return newNetCrypto(neto, dhtpk, dhtsk, pk, sk, clk)
+}
+
+func (this *NetCrypto) tstAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: this.neto.srv.LocalAddr().(*net.UDPAddr).Port}
+}
+
+func (this *NetCrypto) tstStatus(realpk *CryptoKey) uint8 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if c, ok := this.conns[realpk.BinStr()]; ok {
+		return c.Status
+	}
+	return CRYPTO_CONN_NO_CONNECTION
+}
+
+func TestNetCryptoLossless(t *testing.T) {
+	clk := newFakeTstClock()
+	nc0, nc1 := newTstNetCrypto(clk), newTstNetCrypto(clk)
+	defer nc0.neto.srv.Close()
+	defer nc1.neto.srv.Close()
+	defer nc0.Kill()
+	defer nc1.Kill()
+
+	var mu sync.Mutex
+	var recvs [][]byte
+	nc1.OnNewConn = func(c *CryptoConn) bool {
+		c.OnLossless = func(c *CryptoConn, data []byte) {
+			mu.Lock()
+			recvs = append(recvs, data)
+			mu.Unlock()
+		}
+		return c.Pubkey.Equal(nc0.SelfPubkey.Bytes())
+	}
+	dropn := 0
+	sendto := nc0.sendto
+	nc0.sendto = func(pkt []byte, addr net.Addr) error {
+		if pkt[0] == NET_PACKET_CRYPTO_DATA && dropn > 0 {
+			dropn--
+			return nil
+		}
+		return sendto(pkt, addr)
+	}
+
+	c0, err := nc0.Connect(nc1.SelfPubkey, nc1.dhtpk, nc1.tstAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := waitTstCond(3*time.Second, func() bool {
+		return nc0.tstStatus(nc1.SelfPubkey) == CRYPTO_CONN_ESTABLISHED &&
+			nc1.tstStatus(nc0.SelfPubkey) == CRYPTO_CONN_ESTABLISHED
+	})
+	if !ok {
+		t.Fatal("not established:", nc0.tstStatus(nc1.SelfPubkey), nc1.tstStatus(nc0.SelfPubkey))
+	}
+	if _, err := c0.SendLossless([]byte{PACKET_ID_KILL}); err == nil {
+		t.Error("reserved id sent as lossless")
+	}
+
+	// the second one lost, the third one held until it is resent
+	for i := 0; i < 3; i++ {
+		nc0.mu.Lock()
+		dropn = ifElseTstInt(i == 1, 1, 0)
+		nc0.mu.Unlock()
+		if _, err := c0.SendLossless([]byte{PACKET_ID_LOSSLESS_RANGE_START, byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recvn := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(recvs)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return recvn() == 1 }) {
+		t.Fatal("first packet not received:", recvn())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if recvn() != 1 {
+		t.Fatal("received out of order:", recvn())
+	}
+	clk.Advance(CRYPTO_SEND_PACKET_INTERVAL*time.Millisecond + DEFAULT_PING_CONNECTION*time.Millisecond)
+	if !waitTstCond(3*time.Second, func() bool { return recvn() == 3 }) {
+		t.Fatal("lost packet not resent:", recvn())
+	}
+	for i, data := range recvs {
+		if !bytes.Equal(data, []byte{PACKET_ID_LOSSLESS_RANGE_START, byte(i)}) {
+			t.Error("invalid data:", i, data)
+		}
+	}
+
+	c0.Close()
+	if !waitTstCond(3*time.Second, func() bool { return nc1.tstStatus(nc0.SelfPubkey) == CRYPTO_CONN_NO_CONNECTION }) {
+		t.Error("kill packet not handled")
+	}
+}
+
+func ifElseTstInt(c bool, a, b int) int {
+	if c {
+		return a
+	}
+	return b
+}
+
+func TestNetCryptoRequestPacket(t *testing.T) {
+	recvc := &CryptoConn{}
+	recvc.recvArray.pkts = map[uint32][]byte{}
+	missing := map[uint32]bool{1: true, 5: true, 290: true}
+	for i := uint32(0); i < 300; i++ {
+		if !missing[i] {
+			recvc.recvArray.add(i, []byte{PACKET_ID_LOSSLESS_RANGE_START})
+		}
+	}
+	if n := len(recvc.recvArray.takeInOrder()); n != 1 {
+		t.Fatal("in order:", n)
+	}
+
+	clk := newFakeTstClock()
+	sendc := &CryptoConn{ncro: &NetCrypto{clock: clk}, rtt: time.Second}
+	sendc.sendArray.pkts = map[uint32]*cryptoSentPacket{}
+	sendc.sendArray.start, sendc.sendArray.end = 1, 300
+	for i := uint32(1); i < 300; i++ {
+		sendc.sendArray.pkts[i] = &cryptoSentPacket{sentAt: clk.Now()}
+	}
+	clk.Advance(2 * time.Second)
+	if err := sendc.handleRequestPacket(recvc.requestPacket()); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i < 300; i++ {
+		pkt, ok := sendc.sendArray.pkts[i]
+		switch {
+		case missing[i]:
+			if !ok || !pkt.sentAt.IsZero() {
+				t.Error("missing packet not marked:", i)
+			}
+		case i < 290:
+			if ok {
+				t.Error("received packet not freed:", i)
+			}
+		default:
+			if !ok || pkt.sentAt.IsZero() {
+				t.Error("packet after last request changed:", i)
+			}
+		}
+	}
+}
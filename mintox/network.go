@@ -4,6 +4,10 @@ import (
 	"gopp"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
 )
 
 const SIZE_IP4 = 4
@@ -118,15 +122,22 @@ type PacketHandle struct {
 type NetworkCore struct {
 	srv *net.UDPConn
 
-	PacketHandlers map[uint8]PacketHandle
+	handlermu      sync.RWMutex
+	PacketHandlers map[uint8]PacketHandle // handlermu
+
+	sendq       chan netSendItem // see SendQueued
+	SendDropped int64            // atomic, queued sends dropped for queue full
+	stopC       chan struct{}
+	closeOnce   sync.Once
+
+	bsinfo bootstrapInfoHolder
+
+	OnionAmplifyDropped int64 // atomic, onion responses dropped by amplification limit
 
-	bsinfo BootstrapInfo
+	udpoff int32 // atomic, 1 when UDP disabled, like udp_enabled=false of c
 }
 
 func NewNetworkCore() *NetworkCore {
-	this := &NetworkCore{}
-	this.PacketHandlers = make(map[uint8]PacketHandle, 256)
-
 	laddr := &net.UDPAddr{}
 	laddr.IP = net.ParseIP("0.0.0.0")
 	var srv *net.UDPConn
@@ -140,17 +151,57 @@ func NewNetworkCore() *NetworkCore {
 		}
 	}
 	log.Println("Listen on UDP:", srv.LocalAddr().String())
+	return newNetworkCore(srv)
+}
+
+// listen on exactly laddr, network udp for dual stack or udp4/udp6, like new_networking_ex
+func NewNetworkCoreFromAddr(network string, laddr *net.UDPAddr) (*NetworkCore, error) {
+	srv, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen udp")
+	}
+	log.Println("Listen on UDP:", srv.LocalAddr().String())
+	return newNetworkCore(srv), nil
+}
+
+func newNetworkCore(srv *net.UDPConn) *NetworkCore {
+	this := &NetworkCore{}
+	this.PacketHandlers = make(map[uint8]PacketHandle, 256)
+	this.sendq = make(chan netSendItem, NET_SEND_QUEUE_SIZE)
+	this.stopC = make(chan struct{})
 	this.srv = srv
 
 	this.start()
 	return this
 }
+
+func (this *NetworkCore) LocalAddr() net.Addr { return this.srv.LocalAddr() }
+
+// stop reading and queued sending, handlers not called after
+func (this *NetworkCore) Close() error {
+	this.closeOnce.Do(func() { close(this.stopC) })
+	return this.srv.Close()
+}
+
+// like networking_registerhandler, nil cbfn to unregister. safe while polling
 func (this *NetworkCore) RegisterHandle(ptype uint8, cbfn PacketHandleFunc, object interface{}) {
+	this.handlermu.Lock()
+	defer this.handlermu.Unlock()
 	this.PacketHandlers[ptype] = PacketHandle{cbfn, object}
 }
 
+func (this *NetworkCore) handler(ptype uint8) (PacketHandle, bool) {
+	this.handlermu.RLock()
+	defer this.handlermu.RUnlock()
+	h, ok := this.PacketHandlers[ptype]
+	return h, ok
+}
+
 /// for read here
-func (this *NetworkCore) start() { go this.doPoll(nil) }
+func (this *NetworkCore) start() {
+	go this.doPoll(nil)
+	go this.doSend()
+}
 func (this *NetworkCore) doPoll(cbdata interface{}) {
 	for {
 		rdbuf := make([]byte, 2000)
@@ -159,7 +210,7 @@ func (this *NetworkCore) doPoll(cbdata interface{}) {
 		if err != nil {
 			break
 		}
-		if rn < 1 {
+		if rn < 1 || !this.UDPEnabled() {
 			continue
 		}
 		// dispatch
@@ -171,7 +222,7 @@ func (this *NetworkCore) doPoll(cbdata interface{}) {
 			log.Printf("recv UDP pkt: %v, 0x%x, %v, %s, %v\n", rn, rdbuf[0], rdbuf[0], pktname, raddr)
 		}
 
-		h, ok := this.PacketHandlers[rdbuf[0]]
+		h, ok := this.handler(rdbuf[0])
 		if !ok || h.Func == nil {
 			log.Println("Packet has no handler:", pktname)
 			continue
@@ -185,6 +236,16 @@ func (this *NetworkCore) doPoll(cbdata interface{}) {
 
 func (this *NetworkCore) Write(data []byte) (int, error) { return this.srv.Write(data) }
 func (this *NetworkCore) WriteTo(data []byte, addr net.Addr) (int, error) {
+	if !this.UDPEnabled() {
+		return 0, errors.New("UDP disabled")
+	}
 	wn, err := this.srv.WriteTo(data, addr)
 	return wn, err
 }
+
+// with UDP disabled, nothing is sent or handled by UDP, everything goes by TCP relays.
+// used when a proxy is set, as proxies here do not forward UDP.
+func (this *NetworkCore) SetUDPEnabled(enabled bool) {
+	atomic.StoreInt32(&this.udpoff, int32(gopp.IfElseInt(enabled, 0, 1)))
+}
+func (this *NetworkCore) UDPEnabled() bool { return atomic.LoadInt32(&this.udpoff) == 0 }
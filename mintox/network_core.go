@@ -0,0 +1,99 @@
+package mintox
+
+import (
+	"gopp"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+/* Ports tried by new_networking_ex when no port given */
+const TOX_PORTRANGE_FROM = 33445
+const TOX_PORTRANGE_TO = 33545
+const TOX_PORT_DEFAULT = TOX_PORTRANGE_FROM
+
+/* Packets waiting in the send queue of a NetworkCore */
+const NET_SEND_QUEUE_SIZE = 512
+
+type netSendItem struct {
+	data []byte
+	addr net.Addr
+}
+
+// like new_networking_ex, bind to ip with the first free port in [portFrom, portTo].
+// 0 for both tries TOX_PORTRANGE_FROM..TOX_PORTRANGE_TO, one 0 for the other.
+// nil or unspecified ipv6 ip for dual stack, fallback to ipv4 if no ipv6.
+func NewNetworkingEx(ip net.IP, portFrom, portTo uint16) (*NetworkCore, error) {
+	switch {
+	case portFrom == 0 && portTo == 0:
+		portFrom, portTo = TOX_PORTRANGE_FROM, TOX_PORTRANGE_TO
+	case portFrom == 0:
+		portFrom = portTo
+	case portTo == 0:
+		portTo = portFrom
+	case portFrom > portTo:
+		portFrom, portTo = portTo, portFrom
+	}
+	srv, err := listenUDPRange(ip, portFrom, portTo)
+	if err != nil && (ip == nil || ip.Equal(net.IPv6unspecified)) {
+		log.Println("Dual stack UDP failed, try ipv4:", err)
+		srv, err = listenUDPRange(net.IPv4zero, portFrom, portTo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Listen on UDP:", srv.LocalAddr().String())
+	return newNetworkCore(srv), nil
+}
+
+func listenUDPRange(ip net.IP, portFrom, portTo uint16) (*net.UDPConn, error) {
+	network := "udp"
+	if ip.To4() != nil {
+		network = "udp4"
+	}
+	var err error
+	for port := int(portFrom); port <= int(portTo); port++ {
+		srv, lerr := net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: port})
+		if lerr == nil {
+			return srv, nil
+		}
+		err = lerr
+	}
+	return nil, errors.Wrapf(err, "no free UDP port in %d-%d of %v", portFrom, portTo, ip)
+}
+
+// send out of caller's goroutine, for bursts like hole punching or onion
+// forwards. Dropped and error when the queue full, data must not be reused.
+func (this *NetworkCore) SendQueued(data []byte, addr net.Addr) error {
+	if !this.UDPEnabled() {
+		return errors.New("UDP disabled")
+	}
+	select {
+	case <-this.stopC:
+		return errors.New("Network closed")
+	default:
+	}
+	select {
+	case this.sendq <- netSendItem{data, addr}:
+		return nil
+	default:
+		atomic.AddInt64(&this.SendDropped, 1)
+		return errors.Errorf("Send queue full: %d", len(this.sendq))
+	}
+}
+
+func (this *NetworkCore) SendQueueLen() int { return len(this.sendq) }
+
+func (this *NetworkCore) doSend() {
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case item := <-this.sendq:
+			_, err := this.WriteTo(item.data, item.addr)
+			gopp.ErrPrint(err, item.addr)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package mintox
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewNetworkingExPortRange(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1)
+	busy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: lo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := uint16(busy.LocalAddr().(*net.UDPAddr).Port)
+
+	if _, err := NewNetworkingEx(lo, port, port); err == nil {
+		t.Error("bound to busy port")
+	}
+	// reversed range, busy port skipped
+	neto, err := NewNetworkingEx(lo, port+3, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer neto.Close()
+	if got := uint16(neto.LocalAddr().(*net.UDPAddr).Port); got <= port || got > port+3 {
+		t.Error("port not in range:", got, port)
+	}
+}
+
+func TestNetworkCoreSendQueued(t *testing.T) {
+	lo := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a, err := NewNetworkCoreFromAddr("udp4", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewNetworkCoreFromAddr("udp4", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var got int32
+	handle := func(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+		if len(data) == 2 && data[1] == 7 {
+			atomic.AddInt32(&got, 1)
+		}
+		return 0, nil
+	}
+	// registered while polling
+	b.RegisterHandle(NET_PACKET_LAN_DISCOVERY, handle, nil)
+	for i := 0; i < 3; i++ {
+		if err := a.SendQueued([]byte{NET_PACKET_LAN_DISCOVERY, 7}, b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitTstCond(3*time.Second, func() bool { return atomic.LoadInt32(&got) == 3 }) {
+		t.Fatal("queued packets not handled:", atomic.LoadInt32(&got))
+	}
+
+	b.RegisterHandle(NET_PACKET_LAN_DISCOVERY, nil, nil)
+	a.SendQueued([]byte{NET_PACKET_LAN_DISCOVERY, 7}, b.LocalAddr())
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&got) != 3 {
+		t.Error("handled after unregistered")
+	}
+
+	a.SetUDPEnabled(false)
+	if a.SendQueued([]byte{NET_PACKET_LAN_DISCOVERY}, b.LocalAddr()) == nil {
+		t.Error("queued when UDP disabled")
+	}
+	a.SetUDPEnabled(true)
+	a.Close()
+	if a.SendQueued([]byte{NET_PACKET_LAN_DISCOVERY}, b.LocalAddr()) == nil {
+		t.Error("queued after closed")
+	}
+}
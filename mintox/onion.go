@@ -1,9 +1,15 @@
 package mintox
 
 import (
+	"encoding/binary"
+	"fmt"
 	"gopp"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 /* Change symmetric keys every 2 hours to make paths expire eventually. */
@@ -19,8 +25,20 @@ type Onion struct {
 	shrkeys2 [256 * MAX_KEYS_PER_SLOT]*SharedKey
 	shrkeys3 [256 * MAX_KEYS_PER_SLOT]*SharedKey
 
-	recv1func func(Object, addr net.Addr, data []byte)
+	shrkeys map[string]*SharedKey // binpk =>, only used by the read routine
+
+	recv1func func(Object, net.Addr, []byte) int
 	cbdata    Object
+
+	retmu   sync.Mutex
+	retlens map[string]onionRetLen // binnonce of our return part =>, retmu
+	retq    []string               // binnonces, oldest first
+}
+
+// request length of a return part made, responses back by it capped to it
+type onionRetLen struct {
+	reqlen int
+	at     time.Time
 }
 
 //
@@ -63,13 +81,19 @@ type OnionPath struct {
 }
 
 func (this *DHT) NewOnion() *Onion {
-	that := &Onion{}
+	that := newOnion(this.Neto)
 	that.dhto = this
-	that.neto = this.Neto
+	return that
+}
+
+func newOnion(neto *NetworkCore) *Onion {
+	that := &Onion{}
+	that.neto = neto
 	that.timestamp = time.Now()
 	_, that.secsymkey, _ = NewCBKeyPair()
+	that.shrkeys = map[string]*SharedKey{}
+	that.retlens = map[string]onionRetLen{}
 
-	neto := this.Neto
 	neto.RegisterHandle(NET_PACKET_ONION_SEND_INITIAL, that.handle_send_initial, that)
 	neto.RegisterHandle(NET_PACKET_ONION_SEND_1, that.handle_send_1, that)
 	neto.RegisterHandle(NET_PACKET_ONION_SEND_2, that.handle_send_2, that)
@@ -90,22 +114,234 @@ func (this *Onion) Kill() {
 	this = nil
 }
 
+func (this *Onion) getSharedKey(pubkey *CryptoKey) (*CryptoKey, error) {
+	if this.dhto == nil {
+		return nil, errors.New("Onion without dht keys")
+	}
+	return this.dhto.GetSharedKey(this.shrkeys, pubkey), nil
+}
+
+// encrypt source and the return part of previous hop, so response can go back
+func (this *Onion) createReturn(source net.Addr, prevret []byte, reqlen int) ([]byte, error) {
+	ipport, err := ipportPack(source)
+	if err != nil {
+		return nil, err
+	}
+	nonce := CBRandomNonce()
+	encrypted, err := EncryptDataSymmetric(this.secsymkey, nonce, append(ipport, prevret...))
+	if err != nil {
+		return nil, err
+	}
+	this.noteReturn(nonce, reqlen)
+	return append(nonce.Bytes(), encrypted...), nil
+}
+
+// remember reqlen of the request our return part of nonce made for
+func (this *Onion) noteReturn(nonce *CBNonce, reqlen int) {
+	now := time.Now()
+	this.retmu.Lock()
+	defer this.retmu.Unlock()
+	for len(this.retq) > 0 {
+		binnonce := this.retq[0]
+		if len(this.retq) < ONION_MAX_RETURNS && now.Sub(this.retlens[binnonce].at) < ONION_RETURN_TIMEOUT*time.Second {
+			break
+		}
+		delete(this.retlens, binnonce)
+		this.retq = this.retq[1:]
+	}
+	binnonce := string(nonce.Bytes())
+	this.retlens[binnonce] = onionRetLen{reqlen, now}
+	this.retq = append(this.retq, binnonce)
+}
+
+// response data back by our return part of retlen, dropped when too big for
+// its request, or the request unknown. Data responses are not capped, an
+// announce node sends them by the stored return part for requests of others.
+func (this *Onion) capResponse(data []byte, retlen int) error {
+	if data[1+retlen] == NET_PACKET_ONION_DATA_RESPONSE {
+		return nil
+	}
+	this.retmu.Lock()
+	ret, ok := this.retlens[string(data[1:1+NONCE_SIZE])]
+	this.retmu.Unlock()
+	if ok && onionAmplificationOK(ret.reqlen, len(data)) {
+		return nil
+	}
+	atomic.AddInt64(&this.neto.OnionAmplifyDropped, 1)
+	return errors.Errorf("Onion response too big or request unknown: %d, request: %d", len(data), ret.reqlen)
+}
+
+// decrypt return part made by createReturn, return addr and return part of previous hop
+func (this *Onion) openReturn(retpart []byte, prevlen int) (net.Addr, []byte, error) {
+	nonce := NewCBNonce(retpart[:NONCE_SIZE])
+	plain, err := DecryptDataSymmetric(this.secsymkey, nonce, retpart[NONCE_SIZE:])
+	if err != nil || len(plain) != SIZE_IPPORT+prevlen {
+		return nil, nil, errors.Errorf("Invalid onion return: %v", err)
+	}
+	addr, err := ipportUnpack(plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		return nil, nil, errors.Errorf("Onion return is not ip: %v", addr)
+	}
+	return addr, plain[SIZE_IPPORT:], nil
+}
+
+// decrypt layer of packet id | nonce | pubkey | encrypted | return part of retlen
+func (this *Onion) openLayer(data []byte, retlen int) (*CBNonce, []byte, error) {
+	nonce := NewCBNonce(data[1 : 1+NONCE_SIZE])
+	pubkey := NewCryptoKey(data[1+NONCE_SIZE : 1+NONCE_SIZE+PUBLIC_KEY_SIZE])
+	shrkey, err := this.getSharedKey(pubkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := DecryptDataSymmetric(shrkey, nonce, data[1+NONCE_SIZE+PUBLIC_KEY_SIZE:len(data)-retlen])
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, plain, nil
+}
+
 func (this *Onion) handle_send_initial(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) > ONION_MAX_PACKET_SIZE {
+		return 1, errors.Errorf("Onion send initial too big: %d", len(data))
+	}
+	if len(data) <= 1+ONION_SEND_1 {
+		return 1, errors.Errorf("Onion send initial too short: %d", len(data))
+	}
+	nonce, plain, err := this.openLayer(data, 0)
+	if err != nil {
+		return 1, err
+	}
+	if err := this.Send1(plain, addr, nonce); err != nil {
+		return 1, err
+	}
 	return 0, nil
 }
 func (this *Onion) handle_send_1(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) > ONION_MAX_PACKET_SIZE {
+		return 1, errors.Errorf("Onion send 1 too big: %d", len(data))
+	}
+	if len(data) <= 1+ONION_SEND_2 {
+		return 1, errors.Errorf("Onion send 1 too short: %d", len(data))
+	}
+	nonce, plain, err := this.openLayer(data, ONION_RETURN_1)
+	if err != nil {
+		return 1, err
+	}
+	sendto, err := ipportUnpack(plain)
+	if err != nil {
+		return 1, err
+	}
+	retpart, err := this.createReturn(addr, data[len(data)-ONION_RETURN_1:], len(data))
+	if err != nil {
+		return 1, err
+	}
+
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(NET_PACKET_ONION_SEND_2)
+	buf.Write(nonce.Bytes())
+	buf.Write(plain[SIZE_IPPORT:])
+	buf.Write(retpart)
+	if _, err = this.neto.WriteTo(buf.Bytes(), sendto); err != nil {
+		return 1, err
+	}
 	return 0, nil
 }
 func (this *Onion) handle_send_2(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) > ONION_MAX_PACKET_SIZE {
+		return 1, errors.Errorf("Onion send 2 too big: %d", len(data))
+	}
+	if len(data) <= 1+ONION_SEND_3 {
+		return 1, errors.Errorf("Onion send 2 too short: %d", len(data))
+	}
+	_, plain, err := this.openLayer(data, ONION_RETURN_2)
+	if err != nil {
+		return 1, err
+	}
+	if len(plain) <= SIZE_IPPORT {
+		return 1, errors.Errorf("Onion send 2 no data: %d", len(plain))
+	}
+	sendto, err := ipportUnpack(plain)
+	if err != nil {
+		return 1, err
+	}
+	retpart, err := this.createReturn(addr, data[len(data)-ONION_RETURN_2:], len(data))
+	if err != nil {
+		return 1, err
+	}
+
+	// the destination sees plain data with return part appended
+	buf := gopp.NewBufferZero()
+	buf.Write(plain[SIZE_IPPORT:])
+	buf.Write(retpart)
+	if _, err = this.neto.WriteTo(buf.Bytes(), sendto); err != nil {
+		return 1, err
+	}
 	return 0, nil
 }
 func (this *Onion) handle_recv_1(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	if len(data) > ONION_MAX_PACKET_SIZE {
+		return 1, errors.Errorf("Onion recv 1 too big: %d", len(data))
+	}
+	if len(data) <= 1+ONION_RETURN_1 {
+		return 1, errors.Errorf("Onion recv 1 too short: %d", len(data))
+	}
+	nonce := NewCBNonce(data[1 : 1+NONCE_SIZE])
+	plain, err := DecryptDataSymmetric(this.secsymkey, nonce, data[1+NONCE_SIZE:1+ONION_RETURN_1])
+	if err != nil || len(plain) != SIZE_IPPORT {
+		return 1, errors.Errorf("Invalid onion return: %v", err)
+	}
+	sendto, err := ipportUnpack(plain)
+	if err != nil {
+		return 1, err
+	}
+	if err := this.capResponse(data, ONION_RETURN_1); err != nil {
+		return 1, err
+	}
+	payload := data[1+ONION_RETURN_1:]
+	if _, ok := sendto.(*TCPOnionAddr); ok {
+		if this.recv1func == nil {
+			return 1, errors.New("No onion recv 1 callback")
+		}
+		return this.recv1func(this.cbdata, sendto, payload), nil
+	}
+	_, err = this.neto.WriteTo(payload, sendto)
+	if err != nil {
+		return 1, err
+	}
 	return 0, nil
 }
 func (this *Onion) handle_recv_2(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
-	return 0, nil
+	return this.handleRecv(data, ONION_RETURN_2, ONION_RETURN_1, NET_PACKET_ONION_RECV_1)
 }
 func (this *Onion) handle_recv_3(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	return this.handleRecv(data, ONION_RETURN_3, ONION_RETURN_2, NET_PACKET_ONION_RECV_2)
+}
+
+// strip our return part of retlen, pass response to previous hop with its return part of prevlen
+func (this *Onion) handleRecv(data []byte, retlen, prevlen int, ptype uint8) (int, error) {
+	if len(data) > ONION_MAX_PACKET_SIZE {
+		return 1, errors.Errorf("Onion response too big: %d", len(data))
+	}
+	if len(data) <= 1+retlen {
+		return 1, errors.Errorf("Onion response too short: %d", len(data))
+	}
+	sendto, prevret, err := this.openReturn(data[1:1+retlen], prevlen)
+	if err != nil {
+		return 1, err
+	}
+	if err := this.capResponse(data, retlen); err != nil {
+		return 1, err
+	}
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(ptype)
+	buf.Write(prevret)
+	buf.Write(data[1+retlen:])
+	if _, err = this.neto.WriteTo(buf.Bytes(), sendto); err != nil {
+		return 1, err
+	}
 	return 0, nil
 }
 
@@ -120,10 +356,15 @@ func (this *Onion) handle_recv_3(object interface{}, addr net.Addr, data []byte,
  */
 // int create_onion_path(const DHT *dht, Onion_Path *new_path, const Node_format *nodes);
 func (this *DHT) NewOnionPath(nodes []*NodeFormat) *OnionPath {
+	return newOnionPath(this.SelfPubkey, this.SelfSeckey, nodes)
+}
+
+// first hop sees our dht pubkey, the others random ones
+func newOnionPath(dhtpk, dhtsk *CryptoKey, nodes []*NodeFormat) *OnionPath {
 	op := &OnionPath{}
 
-	op.shrkey1, _ = CBBeforeNm(nodes[0].Pubkey, this.SelfSeckey)
-	op.pubkey1 = this.SelfPubkey
+	op.shrkey1, _ = CBBeforeNm(nodes[0].Pubkey, dhtsk)
+	op.pubkey1 = dhtpk
 
 	randpk, randsk, _ := NewCBKeyPair()
 	op.shrkey2, _ = CBBeforeNm(nodes[1].Pubkey, randsk)
@@ -181,7 +422,52 @@ func (this *OnionPath) ToNodes() (nodes []*NodeFormat) {
 // int create_onion_packet(uint8_t *packet, uint16_t max_packet_length, const Onion_Path *path, IP_Port dest,
 //                        const uint8_t *data, uint16_t length);
 func (this *OnionPath) CreatePacket(dest net.Addr, data []byte) (packet []byte, err error) {
-	return
+	if len(data) == 0 || 1+len(data)+ONION_SEND_1 > ONION_MAX_PACKET_SIZE {
+		return nil, errors.Errorf("Invalid onion data size: %d", len(data))
+	}
+	nonce := CBRandomNonce()
+	step3, err := this.createLayers(nonce, dest, data)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := EncryptDataSymmetric(this.shrkey1, nonce, step3)
+	if err != nil {
+		return nil, err
+	}
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(NET_PACKET_ONION_SEND_INITIAL)
+	buf.Write(nonce.Bytes())
+	buf.Write(this.pubkey1.Bytes())
+	buf.Write(encrypted)
+	return buf.Bytes(), nil
+}
+
+// layers for node 3 and node 2: ip_port2 | pubkey2 | encrypted(ip_port3 | pubkey3 | encrypted(dest | data))
+func (this *OnionPath) createLayers(nonce *CBNonce, dest net.Addr, data []byte) ([]byte, error) {
+	step := gopp.NewBufferZero()
+	for i, hop := range []struct {
+		addr           net.Addr
+		pubkey, shrkey *CryptoKey
+	}{{dest, nil, nil}, {this.addr3, this.pubkey3, this.shrkey3}, {this.addr2, this.pubkey2, this.shrkey2}} {
+		ipport, err := ipportPack(hop.addr)
+		if err != nil {
+			return nil, err
+		}
+		plain := step.Bytes()
+		step = gopp.NewBufferZero()
+		step.Write(ipport)
+		if i == 0 {
+			step.Write(data)
+			continue
+		}
+		encrypted, err := EncryptDataSymmetric(hop.shrkey, nonce, plain)
+		if err != nil {
+			return nil, err
+		}
+		step.Write(hop.pubkey.Bytes())
+		step.Write(encrypted)
+	}
+	return step.Bytes(), nil
 }
 
 /* Create a onion packet to be sent over tcp.
@@ -196,7 +482,15 @@ func (this *OnionPath) CreatePacket(dest net.Addr, data []byte) (packet []byte,
 // int create_onion_packet_tcp(uint8_t *packet, uint16_t max_packet_length, const Onion_Path *path, IP_Port dest,
 //                            const uint8_t *data, uint16_t length);
 func (this *OnionPath) CreatePacketTCP(dest net.Addr, data []byte) (packet []byte, err error) {
-	return
+	if len(data) == 0 || NONCE_SIZE+SIZE_IPPORT+ONION_SEND_BASE*2+len(data) > ONION_MAX_PACKET_SIZE {
+		return nil, errors.Errorf("Invalid onion data size: %d", len(data))
+	}
+	nonce := CBRandomNonce()
+	step3, err := this.createLayers(nonce, dest, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce.Bytes(), step3...), nil
 }
 
 /* Create and send a onion packet.
@@ -209,7 +503,12 @@ func (this *OnionPath) CreatePacketTCP(dest net.Addr, data []byte) (packet []byt
  */
 // int send_onion_packet(Networking_Core *net, const Onion_Path *path, IP_Port dest, const uint8_t *data, uint16_t length);
 func (this *Onion) SendPacket(path *OnionPath, dest net.Addr, data []byte) error {
-	return nil
+	packet, err := path.CreatePacket(dest, data)
+	if err != nil {
+		return err
+	}
+	_, err = this.neto.WriteTo(packet, path.addr1)
+	return err
 }
 
 /* Create and send a onion response sent initially to dest with.
@@ -228,6 +527,31 @@ func (this *NetworkCore) SendOnionResponse(dest net.Addr, data []byte, retdat []
 	return
 }
 
+/* A response forwarded for one onion request can not be bigger than this times of the request,
+ * so we can not be used to amplify traffic to a spoofed source.
+ */
+const ONION_MAX_AMPLIFICATION = 2
+
+/* seconds our return part is known to cap responses, like ONION_ANNOUNCE_TIMEOUT */
+const ONION_RETURN_TIMEOUT = 300
+
+/* return parts known, oldest forgotten first */
+const ONION_MAX_RETURNS = 65536
+
+func onionAmplificationOK(reqlen, rsplen int) bool {
+	return rsplen <= reqlen*ONION_MAX_AMPLIFICATION
+}
+
+// Same as SendOnionResponse, but drop the response if it is too big for the reqlen request.
+func (this *NetworkCore) SendOnionResponseCapped(dest net.Addr, data []byte, retdat []byte, reqlen int) error {
+	rsplen := 1 + len(retdat) + len(data)
+	if !onionAmplificationOK(reqlen, rsplen) {
+		atomic.AddInt64(&this.OnionAmplifyDropped, 1)
+		return errors.Errorf("Onion response too big: %d, request: %d", rsplen, reqlen)
+	}
+	return this.SendOnionResponse(dest, data, retdat)
+}
+
 /* Function to handle/send received decrypted versions of the packet sent with send_onion_packet.
  *
  * return 0 on success.
@@ -240,7 +564,38 @@ func (this *NetworkCore) SendOnionResponse(dest net.Addr, data []byte, retdat []
  */
 // int onion_send_1(const Onion *onion, const uint8_t *plain, uint16_t len, IP_Port source, const uint8_t *nonce);
 func (this *Onion) Send1(plain []byte, source net.Addr, nonce *CBNonce) error {
-	return nil
+	if len(plain) > ONION_MAX_PACKET_SIZE+SIZE_IPPORT-(1+NONCE_SIZE+ONION_RETURN_1) {
+		return errors.Errorf("Onion send 1 too big: %d", len(plain))
+	}
+	if len(plain) <= SIZE_IPPORT+ONION_SEND_BASE*2 {
+		return errors.Errorf("Onion send 1 too short: %d", len(plain))
+	}
+	sendto, err := ipportUnpack(plain[:SIZE_IPPORT])
+	if err != nil {
+		return err
+	}
+	if _, ok := sendto.(*TCPOnionAddr); ok {
+		return errors.New("Onion next hop is not ip")
+	}
+	ipport, err := ipportPack(source)
+	if err != nil {
+		return err
+	}
+	retnonce := CBRandomNonce()
+	retpart, err := EncryptDataSymmetric(this.secsymkey, retnonce, ipport)
+	if err != nil {
+		return err
+	}
+	this.noteReturn(retnonce, 1+NONCE_SIZE+len(plain)) // about the request got
+
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(NET_PACKET_ONION_SEND_1)
+	buf.Write(nonce.Bytes())
+	buf.Write(plain[SIZE_IPPORT:])
+	buf.Write(retnonce.Bytes())
+	buf.Write(retpart)
+	_, err = this.neto.WriteTo(buf.Bytes(), sendto)
+	return err
 }
 
 /* Set the callback to be called when the dest ip_port doesn't have AF_INET6 or AF_INET as the family.
@@ -249,6 +604,62 @@ func (this *Onion) Send1(plain []byte, source net.Addr, nonce *CBNonce) error {
  */
 // void set_callback_handle_recv_1(Onion *onion, int (*function)(void *, IP_Port, const uint8_t *, uint16_t),
 // 	void *object);
-func (this *Onion) SetCallbackHandleRecv1(f func(Object, net.Addr, []byte) int) {
+func (this *Onion) SetCallbackHandleRecv1(f func(Object, net.Addr, []byte) int, object Object) {
+	this.recv1func = f
+	this.cbdata = object
+}
+
+/* Family of ip_port for onion packets received by TCP relay, see TCP_server.h */
+const TCP_ONION_FAMILY = (TOX_AF_INET6 + 1)
+
+// source of an onion request received from a TCP relay conn, keyed by conn identifier
+type TCPOnionAddr struct {
+	Identifier uint64
+}
+
+func (this *TCPOnionAddr) Network() string { return "tcponion" }
+func (this *TCPOnionAddr) String() string  { return fmt.Sprintf("tcponion:%d", this.Identifier) }
+
+// fixed size ip_port used in onion return parts: family | ip(16) | port
+func ipportPack(addr net.Addr) ([]byte, error) {
+	data := make([]byte, SIZE_IPPORT)
+	switch a := addr.(type) {
+	case *TCPOnionAddr:
+		data[0] = TCP_ONION_FAMILY
+		binary.BigEndian.PutUint64(data[1:], a.Identifier)
+	case *net.UDPAddr:
+		if ip4 := a.IP.To4(); ip4 != nil {
+			data[0] = TOX_AF_INET
+			copy(data[1:], ip4)
+		} else if ip6 := a.IP.To16(); ip6 != nil {
+			data[0] = TOX_AF_INET6
+			copy(data[1:], ip6)
+		} else {
+			return nil, errors.Errorf("Invalid ip: %v", addr)
+		}
+		binary.BigEndian.PutUint16(data[1+SIZE_IP6:], uint16(a.Port))
+	default:
+		return nil, errors.Errorf("Unsupported addr: %v", addr)
+	}
+	return data, nil
+}
 
+func ipportUnpack(data []byte) (net.Addr, error) {
+	if len(data) < SIZE_IPPORT {
+		return nil, errors.Errorf("Invalid ip_port length: %d", len(data))
+	}
+	port := int(binary.BigEndian.Uint16(data[1+SIZE_IP6:]))
+	switch data[0] {
+	case TOX_AF_INET:
+		ip := make(net.IP, SIZE_IP4)
+		copy(ip, data[1:1+SIZE_IP4])
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	case TOX_AF_INET6:
+		ip := make(net.IP, SIZE_IP6)
+		copy(ip, data[1:1+SIZE_IP6])
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	case TCP_ONION_FAMILY:
+		return &TCPOnionAddr{binary.BigEndian.Uint64(data[1:])}, nil
+	}
+	return nil, errors.Errorf("Invalid ip_port family: %d", data[0])
 }
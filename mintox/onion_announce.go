@@ -9,6 +9,8 @@ import (
 	"net"
 	"time"
 	"unsafe"
+
+	"github.com/pkg/errors"
 )
 
 const ONION_ANNOUNCE_MAX_ENTRIES = 160
@@ -21,7 +23,7 @@ const ONION_ANNOUNCE_REQUEST_SIZE = (1 + NONCE_SIZE + PUBLIC_KEY_SIZE + ONION_PI
 
 const ONION_ANNOUNCE_RESPONSE_MIN_SIZE = (1 + ONION_ANNOUNCE_SENDBACK_DATA_LENGTH + NONCE_SIZE + 1 + ONION_PING_ID_SIZE + MAC_SIZE)
 
-// const ONION_ANNOUNCE_RESPONSE_MAX_SIZE = (ONION_ANNOUNCE_RESPONSE_MIN_SIZE + sizeof(Node_format)*MAX_SENT_NODES)
+const ONION_ANNOUNCE_RESPONSE_MAX_SIZE = (ONION_ANNOUNCE_RESPONSE_MIN_SIZE + PACKED_NODE_SIZE_IP6*MAX_SENT_NODES)
 
 const ONION_DATA_RESPONSE_MIN_SIZE = (1 + NONCE_SIZE + PUBLIC_KEY_SIZE + MAC_SIZE)
 
@@ -58,6 +60,8 @@ func (this *Onion_Announce_Entry) Compare(thatx PLItem) int {
 func (this *Onion_Announce_Entry) Update(thatx PLItem) {
 	that := thatx.(*Onion_Announce_Entry)
 	this.Timestamp = that.Timestamp
+	// return path of the latest announce, data requests go by it
+	this.RetAddr, this.RetDat, this.DatPubkey = that.RetAddr, that.RetDat, that.DatPubkey
 }
 
 type Onion_Announce struct {
@@ -89,7 +93,7 @@ func NewOnionAnnounce(dhto *DHT) *Onion_Announce {
 
 	neto := dhto.Neto
 	neto.RegisterHandle(NET_PACKET_ANNOUNCE_REQUEST, this.handleAnnounceRequest, this)
-	// neto.RegisterHandle(NET_PACKET_ONION_DATA_REQUEST, this.handleDataRequest, this)
+	neto.RegisterHandle(NET_PACKET_ONION_DATA_REQUEST, this.handleDataRequest, this)
 
 	return this
 }
@@ -97,7 +101,7 @@ func NewOnionAnnounce(dhto *DHT) *Onion_Announce {
 func (this *Onion_Announce) Kill() {
 	neto := this.neto
 	neto.RegisterHandle(NET_PACKET_ANNOUNCE_REQUEST, nil, nil)
-	// neto.RegisterHandle(NET_PACKET_ONION_DATA_REQUEST, nil,nil)
+	neto.RegisterHandle(NET_PACKET_ONION_DATA_REQUEST, nil, nil)
 	this = nil
 }
 
@@ -113,7 +117,7 @@ func (this *Onion_Announce) handleAnnounceRequest(object interface{}, addr net.A
 	wntsz := ONION_PING_ID_SIZE + PUBLIC_KEY_SIZE + PUBLIC_KEY_SIZE + ONION_ANNOUNCE_SENDBACK_DATA_LENGTH + MAC_SIZE
 	// log.Printf("0x%x, %d, %s, %d, %d, %d\n", data[1+NONCE_SIZE+PUBLIC_KEY_SIZE+wntsz], data[1+NONCE_SIZE+PUBLIC_KEY_SIZE+wntsz], netpktname(data[1+NONCE_SIZE+PUBLIC_KEY_SIZE+wntsz]), ONION_ANNOUNCE_REQUEST_SIZE+ONION_RETURN_3, ONION_ANNOUNCE_REQUEST_SIZE, ONION_RETURN_3)
 	plnpkt, err := DecryptDataSymmetric(shrkey, nonce, data[1+NONCE_SIZE+PUBLIC_KEY_SIZE:1+NONCE_SIZE+PUBLIC_KEY_SIZE+wntsz])
-	gopp.ErrPrint(err, "decrypt:", nonce.ToHex20(), pktpk.ToHex20(), shrkey.ToHex20(), len(data), len(data)-1-NONCE_SIZE-PUBLIC_KEY_SIZE, wntsz)
+	gopp.ErrPrint(err, "decrypt:", logkey(nonce), pktpk.ToHex20(), logkey(shrkey), len(data), len(data)-1-NONCE_SIZE-PUBLIC_KEY_SIZE, wntsz)
 
 	pingid := plnpkt[:ONION_PING_ID_SIZE]
 	searchpk := NewCryptoKey(plnpkt[ONION_PING_ID_SIZE : ONION_PING_ID_SIZE+PUBLIC_KEY_SIZE])
@@ -189,15 +193,29 @@ func (this *Onion_Announce) handleAnnounceRequest(object interface{}, addr net.A
 	rspbuf.Write(rspnonce.Bytes())
 	rspbuf.Write(encplpkt)
 
-	err = this.neto.SendOnionResponse(addr, rspbuf.Bytes(), retdat)
+	err = this.neto.SendOnionResponseCapped(addr, rspbuf.Bytes(), retdat, len(data))
 	gopp.ErrPrint(err)
 	log.Println("retdat:", len(retdat), pingidok, plbuf.Bytes()[0], NewCryptoKey(pingid1).ToHex20(), NewCryptoKey(pingid2).ToHex20())
 
 	return 0, nil
 }
 
+// pass data to the announced one by its return path, data response is
+// nonce | pubkey | encrypted, all after the destination pubkey
 func (this *Onion_Announce) handleDataRequest(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
-	log.Println("handle announce request:", len(data), addr)
+	if len(data) <= DATA_REQUEST_MIN_SIZE_RECV || len(data) > ONION_MAX_PACKET_SIZE {
+		return 1, errors.Errorf("Invalid data request size: %d", len(data))
+	}
+	entry := this.find_in_entries(NewCryptoKey(data[1 : 1+PUBLIC_KEY_SIZE]))
+	if entry == nil {
+		return 1, errors.New("Data request to one not announced")
+	}
+	rspbuf := gopp.NewBufferZero()
+	rspbuf.WriteByte(NET_PACKET_ONION_DATA_RESPONSE)
+	rspbuf.Write(data[1+PUBLIC_KEY_SIZE : len(data)-ONION_RETURN_3])
+	if err := this.neto.SendOnionResponse(entry.RetAddr, rspbuf.Bytes(), entry.RetDat); err != nil {
+		return 1, err
+	}
 	return 0, nil
 }
 
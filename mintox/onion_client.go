@@ -0,0 +1,917 @@
+package mintox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopp"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const MAX_ONION_CLIENTS = 8
+const MAX_ONION_CLIENTS_ANNOUNCE = 12 /* Number of nodes to announce ourselves to. */
+const ONION_NODE_PING_INTERVAL = 15
+const ONION_NODE_TIMEOUT = ONION_NODE_PING_INTERVAL
+
+/* The interval in seconds at which to tell our friends where we are */
+const ONION_DHTPK_SEND_INTERVAL = 30
+
+const NUMBER_ONION_PATHS = 6
+
+/* The timeout the first time the path is added and then for all the next consecutive times */
+const ONION_PATH_FIRST_TIMEOUT = 4
+const ONION_PATH_TIMEOUT = 10
+const ONION_PATH_MAX_LIFETIME = 1200
+const ONION_PATH_MAX_NO_RESPONSE_USES = 4
+
+const MAX_STORED_PINGED_NODES = 9
+const MIN_NODE_PING_TIME = 10
+
+const MAX_PATH_NODES = 32
+
+const ANNOUNCE_INTERVAL_NOT_ANNOUNCED = 3
+const ANNOUNCE_INTERVAL_ANNOUNCED = ONION_NODE_PING_INTERVAL
+
+const ANNOUNCE_FRIEND = (ONION_NODE_PING_INTERVAL * 6)
+const ANNOUNCE_FRIEND_BEGINNING = 3
+const RUN_COUNT_FRIEND_ANNOUNCE_BEGINNING = 17
+
+const ANNOUNCE_ARRAY_SIZE = 256
+const ANNOUNCE_TIMEOUT = 10
+
+const ONION_DATA_IN_RESPONSE_MIN_SIZE = (PUBLIC_KEY_SIZE + MAC_SIZE)
+const ONION_CLIENT_MAX_DATA_SIZE = (MAX_DATA_REQUEST_SIZE - ONION_DATA_IN_RESPONSE_MIN_SIZE)
+
+const ONION_DATA_FRIEND_REQ = CRYPTO_PACKET_FRIEND_REQ
+const ONION_DATA_DHTPK = CRYPTO_PACKET_DHTPK
+
+const DHTPK_DATA_MIN_LENGTH = (1 + 8 + PUBLIC_KEY_SIZE)
+const DHTPK_DATA_MAX_LENGTH = (DHTPK_DATA_MIN_LENGTH + PACKED_NODE_SIZE_IP6*MAX_SENT_NODES)
+
+// Onion_Node, a node we are announced on, or searched a friend on
+type onionNode struct {
+	pubkey     *CryptoKey
+	addr       net.Addr
+	pingid     []byte     // announce with it, self list only
+	datpk      *CryptoKey // data pubkey of friend stored on node, friend lists only
+	isStored   bool
+	lastRecv   time.Time
+	lastPinged time.Time
+	pathnum    uint32
+}
+
+type onionList struct {
+	nodes  []*onionNode
+	pinged map[string]time.Time // binpk => when pinged as told by responses
+}
+
+// Onion_Client_Paths, a pool scored by announce answers, see onion_client_paths.go
+type onionPaths struct {
+	paths       [NUMBER_ONION_PATHS]*OnionPath
+	created     [NUMBER_ONION_PATHS]time.Time
+	lastSuccess [NUMBER_ONION_PATHS]time.Time
+	lastUsed    [NUMBER_ONION_PATHS]time.Time
+	noRspUses   [NUMBER_ONION_PATHS]int
+	probes      [NUMBER_ONION_PATHS]int           // announce requests sent
+	answers     [NUMBER_ONION_PATHS]int           // announce responses
+	rtt         [NUMBER_ONION_PATHS]time.Duration // smoothed announce response time
+	lastRotated time.Time
+}
+
+// Onion_Friend
+type onionFriend struct {
+	realpk        *CryptoKey
+	dhtpk         *CryptoKey // told by friend, or set from its handshake
+	online        bool       // friend conn up, no need to search
+	tmppk, tmpsk  *CryptoKey // search with it, not to leak our real pubkey
+	list          onionList
+	runCount      int
+	lastDHTPKSent time.Time
+	lastNoReplay  uint64
+}
+
+type onionSendback struct {
+	friendpk *CryptoKey // nil for announce of self
+	nodepk   *CryptoKey
+	addr     net.Addr
+	pathnum  uint32
+	sent     time.Time
+}
+
+// like Onion_Client, announce us under our real pubkey on the nodes close to it,
+// and search friends there by their real pubkey, so we can tell them our dht
+// pubkey and where to reach us, or send them friend requests.
+// Paths are 3 hops of path nodes, or a TCP relay then 2 hops when UDP is disabled.
+type OnionClient struct {
+	ncro  *NetCrypto
+	dhto  *DHT // nil then path nodes only by AddPathNode
+	clock clock
+
+	// data keypair announced with us, friends encrypt data to us with it
+	tmppk *CryptoKey
+	tmpsk *CryptoKey
+
+	mu          sync.Mutex
+	pathNodes   []*NodeFormat
+	badNodes    map[string]time.Time // binpk => until, nodes of failing paths not built with
+	selfPaths   onionPaths
+	friendPaths onionPaths
+	announced   onionList
+	friends     map[string]*onionFriend // binpk =>
+	sendbacks   map[uint64]*onionSendback
+	relays      []*TCPClient
+	handlers    map[uint8]func(realpk *CryptoKey, data []byte)
+	stopC       chan bool
+
+	// friend told its dht pubkey, with its tcp relays and dht nodes close to it
+	OnDHTPubkey func(realpk, dhtpk *CryptoKey, nodes []*NodeFormat)
+}
+
+func NewOnionClient(ncro *NetCrypto, dhto *DHT) *OnionClient {
+	this := &OnionClient{}
+	this.ncro, this.dhto = ncro, dhto
+	this.clock = ncro.clock
+	this.tmppk, this.tmpsk, _ = NewCBKeyPair()
+	this.announced.pinged = map[string]time.Time{}
+	this.badNodes = map[string]time.Time{}
+	this.friends = map[string]*onionFriend{}
+	this.sendbacks = map[uint64]*onionSendback{}
+	this.handlers = map[uint8]func(*CryptoKey, []byte){}
+	this.stopC = make(chan bool)
+
+	if neto := ncro.neto; neto != nil {
+		neto.RegisterHandle(NET_PACKET_ANNOUNCE_RESPONSE, this.handleAnnounceResponse, this)
+		neto.RegisterHandle(NET_PACKET_ONION_DATA_RESPONSE, this.handleDataResponse, this)
+	}
+	go this.doOnionClientLoop()
+	return this
+}
+
+func (this *OnionClient) Kill() {
+	close(this.stopC)
+	if neto := this.ncro.neto; neto != nil {
+		neto.RegisterHandle(NET_PACKET_ANNOUNCE_RESPONSE, nil, nil)
+		neto.RegisterHandle(NET_PACKET_ONION_DATA_RESPONSE, nil, nil)
+	}
+}
+
+// like onion_add_path_node, udp node to build paths with and to announce to at first
+func (this *OnionClient) AddPathNode(node *NodeFormat) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.addPathNodeLocked(node)
+}
+
+// mu held by caller
+func (this *OnionClient) addPathNodeLocked(node *NodeFormat) bool {
+	if _, ok := node.Addr.(*net.UDPAddr); !ok {
+		return false
+	}
+	for _, n := range this.pathNodes {
+		if n.Pubkey.Equal2(node.Pubkey) {
+			return false
+		}
+	}
+	if len(this.pathNodes) >= MAX_PATH_NODES {
+		this.pathNodes = this.pathNodes[1:]
+	}
+	this.pathNodes = append(this.pathNodes, &NodeFormat{Pubkey: node.Pubkey, Addr: node.Addr})
+	return true
+}
+
+// relay as first hop of paths, cli must use our dht keypair
+func (this *OnionClient) AddTCPRelay(cli *TCPClient) {
+	cli.OnOnionResponse = func(data []byte) {
+		_, err := this.handleResponse(nil, data)
+		gopp.ErrPrint(err, cli.ServAddr)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.relays = append(this.relays, cli)
+}
+
+// like oniondata_registerhandler, data from friends or strangers with packet id ptype
+func (this *OnionClient) RegisterDataHandler(ptype uint8, fn func(realpk *CryptoKey, data []byte)) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.handlers[ptype] = fn
+}
+
+func (this *OnionClient) AddFriend(realpk *CryptoKey) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.friends[realpk.BinStr()]; ok {
+		return
+	}
+	f := &onionFriend{realpk: realpk}
+	f.tmppk, f.tmpsk, _ = NewCBKeyPair()
+	f.list.pinged = map[string]time.Time{}
+	this.friends[realpk.BinStr()] = f
+}
+
+func (this *OnionClient) DelFriend(realpk *CryptoKey) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.friends[realpk.BinStr()]; !ok {
+		return false
+	}
+	delete(this.friends, realpk.BinStr())
+	return true
+}
+
+// like onion_set_friend_online, stop searching a friend connected
+func (this *OnionClient) SetFriendOnline(realpk *CryptoKey, online bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if f, ok := this.friends[realpk.BinStr()]; ok {
+		if f.online && !online {
+			f.runCount = 0
+		}
+		f.online = online
+	}
+}
+
+// like onion_set_friend_DHT_pubkey, dht pubkey learned in other ways
+func (this *OnionClient) SetFriendDHTPubkey(realpk, dhtpk *CryptoKey) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if f, ok := this.friends[realpk.BinStr()]; ok {
+		f.dhtpk = dhtpk
+	}
+}
+
+func (this *OnionClient) FriendDHTPubkey(realpk *CryptoKey) *CryptoKey {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if f, ok := this.friends[realpk.BinStr()]; ok {
+		return f.dhtpk
+	}
+	return nil
+}
+
+// number of nodes we are announced on
+func (this *OnionClient) Announced() (n int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, node := range this.announced.nodes {
+		if node.isStored && !this.timeout(node.lastRecv, ONION_NODE_TIMEOUT) {
+			n++
+		}
+	}
+	return
+}
+
+// like send_onion_data, send data to friend by the nodes it announced on.
+// return the number of nodes sent to
+func (this *OnionClient) SendData(realpk *CryptoKey, data []byte) (int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, ok := this.friends[realpk.BinStr()]
+	if !ok {
+		return 0, errors.New("Not onion friend")
+	}
+	return this.sendDataLocked(f, data)
+}
+
+// mu held by caller
+func (this *OnionClient) sendDataLocked(f *onionFriend, data []byte) (int, error) {
+	if len(data) == 0 || len(data) > ONION_CLIENT_MAX_DATA_SIZE {
+		return 0, errors.Errorf("Invalid onion data size: %d", len(data))
+	}
+	alive, good := 0, []*onionNode{}
+	for _, n := range f.list.nodes {
+		if this.timeout(n.lastRecv, ONION_NODE_TIMEOUT) {
+			continue
+		}
+		alive++
+		if n.isStored && n.datpk != nil {
+			good = append(good, n)
+		}
+	}
+	if len(good) < (alive-1)/4+1 {
+		return 0, errors.Errorf("Friend found on too few nodes: %d/%d", len(good), alive)
+	}
+
+	nonce := CBRandomNonce()
+	shrkey, err := CBBeforeNm(f.realpk, this.ncro.SelfSeckey)
+	if err != nil {
+		return 0, err
+	}
+	encrypted, err := EncryptDataSymmetric(shrkey, nonce, data)
+	if err != nil {
+		return 0, err
+	}
+	inner := append(append([]byte{}, this.ncro.SelfPubkey.Bytes()...), encrypted...)
+
+	sent := 0
+	for _, n := range good {
+		// create_data_request, encrypted to friend's data pubkey by random key
+		randpk, randsk, _ := NewCBKeyPair()
+		shrkey, err := CBBeforeNm(n.datpk, randsk)
+		if err != nil {
+			continue
+		}
+		encrypted, err := EncryptDataSymmetric(shrkey, nonce, inner)
+		if err != nil {
+			continue
+		}
+		buf := gopp.NewBufferZero()
+		buf.WriteByte(NET_PACKET_ONION_DATA_REQUEST)
+		buf.Write(f.realpk.Bytes())
+		buf.Write(nonce.Bytes())
+		buf.Write(randpk.Bytes())
+		buf.Write(encrypted)
+		if _, err := this.sendOnionLocked(&this.friendPaths, -1, n.addr, buf.Bytes()); err == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		return 0, errors.New("Onion data not sent")
+	}
+	return sent, nil
+}
+
+// like send_dhtpk_announce, no_replay | dht pubkey | our tcp relays and dht nodes
+func (this *OnionClient) sendDHTPKLocked(f *onionFriend) (int, error) {
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(ONION_DATA_DHTPK)
+	binary.Write(buf, binary.BigEndian, uint64(this.clock.Now().Unix()))
+	buf.Write(this.ncro.dhtpk.Bytes())
+	num := 0
+	for _, cli := range this.relays {
+		if num >= MAX_SENT_NODES || cli.Status != TCP_CLIENT_CONFIRMED {
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp", cli.ServAddr)
+		if err != nil {
+			continue
+		}
+		if data, err := PackNode(addr, cli.ServPubkey); err == nil {
+			buf.Write(data)
+			num++
+		}
+	}
+	if this.dhto != nil && num < MAX_SENT_NODES {
+		for _, node := range this.dhto.GetClosestNodes(this.ncro.dhtpk, MAX_SENT_NODES-num) {
+			if data, err := PackNode(node.Addr, node.Pubkey); err == nil {
+				buf.Write(data)
+			}
+		}
+	}
+	return this.sendDataLocked(f, buf.Bytes())
+}
+
+func (this *OnionClient) timeout(t time.Time, secs int) bool {
+	return this.clock.Now().Sub(t) >= time.Duration(secs)*time.Second
+}
+
+func (this *OnionClient) udpEnabled() bool {
+	return this.ncro.neto != nil && this.ncro.neto.UDPEnabled()
+}
+
+// mu held by caller
+func (this *OnionClient) relayLocked(pubkey *CryptoKey) *TCPClient {
+	for _, cli := range this.relays {
+		if cli.ServPubkey.Equal2(pubkey) && cli.Status == TCP_CLIENT_CONFIRMED {
+			return cli
+		}
+	}
+	return nil
+}
+
+// like random_nodes_path_onion, by UDP when possible, else first hop is a TCP relay
+func (this *OnionClient) randomPathNodesLocked() ([]*NodeFormat, error) {
+	if this.udpEnabled() && len(this.pathNodes) >= ONION_PATH_LENGTH {
+		return this.randomNodesLocked(ONION_PATH_LENGTH), nil
+	}
+	var relays []*TCPClient
+	for _, cli := range this.relays {
+		if cli.Status == TCP_CLIENT_CONFIRMED {
+			relays = append(relays, cli)
+		}
+	}
+	if len(relays) == 0 || len(this.pathNodes) < ONION_PATH_LENGTH-1 {
+		return nil, errors.Errorf("Not enough onion path nodes: %d, relays: %d", len(this.pathNodes), len(relays))
+	}
+	cli := relays[rand.Intn(len(relays))]
+	addr, err := net.ResolveTCPAddr("tcp", cli.ServAddr)
+	if err != nil {
+		return nil, err
+	}
+	relay := &NodeFormat{Pubkey: cli.ServPubkey, Addr: addr}
+	return append([]*NodeFormat{relay}, this.randomNodesLocked(ONION_PATH_LENGTH-1)...), nil
+}
+
+// nodes of failing paths only when not enough others. mu held by caller
+func (this *OnionClient) randomNodesLocked(n int) (nodes []*NodeFormat) {
+	for binpk, until := range this.badNodes {
+		if !this.clock.Now().Before(until) {
+			delete(this.badNodes, binpk)
+		}
+	}
+	var bads []*NodeFormat
+	for _, i := range rand.Perm(len(this.pathNodes)) {
+		if len(nodes) >= n {
+			break
+		}
+		if _, bad := this.badNodes[this.pathNodes[i].Pubkey.BinStr()]; bad {
+			bads = append(bads, this.pathNodes[i])
+			continue
+		}
+		nodes = append(nodes, this.pathNodes[i])
+	}
+	for _, node := range bads {
+		if len(nodes) >= n {
+			break
+		}
+		nodes = append(nodes, node)
+	}
+	return
+}
+
+// like path_timed_out, also when failing by score
+func (this *OnionClient) pathTimedOut(ps *onionPaths, i int) bool {
+	path := ps.paths[i]
+	if path == nil {
+		return true
+	}
+	if _, ok := path.addr1.(*net.TCPAddr); ok {
+		if this.relayLocked(path.nodepk1) == nil {
+			return true
+		}
+	} else if !this.udpEnabled() {
+		return true
+	}
+	return this.pathNoResponse(ps, i) || ps.failing(i) || this.timeout(ps.created[i], ONION_PATH_MAX_LIFETIME)
+}
+
+func (this *OnionClient) pathNoResponse(ps *onionPaths, i int) bool {
+	timeout := ONION_PATH_TIMEOUT
+	if ps.lastSuccess[i].IsZero() {
+		timeout = ONION_PATH_FIRST_TIMEOUT
+	}
+	return ps.noRspUses[i] >= ONION_PATH_MAX_NO_RESPONSE_USES && this.timeout(ps.lastUsed[i], timeout)
+}
+
+// like random_path, pathnum < 0 for one picked by score. Path is renewed if timed out.
+func (this *OnionClient) pathLocked(ps *onionPaths, pathnum int) (int, error) {
+	i := ps.pick()
+	if pathnum >= 0 {
+		i = pathnum % NUMBER_ONION_PATHS
+	}
+	if this.pathTimedOut(ps, i) {
+		return i, this.buildPathLocked(ps, i)
+	}
+	return i, nil
+}
+
+// send data to dest by a path of ps, return the path number used
+func (this *OnionClient) sendOnionLocked(ps *onionPaths, pathnum int, dest net.Addr, data []byte) (uint32, error) {
+	i, err := this.pathLocked(ps, pathnum)
+	if err != nil {
+		return 0, err
+	}
+	path := ps.paths[i]
+	if _, ok := path.addr1.(*net.TCPAddr); ok {
+		packet, err := path.CreatePacketTCP(dest, data)
+		if err != nil {
+			return 0, err
+		}
+		if err = this.relayLocked(path.nodepk1).SendOnionRequest(packet); err != nil {
+			return 0, err
+		}
+	} else {
+		packet, err := path.CreatePacket(dest, data)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = this.ncro.neto.WriteTo(packet, path.addr1); err != nil {
+			return 0, err
+		}
+	}
+	ps.lastUsed[i] = this.clock.Now()
+	ps.noRspUses[i]++
+	return path.pathnum, nil
+}
+
+// like client_send_announce_request, announce us when f is nil, else search f.
+// pathnum < 0 for a random path.
+func (this *OnionClient) sendAnnounceLocked(f *onionFriend, dest net.Addr, nodepk *CryptoKey,
+	pingid []byte, pathnum int) error {
+	now := this.clock.Now()
+	for id, sb := range this.sendbacks {
+		if now.Sub(sb.sent) >= ANNOUNCE_TIMEOUT*time.Second {
+			delete(this.sendbacks, id)
+		}
+	}
+	if len(this.sendbacks) >= ANNOUNCE_ARRAY_SIZE {
+		return errors.New("Too many announce requests pending")
+	}
+
+	ps, senderpk, sendersk := &this.selfPaths, this.ncro.SelfPubkey, this.ncro.SelfSeckey
+	searchpk, datpk := this.ncro.SelfPubkey, this.tmppk.Bytes()
+	sb := &onionSendback{nodepk: nodepk, addr: dest, sent: now}
+	if f != nil {
+		ps, senderpk, sendersk = &this.friendPaths, f.tmppk, f.tmpsk
+		searchpk, datpk = f.realpk, make([]byte, PUBLIC_KEY_SIZE)
+		sb.friendpk = f.realpk
+		pingid = nil
+	}
+	if pingid == nil {
+		pingid = make([]byte, ONION_PING_ID_SIZE)
+	}
+	sbid := rand.Uint64()
+	for this.sendbacks[sbid] != nil {
+		sbid = rand.Uint64()
+	}
+
+	// create_announce_request
+	plnbuf := gopp.NewBufferZero()
+	plnbuf.Write(pingid)
+	plnbuf.Write(searchpk.Bytes())
+	plnbuf.Write(datpk)
+	binary.Write(plnbuf, binary.BigEndian, sbid)
+	nonce := CBRandomNonce()
+	shrkey, err := CBBeforeNm(nodepk, sendersk)
+	if err != nil {
+		return err
+	}
+	encrypted, err := EncryptDataSymmetric(shrkey, nonce, plnbuf.Bytes())
+	if err != nil {
+		return err
+	}
+	buf := gopp.NewBufferZero()
+	buf.WriteByte(NET_PACKET_ANNOUNCE_REQUEST)
+	buf.Write(nonce.Bytes())
+	buf.Write(senderpk.Bytes())
+	buf.Write(encrypted)
+
+	sb.pathnum, err = this.sendOnionLocked(ps, pathnum, dest, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	ps.probes[sb.pathnum%NUMBER_ONION_PATHS]++
+	this.sendbacks[sbid] = sb
+	return nil
+}
+
+func (this *OnionClient) handleAnnounceResponse(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	return this.handleResponse(addr, data)
+}
+func (this *OnionClient) handleDataResponse(object interface{}, addr net.Addr, data []byte, cbdata interface{}) (int, error) {
+	return this.handleResponse(addr, data)
+}
+
+// responses by UDP, or by a TCP relay when addr is nil
+func (this *OnionClient) handleResponse(addr net.Addr, data []byte) (int, error) {
+	if len(data) == 0 {
+		return 1, errors.New("Empty onion response")
+	}
+	var err error
+	switch data[0] {
+	case NET_PACKET_ANNOUNCE_RESPONSE:
+		err = this.handleAnnounce(data)
+	case NET_PACKET_ONION_DATA_RESPONSE:
+		err = this.handleData(data)
+	default:
+		err = errors.Errorf("Invalid onion response: %d", data[0])
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+// like handle_announce_response
+func (this *OnionClient) handleAnnounce(data []byte) error {
+	if len(data) < ONION_ANNOUNCE_RESPONSE_MIN_SIZE || len(data) > ONION_ANNOUNCE_RESPONSE_MAX_SIZE {
+		return errors.Errorf("Invalid announce response size: %d", len(data))
+	}
+	sbid := binary.BigEndian.Uint64(data[1:])
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	sb, ok := this.sendbacks[sbid]
+	if !ok {
+		return errors.New("Announce response not requested")
+	}
+	delete(this.sendbacks, sbid)
+	var f *onionFriend
+	seckey := this.ncro.SelfSeckey
+	if sb.friendpk != nil {
+		if f, ok = this.friends[sb.friendpk.BinStr()]; !ok {
+			return errors.New("Announce response of friend deleted")
+		}
+		seckey = f.tmpsk
+	}
+	shrkey, err := CBBeforeNm(sb.nodepk, seckey)
+	if err != nil {
+		return err
+	}
+	pos := 1 + ONION_ANNOUNCE_SENDBACK_DATA_LENGTH
+	nonce := NewCBNonce(data[pos : pos+NONCE_SIZE])
+	plain, err := DecryptDataSymmetric(shrkey, nonce, data[pos+NONCE_SIZE:])
+	if err != nil {
+		return err
+	}
+	if len(plain) < 1+ONION_PING_ID_SIZE {
+		return errors.Errorf("Invalid announce response plain size: %d", len(plain))
+	}
+	var nodes []*NodeFormat
+	for rest := plain[1+ONION_PING_ID_SIZE:]; len(rest) > 0 && len(nodes) < MAX_SENT_NODES; {
+		node, n, err := UnpackNode(rest)
+		if err != nil {
+			break
+		}
+		nodes = append(nodes, node)
+		rest = rest[n:]
+	}
+
+	ps := &this.selfPaths
+	if f != nil {
+		ps = &this.friendPaths
+	}
+	// set_path_timeouts
+	if i := sb.pathnum % NUMBER_ONION_PATHS; ps.paths[i] != nil && ps.paths[i].pathnum == sb.pathnum {
+		ps.lastSuccess[i], ps.noRspUses[i] = this.clock.Now(), 0
+		ps.answered(int(i), this.clock.Now().Sub(sb.sent))
+	}
+	this.addPathNodeLocked(&NodeFormat{Pubkey: sb.nodepk, Addr: sb.addr})
+	this.addToListLocked(f, sb.nodepk, sb.addr, plain[0], plain[1:1+ONION_PING_ID_SIZE], sb.pathnum)
+	this.pingNodesLocked(f, nodes)
+	return nil
+}
+
+// like client_add_to_list, list kept with nodes closest to the searched pubkey
+func (this *OnionClient) addToListLocked(f *onionFriend, nodepk *CryptoKey, addr net.Addr,
+	isStored uint8, key []byte, pathnum uint32) {
+	list, maxn, refpk := &this.announced, MAX_ONION_CLIENTS_ANNOUNCE, this.ncro.SelfPubkey
+	if f != nil {
+		list, maxn, refpk = &f.list, MAX_ONION_CLIENTS, f.realpk
+		if isStored >= 2 {
+			return
+		}
+	}
+
+	var node *onionNode
+	for _, n := range list.nodes {
+		if n.pubkey.Equal2(nodepk) {
+			node = n
+		}
+	}
+	if node == nil {
+		node = &onionNode{pubkey: nodepk}
+		if len(list.nodes) < maxn {
+			list.nodes = append(list.nodes, node)
+		} else {
+			far := 0
+			for i, n := range list.nodes {
+				if this.timeout(n.lastRecv, ONION_NODE_TIMEOUT) {
+					far = i
+					break
+				}
+				if bytes.Compare(IDDistance(refpk, n.pubkey), IDDistance(refpk, list.nodes[far].pubkey)) > 0 {
+					far = i
+				}
+			}
+			old := list.nodes[far]
+			if !this.timeout(old.lastRecv, ONION_NODE_TIMEOUT) &&
+				bytes.Compare(IDDistance(refpk, nodepk), IDDistance(refpk, old.pubkey)) >= 0 {
+				return
+			}
+			list.nodes[far] = node
+		}
+	}
+	node.addr, node.pathnum = addr, pathnum
+	node.lastRecv = this.clock.Now()
+	if f == nil {
+		// stored on it when it knows our data pubkey
+		node.isStored = isStored == 2 || (isStored == 1 && bytes.Equal(key, this.tmppk.Bytes()))
+		node.pingid = append([]byte{}, key...)
+		if !node.isStored {
+			node.lastPinged = time.Time{}
+		}
+	} else {
+		node.isStored = isStored == 1
+		if node.isStored {
+			node.datpk = NewCryptoKey(append([]byte{}, key...))
+		}
+	}
+}
+
+// like client_ping_nodes, announce to or search on nodes closer than ours
+func (this *OnionClient) pingNodesLocked(f *onionFriend, nodes []*NodeFormat) {
+	list, maxn, refpk := &this.announced, MAX_ONION_CLIENTS_ANNOUNCE, this.ncro.SelfPubkey
+	if f != nil {
+		list, maxn, refpk = &f.list, MAX_ONION_CLIENTS, f.realpk
+	}
+	for k, t := range list.pinged {
+		if this.timeout(t, MIN_NODE_PING_TIME) {
+			delete(list.pinged, k)
+		}
+	}
+	for _, node := range nodes {
+		if _, ok := node.Addr.(*net.UDPAddr); !ok || len(list.pinged) >= MAX_STORED_PINGED_NODES {
+			continue
+		}
+		if _, ok := list.pinged[node.Pubkey.BinStr()]; ok {
+			continue
+		}
+		known, closer := false, len(list.nodes) < maxn
+		for _, n := range list.nodes {
+			if n.pubkey.Equal2(node.Pubkey) {
+				known = true
+			}
+			if bytes.Compare(IDDistance(refpk, node.Pubkey), IDDistance(refpk, n.pubkey)) < 0 {
+				closer = true
+			}
+		}
+		if known || !closer {
+			continue
+		}
+		if err := this.sendAnnounceLocked(f, node.Addr, node.Pubkey, nil, -1); err == nil {
+			list.pinged[node.Pubkey.BinStr()] = this.clock.Now()
+		}
+	}
+}
+
+// like handle_data_response, nonce | temp pubkey | encrypted(real pubkey | encrypted(data))
+func (this *OnionClient) handleData(data []byte) error {
+	if len(data) <= ONION_DATA_RESPONSE_MIN_SIZE+ONION_DATA_IN_RESPONSE_MIN_SIZE || len(data) > ONION_MAX_PACKET_SIZE {
+		return errors.Errorf("Invalid data response size: %d", len(data))
+	}
+	nonce := NewCBNonce(data[1 : 1+NONCE_SIZE])
+	randpk := NewCryptoKey(data[1+NONCE_SIZE : 1+NONCE_SIZE+PUBLIC_KEY_SIZE])
+	shrkey, err := CBBeforeNm(randpk, this.tmpsk)
+	if err != nil {
+		return err
+	}
+	tmpplain, err := DecryptDataSymmetric(shrkey, nonce, data[1+NONCE_SIZE+PUBLIC_KEY_SIZE:])
+	if err != nil {
+		return err
+	}
+	if len(tmpplain) <= ONION_DATA_IN_RESPONSE_MIN_SIZE {
+		return errors.Errorf("Invalid data response plain size: %d", len(tmpplain))
+	}
+	srcpk := NewCryptoKey(append([]byte{}, tmpplain[:PUBLIC_KEY_SIZE]...))
+	shrkey, err = CBBeforeNm(srcpk, this.ncro.SelfSeckey)
+	if err != nil {
+		return err
+	}
+	plain, err := DecryptDataSymmetric(shrkey, nonce, tmpplain[PUBLIC_KEY_SIZE:])
+	if err != nil {
+		return err
+	}
+	if len(plain) == 0 {
+		return errors.New("Empty onion data")
+	}
+	if plain[0] == ONION_DATA_DHTPK {
+		return this.handleDHTPK(srcpk, plain)
+	}
+	this.mu.Lock()
+	fn := this.handlers[plain[0]]
+	this.mu.Unlock()
+	if fn == nil {
+		return errors.Errorf("No onion data handler: %d", plain[0])
+	}
+	fn(srcpk, plain)
+	return nil
+}
+
+// like handle_dhtpk_announce
+func (this *OnionClient) handleDHTPK(srcpk *CryptoKey, data []byte) error {
+	if len(data) < DHTPK_DATA_MIN_LENGTH || len(data) > DHTPK_DATA_MAX_LENGTH {
+		return errors.Errorf("Invalid dhtpk size: %d", len(data))
+	}
+	this.mu.Lock()
+	f, ok := this.friends[srcpk.BinStr()]
+	if !ok {
+		this.mu.Unlock()
+		return errors.New("Dhtpk from stranger")
+	}
+	noreplay := binary.BigEndian.Uint64(data[1:])
+	if noreplay <= f.lastNoReplay {
+		this.mu.Unlock()
+		return errors.Errorf("Dhtpk replayed: %d", noreplay)
+	}
+	f.lastNoReplay = noreplay
+	f.dhtpk = NewCryptoKey(append([]byte{}, data[1+8:DHTPK_DATA_MIN_LENGTH]...))
+	dhtpk, fn := f.dhtpk, this.OnDHTPubkey
+	this.mu.Unlock()
+
+	var nodes []*NodeFormat
+	for rest := data[DHTPK_DATA_MIN_LENGTH:]; len(rest) > 0; {
+		node, n, err := UnpackNode(rest)
+		if err != nil {
+			break
+		}
+		nodes = append(nodes, node)
+		rest = rest[n:]
+	}
+	log.Println("Friend dht pubkey by onion:", srcpk.ToHex20(), dhtpk.ToHex20(), len(nodes))
+	if fn != nil {
+		fn(srcpk, dhtpk, nodes)
+	}
+	return nil
+}
+
+func (this *OnionClient) doOnionClientLoop() {
+	tickC, stop := this.clock.Tick(time.Second)
+	defer stop()
+	for {
+		select {
+		case <-tickC:
+			this.doOnionClient()
+		case <-this.stopC:
+			return
+		}
+	}
+}
+
+// like do_onion_client
+func (this *OnionClient) doOnionClient() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.dhto != nil && len(this.pathNodes) < MAX_PATH_NODES {
+		for _, node := range this.dhto.GetClosestNodes(this.ncro.dhtpk, MAX_SENT_NODES) {
+			this.addPathNodeLocked(node)
+		}
+	}
+	this.doPathsLocked(&this.selfPaths)
+	this.doPathsLocked(&this.friendPaths)
+	this.doAnnounceLocked()
+	for _, f := range this.friends {
+		this.doFriendLocked(f)
+	}
+}
+
+// like do_announce
+func (this *OnionClient) doAnnounceLocked() {
+	count := 0
+	for _, n := range this.announced.nodes {
+		if this.timeout(n.lastRecv, ONION_NODE_TIMEOUT) {
+			continue
+		}
+		count++
+		interval := ANNOUNCE_INTERVAL_NOT_ANNOUNCED
+		if i := n.pathnum % NUMBER_ONION_PATHS; n.isStored && this.selfPaths.paths[i] != nil &&
+			this.selfPaths.paths[i].pathnum == n.pathnum && !this.pathTimedOut(&this.selfPaths, int(i)) {
+			interval = ANNOUNCE_INTERVAL_ANNOUNCED
+		}
+		if this.timeout(n.lastPinged, interval) {
+			err := this.sendAnnounceLocked(nil, n.addr, n.pubkey, n.pingid, int(n.pathnum%NUMBER_ONION_PATHS))
+			if err == nil {
+				n.lastPinged = this.clock.Now()
+			}
+		}
+	}
+	if count < MAX_ONION_CLIENTS_ANNOUNCE {
+		for _, node := range this.randomNodesLocked(MAX_ONION_CLIENTS_ANNOUNCE / 2) {
+			this.sendAnnounceLocked(nil, node.Addr, node.Pubkey, nil, -1)
+		}
+	}
+}
+
+// like do_friend, search friend until it is online, and tell it our dht pubkey
+func (this *OnionClient) doFriendLocked(f *onionFriend) {
+	if f.online {
+		return
+	}
+	interval := ANNOUNCE_FRIEND
+	if f.runCount < RUN_COUNT_FRIEND_ANNOUNCE_BEGINNING {
+		interval = ANNOUNCE_FRIEND_BEGINNING
+	}
+	count := 0
+	for _, n := range f.list.nodes {
+		if this.timeout(n.lastRecv, ONION_NODE_TIMEOUT) {
+			continue
+		}
+		count++
+		if n.lastPinged.IsZero() {
+			n.lastPinged = this.clock.Now()
+			continue
+		}
+		if this.timeout(n.lastPinged, interval) {
+			if this.sendAnnounceLocked(f, n.addr, n.pubkey, nil, -1) == nil {
+				n.lastPinged = this.clock.Now()
+			}
+		}
+	}
+	if count < MAX_ONION_CLIENTS {
+		for _, node := range this.randomNodesLocked(MAX_ONION_CLIENTS / 2) {
+			this.sendAnnounceLocked(f, node.Addr, node.Pubkey, nil, -1)
+		}
+	}
+	f.runCount++
+
+	if this.timeout(f.lastDHTPKSent, ONION_DHTPK_SEND_INTERVAL) {
+		if n, _ := this.sendDHTPKLocked(f); n > 0 {
+			f.lastDHTPKSent = this.clock.Now()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package mintox
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Path pool of the onion client. Every slot is built ahead, announces sent on
+// a path are its probes, answer ratio and response time make its score. Paths
+// are picked weighted by score, retired when failing, their nodes left out of
+// new paths for a while, and the worst one rebuilt on a timer.
+
+const ONION_PATH_MIN_PROBES = 8        // announces sent on a path before it can fail
+const ONION_PATH_MIN_SUCCESS = 0.25    // answer ratio under which a path fails
+const ONION_PATH_ROTATE_INTERVAL = 300 // seconds, worst path rebuilt
+const ONION_PATH_NODE_PENALTY = 120    // seconds, nodes of a failed path not built with
+
+// answer ratio over response time, the prior for unbuilt and unanswered paths
+func (this *onionPaths) score(i int) float64 {
+	rtt := ONION_PATH_FIRST_TIMEOUT * time.Second / 2
+	if this.answers[i] > 0 {
+		rtt = this.rtt[i]
+	}
+	ratio := float64(this.answers[i]+1) / float64(this.probes[i]+2)
+	return ratio / (1 + rtt.Seconds())
+}
+
+func (this *onionPaths) failing(i int) bool {
+	return this.probes[i] >= ONION_PATH_MIN_PROBES &&
+		float64(this.answers[i]) < float64(this.probes[i])*ONION_PATH_MIN_SUCCESS
+}
+
+func (this *onionPaths) answered(i int, rtt time.Duration) {
+	if this.answers[i] == 0 {
+		this.rtt[i] = rtt
+	} else {
+		this.rtt[i] = (7*this.rtt[i] + rtt) / 8
+	}
+	this.answers[i]++
+}
+
+// random slot weighted by score
+func (this *onionPaths) pick() int {
+	var scores [NUMBER_ONION_PATHS]float64
+	total := 0.0
+	for i := range scores {
+		scores[i] = this.score(i)
+		total += scores[i]
+	}
+	r := rand.Float64() * total
+	for i, sc := range scores {
+		if r < sc {
+			return i
+		}
+		r -= sc
+	}
+	return NUMBER_ONION_PATHS - 1
+}
+
+// new path in slot i, nodes of a failed old one penalized. mu held by caller
+func (this *OnionClient) buildPathLocked(ps *onionPaths, i int) error {
+	if old := ps.paths[i]; old != nil && (ps.failing(i) || this.pathNoResponse(ps, i)) {
+		until := this.clock.Now().Add(ONION_PATH_NODE_PENALTY * time.Second)
+		for _, pk := range []*CryptoKey{old.nodepk1, old.nodepk2, old.nodepk3} {
+			this.badNodes[pk.BinStr()] = until
+		}
+	}
+	nodes, err := this.randomPathNodesLocked()
+	if err != nil {
+		return err
+	}
+	path := newOnionPath(this.ncro.dhtpk, this.ncro.dhtsk, nodes)
+	path.pathnum = rand.Uint32()/NUMBER_ONION_PATHS*NUMBER_ONION_PATHS + uint32(i)
+	ps.paths[i] = path
+	ps.created[i] = this.clock.Now()
+	ps.lastSuccess[i], ps.lastUsed[i], ps.noRspUses[i] = time.Time{}, time.Time{}, 0
+	ps.probes[i], ps.answers[i], ps.rtt[i] = 0, 0, 0
+	return nil
+}
+
+// fill the pool, rebuild the worst path each ONION_PATH_ROTATE_INTERVAL. mu held by caller
+func (this *OnionClient) doPathsLocked(ps *onionPaths) {
+	for i := range ps.paths {
+		if this.pathTimedOut(ps, i) {
+			if err := this.buildPathLocked(ps, i); err != nil {
+				return // not enough nodes yet
+			}
+		}
+	}
+	if ps.lastRotated.IsZero() {
+		ps.lastRotated = this.clock.Now()
+		return
+	}
+	if !this.timeout(ps.lastRotated, ONION_PATH_ROTATE_INTERVAL) {
+		return
+	}
+	ps.lastRotated = this.clock.Now()
+	worst := 0
+	for i := range ps.paths {
+		if ps.score(i) < ps.score(worst) {
+			worst = i
+		}
+	}
+	this.buildPathLocked(ps, worst)
+}
+
+// one path of the pool
+type OnionPathStats struct {
+	Pathnum uint32
+	Nodes   []*CryptoKey // hops, the first a TCP relay when Relay
+	Relay   bool
+	Age     time.Duration
+	Probes  int // announces sent
+	Answers int
+	RTT     time.Duration // smoothed, 0 if never answered
+	Score   float64
+}
+
+// PathStats of built paths announcing us, or searching friends
+func (this *OnionClient) PathStats(friend bool) (stats []OnionPathStats) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ps := &this.selfPaths
+	if friend {
+		ps = &this.friendPaths
+	}
+	for i, path := range ps.paths {
+		if path == nil {
+			continue
+		}
+		_, relay := path.addr1.(*net.TCPAddr)
+		stats = append(stats, OnionPathStats{
+			Pathnum: path.pathnum,
+			Nodes:   []*CryptoKey{path.nodepk1, path.nodepk2, path.nodepk3},
+			Relay:   relay,
+			Age:     this.clock.Now().Sub(ps.created[i]),
+			Probes:  ps.probes[i],
+			Answers: ps.answers[i],
+			RTT:     ps.rtt[i],
+			Score:   ps.score(i),
+		})
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOnionPathScore(t *testing.T) {
+	ps := &onionPaths{}
+	prior := ps.score(0)
+	for j := 0; j < ONION_PATH_MIN_PROBES; j++ {
+		ps.probes[0]++
+		ps.answered(0, 100*time.Millisecond)
+		ps.probes[1]++
+	}
+	ps.answered(1, time.Second)
+	if ps.rtt[0] != 100*time.Millisecond || ps.answers[0] != ONION_PATH_MIN_PROBES {
+		t.Error("answers:", ps.rtt[0], ps.answers[0])
+	}
+	if !(ps.score(0) > prior && prior > ps.score(1)) {
+		t.Error("scores:", ps.score(0), prior, ps.score(1))
+	}
+	if ps.failing(0) || !ps.failing(1) || ps.failing(2) {
+		t.Error("failing:", ps.failing(0), ps.failing(1), ps.failing(2))
+	}
+
+	var picks [NUMBER_ONION_PATHS]int
+	for j := 0; j < 3000; j++ {
+		picks[ps.pick()]++
+	}
+	if picks[0] <= picks[2] || picks[2] <= picks[1] {
+		t.Error("picks not weighted by score:", picks)
+	}
+}
+
+func TestOnionPathPool(t *testing.T) {
+	nc := newTstNetCrypto(newFakeTstClock())
+	defer nc.neto.srv.Close()
+	defer nc.Kill()
+	oc := NewOnionClient(nc, nil)
+	defer oc.Kill()
+	for i := 0; i < 2*ONION_PATH_LENGTH; i++ {
+		pk, _, _ := NewCBKeyPair()
+		oc.AddPathNode(&NodeFormat{Pubkey: pk, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1 + i}})
+	}
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	ps := &oc.selfPaths
+	oc.doPathsLocked(ps)
+	for i, path := range ps.paths {
+		if path == nil || int(path.pathnum%NUMBER_ONION_PATHS) != i {
+			t.Fatal("pool not filled:", i)
+		}
+	}
+
+	// failing path rebuilt without its nodes
+	old := ps.paths[0]
+	ps.probes[0] = ONION_PATH_MIN_PROBES
+	oc.doPathsLocked(ps)
+	if ps.paths[0] == old || ps.probes[0] != 0 || len(oc.badNodes) != ONION_PATH_LENGTH {
+		t.Fatal("failing path kept:", ps.probes[0], len(oc.badNodes))
+	}
+	for _, pk := range []*CryptoKey{ps.paths[0].nodepk1, ps.paths[0].nodepk2, ps.paths[0].nodepk3} {
+		if _, bad := oc.badNodes[pk.BinStr()]; bad {
+			t.Error("built with node of failed path:", pk)
+		}
+	}
+
+	// worst path rotated on timer, others kept
+	paths := ps.paths
+	ps.probes[3] = ONION_PATH_MIN_PROBES - 1
+	ps.lastRotated = oc.clock.Now().Add(-ONION_PATH_ROTATE_INTERVAL * time.Second)
+	oc.doPathsLocked(ps)
+	for i := range paths {
+		if (ps.paths[i] != paths[i]) != (i == 3) {
+			t.Error("rotated:", i)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// onion relay with announce store, like a bootstrap node
+type tstOnionNode struct {
+	dhto   *DHT
+	onion  *Onion
+	oniona *Onion_Announce
+}
+
+func newTstOnionNode() *tstOnionNode {
+	this := &tstOnionNode{dhto: NewDHT()}
+	this.onion = this.dhto.NewOnion()
+	this.oniona = NewOnionAnnounce(this.dhto)
+	return this
+}
+
+func (this *tstOnionNode) node() *NodeFormat {
+	port := this.dhto.Neto.srv.LocalAddr().(*net.UDPAddr).Port
+	return &NodeFormat{Pubkey: this.dhto.SelfPubkey, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func (this *tstOnionNode) kill() {
+	this.oniona.Kill()
+	this.onion.Kill()
+	this.dhto.Neto.srv.Close()
+}
+
+func TestOnionPathRoundTrip(t *testing.T) {
+	var nodes []*NodeFormat
+	for i := 0; i < ONION_PATH_LENGTH; i++ {
+		n := newTstOnionNode()
+		defer n.kill()
+		nodes = append(nodes, n.node())
+	}
+	src, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	src.SetReadDeadline(time.Now().Add(3 * time.Second))
+	dst.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	dhtpk, dhtsk, _ := NewCBKeyPair()
+	path := newOnionPath(dhtpk, dhtsk, nodes)
+	packet, err := path.CreatePacket(dst.LocalAddr(), []byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.WriteTo(packet, nodes[0].Addr); err != nil {
+		t.Fatal(err)
+	}
+
+	rdbuf := make([]byte, 2000)
+	rn, hop3, err := dst.ReadFrom(rdbuf)
+	if err != nil {
+		t.Fatal("onion request not delivered:", err)
+	}
+	if rn != len("request")+ONION_RETURN_3 || string(rdbuf[:len("request")]) != "request" {
+		t.Fatal("delivered data:", rn, string(rdbuf[:rn]))
+	}
+	if hop3.String() != nodes[2].Addr.String() {
+		t.Error("not delivered by last hop:", hop3)
+	}
+
+	rsp := []byte{NET_PACKET_ONION_RECV_3}
+	rsp = append(rsp, rdbuf[len("request"):rn]...)
+	rsp = append(rsp, "response"...)
+	if _, err := dst.WriteTo(rsp, hop3); err != nil {
+		t.Fatal(err)
+	}
+	rn, hop1, err := src.ReadFrom(rdbuf)
+	if err != nil {
+		t.Fatal("onion response not returned:", err)
+	}
+	if string(rdbuf[:rn]) != "response" || hop1.String() != nodes[0].Addr.String() {
+		t.Error("returned response:", string(rdbuf[:rn]), hop1)
+	}
+
+	// a changed byte fails decryption at first hop
+	packet[len(packet)-1] ^= 1
+	src.WriteTo(packet, nodes[0].Addr)
+	dst.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := dst.ReadFrom(rdbuf); err == nil {
+		t.Error("tampered onion request delivered")
+	}
+}
+
+func TestOnionClientFriendRequest(t *testing.T) {
+	var onodes []*tstOnionNode
+	for i := 0; i < 4; i++ {
+		n := newTstOnionNode()
+		defer n.kill()
+		onodes = append(onodes, n)
+	}
+	_, sk, _ := NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, onodes[0].onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+
+	clk := newFakeTstClock()
+	ms := []*Messenger{newTstMessenger(clk), newTstMessenger(clk)}
+	ocs := make([]*OnionClient, 2)
+	for i, m := range ms {
+		defer m.tstKill()
+		fcs := m.FriendConns()
+		ocs[i] = NewOnionClient(fcs.ncro, nil)
+		defer ocs[i].Kill()
+		for _, n := range onodes[1:] {
+			ocs[i].AddPathNode(n.node())
+		}
+		fcs.SetOnionClient(ocs[i])
+	}
+	// m1 reaches the onion by the relay only
+	ms[1].fcs.ncro.neto.SetUDPEnabled(false)
+	ms[0].fcs.ConnectTCPRelay(lsner.Addr().String(), srvo.Pubkey)
+	ms[1].fcs.ConnectTCPRelay(lsner.Addr().String(), srvo.Pubkey)
+
+	step := func(cond func() bool) bool {
+		for i := 0; i < 60; i++ {
+			clk.Advance(time.Second)
+			if waitTstCond(100*time.Millisecond, cond) {
+				return true
+			}
+		}
+		return false
+	}
+	if !step(func() bool { return ocs[0].Announced() > 0 && ocs[1].Announced() > 0 }) {
+		t.Fatal("not announced:", ocs[0].Announced(), ocs[1].Announced())
+	}
+	if srvo.Counters().OnionForwarded == 0 {
+		t.Error("onion of m1 not by relay")
+	}
+
+	reqC := make(chan []byte, 1)
+	ms[1].OnFriendRequest = func(pubkey *CryptoKey, msg []byte) {
+		if pubkey.Equal2(ms[0].SelfPubkey) {
+			select {
+			case reqC <- msg:
+			default:
+			}
+		}
+	}
+	fnum, err := ms[0].AddFriend(ms[1].Address(), []byte("found you"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg []byte
+	if !step(func() bool {
+		select {
+		case msg = <-reqC:
+			return true
+		default:
+			return false
+		}
+	}) || string(msg) != "found you" {
+		t.Fatal("friend request by onion not received:", string(msg))
+	}
+
+	fnum1, err := ms[1].AddFriendNorequest(ms[0].SelfPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !step(func() bool {
+		return ms[0].FriendConnectionStatus(fnum) == CONNECTION_TCP && ms[1].FriendConnectionStatus(fnum1) == CONNECTION_TCP
+	}) {
+		t.Fatal("friends not connected:", ms[0].FriendConnectionStatus(fnum), ms[1].FriendConnectionStatus(fnum1))
+	}
+	if dhtpk := ocs[1].FriendDHTPubkey(ms[0].SelfPubkey); dhtpk == nil || !dhtpk.Equal2(ms[0].fcs.ncro.dhtpk) {
+		t.Error("dht pubkey not learned by onion")
+	}
+}
@@ -0,0 +1,54 @@
+package mintox
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOnionResponseAmplification(t *testing.T) {
+	neto := &NetworkCore{}
+	dest := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445}
+	retdat := make([]byte, ONION_RETURN_3)
+	reqlen := ANNOUNCE_REQUEST_SIZE_RECV
+
+	err := neto.SendOnionResponseCapped(dest, make([]byte, reqlen*ONION_MAX_AMPLIFICATION), retdat, reqlen)
+	if err == nil {
+		t.Error("oversized onion response not dropped")
+	}
+	if n := atomic.LoadInt64(&neto.OnionAmplifyDropped); n != 1 {
+		t.Error("violation not counted:", n)
+	}
+	if !onionAmplificationOK(reqlen, 1+ONION_RETURN_3+ONION_ANNOUNCE_RESPONSE_MIN_SIZE+MAX_SENT_NODES*(SIZE_IPPORT+PUBLIC_KEY_SIZE)) {
+		t.Error("max announce response should pass")
+	}
+}
+
+func TestOnionForwardAmplification(t *testing.T) {
+	node := newTstOnionNode()
+	defer node.kill()
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445}
+	reqlen := 200
+	retpart, err := node.onion.createReturn(src, make([]byte, ONION_RETURN_1), reqlen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := func(ptype byte, n int) []byte {
+		rsp := append([]byte{NET_PACKET_ONION_RECV_2}, retpart...)
+		return append(append(rsp, ptype), make([]byte, n)...)
+	}
+
+	if _, err := node.onion.handle_recv_2(nil, src, response(NET_PACKET_ANNOUNCE_RESPONSE, 16), nil); err != nil {
+		t.Error("response in cap dropped:", err)
+	}
+	if _, err := node.onion.handle_recv_2(nil, src, response(NET_PACKET_ANNOUNCE_RESPONSE, reqlen*ONION_MAX_AMPLIFICATION), nil); err == nil {
+		t.Error("oversized response forwarded")
+	}
+	// others' data by a stored return part
+	if _, err := node.onion.handle_recv_2(nil, src, response(NET_PACKET_ONION_DATA_RESPONSE, reqlen*ONION_MAX_AMPLIFICATION), nil); err != nil {
+		t.Error("data response dropped:", err)
+	}
+	if n := atomic.LoadInt64(&node.dhto.Neto.OnionAmplifyDropped); n != 1 {
+		t.Error("violation not counted:", n)
+	}
+}
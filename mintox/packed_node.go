@@ -0,0 +1,105 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+/* ip + port, ARRAY_ENTRY_SIZE is the ipv4 one */
+const ARRAY_ENTRY_SIZE_IPV6 = (SIZE_IP6 + SIZE_PORT)
+
+const PACKED_NODE_SIZE_IP4 = (1 + SIZE_IP4 + SIZE_PORT + PUBLIC_KEY_SIZE)
+const PACKED_NODE_SIZE_IP6 = (1 + SIZE_IP6 + SIZE_PORT + PUBLIC_KEY_SIZE)
+
+// ip type | ip(4) | port | pubkey, ip type is TOX_AF_INET or TOX_TCP_INET for tcp addr
+func PackNodeV4(addr net.Addr, pubkey *CryptoKey) ([]byte, error) {
+	ip, port, istcp := splitNodeAddr(addr)
+	if ip == nil || ip.To4() == nil {
+		return nil, errors.Errorf("Not ipv4 addr: %v", addr)
+	}
+	iptype := byte(TOX_AF_INET)
+	if istcp {
+		iptype = TOX_TCP_INET
+	}
+	return packNode(iptype, ip.To4(), port, pubkey), nil
+}
+
+// ip type | ip(16) | port | pubkey, ipv4 addr packed as ipv4 mapped ipv6
+func PackNodeV6(addr net.Addr, pubkey *CryptoKey) ([]byte, error) {
+	ip, port, istcp := splitNodeAddr(addr)
+	if ip == nil || ip.To16() == nil {
+		return nil, errors.Errorf("Not ip addr: %v", addr)
+	}
+	iptype := byte(TOX_AF_INET6)
+	if istcp {
+		iptype = TOX_TCP_INET6
+	}
+	return packNode(iptype, ip.To16(), port, pubkey), nil
+}
+
+// ipv4 addr use v4 format, else v6
+func PackNode(addr net.Addr, pubkey *CryptoKey) ([]byte, error) {
+	if ip, _, _ := splitNodeAddr(addr); ip != nil && ip.To4() != nil {
+		return PackNodeV4(addr, pubkey)
+	}
+	return PackNodeV6(addr, pubkey)
+}
+
+// return node and used bytes of data. Addr is *net.TCPAddr for tcp ip type, else *net.UDPAddr
+func UnpackNode(data []byte) (*NodeFormat, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errors.New("Empty packed node")
+	}
+	iplen, istcp := 0, false
+	switch data[0] {
+	case TOX_AF_INET:
+		iplen = SIZE_IP4
+	case TOX_TCP_INET:
+		iplen, istcp = SIZE_IP4, true
+	case TOX_AF_INET6:
+		iplen = SIZE_IP6
+	case TOX_TCP_INET6:
+		iplen, istcp = SIZE_IP6, true
+	default:
+		return nil, 0, errors.Errorf("Invalid ip type: %d", data[0])
+	}
+	pktlen := 1 + iplen + SIZE_PORT + PUBLIC_KEY_SIZE
+	if len(data) < pktlen {
+		return nil, 0, errors.Errorf("Packed node too short: %d, want: %d", len(data), pktlen)
+	}
+	ip := make(net.IP, iplen)
+	copy(ip, data[1:1+iplen])
+	port := int(binary.BigEndian.Uint16(data[1+iplen:]))
+
+	node := &NodeFormat{}
+	node.Pubkey = NewCryptoKey(data[1+iplen+SIZE_PORT : pktlen])
+	if istcp {
+		node.Addr = &net.TCPAddr{IP: ip, Port: port}
+	} else {
+		node.Addr = &net.UDPAddr{IP: ip, Port: port}
+	}
+	return node, pktlen, nil
+}
+
+func packNode(iptype byte, ip net.IP, port uint16, pubkey *CryptoKey) []byte {
+	buf := make([]byte, 1+len(ip)+SIZE_PORT, 1+len(ip)+SIZE_PORT+PUBLIC_KEY_SIZE)
+	buf[0] = iptype
+	copy(buf[1:], ip)
+	binary.BigEndian.PutUint16(buf[1+len(ip):], port)
+	if pubkey != nil {
+		buf = append(buf, pubkey.Bytes()...)
+	}
+	return buf
+}
+
+func splitNodeAddr(addr net.Addr) (ip net.IP, port uint16, istcp bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port), false
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port), true
+	}
+	return nil, 0, false
+}
@@ -0,0 +1,47 @@
+package mintox
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestPackNode(t *testing.T) {
+	pk, _, _ := NewCBKeyPair()
+	udp4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445}
+	tcp6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	want4 := append([]byte{TOX_AF_INET, 127, 0, 0, 1, 0x82, 0xa5}, pk.Bytes()...)
+	want6 := append([]byte{TOX_TCP_INET6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb},
+		pk.Bytes()...)
+
+	pkt4, err := PackNodeV4(udp4, pk)
+	if err != nil || !bytes.Equal(pkt4, want4) || len(pkt4) != PACKED_NODE_SIZE_IP4 {
+		t.Errorf("v4 got: %x, %v", pkt4, err)
+	}
+	pkt6, err := PackNode(tcp6, pk)
+	if err != nil || !bytes.Equal(pkt6, want6) || len(pkt6) != PACKED_NODE_SIZE_IP6 {
+		t.Errorf("v6 got: %x, %v", pkt6, err)
+	}
+	if _, err := PackNodeV4(tcp6, pk); err == nil {
+		t.Error("packed ipv6 addr as v4")
+	}
+
+	// two nodes back to back
+	data := append(pkt4, pkt6...)
+	node, n, err := UnpackNode(data)
+	if err != nil || n != PACKED_NODE_SIZE_IP4 || node.Addr.String() != udp4.String() || !node.Pubkey.Equal2(pk) {
+		t.Error("unpack v4:", node, n, err)
+	}
+	node, n, err = UnpackNode(data[n:])
+	if err != nil || n != PACKED_NODE_SIZE_IP6 || node.Addr.String() != tcp6.String() || node.Addr.Network() != "tcp" {
+		t.Error("unpack v6:", node, n, err)
+	}
+
+	if _, _, err := UnpackNode(pkt6[:PACKED_NODE_SIZE_IP6-1]); err == nil {
+		t.Error("unpacked short data")
+	}
+	if _, _, err := UnpackNode(append([]byte{3}, pkt4[1:]...)); err == nil {
+		t.Error("unpacked invalid ip type")
+	}
+}
@@ -6,31 +6,73 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+/* Maximum newly announced nodes to ping per TIME_TO_PING seconds. */
+const MAX_TO_PING = 32
+
+/* Ping newly announced nodes to ping per TIME_TO_PING seconds*/
+const TIME_TO_PING = 2
+
 type Ping struct {
 	dhto       *DHT
 	neto       *NetworkCore
 	Pubkey     *CryptoKey
+	topingmu   sync.Mutex
 	ToPing     []*NodeFormat
 	LastToPing time.Time
+
+	pings *PingRegistry // ids of sent ping requests, responses must match one
 }
 
 func NewPing(dhto *DHT, pk *CryptoKey, neto *NetworkCore) *Ping {
 	this := &Ping{dhto: dhto, Pubkey: pk, neto: neto}
+	this.pings = NewPingRegistry(DHT_PING_ARRAY_SIZE, PING_TIMEOUT*time.Second)
 
 	neto.RegisterHandle(NET_PACKET_PING_REQUEST, this.HandlePingRequest, this)
 	neto.RegisterHandle(NET_PACKET_PING_RESPONSE, this.HandlePingResponse, this)
 	return this
 }
 
+// like add_to_ping, queue node at most MAX_TO_PING, dup ignored
+func (this *Ping) addToPing(node *NodeFormat) bool {
+	this.topingmu.Lock()
+	defer this.topingmu.Unlock()
+	if len(this.ToPing) >= MAX_TO_PING {
+		return false
+	}
+	for _, n := range this.ToPing {
+		if n.Key() == node.Key() {
+			return false
+		}
+	}
+	this.ToPing = append(this.ToPing, node)
+	return true
+}
+
+func (this *Ping) takeToPing() (nodes []*NodeFormat) {
+	this.topingmu.Lock()
+	defer this.topingmu.Unlock()
+	nodes, this.ToPing = this.ToPing, nil
+	this.LastToPing = time.Now()
+	return
+}
+
 func (this *Ping) HandlePingRequest(object interface{}, source net.Addr, packet []byte, cbdata interface{}) (int, error) {
+	if len(packet) != 1+PUBLIC_KEY_SIZE+NONCE_SIZE+1+8+MAC_SIZE {
+		return 1, errors.Errorf("Invalid ping request length: %d", len(packet))
+	}
 	pubkey := NewCryptoKey(packet[1 : 1+PUBLIC_KEY_SIZE])
 	nonce := NewCBNonce(packet[1+PUBLIC_KEY_SIZE : 1+PUBLIC_KEY_SIZE+NONCE_SIZE])
 	shrkey := this.dhto.GetSharedKeyRecv(pubkey)
 	plain, err := DecryptDataSymmetric(shrkey, nonce, packet[1+PUBLIC_KEY_SIZE+NONCE_SIZE:])
-	gopp.ErrPrint(err)
+	if err != nil || len(plain) != 1+8 {
+		return 1, errors.Errorf("Invalid ping request: %v", err)
+	}
 
 	var pingid uint64
 	err = binary.Read(gopp.NewBufferBuf(plain[1:]), binary.BigEndian, &pingid)
@@ -42,7 +84,22 @@ func (this *Ping) HandlePingRequest(object interface{}, source net.Addr, packet
 }
 
 func (this *Ping) HandlePingResponse(object interface{}, source net.Addr, packet []byte, cbdata interface{}) (int, error) {
-	log.Println("ping response from:", source, len(packet))
+	if len(packet) != 1+PUBLIC_KEY_SIZE+NONCE_SIZE+1+8+MAC_SIZE {
+		return 1, errors.Errorf("Invalid ping response length: %d", len(packet))
+	}
+	pubkey := NewCryptoKey(packet[1 : 1+PUBLIC_KEY_SIZE])
+	nonce := NewCBNonce(packet[1+PUBLIC_KEY_SIZE : 1+PUBLIC_KEY_SIZE+NONCE_SIZE])
+	shrkey := this.dhto.GetSharedKeySent(pubkey)
+	plain, err := DecryptDataSymmetric(shrkey, nonce, packet[1+PUBLIC_KEY_SIZE+NONCE_SIZE:])
+	if err != nil || plain[0] != NET_PACKET_PING_RESPONSE {
+		return 1, errors.Errorf("Invalid ping response: %v", err)
+	}
+	pingid := binary.BigEndian.Uint64(plain[1:])
+	if _, ok := this.pings.Match(pingid); !ok {
+		return 1, errors.Errorf("Unknown ping id: %d, %v", pingid, source)
+	}
+	log.Println("ping response from:", source, pubkey.ToHex20())
+	this.dhto.friendPinged(pubkey, source)
 	return 0, nil
 }
 
@@ -79,6 +136,7 @@ func (this *Ping) SendPingRequest(addr net.Addr, pubkey *CryptoKey) {
 	plnpkt.WriteByte(byte(NET_PACKET_PING_REQUEST))
 	pingid := rand.Uint64()
 	gopp.CmpAndSwapN(&pingid, 0, 1)
+	this.pings.Add(pingid)
 	binary.Write(plnpkt, binary.BigEndian, pingid)
 
 	nonce := CBRandomNonce()
@@ -0,0 +1,117 @@
+package mintox
+
+import (
+	"sync"
+	"time"
+)
+
+const TCP_MAX_PENDING_PINGS = 16
+const TCP_PING_EXPIRE = 10 // seconds
+
+// outstanding ping ids with their send time, bounded.
+// zero value is usable with default limits.
+type PingRegistry struct {
+	MaxPending int           // default TCP_MAX_PENDING_PINGS
+	Expire     time.Duration // default TCP_PING_EXPIRE seconds
+
+	mu      sync.Mutex
+	pending map[uint64]time.Time
+	expired int64
+}
+
+func NewPingRegistry(maxPending int, expire time.Duration) *PingRegistry {
+	return &PingRegistry{MaxPending: maxPending, Expire: expire}
+}
+
+func (this *PingRegistry) limits() (int, time.Duration) {
+	maxPending, expire := this.MaxPending, this.Expire
+	if maxPending <= 0 {
+		maxPending = TCP_MAX_PENDING_PINGS
+	}
+	if expire <= 0 {
+		expire = TCP_PING_EXPIRE * time.Second
+	}
+	return maxPending, expire
+}
+
+// Add records ping id sent now. When full, expired ones are dropped first,
+// then the oldest one.
+func (this *PingRegistry) Add(pingid uint64) {
+	this.addAt(pingid, time.Now())
+}
+
+func (this *PingRegistry) addAt(pingid uint64, sentAt time.Time) {
+	maxPending, _ := this.limits()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.pending == nil {
+		this.pending = map[uint64]time.Time{}
+	}
+	if _, ok := this.pending[pingid]; !ok && len(this.pending) >= maxPending {
+		this.expireLocked(sentAt)
+	}
+	for len(this.pending) >= maxPending {
+		var oldid uint64
+		var oldat time.Time
+		for id, at := range this.pending {
+			if oldat.IsZero() || at.Before(oldat) {
+				oldid, oldat = id, at
+			}
+		}
+		delete(this.pending, oldid)
+		this.expired++
+	}
+	this.pending[pingid] = sentAt
+}
+
+// Match removes ping id and returns its round trip time.
+// ok is false for unknown, expired or already matched id.
+func (this *PingRegistry) Match(pongid uint64) (rtt time.Duration, ok bool) {
+	_, expire := this.limits()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	sentAt, ok := this.pending[pongid]
+	if !ok {
+		return 0, false
+	}
+	delete(this.pending, pongid)
+	rtt = time.Since(sentAt)
+	if rtt > expire {
+		this.expired++
+		return 0, false
+	}
+	return rtt, true
+}
+
+// ExpireOld drops unmatched pings older than Expire, returns dropped count.
+func (this *PingRegistry) ExpireOld() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.expireLocked(time.Now())
+}
+
+func (this *PingRegistry) expireLocked(now time.Time) int {
+	_, expire := this.limits()
+	n := 0
+	for id, at := range this.pending {
+		if now.Sub(at) > expire {
+			delete(this.pending, id)
+			n++
+		}
+	}
+	this.expired += int64(n)
+	return n
+}
+
+func (this *PingRegistry) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.pending)
+}
+
+// count of pings dropped without matched pong
+func (this *PingRegistry) Expired() int64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.expired
+}
@@ -0,0 +1,50 @@
+package mintox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingRegistry(t *testing.T) {
+	reg := NewPingRegistry(4, time.Second)
+	now := time.Now()
+	for i := 1; i <= 6; i++ {
+		reg.addAt(uint64(i), now.Add(time.Duration(i-10)*time.Millisecond))
+	}
+	if reg.Len() != 4 {
+		t.Error("registry not bounded:", reg.Len())
+	}
+	if _, ok := reg.Match(1); ok {
+		t.Error("oldest ping should be evicted")
+	}
+	if rtt, ok := reg.Match(6); !ok || rtt <= 0 {
+		t.Error("ping not matched:", rtt, ok)
+	}
+	if _, ok := reg.Match(6); ok {
+		t.Error("ping matched twice")
+	}
+
+	reg.addAt(7, now.Add(-2*time.Second))
+	if n := reg.ExpireOld(); n != 1 {
+		t.Error("expired count:", n)
+	}
+	if reg.Expired() != 3 {
+		t.Error("total expired:", reg.Expired())
+	}
+}
+
+func TestClientPingRTT(t *testing.T) {
+	cli, secon := newTstClientPair(t)
+	defer secon.Close()
+	if cli.RTT() <= 0 || cli.SRTT() <= 0 {
+		t.Error("no rtt from first ping")
+	}
+	for i := 0; i < 3; i++ {
+		if err := cli.SendPing(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitTstCond(3*time.Second, func() bool { return cli.PendingPings() == 0 }) {
+		t.Error("pongs not matched:", cli.PendingPings())
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !mintoxdebug
+// +build !mintoxdebug
+
+package mintox
+
+const checkQueueAccountingDefault = false
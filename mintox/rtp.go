@@ -0,0 +1,283 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/* Lossy packet ids of media, payload type is them % 128 */
+const (
+	RTP_TYPE_AUDIO = 192
+	RTP_TYPE_VIDEO = 193
+)
+
+const RTP_HEADER_SIZE = 80
+const RTP_PADDING_FIELDS = 11 /* Zero uint32s between the full and lower fields, were csrc. */
+const RTP_MAX_PAYLOAD = (MAX_CRYPTO_DATA_SIZE - 1 - RTP_HEADER_SIZE)
+const RTP_MAX_FRAME_SIZE = 4 * 1024 * 1024 /* Larger frames not sent nor reassembled. */
+const RTP_WORK_BUFFERS = 3                 /* Frames reassembled at once, like USED_RTP_WORKBUFFER_COUNT. */
+
+/* Flags of RTPHeader */
+const (
+	RTP_LARGE_FRAME = 1 << 0 // offset and length by the full fields
+	RTP_KEY_FRAME   = 1 << 1
+)
+
+// like RTPHeader of toxav, network byte order
+type rtpHeader struct {
+	ve, pe, xe, cc uint8 // ve 2, others 0
+	ma, pt         uint8
+	sequnum        uint16
+	timestamp      uint32
+	ssrc           uint32
+	flags          uint64
+	offsetFull     uint32
+	lengthFull     uint32
+	receivedFull   uint32 // not used
+	offsetLower    uint16
+	lengthLower    uint16
+}
+
+// like rtp_header_pack
+func (this *rtpHeader) bytes() []byte {
+	buf := make([]byte, RTP_HEADER_SIZE)
+	buf[0] = (this.ve&3)<<6 | (this.pe&1)<<5 | (this.xe&1)<<4 | this.cc&0xf
+	buf[1] = (this.ma&1)<<7 | this.pt&0x7f
+	binary.BigEndian.PutUint16(buf[2:], this.sequnum)
+	binary.BigEndian.PutUint32(buf[4:], this.timestamp)
+	binary.BigEndian.PutUint32(buf[8:], this.ssrc)
+	binary.BigEndian.PutUint64(buf[12:], this.flags)
+	binary.BigEndian.PutUint32(buf[20:], this.offsetFull)
+	binary.BigEndian.PutUint32(buf[24:], this.lengthFull)
+	binary.BigEndian.PutUint32(buf[28:], this.receivedFull)
+	off := 32 + RTP_PADDING_FIELDS*4
+	binary.BigEndian.PutUint16(buf[off:], this.offsetLower)
+	binary.BigEndian.PutUint16(buf[off+2:], this.lengthLower)
+	return buf
+}
+
+// like rtp_header_unpack
+func parseRTPHeader(data []byte) (*rtpHeader, error) {
+	if len(data) < RTP_HEADER_SIZE {
+		return nil, errors.Errorf("Invalid rtp header length: %d", len(data))
+	}
+	this := &rtpHeader{}
+	this.ve, this.pe, this.xe, this.cc = data[0]>>6, data[0]>>5&1, data[0]>>4&1, data[0]&0xf
+	this.ma, this.pt = data[1]>>7, data[1]&0x7f
+	this.sequnum = binary.BigEndian.Uint16(data[2:])
+	this.timestamp = binary.BigEndian.Uint32(data[4:])
+	this.ssrc = binary.BigEndian.Uint32(data[8:])
+	this.flags = binary.BigEndian.Uint64(data[12:])
+	this.offsetFull = binary.BigEndian.Uint32(data[20:])
+	this.lengthFull = binary.BigEndian.Uint32(data[24:])
+	this.receivedFull = binary.BigEndian.Uint32(data[28:])
+	off := 32 + RTP_PADDING_FIELDS*4
+	this.offsetLower = binary.BigEndian.Uint16(data[off:])
+	this.lengthLower = binary.BigEndian.Uint16(data[off+2:])
+	if this.ve != 2 {
+		return nil, errors.Errorf("Invalid rtp version: %d", this.ve)
+	}
+	return this, nil
+}
+
+// offset and length of the frame a packet is part of
+func (this *rtpHeader) span() (offset, length uint32) {
+	if this.flags&RTP_LARGE_FRAME != 0 {
+		return this.offsetFull, this.lengthFull
+	}
+	return uint32(this.offsetLower), uint32(this.lengthLower)
+}
+
+// RTPFrame is one encoded audio or video frame of a friend
+type RTPFrame struct {
+	Type      uint8 // RTP_TYPE_*
+	Seq       uint16
+	Timestamp uint32 // ms of sender
+	Keyframe  bool
+	Complete  bool   // false when parts lost, missing bytes zero
+	Data      []byte // as given to SendFrame
+}
+
+// frame being reassembled
+type rtpWork struct {
+	frame  *RTPFrame
+	got    map[uint32]bool // offsets of parts received
+	recved uint32
+}
+
+// frames of a friend and type being reassembled
+type rtpRecv struct {
+	work    []*rtpWork // by Seq
+	lastSeq uint16     // of frame given last
+	started bool
+}
+
+type rtpKey struct {
+	fnum uint32
+	typ  uint8
+}
+
+// like RTPSession of toxav, encoded audio and video frames of friends over
+// lossy packets of Messenger, split into packets and reassembled. Encoding,
+// like by opus or vpx, and jitter buffering are of the app.
+type RTPSession struct {
+	m    *Messenger
+	ssrc uint32
+
+	mu    sync.Mutex
+	seqs  map[rtpKey]uint16 // next sequnum sent
+	recvs map[rtpKey]*rtpRecv
+
+	// frames in Seq order, a partial one when newer ones complete or
+	// RTP_WORK_BUFFERS wait
+	OnFrame func(fnum uint32, frame *RTPFrame)
+}
+
+func NewRTPSession(m *Messenger) *RTPSession {
+	this := &RTPSession{}
+	this.m = m
+	this.ssrc = rand.Uint32()
+	this.seqs = map[rtpKey]uint16{}
+	this.recvs = map[rtpKey]*rtpRecv{}
+	m.mu.Lock()
+	m.rtp = this
+	m.mu.Unlock()
+	return this
+}
+
+// SendFrame like rtp_send_data, frame to online friend split into packets
+// of one sequence number, typ RTP_TYPE_*
+func (this *RTPSession) SendFrame(fnum uint32, typ uint8, frame []byte, keyframe bool) error {
+	if typ != RTP_TYPE_AUDIO && typ != RTP_TYPE_VIDEO {
+		return errors.Errorf("Invalid rtp type: %d", typ)
+	}
+	if len(frame) == 0 || len(frame) > RTP_MAX_FRAME_SIZE {
+		return errors.Errorf("Invalid frame length: %d", len(frame))
+	}
+	key := rtpKey{fnum, typ}
+	this.mu.Lock()
+	seq := this.seqs[key]
+	this.seqs[key] = seq + 1
+	this.mu.Unlock()
+
+	hdr := &rtpHeader{ve: 2, pt: typ % 128, sequnum: seq, ssrc: this.ssrc}
+	hdr.timestamp = uint32(this.m.clock.Now().UnixNano() / 1e6)
+	if typ == RTP_TYPE_VIDEO {
+		hdr.flags |= RTP_LARGE_FRAME
+	}
+	if keyframe {
+		hdr.flags |= RTP_KEY_FRAME
+	}
+	hdr.lengthFull, hdr.lengthLower = uint32(len(frame)), uint16(len(frame))
+	for off := 0; off < len(frame); off += RTP_MAX_PAYLOAD {
+		end := off + RTP_MAX_PAYLOAD
+		if end > len(frame) {
+			end = len(frame)
+		}
+		hdr.offsetFull, hdr.offsetLower = uint32(off), uint16(off)
+		pkt := append(append([]byte{typ}, hdr.bytes()...), frame[off:end]...)
+		if err := this.m.sendFriendLossy(fnum, pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// like handle_rtp_packet, typ | header | part of frame
+func (this *RTPSession) handlePacket(fnum uint32, data []byte) {
+	hdr, err := parseRTPHeader(data[1:])
+	if err != nil || hdr.pt != data[0]%128 {
+		return
+	}
+	part := data[1+RTP_HEADER_SIZE:]
+	offset, length := hdr.span()
+	if len(part) == 0 || length == 0 || length > RTP_MAX_FRAME_SIZE ||
+		uint64(offset)+uint64(len(part)) > uint64(length) {
+		return
+	}
+
+	this.mu.Lock()
+	key := rtpKey{fnum, data[0]}
+	r := this.recvs[key]
+	if r == nil {
+		r = &rtpRecv{}
+		this.recvs[key] = r
+	}
+	frames := r.addLocked(hdr, data[0], offset, length, part)
+	fn := this.OnFrame
+	this.mu.Unlock()
+	if fn != nil {
+		for _, frame := range frames {
+			fn(fnum, frame)
+		}
+	}
+}
+
+// frames to give, older ones than a complete one partial. mu held by caller
+func (this *rtpRecv) addLocked(hdr *rtpHeader, typ uint8, offset, length uint32, part []byte) (frames []*RTPFrame) {
+	if this.started && int16(hdr.sequnum-this.lastSeq) <= 0 {
+		return nil // late part of a frame given
+	}
+	idx := len(this.work)
+	for i, w := range this.work {
+		if w.frame.Seq == hdr.sequnum {
+			idx = i
+			break
+		}
+		if int16(hdr.sequnum-w.frame.Seq) < 0 {
+			idx = i
+			this.work = append(this.work[:i], append([]*rtpWork{nil}, this.work[i:]...)...)
+			break
+		}
+	}
+	if idx == len(this.work) {
+		this.work = append(this.work, nil)
+	}
+	w := this.work[idx]
+	if w == nil {
+		w = &rtpWork{got: map[uint32]bool{}}
+		w.frame = &RTPFrame{Type: typ, Seq: hdr.sequnum, Timestamp: hdr.timestamp,
+			Keyframe: hdr.flags&RTP_KEY_FRAME != 0, Data: make([]byte, length)}
+		this.work[idx] = w
+	}
+	if uint32(len(w.frame.Data)) != length {
+		return nil // not of this frame
+	}
+	if !w.got[offset] {
+		w.got[offset] = true
+		w.recved += uint32(copy(w.frame.Data[offset:], part))
+	}
+
+	n := 0 // frames given from the front of work
+	if w.recved >= length {
+		w.frame.Complete = true
+		n = idx + 1
+	} else if len(this.work) > RTP_WORK_BUFFERS {
+		n = len(this.work) - RTP_WORK_BUFFERS
+	}
+	for _, w := range this.work[:n] {
+		frames = append(frames, w.frame)
+		this.lastSeq, this.started = w.frame.Seq, true
+	}
+	this.work = append(this.work[:0], this.work[n:]...)
+	return
+}
+
+func (this *RTPSession) handleFriendStatus(fnum uint32, online bool) {
+	if !online {
+		this.delFriend(fnum)
+	}
+}
+
+// frames reassembled dropped, sequence numbers start over
+func (this *RTPSession) delFriend(fnum uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, typ := range []uint8{RTP_TYPE_AUDIO, RTP_TYPE_VIDEO} {
+		delete(this.seqs, rtpKey{fnum, typ})
+		delete(this.recvs, rtpKey{fnum, typ})
+	}
+}
@@ -0,0 +1,145 @@
+package mintox
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRTPHeader(t *testing.T) {
+	hdr := &rtpHeader{ve: 2, pt: RTP_TYPE_VIDEO % 128, sequnum: 65535, timestamp: 123456, ssrc: 7,
+		flags: RTP_LARGE_FRAME | RTP_KEY_FRAME, offsetFull: 70000, lengthFull: 90000, offsetLower: 4464, lengthLower: 24464}
+	buf := hdr.bytes()
+	if len(buf) != RTP_HEADER_SIZE || buf[0] != 0x80 || buf[1] != 65 {
+		t.Fatal("rtp header:", buf)
+	}
+	hdr2, err := parseRTPHeader(buf)
+	if err != nil || *hdr2 != *hdr {
+		t.Fatal("parse:", hdr2, err)
+	}
+	if off, length := hdr2.span(); off != 70000 || length != 90000 {
+		t.Error("large frame span:", off, length)
+	}
+	hdr2.flags = 0
+	if off, length := hdr2.span(); off != 4464 || length != 24464 {
+		t.Error("span:", off, length)
+	}
+	buf[0] = 0x40
+	if _, err := parseRTPHeader(buf); err == nil {
+		t.Error("rtp version 1 parsed")
+	}
+	if _, err := parseRTPHeader(buf[:RTP_HEADER_SIZE-1]); err == nil {
+		t.Error("short header parsed")
+	}
+}
+
+// parts of a frame by the same sequnum, lost and reordered ones
+func TestRTPReassemble(t *testing.T) {
+	s := &RTPSession{recvs: map[rtpKey]*rtpRecv{}}
+	var frames []*RTPFrame
+	s.OnFrame = func(fnum uint32, frame *RTPFrame) { frames = append(frames, frame) }
+	frame := bytes.Repeat([]byte("0123456789"), RTP_MAX_PAYLOAD/4)
+	parts := func(seq uint16) (pkts [][]byte) {
+		hdr := &rtpHeader{ve: 2, pt: RTP_TYPE_VIDEO % 128, sequnum: seq, timestamp: uint32(seq) * 40,
+			flags: RTP_LARGE_FRAME, lengthFull: uint32(len(frame))}
+		for off := 0; off < len(frame); off += RTP_MAX_PAYLOAD {
+			end := off + RTP_MAX_PAYLOAD
+			if end > len(frame) {
+				end = len(frame)
+			}
+			hdr.offsetFull = uint32(off)
+			pkts = append(pkts, append(append([]byte{RTP_TYPE_VIDEO}, hdr.bytes()...), frame[off:end]...))
+		}
+		return
+	}
+	if ps := parts(0); len(ps) != 3 {
+		t.Fatal("parts:", len(ps))
+	}
+
+	p0, p1 := parts(65534), parts(65535)
+	s.handlePacket(0, p1[2])
+	s.handlePacket(0, p0[1])
+	s.handlePacket(0, p1[0])
+	s.handlePacket(0, p1[0]) // duplicate
+	if len(frames) != 0 {
+		t.Fatal("incomplete frame given:", len(frames))
+	}
+	s.handlePacket(0, p1[1])
+	if len(frames) != 2 || frames[0].Seq != 65534 || frames[0].Complete || !frames[1].Complete ||
+		!bytes.Equal(frames[1].Data, frame) || frames[1].Timestamp != 65535*40 {
+		t.Fatal("frames:", frames)
+	}
+	s.handlePacket(0, p0[0]) // late
+	frames = nil
+	// waiting ones pushed out in order, seq wraps
+	for seq := uint16(0); seq < RTP_WORK_BUFFERS+1; seq++ {
+		s.handlePacket(0, parts(seq)[0])
+	}
+	if len(frames) != 1 || frames[0].Seq != 0 || frames[0].Complete {
+		t.Fatal("pushed out:", frames)
+	}
+	bad := parts(9)[2]
+	bad[1+26] = 0 // lengthFull smaller than offset
+	s.handlePacket(0, bad)
+	if len(frames) != 1 {
+		t.Error("invalid part taken")
+	}
+}
+
+func TestRTPSendFrame(t *testing.T) {
+	clk := newFakeTstClock()
+	m0, m1, fnum0, fnum1 := newTstFriendPair(t, clk)
+	defer m0.tstKill()
+	defer m1.tstKill()
+	s0, s1 := NewRTPSession(m0), NewRTPSession(m1)
+	frameC := make(chan *RTPFrame, 8)
+	s1.OnFrame = func(fnum uint32, frame *RTPFrame) {
+		if fnum == fnum1 {
+			frameC <- frame
+		}
+	}
+	lossyC := make(chan []byte, 4)
+	m1.OnFriendLossyPacket = func(fnum uint32, data []byte) { lossyC <- data }
+
+	video := bytes.Repeat([]byte{1, 2, 3}, 2000)
+	audio := []byte("opus frame")
+	if err := s0.SendFrame(fnum0, RTP_TYPE_VIDEO, video, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s0.SendFrame(fnum0, RTP_TYPE_AUDIO, audio, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s0.SendFrame(fnum0, RTP_TYPE_VIDEO+1, audio, false); err == nil {
+		t.Error("invalid type sent")
+	}
+	if err := m0.SendLossyPacket(fnum0, []byte{PACKET_ID_LOSSY_RANGE_START + PACKET_LOSSY_AV_RESERVED, 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m0.SendLossyPacket(fnum0, []byte{RTP_TYPE_AUDIO, 9}); err == nil {
+		t.Error("A/V id sent as custom lossy")
+	}
+
+	got := map[uint8]*RTPFrame{}
+	for len(got) < 2 {
+		select {
+		case frame := <-frameC:
+			got[frame.Type] = frame
+		case <-time.After(3 * time.Second):
+			t.Fatal("frames not got:", got)
+		}
+	}
+	if f := got[RTP_TYPE_VIDEO]; !f.Complete || !f.Keyframe || !bytes.Equal(f.Data, video) {
+		t.Error("video frame:", f.Seq, f.Complete, f.Keyframe, len(f.Data))
+	}
+	if f := got[RTP_TYPE_AUDIO]; !f.Complete || f.Keyframe || !bytes.Equal(f.Data, audio) {
+		t.Error("audio frame:", f)
+	}
+	select {
+	case data := <-lossyC:
+		if data[1] != 9 {
+			t.Error("custom lossy:", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("custom lossy not got")
+	}
+}
@@ -0,0 +1,399 @@
+package mintox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopp"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* savedata of toxcore, sections of: length | type | cookie type | data, little endian */
+const STATE_COOKIE_GLOBAL = 0x15ed1b1f
+const STATE_COOKIE_TYPE = 0x01ce
+
+const (
+	STATE_TYPE_NOSPAMKEYS    = 1
+	STATE_TYPE_DHT           = 2
+	STATE_TYPE_FRIENDS       = 3
+	STATE_TYPE_NAME          = 4
+	STATE_TYPE_STATUSMESSAGE = 5
+	STATE_TYPE_STATUS        = 6
+	STATE_TYPE_TCP_RELAY     = 10
+	STATE_TYPE_PATH_NODE     = 11
+	STATE_TYPE_CONFERENCES   = 20
+	STATE_TYPE_GC_GROUPS     = 21 // ours, not the msgpack groups of toxcore
+	STATE_TYPE_END           = 255
+)
+
+const DHT_STATE_COOKIE_GLOBAL = 0x159000d
+const DHT_STATE_COOKIE_TYPE = 0x11ce
+const DHT_STATE_TYPE_NODES = 4
+
+const MAX_SAVED_DHT_NODES = (((DHT_FAKE_FRIEND_NUMBER * MAX_FRIEND_CLIENTS) + LCLIENT_LIST) * 2)
+
+/* request message saved with friend not confirmed */
+const SAVED_FRIEND_REQUEST_SIZE = 1024
+
+/* like friend_size(), fields of Saved_Friend without padding, lengths big endian */
+const SAVED_FRIEND_SIZE = (1 + PUBLIC_KEY_SIZE + SAVED_FRIEND_REQUEST_SIZE + 2 + MAX_NAME_LENGTH + 2 +
+	MAX_STATUSMESSAGE_LENGTH + 2 + 1 + 4 + 8)
+
+type SavedFriend struct {
+	Status        uint8 // FRIEND_*, below FRIEND_CONFIRMED request not accepted yet
+	Pubkey        *CryptoKey
+	RequestMsg    []byte // while not confirmed
+	Nospam        uint32 // while not confirmed
+	Name          []byte
+	StatusMessage []byte
+	UserStatus    uint8
+	LastSeen      time.Time
+}
+
+// SaveData is toxcore savedata, the one c-toxcore clients load and save.
+type SaveData struct {
+	Nospam        uint32
+	Pubkey        *CryptoKey
+	Seckey        *CryptoKey
+	Name          []byte
+	StatusMessage []byte
+	UserStatus    uint8
+	Friends       []*SavedFriend
+	DHTNodes      []*NodeFormat
+	TCPRelays     []*NodeFormat
+	PathNodes     []*NodeFormat
+	Conferences   []byte // kept as is
+	Groups        []byte // of GroupChats.Save
+}
+
+func unpackSavedNodes(data []byte) (nodes []*NodeFormat, err error) {
+	for len(data) > 0 {
+		node, n, err := UnpackNode(data)
+		if err != nil {
+			return nodes, err
+		}
+		nodes = append(nodes, node)
+		data = data[n:]
+	}
+	return
+}
+
+func packSavedNodes(nodes []*NodeFormat) []byte {
+	buf := gopp.NewBufferZero()
+	for _, node := range nodes {
+		pkt, err := PackNode(node.Addr, node.Pubkey)
+		if err != nil {
+			log.Println("Node not saved:", node.Addr, err)
+			continue
+		}
+		buf.Write(pkt)
+	}
+	return buf.Bytes()
+}
+
+// section header and data of section
+func readStateSections(data []byte, cookie uint16, f func(typ uint16, data []byte) (bool, error)) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return errors.Errorf("Truncated section header: %d", len(data))
+		}
+		length := binary.LittleEndian.Uint32(data)
+		typ := binary.LittleEndian.Uint16(data[4:])
+		if c := binary.LittleEndian.Uint16(data[6:]); c != cookie {
+			return errors.Errorf("Invalid section cookie: %x, type: %d", c, typ)
+		}
+		data = data[8:]
+		if uint32(len(data)) < length {
+			return errors.Errorf("Truncated section: %d, type: %d", length, typ)
+		}
+		if end, err := f(typ, data[:length]); end || err != nil {
+			return err
+		}
+		data = data[length:]
+	}
+	return nil
+}
+
+func writeStateSection(buf io.Writer, cookie uint16, typ uint16, data []byte) {
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint32(hdr, uint32(len(data)))
+	binary.LittleEndian.PutUint16(hdr[4:], typ)
+	binary.LittleEndian.PutUint16(hdr[6:], cookie)
+	buf.Write(hdr)
+	buf.Write(data)
+}
+
+// ParseSaveData reads savedata, unknown sections are skipped like c-toxcore.
+func ParseSaveData(data []byte) (*SaveData, error) {
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != 0 ||
+		binary.LittleEndian.Uint32(data[4:]) != STATE_COOKIE_GLOBAL {
+		return nil, errors.New("Invalid savedata header")
+	}
+	this := &SaveData{}
+	haskeys := false
+	err := readStateSections(data[8:], STATE_COOKIE_TYPE, func(typ uint16, data []byte) (bool, error) {
+		var err error
+		switch typ {
+		case STATE_TYPE_NOSPAMKEYS:
+			if len(data) != 4+PUBLIC_KEY_SIZE+SECRET_KEY_SIZE {
+				return true, errors.Errorf("Invalid keys section length: %d", len(data))
+			}
+			this.Nospam = binary.BigEndian.Uint32(data)
+			this.Pubkey = NewCryptoKey(append([]byte{}, data[4:4+PUBLIC_KEY_SIZE]...))
+			this.Seckey = NewCryptoKey(append([]byte{}, data[4+PUBLIC_KEY_SIZE:]...))
+			if !CBDerivePubkey(this.Seckey).Equal2(this.Pubkey) {
+				return true, errors.New("Pubkey not match seckey")
+			}
+			haskeys = true
+		case STATE_TYPE_DHT:
+			err = this.parseDHT(data)
+		case STATE_TYPE_FRIENDS:
+			err = this.parseFriends(data)
+		case STATE_TYPE_NAME:
+			if len(data) <= MAX_NAME_LENGTH {
+				this.Name = append([]byte{}, data...)
+			}
+		case STATE_TYPE_STATUSMESSAGE:
+			if len(data) <= MAX_STATUSMESSAGE_LENGTH {
+				this.StatusMessage = append([]byte{}, data...)
+			}
+		case STATE_TYPE_STATUS:
+			if len(data) == 1 && data[0] < USERSTATUS_INVALID {
+				this.UserStatus = data[0]
+			}
+		case STATE_TYPE_TCP_RELAY:
+			this.TCPRelays, err = unpackSavedNodes(data)
+		case STATE_TYPE_PATH_NODE:
+			this.PathNodes, err = unpackSavedNodes(data)
+		case STATE_TYPE_CONFERENCES:
+			this.Conferences = append([]byte{}, data...)
+		case STATE_TYPE_GC_GROUPS:
+			this.Groups = append([]byte{}, data...)
+		case STATE_TYPE_END:
+			return true, nil
+		default:
+			log.Println("Unknown savedata section:", typ, len(data))
+		}
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !haskeys {
+		return nil, errors.New("No keys in savedata")
+	}
+	return this, nil
+}
+
+func (this *SaveData) parseDHT(data []byte) error {
+	if len(data) < 4 || binary.LittleEndian.Uint32(data) != DHT_STATE_COOKIE_GLOBAL {
+		return errors.New("Invalid dht section cookie")
+	}
+	return readStateSections(data[4:], DHT_STATE_COOKIE_TYPE, func(typ uint16, data []byte) (bool, error) {
+		if typ != DHT_STATE_TYPE_NODES {
+			log.Println("Unknown dht section:", typ, len(data))
+			return false, nil
+		}
+		nodes, err := unpackSavedNodes(data)
+		this.DHTNodes = append(this.DHTNodes, nodes...)
+		return false, err
+	})
+}
+
+// like friends_list_load
+func (this *SaveData) parseFriends(data []byte) error {
+	if len(data)%SAVED_FRIEND_SIZE != 0 {
+		return errors.Errorf("Invalid friends section length: %d", len(data))
+	}
+	for ; len(data) > 0; data = data[SAVED_FRIEND_SIZE:] {
+		rd := bytes.NewReader(data[:SAVED_FRIEND_SIZE])
+		next := func(n int) []byte {
+			b := make([]byte, n)
+			rd.Read(b)
+			return b
+		}
+		lenfield := func(b []byte, max int) []byte {
+			n := int(binary.BigEndian.Uint16(next(2)))
+			if n > max {
+				n = max
+			}
+			return b[:n]
+		}
+		f := &SavedFriend{}
+		f.Status = next(1)[0]
+		f.Pubkey = NewCryptoKey(next(PUBLIC_KEY_SIZE))
+		f.RequestMsg = lenfield(next(SAVED_FRIEND_REQUEST_SIZE), SAVED_FRIEND_REQUEST_SIZE)
+		f.Name = lenfield(next(MAX_NAME_LENGTH), MAX_NAME_LENGTH)
+		f.StatusMessage = lenfield(next(MAX_STATUSMESSAGE_LENGTH), MAX_STATUSMESSAGE_LENGTH)
+		f.UserStatus = next(1)[0]
+		f.Nospam = binary.BigEndian.Uint32(next(4))
+		if ts := binary.BigEndian.Uint64(next(8)); ts != 0 {
+			f.LastSeen = time.Unix(int64(ts), 0)
+		}
+		if f.Status == FRIEND_NOFRIEND {
+			continue
+		}
+		this.Friends = append(this.Friends, f)
+	}
+	return nil
+}
+
+// like friends_list_save, request or info by status
+func (this *SavedFriend) bytes() []byte {
+	buf := gopp.NewBufferZero()
+	field := func(data []byte, size int) {
+		b := make([]byte, size+2)
+		n := copy(b[:size], data)
+		binary.BigEndian.PutUint16(b[size:], uint16(n))
+		buf.Write(b)
+	}
+	var reqmsg, name, statusmsg []byte
+	var userstatus uint8
+	var nospam uint32
+	var ts uint64
+	if this.Status >= FRIEND_CONFIRMED {
+		name, statusmsg, userstatus = this.Name, this.StatusMessage, this.UserStatus
+		if !this.LastSeen.IsZero() {
+			ts = uint64(this.LastSeen.Unix())
+		}
+	} else {
+		reqmsg, nospam = this.RequestMsg, this.Nospam
+	}
+	buf.WriteByte(this.Status)
+	buf.Write(this.Pubkey.Bytes())
+	field(reqmsg, SAVED_FRIEND_REQUEST_SIZE)
+	field(name, MAX_NAME_LENGTH)
+	field(statusmsg, MAX_STATUSMESSAGE_LENGTH)
+	buf.WriteByte(userstatus)
+	binary.Write(buf, binary.BigEndian, nospam)
+	binary.Write(buf, binary.BigEndian, ts)
+	return buf.Bytes()
+}
+
+// Bytes writes savedata with all sections in c-toxcore order.
+func (this *SaveData) Bytes() []byte {
+	buf := gopp.NewBufferZero()
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint32(hdr[4:], STATE_COOKIE_GLOBAL)
+	buf.Write(hdr)
+
+	keys := make([]byte, 4, 4+PUBLIC_KEY_SIZE+SECRET_KEY_SIZE)
+	binary.BigEndian.PutUint32(keys, this.Nospam)
+	keys = append(append(keys, this.Pubkey.Bytes()...), this.Seckey.Bytes()...)
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_NOSPAMKEYS, keys)
+
+	dhtbuf := gopp.NewBufferZero()
+	binary.Write(dhtbuf, binary.LittleEndian, uint32(DHT_STATE_COOKIE_GLOBAL))
+	writeStateSection(dhtbuf, DHT_STATE_COOKIE_TYPE, DHT_STATE_TYPE_NODES, packSavedNodes(this.DHTNodes))
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_DHT, dhtbuf.Bytes())
+
+	frndbuf := gopp.NewBufferZero()
+	for _, f := range this.Friends {
+		frndbuf.Write(f.bytes())
+	}
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_FRIENDS, frndbuf.Bytes())
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_NAME, this.Name)
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_STATUSMESSAGE, this.StatusMessage)
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_STATUS, []byte{this.UserStatus})
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_TCP_RELAY, packSavedNodes(this.TCPRelays))
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_PATH_NODE, packSavedNodes(this.PathNodes))
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_CONFERENCES, this.Conferences)
+	if len(this.Groups) > 0 {
+		writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_GC_GROUPS, this.Groups)
+	}
+	writeStateSection(buf, STATE_COOKIE_TYPE, STATE_TYPE_END, nil)
+	return buf.Bytes()
+}
+
+// SaveData of messenger, dht nodes if FriendConns has dht and relays added to it.
+func (this *Messenger) SaveData() *SaveData {
+	sd := &SaveData{Pubkey: this.SelfPubkey, Seckey: this.SelfSeckey}
+	this.mu.Lock()
+	sd.Nospam = this.nospam
+	sd.Name = append([]byte{}, this.name...)
+	sd.StatusMessage = append([]byte{}, this.statusmsg...)
+	sd.UserStatus = this.userstatus
+	for _, f := range this.friends {
+		if f == nil {
+			continue
+		}
+		sf := &SavedFriend{Status: f.Status, Pubkey: f.Pubkey, Nospam: f.nospam, UserStatus: f.UserStatus}
+		sf.RequestMsg, sf.Name, sf.StatusMessage = f.reqmsg, f.Name, f.StatusMessage
+		if f.Status == FRIEND_ONLINE {
+			sf.LastSeen = this.clock.Now()
+		} else {
+			sf.LastSeen = f.LastSeen
+		}
+		sd.Friends = append(sd.Friends, sf)
+	}
+	groups := this.groups
+	this.mu.Unlock()
+	if groups != nil {
+		sd.Groups = groups.Save()
+	}
+
+	if dhto := this.fcs.dhto; dhto != nil {
+		sd.DHTNodes = dhto.GetClosestNodes(dhto.SelfPubkey, MAX_SAVED_DHT_NODES)
+	}
+	for _, cli := range this.fcs.snapRelays() {
+		addr, err := net.ResolveTCPAddr("tcp", cli.ServAddr)
+		if err != nil {
+			log.Println("Relay not saved:", cli.ServAddr, err)
+			continue
+		}
+		sd.TCPRelays = append(sd.TCPRelays, &NodeFormat{Pubkey: cli.ServPubkey, Addr: addr})
+	}
+	return sd
+}
+
+// LoadSaveData restores nospam, info, friends and groups of sd made with our
+// keys, and bootstraps dht from its nodes. Relays in sd are for caller to connect.
+func (this *Messenger) LoadSaveData(sd *SaveData) error {
+	if !sd.Pubkey.Equal2(this.SelfPubkey) {
+		return errors.Errorf("Savedata of other key: %s", sd.Pubkey.ToHex20())
+	}
+	this.SetNospam(sd.Nospam)
+	gopp.ErrPrint(this.SetName(sd.Name))
+	gopp.ErrPrint(this.SetStatusMessage(sd.StatusMessage))
+	gopp.ErrPrint(this.SetUserStatus(sd.UserStatus))
+	for _, sf := range sd.Friends {
+		if sf.Status < FRIEND_CONFIRMED {
+			addr := make([]byte, FRIEND_ADDRESS_SIZE)
+			copy(addr, sf.Pubkey.Bytes())
+			binary.BigEndian.PutUint32(addr[PUBLIC_KEY_SIZE:], sf.Nospam)
+			sum := addressChecksum(addr[:PUBLIC_KEY_SIZE+4])
+			copy(addr[PUBLIC_KEY_SIZE+4:], sum[:])
+			_, err := this.AddFriend(addr, sf.RequestMsg)
+			gopp.ErrPrint(err, sf.Pubkey.ToHex20())
+			continue
+		}
+		fnum, err := this.AddFriendNorequest(sf.Pubkey)
+		if err != nil {
+			gopp.ErrPrint(err, sf.Pubkey.ToHex20())
+			continue
+		}
+		this.mu.Lock()
+		f := this.friends[fnum]
+		f.Name = append([]byte{}, sf.Name...)
+		f.StatusMessage = append([]byte{}, sf.StatusMessage...)
+		f.UserStatus = sf.UserStatus
+		f.LastSeen = sf.LastSeen
+		this.mu.Unlock()
+	}
+	this.mu.Lock()
+	groups := this.groups
+	this.mu.Unlock()
+	if groups != nil && len(sd.Groups) > 0 {
+		gopp.ErrPrint(groups.Load(sd.Groups))
+	}
+	if dhto := this.fcs.dhto; dhto != nil {
+		for _, node := range sd.DHTNodes {
+			gopp.ErrPrint(dhto.Bootstrap(node.Addr, node.Pubkey), node.Addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package mintox
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSaveDataRoundTrip(t *testing.T) {
+	if SAVED_FRIEND_SIZE != 2211 {
+		t.Fatal("saved friend size:", SAVED_FRIEND_SIZE)
+	}
+	pk, sk, _ := NewCBKeyPair()
+	fpk0, _, _ := NewCBKeyPair()
+	fpk1, _, _ := NewCBKeyPair()
+	nodepk, _, _ := NewCBKeyPair()
+	sd := &SaveData{Nospam: 0x01020304, Pubkey: pk, Seckey: sk}
+	sd.Name, sd.StatusMessage, sd.UserStatus = []byte("me"), []byte("here"), USERSTATUS_AWAY
+	sd.Friends = []*SavedFriend{
+		{Status: FRIEND_CONFIRMED, Pubkey: fpk0, Name: []byte("f0"), StatusMessage: []byte("s0"),
+			UserStatus: USERSTATUS_BUSY, LastSeen: time.Unix(1500000000, 0)},
+		{Status: FRIEND_REQUESTED, Pubkey: fpk1, RequestMsg: []byte("add me"), Nospam: 0xa0b0c0d0},
+	}
+	sd.DHTNodes = []*NodeFormat{{Pubkey: nodepk, Addr: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 33445}}}
+	sd.TCPRelays = []*NodeFormat{{Pubkey: nodepk, Addr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}}}
+
+	data := sd.Bytes()
+	hdr := []byte{0, 0, 0, 0, 0x1f, 0x1b, 0xed, 0x15, 68, 0, 0, 0, 1, 0, 0xce, 0x01, 1, 2, 3, 4}
+	if !bytes.Equal(data[:len(hdr)], hdr) {
+		t.Fatalf("header: %x", data[:len(hdr)])
+	}
+	sd2, err := ParseSaveData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd2.Nospam != sd.Nospam || !sd2.Pubkey.Equal2(pk) || !sd2.Seckey.Equal2(sk) ||
+		string(sd2.Name) != "me" || string(sd2.StatusMessage) != "here" || sd2.UserStatus != USERSTATUS_AWAY {
+		t.Error("self info:", sd2)
+	}
+	if len(sd2.Friends) != 2 {
+		t.Fatal("friends:", len(sd2.Friends))
+	}
+	f0, f1 := sd2.Friends[0], sd2.Friends[1]
+	if !f0.Pubkey.Equal2(fpk0) || string(f0.Name) != "f0" || string(f0.StatusMessage) != "s0" ||
+		f0.UserStatus != USERSTATUS_BUSY || f0.LastSeen.Unix() != 1500000000 || len(f0.RequestMsg) != 0 {
+		t.Error("confirmed friend:", f0)
+	}
+	if !f1.Pubkey.Equal2(fpk1) || f1.Status != FRIEND_REQUESTED || string(f1.RequestMsg) != "add me" ||
+		f1.Nospam != 0xa0b0c0d0 {
+		t.Error("requested friend:", f1)
+	}
+	if len(sd2.DHTNodes) != 1 || sd2.DHTNodes[0].Addr.String() != "1.2.3.4:33445" ||
+		len(sd2.TCPRelays) != 1 || sd2.TCPRelays[0].Addr.Network() != "tcp" {
+		t.Error("nodes:", sd2.DHTNodes, sd2.TCPRelays)
+	}
+	if !bytes.Equal(sd2.Bytes(), data) {
+		t.Error("not same bytes after round trip")
+	}
+
+	if _, err := ParseSaveData(data[:len(data)-20]); err == nil {
+		t.Error("truncated savedata parsed")
+	}
+	_, sk2, _ := NewCBKeyPair()
+	sd.Seckey = sk2
+	if _, err := ParseSaveData(sd.Bytes()); err == nil {
+		t.Error("mismatched keys parsed")
+	}
+}
+
+func TestMessengerSaveLoad(t *testing.T) {
+	m0 := newTstMessenger(defaultClock)
+	defer m0.tstKill()
+	m0.SetName([]byte("m0"))
+	m0.SetNospam(42)
+	fpk, _, _ := NewCBKeyPair()
+	if _, err := m0.AddFriendNorequest(fpk); err != nil {
+		t.Fatal(err)
+	}
+
+	sd, err := ParseSaveData(m0.SaveData().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	neto := NewNetworkCore()
+	dhtpk, dhtsk, _ := NewCBKeyPair()
+	nc := newNetCrypto(neto, dhtpk, dhtsk, sd.Pubkey, sd.Seckey, defaultClock)
+	m1 := NewMessenger(NewFriendConns(nc, nil))
+	defer m1.tstKill()
+	if err := m1.LoadSaveData(sd); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m1.Address(), m0.Address()) || string(m1.Name()) != "m0" {
+		t.Error("self not restored:", m1.Nospam(), string(m1.Name()))
+	}
+	if fnum, ok := m1.FriendNumber(fpk); !ok || m1.Friend(fnum).Status != FRIEND_CONFIRMED {
+		t.Error("friend not restored")
+	}
+	if m0.LoadSaveData(&SaveData{Pubkey: fpk}) == nil {
+		t.Error("savedata of other key loaded")
+	}
+}
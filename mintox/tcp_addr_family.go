@@ -0,0 +1,116 @@
+package mintox
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// address families TCPServer listens on
+const (
+	TCP_FAMILY_IPV4 = "ipv4" // 0.0.0.0 or an ipv4 bind_addr only
+	TCP_FAMILY_IPV6 = "ipv6" // :: or an ipv6 bind_addr only, IPV6_V6ONLY set
+	TCP_FAMILY_DUAL = "dual" // both, one listener per family when bind_addr empty
+)
+
+// family => network of net.Listen
+var tcpfamilies = map[string]string{
+	TCP_FAMILY_IPV4: "tcp4", TCP_FAMILY_IPV6: "tcp6", TCP_FAMILY_DUAL: "tcp"}
+
+// empty family is dual
+func validateTCPFamily(family string, bindaddr string) error {
+	if family == "" {
+		family = TCP_FAMILY_DUAL
+	}
+	if _, ok := tcpfamilies[family]; !ok {
+		return errors.Errorf("invalid addr_family: %s", family)
+	}
+	if bindaddr == "" || family == TCP_FAMILY_DUAL {
+		return nil
+	}
+	ip := net.ParseIP(bindaddr)
+	if ip == nil {
+		return nil // host name, resolved by family when listen
+	}
+	if (ip.To4() != nil) != (family == TCP_FAMILY_IPV4) {
+		return errors.Errorf("bind_addr %s not of addr_family %s", bindaddr, family)
+	}
+	return nil
+}
+
+// listeners of one port by cfg.AddrFamily and cfg.BindAddr, cfg.ReusePort of each.
+// Dual stack on all addresses listens ipv4 and ipv6 separately, not depend on
+// platform's IPV6_V6ONLY default, and keeps going with one family if the other failed.
+func listenTCPFamily(cfg *TCPServerConfig, port uint16) ([]net.Listener, error) {
+	family := cfg.AddrFamily
+	if family == "" {
+		family = TCP_FAMILY_DUAL
+	}
+	portstr := fmt.Sprintf("%d", port)
+	if family != TCP_FAMILY_DUAL || cfg.BindAddr != "" {
+		return listenTCPReusePort(tcpfamilies[family], net.JoinHostPort(cfg.BindAddr, portstr), cfg.ReusePort)
+	}
+
+	var lsners []net.Listener
+	var errs []error
+	for _, network := range []string{"tcp4", "tcp6"} {
+		lns, err := listenTCPReusePort(network, net.JoinHostPort("", portstr), cfg.ReusePort)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lsners = append(lsners, lns...)
+	}
+	if len(lsners) == 0 {
+		return nil, errs[0]
+	}
+	for _, err := range errs {
+		defaultLogger.get().Warn("Listen one family failed", "port", port, "err", err)
+	}
+	return lsners, nil
+}
+
+// TOX_AF_INET or TOX_AF_INET6 of tcp addr, ipv4 mapped ipv6 addr is TOX_AF_INET
+func tcpAddrFamily(addr net.Addr) uint8 {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case nil:
+	default:
+		if host, _, err := net.SplitHostPort(a.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	switch {
+	case ip == nil:
+		return 0
+	case ip.To4() != nil:
+		return TOX_AF_INET
+	default:
+		return TOX_AF_INET6
+	}
+}
+
+// accepted conn counted by family, unknown ones like pipes not counted
+func (this *TCPServer) countAcceptFamily(family uint8) {
+	switch family {
+	case TOX_AF_INET:
+		atomic.AddInt64(&this.cnts.AcceptedIPv4, 1)
+	case TOX_AF_INET6:
+		atomic.AddInt64(&this.cnts.AcceptedIPv6, 1)
+	}
+}
+
+// confirmed conns by family, 0 for unknown
+func (this *TCPServer) ConnCountByFamily() map[uint8]int {
+	rets := map[uint8]int{}
+	this.connmu.RLock()
+	for _, c := range this.Conns {
+		rets[c.Family]++
+	}
+	this.connmu.RUnlock()
+	return rets
+}
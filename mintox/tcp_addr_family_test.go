@@ -0,0 +1,128 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTCPFamilyConfig(t *testing.T) {
+	for _, tc := range []struct {
+		family, bindaddr string
+		ok               bool
+	}{
+		{"", "", true},
+		{TCP_FAMILY_DUAL, "127.0.0.1", true},
+		{TCP_FAMILY_IPV4, "127.0.0.1", true},
+		{TCP_FAMILY_IPV4, "::1", false},
+		{TCP_FAMILY_IPV6, "::1", true},
+		{TCP_FAMILY_IPV6, "127.0.0.1", false},
+		{TCP_FAMILY_IPV6, "localhost", true},
+		{"ipx", "", false},
+	} {
+		err := validateTCPFamily(tc.family, tc.bindaddr)
+		if (err == nil) != tc.ok {
+			t.Error("validate:", tc.family, tc.bindaddr, err)
+		}
+	}
+	if _, err := ParseTCPServerConfig([]byte(`{"addr_family": "ipv6", "bind_addr": "0.0.0.0"}`)); err == nil {
+		t.Error("mismatched family accepted")
+	}
+
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	if f := tcpAddrFamily(c0.RemoteAddr()); f != 0 {
+		t.Error("pipe family:", f)
+	}
+	mapped := &net.TCPAddr{IP: net.ParseIP("::ffff:1.2.3.4"), Port: 1}
+	if f := tcpAddrFamily(mapped); f != TOX_AF_INET {
+		t.Error("ipv4 mapped family:", f)
+	}
+	if f := tcpAddrFamily(&net.TCPAddr{IP: net.IPv6loopback}); f != TOX_AF_INET6 {
+		t.Error("ipv6 family:", f)
+	}
+}
+
+func tstHasIPv6() bool {
+	lsner, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	lsner.Close()
+	return true
+}
+
+func TestTCPServerAddrFamily(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connect := func(srvo *TCPServer, addr string) *TCPClient {
+		pk, sk2, _ := NewCBKeyPair()
+		cli := NewTCPClient(addr, srvo.Pubkey, pk, sk2)
+		if !waitTstCond(3*time.Second, func() bool { return cli.Status == TCP_CLIENT_CONFIRMED }) {
+			t.Fatal("not confirmed:", addr)
+		}
+		return cli
+	}
+	newServer := func(family, bindaddr string) *TCPServer {
+		cfg := DefaultTCPServerConfig()
+		cfg.Seckey = sk
+		cfg.Ports = []uint16{0}
+		cfg.AddrFamily = family
+		cfg.BindAddr = bindaddr
+		srvo, err := NewTCPServerFromConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srvo.Start()
+		return srvo
+	}
+
+	srvo := newServer(TCP_FAMILY_IPV4, "127.0.0.1")
+	defer srvo.Shutdown(ctx)
+	cli := connect(srvo, srvo.Addrs()[0].String())
+	defer cli.Close()
+	if cnts := srvo.Counters(); cnts.AcceptedIPv4 != 1 || cnts.AcceptedIPv6 != 0 {
+		t.Error("ipv4 accepted:", cnts.AcceptedIPv4, cnts.AcceptedIPv6)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCountByFamily()[TOX_AF_INET] == 1 }) {
+		t.Error("ipv4 conns:", srvo.ConnCountByFamily())
+	}
+	for _, b := range srvo.ListConns() {
+		if b.Family != TOX_AF_INET {
+			t.Error("conn family:", b.Family, b.Addr)
+		}
+	}
+
+	if !tstHasIPv6() {
+		t.Skip("no ipv6")
+	}
+	// dual on all addresses, one listener each family
+	srvo2 := newServer(TCP_FAMILY_DUAL, "")
+	defer srvo2.Shutdown(ctx)
+	if len(srvo2.Addrs()) != 2 {
+		t.Fatal("dual listeners:", srvo2.Addrs())
+	}
+	for _, addr := range srvo2.Addrs() {
+		host := "127.0.0.1"
+		if tcpAddrFamily(addr) == TOX_AF_INET6 {
+			host = "::1"
+		}
+		cli := connect(srvo2, net.JoinHostPort(host, strconv.Itoa(addr.(*net.TCPAddr).Port)))
+		defer cli.Close()
+	}
+	if cnts := srvo2.Counters(); cnts.AcceptedIPv4 != 1 || cnts.AcceptedIPv6 != 1 {
+		t.Error("dual accepted:", cnts.AcceptedIPv4, cnts.AcceptedIPv6)
+	}
+
+	srvo3 := newServer(TCP_FAMILY_IPV6, "::1")
+	defer srvo3.Shutdown(ctx)
+	cli3 := connect(srvo3, srvo3.Addrs()[0].String())
+	defer cli3.Close()
+	if cnts := srvo3.Counters(); cnts.AcceptedIPv6 != 1 || cnts.AcceptedIPv4 != 0 {
+		t.Error("ipv6 accepted:", cnts.AcceptedIPv4, cnts.AcceptedIPv6)
+	}
+}
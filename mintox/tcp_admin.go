@@ -0,0 +1,313 @@
+package mintox
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Admin api of a running relay, HTTP+JSON on a unix socket or loopback port:
+//   GET  /conns                      handshaking and confirmed conns
+//   GET  /stats                      counters and packet counts
+//   GET  /bans                       banned ips and ranges, expire time
+//   GET  /usage                      bytes per client pubkey, day and month quota
+//   POST /disconnect?pubkey=hex      close the conn of client pubkey
+//   POST /ban?ip=x&duration=secs     ban ip or CIDR range, ban_duration if no duration, 0 for ever
+//   POST /unban?ip=x
+//   POST /reload                     reload the config file
+//   GET  /tap?pubkey=hex             packet headers kept by the tap of conn
+//   POST /tap?pubkey=hex&size=n      start tap of conn keeping n headers, 0 stops
+//   POST /rotate-key?file=x&drain=secs
+//                                    new key from keys file, old key conns closed after drain, 0 for never
+// Like curl --unix-socket /run/mintox.sock -X POST 'http://x/ban?ip=1.2.3.4'
+// On a loopback port admin_token is needed as Authorization: Bearer token.
+
+// one conn in /conns
+type TCPAdminConn struct {
+	Pubkey      string    `json:"pubkey"` // empty if handshake not done
+	Addr        string    `json:"addr"`
+	Status      string    `json:"status"`
+	ConnectedAt time.Time `json:"connected_at"`
+	SRTTMs      float64   `json:"srtt_ms"`
+	BytesRecv   int64     `json:"bytes_recv"`
+	BytesSent   int64     `json:"bytes_sent"`
+	QueuedBytes int       `json:"queued_bytes"`
+	Routes      int       `json:"routes"`
+}
+
+// one client in /usage
+type TCPAdminUsage struct {
+	Pubkey     string `json:"pubkey"`
+	BytesRecv  int64  `json:"bytes_recv"`
+	BytesSent  int64  `json:"bytes_sent"`
+	DayBytes   int64  `json:"day_bytes"`
+	MonthBytes int64  `json:"month_bytes"`
+	OverQuota  bool   `json:"over_quota"`
+	Online     bool   `json:"online"`
+}
+
+type tcpAdminStats struct {
+	Counters    TCPServerCounters `json:"counters"`
+	Handshaking int               `json:"handshaking"`
+	Confirmed   int               `json:"confirmed"`
+	Parked      int               `json:"parked"`
+	QueuedBytes int64             `json:"queued_bytes"`
+	Packets     map[string]int64  `json:"packets"`
+}
+
+func (this *TCPServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conns", adminGet(func(r *http.Request) (interface{}, error) {
+		stats := this.Stats()
+		conns := []TCPAdminConn{}
+		for _, st := range stats.Conns {
+			ac := TCPAdminConn{Addr: st.Addr.String(), Status: tcpstname(st.Status), ConnectedAt: st.ConnectedAt}
+			if st.Pubkey != nil {
+				ac.Pubkey = st.Pubkey.ToHex()
+			}
+			ac.SRTTMs = float64(st.SRTT) / float64(time.Millisecond)
+			ac.BytesRecv, ac.BytesSent = st.BytesRecv, st.BytesSent
+			ac.QueuedBytes, ac.Routes = st.QueuedBytes, st.Routes
+			conns = append(conns, ac)
+		}
+		return conns, nil
+	}))
+	mux.HandleFunc("/stats", adminGet(func(r *http.Request) (interface{}, error) {
+		st := this.Stats()
+		return tcpAdminStats{st.Counters, st.Handshaking, st.Confirmed, st.Parked, st.QueuedBytes, this.PacketCounts()}, nil
+	}))
+	mux.HandleFunc("/bans", adminGet(func(r *http.Request) (interface{}, error) {
+		return this.BannedIPs(), nil
+	}))
+	mux.HandleFunc("/usage", adminGet(func(r *http.Request) (interface{}, error) {
+		usages := []TCPAdminUsage{}
+		for _, u := range this.Usages() {
+			usages = append(usages, TCPAdminUsage{u.Pubkey.ToHex(), u.BytesRecv, u.BytesSent,
+				u.DayBytes, u.MonthBytes, u.OverQuota, u.Online})
+		}
+		return usages, nil
+	}))
+	mux.HandleFunc("/disconnect", adminPost(func(r *http.Request) (interface{}, error) {
+		pubkey, err := CryptoKeyFromHex(r.FormValue("pubkey"))
+		if err != nil {
+			return nil, err
+		}
+		if !this.Disconnect(pubkey) {
+			return nil, errAdminNotFound
+		}
+		return "ok", nil
+	}))
+	mux.HandleFunc("/ban", adminPost(func(r *http.Request) (interface{}, error) {
+		secs := this.config().BanDuration
+		if s := r.FormValue("duration"); s != "" {
+			var err error
+			if secs, err = strconv.Atoi(s); err != nil || secs < 0 {
+				return nil, errors.Errorf("Invalid duration: %s", s)
+			}
+		}
+		return "ok", this.Ban(r.FormValue("ip"), time.Duration(secs)*time.Second, "admin")
+	}))
+	mux.HandleFunc("/unban", adminPost(func(r *http.Request) (interface{}, error) {
+		if _, _, err := parseBanNet(r.FormValue("ip")); err != nil {
+			return nil, err
+		}
+		if !this.UnbanIP(r.FormValue("ip")) {
+			return nil, errAdminNotFound
+		}
+		return "ok", nil
+	}))
+	mux.HandleFunc("/reload", adminPost(func(r *http.Request) (interface{}, error) {
+		return "ok", this.ReloadFile()
+	}))
+	mux.HandleFunc("/tap", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			adminPost(func(r *http.Request) (interface{}, error) {
+				pubkey, err := CryptoKeyFromHex(r.FormValue("pubkey"))
+				if err != nil {
+					return nil, err
+				}
+				size, err := strconv.Atoi(r.FormValue("size"))
+				if err != nil || size < 0 || size > TCP_TAP_MAX_SIZE {
+					return nil, errors.Errorf("Invalid size: %s", r.FormValue("size"))
+				}
+				if !this.TapConn(pubkey, size) {
+					return nil, errAdminNotFound
+				}
+				return "ok", nil
+			})(w, r)
+			return
+		}
+		adminGet(func(r *http.Request) (interface{}, error) {
+			pubkey, err := CryptoKeyFromHex(r.FormValue("pubkey"))
+			if err != nil {
+				return nil, err
+			}
+			entries, ok := this.TapEntries(pubkey)
+			if !ok {
+				return nil, errAdminNotFound
+			}
+			return entries, nil
+		})(w, r)
+	})
+
+	mux.HandleFunc("/rotate-key", adminPost(func(r *http.Request) (interface{}, error) {
+		secs, err := strconv.Atoi(r.FormValue("drain"))
+		if err != nil || secs < 0 {
+			return nil, errors.Errorf("Invalid drain: %s", r.FormValue("drain"))
+		}
+		if err := this.RotateKeyFile(r.FormValue("file"), time.Duration(secs)*time.Second); err != nil {
+			return nil, err
+		}
+		pubkey, _ := this.Keys()
+		return pubkey.ToHex(), nil
+	}))
+	return mux
+}
+
+var errAdminNotFound = errors.New("Not found")
+
+type adminFunc func(r *http.Request) (interface{}, error)
+
+func adminGet(fn adminFunc) http.HandlerFunc  { return adminServe(http.MethodGet, fn) }
+func adminPost(fn adminFunc) http.HandlerFunc { return adminServe(http.MethodPost, fn) }
+
+// result as json, error as {"error": msg}
+func adminServe(method string, fn adminFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var ret interface{}
+		var err error
+		code := http.StatusOK
+		if r.Method != method {
+			code, err = http.StatusMethodNotAllowed, errors.Errorf("Use %s", method)
+		} else if ret, err = fn(r); err == errAdminNotFound {
+			code = http.StatusNotFound
+		} else if err != nil {
+			code = http.StatusBadRequest
+		}
+		if err != nil {
+			ret = map[string]string{"error": err.Error()}
+		}
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(ret)
+	}
+}
+
+func adminError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// h behind a loopback Host, against dns rebinding of browsers, and admin_token
+func (this *TCPServer) adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			adminError(w, http.StatusForbidden, errors.Errorf("Host not loopback: %s", r.Host))
+			return
+		}
+		token := this.config().AdminToken
+		auth := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			adminError(w, http.StatusUnauthorized, errors.New("Invalid admin token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ListenAdmin serves AdminHandler on addr, unix:/path of mode 0600 or
+// loopback host:port with admin_token, never on a public address.
+// Closed by Shutdown.
+func (this *TCPServer) ListenAdmin(addr string) error {
+	var lsner net.Listener
+	var err error
+	handler := this.AdminHandler()
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		if lsner, err = listenAdminUnix(path); err != nil {
+			return err
+		}
+		this.adminSock = path
+	} else {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return errors.Wrap(err, "admin addr")
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return errors.Errorf("Admin addr not loopback: %s", addr)
+		}
+		if this.config().AdminToken == "" {
+			return errors.Errorf("No admin_token for admin addr: %s", addr)
+		}
+		if lsner, err = net.Listen("tcp", addr); err != nil {
+			return errors.Wrap(err, "listen admin")
+		}
+		handler = this.adminAuth(handler)
+	}
+	hsrv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	this.admin = hsrv
+	this.adminAddr = lsner.Addr()
+	this.logr().Info("Admin listened", "addr", lsner.Addr())
+	go func() {
+		err := hsrv.Serve(lsner)
+		if err != http.ErrServerClosed {
+			this.logr().Warn("Admin serve failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// socket made in a new 0700 dir, so no one connects before its chmod,
+// then moved to path
+func listenAdminUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path) // stale of last run
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".admin")
+	if err != nil {
+		return nil, errors.Wrap(err, "listen admin")
+	}
+	defer os.RemoveAll(dir)
+	tmppath := filepath.Join(dir, "sock")
+	lsner, err := net.Listen("unix", tmppath)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen admin")
+	}
+	lsner.(*net.UnixListener).SetUnlinkOnClose(false) // removed by Shutdown
+	if err = os.Chmod(tmppath, 0600); err == nil {
+		err = os.Rename(tmppath, path)
+	}
+	if err != nil {
+		lsner.Close()
+		return nil, errors.Wrap(err, "listen admin")
+	}
+	return lsner, nil
+}
+
+// Disconnect closes the confirmed conn of client pubkey, not parked for resume
+func (this *TCPServer) Disconnect(pubkey *CryptoKey) bool {
+	this.connmu.RLock()
+	c, ok := this.Conns[pubkey.BinStr()]
+	this.connmu.RUnlock()
+	if !ok {
+		return false
+	}
+	this.logr().Info("Disconnect by admin", "pubkey", pubkey.ToHex20(), "addr", c.Sock.RemoteAddr())
+	c.doClose(true, TCP_CLOSE_ADMIN)
+	return true
+}
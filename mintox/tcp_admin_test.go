@@ -0,0 +1,171 @@
+package mintox
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request to the admin unix socket, json result decoded into ret
+func tstAdminDo(t *testing.T, sock, method, path string, ret interface{}) int {
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		}}}
+	req, _ := http.NewRequest(method, "http://admin"+path, nil)
+	resp, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ret != nil {
+		if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+			t.Fatal(path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	if err := srvo.ListenAdmin("unix:" + sock); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("admin socket mode:", fi, err)
+	}
+
+	pk, sk, _ := NewCBKeyPair()
+	cli := NewTCPClient(addr, srvo.Pubkey, pk, sk)
+	defer cli.Close()
+	if !waitTstCond(3*time.Second, func() bool { _, ok := srvo.ConnStats(pk); return ok }) {
+		t.Fatal("client not confirmed")
+	}
+
+	conns := []TCPAdminConn{}
+	if code := tstAdminDo(t, sock, "GET", "/conns", &conns); code != 200 || len(conns) != 1 || conns[0].Pubkey != pk.ToHex() {
+		t.Error("conns:", code, conns)
+	}
+	stats := tcpAdminStats{}
+	if tstAdminDo(t, sock, "GET", "/stats", &stats); stats.Confirmed != 1 || stats.Counters.AcceptedIPv4 == 0 {
+		t.Error("stats:", stats)
+	}
+	if code := tstAdminDo(t, sock, "GET", "/disconnect?pubkey="+pk.ToHex(), nil); code != http.StatusMethodNotAllowed {
+		t.Error("get disconnect:", code)
+	}
+	if code := tstAdminDo(t, sock, "POST", "/disconnect?pubkey="+pk.ToHex(), nil); code != 200 {
+		t.Error("disconnect:", code)
+	}
+	if !waitTstCond(3*time.Second, func() bool { _, ok := srvo.ConnStats(pk); return !ok }) {
+		t.Error("conn not disconnected")
+	}
+	if code := tstAdminDo(t, sock, "POST", "/disconnect?pubkey="+pk.ToHex(), nil); code != http.StatusNotFound {
+		t.Error("disconnect again:", code)
+	}
+	if code := tstAdminDo(t, sock, "POST", "/disconnect?pubkey="+strings.Repeat("zz", PUBLIC_KEY_SIZE), nil); code != http.StatusBadRequest {
+		t.Error("disconnect non-hex pubkey:", code)
+	}
+
+	if code := tstAdminDo(t, sock, "POST", "/ban?ip=10.1.2.3&duration=60", nil); code != 200 {
+		t.Error("ban:", code)
+	}
+	bans := map[string]time.Time{}
+	if tstAdminDo(t, sock, "GET", "/bans", &bans); bans["10.1.2.3"].IsZero() {
+		t.Error("bans:", bans)
+	}
+	if code := tstAdminDo(t, sock, "POST", "/ban?ip=nonsense", nil); code != http.StatusBadRequest {
+		t.Error("ban invalid ip:", code)
+	}
+	if code := tstAdminDo(t, sock, "POST", "/unban?ip=10.1.2.3", nil); code != 200 || len(srvo.BannedIPs()) != 0 {
+		t.Error("unban:", code)
+	}
+
+	errret := map[string]string{}
+	if code := tstAdminDo(t, sock, "POST", "/reload", &errret); code != http.StatusBadRequest || errret["error"] == "" {
+		t.Error("reload without file:", code, errret)
+	}
+}
+
+func TestAdminLoopbackOnly(t *testing.T) {
+	srvo := newTstServer()
+	if err := srvo.ListenAdmin("0.0.0.0:0"); err == nil {
+		t.Error("admin on public addr")
+	}
+	if err := srvo.ListenAdmin("127.0.0.1:0"); err == nil {
+		t.Error("admin on loopback port without token")
+	}
+	cfg := *srvo.config()
+	cfg.AdminToken = "s3cret"
+	if err := srvo.Reload(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := srvo.ListenAdmin("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer srvo.admin.Close()
+	get := func(host, token string) int {
+		req, _ := http.NewRequest("GET", "http://"+srvo.adminAddr.String()+"/stats", nil)
+		if host != "" {
+			req.Host = host
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("", "s3cret"); code != 200 {
+		t.Error("loopback admin:", code)
+	}
+	if code := get("", "wrong"); code != http.StatusUnauthorized {
+		t.Error("wrong token:", code)
+	}
+	if code := get("", ""); code != http.StatusUnauthorized {
+		t.Error("no token:", code)
+	}
+	if code := get("evil.example:80", "s3cret"); code != http.StatusForbidden {
+		t.Error("rebound host:", code)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "relay.json")
+	ioutil.WriteFile(fname, []byte(`{"ports": [33445], "max_conns": 5}`), 0600)
+	cfg, err := LoadTCPServerConfig(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cfg.Seckey, _ = NewCBKeyPair()
+	srvo, err := NewTCPServerWithListenersConfig([]net.Listener{&tstListener{}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(fname, []byte(`{"ports": [1], "max_conns": 7, "ban_duration": -1}`), 0600)
+	if err := srvo.ReloadFile(); err == nil {
+		t.Error("invalid config reloaded")
+	}
+	ioutil.WriteFile(fname, []byte(`{"ports": [1], "max_conns": 7}`), 0600)
+	if err := srvo.ReloadFile(); err != nil {
+		t.Fatal(err)
+	}
+	newcfg := srvo.config()
+	if newcfg.MaxConns != 7 || newcfg.Ports[0] != 33445 || newcfg.Seckey != cfg.Seckey {
+		t.Error("reloaded:", newcfg.MaxConns, newcfg.Ports)
+	}
+}
@@ -0,0 +1,66 @@
+package mintox
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// what to do when a write queue of conn is full
+const (
+	TCP_BACKPRESSURE_BLOCK       = "block"       // wait for room, at most TCP_BACKPRESSURE_WAIT
+	TCP_BACKPRESSURE_DROP_OLDEST = "drop-oldest" // discard the head of queue to make room
+	TCP_BACKPRESSURE_DROP_NEWEST = "drop-newest" // discard the new packet
+	TCP_BACKPRESSURE_CLOSE       = "close"       // close the slow conn
+)
+
+var tcpbackpressures = map[string]bool{
+	TCP_BACKPRESSURE_BLOCK: true, TCP_BACKPRESSURE_DROP_OLDEST: true,
+	TCP_BACKPRESSURE_DROP_NEWEST: true, TCP_BACKPRESSURE_CLOSE: true}
+
+/* max time in seconds to block a sender on full queue */
+const TCP_BACKPRESSURE_WAIT = 1
+
+// queue data to q, dlen is its byte counter, see enqueueCtrl for the accounting.
+// return false if data not queued.
+func (this *TCPSecureConn) enqueue(q chan []byte, dlen *int32, data []byte, dequeued func([]byte)) bool {
+	atomic.AddInt32(dlen, int32(len(data)))
+	select {
+	case q <- data:
+		return true
+	default:
+	}
+
+	switch this.backpressure {
+	case TCP_BACKPRESSURE_BLOCK:
+		tmer := time.NewTimer(TCP_BACKPRESSURE_WAIT * time.Second)
+		defer tmer.Stop()
+		select {
+		case q <- data:
+			return true
+		case <-this.stopC:
+		case <-tmer.C:
+		}
+	case TCP_BACKPRESSURE_DROP_OLDEST:
+		// other senders may take the room first, try twice then give up
+		for i := 0; i < 2; i++ {
+			select {
+			case old := <-q:
+				dequeued(old)
+				this.dropPacket(old)
+			default:
+			}
+			select {
+			case q <- data:
+				return true
+			default:
+			}
+		}
+	case TCP_BACKPRESSURE_CLOSE:
+		log.Println("Write queue full, close:", len(q), this.Sock.RemoteAddr())
+		// caller may hold server locks that OnClosed takes
+		go this.doClose(true, TCP_CLOSE_QUEUE_FULL)
+	}
+	dequeued(data)
+	return false
+}
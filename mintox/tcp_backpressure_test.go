@@ -0,0 +1,100 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTstBackpressureConn(mode string) *TCPSecureConn {
+	cfg := DefaultTCPConnConfig()
+	cfg.CtrlQueueSize = 2
+	cfg.Backpressure = mode
+	c0, _ := net.Pipe()
+	return newTCPSecureConn(c0, cfg)
+}
+
+func TestBackpressureModes(t *testing.T) {
+	c := newTstBackpressureConn(TCP_BACKPRESSURE_DROP_NEWEST)
+	c.enqueueCtrl([]byte{1})
+	c.enqueueCtrl([]byte{2})
+	if c.enqueueCtrl([]byte{3}) || (<-c.cwctrlq)[0] != 1 {
+		t.Error("drop-newest")
+	}
+
+	c = newTstBackpressureConn(TCP_BACKPRESSURE_DROP_OLDEST)
+	dropped := 0
+	c.OnNetDrop = func(n int) { dropped += n }
+	c.enqueueCtrl([]byte{1})
+	c.enqueueCtrl([]byte{2})
+	if !c.enqueueCtrl([]byte{3, 3}) || dropped != 1 || (<-c.cwctrlq)[0] != 2 {
+		t.Error("drop-oldest:", dropped)
+	}
+	if c.cwctrldlen != 3 {
+		t.Error("queue bytes:", c.cwctrldlen)
+	}
+
+	c = newTstBackpressureConn(TCP_BACKPRESSURE_BLOCK)
+	c.enqueueCtrl([]byte{1})
+	c.enqueueCtrl([]byte{2})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.ctrlDequeued(<-c.cwctrlq)
+	}()
+	if !c.enqueueCtrl([]byte{3}) {
+		t.Error("block not queued after room")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.Close()
+	}()
+	btime := time.Now()
+	if c.enqueueCtrl([]byte{4}) || time.Since(btime) > TCP_BACKPRESSURE_WAIT*time.Second {
+		t.Error("block not released by close:", time.Since(btime))
+	}
+
+	c = newTstBackpressureConn(TCP_BACKPRESSURE_CLOSE)
+	c.enqueueCtrl([]byte{1})
+	c.enqueueCtrl([]byte{2})
+	if c.enqueueCtrl([]byte{3}) {
+		t.Error("close mode queued")
+	}
+	if !waitTstCond(3*time.Second, func() bool { return c.isClosed() }) || c.CloseReason() != TCP_CLOSE_QUEUE_FULL {
+		t.Error("close mode not closed:", c.CloseReason())
+	}
+
+	cfg := DefaultTCPConnConfig()
+	cfg.Backpressure = "wait"
+	if cfg.Validate() == nil {
+		t.Error("invalid backpressure accepted")
+	}
+}
+
+// frames crossing the smallest ring buffer, read must not overflow it
+func TestSmallReadBuffer(t *testing.T) {
+	cfg := DefaultTCPConnConfig()
+	cfg.ReadBufferSize = MAX_PACKET_SIZE * 2
+	c0, c1 := net.Pipe()
+	pk, sk, _ := NewCBKeyPair()
+	secon := newTCPSecureConn(c0, cfg)
+	secon.Seckey = sk
+	secon.Start()
+	defer secon.Close()
+
+	peer := newTstPeer(t, c1, pk)
+	peer.handshake()
+	var burst []byte
+	for i := 0; i < 8; i++ {
+		encpkt, err := peer.CreatePacket(make([]byte, TCP_MAX_PLAIN_SIZE))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.SentNonce.Incr()
+		burst = append(burst, encpkt...)
+	}
+	if _, err := c1.Write(burst); err != nil {
+		t.Fatal(err)
+	}
+	peer.ping()
+	peer.readUntil(TCP_PACKET_PONG)
+}
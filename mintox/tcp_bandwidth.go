@@ -0,0 +1,59 @@
+package mintox
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bytes of a peer's conn in the last sample interval
+type BandwidthSample struct {
+	Pubkey   *CryptoKey
+	In       int64
+	Out      int64
+	Interval time.Duration
+	Online   bool // peer has a confirmed conn
+}
+
+// report bandwidth of peer every interval on a dedicated goroutine, call cancel to stop.
+// counters are read atomic, so not touch the conn's read/write path.
+func (this *TCPServer) SubscribeBandwidth(pubkey *CryptoKey, interval time.Duration,
+	cb func(BandwidthSample)) (cancel func(), err error) {
+	if interval <= 0 {
+		return nil, errors.Errorf("Invalid interval: %v", interval)
+	}
+	stopC := make(chan bool)
+	go this.runBandwidthSampler(pubkey, interval, cb, stopC)
+	var once sync.Once
+	return func() { once.Do(func() { close(stopC) }) }, nil
+}
+
+func (this *TCPServer) runBandwidthSampler(pubkey *CryptoKey, interval time.Duration,
+	cb func(BandwidthSample), stopC chan bool) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	var lastc *TCPSecureConn
+	var lastin, lastout int64
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-tick.C:
+		}
+		smp := BandwidthSample{Pubkey: pubkey, Interval: interval}
+		c := this.confirmedConn(pubkey)
+		if c != nil {
+			if c != lastc { // reconnected, new baseline
+				lastc, lastin, lastout = c, 0, 0
+			}
+			in, out := c.RecvBytes(), c.SentBytes()
+			smp.In, smp.Out, smp.Online = in-lastin, out-lastout, true
+			lastin, lastout = in, out
+		} else {
+			lastc = nil
+		}
+		cb(smp)
+	}
+}
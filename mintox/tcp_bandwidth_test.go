@@ -0,0 +1,46 @@
+package mintox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribeBandwidth(t *testing.T) {
+	srvo := newTstServer()
+	c := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+
+	smpC := make(chan BandwidthSample, 16)
+	if _, err := srvo.SubscribeBandwidth(c.Pubkey, 0, func(BandwidthSample) {}); err == nil {
+		t.Error("zero interval subscribed")
+	}
+	cancel, err := srvo.SubscribeBandwidth(c.Pubkey, 20*time.Millisecond, func(smp BandwidthSample) { smpC <- smp })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	c.noteSent(100)
+	c.noteSent(20)
+	nextSample := func(ok func(BandwidthSample) bool) BandwidthSample {
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case smp := <-smpC:
+				if ok(smp) {
+					return smp
+				}
+			case <-timeout:
+				t.Fatal("no expected sample")
+			}
+		}
+	}
+	smp := nextSample(func(smp BandwidthSample) bool { return smp.Out != 0 })
+	if !smp.Online || smp.Out != 120 || smp.In != 0 {
+		t.Error("invalid sample:", smp.Online, smp.In, smp.Out)
+	}
+
+	c.setStatus(TCP_STATUS_NO_STATUS)
+	nextSample(func(smp BandwidthSample) bool { return !smp.Online })
+	cancel()
+	cancel()
+}
@@ -0,0 +1,319 @@
+package mintox
+
+import (
+	"encoding/json"
+	"gopp"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Bans of source ips and CIDR ranges, checked on accept before the handshake.
+// The file store keeps them over restarts. An expired ban is kept a while as
+// reputation of the source, the next automatic ban of it lasts twice as long.
+
+const TCP_BAN_REPUTATION = 7 * 24 * 3600 // seconds, expired bans remembered
+const TCP_BAN_MAX_ESCALATE = 6           // automatic ban at most 2^6 times ban_duration
+
+// one banned ip or range
+type TCPBan struct {
+	Net    string    `json:"net"`   // 1.2.3.4 or 10.0.0.0/8
+	Until  time.Time `json:"until"` // zero for never expire
+	Reason string    `json:"reason,omitempty"`
+	Count  int       `json:"count"` // times banned automatically
+}
+
+func (this *TCPBan) active(now time.Time) bool {
+	return this.Until.IsZero() || now.Before(this.Until)
+}
+
+// BanStore keeps bans by canonical Net, safe for concurrent use.
+// Expired bans are kept until Prune.
+type BanStore interface {
+	Put(ban TCPBan) error
+	Get(ipnet string) (TCPBan, bool)
+	Remove(ipnet string) (bool, error)
+	Banned(ip net.IP, now time.Time) (TCPBan, bool) // active ban covering ip
+	List() []TCPBan
+	Prune(expiredBefore time.Time) error
+}
+
+// canonical form of an ip or CIDR, single host range as plain ip
+func parseBanNet(s string) (string, *net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return "", nil, errors.Errorf("Invalid ip: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return ip.String(), &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", nil, errors.Errorf("Invalid ip range: %s", s)
+	}
+	if ones, bits := ipnet.Mask.Size(); ones == bits {
+		return ipnet.IP.String(), ipnet, nil
+	}
+	return ipnet.String(), ipnet, nil
+}
+
+// in memory, lost on restart, the default without ban_file
+type memBanStore struct {
+	mu     sync.RWMutex
+	bans   map[string]TCPBan
+	ranges map[string]*net.IPNet // of bans not single host
+}
+
+func newMemBanStore() *memBanStore {
+	return &memBanStore{bans: map[string]TCPBan{}, ranges: map[string]*net.IPNet{}}
+}
+
+func (this *memBanStore) Put(ban TCPBan) error {
+	key, ipnet, err := parseBanNet(ban.Net)
+	if err != nil {
+		return err
+	}
+	ban.Net = key
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.bans[key] = ban
+	if key != ipnet.IP.String() {
+		this.ranges[key] = ipnet
+	}
+	return nil
+}
+
+func (this *memBanStore) Get(ipnet string) (TCPBan, bool) {
+	key, _, err := parseBanNet(ipnet)
+	if err != nil {
+		return TCPBan{}, false
+	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	ban, ok := this.bans[key]
+	return ban, ok
+}
+
+func (this *memBanStore) Remove(ipnet string) (bool, error) {
+	key, _, err := parseBanNet(ipnet)
+	if err != nil {
+		return false, err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, ok := this.bans[key]
+	delete(this.bans, key)
+	delete(this.ranges, key)
+	return ok, nil
+}
+
+// host ban by map, ranges scanned, there are few of them
+func (this *memBanStore) Banned(ip net.IP, now time.Time) (TCPBan, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if ban, ok := this.bans[ip.String()]; ok && ban.active(now) {
+		return ban, true
+	}
+	for key, ipnet := range this.ranges {
+		if ban := this.bans[key]; ipnet.Contains(ip) && ban.active(now) {
+			return ban, true
+		}
+	}
+	return TCPBan{}, false
+}
+
+// sorted by Net
+func (this *memBanStore) List() []TCPBan {
+	this.mu.RLock()
+	bans := make([]TCPBan, 0, len(this.bans))
+	for _, ban := range this.bans {
+		bans = append(bans, ban)
+	}
+	this.mu.RUnlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Net < bans[j].Net })
+	return bans
+}
+
+func (this *memBanStore) Prune(expiredBefore time.Time) error {
+	this.prune(expiredBefore)
+	return nil
+}
+
+func (this *memBanStore) prune(expiredBefore time.Time) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	n := 0
+	for key, ban := range this.bans {
+		if !ban.Until.IsZero() && ban.Until.Before(expiredBefore) {
+			delete(this.bans, key)
+			delete(this.ranges, key)
+			n++
+		}
+	}
+	return n
+}
+
+// FileBanStore is a memory store saved to a json file on each change
+type FileBanStore struct {
+	*memBanStore
+	filename string
+	filemu   sync.Mutex // change and its save, so saves in order
+}
+
+// NewFileBanStore loads filename, none yet is an empty store
+func NewFileBanStore(filename string) (*FileBanStore, error) {
+	this := &FileBanStore{memBanStore: newMemBanStore(), filename: filename}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return this, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "load bans")
+	}
+	bans := []TCPBan{}
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	for _, ban := range bans {
+		if err := this.memBanStore.Put(ban); err != nil {
+			return nil, errors.Wrap(err, filename)
+		}
+	}
+	return this, nil
+}
+
+func (this *FileBanStore) Put(ban TCPBan) error {
+	this.filemu.Lock()
+	defer this.filemu.Unlock()
+	if err := this.memBanStore.Put(ban); err != nil {
+		return err
+	}
+	return this.save()
+}
+
+func (this *FileBanStore) Remove(ipnet string) (bool, error) {
+	this.filemu.Lock()
+	defer this.filemu.Unlock()
+	ok, err := this.memBanStore.Remove(ipnet)
+	if !ok || err != nil {
+		return ok, err
+	}
+	return true, this.save()
+}
+
+func (this *FileBanStore) Prune(expiredBefore time.Time) error {
+	this.filemu.Lock()
+	defer this.filemu.Unlock()
+	if this.prune(expiredBefore) == 0 {
+		return nil
+	}
+	return this.save()
+}
+
+// filemu locked
+func (this *FileBanStore) save() error {
+	data, err := json.MarshalIndent(this.List(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeFileAtomic(this.filename, append(data, '\n')), "save bans")
+}
+
+// BanStore set by code, else file of ban_file, else in memory
+func newTCPBanStore(cfg *TCPServerConfig) (BanStore, error) {
+	if cfg.BanStore != nil {
+		return cfg.BanStore, nil
+	}
+	if cfg.BanFile != "" {
+		bs, err := NewFileBanStore(cfg.BanFile)
+		if err != nil {
+			return nil, err
+		}
+		return bs, nil
+	}
+	return newMemBanStore(), nil
+}
+
+/////
+
+func (this *TCPServer) bannedIP(ip string, now time.Time) bool {
+	nip := net.ParseIP(ip)
+	if nip == nil {
+		return false
+	}
+	_, ok := this.bans.Banned(nip, now)
+	return ok
+}
+
+// ban ip over limits, each ban remembered doubles the duration
+func (this *TCPServer) banAuto(ip string, now time.Time) {
+	ban := TCPBan{Net: ip, Reason: "over rate limits", Count: 1}
+	if old, ok := this.bans.Get(ip); ok {
+		ban.Count = old.Count + 1
+	}
+	escalate := ban.Count - 1
+	if escalate > TCP_BAN_MAX_ESCALATE {
+		escalate = TCP_BAN_MAX_ESCALATE
+	}
+	d := time.Duration(this.config().BanDuration) * time.Second << uint(escalate)
+	ban.Until = now.Add(d)
+	atomic.AddInt64(&this.cnts.Bans, 1)
+	log.Println("Banned:", ip, d, ban.Count)
+	if err := this.bans.Put(ban); err != nil {
+		log.Println("Ban not stored:", ip, err)
+	}
+}
+
+// Ban rejects new conns from ip or CIDR range for d, 0 for ever,
+// and closes its current conns.
+func (this *TCPServer) Ban(ipnet string, d time.Duration, reason string) error {
+	key, nw, err := parseBanNet(ipnet)
+	if err != nil {
+		return err
+	}
+	ban := TCPBan{Net: key, Reason: reason}
+	if old, ok := this.bans.Get(key); ok {
+		ban.Count = old.Count
+	}
+	if d > 0 {
+		ban.Until = this.clock.Now().Add(d)
+	}
+	if err := this.bans.Put(ban); err != nil {
+		return err
+	}
+	this.logr().Info("Banned", "net", key, "duration", d, "reason", reason)
+	for _, c := range this.snapshotConns() {
+		if ip := net.ParseIP(tcpRemoteIP(c.Sock)); ip != nil && nw.Contains(ip) {
+			c.doClose(true, TCP_CLOSE_BANNED)
+		}
+	}
+	return nil
+}
+
+// drop bans expired over TCP_BAN_REPUTATION
+func (this *TCPServer) runBanGC() {
+	tickC, tickStop := this.clock.Tick(TCP_IP_SWEEP * time.Second)
+	defer tickStop()
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case <-tickC:
+		}
+		err := this.bans.Prune(this.clock.Now().Add(-TCP_BAN_REPUTATION * time.Second))
+		gopp.ErrPrint(err)
+	}
+}
@@ -0,0 +1,147 @@
+package mintox
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileBanStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mintox-bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bans.json")
+	now := time.Now()
+
+	bs, err := NewFileBanStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Put(TCPBan{Net: "1.2.3.4/32", Until: now.Add(time.Minute), Count: 2})
+	bs.Put(TCPBan{Net: "10.1.0.0/16", Reason: "admin"})
+	bs.Put(TCPBan{Net: "2001:db8::1", Until: now.Add(-time.Minute)})
+	if err := bs.Put(TCPBan{Net: "nonsense"}); err == nil {
+		t.Error("invalid net stored")
+	}
+
+	// survives restart
+	bs, err = NewFileBanStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bans := bs.List(); len(bans) != 3 || bans[0].Net != "1.2.3.4" || bans[1].Net != "10.1.0.0/16" {
+		t.Fatal("bans not loaded:", bans)
+	}
+	if ban, ok := bs.Get("1.2.3.4"); !ok || ban.Count != 2 {
+		t.Error("ban reputation:", ban, ok)
+	}
+	cases := map[string]bool{
+		"1.2.3.4":         true,
+		"::ffff:1.2.3.4":  true,
+		"1.2.3.5":         false,
+		"10.1.200.7":      true,
+		"10.2.0.1":        false,
+		"2001:db8::1":     false, // expired
+		"2001:db8::dead":  false,
+		"::ffff:10.1.0.1": true,
+	}
+	for ip, want := range cases {
+		if _, ok := bs.Banned(net.ParseIP(ip), now); ok != want {
+			t.Error("banned:", ip, ok)
+		}
+	}
+	if _, ok := bs.Banned(net.ParseIP("1.2.3.4"), now.Add(2*time.Minute)); ok {
+		t.Error("ban not expired")
+	}
+
+	if err := bs.Prune(now); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := bs.Remove("10.1.0.0/16"); !ok {
+		t.Error("range not removed")
+	}
+	bs, _ = NewFileBanStore(filename)
+	if bans := bs.List(); len(bans) != 1 || bans[0].Net != "1.2.3.4" {
+		t.Error("prune and remove not saved:", bans)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp*")); len(matches) != 0 {
+		t.Error("temp files left:", matches)
+	}
+
+	ioutil.WriteFile(filename, []byte("[{"), 0600)
+	if _, err := NewFileBanStore(filename); err == nil {
+		t.Error("corrupt file loaded")
+	}
+}
+
+func TestBanPersistRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mintox-bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := DefaultTCPServerConfig()
+	cfg.BanFile = filepath.Join(dir, "bans.json")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srvo, addr := newTstListenServer(t, cfg, defaultClock)
+	if err := srvo.Ban("127.0.0.0/8", time.Minute, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srvo.Ban("127.0.0.1/33", time.Minute, "test"); err == nil {
+		t.Error("invalid range banned")
+	}
+	if !tstDialRejected(t, addr) {
+		t.Error("ip in banned range not rejected")
+	}
+	srvo.Shutdown(ctx)
+
+	srvo, addr = newTstListenServer(t, cfg, defaultClock)
+	defer srvo.Shutdown(ctx)
+	if !tstDialRejected(t, addr) || srvo.Counters().BanRejected != 1 {
+		t.Error("ban lost by restart:", srvo.BannedIPs())
+	}
+	if !srvo.UnbanIP("127.0.0.0/8") || len(srvo.BannedIPs()) != 0 {
+		t.Error("unban range:", srvo.BannedIPs())
+	}
+}
+
+// repeated offender banned longer each time
+func TestBanEscalate(t *testing.T) {
+	srvo := newTstServer()
+	clk := newFakeTstClock()
+	srvo.clock = clk
+	d := time.Duration(srvo.config().BanDuration) * time.Second
+	for i := 0; i < TCP_BAN_MAX_ESCALATE+2; i++ {
+		now := clk.Now()
+		srvo.banAuto("192.0.2.1", now)
+		escalate := i
+		if escalate > TCP_BAN_MAX_ESCALATE {
+			escalate = TCP_BAN_MAX_ESCALATE
+		}
+		until := srvo.BannedIPs()["192.0.2.1"]
+		if until.Sub(now) != d<<uint(escalate) {
+			t.Fatal("ban duration:", i, until.Sub(now))
+		}
+		clk.Advance(until.Sub(now))
+		if len(srvo.BannedIPs()) != 0 {
+			t.Fatal("ban not expired:", i)
+		}
+	}
+	if srvo.Counters().Bans != TCP_BAN_MAX_ESCALATE+2 {
+		t.Error("bans counted:", srvo.Counters().Bans)
+	}
+	// forgotten after TCP_BAN_REPUTATION
+	clk.Advance(TCP_BAN_REPUTATION*time.Second + time.Second)
+	srvo.bans.Prune(clk.Now().Add(-TCP_BAN_REPUTATION * time.Second))
+	if _, ok := srvo.bans.Get("192.0.2.1"); ok {
+		t.Error("reputation not pruned")
+	}
+}
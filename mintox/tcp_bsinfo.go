@@ -0,0 +1,47 @@
+package mintox
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// read loop stops after answered an info request, not a protocol error
+var errTCPInfoServed = errors.New("Bootstrap info served")
+
+// answer bootstrap info requests on relay ports too, like the UDP one of
+// tox-bootstrapd. Version is BOOTSTRAPD_VERSION. Off until set.
+func (this *TCPServer) SetMOTD(motd string) error { return this.bsinfo.setMotd(motd) }
+
+// same as NetworkCore.SetMOTDFunc, for info requests on relay ports
+func (this *TCPServer) SetMOTDFunc(fn func() string) { this.bsinfo.setMotdFunc(fn) }
+
+// before the handshake, hold the first INFO_REQUEST_PACKET_LENGTH bytes to tell
+// an info request. Answered and errTCPInfoServed returned, else kept in hshead
+// as the beginning of the handshake. read goroutine only.
+func (this *TCPSecureConn) serveBootstrapInfo() error {
+	head := make([]byte, INFO_REQUEST_PACKET_LENGTH)
+	if _, err := io.ReadFull(this.crbuf, head); err != nil {
+		return err
+	}
+	if !isTCPBootstrapInfoRequest(head) {
+		this.hshead = head
+		return nil
+	}
+	srvo := this.srvo
+	srvo.hsconnmu.Lock()
+	delete(srvo.HSConns, this.Sock) // not a failed handshake
+	srvo.hsconnmu.Unlock()
+	if _, err := this.sockWrite(srvo.bsinfo.response()); err != nil {
+		return err
+	}
+	atomic.AddInt64(&srvo.cnts.InfoServed, 1)
+	this.logr().Debug("Bootstrap info served", "addr", this.Sock.RemoteAddr())
+	return errTCPInfoServed
+}
+
+// info request possible on this conn, not yet told
+func (this *TCPSecureConn) wantInfoRequest() bool {
+	return this.srvo != nil && !this.rehs && this.hshead == nil && this.srvo.bsinfo.enabled()
+}
@@ -0,0 +1,141 @@
+package mintox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requestTstTCPInfo(t *testing.T, addr string, split bool) *BootstrapInfo {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := NewBootstrapInfoRequest()
+	if split {
+		c.Write(req[:10])
+		time.Sleep(50 * time.Millisecond)
+		req = req[10:]
+	}
+	c.Write(req)
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	rsp, err := ioutil.ReadAll(c) // closed by server after answered
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ParseBootstrapInfo(rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestTCPBootstrapInfo(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	// not enabled, the request taken as a bad handshake
+	c, _ := net.Dial("tcp", addr)
+	c.Write(NewBootstrapInfoRequest())
+	c.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.Counters().HandshakeFailed == 1 }) {
+		t.Fatal("request accepted when not enabled")
+	}
+
+	if err := srvo.SetMOTD(strings.Repeat("x", MAX_MOTD_LENGTH+1)); err == nil {
+		t.Error("too long motd set")
+	}
+	if err := srvo.SetMOTD("static motd"); err != nil {
+		t.Fatal(err)
+	}
+	info := requestTstTCPInfo(t, addr, false)
+	if info.Version != BOOTSTRAPD_VERSION || info.Motd != "static motd" {
+		t.Error("info:", info)
+	}
+
+	served := 0
+	srvo.SetMOTDFunc(func() string {
+		served++
+		return fmt.Sprintf("served %d, conns %d", served, srvo.ConnCount())
+	})
+	// the asking conn not counted
+	if info := requestTstTCPInfo(t, addr, true); info.Motd != "served 1, conns 0" {
+		t.Error("dynamic motd:", info.Motd)
+	}
+	srvo.SetMOTDFunc(func() string { return strings.Repeat("y", MAX_MOTD_LENGTH*2) })
+	if info := requestTstTCPInfo(t, addr, false); len(info.Motd) != MAX_MOTD_LENGTH {
+		t.Error("long motd not cut:", len(info.Motd))
+	}
+	srvo.SetMOTDFunc(nil)
+	if info := requestTstTCPInfo(t, addr, false); info.Motd != "static motd" {
+		t.Error("static motd not back:", info.Motd)
+	}
+
+	// handshake still works with info enabled
+	pk, sk, _ := NewCBKeyPair()
+	cli := NewTCPClient(addr, srvo.Pubkey, pk, sk)
+	defer cli.Close()
+	if !waitTstCond(3*time.Second, func() bool { return cli.Status == TCP_CLIENT_CONFIRMED }) {
+		t.Error("client not confirmed")
+	}
+	if n := srvo.Counters().HandshakeFailed; n != 1 {
+		t.Error("handshake failed:", n)
+	}
+	if n := srvo.Counters().InfoServed; n != 4 {
+		t.Error("info served:", n)
+	}
+}
+
+func TestUDPBootstrapInfoMOTDFunc(t *testing.T) {
+	neto, err := NewNetworkCoreFromAddr("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer neto.Close()
+	c, err := net.DialUDP("udp4", nil, neto.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	request := func() *BootstrapInfo {
+		c.Write(NewBootstrapInfoRequest())
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		rsp := make([]byte, 1+4+MAX_MOTD_LENGTH+1)
+		n, err := c.Read(rsp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ParseBootstrapInfo(rsp[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	up := time.Now()
+	neto.SetMOTDFunc(func() string { return fmt.Sprintf("up %v", time.Since(up) >= 0) })
+	if info := request(); info.Version != BOOTSTRAPD_VERSION || info.Motd != "up true" {
+		t.Error("dynamic motd:", info)
+	}
+	neto.BootstrapSetCallback(7, "set by callback")
+	neto.SetMOTDFunc(nil)
+	if info := request(); info.Version != 7 || info.Motd != "set by callback" {
+		t.Error("callback motd:", info)
+	}
+	if neto.SetMOTD("new motd") != nil {
+		t.Fatal("set motd failed")
+	}
+	if info := request(); info.Version != 7 || info.Motd != "new motd" {
+		t.Error("motd:", info)
+	}
+	if _, err := ParseBootstrapInfo([]byte{BOOTSTRAP_INFO_PACKET_ID, 0, 0}); err == nil {
+		t.Error("short info parsed")
+	}
+}
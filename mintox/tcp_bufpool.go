@@ -0,0 +1,82 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// pooled buffers fit a socket read and the largest frame: length + encrypted packet
+const TCP_POOL_BUF_SIZE = 4096
+
+// buffers of the packet path, reused across packets and conns to keep GC quiet at relay scale
+var tcpBufPool = sync.Pool{New: func() interface{} {
+	buf := make([]byte, TCP_POOL_BUF_SIZE)
+	return &buf
+}}
+
+func getTCPBuf() *[]byte { return tcpBufPool.Get().(*[]byte) }
+
+// buf must not be used after
+func putTCPBuf(buf *[]byte) {
+	if buf == nil || cap(*buf) < TCP_POOL_BUF_SIZE {
+		return
+	}
+	*buf = (*buf)[:TCP_POOL_BUF_SIZE]
+	tcpBufPool.Put(buf)
+}
+
+// length + encrypted plain appended to dst, nonce not increased
+func appendTCPPacket(dst []byte, shrkey *CryptoKey, nonce *CBNonce, plain []byte) ([]byte, error) {
+	if err := checkPacketSize(len(plain)); err != nil {
+		return dst, err
+	}
+	n := len(dst)
+	dst = growBytes(dst, TCP_FRAME_HEADER_SIZE)
+	dst, err := EncryptDataSymmetricTo(dst, shrkey, nonce, plain)
+	if err != nil {
+		return dst[:n], err
+	}
+	putFrameHeader(dst[n:], len(dst)-n-TCP_FRAME_HEADER_SIZE)
+	return dst, nil
+}
+
+// length + encrypted packet decrypted and appended to dst, nonce increased only on success,
+// so a bad packet never desyncs the stream silently
+func openTCPPacket(dst []byte, shrkey *CryptoKey, nonce *CBNonce, encpkt []byte) (datlen uint16, plain []byte, err error) {
+	if len(encpkt) < TCP_FRAME_HEADER_SIZE+MAC_SIZE {
+		return 0, nil, errors.Errorf("Packet too short: %d", len(encpkt))
+	}
+	datlen = binary.BigEndian.Uint16(encpkt)
+	if int(datlen) != len(encpkt)-TCP_FRAME_HEADER_SIZE {
+		return datlen, nil, errors.Errorf("Packet length mismatch: %d, %d", datlen, len(encpkt)-TCP_FRAME_HEADER_SIZE)
+	}
+	plain, err = DecryptDataSymmetricTo(dst, shrkey, nonce, encpkt[TCP_FRAME_HEADER_SIZE:])
+	if err != nil {
+		return datlen, nil, errors.Wrap(err, "Decrypt packet")
+	}
+	nonce.Incr()
+	return datlen, plain, nil
+}
+
+// read goroutine's buffers, taken from pool at first use, back when read loop done
+type tcpReadBufs struct {
+	sock  *[]byte // socket read
+	frame *[]byte // length + encrypted of current packet
+	plain *[]byte // decrypted of current packet, valid until next packet
+}
+
+func (this *tcpReadBufs) get(pb **[]byte) []byte {
+	if *pb == nil {
+		*pb = getTCPBuf()
+	}
+	return **pb
+}
+
+func (this *tcpReadBufs) release() {
+	for _, pb := range []**[]byte{&this.sock, &this.frame, &this.plain} {
+		putTCPBuf(*pb)
+		*pb = nil
+	}
+}
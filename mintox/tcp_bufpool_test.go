@@ -0,0 +1,136 @@
+package mintox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTstPacketKeys() (*CryptoKey, *CBNonce, *CBNonce) {
+	pk, sk, _ := NewCBKeyPair()
+	shrkey, _ := CBBeforeNm(pk, sk)
+	nonce := CBRandomNonce()
+	return shrkey, nonce, NewCBNonce(append([]byte{}, nonce.Bytes()...))
+}
+
+func TestTCPPacketPooled(t *testing.T) {
+	shrkey, sent, recv := newTstPacketKeys()
+	c := &TCPSecureConn{Shrkey: shrkey, SentNonce: sent, RecvNonce: recv}
+	plain := CBRandomBytes(TCP_MAX_PLAIN_SIZE)
+
+	old, err := EncryptDataSymmetric(shrkey, sent, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encpkt, err := c.CreatePacket(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encpkt) != 2+len(old) || !bytes.Equal(encpkt[2:], old) || int(encpkt[0])<<8|int(encpkt[1]) != len(old) {
+		t.Fatal("packet differs from unpooled one")
+	}
+	if _, err := c.CreatePacket(make([]byte, TCP_MAX_PLAIN_SIZE+1)); err == nil {
+		t.Error("too big packet created")
+	}
+
+	buf := getTCPBuf()
+	defer putTCPBuf(buf)
+	datlen, plnpkt, err := c.unpacketTo((*buf)[:0], encpkt)
+	if err != nil || int(datlen) != len(old) || !bytes.Equal(plnpkt, plain) || &plnpkt[0] != &(*buf)[0] {
+		t.Fatal("unpacket into pooled buffer:", err, datlen)
+	}
+	encpkt[len(encpkt)-1] ^= 1
+	if _, _, err := c.Unpacket(encpkt); err == nil {
+		t.Error("corrupted packet decrypted")
+	}
+	if _, _, err := c.Unpacket(encpkt[:1]); err == nil {
+		t.Error("truncated packet decrypted")
+	}
+}
+
+func TestTCPPacketPathNoAlloc(t *testing.T) {
+	shrkey, sent, recv := newTstPacketKeys()
+	plain := CBRandomBytes(1024)
+	frame, plnbuf := getTCPBuf(), getTCPBuf()
+	defer putTCPBuf(frame)
+	defer putTCPBuf(plnbuf)
+	allocs := testing.AllocsPerRun(100, func() {
+		encpkt, err := appendTCPPacket((*frame)[:0], shrkey, sent, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecryptDataSymmetricTo((*plnbuf)[:0], shrkey, recv, encpkt[2:]); err != nil {
+			t.Fatal(err)
+		}
+		sent.Incr()
+		recv.Incr()
+	})
+	if allocs != 0 {
+		t.Error("allocs per packet:", allocs)
+	}
+}
+
+func BenchmarkTCPPacketUnpooled(b *testing.B) {
+	shrkey, sent, recv := newTstPacketKeys()
+	plain := CBRandomBytes(1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(plain)))
+	for i := 0; i < b.N; i++ {
+		encdat, _ := EncryptDataSymmetric(shrkey, sent, plain)
+		DecryptDataSymmetric(shrkey, recv, encdat)
+	}
+}
+
+func BenchmarkTCPPacketPooled(b *testing.B) {
+	shrkey, sent, recv := newTstPacketKeys()
+	plain := CBRandomBytes(1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(plain)))
+	for i := 0; i < b.N; i++ {
+		frame, plnbuf := getTCPBuf(), getTCPBuf()
+		encpkt, _ := appendTCPPacket((*frame)[:0], shrkey, sent, plain)
+		DecryptDataSymmetricTo((*plnbuf)[:0], shrkey, recv, encpkt[2:])
+		putTCPBuf(frame)
+		putTCPBuf(plnbuf)
+	}
+}
+
+func TestTCPUnpacketStrict(t *testing.T) {
+	shrkey, sent, recv := newTstPacketKeys()
+	c := &TCPSecureConn{Shrkey: shrkey, SentNonce: sent, RecvNonce: recv}
+	next := func() []byte {
+		encpkt, err := c.CreatePacket([]byte{TCP_PACKET_PING, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SentNonce.Incr()
+		return encpkt
+	}
+	encpkt := next()
+	nonce := append([]byte{}, recv.Bytes()...)
+	for _, bad := range [][]byte{
+		nil,
+		encpkt[:1],
+		encpkt[:2+MAC_SIZE-1],               // shorter than mac
+		encpkt[:len(encpkt)-1],              // length prefix not match
+		append([]byte{0, 0}, encpkt[2:]...), // zero length prefix
+	} {
+		if _, plain, err := c.Unpacket(bad); err == nil || plain != nil {
+			t.Error("bad packet unpacked:", len(bad), err)
+		}
+	}
+	corrupted := append([]byte{}, encpkt...)
+	corrupted[2] ^= 0x80
+	if _, _, err := c.Unpacket(corrupted); err == nil {
+		t.Error("corrupted packet unpacked")
+	}
+	if !bytes.Equal(recv.Bytes(), nonce) {
+		t.Fatal("nonce advanced by failed packets")
+	}
+	// stream still in sync after failures
+	for i := 0; i < 2; i++ {
+		if _, plain, err := c.Unpacket(encpkt); err != nil || !bytes.Equal(plain, []byte{TCP_PACKET_PING, 1}) {
+			t.Fatal("valid packet not unpacked:", i, err)
+		}
+		encpkt = next()
+	}
+}
@@ -0,0 +1,139 @@
+package mintox
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// TCPConnCallbacks subscribes events of a TCPSecureConn, nil fields for not interested.
+// Pass it to NewTCPSecureConn, so it is set before Start and never misses an event.
+// All are called on the conn's own goroutines, in subscribed order, after the
+// legacy On* fields of the conn, a slow one stalls the conn.
+type TCPConnCallbacks struct {
+	OnNetRecv   func(n int) // read goroutine
+	OnNetSent   func(n int) // write and ping goroutines
+	OnNetDrop   func(n int) // queued packet not sent when conn closed
+	OnConfirmed func(obj Object)
+	OnClosed    func(obj Object) // once, by any goroutine called Close
+	OnError     func(obj Object, err error)
+	// valid oob send of the conn, data valid only during the call
+	OnOOBData func(obj Object, dstpk *CryptoKey, data []byte)
+}
+
+type tcpConnSubs struct {
+	mu   sync.Mutex   // writers
+	subs atomic.Value // []TCPConnCallbacks, copy on write
+}
+
+func (this *tcpConnSubs) add(cbs ...TCPConnCallbacks) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	old := this.get()
+	subs := make([]TCPConnCallbacks, 0, len(old)+len(cbs))
+	this.subs.Store(append(append(subs, old...), cbs...))
+}
+
+func (this *tcpConnSubs) get() []TCPConnCallbacks {
+	subs, _ := this.subs.Load().([]TCPConnCallbacks)
+	return subs
+}
+
+func (this *tcpConnSubs) clear() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.subs.Store([]TCPConnCallbacks(nil))
+}
+
+// Subscribe adds a subscriber any time, safe with running conn.
+// Events before it returned are missed, subscribe at NewTCPSecureConn for all.
+func (this *TCPSecureConn) Subscribe(cbs TCPConnCallbacks) {
+	if this.isClosed() {
+		return
+	}
+	this.subs.add(cbs)
+}
+
+// the legacy On* fields, doClose nils them under connmu
+func (this *TCPSecureConn) legacyCallbacks() TCPConnCallbacks {
+	this.connmu.RLock()
+	defer this.connmu.RUnlock()
+	return TCPConnCallbacks{OnNetRecv: this.OnNetRecv, OnNetSent: this.OnNetSent, OnNetDrop: this.OnNetDrop,
+		OnConfirmed: this.OnConfirmed, OnClosed: this.OnClosed, OnError: this.OnError, OnOOBData: this.OnOOBData}
+}
+
+func (this *TCPSecureConn) emitNetRecv(n int) {
+	if fn := this.legacyCallbacks().OnNetRecv; fn != nil {
+		fn(n)
+	}
+	for _, cbs := range this.subs.get() {
+		if cbs.OnNetRecv != nil {
+			cbs.OnNetRecv(n)
+		}
+	}
+}
+
+func (this *TCPSecureConn) emitNetSent(n int) {
+	if fn := this.legacyCallbacks().OnNetSent; fn != nil {
+		fn(n)
+	}
+	for _, cbs := range this.subs.get() {
+		if cbs.OnNetSent != nil {
+			cbs.OnNetSent(n)
+		}
+	}
+}
+
+func (this *TCPSecureConn) emitNetDrop(n int) {
+	if fn := this.legacyCallbacks().OnNetDrop; fn != nil {
+		fn(n)
+	}
+	for _, cbs := range this.subs.get() {
+		if cbs.OnNetDrop != nil {
+			cbs.OnNetDrop(n)
+		}
+	}
+}
+
+func (this *TCPSecureConn) emitConfirmed() {
+	if fn := this.legacyCallbacks().OnConfirmed; fn != nil {
+		fn(this)
+	}
+	for _, cbs := range this.subs.get() {
+		if cbs.OnConfirmed != nil {
+			cbs.OnConfirmed(this)
+		}
+	}
+}
+
+func (this *TCPSecureConn) emitClosed() {
+	if fn := this.legacyCallbacks().OnClosed; fn != nil {
+		fn(this)
+	}
+	for _, cbs := range this.subs.get() {
+		if cbs.OnClosed != nil {
+			cbs.OnClosed(this)
+		}
+	}
+}
+
+func (this *TCPSecureConn) emitError(err error) {
+	if fn := this.legacyCallbacks().OnError; fn != nil {
+		fn(this, err)
+	}
+	for _, cbs := range this.subs.get() {
+		if cbs.OnError != nil {
+			cbs.OnError(this, err)
+		}
+	}
+}
+
+func (this *TCPSecureConn) emitOOBData(dstpk *CryptoKey, data []byte) {
+	if fn := this.legacyCallbacks().OnOOBData; fn != nil {
+		fn(this, dstpk, data)
+	}
+	for _, cbs := range this.subs.get() {
+		if cbs.OnOOBData != nil {
+			cbs.OnOOBData(this, dstpk, data)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package mintox
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTCPConnCallbacks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(ev string) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}
+	var recvn int64
+	sub := func(name string) TCPConnCallbacks {
+		return TCPConnCallbacks{
+			OnNetRecv:   func(n int) { atomic.AddInt64(&recvn, int64(n)) },
+			OnConfirmed: func(Object) { record(name + " confirmed") },
+			OnClosed:    func(Object) { record(name + " closed") },
+		}
+	}
+
+	c0, c1 := net.Pipe()
+	pk, sk, _ := NewCBKeyPair()
+	secon := NewTCPSecureConn(c0, sub("a"), sub("b"))
+	secon.Seckey = sk
+	secon.Start()
+	peer := newTstPeer(t, c1, pk)
+	peer.handshake()
+	if !waitTstCond(3*time.Second, func() bool { return secon.status() == TCP_STATUS_CONFIRMED }) {
+		t.Fatal("conn not confirmed")
+	}
+	late := int32(0)
+	secon.Subscribe(TCPConnCallbacks{OnClosed: func(Object) { atomic.AddInt32(&late, 1) }})
+	secon.Close()
+	secon.Close()
+	secon.Subscribe(TCPConnCallbacks{OnClosed: func(Object) { t.Error("subscribed after closed") }})
+
+	want := []string{"a confirmed", "b confirmed", "a closed", "b closed"}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != len(want) {
+		t.Fatal("events:", events)
+	}
+	for i, ev := range want {
+		if events[i] != ev {
+			t.Error("event order:", i, events[i], ev)
+		}
+	}
+	if n := atomic.LoadInt64(&recvn); n != 2*secon.RecvBytes() {
+		t.Error("recv bytes not told to both:", n, secon.RecvBytes())
+	}
+	if atomic.LoadInt32(&late) != 1 {
+		t.Error("late subscriber not called")
+	}
+}
+
+// legacy fields read by conn goroutines while Close nils them, for -race
+func TestTCPConnLegacyCallbacksClose(t *testing.T) {
+	c0, _ := net.Pipe()
+	secon := NewTCPSecureConn(c0)
+	var sentn int64
+	secon.OnNetSent = func(n int) { atomic.AddInt64(&sentn, int64(n)) }
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			secon.emitNetSent(1)
+		}
+	}()
+	secon.Close()
+	<-done
+	n := atomic.LoadInt64(&sentn)
+	secon.emitNetSent(1)
+	if atomic.LoadInt64(&sentn) != n {
+		t.Error("legacy callback called after closed")
+	}
+}
@@ -1,7 +1,6 @@
 package mintox
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"gopp"
@@ -9,9 +8,9 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/djherbis/buffer"
 	"github.com/pkg/errors"
@@ -78,6 +77,7 @@ func ServerHandshakeFrom(encpkt []byte, shrkey *CryptoKey) *ServerHandshake {
 type TCPClient struct {
 	Status   uint8
 	ServAddr string
+	Proxy    *TCPProxyInfo // nil for direct conn
 
 	SelfPubkey *CryptoKey
 	SelfSeckey *CryptoKey
@@ -89,10 +89,15 @@ type TCPClient struct {
 	SentNonce  *CBNonce
 	RecvNonce  *CBNonce
 	TempNonce  *CBNonce
+	// TCP_HANDSHAKE_*, set before connect, noise one for mintox relays only
+	HandshakeVersion uint8
+	noise            *tcpNoiseInit // noise handshake in progress
 
 	KillAt    time.Time
 	LastPined uint64
-	Pingid    uint64
+	Pingid    uint64 // last sent, see pings for all outstanding ones
+	pings     PingRegistry
+	rtt       rttStat // of matched pongs
 
 	PingResponseId uint64
 	PingRequestId  uint64
@@ -132,9 +137,39 @@ type TCPClient struct {
 	OnNetRecv      func(n int)
 	OnNetSent      func(n int)
 	OnReservedData func(object Object, number uint32, connection_id uint8, data []byte, cbdata Object)
+
+	// relay replied an onion request of SendOnionRequest
+	OnOnionResponse func(data []byte)
+	// relay replied our routing request, connid is valid only if ok
+	OnRouteEstablished func(peerPubkey *CryptoKey, connid uint8, ok bool)
+
+	// Threading: callbacks fired by received packets (OnNetRecv, RoutingDataFunc,
+	// OnRouteEstablished ...) are called on the read goroutine by default, so a slow one
+	// stalls reading of the conn. Set CallbackPool before start to call them on the pool,
+	// still in order for this conn, but may be dropped if the pool is not blocking.
+	CallbackPool *CallbackPool
+	cbkey        uint64
+
+	// routing data and oob data with peer resolved
+	OnData    func(peerPubkey *CryptoKey, data []byte)
+	OnOOBData func(peerPubkey *CryptoKey, data []byte)
+
+	caps      uint32 // negotiated TCP_CAP_*, atomic
+	rehsing   int32  // 1 when re-handshake sent but not confirmed
+	hsmu      sync.Mutex
+	ticket    []byte     // session ticket of relay, hsmu
+	resumeKey *CryptoKey // session key kept while resuming, hsmu
+	resuming  int32      // 1 when resume sent but not answered
+	readDone  int32      // 1 when read goroutine of the conn done
+
+	peersmu  sync.Mutex
+	peers    map[string]*CryptoKey // binpk => wanted peer, routed again after confirmed
+	clock    clock                 // keepalive time source, nil for real one
+	lastPong int64                 // unixnano of confirmed or last matched pong, atomic
+	closed   int32
+	stopC    chan bool
 }
 
-// TODO proxy
 func NewTCPClientRaw(serv_addr string, serv_pubkey string, self_pubkey, self_seckey string) *TCPClient {
 	this := NewTCPClient(serv_addr, NewCryptoKeyFromHex(serv_pubkey),
 		NewCryptoKeyFromHex(self_pubkey), NewCryptoKeyFromHex(self_seckey))
@@ -142,8 +177,31 @@ func NewTCPClientRaw(serv_addr string, serv_pubkey string, self_pubkey, self_sec
 }
 
 func NewTCPClient(serv_addr string, serv_pubkey, self_pubkey, self_seckey *CryptoKey) *TCPClient {
+	return NewTCPClientProxy(serv_addr, serv_pubkey, self_pubkey, self_seckey, nil)
+}
+
+// with Noise IK handshake, only mintox relays know it
+func NewTCPClientNoise(serv_addr string, serv_pubkey, self_pubkey, self_seckey *CryptoKey) *TCPClient {
+	this := newTCPClientProxy(serv_addr, serv_pubkey, self_pubkey, self_seckey, nil)
+	this.HandshakeVersion = TCP_HANDSHAKE_NOISE_IK
+	this.goConnect()
+	return this
+}
+
+// proxy nil or TCP_PROXY_NONE to connect directly
+func NewTCPClientProxy(serv_addr string, serv_pubkey, self_pubkey, self_seckey *CryptoKey,
+	proxy *TCPProxyInfo) *TCPClient {
+	this := newTCPClientProxy(serv_addr, serv_pubkey, self_pubkey, self_seckey, proxy)
+	this.goConnect()
+	return this
+}
+
+// not connected, set callbacks then goConnect
+func newTCPClientProxy(serv_addr string, serv_pubkey, self_pubkey, self_seckey *CryptoKey,
+	proxy *TCPProxyInfo) *TCPClient {
 	this := &TCPClient{}
 	this.ServAddr = serv_addr
+	this.Proxy = proxy
 
 	var err error
 	//
@@ -158,7 +216,10 @@ func NewTCPClient(serv_addr string, serv_pubkey, self_pubkey, self_seckey *Crypt
 	gopp.ErrPrint(err)
 
 	this.conns = NewBiMap()
+	return this
+}
 
+func (this *TCPClient) goConnect() {
 	go func() {
 		err := this.connect()
 		if err == nil {
@@ -169,7 +230,6 @@ func NewTCPClient(serv_addr string, serv_pubkey, self_pubkey, self_seckey *Crypt
 			}
 		}
 	}()
-	return this
 }
 
 func (this *TCPClient) SetKeyPairRaw(pubkey, seckey string) {
@@ -189,15 +249,35 @@ func (this *TCPClient) SetKeyPair(pubkey, seckey *CryptoKey) {
 }
 
 func (this *TCPClient) connect() error {
-	this.Status = TCP_CLIENT_CONNECTING
-	c, err := net.Dial("tcp", this.ServAddr)
+	switch {
+	case this.Proxy != nil && this.Proxy.Type == TCP_PROXY_HTTP:
+		this.Status = TCP_CLIENT_PROXY_HTTP_CONNECTING
+	case this.Proxy != nil && this.Proxy.Type == TCP_PROXY_SOCKS5:
+		this.Status = TCP_CLIENT_PROXY_SOCKS5_CONNECTING
+	default:
+		this.Status = TCP_CLIENT_CONNECTING
+	}
+	var c net.Conn
+	var err error
+	switch {
+	case isWSURL(this.ServAddr):
+		c, err = DialWS(this.ServAddr, this.Proxy)
+	case isTLSURL(this.ServAddr):
+		c, err = DialTLS(this.ServAddr, this.Proxy)
+	case isQUICURL(this.ServAddr):
+		c, err = DialQUIC(this.ServAddr, this.Proxy)
+	default:
+		c, err = this.Proxy.Dial(this.ServAddr)
+	}
 	gopp.ErrPrint(err, this.ServAddr)
 	if err != nil {
 		return err
 	}
-	tcpc := c.(*net.TCPConn)
-	err = tcpc.SetWriteBuffer(128 * 1024)
-	gopp.ErrPrint(err)
+	if tcpc, ok := c.(*net.TCPConn); ok {
+		err = tcpc.SetWriteBuffer(128 * 1024)
+		gopp.ErrPrint(err)
+	}
+	this.Status = TCP_CLIENT_CONNECTING
 	log.Println("Connected to:", c.RemoteAddr(), err)
 
 	this.conn = c
@@ -210,6 +290,9 @@ func (this *TCPClient) connect() error {
 }
 
 func (this *TCPClient) Close() error {
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) && this.stopC != nil {
+		close(this.stopC)
+	}
 	if this.conn != nil {
 		err := errors.Wrap(this.conn.Close(), this.ServAddr)
 		return err
@@ -217,24 +300,39 @@ func (this *TCPClient) Close() error {
 	return errors.Errorf("Not connected: %s", this.ServAddr)
 }
 
+// call fn directly or on CallbackPool
+func (this *TCPClient) callback(fn func()) {
+	if this.CallbackPool == nil {
+		fn()
+		return
+	}
+	if this.cbkey == 0 {
+		this.cbkey = nextCallbackKey()
+	}
+	if !this.CallbackPool.Submit(this.cbkey, fn) {
+		log.Println("Callback pool full, drop callback:", this.ServAddr)
+	}
+}
+
 func (this *TCPClient) start() {
+	this.stopC = make(chan bool)
 	go this.doWriteConn()
 	go this.doReadConn()
 }
 func (this *TCPClient) doWriteConn() {
-	spdc := NewSpeedCalc()
-
 	flushCtrl := func() error {
 		for len(this.cwctrlq) > 0 {
 			data := <-this.cwctrlq
-			atomic.AddInt32(&this.cwctrldlen, -int32(len(data)))
+			this.ctrlDequeued(data)
 			var datai = []interface{}{data}
 			wn, err := this.WritePacket(datai[0].([]byte))
+			if err == ErrRehandshaking {
+				continue
+			}
 			gopp.ErrPrint(err, wn, this.ServAddr)
 			if err != nil {
 				return err
 			}
-			spdc.Data(wn)
 			if this.OnNetSent != nil {
 				this.OnNetSent(wn)
 			}
@@ -243,25 +341,29 @@ func (this *TCPClient) doWriteConn() {
 		return nil
 	}
 
-	lastLogTime := time.Now().Add(-3 * time.Second)
+	stopC := this.stopC
 	stop := false
 	for !stop {
 		data, ctrlq := []byte(nil), false
 		select {
+		case <-stopC:
+			goto endloop
 		case data = <-this.cwctrlq:
-			atomic.AddInt32(&this.cwctrldlen, -int32(len(data)))
+			this.ctrlDequeued(data)
 			ctrlq = true
 		case data = <-this.cwdataq:
-			atomic.AddInt32(&this.cwdatadlen, -int32(len(data)))
+			this.dataDequeued(data)
 		}
 
 		var datai = []interface{}{data}
 		wn, err := this.WritePacket(datai[0].([]byte))
+		if err == ErrRehandshaking {
+			continue // dropped, the conn goes on
+		}
 		gopp.ErrPrint(err, wn, this.ServAddr)
 		if err != nil {
 			goto endloop
 		}
-		spdc.Data(wn)
 		if this.OnNetSent != nil {
 			this.OnNetSent(wn)
 		}
@@ -274,27 +376,47 @@ func (this *TCPClient) doWriteConn() {
 			}
 		}
 
-		if int(time.Since(lastLogTime).Seconds()) >= 1 {
-			lastLogTime = time.Now()
-			log.Printf("------- async wrote ----- spd: %d, %s, pq:%d, cq:%d------\n",
-				spdc.Avgspd, this.ServAddr, len(this.cwctrlq), len(this.cwdataq))
-		}
 	}
 endloop:
 	log.Println("write routine done:", this.ServAddr)
 }
+
+// same accounting rule as TCPSecureConn.enqueueCtrl
+func (this *TCPClient) enqueueCtrl(data []byte) bool {
+	atomic.AddInt32(&this.cwctrldlen, int32(len(data)))
+	select {
+	case this.cwctrlq <- data:
+		return true
+	default:
+		this.ctrlDequeued(data)
+		return false
+	}
+}
+func (this *TCPClient) enqueueData(data []byte) bool {
+	atomic.AddInt32(&this.cwdatadlen, int32(len(data)))
+	select {
+	case this.cwdataq <- data:
+		return true
+	default:
+		this.dataDequeued(data)
+		return false
+	}
+}
+func (this *TCPClient) ctrlDequeued(data []byte) {
+	checkQueueLen(atomic.AddInt32(&this.cwctrldlen, -int32(len(data))), "ctrl")
+}
+func (this *TCPClient) dataDequeued(data []byte) {
+	checkQueueLen(atomic.AddInt32(&this.cwdatadlen, -int32(len(data))), "data")
+}
+
 func (this *TCPClient) doReadConn() {
-	lastLogTime := time.Now().Add(-3 * time.Second)
-	spdc := NewSpeedCalc()
-	var nxtpktlen uint16
+	var framer FrameReader
+	pb := getTCPBuf()
+	defer putTCPBuf(pb)
 	stop := false
 	for !stop {
 		c := this.conn
-		if int(time.Since(lastLogTime).Seconds()) >= 1 {
-			lastLogTime = time.Now()
-			log.Printf("------- async reading... ----- spd: %d, %s ------\n", spdc.Avgspd, this.ServAddr)
-		}
-		rdbuf := make([]byte, 3000)
+		rdbuf := (*pb)[:3000]
 		rn, err := c.Read(rdbuf)
 		gopp.ErrPrint(err, rn, this.ServAddr)
 		if err == io.EOF {
@@ -310,59 +432,72 @@ func (this *TCPClient) doReadConn() {
 		}
 
 		if this.OnNetRecv != nil {
-			this.OnNetRecv(rn)
+			this.callback(func() { this.OnNetRecv(rn) })
 		}
-		spdc.Data(rn)
 		gopp.Assert(this.crbuf.Len()+int64(rn) <= this.crbuf.Cap(), "ring buffer full",
 			this.crbuf.Len()+int64(rn), this.crbuf.Cap())
 		wn, err := this.crbuf.Write(rdbuf)
 		gopp.ErrPrint(err)
 		gopp.Assert(wn == rn, "write ring buffer failed", rn, wn)
-		this.doReadPacket(&nxtpktlen)
+		this.doReadPacket(&framer)
 	}
 	log.Println("tcp client done.", this.ServAddr, tcpstname(this.Status))
+	atomic.StoreInt32(&this.readDone, 1)
 	if this.OnClosed != nil {
 		this.OnClosed(this)
 	}
 }
-func (this *TCPClient) doReadPacket(nxtpktlen *uint16) {
+func (this *TCPClient) doReadPacket(framer *FrameReader) {
 	stop := false
 	for !stop {
 		var rdbuf []byte
 		switch {
 		case this.Status == TCP_CLIENT_CONNECTING:
 			// handshake response packet
-			*nxtpktlen = NONCE_SIZE + (PUBLIC_KEY_SIZE + NONCE_SIZE + MAC_SIZE)
-			rdbuf = make([]byte, *nxtpktlen)
-			rn, err := this.crbuf.Read(rdbuf)
+			if this.crbuf.Len() < TCP_SERVER_HANDSHAKE_SIZE {
+				return // wait the whole handshake packet
+			}
+			rdbuf = make([]byte, TCP_SERVER_HANDSHAKE_SIZE)
+			rn, err := io.ReadFull(this.crbuf, rdbuf)
 			gopp.ErrPrint(err)
 			gopp.Assert(rn == cap(rdbuf), "not read enough data", rn, cap(rdbuf))
 		case this.Status == TCP_CLIENT_UNCONFIRMED || this.Status == TCP_CLIENT_CONFIRMED:
 			// length+payload
-			if *nxtpktlen == 0 && this.crbuf.Len() < int64(unsafe.Sizeof(uint16(0))) {
+			pktlen, ok, err := framer.ReadHeader(this.crbuf)
+			gopp.ErrPrint(err)
+			if !ok || err != nil {
 				return
 			}
-			if *nxtpktlen == 0 && this.crbuf.Len() >= int64(unsafe.Sizeof(uint16(0))) {
-				pktlenbuf := make([]byte, 2)
-				rn, err := this.crbuf.Read(pktlenbuf)
-				gopp.ErrPrint(err, rn)
-				err = binary.Read(bytes.NewBuffer(pktlenbuf), binary.BigEndian, nxtpktlen)
-				gopp.ErrPrint(err)
+			if pktlen == TCP_REHANDSHAKE_MARK && this.inRehandshake() {
+				this.Status = TCP_CLIENT_CONNECTING
+				framer.Reset()
+				continue
 			}
-			if this.crbuf.Len() < int64(*nxtpktlen) {
+			// plnpkt passed to callbacks, so always a new frame
+			rdbuf, err = framer.ReadFrame(this.crbuf, nil)
+			if err != nil {
+				log.Println("Invalid frame, close:", err, this.ServAddr)
+				this.Close()
+				return
+			}
+			if rdbuf == nil {
 				return
 			}
-			rdbuf = make([]byte, 2+*nxtpktlen)
-			binary.Write(gopp.NewBufferBuf(rdbuf), binary.BigEndian, *nxtpktlen)
-			rn, err := this.crbuf.Read(rdbuf[2:])
-			gopp.ErrPrint(err)
-			gopp.Assert(rn+2 == cap(rdbuf), "not read enough data", rn+2, cap(rdbuf))
 		}
-		*nxtpktlen = 0
 
 		switch {
 		case this.Status == TCP_CLIENT_CONNECTING:
-			this.HandleHandshake(rdbuf)
+			if !this.inResume() {
+				if err := this.handleHandshakeResponse(rdbuf); err != nil {
+					log.Println("Handshake failed, close:", err, this.ServAddr)
+					this.Close()
+					return
+				}
+			} else if err := this.handleResumeResponse(rdbuf); err != nil {
+				log.Println("Resume failed, close:", err, this.ServAddr)
+				this.Close()
+				return
+			}
 			// ping
 			ping_pkt := this.MakePingPacket()
 			wn, err := this.conn.Write(ping_pkt)
@@ -372,10 +507,29 @@ func (this *TCPClient) doReadPacket(nxtpktlen *uint16) {
 		case this.Status == TCP_CLIENT_UNCONFIRMED:
 			datlen, plnpkt, err := this.Unpacket(rdbuf)
 			gopp.ErrPrint(err)
-			ptype := plnpkt[0]
-			log.Println("read data pkt:", len(rdbuf), datlen, ptype, tcppktname(ptype))
+			if err != nil {
+				log.Println("Decrypt first packet failed, close:", this.ServAddr)
+				this.Close()
+				return
+			}
+			pkt, err := ParseTCPPacket(plnpkt)
+			if err != nil {
+				log.Println("Invalid first packet, close:", err, this.ServAddr)
+				this.Close()
+				return
+			}
+			log.Println("read data pkt:", len(rdbuf), datlen, pkt.Type, tcppktname(pkt.Type))
 			this.HandlePingResponse(plnpkt)
+			log.Println("handshake 2 done. confirmed.")
 			this.Status = TCP_CLIENT_CONFIRMED
+			atomic.StoreInt64(&this.lastPong, this.clk().Now().UnixNano())
+			if atomic.CompareAndSwapInt32(&this.rehsing, 1, 0) {
+				log.Println("Re-handshake done:", this.ServAddr)
+				break
+			}
+			go this.doPingLoop()
+			this.startQUICData()
+			this.routePeers()
 			if this.OnConfirmed != nil {
 				this.OnConfirmed()
 			}
@@ -383,10 +537,19 @@ func (this *TCPClient) doReadPacket(nxtpktlen *uint16) {
 			// TODO read ringbuffer
 			datlen, plnpkt, err := this.Unpacket(rdbuf)
 			gopp.ErrPrint(err)
-			ptype := plnpkt[0]
+			if err != nil {
+				this.onDecryptFailed(err)
+				continue
+			}
+			pkt, err := ParseTCPPacket(plnpkt)
+			if err != nil {
+				log.Println("Drop packet:", err, this.ServAddr)
+				continue
+			}
+			ptype := pkt.Type
 			if ptype < NUM_RESERVED_PORTS {
-				log.Printf("read data pkt: rdlen:%d, datlen:%d, pktype: %d, pktname: %s, from: %s\n",
-					len(rdbuf), datlen, ptype, tcppktname(ptype), this.conn.RemoteAddr().String())
+				defaultLogger.get().Debug("Read packet", "rdlen", len(rdbuf), "datlen", datlen,
+					"pktname", tcppktname(ptype), "addr", this.ServAddr)
 			}
 			switch {
 			case ptype == TCP_PACKET_PING:
@@ -399,17 +562,25 @@ func (this *TCPClient) doReadPacket(nxtpktlen *uint16) {
 				this.HandleConnectionNotification(plnpkt)
 			case ptype == TCP_PACKET_DISCONNECT_NOTIFICATION:
 				this.HandleDisconnectNotification(plnpkt)
-			case ptype == TCP_PACKET_OOB_RECV: // TODO
-			case ptype == TCP_PACKET_ONION_RESPONSE: // TODO
+			case ptype == TCP_PACKET_OOB_RECV:
+				this.HandleOOBRecv(plnpkt)
+			case ptype == TCP_PACKET_ONION_RESPONSE:
+				this.HandleOnionResponse(plnpkt)
+			case ptype == TCP_PACKET_CAPABILITY:
+				this.HandleCapability(plnpkt)
+			case ptype == TCP_PACKET_SESSION_TICKET:
+				this.HandleSessionTicket(plnpkt)
 			case ptype >= NUM_RESERVED_PORTS:
 				this.HandleRoutingData(plnpkt)
 			case ptype > TCP_PACKET_ONION_RESPONSE && ptype < NUM_RESERVED_PORTS:
 				this.HandleReservedData(plnpkt)
 			default:
-				log.Fatalln("wtf", ptype, tcppktname(ptype))
+				log.Println("Unknown packet:", ptype, tcppktname(ptype), this.ServAddr)
 			}
 		default:
-			log.Fatalln("wtf", tcpstname(this.Status))
+			log.Println("Invalid status, close:", tcpstname(this.Status), this.ServAddr)
+			this.Close()
+			return
 		}
 	}
 }
@@ -436,7 +607,10 @@ func (this *TCPClient) DoHandshake() {
 	gopp.TruePrint(rn != TCP_SERVER_HANDSHAKE_SIZE, "recv packet invalid", rn, TCP_SERVER_HANDSHAKE_SIZE)
 	gopp.NilPrint(err, "recv handshake packet:", rn, hex.EncodeToString(rdbuf[:rn]))
 	rdbuf = rdbuf[:rn]
-	this.HandleHandshake(rdbuf)
+	if err := this.HandleHandshake(rdbuf); err != nil {
+		c.Close()
+		return
+	}
 
 	// ping
 	ping_pkt := this.MakePingPacket()
@@ -464,6 +638,9 @@ func (this *TCPClient) SendHandshake() (err error) {
 	return
 }
 func (this *TCPClient) GenerateHandshake() (encpkt []byte, err error) {
+	if this.HandshakeVersion == TCP_HANDSHAKE_NOISE_IK {
+		return this.generateNoiseHandshake()
+	}
 	var temp_pubkey *CryptoKey
 	temp_pubkey, this.TempSeckey, err = NewCBKeyPair()
 	gopp.ErrPrint(err)
@@ -501,31 +678,40 @@ func (this *TCPClient) GenerateHandshake() (encpkt []byte, err error) {
 	return LastPacket, err
 }
 
-func (this *TCPClient) HandleHandshake(rdbuf []byte) {
-	temp_nonce := NewCBNonce(rdbuf[:NONCE_SIZE])
-	encrypted_serv := rdbuf[NONCE_SIZE:]
-	plain_resp, err := DecryptDataSymmetric(this.Shrkey, temp_nonce, encrypted_serv)
+func (this *TCPClient) HandleHandshake(rdbuf []byte) error {
+	temp_pubkey, recv_nonce, err := ParseTCPHandshakeResponse(this.Shrkey, rdbuf)
 	gopp.ErrPrint(err, "decrypt recv handshake packet failed")
-	gopp.NilPrint(err, "decrypt recv handshake packet success", len(plain_resp))
-	temp_pubkey := NewCryptoKey(plain_resp[:PUBLIC_KEY_SIZE])
-	this.RecvNonce = NewCBNonce(plain_resp[PUBLIC_KEY_SIZE:])
-	log.Println("temp_pubkey", temp_pubkey.ToHex())
-	log.Println("this.temp_seckey", this.TempSeckey.ToHex())
-	log.Println("this.recv_nonce", this.RecvNonce.ToHex())
+	if err != nil {
+		return err
+	}
+	this.RecvNonce = recv_nonce
+	log.Println("temp_pubkey", logkey(temp_pubkey))
+	log.Println("this.temp_seckey", logkey(this.TempSeckey))
+	log.Println("this.recv_nonce", logkey(this.RecvNonce))
 	this.Shrkey, err = CBBeforeNm(temp_pubkey, this.TempSeckey)
 	gopp.ErrPrint(err)
+	if err != nil {
+		return err
+	}
 	this.TempSeckey = nil           // handshake done, have new shrkey, free
 	log.Println("handshake 1 done") // handshake 2 is confirm
+	return nil
 }
 
-func (this *TCPClient) MakePingPacket() []byte {
-	/// first ping
+func (this *TCPClient) makePingPlain() []byte {
 	ping_plain := gopp.NewBufferZero()
 	ping_plain.WriteByte(byte(TCP_PACKET_PING))
 	pingid := rand.Uint64()
 	pingid = gopp.IfElse(pingid == 0, uint64(1), pingid).(uint64)
-	this.Pingid = pingid
+	atomic.StoreUint64(&this.Pingid, pingid)
+	this.pings.Add(pingid)
 	binary.Write(ping_plain, binary.BigEndian, pingid)
+	return ping_plain.Bytes()
+}
+
+func (this *TCPClient) MakePingPacket() []byte {
+	/// first ping
+	ping_plain := gopp.NewBufferBuf(this.makePingPlain())
 	// log.Println("ping plnpkt len:", ping_plain.Len())
 
 	encpkt, err := this.CreatePacket(ping_plain.Bytes())
@@ -538,26 +724,75 @@ func (this *TCPClient) MakePingPacket() []byte {
 		ping_pkt := gopp.NewBufferZero()
 		binary.Write(ping_pkt, binary.BigEndian, uint16(len(ping_encrypted)))
 		ping_pkt.Write(ping_encrypted)
-		log.Println(ping_pkt.Len(), len(ping_encrypted))
 		return ping_pkt.Bytes()
 	}
 
 	return encpkt
 }
 
-func (this *TCPClient) HandlePingResponse(rpkt []byte) {
-	pong_pkt := gopp.NewBufferBuf(rpkt)
-	log.Println("pong type:", gopp.Retn(pong_pkt.ReadByte()))
-	var pongid uint64
-	err := binary.Read(pong_pkt.RBufAt(1), binary.BigEndian, &pongid)
-	gopp.ErrPrint(err)
+// SendPing queues a ping, can be called while other pings outstanding.
+func (this *TCPClient) SendPing() error {
+	this.pings.ExpireOld()
+	_, err := this.SendCtrlPacket(this.makePingPlain())
+	return err
+}
 
-	pingid := this.Pingid
-	log.Println(pongid == pingid, pongid, pingid)
+func (this *TCPClient) HandlePingResponse(rpkt []byte) {
+	if len(rpkt) < 1+8 {
+		log.Println("Invalid pong length:", len(rpkt), this.ServAddr)
+		return
+	}
+	pongid := binary.BigEndian.Uint64(rpkt[1:])
 	atomic.CompareAndSwapUint64(&this.Pingid, pongid, 0)
-	log.Println("handshake 2 done. confirmed.")
+	rtt, ok := this.pings.Match(pongid)
+	if !ok {
+		log.Println("Unknown or expired pong:", pongid, this.ServAddr)
+		return
+	}
+	this.rtt.add(rtt)
+	atomic.StoreInt64(&this.lastPong, this.clk().Now().UnixNano())
+	log.Println("pong matched:", pongid, rtt)
+}
+
+func (this *TCPClient) clk() clock {
+	if this.clock == nil {
+		return defaultClock
+	}
+	return this.clock
 }
 
+// like do_TCP_connection ping part, ping every TCP_PING_FREQUENCY,
+// close if no pong in TCP_PING_FREQUENCY+TCP_PING_TIMEOUT
+func (this *TCPClient) doPingLoop() {
+	tickC, tickStop := this.clk().Tick(TCP_PING_FREQUENCY * time.Second)
+	defer tickStop()
+	stopC := this.stopC // of this conn, renewed by Resume
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-tickC:
+		}
+		ponged := this.clk().Now().Sub(time.Unix(0, atomic.LoadInt64(&this.lastPong)))
+		if ponged > (TCP_PING_FREQUENCY+TCP_PING_TIMEOUT)*time.Second {
+			log.Println("cli ping timeout:", int(ponged.Seconds()), this.ServAddr)
+			this.Close()
+			return
+		}
+		err := this.SendPing()
+		gopp.ErrPrint(err, this.ServAddr)
+	}
+}
+
+// RTT of last matched ping, 0 if none yet
+func (this *TCPClient) RTT() time.Duration { return this.rtt.lastRTT() }
+
+// smoothed RTT of matched pings, 0 if none yet
+func (this *TCPClient) SRTT() time.Duration { return this.rtt.smoothed() }
+
+// number of pings waiting for pong
+func (this *TCPClient) PendingPings() int { return this.pings.Len() }
+
 func (this *TCPClient) HandlePingRequest(rpkt []byte) {
 	plnpkt := gopp.NewBufferZero()
 	plnpkt.WriteByte(byte(TCP_PACKET_PONG))
@@ -594,55 +829,170 @@ func (this *TCPClient) SendRoutingRequest(pubkey *CryptoKey) (encpkt []byte, err
 	return
 }
 
+// ask relay for a connid to peer, result comes with OnRouteEstablished
+func (this *TCPClient) RouteToPeer(pubkey *CryptoKey) error {
+	_, err := this.SendRoutingRequest(pubkey)
+	return err
+}
+
 func (this *TCPClient) HandleRoutingResponse(rpkt []byte) {
 	rspdat := rpkt
-	gopp.Assert(rspdat[0] == TCP_PACKET_ROUTING_RESPONSE, "Invalid packet", rspdat[0])
+	if len(rspdat) != 1+1+PUBLIC_KEY_SIZE || rspdat[0] != TCP_PACKET_ROUTING_RESPONSE {
+		log.Println("Invalid routing response length:", len(rspdat))
+		return
+	}
 	connid := rspdat[1]
 	pubkey := NewCryptoKey(rspdat[2 : 2+PUBLIC_KEY_SIZE])
-	log.Println(rspdat[0], connid, pubkey.ToHex()[:20], "<=", this.SelfPubkey.ToHex()[:20])
-
-	this.conns.Insert(connid, pubkey.BinStr())
+	log.Println(rspdat[0], connid, pubkey, "<=", this.SelfPubkey)
+
+	/* connid 0 means the relay refused, no free slot or route to self */
+	ok := connid >= NUM_RESERVED_PORTS
+	if ok {
+		cid := connid - NUM_RESERVED_PORTS
+		if this.Conns[cid].Status != 0 && !this.Conns[cid].Pubkey.Equal2(pubkey) {
+			log.Println("connid already used:", connid, this.Conns[cid].Pubkey.ToHex20())
+			return
+		}
+		if this.Conns[cid].Status == 0 {
+			this.Conns[cid].Status = 1
+			this.Conns[cid].Pubkey = pubkey
+		}
+		this.conns.Insert(connid, pubkey.BinStr())
+	}
+	if this.OnRouteEstablished != nil {
+		this.callback(func() { this.OnRouteEstablished(pubkey, connid, ok) })
+	}
 	if this.RoutingResponseFunc != nil {
-		this.RoutingResponseFunc(this.RoutingResponseCbdata, connid, pubkey)
+		this.callback(func() { this.RoutingResponseFunc(this.RoutingResponseCbdata, connid, pubkey) })
+	}
+}
+
+// connid got from routing response for peer
+func (this *TCPClient) ConnidOf(pubkey *CryptoKey) (uint8, bool) {
+	connid, ok := this.conns.GetInverse(pubkey.BinStr())
+	if !ok {
+		return 0, false
 	}
+	return connid.(uint8), true
 }
 
 func (this *TCPClient) HandleRoutingData(rpkt []byte) {
 	connid := rpkt[0]
 	if this.RoutingDataFunc != nil {
-		this.RoutingDataFunc(this.RoutingDataCbdata, 0, connid, rpkt[1:], nil)
+		this.callback(func() { this.RoutingDataFunc(this.RoutingDataCbdata, 0, connid, rpkt[1:], nil) })
+	}
+	if this.OnData != nil {
+		binpk, ok := this.conns.Get(connid)
+		if !ok {
+			log.Println("connid not found:", connid, this.ServAddr)
+			return
+		}
+		pubkey := NewCryptoKey([]byte(binpk.(string)))
+		this.callback(func() { this.OnData(pubkey, rpkt[1:]) })
+	}
+}
+
+func (this *TCPClient) HandleOOBRecv(rpkt []byte) {
+	if len(rpkt) <= 1+PUBLIC_KEY_SIZE || len(rpkt) > 1+PUBLIC_KEY_SIZE+TCP_MAX_OOB_DATA_LENGTH {
+		log.Println("Invalid oob recv length:", len(rpkt), this.ServAddr)
+		return
+	}
+	pubkey := NewCryptoKey(rpkt[1 : 1+PUBLIC_KEY_SIZE])
+	data := rpkt[1+PUBLIC_KEY_SIZE:]
+	if this.OOBDataFunc != nil {
+		this.callback(func() { this.OOBDataFunc(this, pubkey, data, this.OOBDataCbdata) })
+	}
+	if this.OnOOBData != nil {
+		this.callback(func() { this.OnOOBData(pubkey, data) })
 	}
 }
 
+// AddPeer keeps a route to peer, requested now if confirmed, and again
+// after every new connection, like add_tcp_connection_to_conn.
+func (this *TCPClient) AddPeer(pubkey *CryptoKey) error {
+	this.peersmu.Lock()
+	if this.peers == nil {
+		this.peers = map[string]*CryptoKey{}
+	}
+	this.peers[pubkey.BinStr()] = pubkey
+	this.peersmu.Unlock()
+	if this.Status != TCP_CLIENT_CONFIRMED {
+		return nil
+	}
+	return this.RouteToPeer(pubkey)
+}
+
+// RemovePeer drops the route to peer and tells the relay.
+func (this *TCPClient) RemovePeer(pubkey *CryptoKey) error {
+	this.peersmu.Lock()
+	delete(this.peers, pubkey.BinStr())
+	this.peersmu.Unlock()
+	connid, ok := this.ConnidOf(pubkey)
+	if !ok {
+		return nil
+	}
+	this.conns.Delete(connid)
+	this.Conns[connid-NUM_RESERVED_PORTS].Status = 0
+	this.Conns[connid-NUM_RESERVED_PORTS].Pubkey = nil
+	_, err := this.SendDisconnectNotification(connid)
+	return err
+}
+
+func (this *TCPClient) routePeers() {
+	this.peersmu.Lock()
+	pubkeys := make([]*CryptoKey, 0, len(this.peers))
+	for _, pubkey := range this.peers {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	this.peersmu.Unlock()
+	for _, pubkey := range pubkeys {
+		err := this.RouteToPeer(pubkey)
+		gopp.ErrPrint(err, pubkey.ToHex20())
+	}
+}
+
+// SendData sends data to peer via its route, see AddPeer.
+func (this *TCPClient) SendData(pubkey *CryptoKey, data []byte) error {
+	connid, ok := this.ConnidOf(pubkey)
+	if !ok {
+		return errors.Errorf("No route to peer: %s", pubkey.ToHex20())
+	}
+	_, err := this.SendDataPacket(connid, data)
+	return err
+}
+
+// SendOOB sends data to peer connected to the same relay, no route needed.
+func (this *TCPClient) SendOOB(pubkey *CryptoKey, data []byte) error {
+	if len(data) == 0 || len(data) > TCP_MAX_OOB_DATA_LENGTH {
+		return errors.Errorf("Invalid oob data size: %d, max: %d", len(data), TCP_MAX_OOB_DATA_LENGTH)
+	}
+	_, err := this.SendOOBPacket(pubkey, data)
+	return err
+}
+
 func (this *TCPClient) HandleReservedData(rpkt []byte) {
 	connid := rpkt[0]
 	if this.OnReservedData != nil {
-		this.OnReservedData(this.RoutingDataCbdata, 0, connid, rpkt[1:], nil)
+		this.callback(func() { this.OnReservedData(this.RoutingDataCbdata, 0, connid, rpkt[1:], nil) })
 	}
 }
 
 func (this *TCPClient) SendCtrlPacket(data []byte) (encpkt []byte, err error) {
-	if len(data) > 2048 {
-		return nil, errors.Errorf("Data too long: %d, want: %d", len(data), 2048)
+	if err := checkPacketSize(len(data)); err != nil {
+		return nil, err
 	}
 	if len(this.cwctrlq) >= cap(this.cwctrlq) {
-		log.Println("Ctrl queue is full, drop pkt...", len(data), this.cwctrldlen)
-		return nil, errors.New("Ctrl queue is full")
+		log.Println("Ctrl queue is full, drop pkt...", len(data), atomic.LoadInt32(&this.cwctrldlen))
+		return nil, errors.Wrap(ErrQueueFull, "ctrl")
 	}
 	btime := time.Now()
-	select {
-	case this.cwctrlq <- data:
-		atomic.AddInt32(&this.cwctrldlen, int32(len(data)))
-	default:
-		log.Println("Ctrl queue is full, drop pkt...", len(data), this.cwctrldlen)
-		return nil, errors.New("Ctrl queue is full")
+	if !this.enqueueCtrl(data) {
+		log.Println("Ctrl queue is full, drop pkt...", len(data), atomic.LoadInt32(&this.cwctrldlen))
+		return nil, errors.Wrap(ErrQueueFull, "ctrl")
 	}
 	// encpkt, err = this.CreatePacket(buf.Bytes())
 	// this.WritePacket(encpkt)
-	dtime := time.Since(btime)
-	if dtime > 5*time.Millisecond {
-		log.Fatalln("send use too long", len(data), dtime)
-	} else if dtime > 2*time.Millisecond {
+	if dtime := time.Since(btime); dtime > 2*time.Millisecond {
 		log.Println("send use too long", len(data), dtime)
 	}
 	return
@@ -650,23 +1000,20 @@ func (this *TCPClient) SendCtrlPacket(data []byte) (encpkt []byte, err error) {
 
 // TODO split data
 func (this *TCPClient) SendDataPacket(connid uint8, data []byte) (encpkt []byte, err error) {
-	if len(data) > 2048 {
-		return nil, errors.Errorf("Data too long: %d, want: %d", len(data), 2048)
+	if err := checkPacketSize(1 + len(data)); err != nil {
+		return nil, err
 	}
 	if len(this.cwdataq) >= cap(this.cwdataq) {
-		log.Println("Data queue is full, drop pkt.", len(this.cwdataq), connid, len(data), this.cwdatadlen)
-		return nil, errors.New("Data queue is full")
+		log.Println("Data queue is full, drop pkt.", len(this.cwdataq), connid, len(data), atomic.LoadInt32(&this.cwdatadlen))
+		return nil, errors.Wrap(ErrQueueFull, "data")
 	}
 	buf := gopp.NewBufferZero()
 	buf.WriteByte(byte(connid))
 	buf.Write(data)
 	btime := time.Now()
-	select {
-	case this.cwdataq <- buf.Bytes():
-		atomic.AddInt32(&this.cwdatadlen, int32(buf.Len()))
-	default:
-		log.Println("Data queue is full, drop pkt.", len(this.cwdataq), connid, len(data), this.cwdatadlen)
-		return nil, errors.New("Data queue is full")
+	if !this.enqueueData(buf.Bytes()) {
+		log.Println("Data queue is full, drop pkt.", len(this.cwdataq), connid, len(data), atomic.LoadInt32(&this.cwdatadlen))
+		return nil, errors.Wrap(ErrQueueFull, "data")
 	}
 	dtime := time.Since(btime)
 	if dtime > 2*time.Millisecond {
@@ -697,30 +1044,61 @@ func (this *TCPClient) SendDisconnectNotification(connid uint8) (encpkt []byte,
 	return
 }
 
-func (this *TCPClient) SendOnionRequest(data []byte) (encpkt []byte, err error) {
+// inject onion request into network via the relay, response comes back with OnOnionResponse.
+// Queued only, the write goroutine encrypts it, so no packet returned like other Send*.
+func (this *TCPClient) SendOnionRequest(data []byte) error {
+	if len(data) == 0 || 1+len(data) > MAX_PACKET_SIZE {
+		return errors.Errorf("Invalid onion request size: %d, max: %d", len(data), MAX_PACKET_SIZE-1)
+	}
 	plnbuf := gopp.NewBufferZero()
 	plnbuf.WriteByte(byte(TCP_PACKET_ONION_REQUEST))
 	plnbuf.Write(data)
-	_, err = this.SendCtrlPacket(plnbuf.Bytes())
-	return
+	_, err := this.SendCtrlPacket(plnbuf.Bytes())
+	return err
+}
+
+func (this *TCPClient) HandleOnionResponse(rpkt []byte) {
+	data := rpkt[1:]
+	if this.OnOnionResponse != nil {
+		this.callback(func() { this.OnOnionResponse(data) })
+	}
+	if this.OnionResponseFunc != nil {
+		this.callback(func() { this.OnionResponseFunc(this, data, this.OnionResponseCbdata) })
+	}
 }
 
 func (this *TCPClient) HandleConnectionNotification(rpkt []byte) {
 	connid := rpkt[1]
 	if this.RoutingStatusFunc != nil {
-		this.RoutingStatusFunc(this.RoutingStatusCbdata, 0, connid, 2)
+		this.callback(func() { this.RoutingStatusFunc(this.RoutingStatusCbdata, 0, connid, 2) })
 	}
 }
 func (this *TCPClient) HandleDisconnectNotification(rpkt []byte) {
 	connid := rpkt[1]
 	if this.RoutingStatusFunc != nil {
-		this.RoutingStatusFunc(this.RoutingStatusCbdata, 0, connid, 1)
+		this.callback(func() { this.RoutingStatusFunc(this.RoutingStatusCbdata, 0, connid, 1) })
 	}
 }
 
 func (this *TCPClient) WritePacket(data []byte) (int, error) {
-	encpkt, err := this.CreatePacket(data)
+	if qc, ok := this.conn.(*quicConn); ok && len(data) > 0 && data[0] >= NUM_RESERVED_PORTS {
+		if wn, ok, err := qc.writeData(data); ok {
+			return wn, err
+		}
+	}
+	this.hsmu.Lock()
+	defer this.hsmu.Unlock()
+	if this.inRehandshake() || this.inResume() {
+		log.Println("Re-handshaking, drop pkt:", tcppktname(data[0]), len(data))
+		return 0, ErrRehandshaking
+	}
+	buf := getTCPBuf()
+	defer putTCPBuf(buf)
+	encpkt, err := appendTCPPacket((*buf)[:0], this.Shrkey, this.SentNonce, data)
 	gopp.ErrPrint(err)
+	if err != nil {
+		return 0, err
+	}
 	wn, err := this.conn.Write(encpkt)
 	gopp.ErrPrint(err)
 	if err == nil {
@@ -731,23 +1109,10 @@ func (this *TCPClient) WritePacket(data []byte) (int, error) {
 
 // tcp data packet, not include handshake packet
 func (this *TCPClient) CreatePacket(plain []byte) (encpkt []byte, err error) {
-	// log.Println(len(plain), this.Shrkey.ToHex()[:20], this.SentNonce.ToHex())
-	encdat, err := EncryptDataSymmetric(this.Shrkey, this.SentNonce, plain)
-	gopp.ErrPrint(err)
-
-	pktbuf := gopp.NewBufferZero()
-	binary.Write(pktbuf, binary.BigEndian, uint16(len(encdat)))
-	pktbuf.Write(encdat)
-	encpkt = pktbuf.Bytes()
-	// log.Println("create pkg:", tcppktname(plain[0]), len(encpkt), len(plain))
-	// this.SentNonce.Incr()
-	return
+	return appendTCPPacket(nil, this.Shrkey, this.SentNonce, plain)
 }
 
+// plnpkt passed to callbacks, so always a new one
 func (this *TCPClient) Unpacket(encpkt []byte) (datlen uint16, plnpkt []byte, err error) {
-	err = binary.Read(bytes.NewReader(encpkt), binary.BigEndian, &datlen)
-	gopp.ErrPrint(err)
-	plnpkt, err = DecryptDataSymmetric(this.Shrkey, this.RecvNonce, encpkt[2:])
-	this.RecvNonce.Incr()
-	return
+	return openTCPPacket(nil, this.Shrkey, this.RecvNonce, encpkt)
 }
@@ -0,0 +1,220 @@
+package mintox
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTstClient() *TCPClient {
+	cli := &TCPClient{}
+	cli.cwctrlq = make(chan []byte, 32)
+	cli.cwdataq = make(chan []byte, 128)
+	cli.conns = NewBiMap()
+	return cli
+}
+
+// connected to addr and confirmed, callbacks set by setup before connect.
+// confirmedC told of each confirm, also of resume, wait it instead of Status
+func newTstConfirmedClient(t *testing.T, addr string, srvpk *CryptoKey, setup func(cli *TCPClient)) (cli *TCPClient, confirmedC chan bool) {
+	pk, sk, _ := NewCBKeyPair()
+	cli = newTCPClientProxy(addr, srvpk, pk, sk, nil)
+	confirmedC = make(chan bool, 1)
+	cli.OnConfirmed = func() {
+		select {
+		case confirmedC <- true:
+		default:
+		}
+	}
+	if setup != nil {
+		setup(cli)
+	}
+	cli.goConnect()
+	if !waitTstConfirmed(confirmedC) {
+		t.Fatal("client not confirmed")
+	}
+	return
+}
+
+func waitTstConfirmed(confirmedC chan bool) bool {
+	select {
+	case <-confirmedC:
+		return true
+	case <-time.After(3 * time.Second):
+		return false
+	}
+}
+
+func TestClientOnionRequest(t *testing.T) {
+	cli := newTstClient()
+	if err := cli.SendOnionRequest(make([]byte, MAX_PACKET_SIZE)); err == nil {
+		t.Error("oversized onion request accepted")
+	}
+	if err := cli.SendOnionRequest(nil); err == nil {
+		t.Error("empty onion request accepted")
+	}
+	if err := cli.SendOnionRequest([]byte("onion")); err != nil {
+		t.Fatal(err)
+	}
+	pkt := <-cli.cwctrlq
+	if pkt[0] != TCP_PACKET_ONION_REQUEST || !bytes.Equal(pkt[1:], []byte("onion")) {
+		t.Error("invalid onion request packet:", pkt)
+	}
+
+	var rspdat []byte
+	cli.OnOnionResponse = func(data []byte) { rspdat = data }
+	cli.HandleOnionResponse(append([]byte{TCP_PACKET_ONION_RESPONSE}, "resp"...))
+	if string(rspdat) != "resp" {
+		t.Error("onion response not delivered:", rspdat)
+	}
+}
+
+func TestClientRoutingResponse(t *testing.T) {
+	cli := newTstClient()
+	cli.SelfPubkey, _, _ = NewCBKeyPair()
+	peerpk, _, _ := NewCBKeyPair()
+	var gotpk *CryptoKey
+	var gotcid uint8
+	var gotok bool
+	cli.OnRouteEstablished = func(pk *CryptoKey, connid uint8, ok bool) { gotpk, gotcid, gotok = pk, connid, ok }
+
+	if err := cli.RouteToPeer(peerpk); err != nil {
+		t.Fatal(err)
+	}
+	if pkt := <-cli.cwctrlq; pkt[0] != TCP_PACKET_ROUTING_REQUEST || !bytes.Equal(pkt[1:], peerpk.Bytes()) {
+		t.Error("invalid routing request:", pkt)
+	}
+
+	cli.HandleRoutingResponse(append([]byte{TCP_PACKET_ROUTING_RESPONSE, 0}, peerpk.Bytes()...))
+	if gotok || !gotpk.Equal2(peerpk) {
+		t.Error("refused route reported ok")
+	}
+	if _, ok := cli.ConnidOf(peerpk); ok {
+		t.Error("refused route has connid")
+	}
+
+	cli.HandleRoutingResponse(append([]byte{TCP_PACKET_ROUTING_RESPONSE, 20}, peerpk.Bytes()...))
+	if !gotok || gotcid != 20 {
+		t.Error("route not established:", gotok, gotcid)
+	}
+	if connid, ok := cli.ConnidOf(peerpk); !ok || connid != 20 {
+		t.Error("connid of peer:", connid, ok)
+	}
+	if cli.Conns[20-NUM_RESERVED_PORTS].Status != 1 || !cli.Conns[20-NUM_RESERVED_PORTS].Pubkey.Equal2(peerpk) {
+		t.Error("Conns not populated")
+	}
+}
+
+func TestClientPingTimeout(t *testing.T) {
+	clk := newFakeTstClock()
+	cli, secon := newTstClientPairClock(t, clk)
+	defer secon.Close()
+	if !waitTstCond(3*time.Second, func() bool { return clk.tickerCount() == 1 }) {
+		t.Fatal("ping loop not started")
+	}
+
+	clk.Advance(TCP_PING_FREQUENCY * time.Second)
+	if !waitTstCond(3*time.Second, func() bool { return cli.RTT() > 0 && cli.PendingPings() == 0 }) {
+		t.Fatal("keepalive ping not ponged:", cli.PendingPings())
+	}
+	if atomic.LoadInt32(&cli.closed) != 0 {
+		t.Fatal("closed with pong")
+	}
+
+	clk.Advance((TCP_PING_FREQUENCY+TCP_PING_TIMEOUT)*time.Second + time.Second)
+	if !waitTstCond(3*time.Second, func() bool { return atomic.LoadInt32(&cli.closed) == 1 }) {
+		t.Error("not closed after ping timeout")
+	}
+}
+
+func TestClientPeersEndToEnd(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+
+	clis := make([]*TCPClient, 2)
+	for i := range clis {
+		pk, sk, _ := NewCBKeyPair()
+		clis[i] = NewTCPClient(lsner.Addr().String(), srvo.Pubkey, pk, sk)
+		defer clis[i].Close()
+	}
+	dataC := make(chan []byte, 16)
+	oobC := make(chan []byte, 1)
+	statusC := make(chan uint8, 4)
+	clis[0].OnData = func(pk *CryptoKey, data []byte) {
+		if pk.Equal2(clis[1].SelfPubkey) {
+			dataC <- data
+		}
+	}
+	clis[0].OnOOBData = func(pk *CryptoKey, data []byte) {
+		if pk.Equal2(clis[1].SelfPubkey) {
+			oobC <- data
+		}
+	}
+	clis[1].RoutingStatusFunc = func(_ Object, _ uint32, _ uint8, status uint8) { statusC <- status }
+	for i, cli := range clis {
+		if err := cli.AddPeer(clis[1-i].SelfPubkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// route online when data arrives
+	got := false
+	for btime := time.Now(); !got && time.Since(btime) < 5*time.Second; {
+		clis[1].SendData(clis[0].SelfPubkey, []byte("hello"))
+		select {
+		case data := <-dataC:
+			got = string(data) == "hello"
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if !got {
+		t.Fatal("routed data not received")
+	}
+
+	if err := clis[1].SendOOB(clis[0].SelfPubkey, []byte("oob")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-oobC:
+		if string(data) != "oob" {
+			t.Error("oob data:", string(data))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("oob data not received")
+	}
+	if err := clis[1].SendOOB(clis[0].SelfPubkey, make([]byte, TCP_MAX_OOB_DATA_LENGTH+1)); err == nil {
+		t.Error("oversized oob accepted")
+	}
+
+	if err := clis[0].RemovePeer(clis[1].SelfPubkey); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := clis[0].ConnidOf(clis[1].SelfPubkey); ok {
+		t.Error("route kept after RemovePeer")
+	}
+	if err := clis[0].SendData(clis[1].SelfPubkey, []byte("x")); err == nil {
+		t.Error("send data without route")
+	}
+	for {
+		select {
+		case status := <-statusC:
+			if status != 1 {
+				continue
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("peer not notified of removed route")
+		}
+		break
+	}
+}
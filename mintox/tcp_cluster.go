@@ -0,0 +1,610 @@
+package mintox
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"gopp"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	deadlock "github.com/sasha-s/go-deadlock"
+)
+
+// Relays of a cluster share their clients. A directory maps client pubkeys
+// to the node holding the conn, routing requests, routed data and oob sends
+// to a client of another node are forwarded over the link to that node.
+// The directory is gossiped over the links by default, or shared by code
+// with cluster_directory, like one backed by redis.
+//
+// Links are plain tcp between nodes, every frame encrypted with keys derived
+// from cluster_secret and the random nonces both sides sent first, a uint16
+// big endian length before each frame.
+
+const (
+	TCP_CLUSTER_HELLO         = iota + 1 // node id
+	TCP_CLUSTER_ANNOUNCE                 // pubkey, connected to sender
+	TCP_CLUSTER_WITHDRAW                 // pubkey, gone from sender
+	TCP_CLUSTER_ROUTE_REQUEST            // src, dst pubkey, src of sender wants dst
+	TCP_CLUSTER_ROUTE_ACCEPT             // src, dst pubkey, answer of request, route online
+	TCP_CLUSTER_ROUTE_CLOSE              // src, dst pubkey, route of src offline
+	TCP_CLUSTER_ROUTE_DATA               // src, dst pubkey, data
+	TCP_CLUSTER_OOB                      // src, dst pubkey, data
+)
+
+const TCP_CLUSTER_REDIAL = 3        // seconds between dials of a lost peer
+const TCP_CLUSTER_HELLO_TIMEOUT = 5 // seconds, link handshake
+const TCP_CLUSTER_QUEUE_SIZE = 4096 // frames of a link write queue
+const tcpClusterPairSize = 1 + 2*PUBLIC_KEY_SIZE
+
+// ClusterDirectory maps client pubkeys to node ids, safe for concurrent use.
+type ClusterDirectory interface {
+	Register(pubkey *CryptoKey, node string) error
+	// only if still of node, the client may be on another node already
+	Unregister(pubkey *CryptoKey, node string) error
+	Lookup(pubkey *CryptoKey) (node string, ok bool)
+}
+
+// in memory, shared by servers of one process, or filled by gossip
+type MemClusterDirectory struct {
+	mu    sync.RWMutex
+	nodes map[string]string // binpk => node
+}
+
+func NewMemClusterDirectory() *MemClusterDirectory {
+	return &MemClusterDirectory{nodes: map[string]string{}}
+}
+
+func (this *MemClusterDirectory) Register(pubkey *CryptoKey, node string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.nodes[pubkey.BinStr()] = node
+	return nil
+}
+func (this *MemClusterDirectory) Unregister(pubkey *CryptoKey, node string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.nodes[pubkey.BinStr()] == node {
+		delete(this.nodes, pubkey.BinStr())
+	}
+	return nil
+}
+func (this *MemClusterDirectory) Lookup(pubkey *CryptoKey) (string, bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	node, ok := this.nodes[pubkey.BinStr()]
+	return node, ok
+}
+
+// drop all of node, its link lost
+func (this *MemClusterDirectory) dropNode(node string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for binpk, n := range this.nodes {
+		if n == node {
+			delete(this.nodes, binpk)
+		}
+	}
+}
+
+/////
+
+type TCPCluster struct {
+	Node   string
+	srvo   *TCPServer
+	secret *CryptoKey
+	dir    ClusterDirectory
+	gossip *MemClusterDirectory // dir when not shared, nil otherwise
+	lsner  net.Listener
+
+	mu     deadlock.Mutex
+	links  map[string]*tcpClusterLink // node =>
+	closed int32
+	stopC  chan bool
+}
+
+func newTCPCluster(srvo *TCPServer, cfg *TCPServerConfig) (*TCPCluster, error) {
+	secret, err := CryptoKeyFromHex(cfg.ClusterSecret)
+	if err != nil {
+		return nil, errors.Wrap(err, "cluster_secret")
+	}
+	this := &TCPCluster{srvo: srvo, secret: secret}
+	this.Node = cfg.ClusterNode
+	if this.Node == "" {
+		this.Node = srvo.Pubkey.ToHex()
+	}
+	this.dir = cfg.ClusterDirectory
+	if this.dir == nil {
+		this.gossip = NewMemClusterDirectory()
+		this.dir = this.gossip
+	}
+	this.links = map[string]*tcpClusterLink{}
+	this.stopC = make(chan bool)
+	return this, nil
+}
+
+// Cluster of the server, nil if cluster_listen and cluster_peers not set
+func (this *TCPServer) Cluster() *TCPCluster { return this.cluster }
+
+func (this *TCPCluster) start(cfg *TCPServerConfig) error {
+	if cfg.ClusterListen != "" {
+		lsner, err := net.Listen("tcp", cfg.ClusterListen)
+		if err != nil {
+			return errors.Wrap(err, "listen cluster "+cfg.ClusterListen)
+		}
+		this.lsner = lsner
+		this.srvo.logr().Info("Cluster listened", "node", this.Node, "addr", lsner.Addr())
+		go this.runAccept()
+	}
+	for _, addr := range cfg.ClusterPeers {
+		this.AddPeer(addr)
+	}
+	return nil
+}
+
+// Addr of the cluster listener, nil if not listened
+func (this *TCPCluster) Addr() net.Addr {
+	if this.lsner == nil {
+		return nil
+	}
+	return this.lsner.Addr()
+}
+
+func (this *TCPCluster) close() {
+	if !atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		return
+	}
+	close(this.stopC)
+	if this.lsner != nil {
+		this.lsner.Close()
+	}
+	this.mu.Lock()
+	links := make([]*tcpClusterLink, 0, len(this.links))
+	for _, link := range this.links {
+		links = append(links, link)
+	}
+	this.mu.Unlock()
+	for _, link := range links {
+		link.close()
+	}
+}
+
+// Nodes linked now
+func (this *TCPCluster) Nodes() (nodes []string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for node := range this.links {
+		nodes = append(nodes, node)
+	}
+	return
+}
+
+func (this *TCPCluster) runAccept() {
+	for {
+		c, err := this.lsner.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&this.closed) == 0 {
+				this.srvo.logr().Warn("Cluster accept failed", "err", err)
+			}
+			return
+		}
+		go this.serveLink(c, "")
+	}
+}
+
+// AddPeer links to the node at addr, dialed again while lost till closed
+func (this *TCPCluster) AddPeer(addr string) {
+	go func() {
+		for atomic.LoadInt32(&this.closed) == 0 {
+			c, err := net.DialTimeout("tcp", addr, TCP_CLUSTER_HELLO_TIMEOUT*time.Second)
+			if err == nil {
+				this.serveLink(c, addr)
+			} else {
+				this.srvo.logr().Debug("Cluster dial failed", "addr", addr, "err", err)
+				this.srvo.dialFailed(err)
+			}
+			select {
+			case <-this.stopC:
+				return
+			case <-time.After(TCP_CLUSTER_REDIAL * time.Second):
+			}
+		}
+	}()
+}
+
+// blocks till the link lost
+func (this *TCPCluster) serveLink(c net.Conn, addr string) {
+	link, err := newTCPClusterLink(this, c)
+	if err != nil {
+		this.srvo.logr().Warn("Cluster link failed", "addr", c.RemoteAddr(), "err", err)
+		c.Close()
+		return
+	}
+	this.mu.Lock()
+	if _, ok := this.links[link.node]; ok || atomic.LoadInt32(&this.closed) == 1 {
+		this.mu.Unlock()
+		this.srvo.logr().Debug("Cluster node already linked", "node", link.node, "addr", c.RemoteAddr())
+		c.Close()
+		return
+	}
+	this.links[link.node] = link
+	this.mu.Unlock()
+	this.srvo.logr().Info("Cluster node linked", "node", link.node, "addr", c.RemoteAddr(), "dialed", addr != "")
+
+	go link.runWrite()
+	this.linkUp(link)
+	link.runRead()
+
+	this.mu.Lock()
+	delete(this.links, link.node)
+	this.mu.Unlock()
+	link.close()
+	this.linkDown(link.node)
+	this.srvo.logr().Info("Cluster node lost", "node", link.node, "addr", c.RemoteAddr())
+}
+
+// announce our clients to gossip, and ask routes waiting a peer not here,
+// the peer may be on the new node.
+func (this *TCPCluster) linkUp(link *tcpClusterLink) {
+	for _, c := range this.srvo.confirmedConns() {
+		if this.gossip != nil {
+			link.send(tcpClusterPairPacket(TCP_CLUSTER_ANNOUNCE, c.Pubkey, nil))
+		}
+		for _, pci := range c.routesByConnid() {
+			c.connmu.RLock()
+			status := pci.Status
+			c.connmu.RUnlock()
+			if status != 1 || this.srvo.confirmedConn(pci.Pubkey) != nil {
+				continue
+			}
+			if node, ok := this.dir.Lookup(pci.Pubkey); !ok || node == link.node {
+				link.send(tcpClusterPairPacket(TCP_CLUSTER_ROUTE_REQUEST, c.Pubkey, pci.Pubkey))
+			}
+		}
+	}
+}
+
+// routes to clients of node offline, like killAccepted of its conns
+func (this *TCPCluster) linkDown(node string) {
+	if this.gossip != nil {
+		this.gossip.dropNode(node)
+	}
+	for _, c := range this.srvo.confirmedConns() {
+		for _, pci := range c.routesByConnid() {
+			c.connmu.Lock()
+			down := c.ConnInfos2[pci.Connid] == pci && pci.Status == 2 && pci.Node == node
+			if down {
+				pci.Status, pci.Otherid, pci.Node = 1, 0, ""
+			}
+			c.connmu.Unlock()
+			if down {
+				c.SendDisconnectNotification(pci.Connid)
+			}
+		}
+	}
+}
+
+func (this *TCPCluster) linkOf(pubkey *CryptoKey) *tcpClusterLink {
+	node, ok := this.dir.Lookup(pubkey)
+	if !ok || node == this.Node {
+		return nil
+	}
+	return this.linkOfNode(node)
+}
+func (this *TCPCluster) linkOfNode(node string) *tcpClusterLink {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.links[node]
+}
+
+func (this *TCPCluster) broadcast(pkt []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, link := range this.links {
+		link.send(pkt)
+	}
+}
+
+/////
+
+// hooks of the server, no-op on nil cluster
+
+func (this *TCPCluster) connConfirmed(c *TCPSecureConn) {
+	if this == nil {
+		return
+	}
+	if this.gossip != nil {
+		this.broadcast(tcpClusterPairPacket(TCP_CLUSTER_ANNOUNCE, c.Pubkey, nil))
+		return
+	}
+	gopp.ErrPrint(this.dir.Register(c.Pubkey, this.Node), c.Pubkey)
+}
+
+func (this *TCPCluster) connClosed(c *TCPSecureConn) {
+	if this == nil {
+		return
+	}
+	if this.gossip != nil {
+		this.broadcast(tcpClusterPairPacket(TCP_CLUSTER_WITHDRAW, c.Pubkey, nil))
+		return
+	}
+	gopp.ErrPrint(this.dir.Unregister(c.Pubkey, this.Node), c.Pubkey)
+}
+
+// route of c to pci.Pubkey created, peer not here
+func (this *TCPCluster) requestRoute(c *TCPSecureConn, pci *PeerConnInfo) {
+	if this == nil {
+		return
+	}
+	if link := this.linkOf(pci.Pubkey); link != nil {
+		link.send(tcpClusterPairPacket(TCP_CLUSTER_ROUTE_REQUEST, c.Pubkey, pci.Pubkey))
+	}
+}
+
+// online route of c to a client of pci.Node gone
+func (this *TCPCluster) closeRoute(c *TCPSecureConn, pci *PeerConnInfo) {
+	if link := this.linkOfNode(pci.Node); link != nil {
+		link.send(tcpClusterPairPacket(TCP_CLUSTER_ROUTE_CLOSE, c.Pubkey, pci.Pubkey))
+	}
+}
+
+func (this *TCPCluster) forwardData(c *TCPSecureConn, pci *PeerConnInfo, data []byte) bool {
+	link := this.linkOfNode(pci.Node)
+	return link != nil && link.send(tcpClusterPairPacket(TCP_CLUSTER_ROUTE_DATA, c.Pubkey, pci.Pubkey, data...))
+}
+
+func (this *TCPCluster) forwardOOB(c *TCPSecureConn, dstpk *CryptoKey, data []byte) {
+	if this == nil {
+		return
+	}
+	if link := this.linkOf(dstpk); link != nil {
+		link.send(tcpClusterPairPacket(TCP_CLUSTER_OOB, c.Pubkey, dstpk, data...))
+	}
+}
+
+/////
+
+// packets from node, in read goroutine of its link
+
+func (this *TCPCluster) handlePacket(link *tcpClusterLink, plain []byte) error {
+	ptype := plain[0]
+	switch ptype {
+	case TCP_CLUSTER_ANNOUNCE, TCP_CLUSTER_WITHDRAW:
+		if len(plain) != 1+PUBLIC_KEY_SIZE {
+			return errors.Errorf("Invalid cluster packet length: %d, %d", ptype, len(plain))
+		}
+		if this.gossip == nil {
+			return nil // shared directory, ignore peer's gossip
+		}
+		pubkey := NewCryptoKey(plain[1:])
+		if ptype == TCP_CLUSTER_ANNOUNCE {
+			return this.gossip.Register(pubkey, link.node)
+		}
+		return this.gossip.Unregister(pubkey, link.node)
+	case TCP_CLUSTER_ROUTE_REQUEST, TCP_CLUSTER_ROUTE_ACCEPT, TCP_CLUSTER_ROUTE_CLOSE:
+		if len(plain) != tcpClusterPairSize {
+			return errors.Errorf("Invalid cluster packet length: %d, %d", ptype, len(plain))
+		}
+	case TCP_CLUSTER_ROUTE_DATA, TCP_CLUSTER_OOB:
+		if len(plain) <= tcpClusterPairSize {
+			return errors.Errorf("Invalid cluster packet length: %d, %d", ptype, len(plain))
+		}
+	default:
+		return errors.Errorf("Invalid cluster packet type: %d", ptype)
+	}
+
+	srcpk := NewCryptoKey(plain[1 : 1+PUBLIC_KEY_SIZE])
+	dst := this.srvo.confirmedConn(NewCryptoKey(plain[1+PUBLIC_KEY_SIZE : tcpClusterPairSize]))
+	if dst == nil {
+		return nil // gone meanwhile
+	}
+	data := plain[tcpClusterPairSize:]
+	if ptype == TCP_CLUSTER_OOB {
+		oob := make([]byte, 0, 1+PUBLIC_KEY_SIZE+len(data))
+		oob = append(append(append(oob, TCP_PACKET_OOB_RECV), srcpk.Bytes()...), data...)
+		if dst.isClosed() || !dst.enqueueData(oob) {
+			dst.logr().Debug("Data queue is full, drop cluster oob", "len", len(oob), "addr", dst.Sock.RemoteAddr())
+		}
+		return nil
+	}
+
+	// route state moves under connmu, sends run after it
+	var sends []func()
+	dst.connmu.Lock()
+	pci, ok := dst.ConnInfos[srcpk.BinStr()]
+	if !ok {
+		dst.connmu.Unlock()
+		return nil // dst not asked src, its own request will come to node
+	}
+	connid := pci.Connid
+	switch ptype {
+	case TCP_CLUSTER_ROUTE_REQUEST, TCP_CLUSTER_ROUTE_ACCEPT:
+		if pci.Status == 1 {
+			pci.Status, pci.Otherid, pci.Node = 2, 0, link.node
+			dst.logr().Debug("Two peers connected each other over cluster", "route", pci, "node", link.node)
+			sends = append(sends, func() { dst.SendConnectNotification(connid) })
+		}
+		if ptype == TCP_CLUSTER_ROUTE_REQUEST && pci.Status == 2 && pci.Node == link.node {
+			sends = append(sends, func() { link.send(tcpClusterPairPacket(TCP_CLUSTER_ROUTE_ACCEPT, dst.Pubkey, srcpk)) })
+		}
+	case TCP_CLUSTER_ROUTE_CLOSE:
+		if pci.Status == 2 && pci.Node == link.node {
+			pci.Status, pci.Otherid, pci.Node = 1, 0, ""
+			sends = append(sends, func() { dst.SendDisconnectNotification(connid) })
+		}
+	case TCP_CLUSTER_ROUTE_DATA:
+		if pci.Status == 2 && pci.Node == link.node {
+			sends = append(sends, func() {
+				_, err := dst.SendDataPacket(connid, data)
+				gopp.ErrPrint(err, connid, dst.Sock.RemoteAddr())
+			})
+		}
+	}
+	dst.connmu.Unlock()
+	for _, f := range sends {
+		f()
+	}
+	return nil
+}
+
+func tcpClusterPairPacket(ptype byte, srcpk, dstpk *CryptoKey, data ...byte) []byte {
+	pkt := make([]byte, 0, tcpClusterPairSize+len(data))
+	pkt = append(append(pkt, ptype), srcpk.Bytes()...)
+	if dstpk != nil {
+		pkt = append(pkt, dstpk.Bytes()...)
+	}
+	return append(pkt, data...)
+}
+
+/////
+
+type tcpClusterLink struct {
+	cl        *TCPCluster
+	conn      net.Conn
+	node      string // of peer, by its hello
+	sendKey   *CryptoKey
+	recvKey   *CryptoKey
+	sendNonce *CBNonce
+	recvNonce *CBNonce
+	wq        chan []byte
+	stopC     chan bool
+	closeOnce sync.Once
+}
+
+// exchange nonces and hellos
+func newTCPClusterLink(cl *TCPCluster, c net.Conn) (*tcpClusterLink, error) {
+	this := &tcpClusterLink{cl: cl, conn: c}
+	this.wq = make(chan []byte, TCP_CLUSTER_QUEUE_SIZE)
+	this.stopC = make(chan bool)
+
+	c.SetDeadline(time.Now().Add(TCP_CLUSTER_HELLO_TIMEOUT * time.Second))
+	defer c.SetDeadline(time.Time{})
+	mynonce := CBRandomNonce().Bytes()
+	if _, err := c.Write(mynonce); err != nil {
+		return nil, err
+	}
+	peernonce := make([]byte, NONCE_SIZE)
+	if _, err := io.ReadFull(c, peernonce); err != nil {
+		return nil, err
+	}
+	if string(peernonce) == string(mynonce) {
+		return nil, errors.New("Cluster nonce reflected")
+	}
+	// per link and direction keys, frames of other links never open
+	this.sendKey = tcpClusterKey(cl.secret, mynonce, peernonce)
+	this.recvKey = tcpClusterKey(cl.secret, peernonce, mynonce)
+	this.sendNonce = NewCBNonce(append([]byte{}, mynonce...))
+	this.recvNonce = NewCBNonce(append([]byte{}, peernonce...))
+
+	if err := this.writePacket(append([]byte{TCP_CLUSTER_HELLO}, cl.Node...)); err != nil {
+		return nil, err
+	}
+	hello, err := this.readPacket()
+	if err != nil {
+		return nil, errors.Wrap(err, "hello")
+	}
+	if hello[0] != TCP_CLUSTER_HELLO || len(hello) == 1 {
+		return nil, errors.Errorf("Invalid cluster hello: %d, %d", hello[0], len(hello))
+	}
+	this.node = string(hello[1:])
+	if this.node == cl.Node {
+		return nil, errors.Errorf("Cluster node linked itself: %s", this.node)
+	}
+	return this, nil
+}
+
+func tcpClusterKey(secret *CryptoKey, from, to []byte) *CryptoKey {
+	h := sha256.New()
+	h.Write(secret.Bytes())
+	h.Write(from)
+	h.Write(to)
+	return NewCryptoKey(h.Sum(nil))
+}
+
+// queue plain, false if dropped
+func (this *tcpClusterLink) send(plain []byte) bool {
+	select {
+	case this.wq <- plain:
+		return true
+	default:
+		this.cl.srvo.logr().Warn("Cluster queue is full, drop packet", "node", this.node, "type", plain[0], "len", len(plain))
+		return false
+	}
+}
+
+func (this *tcpClusterLink) close() {
+	this.closeOnce.Do(func() {
+		close(this.stopC)
+		this.conn.Close()
+	})
+}
+
+func (this *tcpClusterLink) runWrite() {
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case plain := <-this.wq:
+			if err := this.writePacket(plain); err != nil {
+				this.cl.srvo.logr().Debug("Cluster write failed", "node", this.node, "err", err)
+				this.close()
+				return
+			}
+		}
+	}
+}
+
+func (this *tcpClusterLink) runRead() {
+	for {
+		plain, err := this.readPacket()
+		if err != nil {
+			if atomic.LoadInt32(&this.cl.closed) == 0 {
+				this.cl.srvo.logr().Debug("Cluster read failed", "node", this.node, "err", err)
+			}
+			return
+		}
+		if err := this.cl.handlePacket(this, plain); err != nil {
+			this.cl.srvo.logr().Warn("Cluster packet invalid", "node", this.node, "err", err)
+			return
+		}
+	}
+}
+
+func (this *tcpClusterLink) writePacket(plain []byte) error {
+	encpkt, err := EncryptDataSymmetric(this.sendKey, this.sendNonce, plain)
+	if err != nil {
+		return err
+	}
+	this.sendNonce.Incr()
+	if len(encpkt) > 0xFFFF {
+		return errors.Errorf("Cluster packet too long: %d", len(encpkt))
+	}
+	frame := make([]byte, TCP_FRAME_HEADER_SIZE, TCP_FRAME_HEADER_SIZE+len(encpkt))
+	putFrameHeader(frame, len(encpkt))
+	_, err = this.conn.Write(append(frame, encpkt...))
+	return err
+}
+
+func (this *tcpClusterLink) readPacket() ([]byte, error) {
+	var hdr [TCP_FRAME_HEADER_SIZE]byte
+	if _, err := io.ReadFull(this.conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	pktlen := int(binary.BigEndian.Uint16(hdr[:]))
+	if pktlen <= MAC_SIZE {
+		return nil, errors.Wrapf(ErrFrameLength, "cluster %d", pktlen)
+	}
+	encpkt := make([]byte, pktlen)
+	if _, err := io.ReadFull(this.conn, encpkt); err != nil {
+		return nil, err
+	}
+	plain, err := DecryptDataSymmetric(this.recvKey, this.recvNonce, encpkt)
+	if err != nil {
+		return nil, errors.Wrap(err, "cluster decrypt")
+	}
+	this.recvNonce.Incr()
+	return plain, nil
+}
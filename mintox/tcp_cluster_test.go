@@ -0,0 +1,190 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTstClusterConfig(secret string) *TCPServerConfig {
+	cfg := DefaultTCPServerConfig()
+	cfg.ClusterListen = "127.0.0.1:0"
+	cfg.ClusterSecret = secret
+	return cfg
+}
+
+func newTstClusterClient(t *testing.T, srvo *TCPServer, addr string) *TCPClient {
+	cli, _ := newTstConfirmedClient(t, addr, srvo.Pubkey, nil)
+	return cli
+}
+
+func TestClusterRouting(t *testing.T) {
+	secret, _, _ := NewCBKeyPair()
+	srvo0, addr0 := newTstListenServer(t, newTstClusterConfig(secret.ToHex()), defaultClock)
+	defer srvo0.Shutdown(context.Background())
+	cfg1 := newTstClusterConfig(secret.ToHex())
+	cfg1.ClusterNode = "node1"
+	cfg1.ClusterPeers = []string{srvo0.Cluster().Addr().String()}
+	srvo1, addr1 := newTstListenServer(t, cfg1, defaultClock)
+	if !waitTstCond(3*time.Second, func() bool {
+		return len(srvo0.Cluster().Nodes()) == 1 && len(srvo1.Cluster().Nodes()) == 1
+	}) {
+		t.Fatal("nodes not linked")
+	}
+	if nodes := srvo0.Cluster().Nodes(); nodes[0] != "node1" {
+		t.Error("node id:", nodes)
+	}
+
+	a := newTstClusterClient(t, srvo0, addr0)
+	b := newTstClusterClient(t, srvo1, addr1)
+	defer a.Close()
+	if !waitTstCond(3*time.Second, func() bool {
+		node, ok := srvo0.Cluster().dir.Lookup(b.SelfPubkey)
+		return ok && node == "node1"
+	}) {
+		t.Fatal("b not gossiped")
+	}
+
+	dataC := make(chan []byte, 16)
+	a.OnData = func(pk *CryptoKey, data []byte) { dataC <- data }
+	a.AddPeer(b.SelfPubkey)
+	b.AddPeer(a.SelfPubkey)
+	if !recvTstRouted(b, a, dataC) {
+		t.Fatal("routed data not received over cluster")
+	}
+
+	oobC := make(chan []byte, 16)
+	a.OnOOBData = func(pk *CryptoKey, data []byte) {
+		if pk.Equal2(b.SelfPubkey) {
+			oobC <- data
+		}
+	}
+	b.SendOOB(a.SelfPubkey, []byte("oob"))
+	select {
+	case data := <-oobC:
+		if string(data) != "oob" {
+			t.Error("oob data:", string(data))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("oob not received over cluster")
+	}
+
+	// b gone, route of a offline, unknown to directory
+	b.Close()
+	ca := srvo0.confirmedConn(a.SelfPubkey)
+	if !waitTstCond(3*time.Second, func() bool {
+		ca.connmu.RLock()
+		pci, ok := ca.ConnInfos[b.SelfPubkey.BinStr()]
+		ca.connmu.RUnlock()
+		return ok && pci.Status == 1 && pci.Node == ""
+	}) {
+		t.Error("route not offline after peer closed")
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		_, ok := srvo0.Cluster().dir.Lookup(b.SelfPubkey)
+		return !ok
+	}) {
+		t.Error("b not withdrawn")
+	}
+
+	srvo1.Shutdown(context.Background())
+	if !waitTstCond(3*time.Second, func() bool { return len(srvo0.Cluster().Nodes()) == 0 }) {
+		t.Error("node not lost")
+	}
+}
+
+func TestClusterSharedDirectory(t *testing.T) {
+	secret, _, _ := NewCBKeyPair()
+	dir := NewMemClusterDirectory()
+	cfg0 := newTstClusterConfig(secret.ToHex())
+	cfg0.ClusterDirectory = dir
+	srvo0, addr0 := newTstListenServer(t, cfg0, defaultClock)
+	defer srvo0.Shutdown(context.Background())
+	cfg1 := newTstClusterConfig(secret.ToHex())
+	cfg1.ClusterDirectory = dir
+	cfg1.ClusterPeers = []string{srvo0.Cluster().Addr().String()}
+	srvo1, addr1 := newTstListenServer(t, cfg1, defaultClock)
+	defer srvo1.Shutdown(context.Background())
+	if !waitTstCond(3*time.Second, func() bool { return len(srvo1.Cluster().Nodes()) == 1 }) {
+		t.Fatal("nodes not linked")
+	}
+
+	a := newTstClusterClient(t, srvo0, addr0)
+	b := newTstClusterClient(t, srvo1, addr1)
+	defer a.Close()
+	defer b.Close()
+	if !waitTstCond(3*time.Second, func() bool {
+		node, ok := dir.Lookup(b.SelfPubkey)
+		return ok && node == srvo1.Pubkey.ToHex()
+	}) {
+		t.Fatal("b not registered")
+	}
+	dataC := make(chan []byte, 16)
+	b.OnData = func(pk *CryptoKey, data []byte) { dataC <- data }
+	b.AddPeer(a.SelfPubkey)
+	a.AddPeer(b.SelfPubkey)
+	if !recvTstRouted(a, b, dataC) {
+		t.Fatal("routed data not received over cluster")
+	}
+
+	// stale entry of another node not removed
+	dir.Register(b.SelfPubkey, "other")
+	dir.Unregister(b.SelfPubkey, srvo1.Cluster().Node)
+	if node, _ := dir.Lookup(b.SelfPubkey); node != "other" {
+		t.Error("entry of other node removed:", node)
+	}
+}
+
+func TestClusterLinkSecret(t *testing.T) {
+	srvo := newTstServer()
+	newcl := func(secret *CryptoKey, node string) *TCPCluster {
+		cfg := newTstClusterConfig(secret.ToHex())
+		cfg.ClusterNode = node
+		cl, err := newTCPCluster(srvo, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cl
+	}
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	link := func(cl0, cl1 *TCPCluster) (err0, err1 error) {
+		errC := make(chan error, 1)
+		go func() {
+			c1, err := lsner.Accept()
+			if err == nil {
+				_, err = newTCPClusterLink(cl1, c1)
+				c1.Close()
+			}
+			errC <- err
+		}()
+		c0, err := net.Dial("tcp", lsner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err0 = newTCPClusterLink(cl0, c0)
+		c0.Close()
+		return err0, <-errC
+	}
+
+	secret, _, _ := NewCBKeyPair()
+	other, _, _ := NewCBKeyPair()
+	if err0, err1 := link(newcl(secret, "n0"), newcl(secret, "n1")); err0 != nil || err1 != nil {
+		t.Fatal("link:", err0, err1)
+	}
+	if err0, err1 := link(newcl(secret, "n0"), newcl(other, "n1")); err0 == nil || err1 == nil {
+		t.Error("linked with wrong secret")
+	}
+	if err0, err1 := link(newcl(secret, "n0"), newcl(secret, "n0")); err0 == nil || err1 == nil {
+		t.Error("linked to itself")
+	}
+
+	cfg := newTstClusterConfig("1234")
+	if err := cfg.Validate(); err == nil {
+		t.Error("invalid cluster_secret accepted")
+	}
+}
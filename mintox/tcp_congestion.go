@@ -0,0 +1,86 @@
+package mintox
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// what to do with a source keep sending faster than its destination can take
+const (
+	TCP_CONGESTION_DROP       = "drop"       // drop and count only
+	TCP_CONGESTION_THROTTLE   = "throttle"   // rate limit source to destination until drained
+	TCP_CONGESTION_DISCONNECT = "disconnect" // kick the source
+)
+
+var tcpcongpolicies = map[string]bool{
+	TCP_CONGESTION_DROP: true, TCP_CONGESTION_THROTTLE: true, TCP_CONGESTION_DISCONNECT: true}
+
+/* max time in seconds to throttle the source for a destination */
+const TCP_CONGESTION_PAUSE = 1
+
+/* floor of the throttled rate, bytes per second */
+const TCP_CONGESTION_MIN_RATE = 1024
+
+// source throttled for a slow destination, read goroutine only
+type tcpCongestion struct {
+	peer  *TCPSecureConn // destination, nil when not throttled
+	since time.Time      // last throttled
+	limit int            // relayed bytes per second to peer
+	rate  tcpRate
+}
+
+// forward to peerco failed, in source conn's read goroutine
+func (this *TCPSecureConn) onForwardDropped(peerco *TCPSecureConn) {
+	atomic.AddInt64(&this.fwdDropped, 1)
+	this.fwdOverflow++
+	cfg := this.srvo.config()
+	if this.fwdOverflow < cfg.CongestionDrops {
+		return
+	}
+
+	// sustained overflow
+	this.fwdOverflow = 0
+	switch cfg.CongestionPolicy {
+	case TCP_CONGESTION_THROTTLE:
+		atomic.AddInt64(&this.srvo.cnts.CongestionThrottled, 1)
+		this.throttleFor(peerco)
+	case TCP_CONGESTION_DISCONNECT:
+		atomic.AddInt64(&this.srvo.cnts.CongestionKicked, 1)
+		log.Println("Source too fast, disconnect:", this.Sock.RemoteAddr(), this.FwdDropped(), peerco.Sock.RemoteAddr())
+		this.doClose(true, TCP_CLOSE_CONGESTION)
+	}
+}
+
+func (this *TCPSecureConn) onForwarded() { this.fwdOverflow = 0 }
+
+// relayed packets dropped because destination queue full or throttled for it
+func (this *TCPSecureConn) FwdDropped() int64 { return atomic.LoadInt64(&this.fwdDropped) }
+
+// halve the rate relayed to peerco, from the recv rate of this second at first
+func (this *TCPSecureConn) throttleFor(peerco *TCPSecureConn) {
+	cong := &this.cong
+	if cong.peer != peerco {
+		cong.peer, cong.limit, cong.rate = peerco, this.rate.bytes, tcpRate{}
+	}
+	cong.since = this.clock.Now()
+	if cong.limit /= 2; cong.limit < TCP_CONGESTION_MIN_RATE {
+		cong.limit = TCP_CONGESTION_MIN_RATE
+	}
+}
+
+// false to drop a packet of nbytes to the destination throttled for. The rate
+// restored when its data queue half drained, or after TCP_CONGESTION_PAUSE.
+func (this *TCPSecureConn) allowForward(peerco *TCPSecureConn, nbytes int) bool {
+	cong := &this.cong
+	if cong.peer != peerco {
+		return true
+	}
+	now := this.clock.Now()
+	if len(peerco.cwdataq) < cap(peerco.cwdataq)/2 || peerco.isClosed() ||
+		now.Sub(cong.since) >= TCP_CONGESTION_PAUSE*time.Second {
+		cong.peer = nil
+		return true
+	}
+	return cong.rate.add(now, nbytes, 0, cong.limit)
+}
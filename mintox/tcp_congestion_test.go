@@ -0,0 +1,72 @@
+package mintox
+
+import (
+	"testing"
+	"time"
+)
+
+// fast source floods a slow destination which never drains
+func floodTstRoute(policy string, n int) (*TCPServer, *TCPSecureConn, *TCPSecureConn) {
+	srvo := newTstServer()
+	srvo.config().DataQueueSize = 4
+	srvo.config().CongestionDrops = 5
+	srvo.config().CongestionPolicy = policy
+	src := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	dst := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	connid := linkTstRelayConns(src, dst)
+	for i := 0; i < n && !src.isClosed(); i++ {
+		src.HandleRoutingData(append([]byte{connid}, "hello"...))
+	}
+	return srvo, src, dst
+}
+
+func TestCongestionDrop(t *testing.T) {
+	srvo, src, dst := floodTstRoute(TCP_CONGESTION_DROP, 20)
+	if len(dst.cwdataq) != 4 || src.FwdDropped() != 16 {
+		t.Error("queued/dropped:", len(dst.cwdataq), src.FwdDropped())
+	}
+	if src.isClosed() || srvo.Counters().CongestionKicked != 0 {
+		t.Error("source kicked with drop policy")
+	}
+}
+
+func TestCongestionDisconnect(t *testing.T) {
+	srvo, src, _ := floodTstRoute(TCP_CONGESTION_DISCONNECT, 20)
+	if !src.isClosed() || src.FwdDropped() != 5 {
+		t.Error("source not kicked after continuous drops:", src.FwdDropped())
+	}
+	if n := srvo.Counters().CongestionKicked; n != 1 {
+		t.Error("CongestionKicked:", n)
+	}
+}
+
+func TestCongestionThrottle(t *testing.T) {
+	btime := time.Now()
+	srvo, src, dst := floodTstRoute(TCP_CONGESTION_THROTTLE, 10)
+	// 6 drops, throttled once without blocking the source's read goroutine
+	if n := srvo.Counters().CongestionThrottled; n != 1 || src.cong.peer != dst {
+		t.Error("CongestionThrottled:", n)
+	}
+	if d := time.Since(btime); d > TCP_CONGESTION_PAUSE*time.Second/2 || src.isClosed() {
+		t.Error("source blocked:", d, src.isClosed())
+	}
+	if src.cong.limit != TCP_CONGESTION_MIN_RATE || src.FwdDropped() != 6 {
+		t.Error("throttled rate/dropped:", src.cong.limit, src.FwdDropped())
+	}
+
+	// over the throttled rate dropped by source, not tried on destination
+	connid := src.ConnInfos[dst.Pubkey.BinStr()].Connid
+	src.HandleRoutingData(append([]byte{connid}, make([]byte, TCP_CONGESTION_MIN_RATE)...))
+	if src.FwdDropped() != 7 || src.fwdOverflow != 1 {
+		t.Error("dropped/overflow:", src.FwdDropped(), src.fwdOverflow)
+	}
+
+	// destination draining restores the rate
+	for len(dst.cwdataq) > 0 {
+		dst.dataDequeued(<-dst.cwdataq)
+	}
+	src.HandleRoutingData(append([]byte{connid}, make([]byte, TCP_CONGESTION_MIN_RATE)...))
+	if len(dst.cwdataq) != 1 || src.cong.peer != nil {
+		t.Error("rate not restored:", len(dst.cwdataq), src.cong.peer)
+	}
+}
@@ -1,9 +1,13 @@
 package mintox
 
 import (
-	"net"
+	"gopp"
+	"log"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const TCP_CONN_NONE = 0
@@ -31,6 +35,9 @@ const RECOMMENDED_FRIEND_TCP_CONNECTIONS = (MAX_FRIEND_TCP_CONNECTIONS / 2)
 /* Number of TCP connections used for onion purposes. */
 const NUM_ONION_TCP_CONNECTIONS = RECOMMENDED_FRIEND_TCP_CONNECTIONS
 
+/* seconds a failed relay sleeps before reconnected */
+const TCP_RELAY_RETRY_INTERVAL = 10
+
 // To Friend's connections
 // 1:MAX_FRIEND_TCP_CONNECTIONS
 // type TCPFriendCon
@@ -39,9 +46,9 @@ type TCPConnectionTo struct {
 	Pubkey *CryptoKey
 
 	Conns [MAX_FRIEND_TCP_CONNECTIONS]struct {
-		Conn   uint32 // ???
-		Status uint
-		Connid uint
+		Conn   uint32 // relay number + 1, 0 for unused
+		Status uint8  // TCP_CONNECTIONS_STATUS_*
+		Connid uint8  // valid when registered
 	}
 
 	Cbid int // id used in callbacks
@@ -49,33 +56,35 @@ type TCPConnectionTo struct {
 
 // To RelayPK's TCPClient connections
 // 1:N
-// type TCPClientCon ???
-// type TCPRelayCon ???
 type TCPCon struct {
 	Status uint8
 
-	TCPClientConns []*TCPClient // TCP_Client_Connection *connection;
-	ConnectedTime  time.Time
-	LockCount      uint32
-	SleepCount     uint32
-	Onion          bool
+	Conn          *TCPClient // TCP_Client_Connection *connection;
+	ConnectedTime time.Time
+	LockCount     uint32 // friends assigned
+	SleepCount    uint32 // times failed and slept
+	Onion         bool
 
 	/* Only used when connection is sleeping. */
-	Addr    net.Addr
+	Addr    string
 	RelayPK *CryptoKey
 	Unsleep bool /* set to 1 to unsleep connection. */
+	sleptAt time.Time
 }
 
-// 1:N
+// like TCP_Connections, pool of relay conns shared by friends, between
+// TCPClient and net_crypto. Each friend is assigned to up to
+// RECOMMENDED_FRIEND_TCP_CONNECTIONS relays, and moved to others when one fails.
 type TCPConnections struct {
 	dhto *DHT
 
 	SelfPubkey *CryptoKey
-	SelfSekkey *CryptoKey
+	SelfSeckey *CryptoKey
 
 	connmu   sync.RWMutex
-	ConnTos  []*TCPConnectionTo
-	TCPConns []*TCPCon
+	ConnTos  []*TCPConnectionTo // connections number =>, nil for killed
+	TCPConns []*TCPCon          // relay number =>, nil for killed
+	friends  map[string]int     // binpk => connections number
 
 	TCPDataFunc   func(object Object, cbid int, data []byte, cbdata Object) int
 	TCPDataCbdata Object
@@ -86,19 +95,492 @@ type TCPConnections struct {
 	TCPOnionFunc   func(object Object, data []byte, cbdata Object) int
 	TCPOnionCbdata Object
 
-	// TCP_Proxy_Info proxy_info;
+	proxy *TCPProxyInfo // of new relay conns, connmu
+	hsver uint8         // TCP_HANDSHAKE_* of new relay conns, connmu
 
 	OnionStatus   bool
 	OnionNumConns uint16
+
+	clock  clock
+	killed bool // connmu
+	stopC  chan bool
 }
 
 func NewTCPConnections(seckey *CryptoKey) *TCPConnections {
+	return NewTCPConnectionsProxy(seckey, nil)
+}
+
+// proxy nil or TCP_PROXY_NONE to connect relays directly
+func NewTCPConnectionsProxy(seckey *CryptoKey, proxy *TCPProxyInfo) *TCPConnections {
 	this := &TCPConnections{}
 	pubkey := CBDerivePubkey(seckey)
-	this.SelfPubkey, this.SelfSekkey = pubkey, seckey
+	this.SelfPubkey, this.SelfSeckey = pubkey, seckey
+	this.proxy = proxy
 
 	this.ConnTos = make([]*TCPConnectionTo, 0)
 	this.TCPConns = make([]*TCPCon, 0)
+	this.friends = map[string]int{}
+	this.clock = defaultClock
+	this.stopC = make(chan bool)
 
+	go this.doTCPConnectionsLoop()
 	return this
 }
+
+func (this *TCPConnections) Kill() {
+	this.connmu.Lock()
+	if this.killed {
+		this.connmu.Unlock()
+		return
+	}
+	this.killed = true
+	close(this.stopC)
+	var clis []*TCPClient
+	for _, tcpcon := range this.TCPConns {
+		if tcpcon != nil && tcpcon.Conn != nil {
+			clis = append(clis, tcpcon.Conn)
+		}
+	}
+	this.connmu.Unlock()
+	for _, cli := range clis {
+		cli.Close()
+	}
+}
+
+// like add_tcp_relay_global, return relay number, the existing one if relaypk added
+func (this *TCPConnections) AddTCPRelay(addr string, relaypk *CryptoKey) (int, error) {
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	if this.killed {
+		return -1, errors.New("TCP connections killed")
+	}
+	if num := this.relayNumLocked(relaypk); num >= 0 {
+		return num, nil
+	}
+	tcpcon := &TCPCon{Addr: addr, RelayPK: relaypk}
+	this.TCPConns = append(this.TCPConns, tcpcon)
+	this.connectRelayLocked(tcpcon)
+	return len(this.TCPConns) - 1, nil
+}
+
+// like kill_tcp_relay_connection, friends on it moved to other relays
+func (this *TCPConnections) KillTCPRelay(relaynum int) error {
+	this.connmu.Lock()
+	tcpcon := this.relayLocked(relaynum)
+	if tcpcon == nil {
+		this.connmu.Unlock()
+		return errors.Errorf("Invalid relay number: %d", relaynum)
+	}
+	this.TCPConns[relaynum] = nil
+	this.releaseRelayLocked(relaynum)
+	cli := tcpcon.Conn
+	this.connmu.Unlock()
+	if cli != nil {
+		cli.Close()
+	}
+	return nil
+}
+
+// like new_tcp_connection_to, friend's data comes with cbid in TCPDataFunc
+func (this *TCPConnections) NewConnectionTo(pubkey *CryptoKey, cbid int) (int, error) {
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	if _, ok := this.friends[pubkey.BinStr()]; ok {
+		return -1, errors.Errorf("Connection to already exists: %s", pubkey.ToHex20())
+	}
+	conto := &TCPConnectionTo{Status: TCP_CONN_VALID, Pubkey: pubkey, Cbid: cbid}
+	this.ConnTos = append(this.ConnTos, conto)
+	num := len(this.ConnTos) - 1
+	this.friends[pubkey.BinStr()] = num
+	this.assignRelaysLocked(conto)
+	return num, nil
+}
+
+// like kill_tcp_connection_to, routes to friend removed from its relays
+func (this *TCPConnections) KillConnectionTo(connnum int) error {
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	conto := this.connToLocked(connnum)
+	if conto == nil {
+		return errors.Errorf("Invalid connections number: %d", connnum)
+	}
+	for i := range conto.Conns {
+		if conto.Conns[i].Conn == 0 {
+			continue
+		}
+		if tcpcon := this.relayLocked(int(conto.Conns[i].Conn - 1)); tcpcon != nil {
+			tcpcon.LockCount--
+			if tcpcon.Conn != nil {
+				err := tcpcon.Conn.RemovePeer(conto.Pubkey)
+				gopp.ErrPrint(err, tcpcon.Addr)
+			}
+		}
+	}
+	delete(this.friends, conto.Pubkey.BinStr())
+	this.ConnTos[connnum] = nil
+	return nil
+}
+
+// like add_tcp_number_relay_connection, use relay for friend besides the assigned ones
+func (this *TCPConnections) AddRelayToConnection(connnum int, relaynum int) error {
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	conto := this.connToLocked(connnum)
+	tcpcon := this.relayLocked(relaynum)
+	if conto == nil || tcpcon == nil {
+		return errors.Errorf("Invalid number: %d, %d", connnum, relaynum)
+	}
+	if tcpcon.Status == TCP_CONN_SLEEPING {
+		tcpcon.Unsleep = true
+	}
+	if !this.addRelayToLocked(conto, relaynum) {
+		return errors.Errorf("Relay not added: %d, %d", connnum, relaynum)
+	}
+	return nil
+}
+
+// like tcp_connection_to_online_tcp_relays
+func (this *TCPConnections) OnlineRelays(connnum int) int {
+	this.connmu.RLock()
+	defer this.connmu.RUnlock()
+	n := 0
+	if conto := this.connToLocked(connnum); conto != nil {
+		for _, c := range conto.Conns {
+			if c.Conn != 0 && c.Status == TCP_CONNECTIONS_STATUS_ONLINE {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// relay numbers friend assigned to
+func (this *TCPConnections) RelaysOf(connnum int) (relaynums []int) {
+	this.connmu.RLock()
+	defer this.connmu.RUnlock()
+	if conto := this.connToLocked(connnum); conto != nil {
+		for _, c := range conto.Conns {
+			if c.Conn != 0 {
+				relaynums = append(relaynums, int(c.Conn-1))
+			}
+		}
+	}
+	return
+}
+
+// like send_packet_tcp_connection, by online route of the lowest srtt relay, on failure
+// the next one. Without online route, as oob by relays friend registered.
+func (this *TCPConnections) SendDataToFriend(connnum int, data []byte) error {
+	type route struct {
+		cli    *TCPClient
+		online bool
+	}
+	var routes []route
+	this.connmu.RLock()
+	conto := this.connToLocked(connnum)
+	if conto == nil {
+		this.connmu.RUnlock()
+		return errors.Errorf("Invalid connections number: %d", connnum)
+	}
+	pubkey := conto.Pubkey
+	for _, c := range conto.Conns {
+		tcpcon := this.relayLocked(int(c.Conn) - 1)
+		if tcpcon == nil || tcpcon.Status != TCP_CONN_CONNECTED || c.Status == TCP_CONNECTIONS_STATUS_NONE {
+			continue
+		}
+		routes = append(routes, route{tcpcon.Conn, c.Status == TCP_CONNECTIONS_STATUS_ONLINE})
+	}
+	this.connmu.RUnlock()
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].online != routes[j].online {
+			return routes[i].online
+		}
+		return rttLess(routes[i].cli.SRTT(), routes[j].cli.SRTT())
+	})
+	var err error
+	for _, r := range routes {
+		if r.online {
+			if err = r.cli.SendData(pubkey, data); err == nil {
+				return nil
+			}
+		}
+	}
+	if err != nil { // online but queues full, oob would not help
+		return err
+	}
+	sent := 0
+	for _, r := range routes {
+		if r.cli.SendOOB(pubkey, data) == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		return errors.Errorf("No relay route to: %s", pubkey.ToHex20())
+	}
+	return nil
+}
+
+func (this *TCPConnections) doTCPConnectionsLoop() {
+	tickC, stop := this.clock.Tick(time.Second)
+	defer stop()
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case <-tickC:
+		}
+		this.doTCPConnections(this.clock.Now())
+	}
+}
+
+// like do_tcp_connections, wake sleeping relays after TCP_RELAY_RETRY_INTERVAL,
+// or at once when asked by AddRelayToConnection
+func (this *TCPConnections) doTCPConnections(now time.Time) {
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	if this.killed {
+		return
+	}
+	for _, tcpcon := range this.TCPConns {
+		if tcpcon == nil || tcpcon.Status != TCP_CONN_SLEEPING {
+			continue
+		}
+		if tcpcon.Unsleep || now.Sub(tcpcon.sleptAt) >= TCP_RELAY_RETRY_INTERVAL*time.Second {
+			this.connectRelayLocked(tcpcon)
+		}
+	}
+}
+
+// connmu held by caller
+func (this *TCPConnections) connectRelayLocked(tcpcon *TCPCon) {
+	cli := newTCPClientProxy(tcpcon.Addr, tcpcon.RelayPK, this.SelfPubkey, this.SelfSeckey, this.proxy)
+	cli.clock = this.clock
+	cli.HandshakeVersion = this.hsver
+	cli.OnConfirmed = func() { this.relayConfirmed(cli) }
+	cli.OnClosed = this.relayClosed
+	cli.RoutingStatusFunc = func(object Object, number uint32, connid uint8, status uint8) {
+		this.routingStatus(cli, connid, status)
+	}
+	cli.OnRouteEstablished = func(peerpk *CryptoKey, connid uint8, ok bool) {
+		if ok {
+			this.routingStatus(cli, connid, TCP_CONNECTIONS_STATUS_REGISTERED)
+		}
+	}
+	cli.OnData = func(peerpk *CryptoKey, data []byte) { this.handleData(peerpk, data) }
+	cli.OnOOBData = func(peerpk *CryptoKey, data []byte) { this.handleOOBData(cli, peerpk, data) }
+	cli.OnOnionResponse = func(data []byte) {
+		if fn := this.TCPOnionFunc; fn != nil {
+			fn(this, data, this.TCPOnionCbdata)
+		}
+	}
+	// friends kept on it while sleeping, routed after confirmed
+	relaynum := this.relayNumLocked(tcpcon.RelayPK)
+	for _, conto := range this.ConnTos {
+		if conto != nil && this.hasRelayLocked(conto, relaynum) {
+			cli.AddPeer(conto.Pubkey)
+		}
+	}
+	tcpcon.Conn = cli
+	tcpcon.Status = TCP_CONN_VALID
+	tcpcon.Unsleep = false
+	cli.goConnect()
+}
+
+// friends short of relays take the new one
+func (this *TCPConnections) relayConfirmed(cli *TCPClient) {
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	relaynum, tcpcon := this.relayByClientLocked(cli)
+	if tcpcon == nil {
+		return
+	}
+	tcpcon.Status = TCP_CONN_CONNECTED
+	tcpcon.ConnectedTime = this.clock.Now()
+	for _, conto := range this.ConnTos {
+		if conto != nil && this.relayCountLocked(conto) < RECOMMENDED_FRIEND_TCP_CONNECTIONS {
+			this.addRelayToLocked(conto, relaynum)
+		}
+	}
+}
+
+// relay failed, sleep it and move its friends to other relays
+func (this *TCPConnections) relayClosed(cli *TCPClient) {
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	relaynum, tcpcon := this.relayByClientLocked(cli)
+	if tcpcon == nil || this.killed {
+		return
+	}
+	log.Println("TCP relay failed, sleep:", tcpcon.Addr, tcpcon.LockCount)
+	tcpcon.Status = TCP_CONN_SLEEPING
+	tcpcon.SleepCount++
+	tcpcon.sleptAt = this.clock.Now()
+	tcpcon.Conn = nil
+	this.releaseRelayLocked(relaynum)
+}
+
+// unassign friends from relay, and assign them to others
+func (this *TCPConnections) releaseRelayLocked(relaynum int) {
+	for _, conto := range this.ConnTos {
+		if conto == nil {
+			continue
+		}
+		released := false
+		for i := range conto.Conns {
+			if conto.Conns[i].Conn == uint32(relaynum+1) {
+				conto.Conns[i].Conn, conto.Conns[i].Status, conto.Conns[i].Connid = 0, TCP_CONNECTIONS_STATUS_NONE, 0
+				released = true
+			}
+		}
+		if released {
+			this.assignRelaysLocked(conto)
+		}
+	}
+	if tcpcon := this.relayLocked(relaynum); tcpcon != nil {
+		tcpcon.LockCount = 0
+	}
+}
+
+func (this *TCPConnections) routingStatus(cli *TCPClient, connid uint8, status uint8) {
+	binpk, ok := cli.conns.Get(connid)
+	if !ok {
+		return
+	}
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	relaynum, tcpcon := this.relayByClientLocked(cli)
+	num, ok := this.friends[binpk.(string)]
+	if tcpcon == nil || !ok {
+		return
+	}
+	conto := this.ConnTos[num]
+	for i := range conto.Conns {
+		if conto.Conns[i].Conn == uint32(relaynum+1) {
+			conto.Conns[i].Status, conto.Conns[i].Connid = status, connid
+		}
+	}
+}
+
+func (this *TCPConnections) handleData(peerpk *CryptoKey, data []byte) {
+	this.connmu.RLock()
+	num, ok := this.friends[peerpk.BinStr()]
+	var cbid int
+	if ok {
+		cbid = this.ConnTos[num].Cbid
+	}
+	this.connmu.RUnlock()
+	if !ok {
+		log.Println("Data from unknown peer:", peerpk.ToHex20())
+		return
+	}
+	if fn := this.TCPDataFunc; fn != nil {
+		fn(this, cbid, data, this.TCPDataCbdata)
+	}
+}
+
+func (this *TCPConnections) handleOOBData(cli *TCPClient, peerpk *CryptoKey, data []byte) {
+	this.connmu.RLock()
+	relaynum, tcpcon := this.relayByClientLocked(cli)
+	this.connmu.RUnlock()
+	if tcpcon == nil {
+		return
+	}
+	if fn := this.TCPOOBFunc; fn != nil {
+		fn(this, peerpk, uint(relaynum), data, this.TCPOOBCbdata)
+	}
+}
+
+// fill friend's relays up to RECOMMENDED_FRIEND_TCP_CONNECTIONS by the least used ones,
+// lower srtt first among equally used
+func (this *TCPConnections) assignRelaysLocked(conto *TCPConnectionTo) {
+	for this.relayCountLocked(conto) < RECOMMENDED_FRIEND_TCP_CONNECTIONS {
+		best := -1
+		for i, tcpcon := range this.TCPConns {
+			if tcpcon == nil || tcpcon.Status == TCP_CONN_SLEEPING || this.hasRelayLocked(conto, i) {
+				continue
+			}
+			if best < 0 || tcpcon.LockCount < this.TCPConns[best].LockCount {
+				best = i
+			} else if tcpcon.LockCount == this.TCPConns[best].LockCount && tcpcon.Conn != nil &&
+				(this.TCPConns[best].Conn == nil || rttLess(tcpcon.Conn.SRTT(), this.TCPConns[best].Conn.SRTT())) {
+				best = i // equally used, the faster one
+			}
+		}
+		if best < 0 || !this.addRelayToLocked(conto, best) {
+			return
+		}
+	}
+}
+
+// connmu held by caller
+func (this *TCPConnections) addRelayToLocked(conto *TCPConnectionTo, relaynum int) bool {
+	if this.hasRelayLocked(conto, relaynum) {
+		return true
+	}
+	for i := range conto.Conns {
+		if conto.Conns[i].Conn != 0 {
+			continue
+		}
+		tcpcon := this.TCPConns[relaynum]
+		conto.Conns[i].Conn, conto.Conns[i].Status = uint32(relaynum+1), TCP_CONNECTIONS_STATUS_NONE
+		tcpcon.LockCount++
+		if tcpcon.Conn != nil {
+			err := tcpcon.Conn.AddPeer(conto.Pubkey)
+			gopp.ErrPrint(err, tcpcon.Addr)
+		}
+		return true
+	}
+	return false
+}
+
+func (this *TCPConnections) relayCountLocked(conto *TCPConnectionTo) (n int) {
+	for _, c := range conto.Conns {
+		if c.Conn != 0 {
+			n++
+		}
+	}
+	return
+}
+
+func (this *TCPConnections) hasRelayLocked(conto *TCPConnectionTo, relaynum int) bool {
+	for _, c := range conto.Conns {
+		if c.Conn == uint32(relaynum+1) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *TCPConnections) connToLocked(connnum int) *TCPConnectionTo {
+	if connnum < 0 || connnum >= len(this.ConnTos) {
+		return nil
+	}
+	return this.ConnTos[connnum]
+}
+
+func (this *TCPConnections) relayLocked(relaynum int) *TCPCon {
+	if relaynum < 0 || relaynum >= len(this.TCPConns) {
+		return nil
+	}
+	return this.TCPConns[relaynum]
+}
+
+func (this *TCPConnections) relayNumLocked(relaypk *CryptoKey) int {
+	for i, tcpcon := range this.TCPConns {
+		if tcpcon != nil && tcpcon.RelayPK.Equal2(relaypk) {
+			return i
+		}
+	}
+	return -1
+}
+
+// nil if cli is not the current conn of any relay, like a replaced one
+func (this *TCPConnections) relayByClientLocked(cli *TCPClient) (int, *TCPCon) {
+	for i, tcpcon := range this.TCPConns {
+		if tcpcon != nil && tcpcon.Conn == cli {
+			return i, tcpcon
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,157 @@
+package mintox
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type tstTCPData struct {
+	cbid int
+	data string
+}
+
+func newTstTCPConnections(t *testing.T, srvos []*TCPServer, addrs []string) (*TCPConnections, chan tstTCPData) {
+	_, sk, _ := NewCBKeyPair()
+	tcpcons := NewTCPConnections(sk)
+	dataC := make(chan tstTCPData, 16)
+	tcpcons.TCPDataFunc = func(object Object, cbid int, data []byte, cbdata Object) int {
+		dataC <- tstTCPData{cbid, string(data)}
+		return 0
+	}
+	for i, srvo := range srvos {
+		if num, err := tcpcons.AddTCPRelay(addrs[i], srvo.Pubkey); err != nil || num != i {
+			t.Fatal("add relay:", num, err)
+		}
+	}
+	return tcpcons, dataC
+}
+
+func recvTstTCPData(t *testing.T, dataC chan tstTCPData, cbid int, data string) {
+	select {
+	case d := <-dataC:
+		if d.cbid != cbid || d.data != data {
+			t.Error("data not match:", d, cbid, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("data not received:", data)
+	}
+}
+
+func TestTCPConnectionsRelaySwitch(t *testing.T) {
+	var srvos []*TCPServer
+	var addrs []string
+	for i := 0; i < RECOMMENDED_FRIEND_TCP_CONNECTIONS+1; i++ {
+		srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		defer srvo.Shutdown(ctx)
+		srvos, addrs = append(srvos, srvo), append(addrs, addr)
+	}
+	a, _ := newTstTCPConnections(t, srvos, addrs)
+	defer a.Kill()
+	b, bdataC := newTstTCPConnections(t, srvos, addrs)
+	defer b.Kill()
+	if num, _ := a.AddTCPRelay(addrs[0], srvos[0].Pubkey); num != 0 {
+		t.Error("relay added twice:", num)
+	}
+
+	na, err := a.NewConnectionTo(b.SelfPubkey, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb, _ := b.NewConnectionTo(a.SelfPubkey, 9)
+	if _, err := a.NewConnectionTo(b.SelfPubkey, 8); err == nil {
+		t.Error("connection to added twice")
+	}
+	if relays := a.RelaysOf(na); len(relays) != RECOMMENDED_FRIEND_TCP_CONNECTIONS || relays[0] != 0 {
+		t.Fatal("relays not assigned:", relays)
+	}
+	online := func(n int) bool {
+		return a.OnlineRelays(na) == n && b.OnlineRelays(nb) == n
+	}
+	if !waitTstCond(5*time.Second, func() bool { return online(RECOMMENDED_FRIEND_TCP_CONNECTIONS) }) {
+		t.Fatal("routes not online:", a.OnlineRelays(na), b.OnlineRelays(nb))
+	}
+	if err := a.SendDataToFriend(na, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	recvTstTCPData(t, bdataC, 9, "hello")
+
+	// relay 0 gone, friends moved to the spare one
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srvos[0].Shutdown(ctx)
+	if !waitTstCond(5*time.Second, func() bool {
+		relays := a.RelaysOf(na)
+		return len(relays) == RECOMMENDED_FRIEND_TCP_CONNECTIONS && relays[0] == RECOMMENDED_FRIEND_TCP_CONNECTIONS &&
+			online(RECOMMENDED_FRIEND_TCP_CONNECTIONS)
+	}) {
+		t.Fatal("not switched to spare relay:", a.RelaysOf(na), a.OnlineRelays(na), b.OnlineRelays(nb))
+	}
+	if err := a.SendDataToFriend(na, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	recvTstTCPData(t, bdataC, 9, "again")
+
+	// sleeping relay retried, still down
+	a.connmu.RLock()
+	tcpcon := a.TCPConns[0]
+	sleeps := tcpcon.SleepCount
+	a.connmu.RUnlock()
+	if sleeps != 1 {
+		t.Fatal("relay not sleeping:", sleeps)
+	}
+	a.doTCPConnections(time.Now().Add(TCP_RELAY_RETRY_INTERVAL * time.Second))
+	if !waitTstCond(5*time.Second, func() bool {
+		a.connmu.RLock()
+		defer a.connmu.RUnlock()
+		return tcpcon.SleepCount == 2 && tcpcon.Status == TCP_CONN_SLEEPING
+	}) {
+		t.Error("sleeping relay not retried")
+	}
+
+	if err := a.KillConnectionTo(na); err != nil {
+		t.Fatal(err)
+	}
+	if a.SendDataToFriend(na, []byte("x")) == nil || a.KillConnectionTo(na) == nil {
+		t.Error("killed connection to still works")
+	}
+}
+
+// friend not routing back to us, only reachable by oob of the shared relay
+func TestTCPConnectionsOOBFallback(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	a, _ := newTstTCPConnections(t, []*TCPServer{srvo}, []string{addr})
+	defer a.Kill()
+	b, _ := newTstTCPConnections(t, []*TCPServer{srvo}, []string{addr})
+	defer b.Kill()
+	oobC := make(chan string, 16)
+	b.TCPOOBFunc = func(object Object, pubkey *CryptoKey, relaynum uint, data []byte, cbdata Object) int {
+		if pubkey.Equal2(a.SelfPubkey) && relaynum == 0 {
+			oobC <- string(data)
+		}
+		return 0
+	}
+
+	na, _ := a.NewConnectionTo(b.SelfPubkey, 1)
+	if !waitTstCond(5*time.Second, func() bool {
+		if a.SendDataToFriend(na, []byte("oob")) != nil {
+			return false
+		}
+		select {
+		case data := <-oobC:
+			return data == "oob"
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}) {
+		t.Fatal("oob fallback not received")
+	}
+	if a.OnlineRelays(na) != 0 {
+		t.Error("one way route online")
+	}
+}
@@ -0,0 +1,70 @@
+package mintox
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// conns of one source ip, handshaking and confirmed, ipmu
+func (this *TCPServer) ipConnDelta(ip string, delta int) {
+	now := this.clock.Now()
+	this.ipmu.Lock()
+	defer this.ipmu.Unlock()
+	st := this.ipStateLocked(ip, now)
+	if st.conns += delta; st.conns < 0 {
+		st.conns = 0
+	}
+}
+
+func (this *TCPServer) IPConns(ip string) int {
+	this.ipmu.Lock()
+	defer this.ipmu.Unlock()
+	if st, ok := this.ips[ip]; ok {
+		return st.conns
+	}
+	return 0
+}
+
+// like the incoming_connection_queue of c-toxcore, over max_conns the least
+// recently active unconfirmed conn is evicted for the new one, rejected if all
+// confirmed. Strict over accept loops, see admitmu.
+func (this *TCPServer) admitConnLimit(c net.Conn) bool {
+	if limit := this.config().MaxConnsPerIP; limit > 0 {
+		ip := tcpRemoteIP(c)
+		if n := this.IPConns(ip); n >= limit {
+			atomic.AddInt64(&this.cnts.ConnLimited, 1)
+			this.logr().Warn("Conns of ip over limit, reject", "conns", n, "addr", c.RemoteAddr())
+			return false
+		}
+	}
+	if this.config().MaxConns <= 0 || this.ConnCount() < this.config().MaxConns {
+		return true
+	}
+	lru := this.lruUnconfirmed()
+	if lru == nil {
+		atomic.AddInt64(&this.cnts.ConnLimited, 1)
+		this.logr().Warn("Conns over limit, reject", "max", this.config().MaxConns, "addr", c.RemoteAddr())
+		return false
+	}
+	atomic.AddInt64(&this.cnts.HandshakeEvicted, 1)
+	this.logr().Info("Conns over limit, evict unconfirmed", "addr", lru.Sock.RemoteAddr(), "for", c.RemoteAddr())
+	this.dropHandshake(lru, TCP_CLOSE_EVICTED)
+	return true
+}
+
+func (this *TCPServer) lruUnconfirmed() (lru *TCPSecureConn) {
+	var lruAt time.Time
+	this.hsconnmu.RLock()
+	defer this.hsconnmu.RUnlock()
+	for _, c := range this.HSConns {
+		at := c.LastRecvAt()
+		if at.IsZero() {
+			at = c.createdAt
+		}
+		if lru == nil || at.Before(lruAt) {
+			lru, lruAt = c, at
+		}
+	}
+	return
+}
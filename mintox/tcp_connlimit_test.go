@@ -0,0 +1,98 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMaxConnsEvictLRU(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.MaxConns = 2
+	srvo, addr := newTstListenServer(t, cfg, defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	dial := func(want int) net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == want }) {
+			t.Fatal("conn count:", srvo.ConnCount(), want)
+		}
+		return c
+	}
+	closed := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := c.Read(make([]byte, 1))
+		nerr, ok := err.(net.Error)
+		return err != nil && !(ok && nerr.Timeout())
+	}
+
+	a := dial(1)
+	defer a.Close()
+	b := dial(2)
+	defer b.Close()
+	a.Write([]byte{1}) // partial handshake, a is more recent now
+	time.Sleep(50 * time.Millisecond)
+	c := dial(2)
+	defer c.Close()
+	if !closed(b) {
+		t.Error("least recently active not evicted")
+	}
+	if n := srvo.Counters().HandshakeEvicted; n != 1 {
+		t.Error("evicted:", n)
+	}
+	a.Close()
+	c.Close()
+	waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 0 })
+
+	// confirmed conns never evicted
+	for i := 0; i < 2; i++ {
+		pk, sk, _ := NewCBKeyPair()
+		cli := NewTCPClient(addr, srvo.Pubkey, pk, sk)
+		defer cli.Close()
+		if !waitTstCond(3*time.Second, func() bool { return cli.Status == TCP_CLIENT_CONFIRMED }) {
+			t.Fatal("client not confirmed")
+		}
+	}
+	if !tstDialRejected(t, addr) {
+		t.Error("admitted over max_conns")
+	}
+	if n := srvo.Counters().ConnLimited; n != 1 {
+		t.Error("limited:", n)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.MaxConnsPerIP = 1
+	srvo, addr := newTstListenServer(t, cfg, defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return srvo.IPConns("127.0.0.1") == 1 }) {
+		t.Fatal("ip conns:", srvo.IPConns("127.0.0.1"))
+	}
+	if !tstDialRejected(t, addr) {
+		t.Error("admitted over max_conns_per_ip")
+	}
+	c.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.IPConns("127.0.0.1") == 0 }) {
+		t.Fatal("ip conns not released:", srvo.IPConns("127.0.0.1"))
+	}
+	pk, sk, _ := NewCBKeyPair()
+	cli := NewTCPClient(addr, srvo.Pubkey, pk, sk)
+	defer cli.Close()
+	if !waitTstCond(3*time.Second, func() bool { return cli.Status == TCP_CLIENT_CONFIRMED }) {
+		t.Error("rejected after released")
+	}
+}
@@ -0,0 +1,125 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Relay conns after handshake carry frames: uint16 big endian length, then
+// that many bytes of encrypted packet. Frames returned here include the
+// header, like Unpacket wants them.
+const TCP_FRAME_HEADER_SIZE = 2
+
+var ErrFrameLength = errors.New("Invalid packet length")
+
+// an encrypted packet is at least a mac and at most MAX_PACKET_SIZE
+func checkFrameLen(pktlen int) error {
+	if pktlen < MAC_SIZE || pktlen > MAX_PACKET_SIZE {
+		return errors.Wrapf(ErrFrameLength, "%d, want %d-%d", pktlen, MAC_SIZE, MAX_PACKET_SIZE)
+	}
+	return nil
+}
+
+func putFrameHeader(frame []byte, pktlen int) {
+	binary.BigEndian.PutUint16(frame, uint16(pktlen))
+}
+
+// ReadFrame reads a whole frame from a stream, blocks till done.
+// dst reused if big enough. A frame cut by EOF is io.ErrUnexpectedEOF.
+func ReadFrame(r io.Reader, dst []byte) ([]byte, error) {
+	frame := growBytes(dst[:0], TCP_FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	pktlen := int(binary.BigEndian.Uint16(frame))
+	if err := checkFrameLen(pktlen); err != nil {
+		return nil, err
+	}
+	frame = growBytes(frame, pktlen)
+	if _, err := io.ReadFull(r, frame[TCP_FRAME_HEADER_SIZE:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// WriteFrame writes header and pkt with one Write, pkt is the encrypted packet
+func WriteFrame(w io.Writer, pkt []byte) (int, error) {
+	if err := checkFrameLen(len(pkt)); err != nil {
+		return 0, err
+	}
+	frame := make([]byte, TCP_FRAME_HEADER_SIZE, TCP_FRAME_HEADER_SIZE+len(pkt))
+	putFrameHeader(frame, len(pkt))
+	return w.Write(append(frame, pkt...))
+}
+
+// buffered data of a conn, like its read ring buffer
+type FrameBuffer interface {
+	io.Reader
+	Len() int64
+}
+
+// FrameReader cuts frames out of a FrameBuffer filled by partial reads,
+// never blocks. A header read before the whole frame is buffered is kept,
+// so call again after more data buffered.
+type FrameReader struct {
+	pktlen uint16
+	hdr    bool // pktlen read
+}
+
+// length of the frame whose header already read, 0 if none
+func (this *FrameReader) Pending() int {
+	if !this.hdr {
+		return 0
+	}
+	return int(this.pktlen)
+}
+
+func (this *FrameReader) HasHeader() bool { return this.hdr }
+
+// forget the header, for a length value that was a mark, not a frame
+func (this *FrameReader) Reset() { this.pktlen, this.hdr = 0, false }
+
+// ReadHeader reads the frame length if not yet, not checked, so special
+// values like TCP_REHANDSHAKE_MARK can be caught before ReadFrame.
+// ok false if the header not buffered yet.
+func (this *FrameReader) ReadHeader(rb FrameBuffer) (pktlen uint16, ok bool, err error) {
+	if this.hdr {
+		return this.pktlen, true, nil
+	}
+	if rb.Len() < TCP_FRAME_HEADER_SIZE {
+		return 0, false, nil
+	}
+	var hdrbuf [TCP_FRAME_HEADER_SIZE]byte
+	if _, err := io.ReadFull(rb, hdrbuf[:]); err != nil {
+		return 0, false, err
+	}
+	this.pktlen, this.hdr = binary.BigEndian.Uint16(hdrbuf[:]), true
+	return this.pktlen, true, nil
+}
+
+// ReadFrame returns the next whole frame in dst (reused if big enough),
+// nil without error if not all buffered yet.
+func (this *FrameReader) ReadFrame(rb FrameBuffer, dst []byte) ([]byte, error) {
+	pktlen, ok, err := this.ReadHeader(rb)
+	if !ok || err != nil {
+		return nil, err
+	}
+	if err := checkFrameLen(int(pktlen)); err != nil {
+		return nil, err
+	}
+	if rb.Len() < int64(pktlen) {
+		return nil, nil
+	}
+	frame := growBytes(dst[:0], TCP_FRAME_HEADER_SIZE+int(pktlen))
+	putFrameHeader(frame, int(pktlen))
+	if _, err := io.ReadFull(rb, frame[TCP_FRAME_HEADER_SIZE:]); err != nil {
+		return nil, err
+	}
+	this.Reset()
+	return frame, nil
+}
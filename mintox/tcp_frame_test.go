@@ -0,0 +1,126 @@
+package mintox
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/djherbis/buffer"
+	"github.com/pkg/errors"
+)
+
+func tstFrame(pktlen int, fill byte) []byte {
+	frame := make([]byte, TCP_FRAME_HEADER_SIZE+pktlen)
+	putFrameHeader(frame, pktlen)
+	for i := TCP_FRAME_HEADER_SIZE; i < len(frame); i++ {
+		frame[i] = fill
+	}
+	return frame
+}
+
+func TestReadWriteFrameStream(t *testing.T) {
+	var stream bytes.Buffer
+	pkts := [][]byte{bytes.Repeat([]byte{1}, MAC_SIZE), bytes.Repeat([]byte{2}, 100), bytes.Repeat([]byte{3}, MAX_PACKET_SIZE)}
+	for _, pkt := range pkts {
+		if wn, err := WriteFrame(&stream, pkt); err != nil || wn != TCP_FRAME_HEADER_SIZE+len(pkt) {
+			t.Fatal("write frame:", wn, err)
+		}
+	}
+	// one byte per read, every read short
+	r := iotest.OneByteReader(&stream)
+	buf := make([]byte, 0, 64)
+	for _, pkt := range pkts {
+		frame, err := ReadFrame(r, buf)
+		if err != nil || !bytes.Equal(frame[TCP_FRAME_HEADER_SIZE:], pkt) || int(frame[0])<<8|int(frame[1]) != len(pkt) {
+			t.Fatal("read frame:", len(frame), err)
+		}
+	}
+	if _, err := ReadFrame(r, buf); err != io.EOF {
+		t.Error("end of stream:", err)
+	}
+
+	for _, pktlen := range []int{0, MAC_SIZE - 1, MAX_PACKET_SIZE + 1} {
+		if _, err := WriteFrame(&stream, make([]byte, pktlen)); errors.Cause(err) != ErrFrameLength {
+			t.Error("written frame of length:", pktlen, err)
+		}
+		stream.Reset()
+		stream.Write(tstFrame(pktlen, 0))
+		if _, err := ReadFrame(&stream, nil); errors.Cause(err) != ErrFrameLength {
+			t.Error("read frame of length:", pktlen, err)
+		}
+	}
+	for _, cut := range []int{1, TCP_FRAME_HEADER_SIZE + 5} {
+		stream.Reset()
+		stream.Write(tstFrame(50, 0)[:cut])
+		if _, err := ReadFrame(&stream, nil); err != io.ErrUnexpectedEOF {
+			t.Error("cut frame:", cut, err)
+		}
+	}
+}
+
+func TestFrameReaderSplit(t *testing.T) {
+	frames := [][]byte{tstFrame(MAC_SIZE, 1), tstFrame(300, 2), tstFrame(MAX_PACKET_SIZE, 3), tstFrame(17, 4)}
+	var stream []byte
+	for _, frame := range frames {
+		stream = append(stream, frame...)
+	}
+	// every split size, frames and headers cut everywhere
+	for step := 1; step <= len(frames[1])+1; step += 7 {
+		rb := buffer.NewRing(buffer.New(4096))
+		var fr FrameReader
+		var got [][]byte
+		for off := 0; off < len(stream); off += step {
+			end := off + step
+			if end > len(stream) {
+				end = len(stream)
+			}
+			rb.Write(stream[off:end])
+			for {
+				frame, err := fr.ReadFrame(rb, nil)
+				if err != nil {
+					t.Fatal(step, err)
+				}
+				if frame == nil {
+					break
+				}
+				got = append(got, frame)
+			}
+		}
+		if len(got) != len(frames) || fr.HasHeader() || rb.Len() != 0 {
+			t.Fatal("frames of step:", step, len(got), fr.Pending(), rb.Len())
+		}
+		for i := range frames {
+			if !bytes.Equal(got[i], frames[i]) {
+				t.Fatal("frame:", step, i)
+			}
+		}
+	}
+}
+
+func TestFrameReaderHeader(t *testing.T) {
+	rb := buffer.NewRing(buffer.New(4096))
+	var fr FrameReader
+	rb.Write([]byte{0xFF})
+	if _, ok, err := fr.ReadHeader(rb); ok || err != nil {
+		t.Fatal("half header read:", ok, err)
+	}
+	// a mark caught before ReadFrame, then a frame follows
+	rb.Write([]byte{0xFF})
+	if pktlen, ok, _ := fr.ReadHeader(rb); !ok || pktlen != TCP_REHANDSHAKE_MARK || fr.Pending() != TCP_REHANDSHAKE_MARK {
+		t.Fatal("mark:", pktlen, ok)
+	}
+	if _, err := fr.ReadFrame(rb, nil); errors.Cause(err) != ErrFrameLength {
+		t.Error("mark as frame:", err)
+	}
+	fr.Reset()
+	rb.Write(tstFrame(20, 9)[:10])
+	if frame, err := fr.ReadFrame(rb, nil); frame != nil || err != nil || fr.Pending() != 20 {
+		t.Fatal("partial frame:", frame, err, fr.Pending())
+	}
+	rb.Write(tstFrame(20, 9)[10:])
+	dst := make([]byte, 0, 64)
+	if frame, err := fr.ReadFrame(rb, dst); err != nil || !bytes.Equal(frame, tstFrame(20, 9)) || &frame[0] != &dst[:1][0] {
+		t.Error("frame not read into dst:", err)
+	}
+}
@@ -0,0 +1,98 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// handle a decrypted packet of a confirmed conn, plnpkt[0] is the packet type
+type TCPPacketHandler func(conn *TCPSecureConn, plnpkt []byte)
+
+// built-in handling of reserved packet types, types not here are ignored unless registered
+var tcpDefaultHandlers = map[byte]TCPPacketHandler{
+	TCP_PACKET_PING:                    (*TCPSecureConn).handlePing,
+	TCP_PACKET_PONG:                    (*TCPSecureConn).handlePong,
+	TCP_PACKET_ROUTING_REQUEST:         (*TCPSecureConn).handleRoutingRequest,
+	TCP_PACKET_CONNECTION_NOTIFICATION: (*TCPSecureConn).handleConnectNotification,
+	TCP_PACKET_DISCONNECT_NOTIFICATION: (*TCPSecureConn).HandleDisconnectNotification,
+	TCP_PACKET_CAPABILITY:              (*TCPSecureConn).HandleCapability,
+	TCP_PACKET_OOB_SEND:                (*TCPSecureConn).handleOOBSend,
+	TCP_PACKET_ONION_REQUEST:           (*TCPSecureConn).handleOnionRequest,
+}
+
+// Register fn for reserved packet type ptype, replace the old one.
+// For types have built-in handling, fn is called after it as an observer,
+// other types (like experimental ones in 10-15) are handled by fn only.
+// Types >= NUM_RESERVED_PORTS are routed data, can not be registered.
+// plnpkt is valid only during the call, copy it to keep.
+func (this *TCPServer) RegisterHandler(ptype byte, fn func(conn *TCPSecureConn, plnpkt []byte)) error {
+	if ptype >= NUM_RESERVED_PORTS {
+		return errors.Errorf("Not reserved packet type: %d", ptype)
+	}
+	this.handlermu.Lock()
+	defer this.handlermu.Unlock()
+	if this.handlers == nil {
+		this.handlers = map[byte]TCPPacketHandler{}
+	}
+	if fn == nil {
+		delete(this.handlers, ptype)
+	} else {
+		this.handlers[ptype] = fn
+	}
+	return nil
+}
+
+func (this *TCPServer) handler(ptype byte) TCPPacketHandler {
+	this.handlermu.RLock()
+	defer this.handlermu.RUnlock()
+	return this.handlers[ptype]
+}
+
+func (this *TCPSecureConn) dispatchPacket(plnpkt []byte) (err error) {
+	ptype := plnpkt[0]
+	// a buggy handler fails only this conn, not the relay
+	defer func() {
+		if x := recover(); x != nil {
+			err = errors.Errorf("Handle packet %s panic: %v", tcppktname(ptype), x)
+		}
+	}()
+	if _, err := ParseTCPPacket(plnpkt); err != nil {
+		this.logr().Warn("Drop packet", "err", err, "addr", this.Sock.RemoteAddr())
+		return nil
+	}
+	if ptype >= NUM_RESERVED_PORTS {
+		this.HandleRoutingData(plnpkt)
+		return nil
+	}
+	if fn, ok := tcpDefaultHandlers[ptype]; ok {
+		fn(this, plnpkt)
+	}
+	if this.srvo != nil {
+		if fn := this.srvo.handler(ptype); fn != nil {
+			fn(this, plnpkt)
+		}
+	}
+	return nil
+}
+
+func (this *TCPSecureConn) handlePing(plnpkt []byte) {
+	this.HandlePingRequest(plnpkt)
+	this.logr().Debug("Pong sent", "addr", this.Sock.RemoteAddr())
+}
+
+// only the pong of our last ping clears it, see doPingLoop
+func (this *TCPSecureConn) handlePong(plnpkt []byte) {
+	if len(plnpkt) != 1+8 {
+		this.logr().Warn("Invalid pong length", "len", len(plnpkt), "addr", this.Sock.RemoteAddr())
+		return
+	}
+	pongid := binary.BigEndian.Uint64(plnpkt[1:])
+	if pongid == 0 || !atomic.CompareAndSwapUint64(&this.Pingid, pongid, 0) {
+		this.logr().Debug("Unknown pong", "pongid", pongid, "addr", this.Sock.RemoteAddr())
+		return
+	}
+	sentAt := unixnanoTime(atomic.LoadInt64(&this.pingSentAt))
+	this.rtt.add(this.clock.Now().Sub(sentAt))
+}
@@ -0,0 +1,38 @@
+package mintox
+
+import "testing"
+
+func TestRegisterHandler(t *testing.T) {
+	srvo := newTstServer()
+	c := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+
+	var got []byte
+	observed := 0
+	if err := srvo.RegisterHandler(11, func(conn *TCPSecureConn, plnpkt []byte) { got = plnpkt }); err != nil {
+		t.Fatal(err)
+	}
+	srvo.RegisterHandler(TCP_PACKET_PING, func(conn *TCPSecureConn, plnpkt []byte) { observed++ })
+	if err := srvo.RegisterHandler(NUM_RESERVED_PORTS, func(*TCPSecureConn, []byte) {}); err == nil {
+		t.Error("registered routed data type")
+	}
+
+	c.dispatchPacket([]byte{11, 1, 2})
+	if len(got) != 3 || got[0] != 11 {
+		t.Error("custom type not handled:", got)
+	}
+
+	c.dispatchPacket([]byte{TCP_PACKET_PING, 0, 0, 0, 0, 0, 0, 0, 1})
+	if observed != 1 {
+		t.Error("ping not observed:", observed)
+	}
+	if len(c.cwctrlq) != 1 || (<-c.cwctrlq)[0] != TCP_PACKET_PONG {
+		t.Error("built-in ping handling replaced")
+	}
+
+	srvo.RegisterHandler(11, nil)
+	got = nil
+	c.dispatchPacket([]byte{11})
+	if got != nil {
+		t.Error("unregistered handler called")
+	}
+}
@@ -0,0 +1,108 @@
+package mintox
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* Client temp nonces and keys of handshakes remembered for replay detection */
+const TCP_HANDSHAKE_REPLAY_WINDOW = 60 // seconds
+const TCP_HANDSHAKE_REPLAY_MAX = 8192
+
+// handshake failures, wrapped with details, test by errors.Cause.
+// Any of them closes the conn.
+var (
+	ErrHandshakeLength  = errors.New("Invalid handshake length")
+	ErrHandshakeDecrypt = errors.New("Decrypt handshake failed")
+	ErrHandshakeKey     = errors.New("Invalid handshake key")
+	ErrHandshakeReplay  = errors.New("Handshake replayed")
+	ErrHandshakeVersion = errors.New("Unknown handshake version")
+)
+
+func IsHandshakeError(err error) bool {
+	switch errors.Cause(err) {
+	case ErrHandshakeLength, ErrHandshakeDecrypt, ErrHandshakeKey, ErrHandshakeReplay, ErrHandshakeVersion:
+		return true
+	}
+	return false
+}
+
+// recently seen client temp nonces and keys of the server, bounded.
+// A legit client never reuses them, the same one again is a captured packet.
+type tcpReplayCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	window time.Duration
+	max    int
+}
+
+func newTCPReplayCache(window time.Duration, max int) *tcpReplayCache {
+	return &tcpReplayCache{seen: map[string]time.Time{}, window: window, max: max}
+}
+
+// check and remember all keys, true if any seen in window
+func (this *tcpReplayCache) check(now time.Time, keys ...[]byte) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, key := range keys {
+		if at, ok := this.seen[string(key)]; ok && now.Sub(at) < this.window {
+			return true
+		}
+	}
+	if len(this.seen)+len(keys) > this.max {
+		this.pruneLocked(now)
+	}
+	for _, key := range keys {
+		this.seen[string(key)] = now
+	}
+	return false
+}
+
+// drop expired, then random ones till room for new
+func (this *tcpReplayCache) pruneLocked(now time.Time) {
+	for key, at := range this.seen {
+		if now.Sub(at) >= this.window {
+			delete(this.seen, key)
+		}
+	}
+	for key := range this.seen {
+		if len(this.seen) < this.max/2 {
+			break
+		}
+		delete(this.seen, key)
+	}
+}
+
+func (this *tcpReplayCache) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.seen)
+}
+
+var zeroCryptoKey = make([]byte, PUBLIC_KEY_SIZE)
+
+// handshake keys sanity, before any crypto done with them
+func (this *TCPSecureConn) checkHandshakeKeys(cliPubkey, tmpPubkey []byte) error {
+	switch {
+	case bytes.Equal(cliPubkey, zeroCryptoKey):
+		return errors.Wrap(ErrHandshakeKey, "zero client pubkey")
+	case bytes.Equal(tmpPubkey, zeroCryptoKey):
+		return errors.Wrap(ErrHandshakeKey, "zero temp pubkey")
+	case bytes.Equal(tmpPubkey, cliPubkey):
+		return errors.Wrap(ErrHandshakeKey, "temp pubkey is the long term one")
+	case this.srvPubkey != nil && bytes.Equal(cliPubkey, this.srvPubkey.Bytes()):
+		return errors.Wrap(ErrHandshakeKey, "client pubkey is the server's")
+	}
+	return nil
+}
+
+// true for replayed handshake, no cache for conns without server
+func (this *TCPSecureConn) handshakeReplayed(tmpNonce, tmpPubkey []byte) bool {
+	if this.srvo == nil || this.srvo.hsreplay == nil {
+		return false
+	}
+	return this.srvo.hsreplay.check(this.clock.Now(), tmpNonce, tmpPubkey)
+}
@@ -0,0 +1,91 @@
+package mintox
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestHandshakeReplayRejected(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	errC := make(chan error, 4)
+	srvo.OnConnError = func(c *TCPSecureConn, err error) { errC <- err }
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(3 * time.Second))
+		return c
+	}
+	expectErr := func(c net.Conn, want error) {
+		defer c.Close()
+		select {
+		case err := <-errC:
+			if errors.Cause(err) != want || !IsHandshakeError(err) {
+				t.Error("unexpected error:", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no error for:", want)
+		}
+		if _, err := ioutil.ReadAll(c); err != nil {
+			t.Error("conn not closed:", want, err)
+		}
+	}
+
+	c := dial()
+	defer c.Close()
+	peer := newTstPeer(t, c, srvo.Pubkey)
+	hspkt, err := peer.GenerateHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write(hspkt)
+	if _, err := io.ReadFull(c, make([]byte, TCP_SERVER_HANDSHAKE_SIZE)); err != nil {
+		t.Fatal("first handshake not answered:", err)
+	}
+	c = dial()
+	c.Write(hspkt)
+	expectErr(c, ErrHandshakeReplay)
+	if n := srvo.Counters().HandshakeReplays; n != 1 {
+		t.Error("replays:", n)
+	}
+
+	// temp key must not be the long term one
+	pk, sk, _ := NewCBKeyPair()
+	shrkey, _ := CBBeforeNm(srvo.Pubkey, sk)
+	nonce := CBRandomNonce()
+	encpkt, _ := EncryptDataSymmetric(shrkey, nonce, append(pk.Bytes(), CBRandomNonce().Bytes()...))
+	c = dial()
+	c.Write(append(append(pk.Bytes(), nonce.Bytes()...), encpkt...))
+	expectErr(c, ErrHandshakeKey)
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	rc := newTCPReplayCache(time.Minute, 4)
+	if rc.check(now, []byte("n1"), []byte("k1")) {
+		t.Error("fresh seen as replay")
+	}
+	if !rc.check(now, []byte("n2"), []byte("k1")) {
+		t.Error("same key not replay")
+	}
+	if rc.check(now.Add(time.Minute), []byte("n1"), []byte("k3")) {
+		t.Error("replay after window")
+	}
+	for i := 0; i < 10; i++ {
+		rc.check(now, []byte{byte(i)})
+	}
+	if rc.Len() > 4 {
+		t.Error("not bounded:", rc.Len())
+	}
+}
@@ -0,0 +1,49 @@
+package mintox
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+/* like TCP_CONNECTION_TIMEOUT of c-toxcore, seconds for a new conn to be confirmed */
+const TCP_HANDSHAKE_TIMEOUT = 10
+
+// evict conns stuck in handshake, peers connect and send nothing or stop
+// after the handshake would hold HSConns and MaxHandshakes slots forever.
+func (this *TCPServer) runHandshakeGC() {
+	tickC, tickStop := this.clock.Tick(time.Second)
+	defer tickStop()
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case <-tickC:
+		}
+		this.evictHandshakes(this.clock.Now())
+	}
+}
+
+func (this *TCPServer) evictHandshakes(now time.Time) int {
+	timeout := time.Duration(this.config().HandshakeTimeout) * time.Second
+	var stales []*TCPSecureConn
+	this.hsconnmu.RLock()
+	for _, c := range this.HSConns {
+		if now.Sub(c.hsStartAt) > timeout {
+			stales = append(stales, c)
+		}
+	}
+	this.hsconnmu.RUnlock()
+
+	for _, c := range stales {
+		log.Println("Handshake timeout:", tcpstname(c.status()), c.Sock.RemoteAddr())
+		atomic.AddInt64(&this.cnts.HandshakeTimeouts, 1)
+		this.dropHandshake(c, TCP_CLOSE_HS_TIMEOUT)
+	}
+	return len(stales)
+}
+
+// hsconnmu must not be held, OnClosed removes c from HSConns
+func (this *TCPServer) dropHandshake(c *TCPSecureConn, reason string) {
+	c.doClose(true, reason)
+}
@@ -0,0 +1,111 @@
+package mintox
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	clk := newFakeTstClock()
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), clk)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	hsCount := func() int {
+		srvo.hsconnmu.RLock()
+		defer srvo.hsconnmu.RUnlock()
+		return len(srvo.HSConns)
+	}
+	confirmedCount := func() int {
+		srvo.connmu.RLock()
+		defer srvo.connmu.RUnlock()
+		return len(srvo.Conns)
+	}
+
+	// silent one, and one stopped after handshake
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	half, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer half.Close()
+	hspkt, _ := newTstPeer(t, half, srvo.Pubkey).GenerateHandshake()
+	half.Write(hspkt)
+	if !waitTstCond(3*time.Second, func() bool { return hsCount() == 2 }) {
+		t.Fatal("handshakes not tracked:", hsCount())
+	}
+
+	clk.Advance(TCP_HANDSHAKE_TIMEOUT * time.Second / 2)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	peer := newTstPeer(t, c, srvo.Pubkey)
+	peer.handshake()
+	if !waitTstCond(3*time.Second, func() bool { return confirmedCount() == 1 }) {
+		t.Fatal("conn not confirmed")
+	}
+
+	clk.Advance(TCP_HANDSHAKE_TIMEOUT*time.Second/2 + time.Second)
+	if !waitTstCond(3*time.Second, func() bool { return hsCount() == 0 }) {
+		t.Fatal("stale handshakes not evicted:", hsCount())
+	}
+	for _, sc := range []net.Conn{silent, half} {
+		sc.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := ioutil.ReadAll(sc); err != nil {
+			t.Error("stale conn not closed:", err)
+		}
+	}
+	if cnts := srvo.Counters(); cnts.HandshakeTimeouts != 2 || cnts.HandshakeFailed != 2 {
+		t.Error("handshake counters:", cnts.HandshakeTimeouts, cnts.HandshakeFailed)
+	}
+	peer.ping()
+	peer.readUntil(TCP_PACKET_PONG)
+	if confirmedCount() != 1 {
+		t.Error("confirmed conn evicted")
+	}
+}
+
+// like c-toxcore, a new conn from the same pubkey kills the old one
+func TestDuplicatePubkeyReplaced(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	var peers []*tstPeer
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		peer := newTstPeer(t, c, srvo.Pubkey)
+		if i > 0 {
+			peer.SetKeyPair(peers[0].SelfPubkey, peers[0].SelfSeckey)
+		}
+		peer.handshake()
+		peers = append(peers, peer)
+	}
+	peers[0].conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := ioutil.ReadAll(peers[0].conn); err != nil {
+		t.Error("old conn not closed:", err)
+	}
+	srvo.connmu.RLock()
+	c := srvo.Conns[peers[0].SelfPubkey.BinStr()]
+	n := len(srvo.Conns)
+	srvo.connmu.RUnlock()
+	if n != 1 || c == nil || c.isClosed() {
+		t.Fatal("new conn not kept:", n)
+	}
+	peers[1].ping()
+	peers[1].readUntil(TCP_PACKET_PONG)
+}
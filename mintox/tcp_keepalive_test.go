@@ -0,0 +1,128 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// manual clock, tickers fire only in Advance
+type fakeTstClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTstTicker
+}
+
+type fakeTstTicker struct {
+	d    time.Duration
+	next time.Time
+	c    chan time.Time
+	stop bool
+}
+
+func newFakeTstClock() *fakeTstClock {
+	return &fakeTstClock{now: time.Unix(1500000000, 0)}
+}
+
+func (this *fakeTstClock) Now() time.Time {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.now
+}
+
+func (this *fakeTstClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	tk := &fakeTstTicker{d: d, next: this.now.Add(d), c: make(chan time.Time, 1)}
+	this.tickers = append(this.tickers, tk)
+	return tk.c, func() {
+		this.mu.Lock()
+		tk.stop = true
+		this.mu.Unlock()
+	}
+}
+
+func (this *fakeTstClock) Advance(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.now = this.now.Add(d)
+	for _, tk := range this.tickers {
+		for !tk.stop && !tk.next.After(this.now) {
+			select {
+			case tk.c <- this.now:
+			default:
+			}
+			tk.next = tk.next.Add(tk.d)
+		}
+	}
+}
+
+func (this *fakeTstClock) tickerCount() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.tickers)
+}
+
+func TestPingKeepaliveTimeout(t *testing.T) {
+	clk := newFakeTstClock()
+	c0, c1 := net.Pipe()
+	secon, srvpk := newTstSecureConn(c0)
+	secon.clock = clk
+	closed := make(chan bool, 1)
+	secon.OnClosed = func(Object) { closed <- true }
+	secon.Start()
+	defer secon.Close()
+
+	peer := newTstPeer(t, c1, srvpk)
+	peer.handshake()
+	if !waitTstCond(3*time.Second, func() bool { return clk.tickerCount() == 1 }) {
+		t.Fatal("ping loop not started")
+	}
+	pingidOf := func() uint64 { return atomic.LoadUint64(&secon.Pingid) }
+
+	// ping sent after TCP_PING_FREQUENCY
+	clk.Advance(TCP_PING_FREQUENCY * time.Second)
+	plnpkt := peer.readPlain()
+	if plnpkt[0] != TCP_PACKET_PING || len(plnpkt) != 9 {
+		t.Fatal("ping not sent:", plnpkt)
+	}
+	pingid := binary.BigEndian.Uint64(plnpkt[1:])
+	if pingid == 0 || pingidOf() != pingid {
+		t.Fatal("ping id not kept:", pingid, pingidOf())
+	}
+
+	// unmatched pong is ignored, matched one clears the ping
+	peer.writePlain(append([]byte{TCP_PACKET_PONG}, make([]byte, 8)...))
+	peer.writePlain(append([]byte{TCP_PACKET_PONG}, plnpkt[1:]...))
+	if !waitTstCond(3*time.Second, func() bool { return pingidOf() == 0 }) {
+		t.Fatal("pong not matched:", pingid)
+	}
+	go io.Copy(ioutil.Discard, c1)
+
+	// next ping, not answered
+	sent := secon.SentBytes()
+	clk.Advance(TCP_PING_FREQUENCY * time.Second)
+	if !waitTstCond(3*time.Second, func() bool { return secon.SentBytes() > sent && pingidOf() != 0 }) {
+		t.Fatal("ping not sent again")
+	}
+	clk.Advance(TCP_PING_TIMEOUT * time.Second)
+	select {
+	case <-closed:
+		t.Fatal("closed before ping timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Advance(time.Second)
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("conn not closed after ping timeout")
+	}
+	if !secon.ClosedLocally() || secon.CloseReason() != TCP_CLOSE_PING_TIMEOUT {
+		t.Error("close reason:", secon.ClosedLocally(), secon.CloseReason())
+	}
+}
@@ -0,0 +1,115 @@
+package mintox
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Rotation of the relay identity. New handshakes use the new key at once,
+// conns accepted before keep the old one, re-handshakes too, till they close
+// or the drain timeout closes them. Clients learn the new pubkey out of band,
+// like from a node list.
+
+// Keys returns the current identity, Pubkey and Seckey fields change by
+// RotateKey, use this while the server runs.
+func (this *TCPServer) Keys() (pubkey, seckey *CryptoKey) {
+	this.keymu.RLock()
+	defer this.keymu.RUnlock()
+	return this.Pubkey, this.Seckey
+}
+
+// RotateKey accepts new handshakes only on seckey from now. OnKeyRotated
+// called when no conn left on the old key, those still on it after drain
+// are closed, 0 drain waits them for ever.
+func (this *TCPServer) RotateKey(seckey *CryptoKey, drain time.Duration) error {
+	if seckey == nil || seckey.Len() != SECRET_KEY_SIZE {
+		return errors.New("Invalid secret key")
+	}
+	if drain < 0 {
+		return errors.Errorf("Invalid drain: %v", drain)
+	}
+	pubkey := CBDerivePubkey(seckey)
+	this.keymu.Lock()
+	oldpk, oldsk := this.Pubkey, this.Seckey
+	if oldsk.Equal2(seckey) {
+		this.keymu.Unlock()
+		return errors.New("Same secret key")
+	}
+	this.Pubkey, this.Seckey = pubkey, seckey
+	this.keymu.Unlock()
+
+	// kept by Reload
+	cfg := *this.config()
+	cfg.Seckey = seckey
+	this.cfgv.Store(&cfg)
+
+	this.logr().Info("Key rotated", "old", oldpk, "new", pubkey, "drain", drain)
+	go this.runKeyDrain(oldpk, oldsk, pubkey, drain)
+	return nil
+}
+
+// RotateKeyFile rotates to the key of a tox-bootstrapd keys file
+func (this *TCPServer) RotateKeyFile(filename string, drain time.Duration) error {
+	kf, err := ReadKeyFile(filename)
+	if err != nil {
+		return err
+	}
+	return this.RotateKey(kf.Seckey, drain)
+}
+
+// handshaking and confirmed conns accepted with seckey
+func (this *TCPServer) connsOfKey(seckey *CryptoKey) (conns []*TCPSecureConn) {
+	for _, c := range this.snapshotConns() {
+		if !c.isClosed() && c.Seckey.Equal2(seckey) {
+			conns = append(conns, c)
+		}
+	}
+	return
+}
+
+// closed when a conn closes after this call
+func (this *TCPServer) connClosedC() <-chan struct{} {
+	this.closedmu.Lock()
+	defer this.closedmu.Unlock()
+	return this.closedC
+}
+
+func (this *TCPServer) signalConnClosed() {
+	this.closedmu.Lock()
+	defer this.closedmu.Unlock()
+	close(this.closedC)
+	this.closedC = make(chan struct{})
+}
+
+// checks conns left on the old key each tick and when one closes
+func (this *TCPServer) runKeyDrain(oldpk, oldsk, newpk *CryptoKey, drain time.Duration) {
+	tickC, tickStop := this.clock.Tick(time.Second)
+	defer tickStop()
+	btime := this.clock.Now()
+	closed := 0
+	for {
+		closedC := this.connClosedC()
+		conns := this.connsOfKey(oldsk)
+		if len(conns) == 0 {
+			break
+		}
+		if drain > 0 && this.clock.Now().Sub(btime) >= drain {
+			for _, c := range conns {
+				c.doClose(true, TCP_CLOSE_KEY_ROTATED)
+			}
+			closed = len(conns)
+			break
+		}
+		select {
+		case <-this.stopC:
+			return
+		case <-tickC:
+		case <-closedC:
+		}
+	}
+	this.logr().Info("Key rotation done", "old", oldpk, "new", newpk, "closed", closed)
+	if this.OnKeyRotated != nil {
+		this.OnKeyRotated(oldpk, newpk, closed)
+	}
+}
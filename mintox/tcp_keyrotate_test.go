@@ -0,0 +1,122 @@
+package mintox
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type tstKeyRotated struct {
+	oldpk, newpk *CryptoKey
+	closed       int
+}
+
+func TestRotateKey(t *testing.T) {
+	clk := newFakeTstClock()
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), clk)
+	defer srvo.Shutdown(context.Background())
+	rotatedC := make(chan tstKeyRotated, 4)
+	srvo.OnKeyRotated = func(oldpk, newpk *CryptoKey, closed int) { rotatedC <- tstKeyRotated{oldpk, newpk, closed} }
+
+	connect := func(srvpk *CryptoKey) *TCPClient {
+		pk, sk, _ := NewCBKeyPair()
+		return NewTCPClient(addr, srvpk, pk, sk)
+	}
+	confirmed := func(cli *TCPClient) bool {
+		return waitTstCond(3*time.Second, func() bool { _, ok := srvo.ConnStats(cli.SelfPubkey); return ok })
+	}
+	// clock advanced after the drain goroutine ticks
+	waitDrain := func(ntick int) {
+		if !waitTstCond(3*time.Second, func() bool { return clk.tickerCount() > ntick }) {
+			t.Fatal("drain not started")
+		}
+	}
+
+	pk0, sk0 := srvo.Keys()
+	a := connect(pk0)
+	defer a.Close()
+	if !confirmed(a) {
+		t.Fatal("a not confirmed")
+	}
+	if err := srvo.RotateKey(sk0, 0); err == nil {
+		t.Error("rotated to the same key")
+	}
+
+	pk1, sk1, _ := NewCBKeyPair()
+	ntick := clk.tickerCount()
+	if err := srvo.RotateKey(sk1, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitDrain(ntick)
+	if pk, _ := srvo.Keys(); !pk.Equal2(pk1) || !srvo.config().Seckey.Equal2(sk1) {
+		t.Fatal("key not rotated")
+	}
+	old := connect(pk0)
+	c := connect(pk1)
+	defer c.Close()
+	if !confirmed(c) {
+		t.Fatal("handshake on new key failed")
+	}
+	if waitTstCond(300*time.Millisecond, func() bool { return old.Status == TCP_CLIENT_CONFIRMED }) {
+		t.Error("handshake on old key accepted")
+	}
+
+	// conns of both keys still relay to each other
+	dataC := make(chan []byte, 16)
+	c.OnData = func(pk *CryptoKey, data []byte) { dataC <- data }
+	a.AddPeer(c.SelfPubkey)
+	c.AddPeer(a.SelfPubkey)
+	if !recvTstRouted(a, c, dataC) {
+		t.Fatal("routed data not received")
+	}
+
+	// drain 0 waits the old conn closed by client, advance under ping timeout
+	clk.Advance(2 * time.Second)
+	select {
+	case r := <-rotatedC:
+		t.Fatal("rotation done with old conn:", r.closed)
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.Close()
+	select {
+	case r := <-rotatedC:
+		if !r.oldpk.Equal2(pk0) || !r.newpk.Equal2(pk1) || r.closed != 0 {
+			t.Error("rotated:", r.oldpk, r.newpk, r.closed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("rotation not done")
+	}
+
+	// from a keys file, conns on the old key closed after drain
+	old.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.Stats().Handshaking == 0 }) {
+		t.Fatal("old key handshakes left")
+	}
+	kf, _ := NewKeyFile()
+	keysfile := filepath.Join(t.TempDir(), "keys")
+	if err := kf.Save(keysfile); err != nil {
+		t.Fatal(err)
+	}
+	ntick = clk.tickerCount()
+	if err := srvo.RotateKeyFile(keysfile, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitDrain(ntick)
+	clk.Advance(5 * time.Second)
+	if cc := srvo.confirmedConn(c.SelfPubkey); cc == nil {
+		t.Fatal("conn closed before drain timeout")
+	}
+	clk.Advance(5 * time.Second)
+	select {
+	case r := <-rotatedC:
+		if !r.newpk.Equal2(kf.Pubkey) || r.closed != 1 {
+			t.Error("rotated:", r.newpk, r.closed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("rotation not done after drain")
+	}
+	if !waitTstCond(3*time.Second, func() bool { _, ok := srvo.ConnStats(c.SelfPubkey); return !ok }) {
+		t.Error("old key conn not closed")
+	}
+}
@@ -0,0 +1,122 @@
+package mintox
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	LOG_LEVEL_DEBUG = 0
+	LOG_LEVEL_INFO  = 1
+	LOG_LEVEL_WARN  = 2
+	LOG_LEVEL_ERROR = 3
+	LOG_LEVEL_OFF   = 4
+)
+
+var loglevelnames = map[int]string{LOG_LEVEL_DEBUG: "DEBUG", LOG_LEVEL_INFO: "INFO",
+	LOG_LEVEL_WARN: "WARN", LOG_LEVEL_ERROR: "ERROR"}
+
+// Logger of TCPServer and its conns, fields are key value pairs like
+// Info("conn closed", "reason", reason, "addr", addr).
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// Logger by standard log package, messages under level dropped
+type StdLogger struct {
+	level int32 // atomic
+}
+
+func NewStdLogger(level int) *StdLogger { return &StdLogger{level: int32(level)} }
+
+func (this *StdLogger) SetLevel(level int) { atomic.StoreInt32(&this.level, int32(level)) }
+func (this *StdLogger) Level() int         { return int(atomic.LoadInt32(&this.level)) }
+
+func (this *StdLogger) Debug(msg string, fields ...interface{}) {
+	this.output(LOG_LEVEL_DEBUG, msg, fields)
+}
+func (this *StdLogger) Info(msg string, fields ...interface{}) {
+	this.output(LOG_LEVEL_INFO, msg, fields)
+}
+func (this *StdLogger) Warn(msg string, fields ...interface{}) {
+	this.output(LOG_LEVEL_WARN, msg, fields)
+}
+func (this *StdLogger) Error(msg string, fields ...interface{}) {
+	this.output(LOG_LEVEL_ERROR, msg, fields)
+}
+
+func (this *StdLogger) output(level int, msg string, fields []interface{}) {
+	if level < this.Level() {
+		return
+	}
+	log.Output(3, loglevelnames[level]+" "+msg+formatLogFields(fields))
+}
+
+// " k=v k2=v2", a field without value printed as is
+func formatLogFields(fields []interface{}) string {
+	var sb strings.Builder
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 < len(fields) {
+			fmt.Fprintf(&sb, " %v=%v", fields[i], fields[i+1])
+		} else {
+			fmt.Fprintf(&sb, " %v", fields[i])
+		}
+	}
+	return sb.String()
+}
+
+// default of servers and conns without SetLogger
+var defaultLogger loggerHolder
+
+func init() { defaultLogger.set(NewStdLogger(LOG_LEVEL_INFO)) }
+
+// SetDefaultLogger sets logger of servers and conns without their own, nil for no log.
+func SetDefaultLogger(l Logger) {
+	if l == nil {
+		l = NewStdLogger(LOG_LEVEL_OFF)
+	}
+	defaultLogger.set(l)
+}
+
+// logger set at runtime and read by conn goroutines
+type loggerHolder struct {
+	v atomic.Value // loggerBox
+}
+
+type loggerBox struct{ Logger }
+
+func (this *loggerHolder) set(l Logger) { this.v.Store(loggerBox{l}) }
+func (this *loggerHolder) get() Logger {
+	if b, ok := this.v.Load().(loggerBox); ok {
+		return b.Logger
+	}
+	return nil
+}
+
+// SetLogger sets logger of server and conns without their own, nil for default.
+func (this *TCPServer) SetLogger(l Logger) { this.logger.set(l) }
+
+func (this *TCPServer) logr() Logger {
+	if l := this.logger.get(); l != nil {
+		return l
+	}
+	return defaultLogger.get()
+}
+
+// SetLogger sets logger of conn, nil for the one of its server.
+func (this *TCPSecureConn) SetLogger(l Logger) { this.logger.set(l) }
+
+func (this *TCPSecureConn) logr() Logger {
+	if l := this.logger.get(); l != nil {
+		return l
+	}
+	if this.srvo != nil {
+		return this.srvo.logr()
+	}
+	return defaultLogger.get()
+}
@@ -0,0 +1,104 @@
+package mintox
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records messages by level
+type tstLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (this *tstLogger) add(level string, msg string, fields []interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.msgs = append(this.msgs, level+" "+msg+formatLogFields(fields))
+}
+func (this *tstLogger) Debug(msg string, fields ...interface{}) { this.add("DEBUG", msg, fields) }
+func (this *tstLogger) Info(msg string, fields ...interface{})  { this.add("INFO", msg, fields) }
+func (this *tstLogger) Warn(msg string, fields ...interface{})  { this.add("WARN", msg, fields) }
+func (this *tstLogger) Error(msg string, fields ...interface{}) { this.add("ERROR", msg, fields) }
+
+func (this *tstLogger) has(prefix string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, m := range this.msgs {
+		if strings.HasPrefix(m, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStdLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	l := NewStdLogger(LOG_LEVEL_WARN)
+	l.Info("dropped")
+	l.Warn("kept", "addr", "1.2.3.4:5", "odd")
+	if strings.Contains(buf.String(), "dropped") {
+		t.Error("info logged under warn level")
+	}
+	if !strings.Contains(buf.String(), "WARN kept addr=1.2.3.4:5 odd") {
+		t.Error("warn line:", buf.String())
+	}
+	l.SetLevel(LOG_LEVEL_OFF)
+	l.Error("off")
+	if strings.Contains(buf.String(), "off") {
+		t.Error("logged when off")
+	}
+}
+
+func TestTCPServerSetLogger(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvl := &tstLogger{}
+	srvo.SetLogger(srvl)
+	srvo.Start()
+
+	pk, sk2, _ := NewCBKeyPair()
+	cli := NewTCPClient(lsner.Addr().String(), srvo.Pubkey, pk, sk2)
+	if !waitTstCond(3*time.Second, func() bool { return cli.Status == TCP_CLIENT_CONFIRMED }) {
+		t.Fatal("not confirmed")
+	}
+	cli.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvl.has("INFO Conn closed by=remote") }) {
+		t.Error("conn close not logged by server logger")
+	}
+
+	// conn's own logger before the server one
+	c0, c1 := net.Pipe()
+	defer c1.Close()
+	secon, _ := newTstSecureConn(c0)
+	secon.srvo = srvo
+	conl := &tstLogger{}
+	secon.SetLogger(conl)
+	if secon.logr() != conl {
+		t.Error("conn logger not used")
+	}
+	secon.SetLogger(nil)
+	if secon.logr() != srvl {
+		t.Error("server logger not used after conn logger reset")
+	}
+	srvo.SetLogger(nil)
+	if secon.logr() != defaultLogger.get() {
+		t.Error("default logger not used")
+	}
+}
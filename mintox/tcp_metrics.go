@@ -0,0 +1,144 @@
+package mintox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// received packets by type, read goroutine of conns
+func (this *TCPServer) countPacket(ptype byte) {
+	idx := int(ptype)
+	if idx > NUM_RESERVED_PORTS {
+		idx = NUM_RESERVED_PORTS
+	}
+	atomic.AddInt64(&this.pktcnts[idx], 1)
+}
+
+// received packets by type name, routed data are counted as DATA
+func (this *TCPServer) PacketCounts() map[string]int64 {
+	rets := map[string]int64{}
+	for i := range this.pktcnts {
+		n := atomic.LoadInt64(&this.pktcnts[i])
+		if n == 0 {
+			continue
+		}
+		if i == NUM_RESERVED_PORTS {
+			rets["DATA"] = n
+		} else {
+			rets[tcppktname(byte(i))] = n
+		}
+	}
+	return rets
+}
+
+// MetricsHandler serves relay metrics in prometheus text format, mount it like
+// http.Handle("/metrics", srvo.MetricsHandler()). Bytes and packets are totals,
+// per second values are rate() of them on prometheus side.
+func (this *TCPServer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := bytes.NewBuffer(nil)
+		this.WriteMetrics(buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
+
+func (this *TCPServer) WriteMetrics(w io.Writer) {
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	single := func(name, typ, help string, v int64) {
+		header(name, typ, help)
+		fmt.Fprintf(w, "%s %d\n", name, v)
+	}
+
+	this.hsconnmu.RLock()
+	hsn := len(this.HSConns)
+	this.hsconnmu.RUnlock()
+	var ctrlq, dataq, qbytes int64
+	this.connmu.RLock()
+	connn := len(this.Conns)
+	for _, c := range this.Conns {
+		ctrlq += int64(len(c.cwctrlq))
+		dataq += int64(len(c.cwdataq))
+		qbytes += int64(atomic.LoadInt32(&c.cwctrldlen)) + int64(atomic.LoadInt32(&c.cwdatadlen))
+	}
+	this.connmu.RUnlock()
+
+	header("tox_tcp_connections", "gauge", "Current conns by state.")
+	fmt.Fprintf(w, "tox_tcp_connections{state=\"confirmed\"} %d\n", connn)
+	fmt.Fprintf(w, "tox_tcp_connections{state=\"handshake\"} %d\n", hsn)
+	header("tox_tcp_queue_packets", "gauge", "Packets in write queues of confirmed conns.")
+	fmt.Fprintf(w, "tox_tcp_queue_packets{queue=\"ctrl\"} %d\n", ctrlq)
+	fmt.Fprintf(w, "tox_tcp_queue_packets{queue=\"data\"} %d\n", dataq)
+	single("tox_tcp_queue_bytes", "gauge", "Bytes in write queues of confirmed conns.", qbytes)
+
+	cnts := this.Counters()
+	header("tox_tcp_bytes_total", "counter", "Bytes on wire of all conns.")
+	fmt.Fprintf(w, "tox_tcp_bytes_total{direction=\"in\"} %d\n", cnts.BytesRecv)
+	fmt.Fprintf(w, "tox_tcp_bytes_total{direction=\"out\"} %d\n", cnts.BytesSent)
+
+	header("tox_tcp_accepted_total", "counter", "Accepted conns by address family.")
+	fmt.Fprintf(w, "tox_tcp_accepted_total{family=\"ipv4\"} %d\n", cnts.AcceptedIPv4)
+	fmt.Fprintf(w, "tox_tcp_accepted_total{family=\"ipv6\"} %d\n", cnts.AcceptedIPv6)
+
+	header("tox_tcp_packets_total", "counter", "Received packets of confirmed conns by type.")
+	for i := range this.pktcnts {
+		name := "DATA"
+		if i < NUM_RESERVED_PORTS {
+			name = tcppktname(byte(i))
+		}
+		fmt.Fprintf(w, "tox_tcp_packets_total{type=%q} %d\n", name, atomic.LoadInt64(&this.pktcnts[i]))
+	}
+
+	for _, m := range []struct {
+		name string
+		help string
+		v    int64
+	}{
+		{"tox_tcp_handshake_failures_total", "Conns closed before confirmed.", cnts.HandshakeFailed},
+		{"tox_tcp_handshake_timeouts_total", "Conns evicted for not confirmed in time.", cnts.HandshakeTimeouts},
+		{"tox_tcp_write_timeouts_total", "Socket writes blocked over write timeout.", cnts.WriteTimeouts},
+		{"tox_tcp_slow_evicted_total", "Conns evicted for saturated write queues.", cnts.SlowEvicted},
+		{"tox_tcp_info_served_total", "Bootstrap info requests answered.", cnts.InfoServed},
+		{"tox_tcp_resumed_total", "Sessions resumed on a new conn.", cnts.Resumed},
+		{"tox_tcp_resume_expired_total", "Closed sessions not resumed in time.", cnts.ResumeExpired},
+		{"tox_tcp_handshake_replays_total", "Handshakes rejected as replayed.", cnts.HandshakeReplays},
+		{"tox_tcp_onion_forwarded_total", "Onion requests of clients sent out.", cnts.OnionForwarded},
+		{"tox_tcp_onion_returned_total", "Onion responses queued to clients.", cnts.OnionReturned},
+		{"tox_tcp_overloaded_total", "New conns rejected by admission control.", cnts.Overloaded},
+		{"tox_tcp_conn_limited_total", "New conns rejected by conn limits.", cnts.ConnLimited},
+		{"tox_tcp_handshake_evicted_total", "Unconfirmed conns evicted for new conns.", cnts.HandshakeEvicted},
+		{"tox_tcp_fd_exhausted_total", "Accept or dial failed with EMFILE/ENFILE.", cnts.FdExhausted},
+		{"tox_tcp_accept_retried_total", "Accept failed with temporary error.", cnts.AcceptRetried},
+		{"tox_tcp_closed_local_total", "Confirmed conns closed by us.", cnts.ClosedLocal},
+		{"tox_tcp_closed_remote_total", "Confirmed conns closed by peer.", cnts.ClosedRemote},
+		{"tox_tcp_conn_errors_total", "Conns closed by malformed packet or protocol error.", cnts.ConnErrors},
+		{"tox_tcp_congestion_throttled_total", "Sources throttled for slow destination.", cnts.CongestionThrottled},
+		{"tox_tcp_congestion_kicked_total", "Sources disconnected for slow destination.", cnts.CongestionKicked},
+		{"tox_tcp_oob_limited_total", "OOB sends dropped by rate limit.", cnts.OOBLimited},
+		{"tox_tcp_rate_limited_total", "Packets dropped by recv rate limit.", cnts.RateLimited},
+		{"tox_tcp_handshake_throttled_total", "New conns rejected by per ip handshake rate.", cnts.HandshakeThrottled},
+		{"tox_tcp_bans_total", "Ips banned automatically.", cnts.Bans},
+		{"tox_tcp_ban_rejected_total", "New conns rejected from banned ip.", cnts.BanRejected},
+		{"tox_tcp_quota_throttled_total", "Relayed packets dropped over quota.", cnts.QuotaThrottled},
+		{"tox_tcp_quota_kicked_total", "Conns closed over quota.", cnts.QuotaKicked},
+	} {
+		single(m.name, "counter", m.help, m.v)
+	}
+
+	snap := this.HandshakeLatencies()
+	header("tox_tcp_handshake_seconds", "histogram", "Accept to confirmed latency.")
+	var acc int64
+	for i, ub := range snap.Bounds {
+		acc += snap.Counts[i]
+		fmt.Fprintf(w, "tox_tcp_handshake_seconds_bucket{le=\"%g\"} %d\n", ub.Seconds(), acc)
+	}
+	acc += snap.Counts[len(snap.Bounds)]
+	fmt.Fprintf(w, "tox_tcp_handshake_seconds_bucket{le=\"+Inf\"} %d\n", acc)
+	fmt.Fprintf(w, "tox_tcp_handshake_seconds_sum %g\n", snap.Sum.Seconds())
+	fmt.Fprintf(w, "tox_tcp_handshake_seconds_count %d\n", acc)
+}
@@ -0,0 +1,63 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	peer := newTstPeer(t, c, srvo.Pubkey)
+	peer.handshake()
+	peer.ping()
+	peer.readUntil(TCP_PACKET_PONG)
+
+	bad, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Write(make([]byte, (PUBLIC_KEY_SIZE+NONCE_SIZE)*2+MAC_SIZE))
+	if !waitTstCond(3*time.Second, func() bool { return srvo.Counters().HandshakeFailed == 1 }) {
+		t.Fatal("handshake failure not counted")
+	}
+	bad.Close()
+
+	rec := httptest.NewRecorder()
+	srvo.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Error("content type:", rec.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`tox_tcp_connections{state="confirmed"} 1`,
+		`tox_tcp_connections{state="handshake"} 0`,
+		`tox_tcp_packets_total{type="PING"} 1`,
+		`tox_tcp_handshake_failures_total 1`,
+		`tox_tcp_handshake_seconds_count 1`,
+		`tox_tcp_handshake_seconds_bucket{le="+Inf"} 1`,
+		"# TYPE tox_tcp_bytes_total counter",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Error("metric missing:", line)
+		}
+	}
+	if cnts := srvo.Counters(); cnts.BytesRecv == 0 || cnts.BytesSent == 0 {
+		t.Error("bytes not counted:", cnts.BytesRecv, cnts.BytesSent)
+	}
+	if n := srvo.PacketCounts()["PING"]; n != 1 {
+		t.Error("packet counts:", srvo.PacketCounts())
+	}
+}
@@ -0,0 +1,279 @@
+package mintox
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Noise IK handshake, an option for mintox peers. The legacy handshake lets
+// anyone with the server's secret key impersonate any client to it (KCI),
+// IK binds the session to both static keys and fresh ephemeral ones.
+//
+// Selected by the client, the server tells by the first bytes, so legacy
+// clients keep working on the same port. Sizes are those of the legacy one:
+//   client => TCP_NOISE_MAGIC(7) | version(1) | e(32) | enc(s)(48) | enc(sent nonce)(40)
+//   server => e(32) | enc(sent nonce | zero pad)(64)
+// Header is the prologue. Session key is the first of Split, nonces from the
+// payloads, so transport, re-handshake and resume are the same for both.
+// Server confirms on the first packet under the session key, only the owner
+// of the client secret key can make it.
+
+const (
+	TCP_HANDSHAKE_LEGACY   = 0
+	TCP_HANDSHAKE_NOISE_IK = 1
+)
+
+const TCP_NOISE_PROTOCOL = "Noise_IK_25519_AESGCM_SHA256"
+
+/* never the beginning of a legacy handshake but by 2^-56 chance of a client pubkey */
+const TCP_NOISE_MAGIC = "\xffmintox"
+const TCP_NOISE_HEADER_SIZE = len(TCP_NOISE_MAGIC) + 1
+
+/* server payload padded to the legacy response size */
+const TCP_NOISE_RESPONSE_PAD = TCP_SERVER_HANDSHAKE_SIZE - PUBLIC_KEY_SIZE - NONCE_SIZE - MAC_SIZE
+
+func isTCPNoiseHandshake(rdbuf []byte) bool {
+	return len(rdbuf) >= TCP_NOISE_HEADER_SIZE && string(rdbuf[:len(TCP_NOISE_MAGIC)]) == TCP_NOISE_MAGIC
+}
+
+// symmetric state of the noise spec, ck/h/k/n
+type noiseState struct {
+	ck []byte
+	h  []byte
+	k  []byte // nil before the first MixKey
+	n  uint64
+}
+
+func newNoiseState(prologue []byte) *noiseState {
+	this := &noiseState{h: make([]byte, sha256.Size)}
+	copy(this.h, TCP_NOISE_PROTOCOL) // shorter than HASHLEN, zero padded
+	this.ck = append([]byte{}, this.h...)
+	this.mixHash(prologue)
+	return this
+}
+
+func (this *noiseState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(this.h)
+	hash.Write(data)
+	this.h = hash.Sum(nil)
+}
+
+func (this *noiseState) mixKey(ikm []byte) {
+	this.ck, this.k = noiseHKDF(this.ck, ikm)
+	this.n = 0
+}
+
+// DH then MixKey
+func (this *noiseState) mixDH(sk, pk *CryptoKey) error {
+	shr, err := CBScalarMult(sk, pk)
+	if err != nil {
+		return errors.Wrap(ErrHandshakeKey, err.Error())
+	}
+	this.mixKey(shr.Bytes())
+	return nil
+}
+
+func (this *noiseState) aead() cipher.AEAD {
+	block, err := aes.NewCipher(this.k)
+	if err != nil {
+		panic(err) // key is always 32 bytes
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func (this *noiseState) nonce() []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], this.n)
+	this.n++
+	return nonce
+}
+
+func (this *noiseState) encryptAndHash(plain []byte) []byte {
+	out := plain
+	if this.k != nil {
+		out = this.aead().Seal(nil, this.nonce(), plain, this.h)
+	}
+	this.mixHash(out)
+	return out
+}
+
+func (this *noiseState) decryptAndHash(data []byte) ([]byte, error) {
+	out := data
+	if this.k != nil {
+		var err error
+		if out, err = this.aead().Open(nil, this.nonce(), data, this.h); err != nil {
+			return nil, errors.Wrap(ErrHandshakeDecrypt, err.Error())
+		}
+	}
+	this.mixHash(data)
+	return out, nil
+}
+
+// session key of both sides
+func (this *noiseState) split() *CryptoKey {
+	k1, _ := noiseHKDF(this.ck, nil)
+	return NewCryptoKey(k1)
+}
+
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	tmpkey := mac.Sum(nil)
+	mac = hmac.New(sha256.New, tmpkey)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+	mac = hmac.New(sha256.New, tmpkey)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	return out1, mac.Sum(nil)
+}
+
+func tcpNoiseHeader(version uint8) []byte {
+	return append([]byte(TCP_NOISE_MAGIC), version)
+}
+
+// client side state between the two messages
+type tcpNoiseInit struct {
+	st    *noiseState
+	tmpsk *CryptoKey
+}
+
+// IK message 1: e, es, s, ss
+func (this *TCPClient) generateNoiseHandshake() ([]byte, error) {
+	tmppk, tmpsk, err := NewCBKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	hdr := tcpNoiseHeader(TCP_HANDSHAKE_NOISE_IK)
+	st := newNoiseState(hdr)
+	st.mixHash(this.ServPubkey.Bytes()) // pre-message <- s
+
+	pkt := append(hdr, tmppk.Bytes()...)
+	st.mixHash(tmppk.Bytes())
+	if err := st.mixDH(tmpsk, this.ServPubkey); err != nil {
+		return nil, err
+	}
+	pkt = append(pkt, st.encryptAndHash(this.SelfPubkey.Bytes())...)
+	if err := st.mixDH(this.SelfSeckey, this.ServPubkey); err != nil {
+		return nil, err
+	}
+	this.SentNonce = CBRandomNonce()
+	pkt = append(pkt, st.encryptAndHash(this.SentNonce.Bytes())...)
+	this.noise = &tcpNoiseInit{st: st, tmpsk: tmpsk}
+	return pkt, nil
+}
+
+// IK message 2: e, ee, se
+func (this *TCPClient) handleNoiseResponse(rdbuf []byte) error {
+	ni := this.noise
+	this.noise = nil
+	if len(rdbuf) != TCP_SERVER_HANDSHAKE_SIZE {
+		return errors.Wrapf(ErrHandshakeLength, "%d, want %d", len(rdbuf), TCP_SERVER_HANDSHAKE_SIZE)
+	}
+	st := ni.st
+	srvtmppk := NewCryptoKey(rdbuf[:PUBLIC_KEY_SIZE])
+	st.mixHash(srvtmppk.Bytes())
+	if err := st.mixDH(ni.tmpsk, srvtmppk); err != nil {
+		return err
+	}
+	if err := st.mixDH(this.SelfSeckey, srvtmppk); err != nil {
+		return err
+	}
+	payload, err := st.decryptAndHash(rdbuf[PUBLIC_KEY_SIZE:])
+	if err != nil {
+		return err
+	}
+	this.RecvNonce = NewCBNonce(payload[:NONCE_SIZE])
+	this.Shrkey = st.split()
+	log.Println("Noise handshake done:", this.ServAddr)
+	return nil
+}
+
+// by the version chosen, legacy one never fails
+func (this *TCPClient) handleHandshakeResponse(rdbuf []byte) error {
+	if this.noise != nil {
+		return this.handleNoiseResponse(rdbuf)
+	}
+	return this.HandleHandshake(rdbuf)
+}
+
+// server side, both messages. rdbuf is TCP_CLIENT_HANDSHAKE_SIZE
+func (this *TCPSecureConn) handleNoiseHandshake(rdbuf []byte) error {
+	hdr := rdbuf[:TCP_NOISE_HEADER_SIZE]
+	if ver := hdr[len(hdr)-1]; ver != TCP_HANDSHAKE_NOISE_IK {
+		return errors.Wrapf(ErrHandshakeVersion, "%d", ver)
+	}
+	selfpk := this.srvPubkey
+	if selfpk == nil {
+		selfpk = CBDerivePubkey(this.Seckey)
+	}
+	st := newNoiseState(hdr)
+	st.mixHash(selfpk.Bytes())
+
+	pos := TCP_NOISE_HEADER_SIZE
+	clitmppk := NewCryptoKey(rdbuf[pos : pos+PUBLIC_KEY_SIZE])
+	pos += PUBLIC_KEY_SIZE
+	st.mixHash(clitmppk.Bytes())
+	if err := st.mixDH(this.Seckey, clitmppk); err != nil {
+		return err
+	}
+	clipk, err := st.decryptAndHash(rdbuf[pos : pos+PUBLIC_KEY_SIZE+MAC_SIZE])
+	if err != nil {
+		return err
+	}
+	pos += PUBLIC_KEY_SIZE + MAC_SIZE
+	if err := this.checkHandshakeKeys(clipk, clitmppk.Bytes()); err != nil {
+		return err
+	}
+	cliPubkey := NewCryptoKey(clipk)
+	if err := st.mixDH(this.Seckey, cliPubkey); err != nil {
+		return err
+	}
+	payload, err := st.decryptAndHash(rdbuf[pos:])
+	if err != nil {
+		return err
+	}
+	if this.rehs && !bytes.Equal(clipk, this.Pubkey.Bytes()) {
+		return errors.New("Re-handshake with another pubkey")
+	}
+	if this.handshakeReplayed(payload, clitmppk.Bytes()) {
+		atomic.AddInt64(&this.srvo.cnts.HandshakeReplays, 1)
+		return errors.Wrapf(ErrHandshakeReplay, "pubkey %s", cliPubkey.ToHex20())
+	}
+	this.Pubkey = cliPubkey
+	this.RecvNonce = NewCBNonce(payload)
+	this.logr().Debug("Noise handshake request", "addr", this.Sock.RemoteAddr(), "pubkey", cliPubkey.ToHex20())
+
+	hsrnd := this.handshakeRandom()
+	tmppk := CBDerivePubkey(hsrnd.TmpSeckey)
+	st.mixHash(tmppk.Bytes())
+	if err := st.mixDH(hsrnd.TmpSeckey, clitmppk); err != nil {
+		return err
+	}
+	if err := st.mixDH(hsrnd.TmpSeckey, cliPubkey); err != nil {
+		return err
+	}
+	plain := append(append([]byte{}, hsrnd.SentNonce.Bytes()...), make([]byte, TCP_NOISE_RESPONSE_PAD)...)
+	body := append(append([]byte{}, tmppk.Bytes()...), st.encryptAndHash(plain)...)
+	return this.sendHandshakeResponse(hsrnd, st.split(), body)
+}
+
+// handshake of relay conns made later, TCP_HANDSHAKE_NOISE_IK if all relays are mintox
+func (this *TCPConnections) SetHandshakeVersion(version uint8) {
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	this.hsver = version
+}
@@ -0,0 +1,149 @@
+package mintox
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestNoiseHandshake(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	pk, sk, _ := NewCBKeyPair()
+	ncli := NewTCPClientNoise(addr, srvo.Pubkey, pk, sk)
+	defer ncli.Close()
+	pk, sk, _ = NewCBKeyPair()
+	lcli := NewTCPClient(addr, srvo.Pubkey, pk, sk)
+	defer lcli.Close()
+	for _, cli := range []*TCPClient{ncli, lcli} {
+		if !waitTstCond(3*time.Second, func() bool { return cli.Status == TCP_CLIENT_CONFIRMED }) {
+			t.Fatal("client not confirmed:", cli.HandshakeVersion)
+		}
+	}
+	if _, ok := srvo.ConnStats(ncli.SelfPubkey); !ok {
+		t.Fatal("noise client not known by pubkey")
+	}
+	if err := ncli.SendPing(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return ncli.PendingPings() == 0 }) {
+		t.Error("no pong under noise session key")
+	}
+
+	// re-handshake keeps the version
+	ncli.SendCapabilities()
+	if !waitTstCond(3*time.Second, func() bool { return ncli.Caps()&TCP_CAP_REHANDSHAKE != 0 }) {
+		t.Fatal("capability not negotiated")
+	}
+	oldkey := ncli.Shrkey
+	if err := ncli.Rehandshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool {
+		return ncli.Shrkey != oldkey && !ncli.inRehandshake() && ncli.Status == TCP_CLIENT_CONFIRMED
+	}) {
+		t.Fatal("noise re-handshake not done")
+	}
+}
+
+func TestNoiseHandshakeRejected(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	errC := make(chan error, 4)
+	srvo.OnConnError = func(c *TCPSecureConn, err error) { errC <- err }
+	expectErr := func(want error) {
+		select {
+		case err := <-errC:
+			if errors.Cause(err) != want {
+				t.Error("unexpected error:", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no error for:", want)
+		}
+	}
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(3 * time.Second))
+		return c
+	}
+	pk, sk, _ := NewCBKeyPair()
+	peer := newTstPeer(t, nil, srvo.Pubkey)
+	peer.SetKeyPair(pk, sk)
+	peer.HandshakeVersion = TCP_HANDSHAKE_NOISE_IK
+
+	hspkt, _ := peer.GenerateHandshake()
+	hspkt[TCP_NOISE_HEADER_SIZE-1] = 9
+	c := dial()
+	c.Write(hspkt)
+	expectErr(ErrHandshakeVersion)
+	c.Close()
+
+	// for another server
+	otherpk, _, _ := NewCBKeyPair()
+	peer.ServPubkey = otherpk
+	hspkt, _ = peer.GenerateHandshake()
+	c = dial()
+	c.Write(hspkt)
+	expectErr(ErrHandshakeDecrypt)
+	c.Close()
+}
+
+// with the server secret key, legacy handshake can impersonate a client, noise one can not
+func TestNoiseHandshakeKCI(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	victimpk, _, _ := NewCBKeyPair()
+
+	// everything but se, which needs the victim's secret key
+	hdr := tcpNoiseHeader(TCP_HANDSHAKE_NOISE_IK)
+	st := newNoiseState(hdr)
+	st.mixHash(srvo.Pubkey.Bytes())
+	tmppk, tmpsk, _ := NewCBKeyPair()
+	pkt := append(hdr, tmppk.Bytes()...)
+	st.mixHash(tmppk.Bytes())
+	st.mixDH(tmpsk, srvo.Pubkey)
+	pkt = append(pkt, st.encryptAndHash(victimpk.Bytes())...)
+	st.mixDH(srvo.Seckey, victimpk) // ss by the stolen key
+	sentNonce := CBRandomNonce()
+	pkt = append(pkt, st.encryptAndHash(sentNonce.Bytes())...)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	c.Write(pkt)
+	rdbuf := make([]byte, TCP_SERVER_HANDSHAKE_SIZE)
+	if _, err := io.ReadFull(c, rdbuf); err != nil {
+		t.Fatal("no handshake response:", err)
+	}
+	srvtmppk := NewCryptoKey(rdbuf[:PUBLIC_KEY_SIZE])
+	st.mixHash(srvtmppk.Bytes())
+	st.mixDH(tmpsk, srvtmppk)
+	if _, err := st.decryptAndHash(rdbuf[PUBLIC_KEY_SIZE:]); err == nil {
+		t.Fatal("response decrypted without se")
+	}
+	cli := &TCPClient{Shrkey: st.split(), SentNonce: sentNonce}
+	c.Write(cli.MakePingPacket())
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("impersonated conn not closed:", err)
+	}
+	if st := srvo.Stats(); st.Confirmed != 0 {
+		t.Error("impersonated conn confirmed")
+	}
+}
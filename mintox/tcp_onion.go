@@ -0,0 +1,57 @@
+package mintox
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// like TCP_PACKET_ONION_REQUEST handling in handle_TCP_packet, forward the
+// layer-1 onion packet to its next hop over UDP. The source is the conn
+// identifier, so the response can find its way back to this conn.
+func (this *TCPSecureConn) handleOnionRequest(plnpkt []byte) {
+	if this.srvo == nil {
+		return
+	}
+	onion, ok := this.srvo.Oniono.(*Onion)
+	if !ok || onion == nil {
+		return
+	}
+	if len(plnpkt) <= 1+NONCE_SIZE+ONION_SEND_BASE*2 {
+		log.Println("Invalid onion request length:", len(plnpkt), this.Sock.RemoteAddr())
+		return
+	}
+	nonce := NewCBNonce(append([]byte{}, plnpkt[1:1+NONCE_SIZE]...))
+	source := &TCPOnionAddr{this.Identifier}
+	if err := onion.Send1(plnpkt[1+NONCE_SIZE:], source, nonce); err != nil {
+		log.Println("Onion request dropped:", err, this.Sock.RemoteAddr())
+		return
+	}
+	atomic.AddInt64(&this.srvo.cnts.OnionForwarded, 1)
+}
+
+// like handle_onion_recv_1, send onion response back to the requesting conn.
+func (this *TCPServer) handleOnionRecv1(object Object, dest net.Addr, data []byte) int {
+	oaddr, ok := dest.(*TCPOnionAddr)
+	if !ok {
+		return 1
+	}
+	this.connmu.RLock()
+	c := this.onionConns[oaddr.Identifier]
+	this.connmu.RUnlock()
+	if c == nil || c.status() != TCP_STATUS_CONFIRMED {
+		return 1
+	}
+	plain := make([]byte, 0, 1+len(data))
+	plain = append(plain, TCP_PACKET_ONION_RESPONSE)
+	plain = append(plain, data...)
+	if checkPacketSize(len(plain)) != nil {
+		return 1
+	}
+	if c.isClosed() || !c.enqueueData(plain) {
+		log.Println("Data queue is full, drop onion response.", len(plain), c.Sock.RemoteAddr())
+		return 1
+	}
+	atomic.AddInt64(&this.cnts.OnionReturned, 1)
+	return 0
+}
@@ -0,0 +1,108 @@
+package mintox
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOnionRelayForward(t *testing.T) {
+	neto := NewNetworkCore()
+	defer neto.srv.Close()
+	onion := newOnion(neto)
+	defer onion.Kill()
+
+	_, sk, _ := NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+
+	c, err := net.Dial("tcp", lsner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	peer := newTstPeer(t, c, srvo.Pubkey)
+	peer.handshake()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 1 }) {
+		t.Fatal("conn not confirmed:", srvo.ConnCount())
+	}
+
+	hop, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hop.Close()
+	hop.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	// too short, dropped
+	nonce := CBRandomNonce()
+	peer.writePlain(append([]byte{TCP_PACKET_ONION_REQUEST}, nonce.Bytes()...))
+
+	ipport, err := ipportPack(hop.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := CBRandomBytes(ONION_SEND_BASE*2 + 16)
+	req := []byte{TCP_PACKET_ONION_REQUEST}
+	req = append(req, nonce.Bytes()...)
+	req = append(req, ipport...)
+	req = append(req, body...)
+	peer.writePlain(req)
+
+	rdbuf := make([]byte, 2000)
+	rn, _, err := hop.ReadFrom(rdbuf)
+	if err != nil {
+		t.Fatal("onion request not forwarded:", err)
+	}
+	fwd := rdbuf[:rn]
+	if fwd[0] != NET_PACKET_ONION_SEND_1 || len(fwd) != 1+NONCE_SIZE+len(body)+ONION_RETURN_1 {
+		t.Fatal("invalid forwarded packet:", fwd[0], len(fwd))
+	}
+	if !bytes.Equal(fwd[1:1+NONCE_SIZE], nonce.Bytes()) || !bytes.Equal(fwd[1+NONCE_SIZE:1+NONCE_SIZE+len(body)], body) {
+		t.Fatal("forwarded packet content changed")
+	}
+	retpart := fwd[len(fwd)-ONION_RETURN_1:]
+
+	// response with the return part goes back to the requesting conn
+	relayaddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: neto.srv.LocalAddr().(*net.UDPAddr).Port}
+	rsp := []byte{NET_PACKET_ONION_RECV_1}
+	rsp = append(rsp, retpart...)
+	rsp = append(rsp, "onion response"...)
+	if _, err := hop.WriteTo(rsp, relayaddr); err != nil {
+		t.Fatal(err)
+	}
+	plnpkt := peer.readUntil(TCP_PACKET_ONION_RESPONSE)
+	if string(plnpkt[1:]) != "onion response" {
+		t.Error("invalid onion response:", plnpkt)
+	}
+}
+
+func TestIpportPack(t *testing.T) {
+	addrs := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445},
+		&net.UDPAddr{IP: net.ParseIP("::1"), Port: 443},
+		&TCPOnionAddr{12345},
+	}
+	for _, addr := range addrs {
+		data, err := ipportPack(addr)
+		if err != nil || len(data) != SIZE_IPPORT {
+			t.Fatal(addr, err, len(data))
+		}
+		addr2, err := ipportUnpack(data)
+		if err != nil || addr2.String() != addr.String() {
+			t.Error(addr, addr2, err)
+		}
+	}
+	if _, err := ipportUnpack(make([]byte, SIZE_IPPORT)); err == nil {
+		t.Error("invalid family accepted")
+	}
+}
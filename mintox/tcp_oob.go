@@ -0,0 +1,57 @@
+package mintox
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// like handle_TCP_oob_send, relay data to a confirmed conn by pubkey.
+// destination lookup is one map access, and the sender is rate limited
+// so flooding OOB sends can not burn relay cpu.
+func (this *TCPSecureConn) handleOOBSend(plnpkt []byte) {
+	if len(plnpkt) <= 1+PUBLIC_KEY_SIZE || len(plnpkt) > 1+PUBLIC_KEY_SIZE+TCP_MAX_OOB_DATA_LENGTH {
+		log.Println("Invalid oob send length:", len(plnpkt), this.Sock.RemoteAddr())
+		return
+	}
+	if !this.allowOOBSend() {
+		return
+	}
+	dstpk := NewCryptoKey(plnpkt[1 : 1+PUBLIC_KEY_SIZE])
+	this.emitOOBData(dstpk, plnpkt[1+PUBLIC_KEY_SIZE:])
+	dst := this.srvo.confirmedConn(dstpk)
+	if dst == nil {
+		this.srvo.cluster.forwardOOB(this, dstpk, plnpkt[1+PUBLIC_KEY_SIZE:])
+		return
+	}
+	plain := make([]byte, 0, len(plnpkt))
+	plain = append(plain, TCP_PACKET_OOB_RECV)
+	plain = append(plain, this.Pubkey.Bytes()...)
+	plain = append(plain, plnpkt[1+PUBLIC_KEY_SIZE:]...)
+	if dst.isClosed() || !dst.enqueueData(plain) {
+		log.Println("Data queue is full, drop oob.", len(plain), dst.Sock.RemoteAddr())
+	}
+}
+
+// fixed one second window, read goroutine only
+func (this *TCPSecureConn) allowOOBSend() bool {
+	limit := this.srvo.config().MaxOOBPerSec
+	if limit <= 0 {
+		return true
+	}
+	now := this.clock.Now()
+	if now.Sub(this.oobWindow) >= time.Second {
+		this.oobWindow, this.oobCount = now, 0
+	}
+	this.oobCount++
+	if this.oobCount <= limit {
+		return true
+	}
+	if !this.oobAbuser {
+		this.oobAbuser = true
+		atomic.AddInt64(&this.srvo.cnts.OOBAbusers, 1)
+		log.Println("OOB send over limit:", limit, this.Sock.RemoteAddr())
+	}
+	atomic.AddInt64(&this.srvo.cnts.OOBLimited, 1)
+	return false
+}
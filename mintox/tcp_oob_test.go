@@ -0,0 +1,80 @@
+package mintox
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestOOBSendRateLimit(t *testing.T) {
+	srvo := newTstServer()
+	srvo.config().MaxOOBPerSec = 3
+	clk := newFakeTstClock()
+	src := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	src.clock = clk
+	dst := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+
+	oobpkt := func(pk *CryptoKey, data []byte) []byte {
+		return append(append([]byte{TCP_PACKET_OOB_SEND}, pk.Bytes()...), data...)
+	}
+	for i := 0; i < 5; i++ {
+		src.dispatchPacket(oobpkt(dst.Pubkey, []byte{byte(i)}))
+	}
+	if len(dst.cwdataq) != 3 {
+		t.Fatal("oob not limited:", len(dst.cwdataq))
+	}
+	plain := <-dst.cwdataq
+	dst.dataDequeued(plain)
+	if plain[0] != TCP_PACKET_OOB_RECV || !bytes.Equal(plain[1:1+PUBLIC_KEY_SIZE], src.Pubkey.Bytes()) ||
+		!bytes.Equal(plain[1+PUBLIC_KEY_SIZE:], []byte{0}) {
+		t.Error("invalid oob recv:", plain)
+	}
+	if cnts := srvo.Counters(); cnts.OOBLimited != 2 || cnts.OOBAbusers != 1 {
+		t.Error("oob counters:", cnts.OOBLimited, cnts.OOBAbusers)
+	}
+
+	// next window
+	clk.Advance(time.Second)
+	src.dispatchPacket(oobpkt(dst.Pubkey, []byte{5}))
+	if len(dst.cwdataq) != 3 {
+		t.Error("oob not allowed in new window:", len(dst.cwdataq))
+	}
+
+	// unknown destination and invalid length, dropped
+	unkpk, _, _ := NewCBKeyPair()
+	clk.Advance(time.Second)
+	src.dispatchPacket(oobpkt(unkpk, []byte{6}))
+	src.dispatchPacket(oobpkt(dst.Pubkey, nil))
+	src.dispatchPacket(oobpkt(dst.Pubkey, make([]byte, TCP_MAX_OOB_DATA_LENGTH+1)))
+	if len(dst.cwdataq) != 3 {
+		t.Error("invalid oob relayed:", len(dst.cwdataq))
+	}
+	if cnts := srvo.Counters(); cnts.OOBAbusers != 1 {
+		t.Error("abuser counted twice:", cnts.OOBAbusers)
+	}
+}
+
+func TestOOBDataCallback(t *testing.T) {
+	srvo := newTstServer()
+	var gotpk *CryptoKey
+	var got [][]byte
+	srvo.OnOOBData = func(c *TCPSecureConn, dstpk *CryptoKey, data []byte) {
+		gotpk = dstpk
+		got = append(got, data)
+	}
+	src := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	src.OnOOBData = srvo.onOOBData
+	dst := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	unkpk, _, _ := NewCBKeyPair()
+
+	src.dispatchPacket(append(append([]byte{TCP_PACKET_OOB_SEND}, dst.Pubkey.Bytes()...), "hi"...))
+	if len(got) != 1 || string(got[0]) != "hi" || !gotpk.Equal(dst.Pubkey.Bytes()) || len(dst.cwdataq) != 1 {
+		t.Fatal("oob not observed and relayed:", got, len(dst.cwdataq))
+	}
+	// offline destination still observed, invalid one not
+	src.dispatchPacket(append(append([]byte{TCP_PACKET_OOB_SEND}, unkpk.Bytes()...), "yo"...))
+	src.dispatchPacket(append([]byte{TCP_PACKET_OOB_SEND}, unkpk.Bytes()...))
+	if len(got) != 2 || !gotpk.Equal(unkpk.Bytes()) {
+		t.Error("offline oob not observed:", got)
+	}
+}
@@ -0,0 +1,135 @@
+package mintox
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Pure parsers of relay wire input, take only bytes and explicit keys, touch
+// no conn state, so they can be fuzzed alone. Malformed input is an error,
+// never a panic. Conns check every packet with them before any handler runs.
+
+var ErrTCPPacketInvalid = errors.New("Invalid packet")
+
+// decrypted packet of a confirmed conn, fields set by type
+type TCPPacket struct {
+	Type   byte
+	Connid uint8      // routing response, notifications, routed data
+	Pingid uint64     // ping, pong
+	Pubkey *CryptoKey // routing request/response, oob send/recv
+	Data   []byte     // payload after the fixed fields, aliases plnpkt
+}
+
+// ParseTCPPacket validates plnpkt by its type, like the length checks
+// of handle_TCP_packet. Other reserved types, like experimental ones
+// or the session ticket, carry Data only and are checked by their handlers.
+func ParseTCPPacket(plnpkt []byte) (*TCPPacket, error) {
+	if len(plnpkt) == 0 {
+		return nil, errors.Wrap(ErrTCPPacketInvalid, "empty")
+	}
+	pkt := &TCPPacket{Type: plnpkt[0]}
+	badlen := func() (*TCPPacket, error) {
+		return nil, errors.Wrapf(ErrTCPPacketInvalid, "%s length %d", tcppktname(pkt.Type), len(plnpkt))
+	}
+	switch ptype := plnpkt[0]; {
+	case ptype >= NUM_RESERVED_PORTS:
+		pkt.Connid = ptype
+		pkt.Data = plnpkt[1:]
+	case ptype == TCP_PACKET_ROUTING_REQUEST:
+		if len(plnpkt) != 1+PUBLIC_KEY_SIZE {
+			return badlen()
+		}
+		pkt.Pubkey = NewCryptoKey(plnpkt[1:])
+	case ptype == TCP_PACKET_ROUTING_RESPONSE:
+		if len(plnpkt) != 1+1+PUBLIC_KEY_SIZE {
+			return badlen()
+		}
+		pkt.Connid = plnpkt[1]
+		pkt.Pubkey = NewCryptoKey(plnpkt[2:])
+	case ptype == TCP_PACKET_CONNECTION_NOTIFICATION || ptype == TCP_PACKET_DISCONNECT_NOTIFICATION:
+		if len(plnpkt) != 2 {
+			return badlen()
+		}
+		pkt.Connid = plnpkt[1]
+	case ptype == TCP_PACKET_PING || ptype == TCP_PACKET_PONG:
+		if len(plnpkt) != 1+8 {
+			return badlen()
+		}
+		pkt.Pingid = pongidOf(plnpkt)
+	case ptype == TCP_PACKET_OOB_SEND || ptype == TCP_PACKET_OOB_RECV:
+		if len(plnpkt) <= 1+PUBLIC_KEY_SIZE || len(plnpkt) > 1+PUBLIC_KEY_SIZE+TCP_MAX_OOB_DATA_LENGTH {
+			return badlen()
+		}
+		pkt.Pubkey = NewCryptoKey(plnpkt[1 : 1+PUBLIC_KEY_SIZE])
+		pkt.Data = plnpkt[1+PUBLIC_KEY_SIZE:]
+	case ptype == TCP_PACKET_ONION_REQUEST:
+		if len(plnpkt) <= 1+NONCE_SIZE+ONION_SEND_BASE*2 {
+			return badlen()
+		}
+		pkt.Data = plnpkt[1:]
+	case ptype == TCP_PACKET_ONION_RESPONSE || ptype == TCP_PACKET_CAPABILITY:
+		if len(plnpkt) < 2 {
+			return badlen()
+		}
+		pkt.Data = plnpkt[1:]
+	default:
+		pkt.Data = plnpkt[1:]
+	}
+	return pkt, nil
+}
+
+func pongidOf(plnpkt []byte) uint64 { return binary.BigEndian.Uint64(plnpkt[1:]) }
+
+// client handshake as the server sees it, see TCPSecureConn.HandleHandshake
+type TCPHandshakeRequest struct {
+	Pubkey    *CryptoKey // client long term
+	TmpNonce  *CBNonce   // of the encrypted part
+	TmpPubkey *CryptoKey // client temp, for the session key
+	SentNonce *CBNonce   // first nonce of client packets
+	Shrkey    *CryptoKey // of Pubkey and the server seckey
+}
+
+// ParseTCPHandshakeRequest decrypts a TCP_CLIENT_HANDSHAKE_SIZE handshake
+// with the server seckey. Noise handshakes are not handled here.
+func ParseTCPHandshakeRequest(seckey *CryptoKey, hspkt []byte) (*TCPHandshakeRequest, error) {
+	if len(hspkt) != TCP_CLIENT_HANDSHAKE_SIZE {
+		return nil, errors.Wrapf(ErrHandshakeLength, "%d, want %d", len(hspkt), TCP_CLIENT_HANDSHAKE_SIZE)
+	}
+	req := &TCPHandshakeRequest{}
+	req.Pubkey = NewCryptoKey(hspkt[:PUBLIC_KEY_SIZE])
+	req.TmpNonce = NewCBNonce(append([]byte{}, hspkt[PUBLIC_KEY_SIZE:PUBLIC_KEY_SIZE+NONCE_SIZE]...))
+	var err error
+	req.Shrkey, err = CBBeforeNm(req.Pubkey, seckey)
+	if err != nil {
+		return nil, errors.Wrap(ErrHandshakeKey, err.Error())
+	}
+	plain, err := DecryptDataSymmetric(req.Shrkey, req.TmpNonce, hspkt[PUBLIC_KEY_SIZE+NONCE_SIZE:])
+	if err != nil {
+		return nil, errors.Wrap(ErrHandshakeDecrypt, err.Error())
+	}
+	if len(plain) != TCP_HANDSHAKE_PLAIN_SIZE {
+		return nil, errors.Wrapf(ErrHandshakeLength, "plain %d, want %d", len(plain), TCP_HANDSHAKE_PLAIN_SIZE)
+	}
+	req.TmpPubkey = NewCryptoKey(plain[:PUBLIC_KEY_SIZE])
+	req.SentNonce = NewCBNonce(append([]byte{}, plain[PUBLIC_KEY_SIZE:]...))
+	return req, nil
+}
+
+// ParseTCPHandshakeResponse decrypts a TCP_SERVER_HANDSHAKE_SIZE response
+// with the client's handshake shrkey, got the server temp pubkey and the
+// first nonce of server packets.
+func ParseTCPHandshakeResponse(shrkey *CryptoKey, hspkt []byte) (tmpPubkey *CryptoKey, recvNonce *CBNonce, err error) {
+	if len(hspkt) != TCP_SERVER_HANDSHAKE_SIZE {
+		return nil, nil, errors.Wrapf(ErrHandshakeLength, "%d, want %d", len(hspkt), TCP_SERVER_HANDSHAKE_SIZE)
+	}
+	tmpNonce := NewCBNonce(append([]byte{}, hspkt[:NONCE_SIZE]...))
+	plain, err := DecryptDataSymmetric(shrkey, tmpNonce, hspkt[NONCE_SIZE:])
+	if err != nil {
+		return nil, nil, errors.Wrap(ErrHandshakeDecrypt, err.Error())
+	}
+	if len(plain) != TCP_HANDSHAKE_PLAIN_SIZE {
+		return nil, nil, errors.Wrapf(ErrHandshakeLength, "plain %d, want %d", len(plain), TCP_HANDSHAKE_PLAIN_SIZE)
+	}
+	return NewCryptoKey(plain[:PUBLIC_KEY_SIZE]), NewCBNonce(append([]byte{}, plain[PUBLIC_KEY_SIZE:]...)), nil
+}
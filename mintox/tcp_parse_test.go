@@ -0,0 +1,157 @@
+package mintox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseTCPPacket(t *testing.T) {
+	pk, _, _ := NewCBKeyPair()
+	valid := [][]byte{
+		append([]byte{TCP_PACKET_ROUTING_REQUEST}, pk.Bytes()...),
+		append([]byte{TCP_PACKET_ROUTING_RESPONSE, 16}, pk.Bytes()...),
+		{TCP_PACKET_CONNECTION_NOTIFICATION, 16},
+		{TCP_PACKET_PING, 0, 0, 0, 0, 0, 0, 0, 9},
+		append(append([]byte{TCP_PACKET_OOB_SEND}, pk.Bytes()...), 1),
+		{TCP_PACKET_CAPABILITY, TCP_CLIENT_CAPS},
+		{12},
+		{NUM_RESERVED_PORTS + 3, 'h', 'i'},
+	}
+	for _, plnpkt := range valid {
+		pkt, err := ParseTCPPacket(plnpkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Type != plnpkt[0] {
+			t.Error("type:", pkt.Type, plnpkt[0])
+		}
+	}
+	if pkt, _ := ParseTCPPacket(valid[1]); pkt.Connid != 16 || !pkt.Pubkey.Equal(pk.Bytes()) {
+		t.Error("routing response:", pkt.Connid)
+	}
+	if pkt, _ := ParseTCPPacket(valid[3]); pkt.Pingid != 9 {
+		t.Error("pingid:", pkt.Pingid)
+	}
+	if pkt, _ := ParseTCPPacket(valid[7]); pkt.Connid != NUM_RESERVED_PORTS+3 || string(pkt.Data) != "hi" {
+		t.Error("routed data:", pkt.Connid, pkt.Data)
+	}
+
+	invalid := [][]byte{
+		nil,
+		{TCP_PACKET_ROUTING_REQUEST},
+		{TCP_PACKET_ROUTING_RESPONSE, 16},
+		{TCP_PACKET_DISCONNECT_NOTIFICATION},
+		{TCP_PACKET_PONG, 1},
+		append([]byte{TCP_PACKET_OOB_RECV}, pk.Bytes()...),
+		append(append([]byte{TCP_PACKET_OOB_SEND}, pk.Bytes()...), make([]byte, TCP_MAX_OOB_DATA_LENGTH+1)...),
+		{TCP_PACKET_ONION_REQUEST, 1, 2},
+		{TCP_PACKET_ONION_RESPONSE},
+	}
+	for _, plnpkt := range invalid {
+		if _, err := ParseTCPPacket(plnpkt); err == nil {
+			t.Error("invalid packet accepted:", plnpkt)
+		}
+	}
+}
+
+func FuzzParseTCPPacket(f *testing.F) {
+	pk, _, _ := NewCBKeyPair()
+	f.Add([]byte{TCP_PACKET_PING, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add(append([]byte{TCP_PACKET_ROUTING_RESPONSE, 16}, pk.Bytes()...))
+	f.Add(append(append([]byte{TCP_PACKET_OOB_SEND}, pk.Bytes()...), 1, 2))
+	f.Add([]byte{NUM_RESERVED_PORTS})
+	f.Fuzz(func(t *testing.T, plnpkt []byte) {
+		pkt, err := ParseTCPPacket(plnpkt)
+		if err != nil {
+			return
+		}
+		if pkt.Type != plnpkt[0] || len(pkt.Data) >= len(plnpkt) {
+			t.Error("parsed:", pkt.Type, len(pkt.Data), len(plnpkt))
+		}
+	})
+}
+
+// built-in handlers on a confirmed conn, a panic is recovered into error
+func FuzzDispatchPacket(f *testing.F) {
+	srvo := newTstServer()
+	c := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	f.Add([]byte{TCP_PACKET_PING, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add(append([]byte{TCP_PACKET_ROUTING_REQUEST}, srvo.Pubkey.Bytes()...))
+	f.Add([]byte{TCP_PACKET_DISCONNECT_NOTIFICATION, 16})
+	f.Add([]byte{TCP_PACKET_CAPABILITY, 0xFF})
+	f.Add([]byte{NUM_RESERVED_PORTS, 1})
+	f.Fuzz(func(t *testing.T, plnpkt []byte) {
+		if len(plnpkt) == 0 {
+			return // rejected before dispatch
+		}
+		if err := c.dispatchPacket(plnpkt); err != nil {
+			t.Error(err)
+		}
+		for len(c.cwctrlq) > 0 {
+			c.ctrlDequeued(<-c.cwctrlq)
+		}
+	})
+}
+
+func FuzzOpenTCPPacket(f *testing.F) {
+	shrkey, _, _ := NewCBKeyPair()
+	nonce := CBRandomNonce()
+	encpkt, _ := appendTCPPacket(nil, shrkey, nonce, []byte{TCP_PACKET_PING, 1, 2, 3, 4, 5, 6, 7, 8})
+	f.Add(encpkt)
+	f.Add(encpkt[:2+MAC_SIZE])
+	f.Fuzz(func(t *testing.T, encpkt []byte) {
+		rnonce := NewCBNonce(append([]byte{}, nonce.Bytes()...))
+		_, plain, err := openTCPPacket(nil, shrkey, rnonce, encpkt)
+		if err != nil {
+			if !bytes.Equal(rnonce.Bytes(), nonce.Bytes()) {
+				t.Error("nonce increased on error")
+			}
+			return
+		}
+		again, err := appendTCPPacket(nil, shrkey, nonce, plain)
+		if err == nil && !bytes.Equal(again, encpkt) {
+			t.Error("not the packet opened")
+		}
+	})
+}
+
+func FuzzParseTCPHandshakeRequest(f *testing.F) {
+	srvpk, srvsk, _ := NewCBKeyPair()
+	peer := newTstPeer(nil, nil, srvpk)
+	hspkt, _ := peer.GenerateHandshake()
+	f.Add(hspkt)
+	f.Add(make([]byte, TCP_CLIENT_HANDSHAKE_SIZE))
+	f.Fuzz(func(t *testing.T, hspkt []byte) {
+		req, err := ParseTCPHandshakeRequest(srvsk, hspkt)
+		if err != nil {
+			if !IsHandshakeError(err) {
+				t.Error("untyped handshake error:", err)
+			}
+			return
+		}
+		if !bytes.Equal(req.Pubkey.Bytes(), hspkt[:PUBLIC_KEY_SIZE]) {
+			t.Error("client pubkey")
+		}
+	})
+}
+
+func FuzzParseTCPHandshakeResponse(f *testing.F) {
+	shrkey, _, _ := NewCBKeyPair()
+	tmppk, _, _ := NewCBKeyPair()
+	nonce := CBRandomNonce()
+	encpkt, _ := EncryptDataSymmetric(shrkey, nonce, append(append([]byte{}, tmppk.Bytes()...), CBRandomNonce().Bytes()...))
+	f.Add(append(append([]byte{}, nonce.Bytes()...), encpkt...))
+	f.Add(make([]byte, TCP_SERVER_HANDSHAKE_SIZE))
+	f.Fuzz(func(t *testing.T, hspkt []byte) {
+		pubkey, recvNonce, err := ParseTCPHandshakeResponse(shrkey, hspkt)
+		if err != nil {
+			if !IsHandshakeError(err) {
+				t.Error("untyped handshake error:", err)
+			}
+			return
+		}
+		if pubkey == nil || recvNonce == nil {
+			t.Error("handshake response parsed empty")
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package mintox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TCP_PROXY_NONE   = 0
+	TCP_PROXY_HTTP   = 1
+	TCP_PROXY_SOCKS5 = 2
+)
+
+const (
+	SOCKS5_VERSION         = 5
+	SOCKS5_AUTH_NONE       = 0
+	SOCKS5_AUTH_PASSWORD   = 2
+	SOCKS5_AUTH_NO_METHODS = 0xff
+	SOCKS5_CMD_CONNECT     = 1
+	SOCKS5_ATYP_IPV4       = 1
+	SOCKS5_ATYP_DOMAIN     = 3
+	SOCKS5_ATYP_IPV6       = 4
+)
+
+const MAX_HTTP_PROXY_REPLY = 4096
+
+// proxy of outgoing TCP conns, like TCP_Proxy_Info of c
+type TCPProxyInfo struct {
+	Type     uint8 // TCP_PROXY_*
+	Host     string
+	Port     uint16
+	Username string // empty for no auth
+	Password string
+}
+
+func (this *TCPProxyInfo) Addr() string {
+	return net.JoinHostPort(this.Host, strconv.Itoa(int(this.Port)))
+}
+
+// connect to proxy and ask it to connect addr, the returned conn is ready for tox handshake
+func (this *TCPProxyInfo) Dial(addr string) (net.Conn, error) {
+	if this == nil || this.Type == TCP_PROXY_NONE {
+		return net.Dial("tcp", addr)
+	}
+	if this.Type != TCP_PROXY_HTTP && this.Type != TCP_PROXY_SOCKS5 {
+		return nil, errors.Errorf("Invalid proxy type: %d", this.Type)
+	}
+	c, err := net.Dial("tcp", this.Addr())
+	if err != nil {
+		return nil, err
+	}
+	if this.Type == TCP_PROXY_HTTP {
+		err = this.connectHTTP(c, addr)
+	} else {
+		err = this.connectSOCKS5(c, addr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, this.Addr())
+	}
+	return c, nil
+}
+
+func (this *TCPProxyInfo) connectHTTP(c net.Conn, addr string) error {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if this.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(this.Username + ":" + this.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	// read byte by byte, tox data may follow the header right after
+	rpl := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(rpl, []byte("\r\n\r\n")) {
+		if len(rpl) >= MAX_HTTP_PROXY_REPLY {
+			return errors.New("HTTP proxy reply too long")
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return err
+		}
+		rpl = append(rpl, b[0])
+	}
+	status := strings.Fields(string(rpl[:bytes.Index(rpl, []byte("\r\n"))]))
+	if len(status) < 2 || !strings.HasPrefix(status[0], "HTTP/1.") || status[1][0] != '2' {
+		return errors.Errorf("HTTP proxy refused: %s", strings.Join(status, " "))
+	}
+	return nil
+}
+
+func (this *TCPProxyInfo) connectSOCKS5(c net.Conn, addr string) error {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	method := byte(SOCKS5_AUTH_NONE)
+	if this.Username != "" {
+		method = SOCKS5_AUTH_PASSWORD
+	}
+	if _, err := c.Write([]byte{SOCKS5_VERSION, 1, method}); err != nil {
+		return err
+	}
+	rpl := make([]byte, 2)
+	if _, err := io.ReadFull(c, rpl); err != nil {
+		return err
+	}
+	if rpl[0] != SOCKS5_VERSION || rpl[1] != method {
+		return errors.Errorf("SOCKS5 method not accepted: %v", rpl)
+	}
+	if method == SOCKS5_AUTH_PASSWORD {
+		if len(this.Username) > 255 || len(this.Password) > 255 {
+			return errors.New("SOCKS5 username or password too long")
+		}
+		wbuf := bytes.NewBuffer([]byte{1, byte(len(this.Username))})
+		wbuf.WriteString(this.Username)
+		wbuf.WriteByte(byte(len(this.Password)))
+		wbuf.WriteString(this.Password)
+		if _, err := c.Write(wbuf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, rpl); err != nil {
+			return err
+		}
+		if rpl[1] != 0 {
+			return errors.Errorf("SOCKS5 auth failed: %d", rpl[1])
+		}
+	}
+
+	wbuf := bytes.NewBuffer([]byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0})
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		wbuf.WriteByte(SOCKS5_ATYP_IPV4)
+		wbuf.Write(ip.To4())
+	case ip != nil:
+		wbuf.WriteByte(SOCKS5_ATYP_IPV6)
+		wbuf.Write(ip.To16())
+	default:
+		if len(host) > 255 {
+			return errors.New("SOCKS5 host too long")
+		}
+		wbuf.WriteByte(SOCKS5_ATYP_DOMAIN)
+		wbuf.WriteByte(byte(len(host)))
+		wbuf.WriteString(host)
+	}
+	binary.Write(wbuf, binary.BigEndian, uint16(port))
+	if _, err := c.Write(wbuf.Bytes()); err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != SOCKS5_VERSION || hdr[1] != 0 {
+		return errors.Errorf("SOCKS5 connect failed: %d", hdr[1])
+	}
+	// skip bound address and port
+	var alen int
+	switch hdr[3] {
+	case SOCKS5_ATYP_IPV4:
+		alen = net.IPv4len
+	case SOCKS5_ATYP_IPV6:
+		alen = net.IPv6len
+	case SOCKS5_ATYP_DOMAIN:
+		if _, err := io.ReadFull(c, hdr[:1]); err != nil {
+			return err
+		}
+		alen = int(hdr[0])
+	default:
+		return errors.Errorf("SOCKS5 invalid address type: %d", hdr[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, alen+2))
+	return err
+}
@@ -0,0 +1,170 @@
+package mintox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// minimal proxy server, reqC gets the requested target and the auth seen
+type tstProxy struct {
+	lsner net.Listener
+	typ   uint8
+	reqC  chan [2]string
+}
+
+func newTstProxy(t *testing.T, typ uint8) *tstProxy {
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	this := &tstProxy{lsner: lsner, typ: typ, reqC: make(chan [2]string, 4)}
+	go func() {
+		for {
+			c, err := lsner.Accept()
+			if err != nil {
+				return
+			}
+			go this.serve(c)
+		}
+	}()
+	return this
+}
+
+func (this *tstProxy) info(user, pass string) *TCPProxyInfo {
+	addr := this.lsner.Addr().(*net.TCPAddr)
+	return &TCPProxyInfo{this.typ, addr.IP.String(), uint16(addr.Port), user, pass}
+}
+
+func (this *tstProxy) serve(c net.Conn) {
+	defer c.Close()
+	var target, auth string
+	rd := bufio.NewReader(c)
+	if this.typ == TCP_PROXY_HTTP {
+		req, err := http.ReadRequest(rd)
+		if err != nil || req.Method != "CONNECT" {
+			return
+		}
+		target, auth = req.Host, req.Header.Get("Proxy-Authorization")
+	} else {
+		hdr := make([]byte, 3)
+		io.ReadFull(rd, hdr)
+		c.Write([]byte{SOCKS5_VERSION, hdr[2]})
+		if hdr[2] == SOCKS5_AUTH_PASSWORD {
+			b := make([]byte, 2)
+			io.ReadFull(rd, b)
+			user := make([]byte, b[1])
+			io.ReadFull(rd, user)
+			io.ReadFull(rd, b[:1])
+			pass := make([]byte, b[0])
+			io.ReadFull(rd, pass)
+			auth = string(user) + ":" + string(pass)
+			c.Write([]byte{1, 0})
+		}
+		req := make([]byte, 4+net.IPv4len+2)
+		if _, err := io.ReadFull(rd, req); err != nil || req[3] != SOCKS5_ATYP_IPV4 {
+			return
+		}
+		port := binary.BigEndian.Uint16(req[8:])
+		target = net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(port)))
+	}
+	this.reqC <- [2]string{target, auth}
+
+	tc, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer tc.Close()
+	if this.typ == TCP_PROXY_HTTP {
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	} else {
+		c.Write([]byte{SOCKS5_VERSION, 0, 0, SOCKS5_ATYP_IPV4, 127, 0, 0, 1, 0, 1})
+	}
+	go io.Copy(tc, rd)
+	io.Copy(c, tc)
+}
+
+func TestTCPClientProxy(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+
+	for _, tc := range []struct {
+		typ        uint8
+		user, pass string
+		auth       string
+	}{
+		{TCP_PROXY_SOCKS5, "", "", ""},
+		{TCP_PROXY_SOCKS5, "u", "p", "u:p"},
+		{TCP_PROXY_HTTP, "", "", ""},
+		{TCP_PROXY_HTTP, "u", "p", "Basic dTpw"},
+	} {
+		proxy := newTstProxy(t, tc.typ)
+		pk, sk, _ := NewCBKeyPair()
+		cli := NewTCPClientProxy(lsner.Addr().String(), srvo.Pubkey, pk, sk, proxy.info(tc.user, tc.pass))
+		select {
+		case req := <-proxy.reqC:
+			if req[0] != lsner.Addr().String() || req[1] != tc.auth {
+				t.Error("proxy request:", tc.typ, req)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("no proxy request:", tc.typ)
+		}
+		if !waitTstCond(3*time.Second, func() bool { return cli.Status == TCP_CLIENT_CONFIRMED }) {
+			t.Error("not confirmed through proxy:", tc.typ, tcpstname(cli.Status))
+		}
+		cli.Close()
+		proxy.lsner.Close()
+	}
+
+	if _, err := (&TCPProxyInfo{Type: 9}).Dial(lsner.Addr().String()); err == nil {
+		t.Error("invalid proxy type dialed")
+	}
+}
+
+func TestProxyDisablesUDP(t *testing.T) {
+	nc := newTstNetCrypto(defaultClock)
+	defer nc.neto.srv.Close()
+	defer nc.Kill()
+	dhto := &DHT{Neto: nc.neto}
+	fcs := NewFriendConns(nc, dhto)
+	defer fcs.Kill()
+
+	fcs.SetProxy(&TCPProxyInfo{TCP_PROXY_SOCKS5, "127.0.0.1", 1, "", ""})
+	if nc.neto.UDPEnabled() {
+		t.Fatal("UDP enabled with proxy")
+	}
+	if _, err := nc.neto.WriteTo([]byte{0}, nc.tstAddr()); err == nil {
+		t.Error("UDP sent while disabled")
+	}
+	if dhto.BootstrapFromAddr("127.0.0.1:33445", nc.dhtpk.ToHex()) == nil {
+		t.Error("dht bootstrapped by UDP while disabled")
+	}
+	// bootstrap node taken as relay instead
+	if err := fcs.Bootstrap("127.0.0.1:1", nc.dhtpk); err != nil {
+		t.Fatal(err)
+	}
+	relays := fcs.snapRelays()
+	if len(relays) != 1 || relays[0].Proxy == nil {
+		t.Error("bootstrap relay:", relays)
+	}
+	relays[0].Close()
+
+	fcs.SetProxy(nil)
+	if !nc.neto.UDPEnabled() {
+		t.Error("UDP not enabled without proxy")
+	}
+}
@@ -0,0 +1,363 @@
+package mintox
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"gopp"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// QUIC transport of relay conns, experimental, the quic-go binding is built
+// with -tags mintoxquic (tcp_quic_enabled.go).
+//
+// One QUIC connection is one relay conn. Its first bidi stream, opened by
+// the client, is the byte stream of TCP: handshake, control, onion and oob,
+// so the secure conn layer runs unchanged on it. Once confirmed, routed data
+// of each connid goes on a unidirectional stream of its own, a lost packet
+// of one friend no longer stalls the others behind it:
+//   data stream => nonce(24) | length + encrypted packet ...
+// Packets are those of the control stream, the stream counts its own nonce
+// from the random one, keyed by the session key at confirm. A re-handshake
+// renews the control stream only, data keys are protected by QUIC's TLS too.
+
+const TCP_QUIC_ALPN = "mintox-relay"
+const TCP_QUIC_HANDSHAKE_TIMEOUT = 10 // seconds
+const TCP_QUIC_MAX_DATA_STREAMS = 256 // one per connid
+
+// set by the quic-go binding, nil when not built in
+var quicListenSessions func(addr string, tlscfg *tls.Config) (quicSessionListener, error)
+var quicDialSession func(addr string, tlscfg *tls.Config) (quicSession, error)
+
+func isQUICEnabled() bool { return quicListenSessions != nil && quicDialSession != nil }
+
+func isQUICURL(addr string) bool { return strings.HasPrefix(addr, "quic://") }
+
+// the part of a QUIC connection used, so the mux runs on fakes in test
+type quicSession interface {
+	OpenStream() (quicStream, error)
+	AcceptStream() (quicStream, error)
+	OpenUniStream() (io.WriteCloser, error)
+	AcceptUniStream() (io.Reader, error)
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+type quicStream interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+type quicSessionListener interface {
+	Accept() (quicSession, error)
+	Addr() net.Addr
+	Close() error
+}
+
+// net.Conn of the control stream, plus data streams
+type quicConn struct {
+	quicStream
+	sess      quicSession
+	closeOnce sync.Once
+
+	datamu sync.Mutex
+	shrkey *CryptoKey // of data streams, nil before started
+	sends  map[uint8]*quicDataStream
+}
+
+type quicDataStream struct {
+	mu    sync.Mutex
+	w     io.WriteCloser
+	nonce *CBNonce
+	err   error // first write failure, stream unusable then
+}
+
+func newQUICConn(sess quicSession, ctrl quicStream) *quicConn {
+	return &quicConn{quicStream: ctrl, sess: sess, sends: map[uint8]*quicDataStream{}}
+}
+
+func (this *quicConn) LocalAddr() net.Addr  { return this.sess.LocalAddr() }
+func (this *quicConn) RemoteAddr() net.Addr { return this.sess.RemoteAddr() }
+
+func (this *quicConn) Close() (err error) {
+	this.closeOnce.Do(func() {
+		this.quicStream.Close()
+		err = this.sess.Close()
+	})
+	return
+}
+
+// start data streams by the session key, ondata gets routed data packets
+// decrypted, connid first, from a goroutine of each stream. Once only.
+func (this *quicConn) startData(shrkey *CryptoKey, ondata func(plnpkt []byte, wirelen int)) {
+	this.datamu.Lock()
+	started := this.shrkey != nil
+	if !started {
+		this.shrkey = shrkey
+	}
+	this.datamu.Unlock()
+	if !started {
+		go this.acceptDataLoop(shrkey, ondata)
+	}
+}
+
+func (this *quicConn) acceptDataLoop(shrkey *CryptoKey, ondata func(plnpkt []byte, wirelen int)) {
+	for {
+		r, err := this.sess.AcceptUniStream()
+		if err != nil {
+			return // session closed
+		}
+		go this.readDataStream(r, shrkey, ondata)
+	}
+}
+
+// a bad packet closes the whole conn, only the peer has the key to make one
+func (this *quicConn) readDataStream(r io.Reader, shrkey *CryptoKey, ondata func(plnpkt []byte, wirelen int)) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, NONCE_SIZE)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return
+	}
+	nonce := NewCBNonce(hdr)
+	frame := make([]byte, 2+MAX_PACKET_SIZE)
+	for {
+		if _, err := io.ReadFull(br, frame[:2]); err != nil {
+			return
+		}
+		pktlen := binary.BigEndian.Uint16(frame)
+		if pktlen > MAX_PACKET_SIZE || pktlen < MAC_SIZE {
+			log.Println("Invalid quic data packet length, close:", pktlen, this.RemoteAddr())
+			this.Close()
+			return
+		}
+		if _, err := io.ReadFull(br, frame[2:2+pktlen]); err != nil {
+			return
+		}
+		_, plnpkt, err := openTCPPacket(nil, shrkey, nonce, frame[:2+pktlen])
+		if err == nil && (len(plnpkt) == 0 || plnpkt[0] < NUM_RESERVED_PORTS) {
+			err = errors.New("Not a routed data packet")
+		}
+		if err != nil {
+			log.Println("Bad quic data packet, close:", err, this.RemoteAddr())
+			this.Close()
+			return
+		}
+		ondata(plnpkt, 2+int(pktlen))
+	}
+}
+
+// routed data on the stream of its connid. false when data streams not
+// started yet, the control stream is used then.
+func (this *quicConn) writeData(plnpkt []byte) (int, bool, error) {
+	this.datamu.Lock()
+	shrkey := this.shrkey
+	if shrkey == nil {
+		this.datamu.Unlock()
+		return 0, false, nil
+	}
+	connid := plnpkt[0]
+	ds, ok := this.sends[connid]
+	if !ok {
+		ds = &quicDataStream{}
+		this.sends[connid] = ds
+	}
+	ds.mu.Lock() // before datamu released, so opened once
+	this.datamu.Unlock()
+	defer ds.mu.Unlock()
+
+	if ds.err != nil {
+		return 0, true, ds.err
+	}
+	buf := getTCPBuf()
+	defer putTCPBuf(buf)
+	pkt := (*buf)[:0]
+	if ds.w == nil {
+		if ds.w, ds.err = this.sess.OpenUniStream(); ds.err != nil {
+			return 0, true, ds.err
+		}
+		ds.nonce = CBRandomNonce()
+		pkt = append(pkt, ds.nonce.Bytes()...)
+	}
+	pkt, err := appendTCPPacket(pkt, shrkey, ds.nonce, plnpkt)
+	if err != nil {
+		return 0, true, err
+	}
+	wn, err := ds.w.Write(pkt)
+	if err != nil {
+		ds.err = err
+		return wn, true, err
+	}
+	ds.nonce.Incr()
+	return wn, true, nil
+}
+
+type quicAccepted struct {
+	c   net.Conn
+	err error
+}
+
+// net.Listener of relay conns over QUIC sessions, the first stream of each
+// awaited concurrently like wsListener.
+type quicListener struct {
+	sl        quicSessionListener
+	connC     chan quicAccepted
+	stopC     chan struct{}
+	closeOnce sync.Once
+}
+
+func newQUICListener(sl quicSessionListener) net.Listener {
+	this := &quicListener{sl: sl}
+	this.connC = make(chan quicAccepted)
+	this.stopC = make(chan struct{})
+	go this.doAccept()
+	return this
+}
+
+// ListenQUIC serves relay conns on udp addr, tlscfg of newTCPTLSConfig
+func ListenQUIC(addr string, tlscfg *tls.Config) (net.Listener, error) {
+	if !isQUICEnabled() {
+		return nil, errors.New("QUIC not built in, need build tag mintoxquic")
+	}
+	tlscfg = tlscfg.Clone()
+	tlscfg.NextProtos = []string{TCP_QUIC_ALPN}
+	sl, err := quicListenSessions(addr, tlscfg)
+	if err != nil {
+		return nil, err
+	}
+	return newQUICListener(sl), nil
+}
+
+func (this *quicListener) doAccept() {
+	for {
+		sess, err := this.sl.Accept()
+		if err != nil {
+			select {
+			case this.connC <- quicAccepted{nil, err}:
+			case <-this.stopC:
+			}
+			return
+		}
+		go this.acceptControl(sess)
+	}
+}
+
+func (this *quicListener) acceptControl(sess quicSession) {
+	ctrlC := make(chan quicStream, 1)
+	go func() {
+		ctrl, err := sess.AcceptStream()
+		gopp.ErrPrint(err, sess.RemoteAddr())
+		ctrlC <- ctrl
+	}()
+	var ctrl quicStream
+	select {
+	case ctrl = <-ctrlC:
+	case <-time.After(TCP_QUIC_HANDSHAKE_TIMEOUT * time.Second):
+	case <-this.stopC:
+	}
+	if ctrl == nil {
+		sess.Close()
+		return
+	}
+	select {
+	case this.connC <- quicAccepted{newQUICConn(sess, ctrl), nil}:
+	case <-this.stopC:
+		sess.Close()
+	}
+}
+
+func (this *quicListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-this.connC:
+		return a.c, a.err
+	case <-this.stopC:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+func (this *quicListener) Addr() net.Addr { return this.sl.Addr() }
+
+func (this *quicListener) Close() error {
+	this.closeOnce.Do(func() { close(this.stopC) })
+	return this.sl.Close()
+}
+
+// dial a quic://host:port relay, no proxy over udp.
+// Certificate not checked, the Tox handshake authenticates the server.
+func DialQUIC(addr string, proxy *TCPProxyInfo) (net.Conn, error) {
+	if !isQUICEnabled() {
+		return nil, errors.New("QUIC not built in, need build tag mintoxquic")
+	}
+	if proxy != nil && proxy.Type != TCP_PROXY_NONE {
+		return nil, errors.New("QUIC can not go by tcp proxy")
+	}
+	hostport := strings.TrimPrefix(addr, "quic://")
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	tlscfg := &tls.Config{ServerName: host, NextProtos: []string{TCP_QUIC_ALPN}}
+	tlscfg.InsecureSkipVerify = true
+	sess, err := quicDialSession(hostport, tlscfg)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	ctrl, err := sess.OpenStream()
+	if err != nil {
+		sess.Close()
+		return nil, errors.Wrap(err, addr)
+	}
+	return newQUICConn(sess, ctrl), nil
+}
+
+/////
+
+func (this *TCPSecureConn) startQUICData() {
+	if qc, ok := this.Sock.(*quicConn); ok {
+		qc.startData(this.Shrkey, this.handleQUICData)
+	}
+}
+
+// routed data from a data stream, read state shared with the read goroutine by rdmu
+func (this *TCPSecureConn) handleQUICData(plnpkt []byte, wirelen int) {
+	atomic.StoreInt64(&this.lastRecvAt, time.Now().UnixNano())
+	atomic.AddInt64(&this.recvBytes, int64(wirelen))
+	atomic.AddInt64(&this.recvPkts, 1)
+	if this.srvo != nil {
+		atomic.AddInt64(&this.srvo.cnts.BytesRecv, int64(wirelen))
+	}
+	this.emitNetRecv(wirelen)
+
+	this.rdmu.Lock()
+	defer this.rdmu.Unlock()
+	if ok, err := this.allowRecv(plnpkt); err != nil {
+		this.doClose(true, err.Error())
+		return
+	} else if !ok {
+		return
+	}
+	if this.srvo != nil {
+		this.srvo.countPacket(plnpkt[0])
+	}
+	this.sniff(plnpkt)
+	this.tapPacket(TCP_TAP_RECV, plnpkt)
+	if err := this.dispatchPacket(plnpkt); err != nil {
+		this.doClose(true, err.Error())
+	}
+}
+
+func (this *TCPClient) startQUICData() {
+	if qc, ok := this.conn.(*quicConn); ok {
+		qc.startData(this.Shrkey, func(plnpkt []byte, _ int) { this.HandleRoutingData(plnpkt) })
+	}
+}
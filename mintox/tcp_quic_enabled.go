@@ -0,0 +1,107 @@
+//go:build mintoxquic
+// +build mintoxquic
+
+package mintox
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quic-go binding of the QUIC transport, see tcp_quic.go
+
+func init() {
+	quicListenSessions = quicGoListen
+	quicDialSession = quicGoDial
+}
+
+func quicGoConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:  TCP_QUIC_HANDSHAKE_TIMEOUT * time.Second,
+		MaxIdleTimeout:        (TCP_PING_FREQUENCY + TCP_PING_TIMEOUT) * time.Second, // tox pings keep it
+		MaxIncomingStreams:    1,
+		MaxIncomingUniStreams: TCP_QUIC_MAX_DATA_STREAMS,
+	}
+}
+
+type quicGoListener struct {
+	ln *quic.Listener
+}
+
+func quicGoListen(addr string, tlscfg *tls.Config) (quicSessionListener, error) {
+	ln, err := quic.ListenAddr(addr, tlscfg, quicGoConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &quicGoListener{ln}, nil
+}
+
+func (this *quicGoListener) Accept() (quicSession, error) {
+	conn, err := this.ln.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicGoSession{conn}, nil
+}
+
+func (this *quicGoListener) Addr() net.Addr { return this.ln.Addr() }
+func (this *quicGoListener) Close() error   { return this.ln.Close() }
+
+func quicGoDial(addr string, tlscfg *tls.Config) (quicSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TCP_QUIC_HANDSHAKE_TIMEOUT*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, tlscfg, quicGoConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &quicGoSession{conn}, nil
+}
+
+type quicGoSession struct {
+	conn quic.Connection
+}
+
+// stream is announced to the peer by its first write, the handshake
+func (this *quicGoSession) OpenStream() (quicStream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TCP_QUIC_HANDSHAKE_TIMEOUT*time.Second)
+	defer cancel()
+	s, err := this.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (this *quicGoSession) AcceptStream() (quicStream, error) {
+	s, err := this.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// blocks while the peer's stream limit reached, one per connid never does
+func (this *quicGoSession) OpenUniStream() (io.WriteCloser, error) {
+	s, err := this.conn.OpenUniStreamSync(this.conn.Context())
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (this *quicGoSession) AcceptUniStream() (io.Reader, error) {
+	s, err := this.conn.AcceptUniStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (this *quicGoSession) LocalAddr() net.Addr  { return this.conn.LocalAddr() }
+func (this *quicGoSession) RemoteAddr() net.Addr { return this.conn.RemoteAddr() }
+func (this *quicGoSession) Close() error         { return this.conn.CloseWithError(0, "") }
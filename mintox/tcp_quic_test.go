@@ -0,0 +1,307 @@
+package mintox
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// in memory QUIC session, net.Pipe control stream and io.Pipe data streams
+type tstQUICSession struct {
+	laddr, raddr net.Addr
+	peer         *tstQUICSession
+	streamC      chan quicStream
+	uniC         chan io.Reader
+	closeC       chan struct{}
+	closeOnce    *sync.Once // shared by both sides
+	unis         int32      // opened data streams
+
+	mu      *sync.Mutex
+	closers *[]io.Closer
+}
+
+func newTstQUICSessionPair(port int) (cli, srv *tstQUICSession) {
+	closeC := make(chan struct{})
+	once, mu, closers := &sync.Once{}, &sync.Mutex{}, &[]io.Closer{}
+	caddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	saddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445}
+	cli = &tstQUICSession{laddr: caddr, raddr: saddr, closeC: closeC, closeOnce: once, mu: mu, closers: closers}
+	srv = &tstQUICSession{laddr: saddr, raddr: caddr, closeC: closeC, closeOnce: once, mu: mu, closers: closers}
+	for _, s := range []*tstQUICSession{cli, srv} {
+		s.streamC = make(chan quicStream, 4)
+		s.uniC = make(chan io.Reader, TCP_QUIC_MAX_DATA_STREAMS)
+	}
+	cli.peer, srv.peer = srv, cli
+	return
+}
+
+func (this *tstQUICSession) track(cs ...io.Closer) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	select {
+	case <-this.closeC:
+		return errors.New("session closed")
+	default:
+	}
+	*this.closers = append(*this.closers, cs...)
+	return nil
+}
+
+func (this *tstQUICSession) OpenStream() (quicStream, error) {
+	c0, c1 := net.Pipe()
+	if err := this.track(c0, c1); err != nil {
+		return nil, err
+	}
+	this.peer.streamC <- c1
+	return c0, nil
+}
+
+func (this *tstQUICSession) AcceptStream() (quicStream, error) {
+	select {
+	case s := <-this.streamC:
+		return s, nil
+	case <-this.closeC:
+		return nil, errors.New("session closed")
+	}
+}
+
+func (this *tstQUICSession) OpenUniStream() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	if err := this.track(r, w); err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&this.unis, 1)
+	this.peer.uniC <- r
+	return w, nil
+}
+
+func (this *tstQUICSession) AcceptUniStream() (io.Reader, error) {
+	select {
+	case r := <-this.uniC:
+		return r, nil
+	case <-this.closeC:
+		return nil, errors.New("session closed")
+	}
+}
+
+func (this *tstQUICSession) LocalAddr() net.Addr  { return this.laddr }
+func (this *tstQUICSession) RemoteAddr() net.Addr { return this.raddr }
+
+func (this *tstQUICSession) Close() error {
+	this.closeOnce.Do(func() {
+		this.mu.Lock()
+		close(this.closeC)
+		cs := *this.closers
+		this.mu.Unlock()
+		for _, c := range cs {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+func (this *tstQUICSession) closed() bool {
+	select {
+	case <-this.closeC:
+		return true
+	default:
+		return false
+	}
+}
+
+type tstQUICListener struct {
+	sessC chan quicSession
+	stopC chan struct{}
+	once  sync.Once
+}
+
+func (this *tstQUICListener) Accept() (quicSession, error) {
+	select {
+	case s := <-this.sessC:
+		return s, nil
+	case <-this.stopC:
+		return nil, errors.New("listener closed")
+	}
+}
+func (this *tstQUICListener) Addr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445}
+}
+func (this *tstQUICListener) Close() error {
+	this.once.Do(func() { close(this.stopC) })
+	return nil
+}
+
+// dials reach the listener, restore by the returned func
+func setTstQUIC(t *testing.T) (*tstQUICListener, *[]*tstQUICSession, func()) {
+	tl := &tstQUICListener{sessC: make(chan quicSession, 8), stopC: make(chan struct{})}
+	var mu sync.Mutex
+	srvsesses := &[]*tstQUICSession{}
+	port := 50000
+	oldListen, oldDial := quicListenSessions, quicDialSession
+	quicListenSessions = func(string, *tls.Config) (quicSessionListener, error) { return tl, nil }
+	quicDialSession = func(addr string, tlscfg *tls.Config) (quicSession, error) {
+		if len(tlscfg.NextProtos) != 1 || tlscfg.NextProtos[0] != TCP_QUIC_ALPN {
+			t.Error("quic alpn:", tlscfg.NextProtos)
+		}
+		mu.Lock()
+		port++
+		cli, srv := newTstQUICSessionPair(port)
+		*srvsesses = append(*srvsesses, srv)
+		mu.Unlock()
+		tl.sessC <- srv
+		return cli, nil
+	}
+	return tl, srvsesses, func() { quicListenSessions, quicDialSession = oldListen, oldDial }
+}
+
+func TestQUICRelay(t *testing.T) {
+	tl, srvsesses, restore := setTstQUIC(t)
+	defer restore()
+	cfg := DefaultTCPServerConfig()
+	_, cfg.Seckey, _ = NewCBKeyPair()
+	srvo, err := NewTCPServerWithListenersConfig([]net.Listener{newQUICListener(tl)}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	clis := make([]*TCPClient, 3)
+	for i := range clis {
+		pk, sk, _ := NewCBKeyPair()
+		clis[i] = NewTCPClient("quic://127.0.0.1:33445", srvo.Pubkey, pk, sk)
+		defer clis[i].Close()
+	}
+	dataC := make(chan string, 16)
+	clis[0].OnData = func(pk *CryptoKey, data []byte) { dataC <- string(data) }
+	for i := 1; i < len(clis); i++ {
+		clis[0].AddPeer(clis[i].SelfPubkey)
+		clis[i].AddPeer(clis[0].SelfPubkey)
+	}
+	// both senders reach clis[0], each by its own server data stream
+	got := map[string]bool{}
+	for btime := time.Now(); len(got) < 2 && time.Since(btime) < 5*time.Second; {
+		for i := 1; i < len(clis); i++ {
+			if !got[string('0'+rune(i))] {
+				clis[i].SendData(clis[0].SelfPubkey, []byte{byte('0' + i)})
+			}
+		}
+		select {
+		case data := <-dataC:
+			got[data] = true
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if len(got) != 2 {
+		t.Fatal("data not routed over quic:", got)
+	}
+	c0 := srvo.confirmedConn(clis[0].SelfPubkey)
+	if c0 == nil {
+		t.Fatal("clis[0] not confirmed on server")
+	}
+	var srvsess *tstQUICSession
+	for _, s := range *srvsesses {
+		if s.raddr.String() == c0.Sock.RemoteAddr().String() {
+			srvsess = s
+		}
+	}
+	if srvsess == nil || atomic.LoadInt32(&srvsess.unis) != 2 {
+		t.Error("data streams to clis[0]:", srvsess)
+	}
+	if st, _ := srvo.ConnStats(clis[1].SelfPubkey); st.BytesRecv == 0 {
+		t.Error("quic data not counted")
+	}
+}
+
+func tstQUICConnPair() (a, b *quicConn, sa, sb *tstQUICSession) {
+	sa, sb = newTstQUICSessionPair(50000)
+	ca, cb := net.Pipe()
+	sa.track(ca, cb)
+	return newQUICConn(sa, ca), newQUICConn(sb, cb), sa, sb
+}
+
+// a stalled connid never blocks the others
+func TestQUICDataStreams(t *testing.T) {
+	a, b, sa, _ := tstQUICConnPair()
+	defer a.Close()
+	_, key, _ := NewCBKeyPair()
+
+	if _, ok, _ := a.writeData([]byte{NUM_RESERVED_PORTS, 1}); ok {
+		t.Error("data stream before started")
+	}
+	stallC := make(chan struct{})
+	dataC := make(chan []byte, 16)
+	b.startData(key, func(plnpkt []byte, wirelen int) {
+		if wirelen != 2+MAC_SIZE+len(plnpkt) {
+			t.Error("wire length:", wirelen)
+		}
+		if plnpkt[0] == NUM_RESERVED_PORTS {
+			<-stallC
+		}
+		dataC <- plnpkt
+	})
+	a.startData(key, nil)
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			a.writeData([]byte{NUM_RESERVED_PORTS, byte(i)})
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if _, ok, err := a.writeData([]byte{NUM_RESERVED_PORTS + 1, byte(i)}); !ok || err != nil {
+			t.Fatal("write data:", ok, err)
+		}
+		select {
+		case plnpkt := <-dataC:
+			if plnpkt[0] != NUM_RESERVED_PORTS+1 || plnpkt[1] != byte(i) {
+				t.Fatal("data:", plnpkt)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("blocked by stalled connid")
+		}
+	}
+	close(stallC)
+	for i := 0; i < 4; i++ {
+		select {
+		case plnpkt := <-dataC:
+			if plnpkt[0] != NUM_RESERVED_PORTS || plnpkt[1] != byte(i) {
+				t.Fatal("stalled data:", plnpkt)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("stalled data lost")
+		}
+	}
+	if n := atomic.LoadInt32(&sa.unis); n != 2 {
+		t.Error("data streams:", n)
+	}
+
+	// forged packet closes the conn
+	w, _ := sa.OpenUniStream()
+	w.Write(append(CBRandomNonce().Bytes(), 0, MAC_SIZE+1))
+	w.Write(make([]byte, MAC_SIZE+1))
+	if !waitTstCond(3*time.Second, sa.closed) {
+		t.Error("forged data packet accepted")
+	}
+}
+
+func TestQUICDisabled(t *testing.T) {
+	if isQUICEnabled() {
+		t.Skip("built with mintoxquic")
+	}
+	if _, err := DialQUIC("quic://127.0.0.1:33445", nil); err == nil {
+		t.Error("dial without quic built in")
+	}
+	cfg := DefaultTCPServerConfig()
+	cfg.QUICPorts = []uint16{33445}
+	if err := cfg.Validate(); err == nil {
+		t.Error("quic_ports without quic built in")
+	}
+}
@@ -0,0 +1,242 @@
+package mintox
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Bytes on wire per client pubkey, summed over its conns and kept over
+// reconnects while the relay runs. With quota_daily_bytes or
+// quota_monthly_bytes a client over quota has its relayed packets throttled
+// to quota_throttle_bytes_per_sec, or is disconnected, new conns too, till
+// the day or month ends. Days and months in UTC. Counted once a second.
+
+const (
+	TCP_QUOTA_THROTTLE   = "throttle"   // rate limit relayed packets
+	TCP_QUOTA_DISCONNECT = "disconnect" // close conns till period end
+)
+
+var tcpquotapolicies = map[string]bool{TCP_QUOTA_THROTTLE: true, TCP_QUOTA_DISCONNECT: true}
+
+const TCP_QUOTA_THROTTLE_RATE = 4096 // bytes per second of relayed packets over quota
+
+// usages kept at most, the offline one of least bytes this month goes first
+var tcpQuotaMaxUsages = 1 << 16
+
+// usage of one client pubkey, usagemu
+type tcpUsage struct {
+	pubkey     *CryptoKey
+	recv, sent int64 // total
+	day, month int64 // recv and sent in current period
+	dayKey     int   // yyyymmdd of day
+	monthKey   int   // yyyymm of month
+	conns      int   // conns counted to it, offline when 0
+}
+
+func tcpQuotaPeriods(now time.Time) (day, month int) {
+	y, m, d := now.UTC().Date()
+	return y*10000 + int(m)*100 + d, y*100 + int(m)
+}
+
+func (this *tcpUsage) rollover(day, month int) {
+	if this.dayKey != day {
+		this.dayKey, this.day = day, 0
+	}
+	if this.monthKey != month {
+		this.monthKey, this.month = month, 0
+	}
+}
+
+func (this *tcpUsage) add(recv, sent int64) {
+	this.recv += recv
+	this.sent += sent
+	this.day += recv + sent
+	this.month += recv + sent
+}
+
+func (this *tcpUsage) overQuota(cfg *TCPServerConfig) bool {
+	return (cfg.QuotaDailyBytes > 0 && this.day >= cfg.QuotaDailyBytes) ||
+		(cfg.QuotaMonthlyBytes > 0 && this.month >= cfg.QuotaMonthlyBytes)
+}
+
+// usage of a client pubkey, from any of its conns till now
+type TCPClientUsage struct {
+	Pubkey     *CryptoKey
+	BytesRecv  int64 // on wire since relay started, include handshake and ping
+	BytesSent  int64
+	DayBytes   int64 // recv and sent today
+	MonthBytes int64 // recv and sent this month
+	OverQuota  bool
+	Online     bool
+}
+
+// usagemu locked
+func (this *TCPServer) usageLocked(pubkey *CryptoKey, now time.Time) *tcpUsage {
+	u, ok := this.usages[pubkey.BinStr()]
+	if !ok {
+		if len(this.usages) >= tcpQuotaMaxUsages {
+			this.evictUsageLocked(now)
+		}
+		u = &tcpUsage{pubkey: pubkey}
+		this.usages[pubkey.BinStr()] = u
+	}
+	u.rollover(tcpQuotaPeriods(now))
+	return u
+}
+
+// drop usage of the offline client of least bytes this month, usagemu locked
+func (this *TCPServer) evictUsageLocked(now time.Time) {
+	day, month := tcpQuotaPeriods(now)
+	var binpk0 string
+	var u0 *tcpUsage
+	for binpk, u := range this.usages {
+		if u.conns > 0 {
+			continue
+		}
+		u.rollover(day, month)
+		if u0 == nil || u.month < u0.month {
+			binpk0, u0 = binpk, u
+		}
+	}
+	if u0 != nil {
+		delete(this.usages, binpk0)
+	}
+}
+
+// add bytes of c since last flush to its usage, usagemu locked
+func (this *TCPSecureConn) flushUsageLocked() {
+	if this.usage == nil {
+		return
+	}
+	recv, sent := this.RecvBytes(), this.SentBytes()
+	this.usage.add(recv-this.usageRecv, sent-this.usageSent)
+	this.usageRecv, this.usageSent = recv, sent
+}
+
+// confirmed c counted to usage of its pubkey, connmu locked
+func (this *TCPServer) quotaConfirmed(c *TCPSecureConn) {
+	this.usagemu.Lock()
+	u := this.usageLocked(c.Pubkey, this.clock.Now())
+	u.conns++
+	c.usage, c.usageRecv, c.usageSent = u, 0, 0
+	over := u.overQuota(this.config())
+	this.usagemu.Unlock()
+	this.applyQuota(c, over)
+}
+
+// last bytes of closed c
+func (this *TCPServer) quotaClosed(c *TCPSecureConn) {
+	this.usagemu.Lock()
+	c.flushUsageLocked()
+	if c.usage != nil {
+		c.usage.conns--
+	}
+	c.usage = nil
+	this.usagemu.Unlock()
+}
+
+// throttle or close c over quota, throttle off when not
+func (this *TCPServer) applyQuota(c *TCPSecureConn, over bool) {
+	if over && this.config().QuotaPolicy == TCP_QUOTA_DISCONNECT {
+		atomic.AddInt64(&this.cnts.QuotaKicked, 1)
+		this.logr().Info("Over quota, disconnect", "pubkey", c.Pubkey.ToHex20(), "addr", c.Sock.RemoteAddr())
+		go c.doClose(true, TCP_CLOSE_QUOTA) // connmu may be held
+		return
+	}
+	var v int32
+	if over {
+		v = 1
+	}
+	if atomic.SwapInt32(&c.overQuota, v) != v && over {
+		this.logr().Info("Over quota, throttle", "pubkey", c.Pubkey.ToHex20(), "addr", c.Sock.RemoteAddr())
+	}
+}
+
+func (this *TCPServer) runQuotaGC() {
+	tickC, tickStop := this.clock.Tick(time.Second)
+	defer tickStop()
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case <-tickC:
+		}
+		this.updateUsage(this.clock.Now())
+	}
+}
+
+// count bytes of confirmed conns, apply quota, drop usage of offline
+// clients of past months
+func (this *TCPServer) updateUsage(now time.Time) {
+	conns := this.confirmedConns()
+	cfg := this.config()
+	day, month := tcpQuotaPeriods(now)
+	overs := make([]bool, len(conns))
+	online := map[string]bool{}
+	this.usagemu.Lock()
+	for i, c := range conns {
+		if c.usage == nil {
+			continue // closed meanwhile
+		}
+		c.usage.rollover(day, month)
+		c.flushUsageLocked()
+		overs[i] = c.usage.overQuota(cfg)
+		online[c.Pubkey.BinStr()] = true
+	}
+	for binpk, u := range this.usages {
+		if !online[binpk] && u.monthKey != month {
+			delete(this.usages, binpk)
+		}
+	}
+	this.usagemu.Unlock()
+	for i, c := range conns {
+		this.applyQuota(c, overs[i])
+	}
+}
+
+func (this *TCPServer) clientUsage(u *tcpUsage, online bool) TCPClientUsage {
+	return TCPClientUsage{Pubkey: u.pubkey, BytesRecv: u.recv, BytesSent: u.sent,
+		DayBytes: u.day, MonthBytes: u.month, OverQuota: u.overQuota(this.config()), Online: online}
+}
+
+// Usage of client pubkey, false if not seen this month
+func (this *TCPServer) Usage(pubkey *CryptoKey) (TCPClientUsage, bool) {
+	c := this.confirmedConn(pubkey)
+	day, month := tcpQuotaPeriods(this.clock.Now())
+	this.usagemu.Lock()
+	defer this.usagemu.Unlock()
+	u, ok := this.usages[pubkey.BinStr()]
+	if !ok {
+		return TCPClientUsage{}, false
+	}
+	u.rollover(day, month)
+	if c != nil {
+		c.flushUsageLocked()
+	}
+	return this.clientUsage(u, c != nil && c.usage == u), true
+}
+
+// Usages of all clients seen this month, most bytes this month first, counted
+// till last second
+func (this *TCPServer) Usages() []TCPClientUsage {
+	online := map[string]bool{}
+	for _, c := range this.confirmedConns() {
+		online[c.Pubkey.BinStr()] = true
+	}
+	day, month := tcpQuotaPeriods(this.clock.Now())
+	this.usagemu.Lock()
+	usages := make([]TCPClientUsage, 0, len(this.usages))
+	for binpk, u := range this.usages {
+		u.rollover(day, month)
+		usages = append(usages, this.clientUsage(u, online[binpk]))
+	}
+	this.usagemu.Unlock()
+	sort.SliceStable(usages, func(i, j int) bool { return usages[i].MonthBytes > usages[j].MonthBytes })
+	return usages
+}
+
+// relayed packets throttled over quota, pings and routing kept
+func tcpQuotaRelayed(ptype byte) bool {
+	return ptype >= NUM_RESERVED_PORTS || ptype == TCP_PACKET_OOB_SEND || ptype == TCP_PACKET_ONION_REQUEST
+}
@@ -0,0 +1,136 @@
+package mintox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsagePeriods(t *testing.T) {
+	u := &tcpUsage{}
+	now := time.Date(2020, 1, 31, 23, 0, 0, 0, time.UTC)
+	u.rollover(tcpQuotaPeriods(now))
+	u.add(10, 20)
+	u.rollover(tcpQuotaPeriods(now.Add(30 * time.Minute)))
+	u.add(1, 0)
+	if u.day != 31 || u.month != 31 {
+		t.Error("same day:", u.day, u.month)
+	}
+	u.rollover(tcpQuotaPeriods(now.Add(2 * time.Hour)))
+	if u.day != 0 || u.month != 0 || u.recv != 11 || u.sent != 20 {
+		t.Error("next month:", u.day, u.month, u.recv, u.sent)
+	}
+
+	cfg := DefaultTCPServerConfig()
+	u.add(5, 0)
+	if u.overQuota(cfg) {
+		t.Error("over no quota")
+	}
+	cfg.QuotaDailyBytes = 5
+	if !u.overQuota(cfg) {
+		t.Error("not over daily quota")
+	}
+	cfg.QuotaDailyBytes, cfg.QuotaMonthlyBytes = 0, 6
+	if u.overQuota(cfg) {
+		t.Error("over monthly quota")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.QuotaDailyBytes = 1 << 20
+	cfg.QuotaThrottleBytesPerSec = 1
+	clk := newFakeTstClock()
+	srvo, addr := newTstListenServer(t, cfg, clk)
+	defer srvo.Shutdown(context.Background())
+	reload := func(fn func(cfg *TCPServerConfig)) {
+		cfg := *srvo.config()
+		fn(&cfg)
+		if err := srvo.Reload(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		srvo.updateUsage(clk.Now())
+	}
+
+	pk, sk, _ := NewCBKeyPair()
+	cli := NewTCPClient(addr, srvo.Pubkey, pk, sk)
+	defer cli.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.confirmedConn(pk) != nil }) {
+		t.Fatal("client not confirmed")
+	}
+	u, ok := srvo.Usage(pk)
+	if !ok || u.BytesRecv == 0 || u.BytesSent == 0 || u.DayBytes != u.BytesRecv+u.BytesSent || !u.Online || u.OverQuota {
+		t.Fatal("usage:", ok, u)
+	}
+
+	// relayed packets throttled, conn kept
+	reload(func(cfg *TCPServerConfig) { cfg.QuotaDailyBytes = 1 })
+	if st, _ := srvo.ConnStats(pk); !st.OverQuota {
+		t.Fatal("conn not throttled")
+	}
+	peerpk, _, _ := NewCBKeyPair()
+	cli.SendOOB(peerpk, []byte("oob"))
+	if !waitTstCond(3*time.Second, func() bool { return srvo.Counters().QuotaThrottled == 1 }) {
+		t.Fatal("oob not throttled:", srvo.Counters().QuotaThrottled)
+	}
+	reload(func(cfg *TCPServerConfig) { cfg.QuotaDailyBytes = 0 })
+	if st, ok := srvo.ConnStats(pk); !ok || st.OverQuota {
+		t.Fatal("conn still throttled:", ok)
+	}
+
+	// closed, and again on reconnect
+	reload(func(cfg *TCPServerConfig) { cfg.QuotaMonthlyBytes, cfg.QuotaPolicy = 1, TCP_QUOTA_DISCONNECT })
+	if !waitTstCond(3*time.Second, func() bool { return srvo.confirmedConn(pk) == nil }) {
+		t.Fatal("conn over quota not closed")
+	}
+	cli.Close()
+	cli2 := NewTCPClient(addr, srvo.Pubkey, pk, sk)
+	defer cli2.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.Counters().QuotaKicked >= 2 }) {
+		t.Fatal("reconnect over quota not closed:", srvo.Counters().QuotaKicked)
+	}
+
+	usages := srvo.Usages()
+	if len(usages) != 1 || !usages[0].Pubkey.Equal2(pk) || usages[0].BytesRecv <= u.BytesRecv || !usages[0].OverQuota {
+		t.Error("usages:", usages)
+	}
+	w := httptest.NewRecorder()
+	srvo.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/usage", nil))
+	ausages := []TCPAdminUsage{}
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &ausages) != nil || len(ausages) != 1 || ausages[0].Pubkey != pk.ToHex() {
+		t.Error("admin usage:", w.Code, w.Body.String())
+	}
+
+	cfg = DefaultTCPServerConfig()
+	cfg.QuotaPolicy = "drop"
+	if err := cfg.Validate(); err == nil {
+		t.Error("invalid quota_policy accepted")
+	}
+}
+
+func TestUsageEvict(t *testing.T) {
+	defer func(n int) { tcpQuotaMaxUsages = n }(tcpQuotaMaxUsages)
+	tcpQuotaMaxUsages = 3
+	srvo := &TCPServer{usages: map[string]*tcpUsage{}}
+	now := time.Date(2020, 1, 31, 23, 0, 0, 0, time.UTC)
+	pks := make([]*CryptoKey, 4)
+	for i := range pks {
+		pks[i], _, _ = NewCBKeyPair()
+	}
+	online := srvo.usageLocked(pks[0], now)
+	online.conns = 1
+	srvo.usageLocked(pks[1], now).add(1, 0)
+	srvo.usageLocked(pks[2], now).add(5, 0)
+	srvo.usageLocked(pks[3], now)
+	if len(srvo.usages) != 3 {
+		t.Fatal("usages:", len(srvo.usages))
+	}
+	if _, ok := srvo.usages[pks[1].BinStr()]; ok {
+		t.Error("least offline usage kept")
+	}
+	if srvo.usages[pks[0].BinStr()] != online {
+		t.Error("online usage evicted")
+	}
+}
@@ -0,0 +1,206 @@
+package mintox
+
+import (
+	"gopp"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const TCP_BAN_VIOLATIONS = 5 // seconds over rate limits before ban
+const TCP_BAN_DURATION = 600 // seconds
+const TCP_BAN_FORGET = 60    // seconds, violations count reset after quiet
+const TCP_IP_SWEEP = 60      // seconds, idle ip state dropped
+
+// fixed one second window of packets and bytes
+type tcpRate struct {
+	window time.Time
+	pkts   int
+	bytes  int
+}
+
+// counts one packet, false when over any non zero limit
+func (this *tcpRate) add(now time.Time, nbytes int, maxPkts, maxBytes int) bool {
+	if now.Sub(this.window) >= time.Second {
+		this.window, this.pkts, this.bytes = now, 0, 0
+	}
+	this.pkts++
+	this.bytes += nbytes
+	return (maxPkts <= 0 || this.pkts <= maxPkts) && (maxBytes <= 0 || this.bytes <= maxBytes)
+}
+
+// per source ip, TCPServer.ipmu
+type tcpIPState struct {
+	rate       tcpRate
+	hsWindow   time.Time // one minute window of handshakes
+	hsCount    int
+	violations int
+	violAt     time.Time // last counted violation, at most one per second
+	conns      int       // open conns, see MaxConnsPerIP
+}
+
+func (this *tcpIPState) idle(now time.Time) bool {
+	return this.conns == 0 &&
+		now.Sub(this.rate.window) >= time.Second &&
+		now.Sub(this.hsWindow) >= time.Minute &&
+		now.Sub(this.violAt) >= TCP_BAN_FORGET*time.Second
+}
+
+func tcpRemoteIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// ipmu locked
+func (this *TCPServer) ipStateLocked(ip string, now time.Time) *tcpIPState {
+	if now.Sub(this.ipgc) >= TCP_IP_SWEEP*time.Second {
+		this.ipgc = now
+		for k, st := range this.ips {
+			if st.idle(now) {
+				delete(this.ips, k)
+			}
+		}
+	}
+	st, ok := this.ips[ip]
+	if !ok {
+		st = &tcpIPState{}
+		this.ips[ip] = st
+	}
+	return st
+}
+
+// count a violation of ip, true when to ban it, after cfg.BanViolations. ipmu locked
+func (this *TCPServer) violateLocked(st *tcpIPState, ip string, now time.Time) bool {
+	if this.config().BanViolations <= 0 || now.Sub(st.violAt) < time.Second {
+		return false
+	}
+	if now.Sub(st.violAt) >= TCP_BAN_FORGET*time.Second {
+		st.violations = 0
+	}
+	st.violAt = now
+	st.violations++
+	if st.violations < this.config().BanViolations {
+		return false
+	}
+	st.violations = 0
+	return true
+}
+
+// reject new conn from banned ip or over handshake rate
+func (this *TCPServer) admitIP(c net.Conn) bool {
+	ip := tcpRemoteIP(c)
+	now := this.clock.Now()
+	if this.bannedIP(ip, now) {
+		atomic.AddInt64(&this.cnts.BanRejected, 1)
+		return false
+	}
+	limit := this.config().MaxIPHandshakesPerMin
+	if limit <= 0 {
+		return true
+	}
+	this.ipmu.Lock()
+	st := this.ipStateLocked(ip, now)
+	if now.Sub(st.hsWindow) >= time.Minute {
+		st.hsWindow, st.hsCount = now, 0
+	}
+	st.hsCount++
+	over := st.hsCount > limit
+	banned := over && this.violateLocked(st, ip, now)
+	this.ipmu.Unlock()
+	if !over {
+		return true
+	}
+	atomic.AddInt64(&this.cnts.HandshakeThrottled, 1)
+	log.Println("Handshake over limit, reject:", limit, c.RemoteAddr())
+	if banned {
+		this.banAuto(ip, now)
+	}
+	return false
+}
+
+// recv rate limit and quota throttle of confirmed conn, false to drop the packet.
+// error when source ip banned, conn should be closed then. rdmu locked
+func (this *TCPSecureConn) allowRecv(plnpkt []byte) (bool, error) {
+	srvo := this.srvo
+	if srvo == nil {
+		return true, nil
+	}
+	cfg := srvo.config()
+	now := this.clock.Now()
+	nbytes := len(plnpkt)
+	if atomic.LoadInt32(&this.overQuota) == 1 && tcpQuotaRelayed(plnpkt[0]) &&
+		!this.qrate.add(now, nbytes, 0, cfg.QuotaThrottleBytesPerSec) {
+		atomic.AddInt64(&srvo.cnts.QuotaThrottled, 1)
+		return false, nil
+	}
+	ok := this.rate.add(now, nbytes, cfg.MaxPacketsPerSec, cfg.MaxBytesPerSec)
+	ipcheck := cfg.MaxIPPacketsPerSec > 0 || cfg.MaxIPBytesPerSec > 0
+	if ok && !ipcheck {
+		return true, nil
+	}
+
+	ip := tcpRemoteIP(this.Sock)
+	srvo.ipmu.Lock()
+	st := srvo.ipStateLocked(ip, now)
+	if ipcheck {
+		ok = st.rate.add(now, nbytes, cfg.MaxIPPacketsPerSec, cfg.MaxIPBytesPerSec) && ok
+	}
+	banned := !ok && srvo.violateLocked(st, ip, now)
+	srvo.ipmu.Unlock()
+	if ok {
+		return true, nil
+	}
+	atomic.AddInt64(&srvo.cnts.RateLimited, 1)
+	if banned {
+		srvo.banAuto(ip, now)
+		srvo.kickIP(ip, this)
+		return false, errors.New(TCP_CLOSE_BANNED)
+	}
+	return false, nil
+}
+
+// close other conns from banned ip, except closes itself
+func (this *TCPServer) kickIP(ip string, except *TCPSecureConn) {
+	for _, c := range this.snapshotConns() {
+		if c != except && tcpRemoteIP(c.Sock) == ip {
+			c.doClose(true, TCP_CLOSE_BANNED)
+		}
+	}
+}
+
+// BanIP rejects new conns from ip or CIDR range for d and closes its current conns.
+func (this *TCPServer) BanIP(ip string, d time.Duration) {
+	gopp.ErrPrint(this.Ban(ip, d, "admin"), ip)
+}
+
+// drops the ban of ip or range, and the reputation of it
+func (this *TCPServer) UnbanIP(ip string) bool {
+	ok, err := this.bans.Remove(ip)
+	gopp.ErrPrint(err, ip)
+	if ok {
+		this.ipmu.Lock()
+		if st, found := this.ips[ip]; found {
+			st.violations = 0
+		}
+		this.ipmu.Unlock()
+	}
+	return ok
+}
+
+// banned ips and ranges and their expire time, zero for never
+func (this *TCPServer) BannedIPs() map[string]time.Time {
+	now := this.clock.Now()
+	rets := map[string]time.Time{}
+	for _, ban := range this.bans.List() {
+		if ban.active(now) {
+			rets[ban.Net] = ban.Until
+		}
+	}
+	return rets
+}
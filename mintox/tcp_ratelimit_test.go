@@ -0,0 +1,156 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTstListenServer(t *testing.T, cfg *TCPServerConfig, clk clock) (*TCPServer, string) {
+	_, cfg.Seckey, _ = NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo, err := NewTCPServerWithListenersConfig([]net.Listener{lsner}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.clock = clk
+	srvo.Start()
+	return srvo, lsner.Addr().String()
+}
+
+// rejected conn is closed by server before any handshake response
+func tstDialRejected(t *testing.T, addr string) bool {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	nerr, ok := err.(net.Error)
+	return err != nil && !(ok && nerr.Timeout())
+}
+
+func TestRecvRateLimitBan(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.MaxPacketsPerSec = 5
+	cfg.BanViolations = 2
+	clk := newFakeTstClock()
+	srvo, addr := newTstListenServer(t, cfg, clk)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	peer := newTstPeer(t, c, srvo.Pubkey)
+	peer.handshake()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 1 }) {
+		t.Fatal("conn not confirmed")
+	}
+	// unmatched pongs are ignored, only counted by limit
+	pong := append([]byte{TCP_PACKET_PONG}, make([]byte, 8)...)
+	for i := 0; i < 8; i++ {
+		peer.writePlain(pong)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return srvo.Counters().RateLimited == 3 }) {
+		t.Fatal("packets not limited:", srvo.Counters().RateLimited)
+	}
+	if srvo.ConnCount() != 1 || len(srvo.BannedIPs()) != 0 {
+		t.Fatal("banned on first violation")
+	}
+
+	// second violation in next window bans the ip
+	clk.Advance(time.Second)
+	for i := 0; i < 6; i++ {
+		peer.writePlain(pong)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 0 }) {
+		t.Fatal("conn not closed after ban")
+	}
+	if cnts := srvo.Counters(); cnts.Bans != 1 || cnts.RateLimited != 4 {
+		t.Error("ban counters:", cnts.Bans, cnts.RateLimited)
+	}
+	if _, ok := srvo.BannedIPs()["127.0.0.1"]; !ok {
+		t.Fatal("ip not banned:", srvo.BannedIPs())
+	}
+	if !tstDialRejected(t, addr) || srvo.Counters().BanRejected != 1 {
+		t.Error("banned ip not rejected:", srvo.Counters().BanRejected)
+	}
+
+	if !srvo.UnbanIP("127.0.0.1") || srvo.UnbanIP("127.0.0.1") {
+		t.Error("unban")
+	}
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	newTstPeer(t, c2, srvo.Pubkey).handshake()
+
+	// ban expires
+	srvo.BanIP("127.0.0.1", time.Minute)
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 0 }) {
+		t.Fatal("conn not kicked by BanIP")
+	}
+	clk.Advance(time.Minute)
+	if len(srvo.BannedIPs()) != 0 {
+		t.Error("ban not expired:", srvo.BannedIPs())
+	}
+}
+
+func TestHandshakeThrottle(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.MaxIPHandshakesPerMin = 2
+	cfg.BanViolations = 0
+	clk := newFakeTstClock()
+	srvo, addr := newTstListenServer(t, cfg, clk)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		newTstPeer(t, c, srvo.Pubkey).handshake()
+	}
+	if !tstDialRejected(t, addr) {
+		t.Fatal("handshake not throttled")
+	}
+	if cnts := srvo.Counters(); cnts.HandshakeThrottled != 1 || cnts.Bans != 0 {
+		t.Error("throttle counters:", cnts.HandshakeThrottled, cnts.Bans)
+	}
+
+	clk.Advance(time.Minute)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	newTstPeer(t, c, srvo.Pubkey).handshake()
+}
+
+func TestRateLimitConfigValidate(t *testing.T) {
+	for i, f := range []func(*TCPServerConfig){
+		func(cfg *TCPServerConfig) { cfg.MaxPacketsPerSec = -1 },
+		func(cfg *TCPServerConfig) { cfg.MaxIPBytesPerSec = -1 },
+		func(cfg *TCPServerConfig) { cfg.MaxIPHandshakesPerMin = -1 },
+		func(cfg *TCPServerConfig) { cfg.BanDuration = 0 },
+	} {
+		cfg := DefaultTCPServerConfig()
+		f(cfg)
+		if cfg.Validate() == nil {
+			t.Error("invalid config accepted:", i)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package mintox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// record and replay raw(encrypted) stream of a TCPSecureConn, for debug and regression test.
+// record format: dir(1) | datlen(4, big endian) | data
+
+const (
+	TCP_RECORD_RECV  = 0 // peer => self
+	TCP_RECORD_SENT  = 1 // self => peer
+	TCP_RECORD_HSKEY = 2 // self handshake randomness, only when LogKeyMaterial
+)
+
+const TCP_RECORD_MAX_SIZE = 1024 * 1024
+
+type recordConn struct {
+	net.Conn
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// wrap c, all read/written bytes of c also write to w
+func NewRecordConn(c net.Conn, w io.Writer) net.Conn {
+	return &recordConn{Conn: c, w: w}
+}
+
+func (this *recordConn) Read(b []byte) (int, error) {
+	n, err := this.Conn.Read(b)
+	if n > 0 {
+		this.record(TCP_RECORD_RECV, b[:n])
+	}
+	return n, err
+}
+
+func (this *recordConn) Write(b []byte) (int, error) {
+	n, err := this.Conn.Write(b)
+	if n > 0 {
+		this.record(TCP_RECORD_SENT, b[:n])
+	}
+	return n, err
+}
+
+func (this *recordConn) record(dir byte, data []byte) {
+	hdr := make([]byte, 5)
+	hdr[0] = dir
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(data)))
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.w.Write(hdr)
+	this.w.Write(data)
+}
+
+func ReadTCPRecord(r io.Reader) (dir byte, data []byte, err error) {
+	hdr := make([]byte, 5)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+	dir = hdr[0]
+	datlen := binary.BigEndian.Uint32(hdr[1:])
+	if datlen > TCP_RECORD_MAX_SIZE {
+		err = errors.Errorf("Invalid record length: %d", datlen)
+		return
+	}
+	data = make([]byte, datlen)
+	_, err = io.ReadFull(r, data)
+	return
+}
+
+// handshake randomness of server side, replayed to get the same session
+type tcpHsRandom struct {
+	SentNonce *CBNonce
+	TmpNonce  *CBNonce
+	TmpSeckey *CryptoKey
+}
+
+func newTCPHsRandom() *tcpHsRandom {
+	_, tmpsk, _ := NewCBKeyPair()
+	return &tcpHsRandom{CBRandomNonce(), CBRandomNonce(), tmpsk}
+}
+
+func (this *tcpHsRandom) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(this.SentNonce.Bytes())
+	buf.Write(this.TmpNonce.Bytes())
+	buf.Write(this.TmpSeckey.Bytes())
+	return buf.Bytes()
+}
+
+func parseTCPHsRandom(data []byte) (*tcpHsRandom, error) {
+	if len(data) != NONCE_SIZE*2+SECRET_KEY_SIZE {
+		return nil, errors.Errorf("Invalid handshake key record: %d", len(data))
+	}
+	this := &tcpHsRandom{}
+	this.SentNonce = NewCBNonce(data[:NONCE_SIZE])
+	this.TmpNonce = NewCBNonce(data[NONCE_SIZE : NONCE_SIZE*2])
+	this.TmpSeckey = NewCryptoKey(data[NONCE_SIZE*2:])
+	return this, nil
+}
+
+// feed recorded recv stream to secon over a pipe, return bytes secon sent.
+// secon should have the same Seckey as recorded one, and the record should
+// have handshake key record for packets after handshake could be decrypted.
+func ReplayTCPStream(r io.Reader, secon *TCPSecureConn) ([]byte, error) {
+	recvs := [][]byte{}
+	sentlen := 0
+	for {
+		dir, data, err := ReadTCPRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch dir {
+		case TCP_RECORD_RECV:
+			recvs = append(recvs, data)
+		case TCP_RECORD_SENT:
+			sentlen += len(data)
+		case TCP_RECORD_HSKEY:
+			secon.hsrnd, err = parseTCPHsRandom(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	c0, c1 := net.Pipe()
+	secon.Sock = c0
+	sentbuf := bytes.NewBuffer(nil)
+	readDone := make(chan bool, 1)
+	go func() {
+		rdbuf := make([]byte, 3000)
+		for sentbuf.Len() < sentlen {
+			rn, err := c1.Read(rdbuf)
+			if err != nil {
+				break
+			}
+			sentbuf.Write(rdbuf[:rn])
+		}
+		readDone <- true
+	}()
+	secon.Start()
+
+	for _, data := range recvs {
+		if _, err := c1.Write(data); err != nil {
+			break
+		}
+	}
+	// wait responses as many as recorded
+	select {
+	case <-readDone:
+	case <-time.After(TCP_FRAME_TIMEOUT * time.Second):
+	}
+	secon.Close()
+	c1.Close()
+	return sentbuf.Bytes(), nil
+}
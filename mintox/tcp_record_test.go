@@ -0,0 +1,69 @@
+package mintox
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func sentOfRecord(t *testing.T, data []byte) (sent []byte, hskey bool) {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		dir, rec, err := ReadTCPRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch dir {
+		case TCP_RECORD_SENT:
+			sent = append(sent, rec...)
+		case TCP_RECORD_HSKEY:
+			hskey = true
+		}
+	}
+	return
+}
+
+func recordTstSession(t *testing.T) ([]byte, *CryptoKey) {
+	recbuf := bytes.NewBuffer(nil)
+	c0, c1 := net.Pipe()
+	secon, srvpk := newTstSecureConn(NewRecordConn(c0, recbuf))
+	secon.Start()
+
+	peer := newTstPeer(t, c1, srvpk)
+	peer.handshake()
+	for i := 0; i < 2; i++ {
+		peer.ping()
+		peer.readPlain()
+	}
+	secon.Close()
+	secon.loops.Wait() // they write recbuf till done
+	return recbuf.Bytes(), secon.Seckey
+}
+
+func TestRecordReplay(t *testing.T) {
+	old := LogKeyMaterial
+	defer func() { LogKeyMaterial = old }()
+
+	LogKeyMaterial = false
+	recdat, _ := recordTstSession(t)
+	if _, hskey := sentOfRecord(t, recdat); hskey {
+		t.Error("handshake key recorded without LogKeyMaterial")
+	}
+
+	LogKeyMaterial = true
+	recdat, sk := recordTstSession(t)
+	sent, hskey := sentOfRecord(t, recdat)
+	if !hskey || len(sent) == 0 {
+		t.Fatal("invalid record:", hskey, len(sent))
+	}
+
+	secon := NewTCPSecureConn(nil)
+	secon.Seckey = sk
+	resent, err := ReplayTCPStream(bytes.NewReader(recdat), secon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, resent) {
+		t.Error("replay not reproduce the session:", len(sent), len(resent))
+	}
+}
@@ -0,0 +1,142 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"gopp"
+	"log"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Re-handshake recovers a desynced stream (continuous MAC failures) over the same socket.
+//
+// It is a mintox extension, must negotiate first, so never confuse a peer not expect it:
+//   client => [TCP_PACKET_CAPABILITY, caps]
+//   server => [TCP_PACKET_CAPABILITY, caps & server's]
+// Both enabled after the server's reply.
+//
+// Exchange, client side initiated:
+//   client => TCP_REHANDSHAKE_MARK(2) | client handshake(128), raw
+//   server: back to NO_STATUS, handle handshake
+//   server => TCP_REHANDSHAKE_MARK(2) | server handshake(96), raw
+//   client => ping, server => pong, both CONFIRMED again, with new session keys.
+// Packets in flight with old keys are dropped. Routes and connids are kept.
+
+const (
+	TCP_CAP_REHANDSHAKE = 1 << 0
+)
+
+const TCP_SERVER_CAPS = TCP_CAP_REHANDSHAKE | TCP_CAP_RESUME
+const TCP_CLIENT_CAPS = TCP_CAP_REHANDSHAKE | TCP_CAP_RESUME
+
+/* frame length value marks a raw handshake packet follows, never a valid length */
+const TCP_REHANDSHAKE_MARK = 0xFFFF
+
+/* continuous decrypt failures allowed waiting for client re-handshake */
+const TCP_MAX_MAC_FAILS = 8
+
+/////
+
+func (this *TCPSecureConn) HandleCapability(rpkt []byte) {
+	if len(rpkt) < 2 {
+		return
+	}
+	caps := rpkt[1] & this.serverCaps()
+	_, err := this.SendCtrlPacket([]byte{TCP_PACKET_CAPABILITY, caps})
+	gopp.ErrPrint(err)
+	if err == nil {
+		this.caps = caps
+	}
+	if err == nil && caps&TCP_CAP_RESUME != 0 {
+		this.issueTicket()
+	}
+}
+
+func (this *TCPSecureConn) canRehandshake() bool {
+	return this.caps&TCP_CAP_REHANDSHAKE != 0 && this.status() == TCP_STATUS_CONFIRMED
+}
+
+func (this *TCPSecureConn) startRehandshake() {
+	log.Println("Re-handshake request:", this.Sock.RemoteAddr(), this.macFails)
+	this.rehs = true
+	this.setStatus(TCP_STATUS_NO_STATUS)
+}
+
+func (this *TCPSecureConn) endRehandshake() {
+	log.Println("Re-handshake done:", this.Sock.RemoteAddr())
+	this.rehs = false
+	this.macFails = 0
+	// ping sent with old keys may be lost, not count it
+	atomic.StoreUint64(&this.Pingid, 0)
+}
+
+// keep the conn for a while if client can re-handshake, else fail
+func (this *TCPSecureConn) onDecryptFailed(err error) error {
+	this.macFails++
+	if this.caps&TCP_CAP_REHANDSHAKE == 0 || this.macFails > TCP_MAX_MAC_FAILS {
+		return errors.Wrapf(err, "Decrypt failed %d times", this.macFails)
+	}
+	log.Println("Decrypt failed, wait re-handshake:", this.macFails, this.Sock.RemoteAddr())
+	return nil
+}
+
+/////
+
+func (this *TCPClient) SendCapabilities() error {
+	_, err := this.SendCtrlPacket([]byte{TCP_PACKET_CAPABILITY, TCP_CLIENT_CAPS})
+	return err
+}
+
+func (this *TCPClient) HandleCapability(rpkt []byte) {
+	if len(rpkt) < 2 {
+		return
+	}
+	atomic.StoreUint32(&this.caps, uint32(rpkt[1]&TCP_CLIENT_CAPS))
+	log.Println("Server capabilities:", rpkt[1], this.ServAddr)
+}
+
+func (this *TCPClient) Caps() uint8 { return uint8(atomic.LoadUint32(&this.caps)) }
+
+// start a fresh handshake on the same conn, packets sent before it done are dropped.
+// read goroutine only, as it switches the read state.
+func (this *TCPClient) Rehandshake() error {
+	if this.Caps()&TCP_CAP_REHANDSHAKE == 0 {
+		return errors.New("Re-handshake not negotiated")
+	}
+	if !atomic.CompareAndSwapInt32(&this.rehsing, 0, 1) {
+		return nil // already
+	}
+	this.hsmu.Lock()
+	defer this.hsmu.Unlock()
+	var err error
+	this.Shrkey, err = CBBeforeNm(this.ServPubkey, this.SelfSeckey)
+	gopp.ErrPrint(err)
+	hspkt, err := this.GenerateHandshake()
+	if err != nil {
+		return err
+	}
+	wrbuf := make([]byte, 2, 2+len(hspkt))
+	binary.BigEndian.PutUint16(wrbuf, TCP_REHANDSHAKE_MARK)
+	wrbuf = append(wrbuf, hspkt...)
+	_, err = this.conn.Write(wrbuf)
+	gopp.ErrPrint(err)
+	log.Println("Re-handshake sent:", this.ServAddr)
+	return err
+}
+
+func (this *TCPClient) inRehandshake() bool { return atomic.LoadInt32(&this.rehsing) == 1 }
+
+// decrypt failed in CONFIRMED status
+func (this *TCPClient) onDecryptFailed(err error) {
+	if this.inRehandshake() {
+		return // old key packet in flight
+	}
+	if this.Caps()&TCP_CAP_REHANDSHAKE == 0 {
+		log.Println("Decrypt failed, close:", err, this.ServAddr)
+		this.Close()
+		return
+	}
+	err = this.Rehandshake()
+	gopp.ErrPrint(err)
+}
@@ -0,0 +1,114 @@
+package mintox
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/djherbis/buffer"
+)
+
+// running client and server conn over a pipe
+func newTstClientPair(t *testing.T) (*TCPClient, *TCPSecureConn) {
+	return newTstClientPairClock(t, nil)
+}
+
+// clk for client keepalive, nil for real clock
+func newTstClientPairClock(t *testing.T, clk clock) (*TCPClient, *TCPSecureConn) {
+	c0, c1 := net.Pipe()
+	secon, srvpk := newTstSecureConn(c0)
+	secon.Start()
+
+	pk, sk, _ := NewCBKeyPair()
+	cli := newTstClient()
+	cli.ServPubkey = srvpk
+	cli.SetKeyPair(pk, sk)
+	cli.conn = c1
+	cli.crbuf = buffer.NewRing(buffer.New(1024 * 1024))
+	confirmed := make(chan bool, 1)
+	cli.OnConfirmed = func() { confirmed <- true }
+	cli.Status = TCP_CLIENT_CONNECTING
+	cli.clock = clk
+	cli.start()
+	if err := cli.SendHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-confirmed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client not confirmed")
+	}
+	return cli, secon
+}
+
+func waitTstCond(timeout time.Duration, cond func() bool) bool {
+	btime := time.Now()
+	for !cond() {
+		if time.Since(btime) > timeout {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+func TestRehandshakeRecover(t *testing.T) {
+	cli, secon := newTstClientPair(t)
+	defer secon.Close()
+	srvconfirmed := 0
+	secon.OnConfirmed = func(Object) { srvconfirmed++ }
+
+	if err := cli.Rehandshake(); err == nil {
+		t.Error("re-handshake before negotiated")
+	}
+	cli.SendCapabilities()
+	if !waitTstCond(3*time.Second, func() bool { return cli.Caps()&TCP_CAP_REHANDSHAKE != 0 }) {
+		t.Fatal("capability not negotiated")
+	}
+
+	// desync client's recv side, next packet from server fails MAC
+	oldkey := cli.Shrkey
+	cli.RecvNonce.Incr()
+	cli.SendCtrlPacket([]byte{TCP_PACKET_PING, 0, 0, 0, 0, 0, 0, 0, 1})
+	if !waitTstCond(3*time.Second, func() bool {
+		return cli.Shrkey != oldkey && !cli.inRehandshake() && cli.Status == TCP_CLIENT_CONFIRMED
+	}) {
+		t.Fatal("re-handshake not done")
+	}
+	if cli.Status != TCP_CLIENT_CONFIRMED || secon.status() != TCP_STATUS_CONFIRMED || secon.isClosed() {
+		t.Fatal("not confirmed again:", cli.Status, secon.status())
+	}
+	if srvconfirmed != 0 {
+		t.Error("server OnConfirmed called by re-handshake")
+	}
+
+	// works with new keys
+	atomic.StoreUint32(&cli.caps, 0)
+	cli.SendCapabilities()
+	if !waitTstCond(3*time.Second, func() bool { return cli.Caps() != 0 }) {
+		t.Error("no response after re-handshake")
+	}
+}
+
+func TestDesyncWithoutCapability(t *testing.T) {
+	cli, secon := newTstClientPair(t)
+	closed := make(chan bool, 1)
+	secon.OnClosed = func(Object) { closed <- true }
+
+	cli.SentNonce.Incr() // server fails MAC
+	cli.SendCtrlPacket([]byte{TCP_PACKET_PING, 0, 0, 0, 0, 0, 0, 0, 1})
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Error("desynced conn not closed")
+	}
+}
+
+func TestWritePacketRehandshaking(t *testing.T) {
+	cli := newTstClient()
+	atomic.StoreInt32(&cli.rehsing, 1)
+	if _, err := cli.WritePacket([]byte{TCP_PACKET_PING, 0, 0, 0, 0, 0, 0, 0, 1}); err != ErrRehandshaking {
+		t.Error("dropped packet not told:", err)
+	}
+}
@@ -0,0 +1,332 @@
+package mintox
+
+import (
+	"crypto/subtle"
+	"gopp"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Session resumption brings a client back on a new conn after a network blip,
+// with its routes and connids on the relay kept, and no new key exchange.
+//
+// A mintox extension, negotiated with TCP_CAP_RESUME like re-handshake, then:
+//   server => [TCP_PACKET_SESSION_TICKET, ticket(32)], again after every resume
+// A conn closed by peer or by timeout is parked for resume_timeout seconds,
+// its routes stay online to peers, packets to it are dropped meanwhile.
+//
+// Resume is a handshake of the same size, with the ticket in place of the temp pubkey:
+//   client => pubkey | nonce | enc(ticket | base nonce), by the long term shared key
+//   server => nonce | enc(ticket | base nonce)
+// Both go on with the parked session key and the new base nonces, old nonces are
+// never restored as packets in flight were lost. Ping/pong confirms as usual,
+// then the server resends the status of every route. A ticket the server not
+// know is taken as a temp pubkey, the client sees no ticket echoed and closes,
+// a full handshake on a new client is the fallback.
+
+const TCP_CAP_RESUME = 1 << 1
+
+/* mintox extension, session ticket of resumption */
+const TCP_PACKET_SESSION_TICKET = 11
+
+const TCP_SESSION_TICKET_SIZE = 32
+
+/* Seconds a closed conn waits for resume */
+const TCP_RESUME_TIMEOUT = 15
+
+// closed locally for these still resumable, client may not know the conn is dead
+var tcpResumableReasons = map[string]bool{
+	TCP_CLOSE_PING_TIMEOUT:  true,
+	TCP_CLOSE_FRAME_TIMEOUT: true,
+	TCP_CLOSE_WRITE_TIMEOUT: true,
+}
+
+func (this *TCPSecureConn) serverCaps() uint8 {
+	if this.srvo == nil || this.srvo.config().ResumeTimeout <= 0 {
+		return TCP_SERVER_CAPS &^ TCP_CAP_RESUME
+	}
+	return TCP_SERVER_CAPS
+}
+
+func (this *TCPSecureConn) issueTicket() {
+	ticket := CBRandomBytes(TCP_SESSION_TICKET_SIZE)
+	this.connmu.Lock()
+	this.ticket = ticket
+	this.connmu.Unlock()
+	_, err := this.SendCtrlPacket(append([]byte{TCP_PACKET_SESSION_TICKET}, ticket...))
+	gopp.ErrPrint(err, this.Sock.RemoteAddr())
+}
+
+func (this *TCPSecureConn) getTicket() []byte {
+	this.connmu.RLock()
+	defer this.connmu.RUnlock()
+	return this.ticket
+}
+
+// parked session of this conn's client with ticket, taken out if found
+func (this *TCPSecureConn) takeResumable(ticket []byte) *TCPSecureConn {
+	if this.srvo == nil || this.rehs {
+		return nil
+	}
+	return this.srvo.takeParked(this.Pubkey, ticket)
+}
+
+// routes, connids and session key of parked, the old conn is dead
+func (this *TCPSecureConn) adoptSession(parked *TCPSecureConn) {
+	parked.connmu.RLock()
+	infos, infos2, ticket := parked.ConnInfos, parked.ConnInfos2, parked.ticket
+	parked.connmu.RUnlock()
+	parked.connidmu.Lock()
+	connids := parked.ConnIds
+	parked.connidmu.Unlock()
+	this.connmu.Lock()
+	this.ConnInfos, this.ConnInfos2, this.ticket = infos, infos2, ticket
+	this.connmu.Unlock()
+	this.connidmu.Lock()
+	this.ConnIds = connids
+	this.connidmu.Unlock()
+	this.caps = parked.caps
+	this.Identifier = parked.Identifier
+	this.parkedAt = parked.parkedAt
+	this.resumed = true
+	log.Println("Resume session:", this.Sock.RemoteAddr(), this.Pubkey.ToHex20(), len(this.ConnInfos))
+}
+
+// after resumed, tell client every route status, peers may gone while parked
+func (this *TCPSecureConn) resyncRoutes() {
+	for _, pci := range this.routesByConnid() {
+		if pci.Status == 2 {
+			this.SendConnectNotification(pci.Connid)
+		} else {
+			this.SendDisconnectNotification(pci.Connid)
+		}
+	}
+	this.issueTicket()
+}
+
+// route to peer binpk offline, peer gone
+func (this *TCPSecureConn) routeOffline(binpk string) (*PeerConnInfo, bool) {
+	this.connmu.RLock()
+	pci, ok := this.ConnInfos[binpk]
+	this.connmu.RUnlock()
+	if ok {
+		this.logr().Debug("Peer gone, route offline", "route", pci)
+		pci.Status = 1
+		pci.Otherid = 0
+	}
+	return pci, ok
+}
+
+func (this *TCPSecureConn) handleResume(ltkey *CryptoKey, cliplnpkt []byte, parked *TCPSecureConn) error {
+	this.adoptSession(parked)
+	this.RecvNonce = NewCBNonce(cliplnpkt[PUBLIC_KEY_SIZE : PUBLIC_KEY_SIZE+NONCE_SIZE])
+	hsrnd := this.hsrnd
+	if hsrnd == nil {
+		hsrnd = newTCPHsRandom()
+	}
+	plain := append(append([]byte{}, cliplnpkt[:TCP_SESSION_TICKET_SIZE]...), hsrnd.SentNonce.Bytes()...)
+	encpkt, err := EncryptDataSymmetric(ltkey, hsrnd.TmpNonce, plain)
+	if err != nil {
+		return err
+	}
+	parked.hsmu.Lock()
+	sesskey := parked.Shrkey
+	parked.hsmu.Unlock()
+
+	this.hsmu.Lock()
+	this.SentNonce = hsrnd.SentNonce
+	this.Shrkey = sesskey
+	wn, err := this.sockWrite(append(append([]byte{}, hsrnd.TmpNonce.Bytes()...), encpkt...))
+	this.hsmu.Unlock()
+	gopp.ErrPrint(err, wn)
+	if err == nil {
+		this.noteSent(wn)
+	}
+	return err
+}
+
+// connmu held by caller. hsfailed for closed before confirmed.
+func (this *TCPServer) parkConn(c *TCPSecureConn, hsfailed bool) bool {
+	if this.config().ResumeTimeout <= 0 || atomic.LoadInt32(&this.shuttingDown) == 1 {
+		return false
+	}
+	ticket := c.getTicket()
+	switch {
+	case ticket == nil || (hsfailed && !c.resumed):
+		return false
+	case hsfailed: // resume failed, wait again till the first parked time
+	case c.closeLocal && !tcpResumableReasons[c.closeReason]:
+		return false
+	default:
+		c.parkedAt = this.clock.Now()
+	}
+	this.parkmu.Lock()
+	old := this.parked[c.Pubkey.BinStr()]
+	this.parked[c.Pubkey.BinStr()] = c
+	this.parkmu.Unlock()
+	if old != nil {
+		this.killAccepted(old)
+	}
+	this.logr().Debug("Conn parked for resume", "pubkey", c.Pubkey.ToHex20(), "reason", c.closeReason)
+	return true
+}
+
+func (this *TCPServer) takeParked(pubkey *CryptoKey, ticket []byte) *TCPSecureConn {
+	this.parkmu.Lock()
+	defer this.parkmu.Unlock()
+	c := this.parked[pubkey.BinStr()]
+	if c == nil || subtle.ConstantTimeCompare(c.getTicket(), ticket) != 1 {
+		return nil
+	}
+	delete(this.parked, pubkey.BinStr())
+	return c
+}
+
+func (this *TCPServer) parkedConn(pubkey *CryptoKey) (*TCPSecureConn, bool) {
+	this.parkmu.Lock()
+	defer this.parkmu.Unlock()
+	c, ok := this.parked[pubkey.BinStr()]
+	return c, ok
+}
+
+// new full handshake of the client, parked session no longer wanted. connmu held by caller
+func (this *TCPServer) dropParked(pubkey *CryptoKey) {
+	this.parkmu.Lock()
+	c := this.parked[pubkey.BinStr()]
+	delete(this.parked, pubkey.BinStr())
+	this.parkmu.Unlock()
+	if c != nil {
+		this.killAccepted(c)
+	}
+}
+
+func (this *TCPServer) ParkedCount() int {
+	this.parkmu.Lock()
+	defer this.parkmu.Unlock()
+	return len(this.parked)
+}
+
+func (this *TCPServer) runResumeGC() {
+	if this.config().ResumeTimeout <= 0 {
+		return
+	}
+	tickC, tickStop := this.clock.Tick(time.Second)
+	defer tickStop()
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case <-tickC:
+		}
+		this.expireParked(this.clock.Now())
+	}
+}
+
+// routes of sessions parked over resume_timeout offline to peers
+func (this *TCPServer) expireParked(now time.Time) int {
+	timeout := time.Duration(this.config().ResumeTimeout) * time.Second
+	var stales []*TCPSecureConn
+	this.parkmu.Lock()
+	for binpk, c := range this.parked {
+		if now.Sub(c.parkedAt) > timeout {
+			stales = append(stales, c)
+			delete(this.parked, binpk)
+		}
+	}
+	this.parkmu.Unlock()
+
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
+	for _, c := range stales {
+		atomic.AddInt64(&this.cnts.ResumeExpired, 1)
+		this.killAccepted(c)
+	}
+	return len(stales)
+}
+
+/////
+
+func (this *TCPClient) HandleSessionTicket(rpkt []byte) {
+	if len(rpkt) != 1+TCP_SESSION_TICKET_SIZE {
+		log.Println("Invalid session ticket length:", len(rpkt), this.ServAddr)
+		return
+	}
+	this.hsmu.Lock()
+	this.ticket = append([]byte{}, rpkt[1:]...)
+	this.hsmu.Unlock()
+}
+
+func (this *TCPClient) CanResume() bool {
+	this.hsmu.Lock()
+	defer this.hsmu.Unlock()
+	return this.ticket != nil && this.Caps()&TCP_CAP_RESUME != 0
+}
+
+func (this *TCPClient) inResume() bool { return atomic.LoadInt32(&this.resuming) == 1 }
+
+// Resume the session on a new conn after this one closed, see OnClosed.
+// Routes and peers kept, OnConfirmed called again when done. If the relay
+// not know the session any more, closed again and CanResume false,
+// use a new client for a full handshake then.
+func (this *TCPClient) Resume() error {
+	if !this.CanResume() {
+		return errors.New("No session to resume")
+	}
+	if atomic.LoadInt32(&this.readDone) == 0 {
+		return errors.New("Still connected")
+	}
+	this.Close() // stop ping loop of the old conn
+	ltkey, err := CBBeforeNm(this.ServPubkey, this.SelfSeckey)
+	if err != nil {
+		return err
+	}
+	this.hsmu.Lock()
+	ticket := this.ticket
+	this.resumeKey, this.Shrkey = this.Shrkey, ltkey
+	this.hsmu.Unlock()
+
+	atomic.StoreInt32(&this.resuming, 1)
+	atomic.StoreInt32(&this.rehsing, 0)
+	atomic.StoreInt32(&this.readDone, 0)
+	atomic.StoreInt32(&this.closed, 0)
+	if err := this.connect(); err != nil {
+		atomic.StoreInt32(&this.readDone, 1)
+		return err
+	}
+	_, err = this.conn.Write(this.generateResume(ticket))
+	gopp.ErrPrint(err, this.ServAddr)
+	log.Println("Resume sent:", this.ServAddr)
+	return err
+}
+
+func (this *TCPClient) generateResume(ticket []byte) []byte {
+	this.SentNonce = CBRandomNonce()
+	this.TempNonce = CBRandomNonce()
+	plain := append(append([]byte{}, ticket...), this.SentNonce.Bytes()...)
+	encrypted, err := EncryptDataSymmetric(this.Shrkey, this.TempNonce, plain)
+	gopp.ErrPrint(err)
+	pkt := append(append([]byte{}, this.SelfPubkey.Bytes()...), this.TempNonce.Bytes()...)
+	return append(pkt, encrypted...)
+}
+
+// server echoed our ticket, or it did a full handshake we can not finish
+func (this *TCPClient) handleResumeResponse(rdbuf []byte) error {
+	atomic.StoreInt32(&this.resuming, 0)
+	this.hsmu.Lock()
+	defer this.hsmu.Unlock()
+	sesskey, ticket := this.resumeKey, this.ticket
+	this.resumeKey, this.ticket = nil, nil // one time
+	plain, err := DecryptDataSymmetric(this.Shrkey, NewCBNonce(rdbuf[:NONCE_SIZE]), rdbuf[NONCE_SIZE:])
+	if err != nil {
+		return errors.Wrap(err, "Decrypt resume response")
+	}
+	if subtle.ConstantTimeCompare(plain[:TCP_SESSION_TICKET_SIZE], ticket) != 1 {
+		return errors.New("Session not resumed")
+	}
+	this.Shrkey = sesskey
+	this.RecvNonce = NewCBNonce(plain[TCP_SESSION_TICKET_SIZE:])
+	return nil
+}
@@ -0,0 +1,169 @@
+package mintox
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a with resume ticket routed to b, both via srvo, confirmedC of a
+func newTstResumePair(t *testing.T, srvo *TCPServer, addr string) (a, b *TCPClient, dataC chan []byte, statusC chan uint8,
+	confirmedC chan bool) {
+	dataC = make(chan []byte, 16)
+	statusC = make(chan uint8, 16)
+	a, confirmedC = newTstConfirmedClient(t, addr, srvo.Pubkey, func(cli *TCPClient) {
+		cli.OnData = func(pk *CryptoKey, data []byte) { dataC <- data }
+	})
+	b, _ = newTstConfirmedClient(t, addr, srvo.Pubkey, func(cli *TCPClient) {
+		cli.RoutingStatusFunc = func(_ Object, _ uint32, _ uint8, status uint8) { statusC <- status }
+	})
+	a.SendCapabilities()
+	if !waitTstCond(3*time.Second, func() bool { return a.CanResume() }) {
+		t.Fatal("no session ticket")
+	}
+
+	a.AddPeer(b.SelfPubkey)
+	b.AddPeer(a.SelfPubkey)
+	if !recvTstRouted(b, a, dataC) {
+		t.Fatal("routed data not received")
+	}
+	return
+}
+
+func recvTstRouted(from, to *TCPClient, dataC chan []byte) bool {
+	for btime := time.Now(); time.Since(btime) < 5*time.Second; {
+		from.SendData(to.SelfPubkey, []byte("hello"))
+		select {
+		case data := <-dataC:
+			if string(data) == "hello" {
+				return true
+			}
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	return false
+}
+
+// network of a gone, server sees EOF
+func dropTstClientConn(t *testing.T, srvo *TCPServer, cli *TCPClient) {
+	cli.conn.Close()
+	if !waitTstCond(3*time.Second, func() bool {
+		return srvo.ParkedCount() == 1 && atomic.LoadInt32(&cli.readDone) == 1
+	}) {
+		t.Fatal("conn not parked:", srvo.ParkedCount())
+	}
+}
+
+func TestTCPSessionResume(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	a, b, dataC, statusC, confirmedC := newTstResumePair(t, srvo, addr)
+	defer a.Close()
+	defer b.Close()
+	cid, _ := a.ConnidOf(b.SelfPubkey)
+
+	if err := a.Resume(); err == nil {
+		t.Error("resumed while connected")
+	}
+	dropTstClientConn(t, srvo, a)
+	if err := a.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstConfirmed(confirmedC) || !waitTstCond(3*time.Second, func() bool { return srvo.Counters().Resumed == 1 }) {
+		t.Fatal("session not resumed:", srvo.Counters().Resumed)
+	}
+	if cid2, _ := a.ConnidOf(b.SelfPubkey); cid2 != cid {
+		t.Error("connid changed:", cid, cid2)
+	}
+	if !recvTstRouted(b, a, dataC) {
+		t.Error("routed data not received after resume")
+	}
+	for len(statusC) > 0 {
+		if status := <-statusC; status != 2 {
+			t.Error("peer told route offline:", status)
+		}
+	}
+	if srvo.ParkedCount() != 0 || srvo.ConnCount() != 2 {
+		t.Error("parked:", srvo.ParkedCount(), srvo.ConnCount())
+	}
+	if !waitTstCond(3*time.Second, func() bool { return a.CanResume() }) {
+		t.Error("no new ticket after resume")
+	}
+}
+
+func TestTCPSessionResumeExpired(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	a, b, _, statusC, _ := newTstResumePair(t, srvo, addr)
+	defer a.Close()
+	defer b.Close()
+
+	dropTstClientConn(t, srvo, a)
+	for len(statusC) > 0 {
+		<-statusC // route online
+	}
+	if n := srvo.expireParked(time.Now()); n != 0 {
+		t.Error("expired early:", n)
+	}
+	if n := srvo.expireParked(time.Now().Add((TCP_RESUME_TIMEOUT + 1) * time.Second)); n != 1 {
+		t.Fatal("not expired:", n)
+	}
+	select {
+	case status := <-statusC:
+		if status != 1 {
+			t.Error("route status:", status)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("peer not told route offline")
+	}
+
+	// unknown ticket, relay did a full handshake the client can not finish
+	if err := a.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return atomic.LoadInt32(&a.readDone) == 1 }) {
+		t.Fatal("resume with stale ticket not closed")
+	}
+	if a.CanResume() {
+		t.Error("stale ticket kept")
+	}
+	cnts := srvo.Counters()
+	if cnts.Resumed != 0 || cnts.ResumeExpired != 1 {
+		t.Error("counters:", cnts.Resumed, cnts.ResumeExpired)
+	}
+}
+
+func TestTCPSessionResumeDisabled(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.ResumeTimeout = -1
+	if cfg.Validate() == nil {
+		t.Error("negative resume_timeout valid")
+	}
+	cfg.ResumeTimeout = 0
+	srvo, addr := newTstListenServer(t, cfg, defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	cli, _ := newTstConfirmedClient(t, addr, srvo.Pubkey, nil)
+	defer cli.Close()
+	cli.SendCapabilities()
+	if !waitTstCond(3*time.Second, func() bool { return cli.Caps()&TCP_CAP_REHANDSHAKE != 0 }) {
+		t.Fatal("capability not negotiated")
+	}
+	if cli.Caps()&TCP_CAP_RESUME != 0 || cli.CanResume() {
+		t.Error("resume negotiated when off")
+	}
+	cli.conn.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 0 }) {
+		t.Fatal("conn not closed")
+	}
+	if srvo.ParkedCount() != 0 {
+		t.Error("parked when off")
+	}
+}
@@ -0,0 +1,82 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Many listening sockets of one port by SO_REUSEPORT, the kernel spreads new
+// conns over them, each with its own accept loop. Accepted conns are admitted
+// and handshaken by a goroutine pool of the loop, so a storm of conns on one
+// socket does not wait for another.
+
+/* Accepted conns queued to the pool of an accept loop per worker. */
+const TCP_ACCEPT_QUEUE_PER_WORKER = 64
+
+// n listeners of network address, SO_REUSEPORT set when n > 1. Port 0 gets
+// the port of the first one.
+func listenTCPReusePort(network, address string, n int) ([]net.Listener, error) {
+	if n <= 1 {
+		lsner, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsner}, nil
+	}
+	lc := &net.ListenConfig{Control: setReusePort}
+	var lsners []net.Listener
+	for i := 0; i < n; i++ {
+		lsner, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			for _, lsner := range lsners {
+				lsner.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			host, _, _ := net.SplitHostPort(address)
+			address = net.JoinHostPort(host, strconv.Itoa(lsner.Addr().(*net.TCPAddr).Port))
+		}
+		lsners = append(lsners, lsner)
+	}
+	return lsners, nil
+}
+
+// admit and handshake accepted conns by cfg.AcceptWorkers goroutines, in
+// the accept loop if 0. done closes the pool after the loop ended.
+func (this *TCPServer) acceptPool() (handle func(c net.Conn), done func()) {
+	serve := func(c net.Conn) {
+		if atomic.LoadInt32(&this.shuttingDown) == 1 {
+			c.Close()
+			return
+		}
+		// limits checked and conn added as one step, loops and workers run at once
+		this.admitmu.Lock()
+		defer this.admitmu.Unlock()
+		if this.admit(c) {
+			this.startHandshake(c)
+		}
+	}
+	n := this.config().AcceptWorkers
+	if n <= 0 {
+		return serve, func() {}
+	}
+	connC := make(chan net.Conn, n*TCP_ACCEPT_QUEUE_PER_WORKER)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range connC {
+				serve(c)
+			}
+		}()
+	}
+	return func(c net.Conn) { connC <- c }, func() {
+		close(connC)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le || sparc64
+// +build !linux mips mipsle mips64 mips64le sparc64
+
+package mintox
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func isReusePortSupported() bool { return false }
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT not supported")
+}
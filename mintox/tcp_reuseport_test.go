@@ -0,0 +1,95 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPServerReusePort(t *testing.T) {
+	if _, err := ParseTCPServerConfig([]byte(`{"reuse_port": -1}`)); err == nil {
+		t.Error("negative reuse_port accepted")
+	}
+	if !isReusePortSupported() {
+		if _, err := ParseTCPServerConfig([]byte(`{"reuse_port": 2}`)); err == nil {
+			t.Error("reuse_port accepted without SO_REUSEPORT")
+		}
+		t.Skip("SO_REUSEPORT not supported")
+	}
+	cfg := DefaultTCPServerConfig()
+	cfg.Ports = []uint16{0}
+	cfg.BindAddr, cfg.AddrFamily = "127.0.0.1", TCP_FAMILY_IPV4
+	cfg.ReusePort, cfg.AcceptWorkers = 4, 2
+	_, cfg.Seckey, _ = NewCBKeyPair()
+	srvo, err := NewTCPServerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	addrs := srvo.Addrs()
+	if len(addrs) != 4 {
+		t.Fatal("listeners:", addrs)
+	}
+	for _, addr := range addrs[1:] {
+		if addr.String() != addrs[0].String() {
+			t.Fatal("listeners not of one port:", addrs)
+		}
+	}
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < 32; i++ {
+		c, err := net.Dial("tcp", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == len(conns) }) {
+		t.Error("conns not accepted:", srvo.ConnCount())
+	}
+}
+
+func TestTCPServerAcceptWorkersConnLimit(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.Ports = []uint16{0}
+	cfg.BindAddr, cfg.AddrFamily = "127.0.0.1", TCP_FAMILY_IPV4
+	cfg.AcceptWorkers, cfg.MaxConnsPerIP = 8, 4
+	_, cfg.Seckey, _ = NewCBKeyPair()
+	srvo, err := NewTCPServerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < 32; i++ {
+		c, err := net.Dial("tcp", srvo.Addrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return srvo.Counters().ConnLimited == int64(len(conns)-4) }) {
+		t.Error("ConnLimited:", srvo.Counters().ConnLimited)
+	}
+	if n := srvo.ConnCount(); n != 4 {
+		t.Error("conns over limit:", n)
+	}
+}
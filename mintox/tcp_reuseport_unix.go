@@ -0,0 +1,25 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!sparc64
+
+package mintox
+
+import (
+	"syscall"
+)
+
+/* SO_REUSEPORT of asm-generic, not in package syscall. */
+const SO_REUSEPORT = 0xf
+
+func isReusePortSupported() bool { return true }
+
+// Control of net.ListenConfig
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,53 @@
+package mintox
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rtt samples of one conn, smoothed like RFC 6298 srtt/rttvar.
+// add by one goroutine at a time, read by any.
+type rttStat struct {
+	last   int64 // time.Duration, atomic
+	srtt   int64
+	rttvar int64
+}
+
+func (this *rttStat) add(sample time.Duration) {
+	if sample < 0 {
+		sample = 0
+	}
+	s := int64(sample)
+	srtt := atomic.LoadInt64(&this.srtt)
+	if srtt == 0 {
+		atomic.StoreInt64(&this.rttvar, s/2)
+		atomic.StoreInt64(&this.srtt, s)
+	} else {
+		diff := srtt - s
+		if diff < 0 {
+			diff = -diff
+		}
+		rttvar := atomic.LoadInt64(&this.rttvar)
+		atomic.StoreInt64(&this.rttvar, rttvar-rttvar/4+diff/4)
+		atomic.StoreInt64(&this.srtt, srtt-srtt/8+s/8)
+	}
+	atomic.StoreInt64(&this.last, s)
+}
+
+func (this *rttStat) lastRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.last))
+}
+func (this *rttStat) smoothed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.srtt))
+}
+func (this *rttStat) variance() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.rttvar))
+}
+
+// for sorting relays by latency, unknown one after all measured
+func rttLess(a, b time.Duration) bool {
+	if a == 0 || b == 0 {
+		return a != 0
+	}
+	return a < b
+}
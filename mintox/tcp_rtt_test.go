@@ -0,0 +1,43 @@
+package mintox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTStatSmoothed(t *testing.T) {
+	var st rttStat
+	if st.smoothed() != 0 || st.lastRTT() != 0 {
+		t.Error("not zero before samples")
+	}
+	st.add(80 * time.Millisecond)
+	if st.smoothed() != 80*time.Millisecond || st.variance() != 40*time.Millisecond {
+		t.Error("first sample:", st.smoothed(), st.variance())
+	}
+	st.add(160 * time.Millisecond)
+	if st.smoothed() != 90*time.Millisecond || st.variance() != 50*time.Millisecond {
+		t.Error("second sample:", st.smoothed(), st.variance())
+	}
+	if st.lastRTT() != 160*time.Millisecond {
+		t.Error("last:", st.lastRTT())
+	}
+}
+
+func TestRTTLess(t *testing.T) {
+	ms := time.Millisecond
+	cases := []struct {
+		a, b time.Duration
+		less bool
+	}{
+		{10 * ms, 20 * ms, true},
+		{20 * ms, 10 * ms, false},
+		{10 * ms, 0, true},
+		{0, 10 * ms, false},
+		{0, 0, false},
+	}
+	for _, c := range cases {
+		if rttLess(c.a, c.b) != c.less {
+			t.Error(c.a, c.b, c.less)
+		}
+	}
+}
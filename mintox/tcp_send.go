@@ -0,0 +1,129 @@
+package mintox
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// send errors of conns, compare with errors.Cause
+var (
+	ErrQueueFull     = errors.New("Write queue is full")
+	ErrClosed        = errors.New("Conn closed")
+	ErrRehandshaking = errors.New("Re-handshaking") // packet dropped, conn still good
+)
+
+// plain packets of reserved types go to the ctrl queue, routing data to the data queue
+func isCtrlPacket(data []byte) bool { return data[0] < NUM_RESERVED_PORTS }
+
+// SendDataCtx queues a plain packet, its first byte a packet type or connid,
+// waits for room in the write queue till ctx done. No backpressure policy
+// applied, ctx is the policy. ctx.Err() when waited too long, ErrClosed if
+// the conn closed. data owned by the conn after a nil return.
+func (this *TCPSecureConn) SendDataCtx(ctx context.Context, data []byte) error {
+	q, dlen, dequeued, err := this.sendQueue(data)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt32(dlen, int32(len(data)))
+	select {
+	case q <- data:
+		return nil
+	default:
+	}
+	select {
+	case q <- data:
+		return nil
+	case <-this.stopC:
+		dequeued(data)
+		return ErrClosed
+	case <-ctx.Done():
+		dequeued(data)
+		return ctx.Err()
+	}
+}
+
+// TrySend is SendDataCtx never waiting, ErrQueueFull if no room
+func (this *TCPSecureConn) TrySend(data []byte) error {
+	q, dlen, dequeued, err := this.sendQueue(data)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt32(dlen, int32(len(data)))
+	select {
+	case q <- data:
+		return nil
+	default:
+		dequeued(data)
+		return ErrQueueFull
+	}
+}
+
+func (this *TCPSecureConn) sendQueue(data []byte) (chan []byte, *int32, func([]byte), error) {
+	if this.isClosed() {
+		return nil, nil, nil, ErrClosed
+	}
+	if err := checkPacketSize(len(data)); err != nil {
+		return nil, nil, nil, err
+	}
+	if isCtrlPacket(data) {
+		return this.cwctrlq, &this.cwctrldlen, this.ctrlDequeued, nil
+	}
+	return this.cwdataq, &this.cwdatadlen, this.dataDequeued, nil
+}
+
+/////
+
+// same as of TCPSecureConn. Before connected there is no queue, waits till ctx done.
+func (this *TCPClient) SendDataCtx(ctx context.Context, data []byte) error {
+	q, dlen, dequeued, err := this.sendQueue(data)
+	if err != nil {
+		return err
+	}
+	stopC := this.stopC
+	atomic.AddInt32(dlen, int32(len(data)))
+	select {
+	case q <- data:
+		return nil
+	default:
+	}
+	select {
+	case q <- data:
+		return nil
+	case <-stopC:
+		dequeued(data)
+		return ErrClosed
+	case <-ctx.Done():
+		dequeued(data)
+		return ctx.Err()
+	}
+}
+
+func (this *TCPClient) TrySend(data []byte) error {
+	q, dlen, dequeued, err := this.sendQueue(data)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt32(dlen, int32(len(data)))
+	select {
+	case q <- data:
+		return nil
+	default:
+		dequeued(data)
+		return ErrQueueFull
+	}
+}
+
+func (this *TCPClient) sendQueue(data []byte) (chan []byte, *int32, func([]byte), error) {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return nil, nil, nil, ErrClosed
+	}
+	if err := checkPacketSize(len(data)); err != nil {
+		return nil, nil, nil, err
+	}
+	if isCtrlPacket(data) {
+		return this.cwctrlq, &this.cwctrldlen, this.ctrlDequeued, nil
+	}
+	return this.cwdataq, &this.cwdatadlen, this.dataDequeued, nil
+}
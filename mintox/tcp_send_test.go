@@ -0,0 +1,76 @@
+package mintox
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestSendDataCtx(t *testing.T) {
+	srvo := newTstServer()
+	c := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	ping := []byte{TCP_PACKET_PING, 1, 2, 3, 4, 5, 6, 7, 8}
+	data := []byte{NUM_RESERVED_PORTS, 'h', 'i'}
+
+	for i := 0; i < cap(c.cwctrlq); i++ {
+		if err := c.TrySend(ping); err != nil {
+			t.Fatal("ctrl queue:", i, err)
+		}
+	}
+	if err := c.TrySend(ping); err != ErrQueueFull {
+		t.Fatal("full ctrl queue:", err)
+	}
+	// data queue not taken by ctrl packets
+	if err := c.TrySend(data); err != nil || len(c.cwdataq) != 1 {
+		t.Fatal("data queue:", err, len(c.cwdataq))
+	}
+	if _, err := c.SendCtrlPacket(ping); errors.Cause(err) != ErrQueueFull {
+		t.Error("SendCtrlPacket on full queue:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.SendDataCtx(ctx, ping); err != context.DeadlineExceeded {
+		t.Error("timeout:", err)
+	}
+	if n := atomic.LoadInt32(&c.cwctrldlen); int(n) != cap(c.cwctrlq)*len(ping) {
+		t.Error("ctrl queue bytes:", n)
+	}
+
+	// room made while waiting
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.ctrlDequeued(<-c.cwctrlq)
+	}()
+	if err := c.SendDataCtx(context.Background(), ping); err != nil {
+		t.Error("wait for room:", err)
+	}
+
+	// closed while waiting
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Close()
+	}()
+	if err := c.SendDataCtx(context.Background(), ping); err != ErrClosed {
+		t.Error("closed while waiting:", err)
+	}
+	if err := c.TrySend(data); err != ErrClosed {
+		t.Error("send on closed:", err)
+	}
+	if _, err := c.SendDataPacket(1, data); errors.Cause(err) != ErrClosed {
+		t.Error("SendDataPacket on closed:", err)
+	}
+	// queues drained by close after stopC closed
+	if !waitTstCond(time.Second, func() bool {
+		return atomic.LoadInt32(&c.cwctrldlen) == 0 && atomic.LoadInt32(&c.cwdatadlen) == 0
+	}) {
+		t.Error("queue bytes after close:", atomic.LoadInt32(&c.cwctrldlen), atomic.LoadInt32(&c.cwdatadlen))
+	}
+
+	if err := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED).TrySend(nil); err == nil {
+		t.Error("empty packet sent")
+	}
+}
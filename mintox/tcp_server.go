@@ -2,16 +2,22 @@ package mintox
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"gopp"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
-	"unsafe"
 
 	"github.com/djherbis/buffer"
 	"github.com/pkg/errors"
@@ -24,6 +30,9 @@ const TCP_MAX_BACKLOG = MAX_INCOMING_CONNECTIONS
 
 const MAX_PACKET_SIZE = 2048
 
+// max plain size of a data packet, encrypted one should fit MAX_PACKET_SIZE
+const TCP_MAX_PLAIN_SIZE = MAX_PACKET_SIZE - MAC_SIZE
+
 const TCP_HANDSHAKE_PLAIN_SIZE = (PUBLIC_KEY_SIZE + NONCE_SIZE)
 const TCP_SERVER_HANDSHAKE_SIZE = (NONCE_SIZE + TCP_HANDSHAKE_PLAIN_SIZE + MAC_SIZE)
 const TCP_CLIENT_HANDSHAKE_SIZE = (PUBLIC_KEY_SIZE + TCP_SERVER_HANDSHAKE_SIZE)
@@ -43,12 +52,18 @@ const TCP_PACKET_OOB_RECV = 7
 const TCP_PACKET_ONION_REQUEST = 8
 const TCP_PACKET_ONION_RESPONSE = 9
 
+/* mintox extension in reserved range, see tcp_rehandshake.go */
+const TCP_PACKET_CAPABILITY = 10
+
 const ARRAY_ENTRY_SIZE = 6
 
 /* frequency to ping connected nodes and timeout in seconds */
 const TCP_PING_FREQUENCY = 30
 const TCP_PING_TIMEOUT = 10
 
+/* a declared frame must be completed in this seconds */
+const TCP_FRAME_TIMEOUT = 10
+
 const (
 	TCP_STATUS_NO_STATUS = iota
 	TCP_STATUS_CONNECTED
@@ -74,6 +89,7 @@ var tcppktnames = map[byte]string{
 func tcppktname(ptype byte) string {
 	name := "TCP_PACKET_INVALID"
 	if ptype > TCP_PACKET_ONION_RESPONSE && ptype < NUM_RESERVED_PORTS {
+		name = fmt.Sprintf("RESERVED_%d", ptype)
 	} else if ptype >= NUM_RESERVED_PORTS {
 		name = fmt.Sprintf("DATA_FOR_CONNID_%d", ptype)
 	} else {
@@ -88,24 +104,48 @@ type PeerConnInfo struct {
 	Index   uint32 // when use constant array, that useful
 	Status  uint8
 	Otherid uint8
-	Connid  uint8 // self
+	Connid  uint8  // self
+	Node    string // cluster node of peer, empty if peer here
+}
+
+/* 0 if not used, 1 if other is offline, 2 if other is online. */
+var pcistnames = map[uint8]string{0: "NONE", 1: "OFFLINE", 2: "ONLINE"}
+
+func (this *PeerConnInfo) String() string {
+	pkstr := this.Pubkey.String()
+	stname, ok := pcistnames[this.Status]
+	if !ok {
+		stname = fmt.Sprintf("UNKNOWN_%d", this.Status)
+	}
+	return fmt.Sprintf("pci{%s %s idx:%d cid:%d oid:%d}", pkstr, stname, this.Index, this.Connid, this.Otherid)
 }
+
 type TCPSecureConn struct {
 	Sock      net.Conn
 	Pubkey    *CryptoKey // client's
 	Seckey    *CryptoKey // self
+	srvPubkey *CryptoKey // of Seckey, server's when accepted, nil for no server
 	Shrkey    *CryptoKey
 	RecvNonce *CBNonce
 	SentNonce *CBNonce
+	hsrnd     *tcpHsRandom   // replay only, nil for new random
+	hsmu      deadlock.Mutex // key switch vs packet write
+
+	caps     uint8 // negotiated TCP_CAP_*
+	rehs     bool  // in re-handshake, read goroutine only
+	macFails int   // continuous decrypt failures
 
 	connmu     deadlock.RWMutex
 	ConnInfos  map[string]*PeerConnInfo // binpk => *PeerConnInfo
 	ConnInfos2 map[uint8]*PeerConnInfo  // connid =>
 	connidmu   deadlock.RWMutex
 	ConnIds    map[uint8]bool // connid => used
-	Status     uint8
+	st         int32          // TCP_STATUS_*, atomic, see status
+	Family     uint8          // TOX_AF_INET or TOX_AF_INET6 of accepted remote addr, 0 for unknown like pipe
 
 	crbuf      buffer.Buffer // conn read ring buffer
+	crbufSize  int64         // ReadBufferSize, Cap of the ring is MaxInt64
+	rdbufs     tcpReadBufs   // pooled, read goroutine only
 	cwctrlq    chan []byte   // ctrl packets like pong []byte
 	cwctrldlen int32         // data length of cwctrlq
 	cwdataq    chan []byte
@@ -113,219 +153,453 @@ type TCPSecureConn struct {
 
 	Identifier uint64
 
-	LastPinged time.Time
-	Pingid     uint64
+	LastPinged time.Time // last ping sent or confirmed, ping loop only after confirmed
+	Pingid     uint64    // outstanding ping, 0 if none, atomic
 
+	// legacy single callbacks, set them before Start, or use TCPConnCallbacks
 	OnNetRecv   func(int)
 	OnClosed    func(Object)
 	OnConfirmed func(Object)
 	OnNetSent   func(int)
-
-	stopC chan bool
-	srvo  *TCPServer
+	OnNetDrop   func(int)           // queued packet not sent when conn closed
+	OnError     func(Object, error) // malformed packet or protocol error, conn closed after it
+	// valid oob send of this conn, called before relayed, also for offline destination.
+	// data is in read buffer reused for next packet, copy it to keep
+	OnOOBData func(obj Object, dstpk *CryptoKey, data []byte)
+	subs      tcpConnSubs // see TCPConnCallbacks
+
+	lastRecvAt int64   // unixnano, atomic
+	lastSentAt int64   // unixnano, atomic
+	recvBytes  int64   // total, atomic
+	sentBytes  int64   // total, atomic
+	recvPkts   int64   // frames handled, atomic
+	sentPkts   int64   // frames written, atomic
+	pingSentAt int64   // unixnano by clock of outstanding ping, atomic
+	rtt        rttStat // of matched pongs
+
+	createdAt   time.Time // about accept time
+	hsLatency   int64     // nanoseconds, accept to confirmed, atomic
+	fwdDropped  int64     // atomic
+	fwdOverflow int       // continuous forward drops, read goroutine only
+	cong        tcpCongestion
+	oobWindow   time.Time // oob rate limit, read goroutine only
+	oobCount    int
+	oobAbuser   bool
+	rate        tcpRate // recv rate limit, read goroutine only
+	qrate       tcpRate // relayed packets over quota, read goroutine only
+	overQuota   int32   // 1 when throttled over quota, atomic
+
+	usage     *tcpUsage // of client pubkey when confirmed, usagemu
+	usageRecv int64     // recvBytes counted to usage, usagemu
+	usageSent int64
+
+	rdmu sync.Mutex // read goroutine state, also taken by quic data streams
+
+	frameTimeout time.Duration // partial frame grace period
+	writeTimeout time.Duration // socket write deadline, 0 for none
+	slowSince    time.Time     // write queues saturated since, slow client gc only
+	hshead       []byte        // handshake beginning read to tell an info request
+	ticket       []byte        // session ticket issued, nil for not resumable, connmu
+	parkedAt     time.Time     // closed and parked for resume, by server clock
+	resumed      bool          // session of a parked conn, read goroutine only till confirmed
+	backpressure string        // write queue full policy
+	hsStartAt    time.Time     // by server clock, for handshake timeout
+	clock        clock         // keepalive time source
+	sniffers     tcpSniffers
+	tap          tcpTap
+
+	closed      int32 // 1 when doClose called
+	closeLocal  bool  // closed by us, valid after closed
+	closeReason string
+	stopC       chan bool
+	loops       sync.WaitGroup // read/write/ping goroutines
+	srvo        *TCPServer
+	logger      loggerHolder // see SetLogger
 }
 
 type TCPServer struct {
-	Oniono Object // TODO
+	Oniono Object // *Onion, forward onion requests of clients when set
 	lsners []net.Listener
 
 	Pubkey *CryptoKey
 	Seckey *CryptoKey
+	keymu  deadlock.RWMutex // of Pubkey and Seckey, see RotateKey
+
+	closedmu deadlock.Mutex
+	closedC  chan struct{} // closed and renewed when a conn closed, see connClosedC
 
 	// c's flow: accept->incomingq -> unconfirmedq -> acceptedq
-	connmu   deadlock.RWMutex
-	Conns    map[string]*TCPSecureConn // binsk =>
-	hsconnmu deadlock.RWMutex
-	HSConns  map[net.Conn]*TCPSecureConn
+	connmu     deadlock.RWMutex
+	Conns      map[string]*TCPSecureConn // binsk =>
+	identseq   uint64                    // last conn identifier, connmu
+	onionConns map[uint64]*TCPSecureConn // Identifier =>
+	hsconnmu   deadlock.RWMutex
+	HSConns    map[net.Conn]*TCPSecureConn
+
+	// conn closed by malformed packet or protocol error, called in its read goroutine
+	OnConnError func(c *TCPSecureConn, err error)
+	// oob send of c, see TCPSecureConn.OnOOBData, data valid only during the call
+	OnOOBData func(c *TCPSecureConn, dstpk *CryptoKey, data []byte)
+	// no conn left on the old key after RotateKey, closed by drain timeout
+	OnKeyRotated func(oldpk, newpk *CryptoKey, closed int)
+
+	// return non nil writer to record conn's raw stream, default off
+	RecordConn func(c net.Conn) io.Writer
+
+	handlermu deadlock.RWMutex
+	handlers  map[byte]TCPPacketHandler // registered by user
+
+	acceptwg     sync.WaitGroup
+	admitmu      sync.Mutex // admit to HSConns by all accept loops, see acceptPool
+	shuttingDown int32      // atomic
+	dialFdUntil  int64      // unixnano, accept paused till when a dial ran out of fds, atomic
+	stopC        chan bool
+
+	admin     *http.Server // admin api, nil if not listened
+	adminAddr net.Addr
+	adminSock string // unix socket path of admin, removed by Shutdown
+
+	cfgv    atomic.Value // *TCPServerConfig, swapped by Reload
+	cnts    TCPServerCounters
+	hslat   LatencyHist                   // handshake latency of confirmed conns
+	pktcnts [NUM_RESERVED_PORTS + 1]int64 // received packets by type, the last for routed data, atomic
+	clock   clock                         // rate limit and conns' keepalive time source
+	ipmu    deadlock.Mutex
+	ips     map[string]*tcpIPState // rate limit and ban state of source ips, ipmu
+	ipgc    time.Time              // last sweep of ips, ipmu
+	bans    BanStore               // of source ips and ranges, see ban_file
+	logger  loggerHolder           // see SetLogger
+	bsinfo  bootstrapInfoHolder    // see SetMOTD
+	parkmu  deadlock.Mutex
+	parked  map[string]*TCPSecureConn // binpk => closed conn waiting resume, parkmu
+
+	hsreplay *tcpReplayCache // client temp nonces and keys of recent handshakes
+	cluster  *TCPCluster     // nil if not in a cluster
+
+	usagemu deadlock.Mutex
+	usages  map[string]*tcpUsage // binpk => bytes of client, see Usage, usagemu
+}
+
+// server wide counters, atomic access
+type TCPServerCounters struct {
+	FdExhausted   int64 // accept or dial failed with EMFILE/ENFILE
+	AcceptRetried int64 // accept failed with temporary error
+	AcceptedIPv4  int64 // conns accepted from ipv4 addr, ipv4 mapped included
+	AcceptedIPv6  int64
+	Overloaded    int64 // new conn rejected by admission control
+	ConnLimited   int64 // new conn rejected by max_conns or max_conns_per_ip
+	ClosedLocal   int64 // confirmed conn closed by us, timeout, kick ...
+	ClosedRemote  int64 // confirmed conn closed by peer, EOF, RST ...
+
+	CongestionThrottled int64 // source throttled for slow destination
+	CongestionKicked    int64 // source disconnected for slow destination
+
+	OOBLimited int64 // oob send dropped by rate limit
+	OOBAbusers int64 // conns ever over oob rate limit
+
+	RateLimited        int64 // packet dropped by per conn or per ip recv rate limit
+	HandshakeThrottled int64 // new conn rejected by per ip handshake rate limit
+	Bans               int64 // ips banned automatically
+	BanRejected        int64 // new conn rejected from banned ip
+	QuotaThrottled     int64 // relayed packet dropped over quota
+	QuotaKicked        int64 // conn closed over quota
+
+	ConnErrors int64 // conns closed by malformed packet or protocol error
+
+	HandshakeFailed   int64 // conns closed before confirmed
+	HandshakeTimeouts int64 // conns evicted for not confirmed in time
+	HandshakeEvicted  int64 // unconfirmed conns evicted for new conn over max_conns
+	WriteTimeouts     int64 // socket writes blocked over write_timeout
+	SlowEvicted       int64 // confirmed conns evicted for saturated write queues
+	InfoServed        int64 // bootstrap info requests answered
+	Resumed           int64 // sessions resumed on a new conn
+	ResumeExpired     int64 // parked sessions not resumed in time
+	HandshakeReplays  int64 // handshakes rejected for replayed temp nonce or key
+	BytesRecv         int64 // on wire of all conns
+	BytesSent         int64
+	OnionForwarded    int64 // onion requests of clients sent out
+	OnionReturned     int64 // onion responses queued to clients
 }
 
 // vconn: peer0pk, peer0cid <=> peer1pk, peer1cid
 
 /////
-func NewTCPSecureConn(c net.Conn) *TCPSecureConn {
+// cbs subscribed before any goroutine started, see TCPConnCallbacks
+func NewTCPSecureConn(c net.Conn, cbs ...TCPConnCallbacks) *TCPSecureConn {
+	return newTCPSecureConn(c, DefaultTCPConnConfig(), cbs...)
+}
+func newTCPSecureConn(c net.Conn, cfg *TCPConnConfig, cbs ...TCPConnCallbacks) *TCPSecureConn {
 	this := &TCPSecureConn{}
+	this.subs.add(cbs...)
 	this.Sock = c
-	c.(*net.TCPConn).SetWriteBuffer(128 * 1024)
+	if rc, ok := c.(*recordConn); ok {
+		c = rc.Conn
+	}
+	if wc, ok := c.(*wsConn); ok {
+		c = wc.Conn
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetWriteBuffer(cfg.SockWriteBuffer)
+	}
 
 	this.ConnInfos = map[string]*PeerConnInfo{}
 	this.ConnInfos2 = map[uint8]*PeerConnInfo{}
 	this.ConnIds = this.initConnids()
-	this.crbuf = buffer.NewRing(buffer.New(1024 * 1024))
-	this.cwctrlq = make(chan []byte, 64)
-	this.cwdataq = make(chan []byte, 128)
+	this.crbuf = buffer.NewRing(buffer.New(int64(cfg.ReadBufferSize)))
+	this.crbufSize = int64(cfg.ReadBufferSize)
+	this.cwctrlq = make(chan []byte, cfg.CtrlQueueSize)
+	this.cwdataq = make(chan []byte, cfg.DataQueueSize)
 	this.stopC = make(chan bool, 0)
+	this.createdAt = time.Now()
+	this.clock = defaultClock
+	this.frameTimeout = time.Duration(cfg.FrameTimeout) * time.Second
+	this.writeTimeout = time.Duration(cfg.WriteTimeout) * time.Second
+	this.backpressure = cfg.Backpressure
 
 	return this
 }
 func (this *TCPSecureConn) Start() {
+	this.loops.Add(2)
 	go this.runReadLoop()
 	go this.runWriteLoop()
 }
 func (this *TCPSecureConn) runReadLoop() {
-	lastLogTime := time.Now().Add(-3 * time.Second)
-	spdc := NewSpeedCalc()
-	var nxtpktlen uint16
+	defer this.loops.Done()
+	var framer FrameReader
+	var frameStart time.Time // first byte time of current partial frame
+	closeLocal, closeReason := false, ""
 	stop := false
 	for !stop {
 		c := this.Sock
-		if int(time.Since(lastLogTime).Seconds()) >= 1 {
-			lastLogTime = time.Now()
-			log.Printf("------- async reading... ----- spd: %d, %s ------\n", spdc.Avgspd, c.RemoteAddr())
+		// never read more than the ring buffer can take, the rest waits in socket buffer,
+		// the ring overwrites unread bytes when written over its size
+		rdbuf := this.rdbufs.get(&this.rdbufs.sock)[:3000]
+		free := int(this.crbufSize - this.crbuf.Len())
+		if free <= 0 {
+			// only we drain it, and a frame fits in half of it
+			this.logr().Warn("Read buffer full", "len", this.crbuf.Len(), "addr", c.RemoteAddr())
+			closeLocal, closeReason = true, "read buffer full"
+			break
+		}
+		if free < len(rdbuf) {
+			rdbuf = rdbuf[:free]
 		}
-		rdbuf := make([]byte, 3000)
 		rn, err := c.Read(rdbuf)
 		gopp.ErrPrint(err, rn, c.RemoteAddr())
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			this.logr().Warn("Frame not completed in time", "waited", time.Since(frameStart), "pktlen", framer.Pending(), "addr", c.RemoteAddr())
+			closeLocal, closeReason = true, TCP_CLOSE_FRAME_TIMEOUT
+			break
+		}
 		if err == io.EOF {
-			this.Status = TCP_STATUS_NO_STATUS
+			this.setStatus(TCP_STATUS_NO_STATUS)
 		}
 		if err != nil {
+			closeReason = err.Error()
 			break
 		}
 		rdbuf = rdbuf[:rn]
 		if rn < 1 {
-			log.Println("Invalid packet:", rn, c.RemoteAddr())
+			this.logr().Warn("Invalid packet", "len", rn, "addr", c.RemoteAddr())
+			closeReason = "empty read"
 			break
 		}
-
-		if this.OnNetRecv != nil {
-			this.OnNetRecv(rn)
+		atomic.StoreInt64(&this.lastRecvAt, time.Now().UnixNano())
+		atomic.AddInt64(&this.recvBytes, int64(rn))
+		if this.srvo != nil {
+			atomic.AddInt64(&this.srvo.cnts.BytesRecv, int64(rn))
 		}
-		spdc.Data(rn)
-		gopp.Assert(this.crbuf.Len()+int64(rn) <= this.crbuf.Cap(), "ring buffer full",
-			this.crbuf.Len()+int64(rn), this.crbuf.Cap())
+
+		this.emitNetRecv(rn)
 		wn, err := this.crbuf.Write(rdbuf)
 		gopp.ErrPrint(err)
 		gopp.Assert(wn == rn, "write ring buffer failed", rn, wn)
-		this.doReadPacket(&nxtpktlen)
+		this.rdmu.Lock()
+		pktn, err := this.doReadPacket(&framer)
+		this.rdmu.Unlock()
+		atomic.AddInt64(&this.recvPkts, int64(pktn))
+		if err == errTCPInfoServed {
+			closeLocal, closeReason = true, TCP_CLOSE_INFO_SERVED
+			break
+		}
+		if err != nil {
+			this.logr().Warn("Read packet failed", "err", err, "addr", c.RemoteAddr())
+			closeLocal, closeReason = true, err.Error()
+			if !this.isClosed() {
+				this.emitError(err)
+			}
+			break
+		}
+
+		// stuck frame detect, peer declared a frame but not send it all
+		pending := this.crbuf.Len() > 0 || (this.status() != TCP_STATUS_NO_STATUS && framer.HasHeader())
+		if pending && (frameStart.IsZero() || pktn > 0) {
+			frameStart = time.Now()
+			c.SetReadDeadline(frameStart.Add(this.frameTimeout))
+		} else if !pending && !frameStart.IsZero() {
+			frameStart = time.Time{}
+			c.SetReadDeadline(time.Time{})
+		}
 	}
-	log.Println("read done.", this.Sock.RemoteAddr(), tcpstname(this.Status))
-	this.doClose()
+	this.logr().Debug("Read routine done", "addr", this.Sock.RemoteAddr(), "status", tcpstname(this.status()))
+	this.rdbufs.release()
+	this.doClose(closeLocal, closeReason)
 }
-func (this *TCPSecureConn) doReadPacket(nxtpktlen *uint16) {
+
+// return handled packet count
+func (this *TCPSecureConn) doReadPacket(framer *FrameReader) (int, error) {
+	pktn := 0
 	stop := false
 	for !stop {
+		if this.isClosed() {
+			return pktn, ErrClosed
+		}
 		var rdbuf []byte
 		switch {
-		case this.Status == TCP_STATUS_NO_STATUS:
+		case this.status() == TCP_STATUS_NO_STATUS:
 			// handshake request packet
-			*nxtpktlen = (PUBLIC_KEY_SIZE+NONCE_SIZE)*2 + MAC_SIZE
-			rdbuf = make([]byte, *nxtpktlen)
-			rn, err := this.crbuf.Read(rdbuf)
+			if this.wantInfoRequest() {
+				if this.crbuf.Len() < INFO_REQUEST_PACKET_LENGTH {
+					return pktn, nil
+				}
+				if err := this.serveBootstrapInfo(); err != nil {
+					return pktn, err
+				}
+			}
+			if this.crbuf.Len()+int64(len(this.hshead)) < TCP_CLIENT_HANDSHAKE_SIZE {
+				return pktn, nil // wait the whole handshake packet
+			}
+			rdbuf = make([]byte, TCP_CLIENT_HANDSHAKE_SIZE)
+			rn, err := io.ReadFull(this.crbuf, rdbuf[copy(rdbuf, this.hshead):])
 			gopp.ErrPrint(err)
-			gopp.Assert(rn == cap(rdbuf), "not read enough data", rn, cap(rdbuf))
-		case this.Status == TCP_STATUS_UNCONFIRMED || this.Status == TCP_STATUS_CONFIRMED:
+			gopp.Assert(rn+len(this.hshead) == cap(rdbuf), "not read enough data", rn, cap(rdbuf))
+			this.hshead = nil
+		case this.status() == TCP_STATUS_UNCONFIRMED || this.status() == TCP_STATUS_CONFIRMED:
 			// length+payload
-			if *nxtpktlen == 0 && this.crbuf.Len() < int64(unsafe.Sizeof(uint16(0))) {
-				return
+			pktlen, ok, err := framer.ReadHeader(this.crbuf)
+			if !ok || err != nil {
+				return pktn, err
 			}
-			if *nxtpktlen == 0 && this.crbuf.Len() >= int64(unsafe.Sizeof(uint16(0))) {
-				pktlenbuf := make([]byte, 2)
-				rn, err := this.crbuf.Read(pktlenbuf)
-				gopp.ErrPrint(err, rn)
-				err = binary.Read(bytes.NewBuffer(pktlenbuf), binary.BigEndian, nxtpktlen)
-				gopp.ErrPrint(err)
+			if pktlen == TCP_REHANDSHAKE_MARK && this.canRehandshake() {
+				this.startRehandshake()
+				framer.Reset()
+				continue
 			}
-			if this.crbuf.Len() < int64(*nxtpktlen) {
-				return
+			rdbuf, err = framer.ReadFrame(this.crbuf, this.rdbufs.get(&this.rdbufs.frame))
+			if rdbuf == nil || err != nil {
+				return pktn, err
 			}
-			rdbuf = make([]byte, 2+*nxtpktlen)
-			err := binary.Write(gopp.NewBufferBuf(rdbuf).WBufAt(0), binary.BigEndian, *nxtpktlen)
-			gopp.ErrPrint(err)
-			rn, err := this.crbuf.Read(rdbuf[2:])
-			gopp.ErrPrint(err)
-			gopp.Assert(rn+2 == cap(rdbuf), "not read enough data", rn+2, cap(rdbuf))
 		}
 
 		switch {
-		case this.Status == TCP_STATUS_NO_STATUS:
-			this.HandleHandshake(rdbuf)
-			this.Status = TCP_STATUS_UNCONFIRMED
-		case this.Status == TCP_STATUS_UNCONFIRMED:
-			datlen, plnpkt, err := this.Unpacket(rdbuf)
-			gopp.ErrPrint(err, len(rdbuf), *nxtpktlen, "//")
+		case this.status() == TCP_STATUS_NO_STATUS:
+			if this.rehs && !isTCPNoiseHandshake(rdbuf) && !bytes.Equal(rdbuf[:PUBLIC_KEY_SIZE], this.Pubkey.Bytes()) {
+				return pktn, errors.New("Re-handshake with another pubkey")
+			}
+			if err := this.HandleHandshake(rdbuf); err != nil {
+				return pktn, err
+			}
+			this.setStatus(TCP_STATUS_UNCONFIRMED)
+		case this.status() == TCP_STATUS_UNCONFIRMED:
+			datlen, plnpkt, err := this.unpacketTo(this.rdbufs.get(&this.rdbufs.plain)[:0], rdbuf)
+			gopp.ErrPrint(err, len(rdbuf), "//")
+			if err != nil {
+				return pktn, errors.Wrap(err, "Decrypt first packet")
+			}
+			if len(plnpkt) == 0 {
+				return pktn, errors.New("Empty first packet")
+			}
 			ptype := plnpkt[0]
-			log.Println("read data pkt:", len(rdbuf), datlen, ptype, tcppktname(ptype))
+			this.logr().Debug("Read first packet", "rdlen", len(rdbuf), "datlen", datlen, "pktname", tcppktname(ptype))
+			this.sniff(plnpkt)
+			this.tapPacket(TCP_TAP_RECV, plnpkt)
 			this.HandlePingRequest(plnpkt)
-			this.Status = TCP_STATUS_CONFIRMED
-			if this.OnConfirmed != nil {
-				this.OnConfirmed(this)
+			this.setStatus(TCP_STATUS_CONFIRMED)
+			if this.rehs {
+				this.endRehandshake()
+				break
 			}
-			this.LastPinged = time.Now()
+			atomic.StoreInt64(&this.hsLatency, int64(time.Since(this.createdAt)))
+			this.emitConfirmed()
+			this.startQUICData()
+			this.LastPinged = this.clock.Now()
+			this.loops.Add(1)
 			go this.doPingLoop()
-		case this.Status == TCP_STATUS_CONFIRMED:
-			// TODO read ringbuffer
-			datlen, plnpkt, err := this.Unpacket(rdbuf)
+		case this.status() == TCP_STATUS_CONFIRMED:
+			datlen, plnpkt, err := this.unpacketTo(this.rdbufs.get(&this.rdbufs.plain)[:0], rdbuf)
 			gopp.ErrPrint(err)
+			if err != nil {
+				if err = this.onDecryptFailed(err); err != nil {
+					return pktn, err
+				}
+				break
+			}
+			this.macFails = 0
+			if len(plnpkt) == 0 {
+				return pktn, errors.New("Empty packet")
+			}
+			if ok, err := this.allowRecv(plnpkt); err != nil {
+				return pktn, err
+			} else if !ok {
+				break
+			}
 			ptype := plnpkt[0]
+			if this.srvo != nil {
+				this.srvo.countPacket(ptype)
+			}
 			if ptype < NUM_RESERVED_PORTS {
-				log.Printf("read data pkt: rdlen:%d, datlen:%d, pktype: %d, pktname: %s, %s\n",
-					len(rdbuf), datlen, ptype, tcppktname(ptype), this.Sock.RemoteAddr().String())
+				this.logr().Debug("Read packet", "rdlen", len(rdbuf), "datlen", datlen,
+					"pktname", tcppktname(ptype), "addr", this.Sock.RemoteAddr())
 			}
-			switch {
-			case ptype == TCP_PACKET_PING:
-				this.HandlePingRequest(plnpkt)
-				log.Println("resp pong:", this.Sock.RemoteAddr())
-			case ptype == TCP_PACKET_PONG:
-				// this.HandlePingResponse(plnpkt)
-				this.LastPinged = time.Now()
-			case ptype == TCP_PACKET_ROUTING_REQUEST:
-				this.handleRoutingRequest(plnpkt)
-			case ptype == TCP_PACKET_ROUTING_RESPONSE:
-				// this.HandleRoutingResponse(plnpkt)
-			case ptype == TCP_PACKET_CONNECTION_NOTIFICATION:
-				// this.HandleConnectionNotification(plnpkt)
-			case ptype == TCP_PACKET_DISCONNECT_NOTIFICATION:
-				this.HandleDisconnectNotification(plnpkt)
-			case ptype == TCP_PACKET_OOB_SEND: // TODO
-			case ptype == TCP_PACKET_OOB_RECV: // TODO
-			case ptype == TCP_PACKET_ONION_REQUEST: // TODO
-			case ptype == TCP_PACKET_ONION_RESPONSE: // TODO
-			case ptype >= NUM_RESERVED_PORTS:
-				this.HandleRoutingData(plnpkt)
-			case ptype > TCP_PACKET_ONION_RESPONSE && ptype < NUM_RESERVED_PORTS:
-				// this.HandleReservedData(plnpkt)
-			default:
-				log.Fatalln("wtf", ptype, tcppktname(ptype))
+			this.sniff(plnpkt)
+			this.tapPacket(TCP_TAP_RECV, plnpkt)
+			if err := this.dispatchPacket(plnpkt); err != nil {
+				return pktn, err
 			}
 		default:
-			log.Fatalln("wtf", tcpstname(this.Status))
+			return pktn, errors.Errorf("Invalid status: %s", tcpstname(this.status()))
 		}
-		*nxtpktlen = 0
+		pktn++
 	}
+	return pktn, nil
 }
 
 func (this *TCPSecureConn) runWriteLoop() {
-	spdc := NewSpeedCalc()
+	defer this.loops.Done()
 
 	flushCtrl := func() error {
 		for len(this.cwctrlq) > 0 {
 			data := <-this.cwctrlq
-			atomic.AddInt32(&this.cwctrldlen, -int32(len(data)))
+			this.ctrlDequeued(data)
 			var datai = []interface{}{data}
 			wn, err := this.WritePacket(datai[0].([]byte))
 			gopp.ErrPrint(err, wn, this.Sock.RemoteAddr())
 			if err != nil {
+				this.dropPacket(data)
 				return err
 			}
-			spdc.Data(wn)
-			if this.OnNetSent != nil {
-				this.OnNetSent(wn)
-			}
+			this.emitNetSent(wn)
+			this.tapPacket(TCP_TAP_SENT, data)
 			// gopp.Assert(wn == len(datai[0].([]byte)), "write lost", wn, len(datai[0].([]byte)), this.ServAddr)
 		}
 		return nil
 	}
 
-	lastLogTime := time.Now().Add(-3 * time.Second)
+	var werr error // write failed, peer gone
 	stop := false
 	for !stop {
 		data, rdok, ctrlq := []byte(nil), false, false
 		select {
+		case <-this.stopC:
+			goto endloop
 		case data, rdok = <-this.cwctrlq:
-			atomic.AddInt32(&this.cwctrldlen, -int32(len(data)))
+			this.ctrlDequeued(data)
 			ctrlq = true
 		case data, rdok = <-this.cwdataq:
-			atomic.AddInt32(&this.cwdatadlen, -int32(len(data)))
+			this.dataDequeued(data)
 		}
 		if !rdok && len(data) == 0 { // maybe close
 			break
@@ -335,107 +609,249 @@ func (this *TCPSecureConn) runWriteLoop() {
 		wn, err := this.WritePacket(datai[0].([]byte))
 		gopp.ErrPrint(err, wn, this.Sock.RemoteAddr())
 		if err != nil {
+			this.dropPacket(data)
+			werr = err
 			goto endloop
 		}
-		spdc.Data(wn)
-		if this.OnNetSent != nil {
-			this.OnNetSent(wn)
-		}
+		this.emitNetSent(wn)
+		this.tapPacket(TCP_TAP_SENT, data)
 		// gopp.Assert(wn == len(datai[0].([]byte)), "write lost", wn, len(datai[0].([]byte)), this.ServAddr)
 		if !ctrlq {
 			err = flushCtrl()
 			gopp.ErrPrint(err)
 			if err != nil {
+				werr = err
 				goto endloop
 			}
 		}
-
-		if int(time.Since(lastLogTime).Seconds()) >= 1 {
-			lastLogTime = time.Now()
-			log.Printf("------- async wrote ----- spd: %d, %s, pq:%d, cq:%d------\n",
-				spdc.Avgspd, this.Sock.RemoteAddr(), len(this.cwctrlq), len(this.cwdataq))
-		}
 	}
 endloop:
-	log.Println("write routine done:", this.Sock.RemoteAddr())
-	this.doClose()
+	this.logr().Debug("Write routine done", "addr", this.Sock.RemoteAddr())
+	if werr != nil {
+		this.doClose(writeCloseReason(werr))
+	} else {
+		this.doClose(true, "write loop done")
+	}
 }
 func (this *TCPSecureConn) SetHandshakeInfo() {
 
 }
-func (this *TCPSecureConn) doPingLoop() { // TODO this routine has delay after client closed
+
+// like do_TCP_confirmed, ping every TCP_PING_FREQUENCY seconds, close the conn
+// if the pong of outstanding ping not back in TCP_PING_TIMEOUT seconds.
+func (this *TCPSecureConn) doPingLoop() {
+	defer this.loops.Done()
+	closeLocal, closeReason := true, "ping loop done"
 	stop := false
-	tick := time.NewTicker(5*time.Second + TCP_PING_FREQUENCY*time.Second/2)
+	tickC, tickStop := this.clock.Tick(time.Second)
+	defer tickStop()
 	for !stop {
 		select {
 		case <-this.stopC:
 			goto endloop
-		case <-tick.C:
-			// time.Sleep(TCP_PING_FREQUENCY * time.Second / 1)
-			if int(time.Since(this.LastPinged).Seconds()) > (TCP_PING_FREQUENCY+TCP_PING_TIMEOUT)/1 {
-				log.Println("srv ping timeout:", int(time.Since(this.LastPinged).Seconds()), this.Sock.RemoteAddr())
+		case <-tickC:
+		}
+		now := this.clock.Now()
+		pinged := now.Sub(this.LastPinged)
+		if atomic.LoadUint64(&this.Pingid) != 0 {
+			if pinged > TCP_PING_TIMEOUT*time.Second {
+				this.logr().Info("Ping timeout", "secs", int(pinged.Seconds()), "addr", this.Sock.RemoteAddr())
+				closeReason = TCP_CLOSE_PING_TIMEOUT
 				goto endloop
 			}
+			continue
+		}
+		if pinged < TCP_PING_FREQUENCY*time.Second {
+			continue
 		}
+		this.hsmu.Lock()
+		atomic.StoreInt64(&this.pingSentAt, now.UnixNano())
 		pingpkt := this.MakePingPacket()
-		_, err := this.Sock.Write(pingpkt)
+		wn, err := this.sockWrite(pingpkt)
+		if err == nil {
+			this.SentNonce.Incr()
+		}
+		this.hsmu.Unlock()
 		gopp.ErrPrint(err, this.Sock.RemoteAddr())
 		if err != nil {
+			closeLocal, closeReason = writeCloseReason(err)
 			break
 		}
-		this.SentNonce.Incr()
-		log.Println("Sent ping:", this.Pingid)
-		// this.LastPinged = time.Now()
-		// log.Println("sent ping to:", len(pingpkt), this.Sock.RemoteAddr(), this.Pingid)
+		this.noteSent(wn)
+		this.LastPinged = now
+		this.logr().Debug("Sent ping", "pingid", atomic.LoadUint64(&this.Pingid))
 	}
 endloop:
-	log.Println("ping routine done:", this.Sock.RemoteAddr())
-	this.doClose()
+	this.logr().Debug("Ping routine done", "addr", this.Sock.RemoteAddr())
+	this.doClose(closeLocal, closeReason)
 }
-func (this *TCPSecureConn) doClose() {
-	info := this.Sock.RemoteAddr()
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("already closed:", info, err)
-		}
-	}()
 
-	this.Status = TCP_STATUS_NO_STATUS
-	if this.OnClosed != nil {
-		this.OnClosed(this)
+// well known CloseReason
+const (
+	TCP_CLOSE_LOCAL         = "closed by local"
+	TCP_CLOSE_PING_TIMEOUT  = "ping timeout"
+	TCP_CLOSE_FRAME_TIMEOUT = "frame timeout"
+	TCP_CLOSE_CONGESTION    = "congestion"
+	TCP_CLOSE_REPLACED      = "replaced by new conn"
+	TCP_CLOSE_SHUTDOWN      = "server shutdown"
+	TCP_CLOSE_BANNED        = "banned by rate limit"
+	TCP_CLOSE_QUEUE_FULL    = "write queue full"
+	TCP_CLOSE_HS_TIMEOUT    = "handshake timeout"
+	TCP_CLOSE_WRITE_TIMEOUT = "write timeout"
+	TCP_CLOSE_SLOW_CLIENT   = "slow client"
+	TCP_CLOSE_INFO_SERVED   = "bootstrap info served"
+	TCP_CLOSE_EVICTED       = "evicted for new conn"
+	TCP_CLOSE_ADMIN         = "closed by admin"
+	TCP_CLOSE_KEY_ROTATED   = "server key rotated"
+	TCP_CLOSE_QUOTA         = "over quota"
+)
+
+// can be called from read/write/ping routines and user, only the first call works.
+// write queues are not closed, so late senders get error instead of panic.
+func (this *TCPSecureConn) doClose(local bool, reason string) {
+	if !atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		return
 	}
+	this.closeLocal, this.closeReason = local, reason
+	this.logr().Info("Conn closed", "by", gopp.IfElseStr(local, "local", "remote"), "reason", reason, "addr", this.Sock.RemoteAddr())
+
+	this.setStatus(TCP_STATUS_NO_STATUS)
+	this.Sock.Close()
+	close(this.stopC)
+	this.drainWriteQueues()
+
+	this.emitClosed()
+	this.subs.clear()
+	this.connmu.Lock()
+	defer this.connmu.Unlock()
 	this.OnClosed = nil
 	this.OnConfirmed = nil
 	this.OnNetRecv = nil
 	this.OnNetSent = nil
+	this.OnNetDrop = nil
+	this.OnError = nil
+	this.OnOOBData = nil
+}
+func (this *TCPSecureConn) Close() { this.doClose(true, TCP_CLOSE_LOCAL) }
+
+// ClosedLocally reports whether the close was initiated on our side
+// (Close, timeout, kick) rather than by peer (EOF, reset).
+// Valid in and after OnClosed.
+func (this *TCPSecureConn) ClosedLocally() bool { return this.closeLocal }
+func (this *TCPSecureConn) CloseReason() string { return this.closeReason }
+func (this *TCPSecureConn) isClosed() bool      { return atomic.LoadInt32(&this.closed) == 1 }
+
+// TCP_STATUS_*, set by read goroutine and doClose, read by any
+func (this *TCPSecureConn) status() uint8      { return uint8(atomic.LoadInt32(&this.st)) }
+func (this *TCPSecureConn) setStatus(st uint8) { atomic.StoreInt32(&this.st, int32(st)) }
+
+// discard queued packets, keep the length counters right
+func (this *TCPSecureConn) drainWriteQueues() {
+	for len(this.cwctrlq) > 0 {
+		data := <-this.cwctrlq
+		this.ctrlDequeued(data)
+		this.dropPacket(data)
+	}
+	for len(this.cwdataq) > 0 {
+		data := <-this.cwdataq
+		this.dataDequeued(data)
+		this.dropPacket(data)
+	}
+}
 
-	this.Sock.Close()
-	close(this.cwctrlq)
-	close(this.cwdataq)
-	close(this.stopC)
+// cwctrldlen/cwdatadlen only changed by these. Add before the channel send
+// and roll back if full, sub after a successful receive. So a racing writer
+// loop never sees the counter below zero, it may over count by the in flight
+// sends, and match the bytes in queue when quiet.
+func (this *TCPSecureConn) enqueueCtrl(data []byte) bool {
+	return this.enqueue(this.cwctrlq, &this.cwctrldlen, data, this.ctrlDequeued)
+}
+func (this *TCPSecureConn) enqueueData(data []byte) bool {
+	return this.enqueue(this.cwdataq, &this.cwdatadlen, data, this.dataDequeued)
+}
+func (this *TCPSecureConn) ctrlDequeued(data []byte) {
+	checkQueueLen(atomic.AddInt32(&this.cwctrldlen, -int32(len(data))), "ctrl")
+}
+func (this *TCPSecureConn) dataDequeued(data []byte) {
+	checkQueueLen(atomic.AddInt32(&this.cwdatadlen, -int32(len(data))), "data")
+}
+
+// CheckQueueAccounting panics when a write queue byte counter goes negative.
+// default off, on with -tags mintoxdebug.
+var CheckQueueAccounting = checkQueueAccountingDefault
+
+func checkQueueLen(n int32, name string) {
+	if CheckQueueAccounting && n < 0 {
+		log.Panicln("write queue byte counter negative:", name, n)
+	}
+}
+
+func (this *TCPSecureConn) dropPacket(data []byte) {
+	this.emitNetDrop(len(data))
+}
+
+// ConnInfos2 is the connid => peer reverse index of ConnInfos
+func (this *TCPSecureConn) PeerForConnID(connid uint8) (*CryptoKey, bool) {
+	this.connmu.RLock()
+	defer this.connmu.RUnlock()
+	if pci, ok := this.ConnInfos2[connid]; ok {
+		return pci.Pubkey, true
+	}
+	return nil, false
 }
-func (this *TCPSecureConn) Close() { this.doClose() }
 
 func (this *TCPSecureConn) HandleRoutingData(rpkt []byte) {
 	connid := rpkt[0]
+	this.connmu.RLock()
 	pci, ok := this.ConnInfos2[connid]
+	this.connmu.RUnlock()
 	if !ok {
-		log.Println("connid not found:", connid)
+		this.logr().Debug("Connid not found", "connid", connid)
 		return
 	}
-	peerco, ok2 := this.srvo.Conns[pci.Pubkey.BinStr()]
-	if !ok2 {
-		log.Println("peer not found:", pci.Pubkey.ToHex20())
+	if pci.Status != 2 {
+		this.logr().Debug("Route not online, drop", "route", pci)
+		return
+	}
+	if pci.Node != "" {
+		if this.srvo.cluster.forwardData(this, pci, rpkt[1:]) {
+			this.onForwarded()
+		}
+		return
+	}
+	peerco := this.srvo.confirmedConn(pci.Pubkey)
+	if peerco == nil {
+		this.logr().Debug("Peer not found or not confirmed", "peer", pci.Pubkey.ToHex20())
 		return
 	}
 	pci3, ok3 := peerco.ConnInfos[this.Pubkey.BinStr()]
 	if !ok3 {
-		log.Println("peer not connect you:", peerco.Sock.RemoteAddr())
+		this.logr().Debug("Peer not connect you", "addr", peerco.Sock.RemoteAddr())
+		return
+	}
+	if !this.allowForward(peerco, len(rpkt)-1) {
+		atomic.AddInt64(&this.fwdDropped, 1)
 		return
 	}
-	log.Println("src/dst connid:", connid, pci3.Connid, this.Sock.RemoteAddr(), peerco.Sock.RemoteAddr())
 	_, err := peerco.SendDataPacket(pci3.Connid, rpkt[1:])
 	gopp.ErrPrint(err, connid, this.Sock.RemoteAddr(), pci3.Connid, peerco.Sock.RemoteAddr())
+	if err != nil {
+		this.onForwardDropped(peerco)
+	} else {
+		this.onForwarded()
+	}
+}
+
+// ConnInfos sorted by self connid, map order is random
+func (this *TCPSecureConn) routesByConnid() []*PeerConnInfo {
+	this.connmu.RLock()
+	pcis := make([]*PeerConnInfo, 0, len(this.ConnInfos2))
+	for _, pci := range this.ConnInfos2 {
+		pcis = append(pcis, pci)
+	}
+	this.connmu.RUnlock()
+	sort.Slice(pcis, func(i, j int) bool { return pcis[i].Connid < pcis[j].Connid })
+	return pcis
 }
 
 func (*TCPSecureConn) initConnids() map[uint8]bool {
@@ -463,6 +879,10 @@ func (this *TCPSecureConn) freeConnid(connid uint8) {
 }
 
 func (this *TCPSecureConn) handleRoutingRequest(reqpkt []byte) {
+	if len(reqpkt) != 1+PUBLIC_KEY_SIZE {
+		this.logr().Warn("Invalid routing request length", "len", len(reqpkt), "addr", this.Sock.RemoteAddr())
+		return
+	}
 	peerpk := NewCryptoKey(reqpkt[1 : 1+PUBLIC_KEY_SIZE])
 	/* If person tries to cennect to himself we deny the request*/
 	if peerpk.Equal(this.Pubkey.Bytes()) {
@@ -485,7 +905,7 @@ func (this *TCPSecureConn) handleRoutingRequest(reqpkt []byte) {
 	///
 	connid := this.nextConnid()
 	if connid == 0 {
-		log.Println("No free connid")
+		this.logr().Warn("No free connid", "addr", this.Sock.RemoteAddr())
 		// response connid=0
 		// send_routing_resonse()
 		this.sendRoutingResponse(0, peerpk)
@@ -497,17 +917,17 @@ func (this *TCPSecureConn) handleRoutingRequest(reqpkt []byte) {
 	pci.Pubkey = peerpk
 	pci.Connid = connid
 
+	this.connmu.Lock()
 	this.ConnInfos[peerpk.BinStr()] = pci
 	this.ConnInfos2[connid] = pci
-	log.Println("Use routing connid:", connid, peerpk.ToHex())
+	this.connmu.Unlock()
+	this.logr().Debug("Use routing connid", "route", pci)
 	// send_routing_resonse()
 	this.sendRoutingResponse(connid, peerpk)
 
 	///
-	this.srvo.connmu.Lock()
-	peerco, ok1 := this.srvo.Conns[peerpk.BinStr()]
-	this.srvo.connmu.Unlock()
-	if ok1 {
+	peerco := this.srvo.confirmedConn(peerpk)
+	if peerco != nil {
 		peerco.connmu.Lock()
 		pci2, ok2 := peerco.ConnInfos[this.Pubkey.BinStr()]
 		peerco.connmu.Unlock()
@@ -517,10 +937,12 @@ func (this *TCPSecureConn) handleRoutingRequest(reqpkt []byte) {
 
 			pci2.Status = 2
 			pci2.Otherid = connid
-			log.Println("two peer connected each other:", this.Sock.RemoteAddr(), peerco.Sock.RemoteAddr())
+			this.logr().Debug("Two peers connected each other", "route", pci, "route2", pci2, "addr", this.Sock.RemoteAddr(), "addr2", peerco.Sock.RemoteAddr())
 			this.SendConnectNotification(pci.Connid)
 			peerco.SendConnectNotification(pci2.Connid)
 		}
+	} else {
+		this.srvo.cluster.requestRoute(this, pci)
 	}
 }
 
@@ -533,27 +955,90 @@ func (this *TCPSecureConn) sendRoutingResponse(connid uint8, peerpk *CryptoKey)
 	gopp.ErrPrint(err, connid, plnpkt.Len())
 }
 
+// client killed a route, like rm_connection_index.
 func (this *TCPSecureConn) HandleDisconnectNotification(pkt []byte) {
-	connid := pkt[1]
-	pci0, ok0 := this.ConnInfos2[connid]
-	gopp.Assert(ok0, "", connid)
-	peerco, ok1 := this.srvo.Conns[pci0.Pubkey.BinStr()]
-	if !ok1 {
-		log.Println("peer conn not found:", pci0.Pubkey.ToHex20())
+	if len(pkt) != 2 {
+		this.logr().Warn("Invalid disconnect notification length", "len", len(pkt), "addr", this.Sock.RemoteAddr())
 		return
 	}
+	if !this.removeRoute(pkt[1], false) {
+		this.logr().Debug("Connid not found", "connid", pkt[1], "addr", this.Sock.RemoteAddr())
+	}
+}
+
+// DrainRoutes removes all routes of the conn, notifies both the client and
+// peers, and frees the connids, the conn itself keeps open.
+// Use it before migrating or quiescing a client.
+func (this *TCPSecureConn) DrainRoutes() (n int) {
+	for _, pci := range this.routesByConnid() {
+		if this.removeRoute(pci.Connid, true) {
+			n++
+		}
+	}
+	this.logr().Debug("Drained routes", "n", n, "addr", this.Sock.RemoteAddr())
+	return
+}
+
+// unlink the peer side first, then free connid, so a reused connid never
+// meets a stale Otherid on the peer. notifySelf also queues a disconnect
+// notification of connid to our client before the connid is reusable.
+func (this *TCPSecureConn) removeRoute(connid uint8, notifySelf bool) bool {
+	this.connmu.Lock()
+	pci0, ok0 := this.ConnInfos2[connid]
+	if ok0 {
+		delete(this.ConnInfos2, connid)
+		delete(this.ConnInfos, pci0.Pubkey.BinStr())
+	}
+	this.connmu.Unlock()
+	if !ok0 {
+		return false
+	}
+	defer this.freeConnid(connid)
+	if notifySelf {
+		defer this.SendDisconnectNotification(connid)
+	}
+	if pci0.Status != 2 {
+		this.logr().Debug("Disconnect offline route", "route", pci0)
+		return true
+	}
+	if pci0.Node != "" {
+		this.srvo.cluster.closeRoute(this, pci0)
+		pci0.Status, pci0.Otherid, pci0.Node = 0, 0, ""
+		return true
+	}
+
+	peerco := this.srvo.confirmedConn(pci0.Pubkey)
+	if peerco == nil {
+		this.logr().Debug("Peer conn not found", "peer", pci0.Pubkey.ToHex20())
+		if parked, ok := this.srvo.parkedConn(pci0.Pubkey); ok {
+			parked.routeOffline(this.Pubkey.BinStr())
+		}
+		return true
+	}
+	peerco.connmu.RLock()
 	pci2, ok2 := peerco.ConnInfos2[pci0.Otherid]
+	peerco.connmu.RUnlock()
 	if !ok2 {
-		log.Println("peer vconn not found:", pci0.Otherid)
-		return
+		this.logr().Debug("Peer vconn not found", "otherid", pci0.Otherid)
+		return true
 	}
 	peercid := pci2.Connid
+	this.logr().Debug("Disconnect route", "route", pci0, "route2", pci2)
 	pci2.Status = 1
 	pci2.Otherid = 0
-	pci0.Status = 1
+	pci0.Status = 0
 	pci0.Otherid = 0
 	peerco.SendDisconnectNotification(peercid)
+	return true
 }
+
+// client should not send it, validate and ignore like toxcore
+func (this *TCPSecureConn) handleConnectNotification(pkt []byte) {
+	if len(pkt) != 2 {
+		this.logr().Warn("Invalid connect notification length", "len", len(pkt), "addr", this.Sock.RemoteAddr())
+	}
+}
+
 func (this *TCPSecureConn) SendConnectNotification(connid uint8) {
 	data := []byte{TCP_PACKET_CONNECTION_NOTIFICATION, connid}
 	this.SendCtrlPacket(data)
@@ -563,37 +1048,81 @@ func (this *TCPSecureConn) SendDisconnectNotification(connid uint8) {
 	this.SendCtrlPacket(data)
 }
 
-func (this *TCPSecureConn) HandleHandshake(rdbuf []byte) {
-	cliPubkey := NewCryptoKey(rdbuf[:PUBLIC_KEY_SIZE])
-	cliTmpNonce := NewCBNonce(rdbuf[PUBLIC_KEY_SIZE : PUBLIC_KEY_SIZE+NONCE_SIZE])
-	shrkey, err := CBBeforeNm(cliPubkey, this.Seckey)
-	gopp.ErrPrint(err)
+func (this *TCPSecureConn) HandleHandshake(rdbuf []byte) error {
+	if len(rdbuf) != TCP_CLIENT_HANDSHAKE_SIZE {
+		return errors.Wrapf(ErrHandshakeLength, "%d, want %d", len(rdbuf), TCP_CLIENT_HANDSHAKE_SIZE)
+	}
+	if isTCPNoiseHandshake(rdbuf) {
+		return this.handleNoiseHandshake(rdbuf)
+	}
+	req, err := ParseTCPHandshakeRequest(this.Seckey, rdbuf)
+	if err != nil {
+		return err
+	}
+	cliPubkey, shrkey := req.Pubkey, req.Shrkey
+	cliplnpkt := append(append([]byte{}, req.TmpPubkey.Bytes()...), req.SentNonce.Bytes()...)
+	if err := this.checkHandshakeKeys(cliPubkey.Bytes(), req.TmpPubkey.Bytes()); err != nil {
+		return err
+	}
+	if this.handshakeReplayed(req.TmpNonce.Bytes(), req.TmpPubkey.Bytes()) {
+		atomic.AddInt64(&this.srvo.cnts.HandshakeReplays, 1)
+		return errors.Wrapf(ErrHandshakeReplay, "pubkey %s", cliPubkey.ToHex20())
+	}
 	this.Pubkey = cliPubkey
-
-	cliplnpkt, err := DecryptDataSymmetric(shrkey, cliTmpNonce, rdbuf[PUBLIC_KEY_SIZE+NONCE_SIZE:])
-	gopp.ErrPrint(err, len(rdbuf), len(cliplnpkt))
-	hstmppk := NewCryptoKey(cliplnpkt[:PUBLIC_KEY_SIZE])
-	log.Println("hs request from:", this.Sock.RemoteAddr(), hstmppk.ToHex()[:20], cliPubkey.ToHex()[:20])
-	// gopp.Assert(hstmppk.Equal(this.SelfPubkey), info string, args ...interface{})
-	this.RecvNonce = NewCBNonce(cliplnpkt[PUBLIC_KEY_SIZE : PUBLIC_KEY_SIZE+NONCE_SIZE])
-
-	this.SentNonce = CBRandomNonce()
-	srvTmpNonce := CBRandomNonce()
-
-	tmpPubkey, tmpSeckey, _ := NewCBKeyPair()
-	this.Shrkey, _ = CBBeforeNm(hstmppk, tmpSeckey)
+	if parked := this.takeResumable(req.TmpPubkey.Bytes()); parked != nil {
+		return this.handleResume(shrkey, cliplnpkt, parked)
+	}
+	hstmppk := req.TmpPubkey
+	this.logr().Debug("Handshake request", "addr", this.Sock.RemoteAddr(), "tmppk", logkey(hstmppk), "pubkey", cliPubkey.ToHex20())
+	this.RecvNonce = req.SentNonce
+
+	hsrnd := this.handshakeRandom()
+	srvTmpNonce := hsrnd.TmpNonce
+
+	tmpSeckey := hsrnd.TmpSeckey
+	tmpPubkey := CBDerivePubkey(tmpSeckey)
+	sesskey, err := CBBeforeNm(hstmppk, tmpSeckey)
+	if err != nil {
+		return errors.Wrap(ErrHandshakeKey, err.Error())
+	}
 	srvplnpkt := gopp.NewBufferZero()
 	srvplnpkt.Write(tmpPubkey.Bytes())
-	srvplnpkt.Write(this.SentNonce.Bytes())
+	srvplnpkt.Write(hsrnd.SentNonce.Bytes())
 
 	encpkt, err := EncryptDataSymmetric(shrkey, srvTmpNonce, srvplnpkt.Bytes())
 	gopp.ErrPrint(err)
+	return this.sendHandshakeResponse(hsrnd, sesskey, append(append([]byte{}, srvTmpNonce.Bytes()...), encpkt...))
+}
 
+func (this *TCPSecureConn) handshakeRandom() *tcpHsRandom {
+	hsrnd := this.hsrnd
+	if hsrnd == nil {
+		hsrnd = newTCPHsRandom()
+	}
+	if rc, ok := this.Sock.(*recordConn); ok && LogKeyMaterial {
+		rc.record(TCP_RECORD_HSKEY, hsrnd.Bytes())
+	}
+	return hsrnd
+}
+
+func (this *TCPSecureConn) sendHandshakeResponse(hsrnd *tcpHsRandom, sesskey *CryptoKey, body []byte) error {
 	wrbuf := gopp.NewBufferZero()
-	wrbuf.Write(srvTmpNonce.Bytes())
-	wrbuf.Write(encpkt)
-	wn, err := this.Sock.Write(wrbuf.Bytes())
+	if this.rehs {
+		binary.Write(wrbuf, binary.BigEndian, uint16(TCP_REHANDSHAKE_MARK))
+	}
+	wrbuf.Write(body)
+
+	// packets after the response use new keys
+	this.hsmu.Lock()
+	this.SentNonce = hsrnd.SentNonce
+	this.Shrkey = sesskey
+	wn, err := this.sockWrite(wrbuf.Bytes())
+	this.hsmu.Unlock()
 	gopp.ErrPrint(err, wn, wrbuf.Len())
+	if err == nil {
+		this.noteSent(wn)
+	}
+	return err
 }
 
 func (this *TCPSecureConn) HandlePingRequest(rpkt []byte) {
@@ -609,66 +1138,99 @@ func (this *TCPSecureConn) HandlePingRequest(rpkt []byte) {
 }
 
 func (this *TCPSecureConn) WritePacket(data []byte) (int, error) {
-	encpkt, err := this.CreatePacket(data)
+	if qc, ok := this.Sock.(*quicConn); ok && len(data) > 0 && data[0] >= NUM_RESERVED_PORTS {
+		if wn, ok, err := qc.writeData(data); ok {
+			if err == nil {
+				this.noteSent(wn)
+			}
+			return wn, err
+		}
+	}
+	this.hsmu.Lock()
+	defer this.hsmu.Unlock()
+	buf := getTCPBuf()
+	defer putTCPBuf(buf)
+	encpkt, err := appendTCPPacket((*buf)[:0], this.Shrkey, this.SentNonce, data)
 	gopp.ErrPrint(err)
-	wn, err := this.Sock.Write(encpkt)
+	if err != nil {
+		return 0, err
+	}
+	wn, err := this.sockWrite(encpkt)
 	gopp.ErrPrint(err)
 	if err == nil {
 		this.SentNonce.Incr()
+		this.noteSent(wn)
 	}
 	return wn, err
 }
 
+func (this *TCPSecureConn) noteSent(n int) {
+	atomic.StoreInt64(&this.lastSentAt, time.Now().UnixNano())
+	atomic.AddInt64(&this.sentBytes, int64(n))
+	atomic.AddInt64(&this.sentPkts, 1)
+	if this.srvo != nil {
+		atomic.AddInt64(&this.srvo.cnts.BytesSent, int64(n))
+	}
+}
+
+// total bytes on wire, include handshake and ping
+func (this *TCPSecureConn) RecvBytes() int64 { return atomic.LoadInt64(&this.recvBytes) }
+func (this *TCPSecureConn) SentBytes() int64 { return atomic.LoadInt64(&this.sentBytes) }
+
+// zero time if never
+func (this *TCPSecureConn) LastRecvAt() time.Time { return unixnanoTime(atomic.LoadInt64(&this.lastRecvAt)) }
+func (this *TCPSecureConn) LastSentAt() time.Time { return unixnanoTime(atomic.LoadInt64(&this.lastSentAt)) }
+
+// time from accept to confirmed, 0 if not confirmed yet
+func (this *TCPSecureConn) HandshakeLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.hsLatency))
+}
+
+func unixnanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return TimeZero
+	}
+	return time.Unix(0, ns)
+}
+
 func (this *TCPSecureConn) SendCtrlPacket(data []byte) (encpkt []byte, err error) {
-	if len(data) > 2048 {
-		return nil, errors.Errorf("Data too long: %d, want: %d", len(data), 2048)
+	if this.isClosed() {
+		return nil, ErrClosed
 	}
-	if len(this.cwctrlq) >= cap(this.cwctrlq) {
-		log.Println("Ctrl queue is full, drop pkt...", len(data), this.cwctrldlen)
-		return nil, errors.New("Ctrl queue is full")
+	if err := checkPacketSize(len(data)); err != nil {
+		return nil, err
 	}
 	btime := time.Now()
-	select {
-	case this.cwctrlq <- data:
-		atomic.AddInt32(&this.cwctrldlen, int32(len(data)))
-	default:
-		log.Println("Ctrl queue is full, drop pkt...", len(data), this.cwctrldlen)
-		return nil, errors.New("Ctrl queue is full")
+	if !this.enqueueCtrl(data) {
+		this.logr().Warn("Ctrl queue is full, drop packet", "len", len(data), "queued", atomic.LoadInt32(&this.cwctrldlen))
+		return nil, errors.Wrap(ErrQueueFull, "ctrl")
 	}
 	// encpkt, err = this.CreatePacket(buf.Bytes())
 	// this.WritePacket(encpkt)
-	dtime := time.Since(btime)
-	if dtime > 5*time.Millisecond {
-		log.Fatalln("send use too long", len(data), dtime)
-	} else if dtime > 2*time.Millisecond {
-		log.Println("send use too long", len(data), dtime)
+	if dtime := time.Since(btime); dtime > 2*time.Millisecond {
+		this.logr().Warn("Send use too long", "len", len(data), "took", dtime)
 	}
 	return
 }
 
 // TODO split data
 func (this *TCPSecureConn) SendDataPacket(connid uint8, data []byte) (encpkt []byte, err error) {
-	if len(data) > 2048 {
-		return nil, errors.Errorf("Data too long: %d, want: %d", len(data), 2048)
+	if this.isClosed() {
+		return nil, ErrClosed
 	}
-	if len(this.cwdataq) >= cap(this.cwdataq) {
-		log.Println("Data queue is full, drop pkt.", len(this.cwdataq), connid, len(data), this.cwdatadlen)
-		return nil, errors.New("Data queue is full")
+	if err := checkPacketSize(1 + len(data)); err != nil {
+		return nil, err
 	}
-	buf := gopp.NewBufferZero()
-	buf.WriteByte(byte(connid))
-	buf.Write(data)
+	buf := make([]byte, 0, 1+len(data))
+	buf = append(append(buf, connid), data...)
 	btime := time.Now()
-	select {
-	case this.cwdataq <- buf.Bytes():
-		atomic.AddInt32(&this.cwdatadlen, int32(buf.Len()))
-	default:
-		log.Println("Data queue is full, drop pkt.", len(this.cwdataq), connid, len(data), this.cwdatadlen)
-		return nil, errors.New("Data queue is full")
+	if !this.enqueueData(buf) {
+		this.logr().Warn("Data queue is full, drop packet", "qlen", len(this.cwdataq), "connid", connid, "len", len(data), "queued", atomic.LoadInt32(&this.cwdatadlen))
+		return nil, errors.Wrap(ErrQueueFull, "data")
 	}
 	dtime := time.Since(btime)
 	if dtime > 2*time.Millisecond {
-		log.Println("send use too long", len(data), dtime)
+		this.logr().Warn("Send use too long", "len", len(data), "took", dtime)
 	}
 	return
 }
@@ -679,7 +1241,7 @@ func (this *TCPSecureConn) MakePingPacket() []byte {
 	ping_plain.WriteByte(byte(TCP_PACKET_PING))
 	pingid := rand.Uint64()
 	pingid = gopp.IfElse(pingid == 0, uint64(1), pingid).(uint64)
-	this.Pingid = pingid
+	atomic.StoreUint64(&this.Pingid, pingid)
 	binary.Write(ping_plain, binary.BigEndian, pingid)
 	// log.Println("ping plnpkt len:", ping_plain.Len())
 
@@ -693,7 +1255,6 @@ func (this *TCPSecureConn) MakePingPacket() []byte {
 		ping_pkt := gopp.NewBufferZero()
 		binary.Write(ping_pkt, binary.BigEndian, uint16(len(ping_encrypted)))
 		ping_pkt.Write(ping_encrypted)
-		log.Println(ping_pkt.Len(), len(ping_encrypted))
 		return ping_pkt.Bytes()
 	}
 
@@ -701,81 +1262,449 @@ func (this *TCPSecureConn) MakePingPacket() []byte {
 }
 
 // tcp data packet, not include handshake packet
-func (this *TCPSecureConn) CreatePacket(plain []byte) (encpkt []byte, err error) {
-	// log.Println(len(plain), this.Shrkey.ToHex()[:20], this.SentNonce.ToHex())
-	encdat, err := EncryptDataSymmetric(this.Shrkey, this.SentNonce, plain)
-	gopp.ErrPrint(err)
+// encrypted plain with uint16 length prefix, too large one would truncate the
+// length and corrupt the frame, and the peer rejects > MAX_PACKET_SIZE anyway.
+func checkPacketSize(plainlen int) error {
+	enclen := plainlen + MAC_SIZE
+	if plainlen <= 0 || enclen > math.MaxUint16 || enclen > MAX_PACKET_SIZE {
+		return errors.Errorf("Invalid packet size: %d, max: %d", plainlen, TCP_MAX_PLAIN_SIZE)
+	}
+	return nil
+}
 
-	pktbuf := gopp.NewBufferZero()
-	binary.Write(pktbuf, binary.BigEndian, uint16(len(encdat)))
-	pktbuf.Write(encdat)
-	encpkt = pktbuf.Bytes()
-	// log.Println("create pkg:", tcppktname(plain[0]), len(encpkt), len(plain))
-	// this.SentNonce.Incr()
-	return
+func (this *TCPSecureConn) CreatePacket(plain []byte) (encpkt []byte, err error) {
+	return appendTCPPacket(nil, this.Shrkey, this.SentNonce, plain)
 }
 func (this *TCPSecureConn) Unpacket(encpkt []byte) (datlen uint16, plnpkt []byte, err error) {
-	err = binary.Read(bytes.NewReader(encpkt), binary.BigEndian, &datlen)
-	gopp.ErrPrint(err)
-	plnpkt, err = DecryptDataSymmetric(this.Shrkey, this.RecvNonce, encpkt[2:])
-	this.RecvNonce.Incr()
-	return
+	return this.unpacketTo(nil, encpkt)
+}
+
+// Unpacket decrypted into dst, reused if big enough
+func (this *TCPSecureConn) unpacketTo(dst []byte, encpkt []byte) (datlen uint16, plnpkt []byte, err error) {
+	return openTCPPacket(dst, this.Shrkey, this.RecvNonce, encpkt)
 }
 
 /////
 func NewTCPServer(ports []uint16, seckey *CryptoKey, oniono Object) *TCPServer {
-	this := &TCPServer{}
-	this.Seckey = seckey
-	this.Pubkey = CBDerivePubkey(seckey)
-	this.Conns = map[string]*TCPSecureConn{}
-	this.HSConns = map[net.Conn]*TCPSecureConn{}
+	cfg := DefaultTCPServerConfig()
+	cfg.Ports = ports
+	cfg.Seckey = seckey
+	cfg.Oniono = oniono
+	this, err := NewTCPServerFromConfig(cfg)
+	gopp.ErrPrint(err)
+	return this
+}
+
+// NewTCPServerWithListeners serves on already bound listeners,
+// like systemd socket activation or fake ones in test, cfg.Ports not used.
+func NewTCPServerWithListeners(lsners []net.Listener, seckey *CryptoKey, oniono Object) (*TCPServer, error) {
+	cfg := DefaultTCPServerConfig()
+	cfg.Seckey = seckey
+	cfg.Oniono = oniono
+	return NewTCPServerWithListenersConfig(lsners, cfg)
+}
+
+func NewTCPServerWithListenersConfig(lsners []net.Listener, cfg *TCPServerConfig) (*TCPServer, error) {
+	if len(lsners) == 0 {
+		return nil, errors.New("No listener")
+	}
+	for i, lsner := range lsners {
+		if lsner == nil {
+			return nil, errors.Errorf("Nil listener at %d", i)
+		}
+	}
+	this, err := newTCPServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	this.lsners = append([]net.Listener{}, lsners...)
+	return this, nil
+}
 
+func NewTCPServerFromConfig(cfg *TCPServerConfig) (*TCPServer, error) {
+	this, err := newTCPServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlscfg *tls.Config
+	if len(cfg.TLSPorts) > 0 || len(cfg.QUICPorts) > 0 {
+		if tlscfg, err = newTCPTLSConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+	ports := append(append(append([]uint16{}, cfg.Ports...), cfg.WSPorts...), cfg.TLSPorts...)
 	for i, port := range ports {
-		lsner, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		lsners, err := listenTCPFamily(cfg, port)
 		gopp.ErrPrint(err, port)
 		if err != nil {
-			return nil
+			for _, lsner := range this.lsners {
+				lsner.Close()
+			}
+			return nil, errors.Wrap(err, fmt.Sprintf("listen %s:%d %s", cfg.BindAddr, port, cfg.AddrFamily))
 		}
-		log.Println("listened on:", i, lsner.Addr().String())
+		for _, lsner := range lsners {
+			kind := "tcp"
+			switch {
+			case i >= len(cfg.Ports)+len(cfg.WSPorts):
+				lsner, kind = NewTLSListener(lsner, tlscfg), "tls"
+			case i >= len(cfg.Ports):
+				lsner, kind = NewWSListener(lsner, cfg.WSPath, cfg.WSTrustProxy), "ws"
+			}
+			this.logr().Info("Listened", "index", len(this.lsners), "addr", lsner.Addr(), "kind", kind)
+			this.lsners = append(this.lsners, lsner)
+		}
+	}
+	for _, port := range cfg.QUICPorts {
+		lsner, err := ListenQUIC(net.JoinHostPort(cfg.BindAddr, fmt.Sprint(port)), tlscfg)
+		if err != nil {
+			for _, lsner := range this.lsners {
+				lsner.Close()
+			}
+			return nil, errors.Wrap(err, fmt.Sprintf("listen quic %s:%d", cfg.BindAddr, port))
+		}
+		this.logr().Info("Listened", "index", len(this.lsners), "addr", lsner.Addr(), "kind", "quic")
 		this.lsners = append(this.lsners, lsner)
 	}
+	if cfg.AdminAddr != "" {
+		if err := this.ListenAdmin(cfg.AdminAddr); err != nil {
+			for _, lsner := range this.lsners {
+				lsner.Close()
+			}
+			return nil, err
+		}
+	}
 
-	return this
+	return this, nil
+}
+
+func newTCPServer(cfg *TCPServerConfig) (*TCPServer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Seckey == nil {
+		return nil, errors.New("No server secret key")
+	}
+	this := &TCPServer{}
+	cfgcp := *cfg
+	this.cfgv.Store(&cfgcp)
+	this.Oniono = cfg.Oniono
+	this.Seckey = cfg.Seckey
+	this.Pubkey = CBDerivePubkey(cfg.Seckey)
+	this.Conns = map[string]*TCPSecureConn{}
+	this.onionConns = map[uint64]*TCPSecureConn{}
+	this.HSConns = map[net.Conn]*TCPSecureConn{}
+	this.parked = map[string]*TCPSecureConn{}
+	this.usages = map[string]*tcpUsage{}
+	this.hsreplay = newTCPReplayCache(TCP_HANDSHAKE_REPLAY_WINDOW*time.Second, TCP_HANDSHAKE_REPLAY_MAX)
+	this.ips = map[string]*tcpIPState{}
+	bans, err := newTCPBanStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	this.bans = bans
+	this.clock = defaultClock
+	this.stopC = make(chan bool)
+	this.closedC = make(chan struct{})
+	if cfg.clusterEnabled() {
+		if this.cluster, err = newTCPCluster(this, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if onion, ok := this.Oniono.(*Onion); ok && onion != nil {
+		onion.SetCallbackHandleRecv1(this.handleOnionRecv1, this)
+	}
+	return this, nil
+}
+
+// Addrs returns listening addresses, useful for port 0 listeners.
+func (this *TCPServer) Addrs() (addrs []net.Addr) {
+	for _, lsner := range this.lsners {
+		addrs = append(addrs, lsner.Addr())
+	}
+	return
 }
 
 func (this *TCPServer) Start() {
+	go this.runHandshakeGC()
+	go this.runSlowClientGC()
+	go this.runResumeGC()
+	go this.runBanGC()
+	go this.runQuotaGC()
+	if this.cluster != nil {
+		err := this.cluster.start(this.config())
+		gopp.ErrPrint(err)
+	}
 	for _, lsner := range this.lsners {
-		go this.runAcceptProc(lsner)
+		this.acceptwg.Add(1)
+		go func(lsner net.Listener) {
+			defer this.acceptwg.Done()
+			this.runAcceptProc(lsner)
+		}(lsner)
 	}
 }
 
 // should block
 func (this *TCPServer) runAcceptProc(lsner net.Listener) {
+	handle, done := this.acceptPool()
+	defer done()
+	var delay time.Duration // backoff when accept temporary failed
 	stop := false
 	for !stop {
+		if d := time.Until(unixnanoTime(atomic.LoadInt64(&this.dialFdUntil))); d > 0 {
+			this.waitConnsFree(this.ConnCount(), d)
+		}
 		c, err := lsner.Accept()
 		gopp.ErrPrint(err, lsner.Addr())
 		if err != nil {
+			if isFdExhausted(err) {
+				atomic.AddInt64(&this.cnts.FdExhausted, 1)
+				delay = acceptBackoff(delay)
+				this.logr().Warn("Out of file descriptors, pause accept", "delay", delay, "conns", this.ConnCount(), "addr", lsner.Addr())
+				this.waitConnsFree(this.ConnCount(), delay)
+				continue
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				atomic.AddInt64(&this.cnts.AcceptRetried, 1)
+				delay = acceptBackoff(delay)
+				time.Sleep(delay)
+				continue
+			}
 			break
 		}
-		this.startHandshake(c)
+		delay = 0
+		if atomic.LoadInt32(&this.shuttingDown) == 1 {
+			c.Close()
+			break
+		}
+		handle(c)
+	}
+	this.logr().Info("Accept done", "addr", lsner.Addr())
+}
+
+func acceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+/* seconds accept paused after an outbound dial ran out of fds */
+const TCP_FD_DIAL_PAUSE = 1
+
+// outbound dial of the server failed, out of fds pauses accept loops, so
+// fds freed by closed conns go to dials
+func (this *TCPServer) dialFailed(err error) {
+	if !isFdExhausted(err) {
+		return
+	}
+	atomic.AddInt64(&this.cnts.FdExhausted, 1)
+	atomic.StoreInt64(&this.dialFdUntil, time.Now().Add(TCP_FD_DIAL_PAUSE*time.Second).UnixNano())
+	this.logr().Warn("Out of file descriptors on dial, pause accept", "for", TCP_FD_DIAL_PAUSE*time.Second, "conns", this.ConnCount())
+}
+
+// wait someone closed and free the fd, or timeout
+func (this *TCPServer) waitConnsFree(cnt int, timeout time.Duration) {
+	btime := time.Now()
+	for time.Since(btime) < timeout {
+		if this.ConnCount() < cnt {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func isFdExhausted(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.EMFILE || e == syscall.ENFILE
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// handshaking and confirmed
+func (this *TCPServer) ConnCount() int {
+	this.hsconnmu.RLock()
+	n := len(this.HSConns)
+	this.hsconnmu.RUnlock()
+	this.connmu.RLock()
+	n += len(this.Conns)
+	this.connmu.RUnlock()
+	return n
+}
+
+// brief of one connection for listing
+type TCPConnBrief struct {
+	Pubkey     *CryptoKey // nil if handshake not done
+	Addr       net.Addr
+	Status     uint8
+	Family     uint8
+	LastRecvAt time.Time
+	LastSentAt time.Time
+}
+
+// handshaking and confirmed connections
+func (this *TCPServer) ListConns() (rets []TCPConnBrief) {
+	brief := func(c *TCPSecureConn) TCPConnBrief {
+		return TCPConnBrief{c.Pubkey, c.Sock.RemoteAddr(), c.status(), c.Family, c.LastRecvAt(), c.LastSentAt()}
+	}
+	this.hsconnmu.RLock()
+	for _, c := range this.HSConns {
+		rets = append(rets, brief(c))
+	}
+	this.hsconnmu.RUnlock()
+	this.connmu.RLock()
+	for _, c := range this.Conns {
+		rets = append(rets, brief(c))
+	}
+	this.connmu.RUnlock()
+	return
+}
+
+func (this *TCPServer) Counters() TCPServerCounters {
+	return TCPServerCounters{
+		FdExhausted:   atomic.LoadInt64(&this.cnts.FdExhausted),
+		AcceptRetried: atomic.LoadInt64(&this.cnts.AcceptRetried),
+		AcceptedIPv4:  atomic.LoadInt64(&this.cnts.AcceptedIPv4),
+		AcceptedIPv6:  atomic.LoadInt64(&this.cnts.AcceptedIPv6),
+		Overloaded:    atomic.LoadInt64(&this.cnts.Overloaded),
+		ConnLimited:   atomic.LoadInt64(&this.cnts.ConnLimited),
+		ClosedLocal:   atomic.LoadInt64(&this.cnts.ClosedLocal),
+		ClosedRemote:  atomic.LoadInt64(&this.cnts.ClosedRemote),
+
+		CongestionThrottled: atomic.LoadInt64(&this.cnts.CongestionThrottled),
+		CongestionKicked:    atomic.LoadInt64(&this.cnts.CongestionKicked),
+
+		OOBLimited: atomic.LoadInt64(&this.cnts.OOBLimited),
+		OOBAbusers: atomic.LoadInt64(&this.cnts.OOBAbusers),
+
+		RateLimited:        atomic.LoadInt64(&this.cnts.RateLimited),
+		HandshakeThrottled: atomic.LoadInt64(&this.cnts.HandshakeThrottled),
+		Bans:               atomic.LoadInt64(&this.cnts.Bans),
+		BanRejected:        atomic.LoadInt64(&this.cnts.BanRejected),
+		QuotaThrottled:     atomic.LoadInt64(&this.cnts.QuotaThrottled),
+		QuotaKicked:        atomic.LoadInt64(&this.cnts.QuotaKicked),
+
+		ConnErrors: atomic.LoadInt64(&this.cnts.ConnErrors),
+
+		HandshakeFailed:   atomic.LoadInt64(&this.cnts.HandshakeFailed),
+		HandshakeTimeouts: atomic.LoadInt64(&this.cnts.HandshakeTimeouts),
+		HandshakeEvicted:  atomic.LoadInt64(&this.cnts.HandshakeEvicted),
+		WriteTimeouts:     atomic.LoadInt64(&this.cnts.WriteTimeouts),
+		SlowEvicted:       atomic.LoadInt64(&this.cnts.SlowEvicted),
+		InfoServed:        atomic.LoadInt64(&this.cnts.InfoServed),
+		Resumed:           atomic.LoadInt64(&this.cnts.Resumed),
+		ResumeExpired:     atomic.LoadInt64(&this.cnts.ResumeExpired),
+		HandshakeReplays:  atomic.LoadInt64(&this.cnts.HandshakeReplays),
+		BytesRecv:         atomic.LoadInt64(&this.cnts.BytesRecv),
+		BytesSent:         atomic.LoadInt64(&this.cnts.BytesSent),
+		OnionForwarded:    atomic.LoadInt64(&this.cnts.OnionForwarded),
+		OnionReturned:     atomic.LoadInt64(&this.cnts.OnionReturned),
+	}
+}
+
+// rising handshake latency is an early warning of cpu saturation
+func (this *TCPServer) HandshakeLatencies() LatencyHistSnapshot { return this.hslat.Snapshot() }
+
+// adaptive admission control, reject new conn early when handshake backlog
+// or queued bytes of all conns over limit, keep existing conns working.
+func (this *TCPServer) admit(c net.Conn) bool {
+	if !this.admitIP(c) {
+		c.Close()
+		return false
+	}
+	why := this.overloadReason()
+	if why != "" {
+		atomic.AddInt64(&this.cnts.Overloaded, 1)
+		this.logr().Warn("Overloaded, reject", "why", why, "addr", c.RemoteAddr())
+		c.Close()
+		return false
+	}
+	if !this.admitConnLimit(c) {
+		c.Close()
+		return false
+	}
+	return true
+}
+
+func (this *TCPServer) overloadReason() string {
+	if this.config().MaxHandshakes > 0 {
+		this.hsconnmu.RLock()
+		hsn := len(this.HSConns)
+		this.hsconnmu.RUnlock()
+		if hsn >= this.config().MaxHandshakes {
+			return fmt.Sprintf("handshake backlog %d >= %d", hsn, this.config().MaxHandshakes)
+		}
 	}
-	log.Println("done", lsner.Addr())
+	if this.config().MaxQueuedBytes > 0 {
+		if qlen := this.QueuedBytes(); qlen >= int64(this.config().MaxQueuedBytes) {
+			return fmt.Sprintf("queued bytes %d >= %d", qlen, this.config().MaxQueuedBytes)
+		}
+	}
+	return ""
+}
+
+// bytes in write queues of all confirmed conns
+func (this *TCPServer) QueuedBytes() (n int64) {
+	this.connmu.RLock()
+	defer this.connmu.RUnlock()
+	for _, c := range this.Conns {
+		n += int64(atomic.LoadInt32(&c.cwctrldlen)) + int64(atomic.LoadInt32(&c.cwdatadlen))
+	}
+	return
 }
 
 func (this *TCPServer) startHandshake(c net.Conn) {
+	if this.RecordConn != nil {
+		if w := this.RecordConn(c); w != nil {
+			c = NewRecordConn(c, w)
+		}
+	}
 	this.hsconnmu.Lock()
 	defer this.hsconnmu.Unlock()
-	secon := NewTCPSecureConn(c)
+	secon := newTCPSecureConn(c, &this.config().TCPConnConfig, TCPConnCallbacks{
+		OnConfirmed: this.onConnConfirmed,
+		OnClosed:    this.onConnClosed,
+		OnError:     this.onConnError,
+		OnOOBData:   this.onOOBData,
+	})
 	secon.srvo = this
-	secon.Seckey = this.Seckey
-	secon.OnConfirmed = this.onConnConfirmed
-	secon.OnClosed = this.onConnClosed
+	secon.Family = tcpAddrFamily(c.RemoteAddr())
+	this.countAcceptFamily(secon.Family)
+	this.ipConnDelta(tcpRemoteIP(c), 1)
+	secon.clock = this.clock
+	secon.hsStartAt = this.clock.Now()
+	secon.srvPubkey, secon.Seckey = this.Keys()
+	if n := this.config().DebugTap; n > 0 {
+		secon.StartTap(n)
+	}
 	this.HSConns[c] = secon
 	secon.Start()
 }
+// relay destination lookup, only confirmed peer can receive relayed packets
+func (this *TCPServer) confirmedConn(pubkey *CryptoKey) *TCPSecureConn {
+	this.connmu.RLock()
+	defer this.connmu.RUnlock()
+	if c, ok := this.Conns[pubkey.BinStr()]; ok && c.status() == TCP_STATUS_CONFIRMED {
+		return c
+	}
+	return nil
+}
+
 func (this *TCPServer) onConnConfirmed(obj Object) {
 	c := obj.(*TCPSecureConn)
+	this.hslat.Add(c.HandshakeLatency())
 	this.hsconnmu.Lock()
 	defer this.hsconnmu.Unlock()
 	if _, ok := this.HSConns[c.Sock]; ok {
@@ -784,41 +1713,104 @@ func (this *TCPServer) onConnConfirmed(obj Object) {
 	this.connmu.Lock()
 	defer this.connmu.Unlock()
 	if oc, ok := this.Conns[c.Pubkey.BinStr()]; ok {
-		log.Println("Already connected:", c.Pubkey.ToHex()[:20])
+		this.logr().Info("Already connected", "pubkey", c.Pubkey.ToHex20())
 		delete(this.Conns, c.Pubkey.BinStr())
-		oc.OnClosed = nil
-		oc.Close()
+		delete(this.onionConns, oc.Identifier)
+		oc.doClose(true, TCP_CLOSE_REPLACED) // its onConnClosed a no-op
+	}
+	if c.resumed {
+		atomic.AddInt64(&this.cnts.Resumed, 1)
+	} else {
+		this.dropParked(c.Pubkey)
+		this.identseq++
+		c.Identifier = this.identseq
 	}
 	this.Conns[c.Pubkey.BinStr()] = c
+	this.onionConns[c.Identifier] = c
+	if c.resumed {
+		c.resyncRoutes()
+	}
+	this.quotaConfirmed(c)
+	this.cluster.connConfirmed(c)
+}
+func (this *TCPServer) onConnError(obj Object, err error) {
+	atomic.AddInt64(&this.cnts.ConnErrors, 1)
+	if this.OnConnError != nil {
+		this.OnConnError(obj.(*TCPSecureConn), err)
+	}
 }
+
+func (this *TCPServer) onOOBData(obj Object, dstpk *CryptoKey, data []byte) {
+	if this.OnOOBData != nil {
+		this.OnOOBData(obj.(*TCPSecureConn), dstpk, data)
+	}
+}
+
 func (this *TCPServer) onConnClosed(obj Object) {
 	c := obj.(*TCPSecureConn)
+	defer this.signalConnClosed()
+	this.ipConnDelta(tcpRemoteIP(c.Sock), -1)
+	this.quotaClosed(c)
+	if c.closeReason == TCP_CLOSE_REPLACED {
+		return // already unlinked by onConnConfirmed, locks held there
+	}
 	this.hsconnmu.Lock()
 	defer this.hsconnmu.Unlock()
-	if _, ok := this.HSConns[c.Sock]; ok {
+	_, hsfailed := this.HSConns[c.Sock]
+	if hsfailed {
 		delete(this.HSConns, c.Sock)
+		atomic.AddInt64(&this.cnts.HandshakeFailed, 1)
+	}
+	if c.Pubkey == nil {
+		return // closed before handshake request
 	}
 	this.connmu.Lock()
 	defer this.connmu.Unlock()
 	if _, ok := this.Conns[c.Pubkey.BinStr()]; ok {
 		delete(this.Conns, c.Pubkey.BinStr())
+		delete(this.onionConns, c.Identifier)
+		this.cluster.connClosed(c)
+		if c.ClosedLocally() {
+			atomic.AddInt64(&this.cnts.ClosedLocal, 1)
+		} else {
+			atomic.AddInt64(&this.cnts.ClosedRemote, 1)
+		}
+	}
+	if this.parkConn(c, hsfailed) {
+		return // routes kept online for resume
 	}
 	this.killAccepted(c)
 }
 
+// like kill_accepted, unlink online routes of c from their peers and notify.
+// walk routes in connid order, so cleanup and notification order is reproducible.
+// connmu held by caller.
 func (this *TCPServer) killAccepted(c *TCPSecureConn) {
 	delbinpk := c.Pubkey.BinStr()
-	notifys := map[*TCPSecureConn]uint8{}
-	for _, ctmp := range this.Conns {
-		if pci, ok := ctmp.ConnInfos[delbinpk]; ok {
-			pci.Status = 1
-			pci.Otherid = 0
-			notifys[ctmp] = pci.Connid
+	notifys := 0
+	for _, pci := range c.routesByConnid() {
+		if pci.Status != 2 {
+			continue
 		}
+		if pci.Node != "" {
+			this.cluster.closeRoute(c, pci)
+			continue
+		}
+		ctmp, ok := this.Conns[pci.Pubkey.BinStr()]
+		if !ok {
+			// parked peer told by resync after resume
+			if ctmp, ok = this.parkedConn(pci.Pubkey); ok {
+				ctmp.routeOffline(delbinpk)
+			}
+			continue
+		}
+		pci2, ok := ctmp.routeOffline(delbinpk)
+		if !ok {
+			continue
+		}
+		this.logr().Debug("Disconnect notify", "connid", pci2.Connid, "addr", ctmp.Sock.RemoteAddr(), "pubkey", ctmp.Pubkey.ToHex20())
+		ctmp.SendDisconnectNotification(pci2.Connid)
+		notifys++
 	}
-	log.Println("disconnect notify:", len(notifys))
-	for ctmp, connid := range notifys {
-		log.Println("disconnct notify...", connid, ctmp.Sock.RemoteAddr(), ctmp.Pubkey.ToHex20())
-		ctmp.SendDisconnectNotification(connid)
-	}
+	this.logr().Debug("Disconnect notified", "n", notifys)
 }
@@ -0,0 +1,291 @@
+package mintox
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// All tunables of TCPServer in one place, so many relays can share one config file.
+// Fields with json tag are the tunable subset, keys and objects are set by code.
+type TCPServerConfig struct {
+	Ports    []uint16 `json:"ports"`
+	BindAddr string   `json:"bind_addr"` // empty for all addresses
+	// ipv4, ipv6 or dual, empty for dual
+	AddrFamily string `json:"addr_family"`
+	// WebSocket listeners, same relay over ws://host:port/ws_path
+	WSPorts      []uint16 `json:"ws_ports"`
+	WSPath       string   `json:"ws_path"`        // empty for TCP_WS_PATH
+	WSTrustProxy bool     `json:"ws_trust_proxy"` // client ip from X-Forwarded-For
+	// TLS listeners looking like https, cert from files, else self signed for
+	// tls_hosts, TLSConfig set by code overrides both
+	TLSPorts    []uint16    `json:"tls_ports"`
+	TLSCertFile string      `json:"tls_cert_file"`
+	TLSKeyFile  string      `json:"tls_key_file"`
+	TLSHosts    []string    `json:"tls_hosts"`
+	TLSConfig   *tls.Config `json:"-"`
+	// QUIC listeners on udp, experimental, cert as tls_*, need build tag mintoxquic
+	QUICPorts []uint16 `json:"quic_ports"`
+	// listening sockets per port of ports, ws_ports and tls_ports, over 1
+	// opened with SO_REUSEPORT, linux only. 0 for 1.
+	ReusePort int `json:"reuse_port"`
+	// goroutines of each accept loop admitting accepted conns, 0 in the loop
+	AcceptWorkers int `json:"accept_workers"`
+
+	TCPConnConfig // json keys flattened
+
+	// admission control, reject new conn when over, 0 for no limit
+	MaxHandshakes  int `json:"max_handshakes"`   // conns in handshake
+	MaxQueuedBytes int `json:"max_queued_bytes"` // write queues of all conns
+	// conn limits, 0 for no limit. Over max_conns the least recently active
+	// unconfirmed conn is evicted for the new one, rejected if none.
+	MaxConns      int `json:"max_conns"`
+	MaxConnsPerIP int `json:"max_conns_per_ip"`
+
+	HandshakeTimeout int `json:"handshake_timeout"` // seconds, accept to confirmed
+
+	// evict conn whose data queue full or queued bytes over slow_client_bytes
+	// for slow_client_timeout seconds, 0 timeout for never, 0 bytes for queue full only
+	SlowClientTimeout int `json:"slow_client_timeout"`
+	SlowClientBytes   int `json:"slow_client_bytes"`
+
+	// source faster than destination, policy applied after continuous drops
+	CongestionPolicy string `json:"congestion_policy"` // drop, throttle or disconnect
+	CongestionDrops  int    `json:"congestion_drops"`
+
+	MaxOOBPerSec int `json:"max_oob_per_sec"` // oob sends of a conn, 0 for no limit
+
+	// seconds a closed session waits for client resume, routes kept meanwhile, 0 for off
+	ResumeTimeout int `json:"resume_timeout"`
+
+	// recv rate limits, packet dropped when over, 0 for no limit
+	MaxPacketsPerSec      int `json:"max_packets_per_sec"`       // of a conn
+	MaxBytesPerSec        int `json:"max_bytes_per_sec"`         // of a conn
+	MaxIPPacketsPerSec    int `json:"max_ip_packets_per_sec"`    // of all conns from one ip
+	MaxIPBytesPerSec      int `json:"max_ip_bytes_per_sec"`      // of all conns from one ip
+	MaxIPHandshakesPerMin int `json:"max_ip_handshakes_per_min"` // new conns from one ip
+	// ip banned after seconds over limits, 0 for never ban
+	BanViolations int `json:"ban_violations"`
+	BanDuration   int `json:"ban_duration"` // seconds
+	// bans kept over restarts in this json file, in memory if empty
+	BanFile  string   `json:"ban_file"`
+	BanStore BanStore `json:"-"` // set by code, instead of ban_file
+
+	// bytes on wire per client pubkey, recv and sent, days and months in UTC,
+	// 0 for no quota. Over quota relayed packets throttled or conns closed.
+	QuotaDailyBytes          int64  `json:"quota_daily_bytes"`
+	QuotaMonthlyBytes        int64  `json:"quota_monthly_bytes"`
+	QuotaPolicy              string `json:"quota_policy"` // throttle or disconnect
+	QuotaThrottleBytesPerSec int    `json:"quota_throttle_bytes_per_sec"`
+
+	// admin api, unix:/path or a loopback host:port, empty for none
+	AdminAddr string `json:"admin_addr"`
+	// bearer token of admin api, needed on a loopback port
+	AdminToken string `json:"admin_token"`
+	// packet headers kept per new conn for debug, see TCPTapEntry, 0 for off
+	DebugTap int `json:"debug_tap"`
+
+	// cluster of relays sharing clients, see TCPCluster. Off if both
+	// cluster_listen and cluster_peers empty.
+	ClusterNode   string   `json:"cluster_node"`   // unique id in cluster, empty for relay pubkey
+	ClusterListen string   `json:"cluster_listen"` // host:port for links of other nodes
+	ClusterPeers  []string `json:"cluster_peers"`  // host:port of nodes to link
+	ClusterSecret string   `json:"cluster_secret"` // 64 hex, same on all nodes
+	// set by code, shared by all nodes instead of gossip
+	ClusterDirectory ClusterDirectory `json:"-"`
+
+	Seckey *CryptoKey `json:"-"`
+	Oniono Object     `json:"-"`
+
+	filename string // loaded from, for reload
+}
+
+// buffers and queues of each TCPSecureConn
+type TCPConnConfig struct {
+	SockWriteBuffer int `json:"sock_write_buffer"` // SO_SNDBUF of accepted conn
+	ReadBufferSize  int `json:"read_buffer_size"`  // conn read ring buffer
+	CtrlQueueSize   int `json:"ctrl_queue_size"`   // packets
+	DataQueueSize   int `json:"data_queue_size"`   // packets
+	FrameTimeout    int `json:"frame_timeout"`     // seconds, close conn if partial frame not completed
+	WriteTimeout    int `json:"write_timeout"`     // seconds, close conn if a socket write blocked, 0 for no limit
+
+	// write queue full: block, drop-oldest, drop-newest or close
+	Backpressure string `json:"backpressure"`
+}
+
+func DefaultTCPConnConfig() *TCPConnConfig {
+	cfg := &TCPConnConfig{}
+	cfg.SockWriteBuffer = 128 * 1024
+	cfg.ReadBufferSize = 1024 * 1024
+	cfg.CtrlQueueSize = 64
+	cfg.DataQueueSize = 128
+	cfg.FrameTimeout = TCP_FRAME_TIMEOUT
+	cfg.WriteTimeout = TCP_WRITE_TIMEOUT
+	cfg.Backpressure = TCP_BACKPRESSURE_DROP_NEWEST
+	return cfg
+}
+
+func (this *TCPConnConfig) Validate() error {
+	switch {
+	case this.ReadBufferSize < MAX_PACKET_SIZE*2:
+		return errors.Errorf("read_buffer_size too small: %d", this.ReadBufferSize)
+	case this.CtrlQueueSize <= 0 || this.DataQueueSize <= 0:
+		return errors.Errorf("invalid queue size: %d, %d", this.CtrlQueueSize, this.DataQueueSize)
+	case this.FrameTimeout <= 0:
+		return errors.Errorf("invalid frame_timeout: %d", this.FrameTimeout)
+	case this.WriteTimeout < 0:
+		return errors.Errorf("invalid write_timeout: %d", this.WriteTimeout)
+	case !tcpbackpressures[this.Backpressure]:
+		return errors.Errorf("invalid backpressure: %s", this.Backpressure)
+	}
+	return nil
+}
+
+func DefaultTCPServerConfig() *TCPServerConfig {
+	cfg := &TCPServerConfig{}
+	cfg.TCPConnConfig = *DefaultTCPConnConfig()
+	cfg.AddrFamily = TCP_FAMILY_DUAL
+	cfg.MaxHandshakes = TCP_MAX_BACKLOG
+	cfg.MaxQueuedBytes = 64 * 1024 * 1024
+	cfg.HandshakeTimeout = TCP_HANDSHAKE_TIMEOUT
+	cfg.SlowClientTimeout = TCP_SLOW_CLIENT_TIMEOUT
+	cfg.SlowClientBytes = 256 * 1024
+	cfg.CongestionPolicy = TCP_CONGESTION_THROTTLE
+	cfg.CongestionDrops = 64
+	cfg.MaxOOBPerSec = 64
+	cfg.ResumeTimeout = TCP_RESUME_TIMEOUT
+	cfg.BanViolations = TCP_BAN_VIOLATIONS
+	cfg.BanDuration = TCP_BAN_DURATION
+	cfg.QuotaPolicy = TCP_QUOTA_THROTTLE
+	cfg.QuotaThrottleBytesPerSec = TCP_QUOTA_THROTTLE_RATE
+	return cfg
+}
+
+// defaults for fields not in data
+func ParseTCPServerConfig(data []byte) (*TCPServerConfig, error) {
+	cfg := DefaultTCPServerConfig()
+	err := json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse tcp server config")
+	}
+	return cfg, cfg.Validate()
+}
+
+func LoadTCPServerConfig(filename string) (*TCPServerConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	cfg, err := ParseTCPServerConfig(data)
+	if cfg != nil {
+		cfg.filename = filename
+	}
+	return cfg, err
+}
+
+func (this *TCPServerConfig) Marshal() ([]byte, error) { return json.MarshalIndent(this, "", "  ") }
+
+func (this *TCPServerConfig) Validate() error {
+	if err := this.TCPConnConfig.Validate(); err != nil {
+		return err
+	}
+	if err := validateTCPFamily(this.AddrFamily, this.BindAddr); err != nil {
+		return err
+	}
+	switch {
+	case this.MaxHandshakes < 0 || this.MaxQueuedBytes < 0:
+		return errors.Errorf("invalid admission limit: %d, %d", this.MaxHandshakes, this.MaxQueuedBytes)
+	case this.WSPath != "" && !strings.HasPrefix(this.WSPath, "/"):
+		return errors.Errorf("invalid ws_path: %s", this.WSPath)
+	case (this.TLSCertFile == "") != (this.TLSKeyFile == ""):
+		return errors.Errorf("tls_cert_file and tls_key_file both needed: %s, %s", this.TLSCertFile, this.TLSKeyFile)
+	case len(this.QUICPorts) > 0 && !isQUICEnabled():
+		return errors.New("quic_ports set but QUIC not built in, need build tag mintoxquic")
+	case this.ReusePort < 0 || this.AcceptWorkers < 0:
+		return errors.Errorf("invalid accept: %d, %d", this.ReusePort, this.AcceptWorkers)
+	case this.ReusePort > 1 && !isReusePortSupported():
+		return errors.New("reuse_port set but SO_REUSEPORT not supported on this platform")
+	case this.MaxConns < 0 || this.MaxConnsPerIP < 0:
+		return errors.Errorf("invalid conn limit: %d, %d", this.MaxConns, this.MaxConnsPerIP)
+	case this.HandshakeTimeout <= 0:
+		return errors.Errorf("invalid handshake_timeout: %d", this.HandshakeTimeout)
+	case this.SlowClientTimeout < 0 || this.SlowClientBytes < 0:
+		return errors.Errorf("invalid slow client: %d, %d", this.SlowClientTimeout, this.SlowClientBytes)
+	case this.DebugTap < 0 || this.DebugTap > TCP_TAP_MAX_SIZE:
+		return errors.Errorf("invalid debug_tap: %d, max %d", this.DebugTap, TCP_TAP_MAX_SIZE)
+	case this.MaxOOBPerSec < 0:
+		return errors.Errorf("invalid max_oob_per_sec: %d", this.MaxOOBPerSec)
+	case this.ResumeTimeout < 0:
+		return errors.Errorf("invalid resume_timeout: %d", this.ResumeTimeout)
+	case this.MaxPacketsPerSec < 0 || this.MaxBytesPerSec < 0:
+		return errors.Errorf("invalid conn rate limit: %d, %d", this.MaxPacketsPerSec, this.MaxBytesPerSec)
+	case this.MaxIPPacketsPerSec < 0 || this.MaxIPBytesPerSec < 0 || this.MaxIPHandshakesPerMin < 0:
+		return errors.Errorf("invalid ip rate limit: %d, %d, %d",
+			this.MaxIPPacketsPerSec, this.MaxIPBytesPerSec, this.MaxIPHandshakesPerMin)
+	case this.BanViolations < 0 || (this.BanViolations > 0 && this.BanDuration <= 0):
+		return errors.Errorf("invalid ban: %d, %d", this.BanViolations, this.BanDuration)
+	case this.QuotaDailyBytes < 0 || this.QuotaMonthlyBytes < 0:
+		return errors.Errorf("invalid quota: %d, %d", this.QuotaDailyBytes, this.QuotaMonthlyBytes)
+	case !tcpquotapolicies[this.QuotaPolicy] || this.QuotaThrottleBytesPerSec <= 0:
+		return errors.Errorf("invalid quota policy: %s, %d", this.QuotaPolicy, this.QuotaThrottleBytesPerSec)
+	case !tcpcongpolicies[this.CongestionPolicy] || this.CongestionDrops <= 0:
+		return errors.Errorf("invalid congestion policy: %s, %d", this.CongestionPolicy, this.CongestionDrops)
+	}
+	if this.clusterEnabled() {
+		if _, err := CryptoKeyFromHex(this.ClusterSecret); err != nil {
+			return errors.Wrap(err, "invalid cluster_secret")
+		}
+	}
+	return nil
+}
+
+func (this *TCPServerConfig) clusterEnabled() bool {
+	return this.ClusterListen != "" || len(this.ClusterPeers) > 0
+}
+
+// current config, never modified, Reload swaps a new one
+func (this *TCPServer) config() *TCPServerConfig {
+	return this.cfgv.Load().(*TCPServerConfig)
+}
+
+// Reload applies limits and timeouts of cfg to the running server, conn
+// buffers to new conns only. Listeners, admin and keys can not change
+// without restart, those of the current config are kept.
+func (this *TCPServer) Reload(cfg *TCPServerConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	old := this.config()
+	newcfg := *cfg
+	newcfg.Ports, newcfg.BindAddr, newcfg.AddrFamily = old.Ports, old.BindAddr, old.AddrFamily
+	newcfg.WSPorts, newcfg.WSPath, newcfg.WSTrustProxy = old.WSPorts, old.WSPath, old.WSTrustProxy
+	newcfg.TLSPorts, newcfg.TLSCertFile, newcfg.TLSKeyFile = old.TLSPorts, old.TLSCertFile, old.TLSKeyFile
+	newcfg.TLSHosts, newcfg.TLSConfig, newcfg.QUICPorts = old.TLSHosts, old.TLSConfig, old.QUICPorts
+	newcfg.ReusePort, newcfg.AcceptWorkers = old.ReusePort, old.AcceptWorkers
+	newcfg.AdminAddr, newcfg.Seckey, newcfg.Oniono = old.AdminAddr, old.Seckey, old.Oniono
+	newcfg.BanFile, newcfg.BanStore = old.BanFile, old.BanStore
+	newcfg.ClusterNode, newcfg.ClusterListen, newcfg.ClusterPeers = old.ClusterNode, old.ClusterListen, old.ClusterPeers
+	newcfg.ClusterSecret, newcfg.ClusterDirectory = old.ClusterSecret, old.ClusterDirectory
+	if newcfg.filename == "" {
+		newcfg.filename = old.filename
+	}
+	this.cfgv.Store(&newcfg)
+	this.logr().Info("Config reloaded", "file", newcfg.filename)
+	return nil
+}
+
+// reload the file config loaded from
+func (this *TCPServer) ReloadFile() error {
+	filename := this.config().filename
+	if filename == "" {
+		return errors.New("Config not loaded from file")
+	}
+	cfg, err := LoadTCPServerConfig(filename)
+	if err != nil {
+		return err
+	}
+	return this.Reload(cfg)
+}
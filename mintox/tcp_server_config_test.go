@@ -0,0 +1,56 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTCPServerConfigJSON(t *testing.T) {
+	cfg, err := ParseTCPServerConfig([]byte(`{"ports": [33445, 3389], "bind_addr": "127.0.0.1", "data_queue_size": 256}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Ports) != 2 || cfg.BindAddr != "127.0.0.1" || cfg.DataQueueSize != 256 {
+		t.Error("config not parsed:", cfg.Ports, cfg.BindAddr, cfg.DataQueueSize)
+	}
+	if cfg.CtrlQueueSize != DefaultTCPServerConfig().CtrlQueueSize {
+		t.Error("default not kept:", cfg.CtrlQueueSize)
+	}
+
+	data, err := cfg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg2, err := ParseTCPServerConfig(data)
+	if err != nil || cfg2.DataQueueSize != 256 || cfg2.Ports[1] != 3389 {
+		t.Error("marshal roundtrip failed:", err, string(data))
+	}
+
+	if _, err := ParseTCPServerConfig([]byte(`{"read_buffer_size": 10}`)); err == nil {
+		t.Error("invalid config accepted")
+	}
+}
+
+func TestNewTCPServerFromConfig(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	cfg := DefaultTCPServerConfig()
+	cfg.BindAddr = "127.0.0.1"
+	cfg.Ports = []uint16{0}
+	cfg.CtrlQueueSize = 7
+	if _, err := NewTCPServerFromConfig(cfg); err == nil {
+		t.Error("server without key created")
+	}
+	cfg.Seckey = sk
+	srvo, err := NewTCPServerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvo.lsners[0].Close()
+	if len(srvo.lsners) != 1 {
+		t.Fatal("listeners:", len(srvo.lsners))
+	}
+	c0, _ := net.Pipe()
+	if secon := newTCPSecureConn(c0, &srvo.config().TCPConnConfig); cap(secon.cwctrlq) != 7 {
+		t.Error("config queue size not applied:", cap(secon.cwctrlq))
+	}
+}
@@ -0,0 +1,945 @@
+package mintox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// deliver one byte per read, stress partial read handling
+type dribbleConn struct{ net.Conn }
+
+func (this dribbleConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return this.Conn.Read(b)
+}
+
+// raw client side peer over a pipe, drive the protocol by hand
+type tstPeer struct {
+	t *testing.T
+	*TCPClient
+}
+
+func newTstPeer(t *testing.T, c net.Conn, srvpk *CryptoKey) *tstPeer {
+	pk, sk, _ := NewCBKeyPair()
+	cli := &TCPClient{ServPubkey: srvpk}
+	cli.SetKeyPair(pk, sk)
+	cli.conn = c
+	return &tstPeer{t, cli}
+}
+
+func newTstSecureConn(c net.Conn) (*TCPSecureConn, *CryptoKey) {
+	pk, sk, _ := NewCBKeyPair()
+	secon := NewTCPSecureConn(c)
+	secon.Seckey = sk
+	return secon, pk
+}
+
+func (this *tstPeer) handshake() {
+	hspkt, err := this.GenerateHandshake()
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	this.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = this.conn.Write(hspkt); err != nil {
+		this.t.Fatal(err)
+	}
+	rdbuf := make([]byte, TCP_SERVER_HANDSHAKE_SIZE)
+	if _, err = io.ReadFull(this.conn, rdbuf); err != nil {
+		this.t.Fatal(err)
+	}
+	this.HandleHandshake(rdbuf)
+
+	pingid := this.ping()
+	plnpkt := this.readPlain()
+	if plnpkt[0] != TCP_PACKET_PONG || pongidOf(plnpkt) != pingid {
+		this.t.Fatal("invalid pong:", plnpkt[0], pongidOf(plnpkt), pingid)
+	}
+}
+
+func (this *tstPeer) ping() uint64 {
+	pingpkt := this.MakePingPacket()
+	if _, err := this.conn.Write(pingpkt); err != nil {
+		this.t.Fatal(err)
+	}
+	this.SentNonce.Incr()
+	return this.Pingid
+}
+
+func (this *tstPeer) writePlain(plain []byte) {
+	if _, err := this.WritePacket(plain); err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+func (this *tstPeer) readPlain() []byte {
+	this.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rdbuf, err := ReadFrame(this.conn, nil)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	_, plnpkt, err := this.Unpacket(rdbuf)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	return plnpkt
+}
+
+func TestHandshakeDribble(t *testing.T) {
+	c0, c1 := net.Pipe()
+	secon, srvpk := newTstSecureConn(dribbleConn{c0})
+	confirmed := make(chan bool, 1)
+	secon.OnConfirmed = func(Object) { confirmed <- true }
+	secon.Start()
+	defer secon.Close()
+
+	peer := newTstPeer(t, c1, srvpk)
+	peer.handshake()
+	select {
+	case <-confirmed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not confirmed")
+	}
+
+	for i := 0; i < 3; i++ {
+		pingid := peer.ping()
+		plnpkt := peer.readPlain()
+		if plnpkt[0] != TCP_PACKET_PONG || pongidOf(plnpkt) != pingid {
+			t.Fatal("invalid pong:", i, plnpkt[0], pongidOf(plnpkt), pingid)
+		}
+	}
+}
+
+func TestLastActivityAt(t *testing.T) {
+	c0, c1 := net.Pipe()
+	secon, srvpk := newTstSecureConn(c0)
+	if !secon.LastRecvAt().IsZero() || !secon.LastSentAt().IsZero() {
+		t.Fatal("activity time should be zero before any io")
+	}
+	secon.Start()
+	defer secon.Close()
+
+	btime := time.Now()
+	peer := newTstPeer(t, c1, srvpk)
+	peer.handshake()
+	if secon.LastRecvAt().Before(btime) || secon.LastSentAt().Before(btime) {
+		t.Error("activity time not updated:", secon.LastRecvAt(), secon.LastSentAt())
+	}
+}
+
+// relay side conn without running loops, registered in srvo
+func newTstRelayConn(srvo *TCPServer, status uint8) *TCPSecureConn {
+	c0, _ := net.Pipe()
+	secon := newTCPSecureConn(c0, &srvo.config().TCPConnConfig)
+	secon.srvo = srvo
+	secon.Seckey = srvo.Seckey
+	secon.Pubkey, _, _ = NewCBKeyPair()
+	secon.setStatus(status)
+	srvo.Conns[secon.Pubkey.BinStr()] = secon
+	return secon
+}
+
+// make a connected route between c0 and c1, return c0's connid
+func linkTstRelayConns(c0, c1 *TCPSecureConn) uint8 {
+	cid0, cid1 := c0.nextConnid(), c1.nextConnid()
+	pci0 := &PeerConnInfo{Pubkey: c1.Pubkey, Status: 2, Connid: cid0, Otherid: cid1}
+	pci1 := &PeerConnInfo{Pubkey: c0.Pubkey, Status: 2, Connid: cid1, Otherid: cid0}
+	c0.ConnInfos[c1.Pubkey.BinStr()], c0.ConnInfos2[cid0] = pci0, pci0
+	c1.ConnInfos[c0.Pubkey.BinStr()], c1.ConnInfos2[cid1] = pci1, pci1
+	return cid0
+}
+
+func newTstServer() *TCPServer {
+	_, sk, _ := NewCBKeyPair()
+	return NewTCPServer(nil, sk, nil)
+}
+
+func TestRelayUnconfirmedDropped(t *testing.T) {
+	srvo := newTstServer()
+	src := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	dst := newTstRelayConn(srvo, TCP_STATUS_UNCONFIRMED)
+	connid := linkTstRelayConns(src, dst)
+
+	src.HandleRoutingData(append([]byte{connid}, "hello"...))
+	if len(dst.cwdataq) != 0 {
+		t.Error("relayed to unconfirmed peer:", len(dst.cwdataq))
+	}
+
+	dst.setStatus(TCP_STATUS_CONFIRMED)
+	src.HandleRoutingData(append([]byte{connid}, "hello"...))
+	if len(dst.cwdataq) != 1 {
+		t.Error("not relayed to confirmed peer:", len(dst.cwdataq))
+	}
+}
+
+func TestCloseDrainQueues(t *testing.T) {
+	c0, _ := net.Pipe()
+	secon := NewTCPSecureConn(c0)
+	dropn, closen := 0, 0
+	secon.OnNetDrop = func(n int) { dropn += n }
+	secon.OnClosed = func(Object) { closen++ }
+	secon.setStatus(TCP_STATUS_CONFIRMED)
+
+	for i := 0; i < 3; i++ {
+		secon.SendCtrlPacket([]byte{TCP_PACKET_PONG, 1, 2, 3})
+	}
+	for i := 0; i < 2; i++ {
+		secon.SendDataPacket(NUM_RESERVED_PORTS, []byte("hello"))
+	}
+
+	secon.Close()
+	secon.Close()
+
+	if closen != 1 {
+		t.Error("OnClosed called times:", closen)
+	}
+	if len(secon.cwctrlq) != 0 || len(secon.cwdataq) != 0 {
+		t.Error("queues not drained:", len(secon.cwctrlq), len(secon.cwdataq))
+	}
+	if secon.cwctrldlen != 0 || secon.cwdatadlen != 0 {
+		t.Error("queue length counter:", secon.cwctrldlen, secon.cwdatadlen)
+	}
+	if dropn != 3*4+2*6 {
+		t.Error("dropped bytes:", dropn)
+	}
+	if _, err := secon.SendCtrlPacket([]byte{TCP_PACKET_PONG}); err == nil {
+		t.Error("send on closed conn should fail")
+	}
+}
+
+func TestPeerForConnID(t *testing.T) {
+	srvo := newTstServer()
+	c0 := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	c1 := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	connid := linkTstRelayConns(c0, c1)
+
+	pk, ok := c0.PeerForConnID(connid)
+	if !ok || !pk.Equal2(c1.Pubkey) {
+		t.Error("peer not found by connid:", connid, ok)
+	}
+	if _, ok := c0.PeerForConnID(connid + 1); ok {
+		t.Error("found peer for unused connid:", connid+1)
+	}
+	if _, ok := c0.PeerForConnID(TCP_PACKET_PING); ok {
+		t.Error("found peer for reserved connid")
+	}
+}
+
+// listener returns errs in order, then a permanent error
+type tstListener struct {
+	errs  []error
+	calls int
+}
+
+func (this *tstListener) Accept() (net.Conn, error) {
+	this.calls++
+	if len(this.errs) > 0 {
+		err := this.errs[0]
+		this.errs = this.errs[1:]
+		return nil, err
+	}
+	return nil, errors.New("use of closed listener")
+}
+func (this *tstListener) Close() error   { return nil }
+func (this *tstListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestAcceptFdExhausted(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	if !isFdExhausted(emfile) || isFdExhausted(errors.New("x")) {
+		t.Fatal("isFdExhausted wrong")
+	}
+
+	srvo := newTstServer()
+	lsner := &tstListener{errs: []error{emfile, emfile}}
+	srvo.runAcceptProc(lsner)
+	if lsner.calls != 3 {
+		t.Error("accept loop should survive EMFILE, calls:", lsner.calls)
+	}
+	if n := srvo.Counters().FdExhausted; n != 2 {
+		t.Error("FdExhausted:", n)
+	}
+}
+
+func TestDialFdExhausted(t *testing.T) {
+	srvo := newTstServer()
+	srvo.dialFailed(errors.New("x"))
+	srvo.dialFailed(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.EMFILE)})
+	if n := srvo.Counters().FdExhausted; n != 1 {
+		t.Error("FdExhausted:", n)
+	}
+	btime := time.Now()
+	srvo.runAcceptProc(&tstListener{})
+	if d := time.Since(btime); d < TCP_FD_DIAL_PAUSE*time.Second*9/10 {
+		t.Error("accept not paused:", d)
+	}
+}
+
+func TestStuckFrameReaped(t *testing.T) {
+	for _, pktlen := range []uint16{100, MAX_PACKET_SIZE + 1} {
+		c0, c1 := net.Pipe()
+		secon, srvpk := newTstSecureConn(c0)
+		secon.frameTimeout = 200 * time.Millisecond
+		closed := make(chan bool, 1)
+		secon.OnClosed = func(Object) { closed <- true }
+		secon.Start()
+
+		peer := newTstPeer(t, c1, srvpk)
+		peer.handshake()
+		go io.Copy(ioutil.Discard, c1)
+
+		// declare a frame, then nothing
+		lenbuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenbuf, pktlen)
+		if _, err := c1.Write(append(lenbuf, 1, 2, 3)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-closed:
+			if !secon.ClosedLocally() {
+				t.Error("stuck frame close should be local:", pktlen, secon.CloseReason())
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("stuck frame conn not closed:", pktlen)
+		}
+		c1.Close()
+	}
+}
+
+func TestCloseInitiator(t *testing.T) {
+	for _, local := range []bool{true, false} {
+		srvo := newTstServer()
+		c0, c1 := net.Pipe()
+		secon, srvpk := newTstSecureConn(c0)
+		closed := make(chan bool, 1)
+		secon.OnConfirmed = srvo.onConnConfirmed
+		secon.OnClosed = func(obj Object) {
+			srvo.onConnClosed(obj)
+			closed <- true
+		}
+		secon.Start()
+
+		peer := newTstPeer(t, c1, srvpk)
+		peer.handshake()
+		peer.ping()
+		go io.Copy(ioutil.Discard, c1)
+		if !waitTstCond(3*time.Second, func() bool { return secon.status() == TCP_STATUS_CONFIRMED }) {
+			t.Fatal("not confirmed")
+		}
+
+		if local {
+			secon.Close()
+		} else {
+			c1.Close()
+		}
+		select {
+		case <-closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("conn not closed, local:", local)
+		}
+		if secon.ClosedLocally() != local {
+			t.Error("close initiator mismatch:", local, secon.CloseReason())
+		}
+		if secon.CloseReason() == "" {
+			t.Error("empty close reason")
+		}
+		cnts := srvo.Counters()
+		if local && cnts.ClosedLocal != 1 || !local && cnts.ClosedRemote != 1 {
+			t.Error("close counters:", local, cnts.ClosedLocal, cnts.ClosedRemote)
+		}
+		c1.Close()
+	}
+}
+
+func TestQueueLenCounter(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.CtrlQueueSize = 32
+	c0, _ := net.Pipe()
+	secon := newTCPSecureConn(c0, &cfg.TCPConnConfig)
+
+	stopC := make(chan bool)
+	deqDone := make(chan bool)
+	go func() {
+		defer close(deqDone)
+		for {
+			select {
+			case data := <-secon.cwctrlq:
+				secon.ctrlDequeued(data)
+			case <-stopC:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				secon.enqueueCtrl(make([]byte, 1+(i+j)%13))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stopC)
+	<-deqDone
+
+	total := 0
+	for len(secon.cwctrlq) > 0 {
+		total += len(<-secon.cwctrlq)
+	}
+	if n := atomic.LoadInt32(&secon.cwctrldlen); int(n) != total {
+		t.Error("counter not match queued bytes:", n, total)
+	}
+}
+
+// concurrent enqueue/dequeue, counter never below zero, equal queued bytes when quiet
+func stressTstQueueLen(t *testing.T, name string, q chan []byte, dlen *int32,
+	enqueue func([]byte) bool, dequeued func([]byte)) {
+	stopC := make(chan bool)
+	deqDone := make(chan bool)
+	var negative int32
+	go func() {
+		defer close(deqDone)
+		for {
+			select {
+			case data := <-q:
+				dequeued(data)
+				if atomic.LoadInt32(dlen) < 0 {
+					atomic.StoreInt32(&negative, 1)
+				}
+			case <-stopC:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				enqueue(make([]byte, 1+(i+j)%29))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stopC)
+	<-deqDone
+
+	total := 0
+	for len(q) > 0 {
+		data := <-q
+		dequeued(data)
+		total += len(data)
+	}
+	if atomic.LoadInt32(&negative) != 0 {
+		t.Error(name, "counter went negative")
+	}
+	if n := atomic.LoadInt32(dlen); n != 0 {
+		t.Error(name, "counter not match queued bytes:", n, total)
+	}
+}
+
+func TestQueueAccountingStress(t *testing.T) {
+	defer func(old bool) { CheckQueueAccounting = old }(CheckQueueAccounting)
+	CheckQueueAccounting = true
+
+	c0, _ := net.Pipe()
+	secon := newTCPSecureConn(c0, DefaultTCPConnConfig())
+	stressTstQueueLen(t, "srv ctrl", secon.cwctrlq, &secon.cwctrldlen, secon.enqueueCtrl, secon.ctrlDequeued)
+	stressTstQueueLen(t, "srv data", secon.cwdataq, &secon.cwdatadlen, secon.enqueueData, secon.dataDequeued)
+
+	cli := newTstClient()
+	stressTstQueueLen(t, "cli ctrl", cli.cwctrlq, &cli.cwctrldlen, cli.enqueueCtrl, cli.ctrlDequeued)
+	stressTstQueueLen(t, "cli data", cli.cwdataq, &cli.cwdatadlen, cli.enqueueData, cli.dataDequeued)
+}
+
+func TestPeerConnInfoString(t *testing.T) {
+	pk, _, _ := NewCBKeyPair()
+	pci := &PeerConnInfo{Pubkey: pk, Status: 2, Index: 3, Connid: 20, Otherid: 17}
+	want := "pci{" + pk.ToHex()[:8] + " ONLINE idx:3 cid:20 oid:17}"
+	if s := pci.String(); s != want {
+		t.Error("got:", s, "want:", want)
+	}
+	if s := (&PeerConnInfo{Status: 9}).String(); s != "pci{<nil> UNKNOWN_9 idx:0 cid:0 oid:0}" {
+		t.Error("got:", s)
+	}
+}
+
+func TestAdmitOverload(t *testing.T) {
+	srvo := newTstServer()
+	srvo.config().MaxHandshakes = 1
+	srvo.config().MaxQueuedBytes = 10
+
+	c0, _ := net.Pipe()
+	if !srvo.admit(c0) {
+		t.Fatal("rejected when idle")
+	}
+	srvo.HSConns[c0] = NewTCPSecureConn(c0)
+	c1, _ := net.Pipe()
+	if srvo.admit(c1) {
+		t.Error("admitted over handshake backlog")
+	}
+	delete(srvo.HSConns, c0)
+
+	rc := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	rc.SendDataPacket(NUM_RESERVED_PORTS, []byte("0123456789"))
+	c2, _ := net.Pipe()
+	if srvo.admit(c2) {
+		t.Error("admitted over queued bytes:", srvo.QueuedBytes())
+	}
+	if n := srvo.Counters().Overloaded; n != 2 {
+		t.Error("Overloaded:", n)
+	}
+	if _, err := c2.Write([]byte{1}); err == nil {
+		t.Error("rejected conn not closed")
+	}
+}
+
+func TestTcppktname(t *testing.T) {
+	cases := map[byte]string{
+		0:   "ROUTING_REQUEST",
+		9:   "ONION_RESPONSE",
+		10:  "RESERVED_10",
+		15:  "RESERVED_15",
+		16:  "DATA_FOR_CONNID_16",
+		255: "DATA_FOR_CONNID_255",
+	}
+	for ptype, want := range cases {
+		if name := tcppktname(ptype); name != want {
+			t.Error(ptype, "got:", name, "want:", want)
+		}
+	}
+}
+
+func TestHandshakeLatency(t *testing.T) {
+	c0, c1 := net.Pipe()
+	secon, srvpk := newTstSecureConn(c0)
+	if secon.HandshakeLatency() != 0 {
+		t.Fatal("latency before confirmed")
+	}
+	srvo := newTstServer()
+	secon.OnConfirmed = srvo.onConnConfirmed
+	secon.Start()
+	defer secon.Close()
+
+	btime := time.Now()
+	newTstPeer(t, c1, srvpk).handshake()
+	// pong may be sent before OnConfirmed
+	waitTstCond(3*time.Second, func() bool { return srvo.HandshakeLatencies().Count > 0 })
+	lat := secon.HandshakeLatency()
+	if lat <= 0 || lat > time.Since(secon.createdAt) || secon.createdAt.After(btime) {
+		t.Error("invalid handshake latency:", lat)
+	}
+	if snap := srvo.HandshakeLatencies(); snap.Count != 1 || snap.Mean != lat {
+		t.Error("server latency stats:", snap.Count, snap.Mean, lat)
+	}
+}
+
+func TestServerWithListeners(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	if _, err := NewTCPServerWithListeners(nil, sk, nil); err == nil {
+		t.Error("empty listeners accepted")
+	}
+
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := srvo.Addrs(); len(addrs) != 1 || addrs[0].String() != lsner.Addr().String() {
+		t.Error("addrs:", addrs)
+	}
+	srvo.Start()
+
+	c, err := net.Dial("tcp", lsner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	peer := newTstPeer(t, c, srvo.Pubkey)
+	peer.handshake()
+	peer.ping()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 1 }) {
+		t.Error("conn not accepted on provided listener:", srvo.ConnCount())
+	}
+}
+
+func TestConnidReuseChurn(t *testing.T) {
+	srvo := newTstServer()
+	src := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	dst := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	routeTo := func(c *TCPSecureConn, pk *CryptoKey) uint8 {
+		c.handleRoutingRequest(append([]byte{TCP_PACKET_ROUTING_REQUEST}, pk.Bytes()...))
+		c.drainWriteQueues()
+		if pci, ok := c.ConnInfos[pk.BinStr()]; ok {
+			return pci.Connid
+		}
+		return 0
+	}
+	usedIds := func(c *TCPSecureConn) (n int) {
+		for _, used := range c.ConnIds {
+			if used {
+				n++
+			}
+		}
+		return
+	}
+	routeTo(dst, src.Pubkey) // dst waits for src, offline route
+
+	rnd := rand.New(rand.NewSource(1))
+	live := map[uint8]*CryptoKey{} // src connid => peer
+	seen := map[uint8]bool{}
+	allocs := 0
+	for i := 0; i < 2000; i++ {
+		if rnd.Intn(2) == 0 {
+			pk := dst.Pubkey
+			if _, ok := src.ConnInfos[pk.BinStr()]; ok || rnd.Intn(4) > 0 {
+				pk, _, _ = NewCBKeyPair()
+			}
+			connid := routeTo(src, pk)
+			if len(live) == NUM_CLIENT_CONNECTIONS {
+				if connid != 0 {
+					t.Fatal("allocated over limit:", connid)
+				}
+				continue
+			}
+			if connid < NUM_RESERVED_PORTS {
+				t.Fatal("invalid connid:", i, connid)
+			}
+			if _, ok := live[connid]; ok {
+				t.Fatal("connid double allocated:", i, connid)
+			}
+			live[connid] = pk
+			seen[connid] = true
+			allocs++
+			if pk == dst.Pubkey {
+				pci := dst.ConnInfos[src.Pubkey.BinStr()]
+				if pci.Status != 2 || pci.Otherid != connid {
+					t.Fatal("route not linked:", i, pci)
+				}
+				dst.drainWriteQueues()
+			}
+		} else {
+			for connid, pk := range live {
+				src.HandleDisconnectNotification([]byte{TCP_PACKET_DISCONNECT_NOTIFICATION, connid})
+				delete(live, connid)
+				if _, ok := src.ConnInfos2[connid]; ok {
+					t.Fatal("route not removed:", i, connid)
+				}
+				if pk == dst.Pubkey {
+					pci := dst.ConnInfos[src.Pubkey.BinStr()]
+					if pci.Status != 1 || pci.Otherid != 0 {
+						t.Fatal("peer side not unlinked before connid free:", i, pci)
+					}
+					if len(dst.cwctrlq) != 1 {
+						t.Fatal("disconnect notification not sent:", len(dst.cwctrlq))
+					}
+					dst.drainWriteQueues()
+				}
+				break
+			}
+		}
+		if n := usedIds(src); n != len(live) || len(src.ConnInfos2) != len(live) {
+			t.Fatal("connid leaked:", i, n, len(src.ConnInfos2), len(live))
+		}
+	}
+	if allocs <= len(seen) {
+		t.Error("connids not reused:", allocs, len(seen))
+	}
+	for i := len(live); i < NUM_CLIENT_CONNECTIONS; i++ {
+		pk, _, _ := NewCBKeyPair()
+		if routeTo(src, pk) == 0 {
+			t.Fatal("free connid not allocated:", i, usedIds(src))
+		}
+	}
+	if pk, _, _ := NewCBKeyPair(); routeTo(src, pk) != 0 {
+		t.Error("allocated over limit")
+	}
+
+	// unknown connid, no panic
+	src.HandleDisconnectNotification([]byte{TCP_PACKET_DISCONNECT_NOTIFICATION, 255})
+}
+
+func TestKillAcceptedOrdered(t *testing.T) {
+	srvo := newTstServer()
+	gone := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	var peers []*TCPSecureConn
+	for i := 0; i < 8; i++ {
+		peer := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+		linkTstRelayConns(gone, peer)
+		peers = append(peers, peer)
+	}
+	offpk, _, _ := NewCBKeyPair()
+	offid := gone.nextConnid()
+	offpci := &PeerConnInfo{Pubkey: offpk, Status: 1, Connid: offid}
+	gone.ConnInfos[offpk.BinStr()], gone.ConnInfos2[offid] = offpci, offpci
+
+	pcis := gone.routesByConnid()
+	for i := 1; i < len(pcis); i++ {
+		if pcis[i-1].Connid >= pcis[i].Connid {
+			t.Fatal("routes not sorted:", pcis[i-1], pcis[i])
+		}
+	}
+
+	srvo.connmu.Lock()
+	delete(srvo.Conns, gone.Pubkey.BinStr())
+	srvo.killAccepted(gone)
+	srvo.connmu.Unlock()
+	for _, peer := range peers {
+		pci := peer.ConnInfos[gone.Pubkey.BinStr()]
+		if pci.Status != 1 || pci.Otherid != 0 {
+			t.Error("peer route not offline:", pci)
+		}
+		if len(peer.cwctrlq) != 1 {
+			t.Fatal("disconnect notification count:", len(peer.cwctrlq))
+		}
+		if pkt := <-peer.cwctrlq; pkt[0] != TCP_PACKET_DISCONNECT_NOTIFICATION || pkt[1] != pci.Connid {
+			t.Error("invalid disconnect notification:", pkt)
+		}
+	}
+}
+
+func TestCreatePacketOversize(t *testing.T) {
+	c0, _ := net.Pipe()
+	secon, _ := newTstSecureConn(c0)
+	pk, sk, _ := NewCBKeyPair()
+	secon.Shrkey, _ = CBBeforeNm(pk, sk)
+	secon.SentNonce = CBRandomNonce()
+
+	for _, n := range []int{TCP_MAX_PLAIN_SIZE + 1, 65535, 70000} {
+		if encpkt, err := secon.CreatePacket(make([]byte, n)); err == nil || encpkt != nil {
+			t.Error("oversized packet created:", n, len(encpkt))
+		}
+	}
+	encpkt, err := secon.CreatePacket(make([]byte, TCP_MAX_PLAIN_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pktlen := binary.BigEndian.Uint16(encpkt); pktlen != MAX_PACKET_SIZE || len(encpkt) != 2+MAX_PACKET_SIZE {
+		t.Error("packet length:", pktlen, len(encpkt))
+	}
+
+	if _, err := secon.SendDataPacket(NUM_RESERVED_PORTS, make([]byte, TCP_MAX_PLAIN_SIZE)); err == nil {
+		t.Error("oversized data packet queued")
+	}
+	if _, err := secon.SendCtrlPacket(make([]byte, TCP_MAX_PLAIN_SIZE+1)); err == nil {
+		t.Error("oversized ctrl packet queued")
+	}
+	if len(secon.cwdataq) != 0 || len(secon.cwctrlq) != 0 {
+		t.Error("oversized packet in queue")
+	}
+}
+
+func TestDrainRoutes(t *testing.T) {
+	srvo := newTstServer()
+	src := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	var peers []*TCPSecureConn
+	for i := 0; i < 3; i++ {
+		peer := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+		linkTstRelayConns(src, peer)
+		peers = append(peers, peer)
+	}
+	offpk, _, _ := NewCBKeyPair()
+	src.handleRoutingRequest(append([]byte{TCP_PACKET_ROUTING_REQUEST}, offpk.Bytes()...))
+	src.drainWriteQueues()
+
+	if n := src.DrainRoutes(); n != 4 {
+		t.Error("drained routes:", n)
+	}
+	if src.isClosed() || src.status() != TCP_STATUS_CONFIRMED {
+		t.Error("conn closed by drain")
+	}
+	if len(src.ConnInfos) != 0 || len(src.ConnInfos2) != 0 {
+		t.Error("routes left:", len(src.ConnInfos), len(src.ConnInfos2))
+	}
+	for connid, used := range src.ConnIds {
+		if used {
+			t.Error("connid not freed:", connid)
+		}
+	}
+	var lastcid uint8
+	for i := 0; i < 4; i++ {
+		pkt := <-src.cwctrlq
+		if pkt[0] != TCP_PACKET_DISCONNECT_NOTIFICATION || pkt[1] <= lastcid {
+			t.Error("invalid client notification:", i, pkt)
+		}
+		lastcid = pkt[1]
+	}
+	for _, peer := range peers {
+		pci := peer.ConnInfos[src.Pubkey.BinStr()]
+		if pci.Status != 1 || pci.Otherid != 0 {
+			t.Error("peer route not offline:", pci)
+		}
+		if len(peer.cwctrlq) != 1 {
+			t.Error("peer not notified:", len(peer.cwctrlq))
+		}
+	}
+}
+
+func TestRelayEndToEnd(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+
+	var peers []*tstPeer
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", lsner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		peer := newTstPeer(t, c, srvo.Pubkey)
+		peer.handshake()
+		peers = append(peers, peer)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 2 }) {
+		t.Fatal("conns not confirmed:", srvo.ConnCount())
+	}
+
+	// both request, both get connid and connect notification
+	connids := make([]uint8, 2)
+	for i, peer := range peers {
+		other := peers[1-i]
+		peer.writePlain(append([]byte{TCP_PACKET_ROUTING_REQUEST}, other.SelfPubkey.Bytes()...))
+		resp := peer.readUntil(TCP_PACKET_ROUTING_RESPONSE)
+		if resp[1] < NUM_RESERVED_PORTS || !bytes.Equal(resp[2:], other.SelfPubkey.Bytes()) {
+			t.Fatal("invalid routing response:", resp[:2])
+		}
+		connids[i] = resp[1]
+	}
+	for i, peer := range peers {
+		if ntf := peer.readUntil(TCP_PACKET_CONNECTION_NOTIFICATION); ntf[1] != connids[i] {
+			t.Error("connect notification connid:", ntf[1], connids[i])
+		}
+	}
+
+	// data both ways, connid rewritten
+	for i, peer := range peers {
+		peer.writePlain([]byte{connids[i], 'h', 'i', byte(i)})
+		data := peers[1-i].readPlain()
+		if !bytes.Equal(data, []byte{connids[1-i], 'h', 'i', byte(i)}) {
+			t.Error("relayed data:", i, data)
+		}
+	}
+
+	// peer 0 kills route, peer 1 notified, data of old route dropped
+	peers[0].writePlain([]byte{TCP_PACKET_DISCONNECT_NOTIFICATION, connids[0]})
+	if ntf := peers[1].readPlain(); ntf[0] != TCP_PACKET_DISCONNECT_NOTIFICATION || ntf[1] != connids[1] {
+		t.Error("disconnect notification:", ntf)
+	}
+	peers[1].writePlain([]byte{connids[1], 'x'})
+	pingid := peers[0].ping()
+	if pong := peers[0].readPlain(); pong[0] != TCP_PACKET_PONG || pongidOf(pong) != pingid {
+		t.Error("data relayed on offline route:", pong)
+	}
+}
+
+func TestTruncatedFrameClosesConn(t *testing.T) {
+	cli, secon := newTstClientPair(t)
+	defer cli.Close()
+	errC := make(chan error, 1)
+	secon.OnError = func(obj Object, err error) { errC <- err }
+	// frame shorter than mac can not be a packet
+	cli.conn.Write([]byte{0, MAC_SIZE - 1})
+	select {
+	case err := <-errC:
+		if !strings.Contains(err.Error(), "Invalid packet length") {
+			t.Error("unexpected error:", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("truncated frame not rejected")
+	}
+}
+
+func TestMalformedPacketClosesConn(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+	errC := make(chan error, 4)
+	srvo.OnConnError = func(c *TCPSecureConn, err error) { errC <- err }
+	srvo.RegisterHandler(11, func(*TCPSecureConn, []byte) { panic("buggy handler") })
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	expectErr := func(c net.Conn, what string) {
+		defer c.Close()
+		select {
+		case err := <-errC:
+			if !strings.Contains(err.Error(), what) {
+				t.Error("unexpected error:", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no error for:", what)
+		}
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := ioutil.ReadAll(c); err != nil {
+			t.Error("conn not closed:", what, err)
+		}
+	}
+
+	c := dial()
+	garbage := make([]byte, (PUBLIC_KEY_SIZE+NONCE_SIZE)*2+MAC_SIZE)
+	rand.Read(garbage)
+	c.Write(garbage)
+	expectErr(c, "Decrypt handshake")
+
+	c = dial()
+	peer := newTstPeer(t, c, srvo.Pubkey)
+	peer.handshake()
+	// client refuses to send it, build the frame by hand
+	encdat, _ := EncryptDataSymmetric(peer.Shrkey, peer.SentNonce, nil)
+	c.Write(append([]byte{0, byte(len(encdat))}, encdat...))
+	expectErr(c, "Empty packet")
+
+	c = dial()
+	peer = newTstPeer(t, c, srvo.Pubkey)
+	peer.handshake()
+	peer.writePlain([]byte{11})
+	expectErr(c, "panic")
+
+	// relay still serves others
+	c = dial()
+	defer c.Close()
+	peer = newTstPeer(t, c, srvo.Pubkey)
+	peer.handshake()
+	peer.ping()
+	peer.readUntil(TCP_PACKET_PONG)
+	if n := srvo.Counters().ConnErrors; n != 3 {
+		t.Error("conn errors:", n)
+	}
+}
@@ -0,0 +1,111 @@
+package mintox
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Shutdown stops the server gracefully: close listeners, notify clients and
+// their peers all routes are gone, wait write queues flushed, then close conns
+// and wait their goroutines done. Pending queues are dropped when ctx done,
+// and ctx's error returned if goroutines not finished in time.
+func (this *TCPServer) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&this.shuttingDown, 0, 1) {
+		return errors.New("Already shutdown")
+	}
+	close(this.stopC)
+	for _, lsner := range this.lsners {
+		lsner.Close()
+	}
+	if this.admin != nil {
+		this.admin.Close()
+	}
+	if this.adminSock != "" {
+		os.Remove(this.adminSock)
+	}
+	this.acceptwg.Wait()
+	if this.cluster != nil {
+		this.cluster.close()
+	}
+
+	conns := this.snapshotConns()
+	for _, c := range conns {
+		if c.status() == TCP_STATUS_CONFIRMED {
+			c.DrainRoutes()
+		}
+	}
+
+	// flush, give up on ctx done
+	for !this.writeQueuesEmpty(conns) {
+		select {
+		case <-ctx.Done():
+			log.Println("Shutdown flush not finished:", ctx.Err(), this.QueuedBytes())
+			goto closeconns
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+closeconns:
+	for _, c := range conns {
+		c.hsmu.Lock() // wait packet being written by write loop
+		c.hsmu.Unlock()
+		c.doClose(true, TCP_CLOSE_SHUTDOWN)
+	}
+
+	doneC := make(chan bool)
+	go func() {
+		for _, c := range conns {
+			c.loops.Wait()
+		}
+		close(doneC)
+	}()
+	select {
+	case <-doneC:
+		log.Println("Shutdown done, conns:", len(conns))
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "wait conns done")
+	}
+}
+
+func (this *TCPServer) confirmedConns() (conns []*TCPSecureConn) {
+	this.connmu.RLock()
+	defer this.connmu.RUnlock()
+	for _, c := range this.Conns {
+		if c.status() == TCP_STATUS_CONFIRMED {
+			conns = append(conns, c)
+		}
+	}
+	return
+}
+
+// confirmed and handshaking conns
+func (this *TCPServer) snapshotConns() (conns []*TCPSecureConn) {
+	this.hsconnmu.RLock()
+	for _, c := range this.HSConns {
+		conns = append(conns, c)
+	}
+	this.hsconnmu.RUnlock()
+	this.connmu.RLock()
+	for _, c := range this.Conns {
+		conns = append(conns, c)
+	}
+	this.connmu.RUnlock()
+	return
+}
+
+func (this *TCPServer) writeQueuesEmpty(conns []*TCPSecureConn) bool {
+	for _, c := range conns {
+		if c.isClosed() {
+			continue
+		}
+		if len(c.cwctrlq) > 0 || len(c.cwdataq) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// read until a packet of ptype
+func (this *tstPeer) readUntil(ptype byte) []byte {
+	for {
+		plnpkt := this.readPlain()
+		if plnpkt[0] == ptype {
+			return plnpkt
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	_, sk, _ := NewCBKeyPair()
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo, err := NewTCPServerWithListeners([]net.Listener{lsner}, sk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+
+	var peers []*tstPeer
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", lsner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		peer := newTstPeer(t, c, srvo.Pubkey)
+		peer.handshake()
+		peers = append(peers, peer)
+	}
+	if !waitTstCond(3*time.Second, func() bool { return srvo.ConnCount() == 2 }) {
+		t.Fatal("conns not confirmed:", srvo.ConnCount())
+	}
+	for i, peer := range peers {
+		other := peers[1-i]
+		peer.writePlain(append([]byte{TCP_PACKET_ROUTING_REQUEST}, other.SelfPubkey.Bytes()...))
+		peer.readUntil(TCP_PACKET_ROUTING_RESPONSE)
+	}
+	peers[0].readUntil(TCP_PACKET_CONNECTION_NOTIFICATION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srvo.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := srvo.Shutdown(ctx); err == nil {
+		t.Error("shutdown twice")
+	}
+	for _, peer := range peers {
+		peer.readUntil(TCP_PACKET_DISCONNECT_NOTIFICATION)
+	}
+	if srvo.ConnCount() != 0 {
+		t.Error("conns left:", srvo.ConnCount())
+	}
+	if c, err := net.DialTimeout("tcp", lsner.Addr().String(), time.Second); err == nil {
+		c.Close()
+		t.Error("listener not closed")
+	}
+}
@@ -0,0 +1,418 @@
+package mintox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In memory network of a TCPServer and synthetic clients over pipes, no real
+// sockets. Each write arrives after latency plus jitter, so data of different
+// conns arrives reordered, in order within a conn like tcp. Writes split into
+// pieces of at most maxChunk bytes make partial reads. Splits and delays come
+// from one seeded rand, a seed replays the same plan.
+type tstSimNet struct {
+	t     *testing.T
+	clk   *fakeTstClock // of server
+	srvo  *TCPServer
+	lsner *tstSimListener
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	latency  time.Duration
+	jitter   time.Duration
+	maxChunk int // 0 for whole writes
+	nconns   int
+
+	srvTickers int // of server's own gc loops, conns' ping loops come on top
+}
+
+func newTstSimNet(t *testing.T, seed int64, cfg *TCPServerConfig) *tstSimNet {
+	this := &tstSimNet{t: t, rnd: rand.New(rand.NewSource(seed))}
+	this.clk = newFakeTstClock()
+	this.lsner = &tstSimListener{connC: make(chan net.Conn, 64), closeC: make(chan bool)}
+	if cfg == nil {
+		cfg = DefaultTCPServerConfig()
+	}
+	_, cfg.Seckey, _ = NewCBKeyPair()
+	srvo, err := NewTCPServerWithListenersConfig([]net.Listener{this.lsner}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.clock = this.clk
+	this.srvo = srvo
+	srvo.Start()
+	// gc loops register their tickers async, wait the count settled
+	for prev, until := -1, time.Now().Add(time.Second); time.Now().Before(until); {
+		n := this.clk.tickerCount()
+		if n == prev {
+			break
+		}
+		prev, this.srvTickers = n, n
+		time.Sleep(20 * time.Millisecond)
+	}
+	return this
+}
+
+func (this *tstSimNet) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	this.srvo.Shutdown(ctx)
+}
+
+func (this *tstSimNet) setLink(latency, jitter time.Duration, maxChunk int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.latency, this.jitter, this.maxChunk = latency, jitter, maxChunk
+}
+
+// pieces of a write and their delays
+func (this *tstSimNet) plan(n int) (sizes []int, delays []time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for n > 0 {
+		size := n
+		if this.maxChunk > 0 {
+			size = 1 + this.rnd.Intn(this.maxChunk)
+			if size > n {
+				size = n
+			}
+		}
+		delay := this.latency
+		if this.jitter > 0 {
+			delay += time.Duration(this.rnd.Int63n(int64(this.jitter)))
+		}
+		sizes, delays = append(sizes, size), append(delays, delay)
+		n -= size
+	}
+	return
+}
+
+// client side of a new conn accepted by the server, from its own ip
+func (this *tstSimNet) dial() net.Conn {
+	this.mu.Lock()
+	this.nconns++
+	n := this.nconns
+	this.mu.Unlock()
+	cliaddr := &net.TCPAddr{IP: net.IPv4(10, 0, byte(n>>8), byte(n)), Port: 33445}
+	srvaddr := &net.TCPAddr{IP: net.IPv4(10, 255, 0, 1), Port: 443}
+	cli, srv := newTstSimPipe(this, cliaddr, srvaddr)
+	select {
+	case this.lsner.connC <- srv:
+	case <-time.After(3 * time.Second):
+		this.t.Fatal("sim conn not accepted")
+	}
+	return cli
+}
+
+// confirmed client
+func (this *tstSimNet) newPeer() *tstPeer {
+	peer := newTstPeer(this.t, this.dial(), this.srvo.Pubkey)
+	peer.handshake()
+	return peer
+}
+
+type tstSimListener struct {
+	connC  chan net.Conn
+	closeC chan bool
+	once   sync.Once
+}
+
+func (this *tstSimListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-this.connC:
+		return c, nil
+	case <-this.closeC:
+		return nil, io.ErrClosedPipe
+	}
+}
+func (this *tstSimListener) Close() error {
+	this.once.Do(func() { close(this.closeC) })
+	return nil
+}
+func (this *tstSimListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 255, 0, 1), Port: 443}
+}
+
+// one direction of a sim conn
+type tstSimStream struct {
+	mu      sync.Mutex
+	segs    []tstSimSegment
+	lastAt  time.Time // of last segment, later ones not before it
+	closed  bool
+	notifyC chan bool // closed on change
+}
+
+type tstSimSegment struct {
+	data []byte
+	at   time.Time // readable from
+}
+
+func newTstSimStream() *tstSimStream { return &tstSimStream{notifyC: make(chan bool)} }
+
+// mu held by caller
+func (this *tstSimStream) notifyLocked() {
+	close(this.notifyC)
+	this.notifyC = make(chan bool)
+}
+
+// sim conn end, reads one stream and writes the other
+type tstSimConn struct {
+	simnet *tstSimNet
+	rd, wr *tstSimStream
+	laddr  net.Addr
+	raddr  net.Addr
+
+	mu        sync.Mutex
+	rdeadline time.Time
+	closed    bool
+}
+
+func newTstSimPipe(simnet *tstSimNet, cliaddr, srvaddr net.Addr) (cli, srv *tstSimConn) {
+	s0, s1 := newTstSimStream(), newTstSimStream()
+	cli = &tstSimConn{simnet: simnet, rd: s0, wr: s1, laddr: cliaddr, raddr: srvaddr}
+	srv = &tstSimConn{simnet: simnet, rd: s1, wr: s0, laddr: srvaddr, raddr: cliaddr}
+	return
+}
+
+type tstSimTimeout struct{}
+
+func (tstSimTimeout) Error() string   { return "sim conn i/o timeout" }
+func (tstSimTimeout) Timeout() bool   { return true }
+func (tstSimTimeout) Temporary() bool { return true }
+
+func (this *tstSimConn) Read(b []byte) (int, error) {
+	for {
+		this.mu.Lock()
+		closed, deadline := this.closed, this.rdeadline
+		this.mu.Unlock()
+		if closed {
+			return 0, io.ErrClosedPipe
+		}
+		now := time.Now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			return 0, tstSimTimeout{}
+		}
+		s := this.rd
+		s.mu.Lock()
+		if len(s.segs) > 0 && !s.segs[0].at.After(now) {
+			n := copy(b, s.segs[0].data)
+			if s.segs[0].data = s.segs[0].data[n:]; len(s.segs[0].data) == 0 {
+				s.segs = s.segs[1:]
+			}
+			s.mu.Unlock()
+			return n, nil
+		}
+		if len(s.segs) == 0 && s.closed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		wait := time.Hour
+		if len(s.segs) > 0 {
+			wait = s.segs[0].at.Sub(now)
+		}
+		if !deadline.IsZero() && deadline.Sub(now) < wait {
+			wait = deadline.Sub(now)
+		}
+		notifyC := s.notifyC
+		s.mu.Unlock()
+		tm := time.NewTimer(wait)
+		select {
+		case <-notifyC:
+		case <-tm.C:
+		}
+		tm.Stop()
+	}
+}
+
+// never blocks, data queued by plan of simnet
+func (this *tstSimConn) Write(b []byte) (int, error) {
+	this.mu.Lock()
+	closed := this.closed
+	this.mu.Unlock()
+	s := this.wr
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if closed || s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	sizes, delays := this.simnet.plan(len(b))
+	now, off := time.Now(), 0
+	for i, size := range sizes {
+		at := now.Add(delays[i])
+		if at.Before(s.lastAt) {
+			at = s.lastAt
+		}
+		s.lastAt = at
+		s.segs = append(s.segs, tstSimSegment{append([]byte{}, b[off:off+size]...), at})
+		off += size
+	}
+	s.notifyLocked()
+	return len(b), nil
+}
+
+// peer reads what was sent, then EOF
+func (this *tstSimConn) Close() error {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil
+	}
+	this.closed = true
+	this.mu.Unlock()
+	for _, s := range []*tstSimStream{this.rd, this.wr} {
+		s.mu.Lock()
+		s.closed = true
+		s.notifyLocked()
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (this *tstSimConn) LocalAddr() net.Addr  { return this.laddr }
+func (this *tstSimConn) RemoteAddr() net.Addr { return this.raddr }
+func (this *tstSimConn) SetDeadline(t time.Time) error {
+	return this.SetReadDeadline(t)
+}
+func (this *tstSimConn) SetReadDeadline(t time.Time) error {
+	this.mu.Lock()
+	this.rdeadline = t
+	this.mu.Unlock()
+	s := this.rd
+	s.mu.Lock()
+	s.notifyLocked()
+	s.mu.Unlock()
+	return nil
+}
+func (this *tstSimConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestSimPlanReplay(t *testing.T) {
+	plans := make([]string, 2)
+	for i := range plans {
+		simnet := &tstSimNet{rnd: rand.New(rand.NewSource(7))}
+		simnet.setLink(time.Millisecond, 5*time.Millisecond, 16)
+		for j := 0; j < 4; j++ {
+			sizes, delays := simnet.plan(100)
+			plans[i] += fmt.Sprint(sizes, delays)
+		}
+	}
+	if plans[0] != plans[1] {
+		t.Error("plan of seed not replayed:", plans)
+	}
+
+	// pieces and delays keep order within a conn
+	simnet := &tstSimNet{rnd: rand.New(rand.NewSource(7))}
+	simnet.setLink(time.Millisecond, 10*time.Millisecond, 3)
+	c0, c1 := newTstSimPipe(simnet, &net.TCPAddr{}, &net.TCPAddr{})
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	c0.Write(data[:20])
+	c0.Write(data[20:])
+	c0.Close()
+	got, err := ioutil.ReadAll(c1)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Error("stream:", string(got), err)
+	}
+	c1.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := c1.Read(make([]byte, 1)); err == nil {
+		t.Error("read after close")
+	}
+}
+
+func TestSimHandshakePartialWrites(t *testing.T) {
+	simnet := newTstSimNet(t, 1, nil)
+	defer simnet.close()
+	simnet.setLink(time.Millisecond, 3*time.Millisecond, 7)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			simnet.newPeer()
+		}()
+	}
+	wg.Wait()
+	if !waitTstCond(3*time.Second, func() bool { return simnet.srvo.ConnCount() == 8 }) {
+		t.Fatal("conns not confirmed:", simnet.srvo.ConnCount())
+	}
+	if n := len(simnet.srvo.ConnCountByFamily()); n != 1 {
+		t.Error("families:", simnet.srvo.ConnCountByFamily())
+	}
+}
+
+func TestSimRouting(t *testing.T) {
+	simnet := newTstSimNet(t, 2, nil)
+	defer simnet.close()
+	simnet.setLink(2*time.Millisecond, 8*time.Millisecond, 64)
+	peers := []*tstPeer{simnet.newPeer(), simnet.newPeer()}
+
+	connids := make([]uint8, 2)
+	for i, peer := range peers {
+		peer.writePlain(append([]byte{TCP_PACKET_ROUTING_REQUEST}, peers[1-i].SelfPubkey.Bytes()...))
+		resp := peer.readUntil(TCP_PACKET_ROUTING_RESPONSE)
+		if resp[1] < NUM_RESERVED_PORTS || !bytes.Equal(resp[2:], peers[1-i].SelfPubkey.Bytes()) {
+			t.Fatal("invalid routing response:", resp[:2])
+		}
+		connids[i] = resp[1]
+	}
+	for i, peer := range peers {
+		if ntf := peer.readUntil(TCP_PACKET_CONNECTION_NOTIFICATION); ntf[1] != connids[i] {
+			t.Error("connect notification connid:", ntf[1], connids[i])
+		}
+	}
+	// a burst each way in order, connid rewritten
+	for i, peer := range peers {
+		for j := 0; j < 16; j++ {
+			peer.writePlain([]byte{connids[i], byte(i), byte(j)})
+		}
+	}
+	for i, peer := range peers {
+		for j := 0; j < 16; j++ {
+			data := peer.readPlain()
+			if !bytes.Equal(data, []byte{connids[i], byte(1 - i), byte(j)}) {
+				t.Fatal("relayed data:", i, j, data)
+			}
+		}
+	}
+}
+
+func TestSimPingTimeout(t *testing.T) {
+	simnet := newTstSimNet(t, 3, nil)
+	defer simnet.close()
+	simnet.setLink(time.Millisecond, time.Millisecond, 5)
+	quiet, live := simnet.newPeer(), simnet.newPeer()
+	if !waitTstCond(3*time.Second, func() bool { return simnet.clk.tickerCount() >= simnet.srvTickers+2 }) {
+		t.Fatal("ping loops not started")
+	}
+
+	// both pinged, only live one answers
+	simnet.clk.Advance(TCP_PING_FREQUENCY * time.Second)
+	for _, peer := range []*tstPeer{quiet, live} {
+		ping := peer.readUntil(TCP_PACKET_PING)
+		if len(ping) != 9 {
+			t.Fatal("ping:", ping)
+		}
+		if peer == live {
+			peer.writePlain(append([]byte{TCP_PACKET_PONG}, ping[1:]...))
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // pong over latency
+	simnet.clk.Advance(TCP_PING_TIMEOUT*time.Second + time.Second)
+	if !waitTstCond(3*time.Second, func() bool { return simnet.srvo.ConnCount() == 1 }) {
+		t.Fatal("quiet peer not timed out:", simnet.srvo.ConnCount())
+	}
+	quiet.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, quiet.conn); err != nil {
+		t.Error("quiet peer conn not closed:", err)
+	}
+	pingid := live.ping()
+	if pong := live.readUntil(TCP_PACKET_PONG); pongidOf(pong) != pingid {
+		t.Error("live peer pong:", pongidOf(pong), pingid)
+	}
+}
@@ -0,0 +1,92 @@
+package mintox
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/* seconds a socket write may block before the conn is closed */
+const TCP_WRITE_TIMEOUT = 10
+
+/* seconds write queues of a confirmed conn may stay saturated before evicted */
+const TCP_SLOW_CLIENT_TIMEOUT = 30
+
+// write with deadline, a peer stopped reading would block the writer forever,
+// and hsmu with it, so ping loop and Shutdown too.
+func (this *TCPSecureConn) sockWrite(b []byte) (int, error) {
+	if this.writeTimeout > 0 {
+		this.Sock.SetWriteDeadline(time.Now().Add(this.writeTimeout))
+	}
+	wn, err := this.Sock.Write(b)
+	if isTimeoutErr(err) && this.srvo != nil {
+		atomic.AddInt64(&this.srvo.cnts.WriteTimeouts, 1)
+	}
+	return wn, err
+}
+
+func isTimeoutErr(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// close reason of a failed write
+func writeCloseReason(err error) (local bool, reason string) {
+	if isTimeoutErr(err) {
+		return true, TCP_CLOSE_WRITE_TIMEOUT
+	}
+	return false, err.Error()
+}
+
+// bytes in write queues, not written to socket yet
+func (this *TCPSecureConn) PendingBytes() int {
+	return int(atomic.LoadInt32(&this.cwctrldlen) + atomic.LoadInt32(&this.cwdatadlen))
+}
+
+// data queue full or pending over maxbytes, 0 maxbytes for queue full only
+func (this *TCPSecureConn) queueSaturated(maxbytes int) bool {
+	return len(this.cwdataq) == cap(this.cwdataq) || (maxbytes > 0 && this.PendingBytes() >= maxbytes)
+}
+
+// evict confirmed conns whose write queues stay saturated, a slow peer reads
+// just enough to dodge the write timeout but pins queue memory forever.
+func (this *TCPServer) runSlowClientGC() {
+	if this.config().SlowClientTimeout == 0 {
+		return
+	}
+	tickC, tickStop := this.clock.Tick(time.Second)
+	defer tickStop()
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case <-tickC:
+		}
+		this.evictSlowClients(this.clock.Now())
+	}
+}
+
+func (this *TCPServer) evictSlowClients(now time.Time) int {
+	timeout := time.Duration(this.config().SlowClientTimeout) * time.Second
+	var slows []*TCPSecureConn
+	this.connmu.RLock()
+	for _, c := range this.Conns {
+		if !c.queueSaturated(this.config().SlowClientBytes) {
+			c.slowSince = time.Time{}
+		} else if c.slowSince.IsZero() {
+			c.slowSince = now
+		} else if now.Sub(c.slowSince) > timeout {
+			slows = append(slows, c)
+		}
+	}
+	this.connmu.RUnlock()
+
+	// closed out of lock, OnClosed removes it from Conns
+	for _, c := range slows {
+		log.Println("Slow client evicted:", c.PendingBytes(), now.Sub(c.slowSince), c.Sock.RemoteAddr())
+		atomic.AddInt64(&this.cnts.SlowEvicted, 1)
+		c.doClose(true, TCP_CLOSE_SLOW_CLIENT)
+	}
+	return len(slows)
+}
@@ -0,0 +1,90 @@
+package mintox
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// peer never reads, write loop must not block forever
+func TestWriteTimeout(t *testing.T) {
+	cfg := DefaultTCPConnConfig()
+	cfg.WriteTimeout = 1
+	c0, c1 := net.Pipe()
+	defer c1.Close()
+	secon := newTCPSecureConn(c0, cfg)
+	secon.Shrkey, secon.SentNonce, secon.RecvNonce = newTstPacketKeys()
+	secon.srvo = newTstServer()
+	secon.Start()
+	defer secon.Close()
+
+	if !secon.enqueueData([]byte{TCP_PACKET_PING, 1}) {
+		t.Fatal("not queued")
+	}
+	if !waitTstCond(5*time.Second, func() bool { return secon.isClosed() }) {
+		t.Fatal("blocked write not timeout")
+	}
+	if !secon.ClosedLocally() || secon.CloseReason() != TCP_CLOSE_WRITE_TIMEOUT {
+		t.Error("close reason:", secon.ClosedLocally(), secon.CloseReason())
+	}
+	if n := secon.srvo.Counters().WriteTimeouts; n != 1 {
+		t.Error("write timeouts:", n)
+	}
+
+	cfg.WriteTimeout = -1
+	if cfg.Validate() == nil {
+		t.Error("invalid write_timeout accepted")
+	}
+}
+
+func TestSlowClientEvicted(t *testing.T) {
+	srvo := newTstServer()
+	srvo.config().SlowClientBytes = 0
+	slow := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	fast := newTstRelayConn(srvo, TCP_STATUS_CONFIRMED)
+	for slow.enqueueData([]byte{1, 2, 3}) {
+	}
+	fast.enqueueData([]byte{1, 2, 3})
+	if slow.PendingBytes() != 3*cap(slow.cwdataq) || fast.PendingBytes() != 3 {
+		t.Fatal("pending bytes:", slow.PendingBytes(), fast.PendingBytes())
+	}
+
+	now := time.Now()
+	timeout := TCP_SLOW_CLIENT_TIMEOUT * time.Second
+	if srvo.evictSlowClients(now) != 0 || srvo.evictSlowClients(now.Add(timeout)) != 0 {
+		t.Fatal("evicted before timeout")
+	}
+	// drained for a moment, saturated time restarts
+	slow.dataDequeued(<-slow.cwdataq)
+	if srvo.evictSlowClients(now.Add(timeout)) != 0 {
+		t.Fatal("evicted after drained")
+	}
+	slow.enqueueData([]byte{1, 2, 3})
+	srvo.evictSlowClients(now.Add(timeout + time.Second))
+	if srvo.evictSlowClients(now.Add(2*timeout+time.Second)) != 0 || slow.isClosed() {
+		t.Fatal("saturated time not restarted")
+	}
+	if srvo.evictSlowClients(now.Add(2*timeout+2*time.Second)) != 1 {
+		t.Fatal("slow client not evicted")
+	}
+	if !slow.isClosed() || slow.CloseReason() != TCP_CLOSE_SLOW_CLIENT || fast.isClosed() {
+		t.Error("evicted conns:", slow.CloseReason(), fast.isClosed())
+	}
+	if slow.PendingBytes() != 0 || srvo.Counters().SlowEvicted != 1 {
+		t.Error("after evicted:", slow.PendingBytes(), srvo.Counters().SlowEvicted)
+	}
+
+	// byte threshold before queue full
+	srvo.config().SlowClientBytes = 4
+	fast.enqueueData([]byte{4, 5})
+	srvo.evictSlowClients(now)
+	if fast.slowSince.IsZero() {
+		t.Error("pending over slow_client_bytes not saturated")
+	}
+
+	cfg := DefaultTCPServerConfig()
+	cfg.SlowClientTimeout = -1
+	if cfg.Validate() == nil {
+		t.Error("invalid slow_client_timeout accepted")
+	}
+}
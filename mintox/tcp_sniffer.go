@@ -0,0 +1,72 @@
+package mintox
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// AllowTCPSniffer must be set explicitly before AttachSniffer works.
+// A sniffer sees decrypted payloads of the conn, that is the peer's routed data,
+// onion and oob packets in plain. Only enable it to debug a specific conn
+// with the consent of its owner, never leave it on in production.
+var AllowTCPSniffer = false
+
+// passive observer of decrypted inbound packets, called on the conn's read
+// goroutine, so should be quick. payload is a private copy, without type byte.
+type TCPSniffer func(ptype byte, payload []byte)
+
+type tcpSniffers struct {
+	mu  sync.Mutex
+	n   int32 // len(fns), atomic, fast path for no sniffer
+	fns map[int]TCPSniffer
+	seq int
+}
+
+// AttachSniffer adds a copy of every decrypted inbound packet to fn,
+// call detach to stop. Fails unless AllowTCPSniffer.
+func (this *TCPSecureConn) AttachSniffer(fn TCPSniffer) (detach func(), err error) {
+	if !AllowTCPSniffer {
+		return nil, errors.New("TCP sniffer not allowed")
+	}
+	if fn == nil {
+		return nil, errors.New("Nil sniffer")
+	}
+	s := &this.sniffers
+	s.mu.Lock()
+	if s.fns == nil {
+		s.fns = map[int]TCPSniffer{}
+	}
+	s.seq++
+	id := s.seq
+	s.fns[id] = fn
+	atomic.StoreInt32(&s.n, int32(len(s.fns)))
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.fns, id)
+			atomic.StoreInt32(&s.n, int32(len(s.fns)))
+			s.mu.Unlock()
+		})
+	}, nil
+}
+
+func (this *TCPSecureConn) sniff(plnpkt []byte) {
+	s := &this.sniffers
+	if atomic.LoadInt32(&s.n) == 0 || len(plnpkt) == 0 {
+		return
+	}
+	s.mu.Lock()
+	fns := make([]TCPSniffer, 0, len(s.fns))
+	for _, fn := range s.fns {
+		fns = append(fns, fn)
+	}
+	s.mu.Unlock()
+	for _, fn := range fns {
+		fn(plnpkt[0], append([]byte{}, plnpkt[1:]...))
+	}
+}
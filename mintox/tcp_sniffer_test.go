@@ -0,0 +1,64 @@
+package mintox
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniffer(t *testing.T) {
+	c0, c1 := net.Pipe()
+	secon, srvpk := newTstSecureConn(c0)
+	defer secon.Close()
+	if _, err := secon.AttachSniffer(func(byte, []byte) {}); err == nil {
+		t.Fatal("sniffer attached without AllowTCPSniffer")
+	}
+
+	defer func(old bool) { AllowTCPSniffer = old }(AllowTCPSniffer)
+	AllowTCPSniffer = true
+	type sniffed struct {
+		ptype   byte
+		payload []byte
+	}
+	sniffC := make(chan sniffed, 8)
+	detach, err := secon.AttachSniffer(func(ptype byte, payload []byte) {
+		sniffC <- sniffed{ptype, payload}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secon.Start()
+
+	peer := newTstPeer(t, c1, srvpk)
+	peer.handshake()
+	go io.Copy(ioutil.Discard, c1)
+	peer.writePlain([]byte{TCP_PACKET_CAPABILITY, 0})
+
+	for _, want := range []byte{TCP_PACKET_PING, TCP_PACKET_CAPABILITY} {
+		select {
+		case pkt := <-sniffC:
+			if pkt.ptype != want {
+				t.Error("sniffed type:", pkt.ptype, want)
+			}
+			if want == TCP_PACKET_PING && len(pkt.payload) != 8 {
+				t.Error("sniffed ping payload:", len(pkt.payload))
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("packet not sniffed:", want)
+		}
+	}
+
+	detach()
+	rn := secon.RecvBytes()
+	peer.ping()
+	if !waitTstCond(3*time.Second, func() bool { return secon.RecvBytes() > rn }) {
+		t.Fatal("ping not received")
+	}
+	select {
+	case pkt := <-sniffC:
+		t.Error("sniffed after detach:", pkt.ptype)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
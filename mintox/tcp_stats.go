@@ -0,0 +1,120 @@
+package mintox
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// snapshot of one conn, for relay dashboards
+type TCPConnStats struct {
+	Pubkey *CryptoKey // client's, nil if handshake not done
+	Addr   net.Addr
+	Status uint8
+	Family uint8
+
+	ConnectedAt      time.Time     // accept time
+	HandshakeLatency time.Duration // 0 if not confirmed yet
+	RTT              time.Duration // of last ping answered, 0 if none yet
+	SRTT             time.Duration // smoothed of answered pings
+	RTTVar           time.Duration
+	LastRecvAt       time.Time
+	LastSentAt       time.Time
+
+	BytesRecv   int64 // on wire, include handshake and ping
+	BytesSent   int64
+	PacketsRecv int64 // frames, include handshake
+	PacketsSent int64
+
+	CtrlQueueLen int // packets waiting in write queues
+	DataQueueLen int
+	QueuedBytes  int
+	FwdDropped   int64 // packets to this conn dropped, see FwdDropped
+	Routes       int
+
+	OverQuota bool // relayed packets throttled, see TCPClientUsage
+}
+
+func (this *TCPSecureConn) Stats() TCPConnStats {
+	this.connmu.RLock()
+	routes := len(this.ConnInfos2)
+	this.connmu.RUnlock()
+	return TCPConnStats{
+		Pubkey: this.Pubkey,
+		Addr:   this.Sock.RemoteAddr(),
+		Status: this.status(),
+		Family: this.Family,
+
+		ConnectedAt:      this.createdAt,
+		HandshakeLatency: this.HandshakeLatency(),
+		RTT:              this.RTT(),
+		SRTT:             this.rtt.smoothed(),
+		RTTVar:           this.rtt.variance(),
+		LastRecvAt:       this.LastRecvAt(),
+		LastSentAt:       this.LastSentAt(),
+
+		BytesRecv:   this.RecvBytes(),
+		BytesSent:   this.SentBytes(),
+		PacketsRecv: atomic.LoadInt64(&this.recvPkts),
+		PacketsSent: atomic.LoadInt64(&this.sentPkts),
+
+		CtrlQueueLen: len(this.cwctrlq),
+		DataQueueLen: len(this.cwdataq),
+		QueuedBytes:  this.PendingBytes(),
+		FwdDropped:   this.FwdDropped(),
+		Routes:       routes,
+
+		OverQuota: atomic.LoadInt32(&this.overQuota) == 1,
+	}
+}
+
+// RTT of last ping answered, 0 if none yet
+func (this *TCPSecureConn) RTT() time.Duration { return this.rtt.lastRTT() }
+
+// smoothed RTT of answered pings, 0 if none yet
+func (this *TCPSecureConn) SRTT() time.Duration { return this.rtt.smoothed() }
+
+// snapshot of the server and all its conns
+type TCPServerStats struct {
+	Counters    TCPServerCounters
+	Handshaking int
+	Confirmed   int
+	Parked      int              // closed sessions waiting resume
+	QueuedBytes int64            // write queues of all confirmed conns
+	Conns       []TCPConnStats   // handshaking and confirmed, oldest first
+	Usages      []TCPClientUsage // of clients seen this month, see Usages
+}
+
+func (this *TCPServer) Stats() TCPServerStats {
+	stats := TCPServerStats{Counters: this.Counters(), Parked: this.ParkedCount(), QueuedBytes: this.QueuedBytes(),
+		Usages: this.Usages()}
+	this.hsconnmu.RLock()
+	for _, c := range this.HSConns {
+		stats.Conns = append(stats.Conns, c.Stats())
+	}
+	stats.Handshaking = len(this.HSConns)
+	this.hsconnmu.RUnlock()
+	this.connmu.RLock()
+	for _, c := range this.Conns {
+		stats.Conns = append(stats.Conns, c.Stats())
+	}
+	stats.Confirmed = len(this.Conns)
+	this.connmu.RUnlock()
+
+	sort.SliceStable(stats.Conns, func(i, j int) bool {
+		return stats.Conns[i].ConnectedAt.Before(stats.Conns[j].ConnectedAt)
+	})
+	return stats
+}
+
+// stats of the confirmed conn of client pubkey
+func (this *TCPServer) ConnStats(pubkey *CryptoKey) (TCPConnStats, bool) {
+	this.connmu.RLock()
+	c, ok := this.Conns[pubkey.BinStr()]
+	this.connmu.RUnlock()
+	if !ok {
+		return TCPConnStats{}, false
+	}
+	return c.Stats(), true
+}
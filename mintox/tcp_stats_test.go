@@ -0,0 +1,102 @@
+package mintox
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTCPConnStats(t *testing.T) {
+	clk := newFakeTstClock()
+	c0, c1 := net.Pipe()
+	secon, srvpk := newTstSecureConn(c0)
+	secon.clock = clk
+	secon.Start()
+	defer secon.Close()
+
+	peer := newTstPeer(t, c1, srvpk)
+	peer.handshake()
+	if !waitTstCond(3*time.Second, func() bool { return clk.tickerCount() == 1 }) {
+		t.Fatal("ping loop not started")
+	}
+	if rtt := secon.Stats().RTT; rtt != 0 {
+		t.Error("rtt before ping:", rtt)
+	}
+
+	clk.Advance(TCP_PING_FREQUENCY * time.Second)
+	plnpkt := peer.readPlain()
+	if plnpkt[0] != TCP_PACKET_PING {
+		t.Fatal("ping not sent:", plnpkt)
+	}
+	clk.Advance(80 * time.Millisecond)
+	peer.writePlain(append([]byte{TCP_PACKET_PONG}, plnpkt[1:]...))
+	if !waitTstCond(3*time.Second, func() bool { return atomic.LoadUint64(&secon.Pingid) == 0 }) {
+		t.Fatal("pong not matched")
+	}
+
+	// handshake, ping and pong each way, ping counted after the write returned
+	waitTstCond(3*time.Second, func() bool { return secon.Stats().PacketsSent == 3 })
+	st := secon.Stats()
+	if st.RTT != 80*time.Millisecond || st.SRTT != 80*time.Millisecond || st.RTTVar != 40*time.Millisecond {
+		t.Error("rtt:", st.RTT, st.SRTT, st.RTTVar)
+	}
+	if st.PacketsRecv != 3 || st.PacketsSent != 3 {
+		t.Error("packets:", st.PacketsRecv, st.PacketsSent)
+	}
+	if st.BytesRecv != secon.RecvBytes() || st.BytesSent != secon.SentBytes() || st.BytesSent == 0 {
+		t.Error("bytes:", st.BytesRecv, st.BytesSent)
+	}
+	if !st.Pubkey.Equal2(peer.SelfPubkey) || st.Status != TCP_STATUS_CONFIRMED || st.ConnectedAt.IsZero() {
+		t.Error("stats:", st.Pubkey, st.Status, st.ConnectedAt)
+	}
+}
+
+func TestTCPServerStats(t *testing.T) {
+	srvo, addr := newTstListenServer(t, DefaultTCPServerConfig(), defaultClock)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	clis := make([]*TCPClient, 2)
+	for i := range clis {
+		pk, sk, _ := NewCBKeyPair()
+		clis[i] = NewTCPClient(addr, srvo.Pubkey, pk, sk)
+		defer clis[i].Close()
+		if !waitTstCond(3*time.Second, func() bool { return clis[i].Status == TCP_CLIENT_CONFIRMED }) {
+			t.Fatal("client not confirmed")
+		}
+	}
+	clis[0].AddPeer(clis[1].SelfPubkey)
+	if !waitTstCond(3*time.Second, func() bool {
+		st, ok := srvo.ConnStats(clis[0].SelfPubkey)
+		return ok && st.Routes == 1
+	}) {
+		t.Error("route not in stats")
+	}
+	hsc, err := net.Dial("tcp", addr) // never handshakes
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hsc.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.Stats().Handshaking == 1 }) {
+		t.Fatal("handshaking conn not in stats")
+	}
+
+	stats := srvo.Stats()
+	if stats.Confirmed != 2 || len(stats.Conns) != 3 || stats.Counters.BytesRecv == 0 {
+		t.Fatal("stats:", stats.Confirmed, len(stats.Conns), stats.Counters.BytesRecv)
+	}
+	for i, cli := range clis {
+		if !stats.Conns[i].Pubkey.Equal2(cli.SelfPubkey) {
+			t.Error("conns not oldest first:", i)
+		}
+	}
+	if stats.Conns[2].Pubkey != nil || stats.Conns[2].Status != TCP_STATUS_NO_STATUS {
+		t.Error("handshaking conn:", stats.Conns[2].Pubkey, stats.Conns[2].Status)
+	}
+	if _, ok := srvo.ConnStats(srvo.Pubkey); ok {
+		t.Error("stats of unknown pubkey")
+	}
+}
@@ -0,0 +1,124 @@
+package mintox
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Debug tap of a conn, keeps headers of decrypted packets in a ring, never
+// payloads, so unlike the sniffer it is fine for any conn. On for new conns
+// by debug_tap, or one conn by TapConn, read back by TapEntries or the admin
+// api /tap.
+
+const (
+	TCP_TAP_RECV = "recv" // peer => self
+	TCP_TAP_SENT = "sent" // self => peer
+)
+
+const TCP_TAP_MAX_SIZE = 64 * 1024 // entries of a tap
+
+// one packet, Len is the plain length with type byte
+type TCPTapEntry struct {
+	Time time.Time `json:"time"`
+	Dir  string    `json:"dir"`
+	Type byte      `json:"type"`
+	Name string    `json:"name"`
+	Len  int       `json:"len"`
+	// short pubkey of the routed peer, oob or routing request target, if any
+	Peer string `json:"peer,omitempty"`
+}
+
+type tcpTap struct {
+	on   int32 // atomic, fast path for no tap
+	mu   sync.Mutex
+	ring []TCPTapEntry
+	next int // write position
+	full bool
+}
+
+func (this *tcpTap) start(size int) {
+	if size > TCP_TAP_MAX_SIZE {
+		size = TCP_TAP_MAX_SIZE
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if size <= 0 {
+		this.ring, this.next, this.full = nil, 0, false
+		atomic.StoreInt32(&this.on, 0)
+		return
+	}
+	this.ring, this.next, this.full = make([]TCPTapEntry, size), 0, false
+	atomic.StoreInt32(&this.on, 1)
+}
+
+func (this *tcpTap) add(e TCPTapEntry) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.ring) == 0 {
+		return
+	}
+	this.ring[this.next] = e
+	this.next++
+	if this.next == len(this.ring) {
+		this.next, this.full = 0, true
+	}
+}
+
+// oldest first
+func (this *tcpTap) entries() []TCPTapEntry {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.full {
+		return append([]TCPTapEntry{}, this.ring[:this.next]...)
+	}
+	return append(append([]TCPTapEntry{}, this.ring[this.next:]...), this.ring[:this.next]...)
+}
+
+// StartTap keeps headers of the last size packets, drops the kept ones,
+// 0 size stops.
+func (this *TCPSecureConn) StartTap(size int) { this.tap.start(size) }
+
+func (this *TCPSecureConn) TapEntries() []TCPTapEntry { return this.tap.entries() }
+
+func (this *TCPSecureConn) tapPacket(dir string, plnpkt []byte) {
+	if atomic.LoadInt32(&this.tap.on) == 0 || len(plnpkt) == 0 {
+		return
+	}
+	ptype := plnpkt[0]
+	e := TCPTapEntry{Time: this.clock.Now(), Dir: dir, Type: ptype, Name: tcppktname(ptype), Len: len(plnpkt)}
+	switch {
+	case ptype >= NUM_RESERVED_PORTS:
+		if pubkey, ok := this.PeerForConnID(ptype); ok {
+			e.Peer = pubkey.String()
+		}
+	case ptype == TCP_PACKET_ROUTING_REQUEST || ptype == TCP_PACKET_OOB_SEND || ptype == TCP_PACKET_OOB_RECV:
+		if len(plnpkt) >= 1+PUBLIC_KEY_SIZE {
+			e.Peer = NewCryptoKey(plnpkt[1 : 1+PUBLIC_KEY_SIZE]).String()
+		}
+	case ptype == TCP_PACKET_ROUTING_RESPONSE:
+		if len(plnpkt) >= 2+PUBLIC_KEY_SIZE {
+			e.Peer = NewCryptoKey(plnpkt[2 : 2+PUBLIC_KEY_SIZE]).String()
+		}
+	}
+	this.tap.add(e)
+}
+
+// TapConn starts tap of the confirmed conn of pubkey, see StartTap
+func (this *TCPServer) TapConn(pubkey *CryptoKey, size int) bool {
+	c := this.confirmedConn(pubkey)
+	if c == nil {
+		return false
+	}
+	c.StartTap(size)
+	return true
+}
+
+// TapEntries of the confirmed conn of pubkey, empty if not tapped
+func (this *TCPServer) TapEntries(pubkey *CryptoKey) ([]TCPTapEntry, bool) {
+	c := this.confirmedConn(pubkey)
+	if c == nil {
+		return nil, false
+	}
+	return c.TapEntries(), true
+}
@@ -0,0 +1,91 @@
+package mintox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTapRing(t *testing.T) {
+	var tap tcpTap
+	tap.add(TCPTapEntry{Len: 1})
+	if n := len(tap.entries()); n != 0 {
+		t.Error("entries of stopped tap:", n)
+	}
+	tap.start(3)
+	for i := 1; i <= 5; i++ {
+		tap.add(TCPTapEntry{Len: i})
+	}
+	es := tap.entries()
+	if len(es) != 3 || es[0].Len != 3 || es[2].Len != 5 {
+		t.Error("ring:", es)
+	}
+	tap.start(0)
+	if len(tap.entries()) != 0 {
+		t.Error("stopped tap kept entries")
+	}
+}
+
+func TestTapConn(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	cfg.DebugTap = 64
+	srvo, addr := newTstListenServer(t, cfg, defaultClock)
+	defer srvo.Shutdown(context.Background())
+
+	pk, sk, _ := NewCBKeyPair()
+	cli := NewTCPClient(addr, srvo.Pubkey, pk, sk)
+	defer cli.Close()
+	if !waitTstCond(3*time.Second, func() bool { return srvo.confirmedConn(pk) != nil }) {
+		t.Fatal("client not confirmed")
+	}
+	peerpk, _, _ := NewCBKeyPair()
+	cli.AddPeer(peerpk)
+
+	var req, resp *TCPTapEntry
+	waitTstCond(3*time.Second, func() bool {
+		es, _ := srvo.TapEntries(pk)
+		for i := range es {
+			switch {
+			case es[i].Dir == TCP_TAP_RECV && es[i].Type == TCP_PACKET_ROUTING_REQUEST:
+				req = &es[i]
+			case es[i].Dir == TCP_TAP_SENT && es[i].Type == TCP_PACKET_ROUTING_RESPONSE:
+				resp = &es[i]
+			}
+		}
+		return req != nil && resp != nil
+	})
+	if req == nil || req.Peer != peerpk.String() || req.Len != 1+PUBLIC_KEY_SIZE || req.Name != "ROUTING_REQUEST" {
+		t.Fatal("routing request not tapped:", req)
+	}
+	if resp == nil || resp.Peer != peerpk.String() {
+		t.Fatal("routing response not tapped:", resp)
+	}
+
+	get := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srvo.AdminHandler().ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+	es := []TCPTapEntry{}
+	if w := get("GET", "/tap?pubkey="+pk.ToHex()); w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &es) != nil || len(es) == 0 {
+		t.Error("admin tap:", w.Code, len(es))
+	}
+	if w := get("POST", "/tap?pubkey="+pk.ToHex()+"&size=0"); w.Code != 200 {
+		t.Error("admin stop tap:", w.Code)
+	}
+	if es, _ := srvo.TapEntries(pk); len(es) != 0 {
+		t.Error("entries after stop:", len(es))
+	}
+	if w := get("POST", "/tap?pubkey="+peerpk.ToHex()+"&size=8"); w.Code != http.StatusNotFound {
+		t.Error("tap of unknown conn:", w.Code)
+	}
+	for _, method := range []string{"GET", "POST"} {
+		if w := get(method, "/tap?pubkey="+strings.Repeat("zz", PUBLIC_KEY_SIZE)+"&size=8"); w.Code != http.StatusBadRequest {
+			t.Error("tap of non-hex pubkey:", method, w.Code)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package mintox
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSRelay(t *testing.T) {
+	cfg := DefaultTCPServerConfig()
+	_, cfg.Seckey, _ = NewCBKeyPair()
+	cfg.TLSHosts = []string{"relay.example.com"}
+	tlscfg, err := newTCPTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo, err := NewTCPServerWithListenersConfig([]net.Listener{NewTLSListener(lsner, tlscfg)}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	// looks like https to a browser trusting the cert
+	roots := x509.NewCertPool()
+	cert, _ := x509.ParseCertificate(tlscfg.Certificates[0].Certificate[0])
+	roots.AddCert(cert)
+	tc, err := tls.Dial("tcp", lsner.Addr().String(),
+		&tls.Config{ServerName: "relay.example.com", RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := tc.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Error("alpn:", proto)
+	}
+	tc.Close()
+
+	clis := make([]*TCPClient, 2)
+	for i := range clis {
+		pk, sk, _ := NewCBKeyPair()
+		clis[i] = NewTCPClient("tls://"+lsner.Addr().String(), srvo.Pubkey, pk, sk)
+		defer clis[i].Close()
+	}
+	dataC := make(chan []byte, 16)
+	clis[0].OnData = func(pk *CryptoKey, data []byte) { dataC <- data }
+	for i, cli := range clis {
+		cli.AddPeer(clis[1-i].SelfPubkey)
+	}
+	got := false
+	for btime := time.Now(); !got && time.Since(btime) < 5*time.Second; {
+		clis[1].SendData(clis[0].SelfPubkey, []byte("hello"))
+		select {
+		case data := <-dataC:
+			got = string(data) == "hello"
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if !got {
+		t.Fatal("data not routed over tls")
+	}
+}
+
+func TestTLSConfigCert(t *testing.T) {
+	cert, err := newSelfSignedCert([]string{"relay.example.com", "10.0.0.1"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	xc, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xc.DNSNames) != 1 || xc.DNSNames[0] != "relay.example.com" ||
+		len(xc.IPAddresses) != 1 || !xc.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("cert names:", xc.DNSNames, xc.IPAddresses)
+	}
+
+	// static cert files
+	dir := t.TempDir()
+	keyder, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	cfg := DefaultTCPServerConfig()
+	cfg.TLSCertFile = filepath.Join(dir, "cert.pem")
+	cfg.TLSKeyFile = filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(cfg.TLSCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(cfg.TLSKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+	tlscfg, err := newTCPTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tlscfg.Certificates[0].Certificate[0]) != string(cert.Certificate[0]) {
+		t.Error("static cert not loaded")
+	}
+
+	cfg.TLSKeyFile = ""
+	if err := cfg.Validate(); err == nil {
+		t.Error("cert without key accepted")
+	}
+	cfg.TLSCertFile = filepath.Join(dir, "none.pem")
+	cfg.TLSKeyFile = cfg.TLSCertFile
+	if _, err := newTCPTLSConfig(cfg); err == nil {
+		t.Error("missing cert file accepted")
+	}
+}
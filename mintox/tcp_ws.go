@@ -0,0 +1,411 @@
+package mintox
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WebSocket transport of relay conns, for browsers and networks only 80/443
+// open. Each Write of the conn is one binary message, the encrypted packets
+// are the same as raw TCP. wss is left to a reverse proxy or a tls listener
+// wrapped by NewWSListener.
+
+const TCP_WS_PATH = "/"
+const TCP_WS_PROTOCOL = "tox"       // subprotocol, echoed when asked
+const TCP_WS_HANDSHAKE_TIMEOUT = 10 // seconds
+
+/* frame payload of ping/close, and of any frame we read, bigger never a relay packet */
+const WS_MAX_CONTROL_PAYLOAD = 125
+const WS_MAX_PAYLOAD = 2 * MAX_PACKET_SIZE
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	WS_OP_CONTINUATION = 0x0
+	WS_OP_TEXT         = 0x1
+	WS_OP_BINARY       = 0x2
+	WS_OP_CLOSE        = 0x8
+	WS_OP_PING         = 0x9
+	WS_OP_PONG         = 0xA
+)
+
+type wsAccepted struct {
+	c   net.Conn
+	err error
+}
+
+// net.Listener of upgraded conns, handshakes run concurrently so a slow one
+// never blocks the others.
+type wsListener struct {
+	net.Listener
+	path       string
+	trustProxy bool // X-Forwarded-For as remote addr
+	connC      chan wsAccepted
+	stopC      chan struct{}
+	closeOnce  sync.Once
+}
+
+// path empty for TCP_WS_PATH. trustProxy only when behind a reverse proxy,
+// clients can fake the header otherwise.
+func NewWSListener(lsner net.Listener, path string, trustProxy bool) net.Listener {
+	if path == "" {
+		path = TCP_WS_PATH
+	}
+	this := &wsListener{Listener: lsner, path: path, trustProxy: trustProxy}
+	this.connC = make(chan wsAccepted)
+	this.stopC = make(chan struct{})
+	go this.doAccept()
+	return this
+}
+
+// errors of the raw listener told to Accept one by one, so its backoff applies
+func (this *wsListener) doAccept() {
+	for {
+		c, err := this.Listener.Accept()
+		if err != nil {
+			select {
+			case this.connC <- wsAccepted{nil, err}:
+			case <-this.stopC:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go this.upgrade(c)
+	}
+}
+
+func (this *wsListener) upgrade(c net.Conn) {
+	c.SetDeadline(time.Now().Add(TCP_WS_HANDSHAKE_TIMEOUT * time.Second))
+	wsc, err := wsServerHandshake(c, this.path, this.trustProxy)
+	if err != nil {
+		log.Println("WebSocket upgrade failed:", err, c.RemoteAddr())
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	select {
+	case this.connC <- wsAccepted{wsc, nil}:
+	case <-this.stopC:
+		wsc.Close()
+	}
+}
+
+func (this *wsListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-this.connC:
+		return a.c, a.err
+	case <-this.stopC:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+func (this *wsListener) Close() error {
+	this.closeOnce.Do(func() { close(this.stopC) })
+	return this.Listener.Close()
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsServerHandshake(c net.Conn, path string, trustProxy bool) (*wsConn, error) {
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	reject := func(code int, why string) (*wsConn, error) {
+		fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+		return nil, errors.New(why)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case req.Method != http.MethodGet:
+		return reject(http.StatusMethodNotAllowed, "method "+req.Method)
+	case req.URL.Path != path:
+		return reject(http.StatusNotFound, "path "+req.URL.Path)
+	case !headerHasToken(req.Header, "Connection", "upgrade") ||
+		!headerHasToken(req.Header, "Upgrade", "websocket"):
+		return reject(http.StatusUpgradeRequired, "not upgrade")
+	case req.Header.Get("Sec-WebSocket-Version") != "13" || key == "":
+		return reject(http.StatusBadRequest, "version or key")
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+	resp += "Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n"
+	if headerHasToken(req.Header, "Sec-WebSocket-Protocol", TCP_WS_PROTOCOL) {
+		resp += "Sec-WebSocket-Protocol: " + TCP_WS_PROTOCOL + "\r\n"
+	}
+	if _, err := io.WriteString(c, resp+"\r\n"); err != nil {
+		return nil, err
+	}
+	wsc := &wsConn{Conn: c, br: br}
+	if trustProxy {
+		wsc.remote = wsForwardedAddr(req.Header.Get("X-Forwarded-For"), c.RemoteAddr())
+	}
+	return wsc, nil
+}
+
+// the first of X-Forwarded-For, the client of the proxy
+func wsForwardedAddr(fwd string, addr net.Addr) net.Addr {
+	host := strings.TrimSpace(strings.Split(fwd, ",")[0])
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	port := 0
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		port = ta.Port
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// dial a ws:// or wss:// relay url, by proxy if not nil
+func DialWS(rawurl string, proxy *TCPProxyInfo) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, errors.Errorf("Not a WebSocket url: %s", rawurl)
+	}
+	hostport := u.Host
+	if u.Port() == "" {
+		hostport = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+	}
+	c, err := proxy.Dial(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		c = tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+	}
+	c.SetDeadline(time.Now().Add(TCP_WS_HANDSHAKE_TIMEOUT * time.Second))
+	wsc, err := wsClientHandshake(c, u)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, rawurl)
+	}
+	c.SetDeadline(time.Time{})
+	return wsc, nil
+}
+
+func isWSURL(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+func wsClientHandshake(c net.Conn, u *url.URL) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	path := u.RequestURI()
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n", path, u.Host)
+	req += "Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n"
+	req += "Sec-WebSocket-Protocol: " + TCP_WS_PROTOCOL + "\r\n\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.Errorf("WebSocket upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("Invalid Sec-WebSocket-Accept")
+	}
+	return &wsConn{Conn: c, br: br, client: true}, nil
+}
+
+// binary messages over an upgraded conn. Writes are framed whole and safe
+// for concurrent use, Read by one goroutine.
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool     // mask writes, expect unmasked reads
+	remote net.Addr // of the real client behind a proxy, nil for the socket's
+
+	rdleft  int64 // payload left in current data frame
+	rdmask  [4]byte
+	rdmpos  int
+	masked  bool
+	wmu     sync.Mutex
+	closed  bool // close frame sent, wmu
+	hdrbuf  [14]byte
+	ctrlbuf [WS_MAX_CONTROL_PAYLOAD]byte
+}
+
+func (this *wsConn) RemoteAddr() net.Addr {
+	if this.remote != nil {
+		return this.remote
+	}
+	return this.Conn.RemoteAddr()
+}
+
+func (this *wsConn) Read(b []byte) (int, error) {
+	for this.rdleft == 0 {
+		op, n, err := this.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case WS_OP_BINARY, WS_OP_TEXT, WS_OP_CONTINUATION:
+			this.rdleft = n
+		case WS_OP_PING, WS_OP_PONG, WS_OP_CLOSE:
+			payload := this.ctrlbuf[:n]
+			if _, err := io.ReadFull(this.br, payload); err != nil {
+				return 0, err
+			}
+			this.unmask(payload)
+			if op == WS_OP_PING {
+				this.writeFrame(WS_OP_PONG, payload)
+			} else if op == WS_OP_CLOSE {
+				this.writeFrame(WS_OP_CLOSE, nil)
+				return 0, io.EOF
+			}
+		default:
+			return 0, errors.Errorf("Invalid WebSocket opcode: %d", op)
+		}
+	}
+	if int64(len(b)) > this.rdleft {
+		b = b[:this.rdleft]
+	}
+	rn, err := this.br.Read(b)
+	this.unmask(b[:rn])
+	this.rdleft -= int64(rn)
+	return rn, err
+}
+
+func (this *wsConn) readHeader() (op byte, n int64, err error) {
+	hdr := this.hdrbuf[:2]
+	if _, err = io.ReadFull(this.br, hdr); err != nil {
+		return
+	}
+	fin, op := hdr[0]&0x80 != 0, hdr[0]&0x0F
+	this.masked = hdr[1]&0x80 != 0
+	if this.masked == this.client {
+		return 0, 0, errors.New("WebSocket frame mask invalid")
+	}
+	n = int64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		if _, err = io.ReadFull(this.br, hdr); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint16(hdr))
+	case 127:
+		ext := this.hdrbuf[:8]
+		if _, err = io.ReadFull(this.br, ext); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint64(ext))
+	}
+	if op >= WS_OP_CLOSE && (n > WS_MAX_CONTROL_PAYLOAD || !fin) {
+		return 0, 0, errors.Errorf("Invalid WebSocket control frame: %d", n)
+	}
+	if n > WS_MAX_PAYLOAD || n < 0 {
+		return 0, 0, errors.Errorf("WebSocket frame too big: %d", n)
+	}
+	if this.masked {
+		if _, err = io.ReadFull(this.br, this.rdmask[:]); err != nil {
+			return
+		}
+		this.rdmpos = 0
+	}
+	return
+}
+
+func (this *wsConn) unmask(b []byte) {
+	if !this.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= this.rdmask[this.rdmpos&3]
+		this.rdmpos++
+	}
+}
+
+func (this *wsConn) Write(b []byte) (int, error) {
+	if err := this.writeFrame(WS_OP_BINARY, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (this *wsConn) writeFrame(op byte, payload []byte) error {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+	if this.closed {
+		return errors.New("WebSocket closed")
+	}
+	if op == WS_OP_CLOSE {
+		this.closed = true
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+	mbit := byte(0)
+	if this.client {
+		mbit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, mbit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, mbit|126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(append(frame, mbit|127), ext[:]...)
+	}
+	if !this.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, c := range payload {
+			frame = append(frame, c^mask[i&3])
+		}
+	}
+	_, err := this.Conn.Write(frame)
+	return err
+}
+
+// close frame best effort, then the socket
+func (this *wsConn) Close() error {
+	this.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	this.writeFrame(WS_OP_CLOSE, nil)
+	return this.Conn.Close()
+}
@@ -0,0 +1,190 @@
+package mintox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSRelay(t *testing.T) {
+	rawl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultTCPServerConfig()
+	_, cfg.Seckey, _ = NewCBKeyPair()
+	srvo, err := NewTCPServerWithListenersConfig([]net.Listener{rawl, NewWSListener(wsl, "/tox", false)}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvo.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer srvo.Shutdown(ctx)
+
+	addrs := []string{"ws://" + wsl.Addr().String() + "/tox", rawl.Addr().String()}
+	clis := make([]*TCPClient, 2)
+	for i := range clis {
+		pk, sk, _ := NewCBKeyPair()
+		clis[i] = NewTCPClient(addrs[i], srvo.Pubkey, pk, sk)
+		defer clis[i].Close()
+		if !waitTstCond(3*time.Second, func() bool { return clis[i].Status == TCP_CLIENT_CONFIRMED }) {
+			t.Fatal("client not confirmed:", addrs[i])
+		}
+	}
+	dataC := make(chan []byte, 16)
+	clis[0].OnData = func(pk *CryptoKey, data []byte) { dataC <- data }
+	for i, cli := range clis {
+		cli.AddPeer(clis[1-i].SelfPubkey)
+	}
+	big := strings.Repeat("x", 1000) // 2 byte ws length
+	got := false
+	for btime := time.Now(); !got && time.Since(btime) < 5*time.Second; {
+		clis[1].SendData(clis[0].SelfPubkey, []byte(big))
+		select {
+		case data := <-dataC:
+			got = string(data) == big
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if !got {
+		t.Fatal("data not routed to ws client")
+	}
+	if st, ok := srvo.ConnStats(clis[0].SelfPubkey); !ok || st.Addr.String() != clis[0].conn.LocalAddr().String() {
+		t.Error("ws conn addr:", st.Addr)
+	}
+}
+
+func TestWSUpgradeRejected(t *testing.T) {
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsl := NewWSListener(lsner, "", true)
+	defer wsl.Close()
+	go func() {
+		for {
+			c, err := wsl.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("ok"))
+		}
+	}()
+
+	request := func(req string) string {
+		c, err := net.Dial("tcp", lsner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(3 * time.Second))
+		io.WriteString(c, req)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+	if st := request("GET / HTTP/1.1\r\nHost: x\r\n\r\n"); !strings.HasPrefix(st, "426") {
+		t.Error("plain http:", st)
+	}
+	if st := request("GET /other HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"); !strings.HasPrefix(st, "404") {
+		t.Error("wrong path:", st)
+	}
+
+	// behind a proxy
+	c, err := net.Dial("tcp", lsner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: x\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nX-Forwarded-For: 10.1.2.3, 127.0.0.1\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("upgrade:", resp.Status, resp.Header)
+	}
+	wsc := &wsConn{Conn: c, br: br, client: true}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(wsc, buf); err != nil || string(buf) != "ok" {
+		t.Fatal("ws read:", err, string(buf))
+	}
+}
+
+// loopback pair, kernel buffers so pong replies never block reads
+func newTstWSPair(t *testing.T) (srv, cli *wsConn) {
+	lsner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsner.Close()
+	c1, err := net.Dial("tcp", lsner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c0, err := lsner.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c0.SetDeadline(time.Now().Add(5 * time.Second))
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	return &wsConn{Conn: c0, br: bufio.NewReader(c0)}, &wsConn{Conn: c1, br: bufio.NewReader(c1), client: true}
+}
+
+func TestWSConnFrames(t *testing.T) {
+	srv, cli := newTstWSPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	cli.writeFrame(WS_OP_PING, []byte("hi"))
+	cli.Write([]byte("hello"))
+	big := make([]byte, WS_MAX_PAYLOAD)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	go cli.Write(big)
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(srv, buf); err != nil || string(buf) != "hel" {
+		t.Fatal("read:", err, string(buf))
+	}
+	rest := make([]byte, 2+len(big))
+	if _, err := io.ReadFull(srv, rest); err != nil || string(rest[:2]) != "lo" {
+		t.Fatal("read across frames:", err)
+	}
+	if !bytes.Equal(rest[2:], big) {
+		t.Fatal("masked payload corrupted")
+	}
+
+	// pong answered to ping is skipped by client, close gives EOF
+	srv.Close()
+	if _, err := cli.Read(buf); err != io.EOF {
+		t.Error("read after close:", err)
+	}
+}
+
+func TestWSConnUnmasked(t *testing.T) {
+	srv, cli := newTstWSPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	// client frames must be masked
+	cli.Conn.Write([]byte{0x80 | WS_OP_BINARY, 1, 'x'})
+	if _, err := srv.Read(make([]byte, 1)); err == nil {
+		t.Error("unmasked client frame accepted")
+	}
+}
@@ -0,0 +1,68 @@
+package mintox
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Tox ID, the address others add us by: pubkey | nospam | checksum.
+// Formatted as 76 uppercase hex chars like toxcore clients.
+type ToxID [FRIEND_ADDRESS_SIZE]byte
+
+func NewToxID(pubkey *CryptoKey, nospam uint32) ToxID {
+	var id ToxID
+	copy(id[:], pubkey.Bytes())
+	binary.BigEndian.PutUint32(id[PUBLIC_KEY_SIZE:], nospam)
+	sum := addressChecksum(id[:PUBLIC_KEY_SIZE+4])
+	copy(id[PUBLIC_KEY_SIZE+4:], sum[:])
+	return id
+}
+
+// checksum verified
+func ToxIDFromBytes(b []byte) (ToxID, error) {
+	var id ToxID
+	if len(b) != FRIEND_ADDRESS_SIZE {
+		return id, errors.Errorf("Invalid address length: %d", len(b))
+	}
+	copy(id[:], b)
+	return id, id.Validate()
+}
+
+// hex case insensitive, surrounding spaces ignored, checksum verified
+func ParseToxID(s string) (ToxID, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return ToxID{}, errors.Wrap(err, "Invalid address hex")
+	}
+	return ToxIDFromBytes(b)
+}
+
+// random nospam from crypto source, like random_u32
+func RandomNospam() uint32 { return binary.BigEndian.Uint32(CBRandomBytes(4)) }
+
+func (this ToxID) String() string { return strings.ToUpper(hex.EncodeToString(this[:])) }
+func (this ToxID) Bytes() []byte  { return append([]byte{}, this[:]...) }
+
+func (this ToxID) Pubkey() *CryptoKey { return NewCryptoKey(this[:PUBLIC_KEY_SIZE]) }
+func (this ToxID) Nospam() uint32     { return binary.BigEndian.Uint32(this[PUBLIC_KEY_SIZE:]) }
+func (this ToxID) Checksum() uint16   { return binary.BigEndian.Uint16(this[PUBLIC_KEY_SIZE+4:]) }
+
+func (this ToxID) Validate() error {
+	sum := addressChecksum(this[:PUBLIC_KEY_SIZE+4])
+	if binary.BigEndian.Uint16(sum[:]) != this.Checksum() {
+		return errors.New("Invalid address checksum")
+	}
+	return nil
+}
+
+// same pubkey with new nospam, requests to the old one are dropped by us
+func (this ToxID) WithNospam(nospam uint32) ToxID { return NewToxID(this.Pubkey(), nospam) }
+
+func (this ToxID) MarshalText() ([]byte, error) { return []byte(this.String()), nil }
+func (this *ToxID) UnmarshalText(text []byte) (err error) {
+	*this, err = ParseToxID(string(text))
+	return
+}
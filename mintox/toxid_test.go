@@ -0,0 +1,68 @@
+package mintox
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestToxID(t *testing.T) {
+	pk, _, _ := NewCBKeyPair()
+	id := NewToxID(pk, 0x01020304)
+	if !id.Pubkey().Equal2(pk) || id.Nospam() != 0x01020304 || id.Validate() != nil {
+		t.Fatal("tox id:", id)
+	}
+	sum := addressChecksum(id[:PUBLIC_KEY_SIZE+4])
+	if id.Checksum() != uint16(sum[0])<<8|uint16(sum[1]) {
+		t.Error("checksum:", id.Checksum())
+	}
+
+	s := id.String()
+	if len(s) != FRIEND_ADDRESS_SIZE*2 || s != strings.ToUpper(s) || !strings.HasPrefix(s, pk.ToHex()) {
+		t.Error("format:", s)
+	}
+	if id2, err := ParseToxID(" " + strings.ToLower(s) + "\n"); err != nil || id2 != id {
+		t.Error("parse:", id2, err)
+	}
+	if id2, err := ToxIDFromBytes(id.Bytes()); err != nil || id2 != id {
+		t.Error("from bytes:", id2, err)
+	}
+
+	bad := id
+	bad[0] ^= 1
+	for _, s := range []string{bad.String(), s[:len(s)-2], s + "00", "zz" + s[2:], ""} {
+		if _, err := ParseToxID(s); err == nil {
+			t.Error("invalid tox id parsed:", s)
+		}
+	}
+
+	id2 := id.WithNospam(0xAABBCCDD)
+	if id2.Nospam() != 0xAABBCCDD || !id2.Pubkey().Equal2(pk) || id2.Validate() != nil || id2 == id {
+		t.Error("with nospam:", id2)
+	}
+
+	data, err := json.Marshal(map[string]ToxID{"id": id})
+	if err != nil || string(data) != `{"id":"`+s+`"}` {
+		t.Fatal("marshal:", string(data), err)
+	}
+	var m map[string]ToxID
+	if err := json.Unmarshal(data, &m); err != nil || m["id"] != id {
+		t.Error("unmarshal:", m, err)
+	}
+	if json.Unmarshal([]byte(`{"id":"`+bad.String()+`"}`), &m) == nil {
+		t.Error("bad checksum unmarshaled")
+	}
+}
+
+func TestMessengerRotateNospam(t *testing.T) {
+	m := newTstMessenger(defaultClock)
+	defer m.tstKill()
+	old := m.ToxID()
+	if old != NewToxID(m.SelfPubkey, m.Nospam()) {
+		t.Error("messenger tox id:", old)
+	}
+	id := m.RotateNospam()
+	if id == old || id.Nospam() != m.Nospam() || !id.Pubkey().Equal2(m.SelfPubkey) || string(m.Address()) != string(id[:]) {
+		t.Error("nospam not rotated:", old, id)
+	}
+}
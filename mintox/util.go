@@ -1,7 +1,10 @@
 package mintox
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -20,3 +23,25 @@ type NetAddr struct {
 	Addrs string
 	Addro net.Addr
 }
+
+// write to a temp file then rename, never left half written
+func writeFileAtomic(filename string, data []byte) error {
+	tmpfp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfp.Write(data)
+	if err == nil {
+		err = tmpfp.Sync()
+	}
+	if cerr := tmpfp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmpfp.Name())
+	}
+	return err
+}